@@ -0,0 +1,387 @@
+package rdns
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/challenge/http01"
+	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/go-acme/lego/v4/registration"
+	"github.com/sirupsen/logrus"
+)
+
+// ACME challenge types supported by ACMEClient.
+const (
+	ACMEChallengeTLSALPN = "tls-alpn-01"
+	ACMEChallengeHTTP    = "http-01"
+)
+
+// Issuer of the self-signed certificate that's used until the first certificate
+// is obtained from the CA.
+const acmePlaceholderIssuer = "routedns acme placeholder"
+
+// ACMEClient obtains and renews a certificate from an ACME CA such as Let's Encrypt
+// and stores it in files. Unlike standalone challenge servers, TLS-ALPN-01 challenges
+// are answered by the TLS listeners that serve the certificate, so the certificate can
+// be renewed on the same port a DoH or DoT listener is using. HTTP-01 challenges are
+// answered by a temporary HTTP server, on port 80 by default.
+type ACMEClient struct {
+	id         string
+	opt        ACMEOptions
+	files      CertificateFiles
+	accountKey crypto.PrivateKey
+
+	mu     sync.Mutex // Serializes renewals
+	client *lego.Client
+	reg    *registration.Resource
+	certs  []*TLSCertificates
+
+	challenges sync.Map // Domain -> *tls.Certificate for TLS-ALPN-01 challenges
+}
+
+// ACMEOptions contain the settings of an ACME client.
+type ACMEOptions struct {
+	// Names the certificate is valid for.
+	Domains []string
+
+	// Account email address, optional.
+	Email string
+
+	// Challenge type, ACMEChallengeTLSALPN or ACMEChallengeHTTP.
+	Challenge string
+
+	// ACME directory URL. Defaults to Let's Encrypt.
+	DirectoryURL string
+
+	// Directory to store the account key and certificates in.
+	StorageDir string
+
+	// Listen address of the HTTP server answering HTTP-01 challenges. Defaults to ":80".
+	HTTPAddress string
+
+	// Renew the certificate once it expires within this time. Defaults to 30 days.
+	RenewBefore time.Duration
+}
+
+var _ registration.User = &ACMEClient{}
+
+// NewACMEClient returns a new ACME client. No requests are sent to the CA until
+// Renew is called. If there's no certificate yet, a self-signed one is created so
+// listeners can be started before the first certificate is obtained.
+func NewACMEClient(id string, opt ACMEOptions) (*ACMEClient, error) {
+	if len(opt.Domains) == 0 {
+		return nil, errors.New("no domains for acme certificate")
+	}
+	switch opt.Challenge {
+	case ACMEChallengeTLSALPN, ACMEChallengeHTTP:
+	default:
+		return nil, fmt.Errorf("unsupported acme challenge '%s'", opt.Challenge)
+	}
+	if opt.DirectoryURL == "" {
+		opt.DirectoryURL = lego.LEDirectoryProduction
+	}
+	if opt.HTTPAddress == "" {
+		opt.HTTPAddress = ":80"
+	}
+	if opt.RenewBefore == 0 {
+		opt.RenewBefore = 30 * 24 * time.Hour
+	}
+	name := strings.ReplaceAll(opt.Domains[0], "*", "_")
+	dir := filepath.Join(opt.StorageDir, "certificates")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	a := &ACMEClient{
+		id:  id,
+		opt: opt,
+		files: CertificateFiles{
+			CertFile: filepath.Join(dir, name+".crt"),
+			KeyFile:  filepath.Join(dir, name+".key"),
+		},
+	}
+	accountKey, err := loadOrCreateKey(filepath.Join(opt.StorageDir, "accounts", accountName(opt.Email)+".key"))
+	if err != nil {
+		return nil, err
+	}
+	a.accountKey = accountKey
+
+	if _, err := os.Stat(a.files.CertFile); errors.Is(err, os.ErrNotExist) {
+		if err := a.writePlaceholder(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// CertificateFiles returns the files the certificate and key are stored in.
+func (a *ACMEClient) CertificateFiles() CertificateFiles {
+	return a.files
+}
+
+// AddCertificates registers certificates that are reloaded after the certificate
+// was renewed.
+func (a *ACMEClient) AddCertificates(certs *TLSCertificates) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.certs = append(a.certs, certs)
+}
+
+// ConfigureTLS sets up a TLS server config to answer TLS-ALPN-01 challenges.
+// Connections that don't request the acme-tls/1 protocol are not affected.
+func (a *ACMEClient) ConfigureTLS(tlsConfig *tls.Config) {
+	if a.opt.Challenge != ACMEChallengeTLSALPN {
+		return
+	}
+	tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if !slices.Contains(hello.SupportedProtos, tlsalpn01.ACMETLS1Protocol) {
+			return nil, nil
+		}
+		cert, ok := a.challenges.Load(strings.ToLower(hello.ServerName))
+		if !ok {
+			return nil, fmt.Errorf("no acme challenge for '%s'", hello.ServerName)
+		}
+		return &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{*cert.(*tls.Certificate)},
+			NextProtos:   []string{tlsalpn01.ACMETLS1Protocol},
+		}, nil
+	}
+}
+
+// Renew obtains a new certificate if there is none yet or if the current one
+// expires soon. Certificates registered with AddCertificates are reloaded after
+// a new certificate was stored.
+func (a *ACMEClient) Renew() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	log := Log.WithFields(logrus.Fields{"id": a.id, "domains": a.opt.Domains})
+	if !a.needsRenewal() {
+		log.Debug("acme certificate is up to date")
+		return nil
+	}
+	log.Info("requesting acme certificate")
+	if err := a.setup(); err != nil {
+		return err
+	}
+	res, err := a.client.Certificate.Obtain(certificate.ObtainRequest{
+		Domains: a.opt.Domains,
+		Bundle:  true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to obtain acme certificate for %v: %w", a.opt.Domains, err)
+	}
+	if err := writeFileAtomic(a.files.KeyFile, res.PrivateKey); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(a.files.CertFile, res.Certificate); err != nil {
+		return err
+	}
+	log.Info("stored new acme certificate")
+	for _, certs := range a.certs {
+		if err := certs.Reload(); err != nil {
+			log.WithError(err).Error("failed to reload certificates")
+		}
+	}
+	return nil
+}
+
+// Returns true if the stored certificate is missing, self-signed, or expires soon.
+func (a *ACMEClient) needsRenewal() bool {
+	b, err := os.ReadFile(a.files.CertFile)
+	if err != nil {
+		return true
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return true
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return true
+	}
+	if cert.Issuer.CommonName == acmePlaceholderIssuer {
+		return true
+	}
+	return time.Until(cert.NotAfter) < a.opt.RenewBefore
+}
+
+// Builds the lego client and registers the account with the CA if needed.
+func (a *ACMEClient) setup() error {
+	if a.client == nil {
+		config := lego.NewConfig(a)
+		config.CADirURL = a.opt.DirectoryURL
+		config.Certificate.KeyType = certcrypto.EC256
+		client, err := lego.NewClient(config)
+		if err != nil {
+			return err
+		}
+		switch a.opt.Challenge {
+		case ACMEChallengeTLSALPN:
+			err = client.Challenge.SetTLSALPN01Provider(acmeTLSALPNProvider{a})
+		case ACMEChallengeHTTP:
+			var host, port string
+			host, port, err = net.SplitHostPort(a.opt.HTTPAddress)
+			if err == nil {
+				err = client.Challenge.SetHTTP01Provider(http01.NewProviderServer(host, port))
+			}
+		}
+		if err != nil {
+			return err
+		}
+		a.client = client
+	}
+	if a.reg == nil {
+		reg, err := a.client.Registration.ResolveAccountByKey()
+		if err != nil {
+			reg, err = a.client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+			if err != nil {
+				return fmt.Errorf("failed to register acme account: %w", err)
+			}
+		}
+		a.reg = reg
+	}
+	return nil
+}
+
+// Writes a self-signed certificate valid for the domains.
+func (a *ACMEClient) writePlaceholder() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: acmePlaceholderIssuer},
+		DNSNames:     a.opt.Domains,
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(a.files.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})); err != nil {
+		return err
+	}
+	return writeFileAtomic(a.files.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+// GetEmail implements registration.User.
+func (a *ACMEClient) GetEmail() string {
+	return a.opt.Email
+}
+
+// GetRegistration implements registration.User.
+func (a *ACMEClient) GetRegistration() *registration.Resource {
+	return a.reg
+}
+
+// GetPrivateKey implements registration.User.
+func (a *ACMEClient) GetPrivateKey() crypto.PrivateKey {
+	return a.accountKey
+}
+
+func (a *ACMEClient) String() string {
+	return a.id
+}
+
+// Makes the certificates for TLS-ALPN-01 challenges available to listeners
+// configured with ACMEClient.ConfigureTLS.
+type acmeTLSALPNProvider struct {
+	a *ACMEClient
+}
+
+func (p acmeTLSALPNProvider) Present(domain, token, keyAuth string) error {
+	cert, err := tlsalpn01.ChallengeCert(domain, keyAuth)
+	if err != nil {
+		return err
+	}
+	p.a.challenges.Store(strings.ToLower(domain), cert)
+	return nil
+}
+
+func (p acmeTLSALPNProvider) CleanUp(domain, token, keyAuth string) error {
+	p.a.challenges.Delete(strings.ToLower(domain))
+	return nil
+}
+
+func accountName(email string) string {
+	if email == "" {
+		return "default"
+	}
+	return email
+}
+
+// Loads a PEM-encoded EC private key from a file, or creates one if the file
+// doesn't exist.
+func loadOrCreateKey(filename string) (crypto.PrivateKey, error) {
+	b, err := os.ReadFile(filename)
+	if err == nil {
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return nil, fmt.Errorf("no key found in %s", filename)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0o700); err != nil {
+		return nil, err
+	}
+	return key, writeFileAtomic(filename, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+}
+
+// Writes a file by writing to a temporary file first and renaming it, so readers
+// never see a partially written file.
+func writeFileAtomic(filename string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0o600); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
@@ -0,0 +1,81 @@
+package rdns
+
+import (
+	"crypto/tls"
+	"encoding/asn1"
+	"net"
+	"testing"
+
+	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
+	"github.com/stretchr/testify/require"
+)
+
+func TestACMEClientTLSALPN(t *testing.T) {
+	a, err := NewACMEClient("test", ACMEOptions{
+		Domains:    []string{"dns.example.com"},
+		Challenge:  ACMEChallengeTLSALPN,
+		StorageDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	// Until a certificate is obtained, there's a self-signed placeholder
+	require.True(t, a.needsRenewal())
+	certs, err := NewTLSCertificates("test", []CertificateFiles{a.CertificateFiles()}, false)
+	require.NoError(t, err)
+	tlsConfig := &tls.Config{GetCertificate: certs.GetCertificate}
+	a.ConfigureTLS(tlsConfig)
+
+	// Present a challenge like lego does before asking the CA to validate it
+	provider := acmeTLSALPNProvider{a}
+	require.NoError(t, provider.Present("dns.example.com", "token", "keyauth"))
+
+	// Connections using the acme-tls/1 protocol get the challenge certificate
+	state := testTLSHandshake(t, tlsConfig, &tls.Config{
+		ServerName:         "dns.example.com",
+		NextProtos:         []string{tlsalpn01.ACMETLS1Protocol},
+		InsecureSkipVerify: true,
+	})
+	require.Equal(t, tlsalpn01.ACMETLS1Protocol, state.NegotiatedProtocol)
+	// The challenge certificate carries the acmeIdentifier extension
+	var hasACMEIdentifier bool
+	for _, ext := range state.PeerCertificates[0].Extensions {
+		hasACMEIdentifier = hasACMEIdentifier || ext.Id.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31})
+	}
+	require.True(t, hasACMEIdentifier)
+
+	// Everything else gets the regular certificate
+	state = testTLSHandshake(t, tlsConfig, &tls.Config{
+		ServerName:         "dns.example.com",
+		NextProtos:         []string{"dot"},
+		InsecureSkipVerify: true,
+	})
+	require.Equal(t, acmePlaceholderIssuer, state.PeerCertificates[0].Issuer.CommonName)
+
+	// Once cleaned up, challenge connections fail
+	require.NoError(t, provider.CleanUp("dns.example.com", "token", "keyauth"))
+	client := tls.Client(testTLSConn(t, tlsConfig), &tls.Config{
+		ServerName:         "dns.example.com",
+		NextProtos:         []string{tlsalpn01.ACMETLS1Protocol},
+		InsecureSkipVerify: true,
+	})
+	require.Error(t, client.Handshake())
+}
+
+// Performs a TLS handshake with a server using the given configs and returns
+// the connection state of the client.
+func testTLSHandshake(t *testing.T, serverConfig, clientConfig *tls.Config) tls.ConnectionState {
+	client := tls.Client(testTLSConn(t, serverConfig), clientConfig)
+	require.NoError(t, client.Handshake())
+	return client.ConnectionState()
+}
+
+// Returns the client end of a connection to a TLS server.
+func testTLSConn(t *testing.T, serverConfig *tls.Config) net.Conn {
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() { clientConn.Close() })
+	go func() {
+		tls.Server(serverConn, serverConfig).Handshake()
+		serverConn.Close()
+	}()
+	return clientConn
+}
@@ -0,0 +1,132 @@
+package rdns
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// HealthCheckOptions contains options for the readiness check of admin
+// listeners, which sends a test query through resolvers.
+type HealthCheckOptions struct {
+	// Resolvers, groups or routers to send the test query through. The
+	// instance is ready if all of them answer. Without resolvers, the
+	// instance is always ready.
+	Resolvers []Resolver
+
+	// Name and type of the test query. Defaults to the NS records of the root.
+	Query string
+	Type  uint16
+
+	// Time to wait for an answer, default 2 seconds.
+	Timeout time.Duration
+}
+
+// Result of the test query through one resolver.
+type healthCheckResult struct {
+	Resolver string `json:"resolver"`
+	Healthy  bool   `json:"healthy"`
+	Rcode    string `json:"rcode,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Duration int64  `json:"duration-ms"`
+}
+
+// Serves the /healthz and /readyz endpoints of admin listeners. Liveness only
+// depends on the process serving requests, readiness on test queries making
+// it through the configured resolvers and upstreams.
+type healthHandler struct {
+	opt HealthCheckOptions
+}
+
+func newHealthHandler(opt HealthCheckOptions) *healthHandler {
+	if opt.Query == "" {
+		opt.Query = "."
+		if opt.Type == 0 {
+			opt.Type = dns.TypeNS
+		}
+	}
+	if opt.Type == 0 {
+		opt.Type = dns.TypeA
+	}
+	if opt.Timeout == 0 {
+		opt.Timeout = defaultQueryTimeout
+	}
+	opt.Query = dns.Fqdn(opt.Query)
+	return &healthHandler{opt: opt}
+}
+
+// Responds to liveness probes.
+func (h *healthHandler) live(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"live": true})
+}
+
+// Responds to readiness probes with the results of test queries, with status
+// 503 if any of them failed.
+func (h *healthHandler) ready(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	results := h.check()
+	ready := true
+	for _, res := range results {
+		ready = ready && res.Healthy
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(struct {
+		Ready  bool                `json:"ready"`
+		Checks []healthCheckResult `json:"checks"`
+	}{ready, results})
+}
+
+// Sends the test query through all resolvers concurrently.
+func (h *healthHandler) check() []healthCheckResult {
+	results := make([]healthCheckResult, len(h.opt.Resolvers))
+	var wg sync.WaitGroup
+	for i, resolver := range h.opt.Resolvers {
+		wg.Add(1)
+		go func(i int, resolver Resolver) {
+			defer wg.Done()
+			results[i] = h.checkResolver(resolver)
+		}(i, resolver)
+	}
+	wg.Wait()
+	return results
+}
+
+// Sends the test query through a resolver. Any response other than SERVFAIL
+// or REFUSED means the resolver and its upstreams are working.
+func (h *healthHandler) checkResolver(resolver Resolver) healthCheckResult {
+	q := new(dns.Msg)
+	q.SetQuestion(h.opt.Query, h.opt.Type)
+	ci := ClientInfo{}.WithTimeout(h.opt.Timeout)
+
+	start := time.Now()
+	a, err := resolver.Resolve(q, ci)
+	res := healthCheckResult{
+		Resolver: resolver.String(),
+		Duration: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	if a == nil {
+		res.Error = "query dropped"
+		return res
+	}
+	res.Rcode = dns.RcodeToString[a.Rcode]
+	res.Healthy = a.Rcode != dns.RcodeServerFailure && a.Rcode != dns.RcodeRefused
+	return res
+}
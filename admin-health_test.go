@@ -0,0 +1,66 @@
+package rdns
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthHandler(t *testing.T) {
+	var query *dns.Msg
+	healthy := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			query = q
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+	failing := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			return nil, errors.New("upstream down")
+		},
+	}
+
+	// Liveness doesn't depend on the resolvers
+	h := newHealthHandler(HealthCheckOptions{Resolvers: []Resolver{healthy, failing}})
+	w := httptest.NewRecorder()
+	h.live(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// Not ready if one of the resolvers fails
+	w = httptest.NewRecorder()
+	h.ready(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	var res struct {
+		Ready  bool
+		Checks []healthCheckResult
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+	require.False(t, res.Ready)
+	require.Len(t, res.Checks, 2)
+	require.True(t, res.Checks[0].Healthy)
+	require.Equal(t, "NOERROR", res.Checks[0].Rcode)
+	require.False(t, res.Checks[1].Healthy)
+	require.Equal(t, "upstream down", res.Checks[1].Error)
+
+	// Ready when all resolvers answer
+	h = newHealthHandler(HealthCheckOptions{Resolvers: []Resolver{healthy}})
+	w = httptest.NewRecorder()
+	h.ready(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// Test query defaults to the root NS records
+	require.Equal(t, 2, healthy.HitCount())
+	require.Equal(t, ".", query.Question[0].Name)
+	require.Equal(t, dns.TypeNS, query.Question[0].Qtype)
+
+	w = httptest.NewRecorder()
+	h.ready(w, httptest.NewRequest(http.MethodPost, "/readyz", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
@@ -0,0 +1,32 @@
+package rdns
+
+import (
+	"net/http"
+	"sync"
+)
+
+// Handlers that elements register to be served by admin listeners, by URL path.
+var (
+	adminHandlers   = make(map[string]http.Handler)
+	adminHandlersMu sync.Mutex
+)
+
+// Registers a handler to be served by all admin listeners created afterwards.
+func registerAdminHandler(pattern string, h http.Handler) {
+	adminHandlersMu.Lock()
+	adminHandlers[pattern] = h
+	adminHandlersMu.Unlock()
+}
+
+// ResetAdminHandlers removes the handlers registered so far, along with the
+// lists shown on the admin listener. Called before loading a new config so
+// admin listeners don't serve the elements of a previous one.
+func ResetAdminHandlers() {
+	adminHandlersMu.Lock()
+	adminHandlers = make(map[string]http.Handler)
+	adminHandlersMu.Unlock()
+
+	listMonitorsMu.Lock()
+	listMonitors = nil
+	listMonitorsMu.Unlock()
+}
@@ -0,0 +1,27 @@
+package rdns
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResetAdminHandlers(t *testing.T) {
+	registerAdminHandler("/routedns/test/reset", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	get := func() int {
+		l, err := NewAdminListener("test-admin", "127.0.0.1:0", AdminListenerOptions{})
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		l.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/routedns/test/reset", nil))
+		return w.Code
+	}
+	require.Equal(t, http.StatusNoContent, get())
+
+	// Listeners created after a reset don't serve the handlers of before
+	ResetAdminHandlers()
+	require.Equal(t, http.StatusNotFound, get())
+}
@@ -5,8 +5,6 @@ import (
 	"crypto/tls"
 	"expvar"
 	"fmt"
-	"log"
-	"net"
 	"net/http"
 	"time"
 
@@ -30,6 +28,9 @@ type AdminListener struct {
 	Lego *mylego.CertConfig
 	MutualTLS bool
 
+	// Certificates served by the listener, reloaded by CertMonitor
+	Certificates *TLSCertificates
+
 	mux *http.ServeMux
 }
 
@@ -40,44 +41,23 @@ type AdminListenerOptions struct {
 	ListenOptions
 
 	// Transport protocol to run HTTPS over. "quic" or "tcp", defaults to "tcp".
+	// With "unix", plain HTTP is served on a unix domain socket at the path
+	// given as address.
 	Transport string
 
 	TLSConfig *tls.Config
+
+	// Readiness check served on /readyz
+	Health HealthCheckOptions
+
+	// Only serve the metrics and admin endpoints of the elements of this
+	// tenant. Serves those of all elements if empty.
+	Tenant string
 }
 
 // Check Cert
 func (s *AdminListener) CertMonitor() error {
-	switch s.Lego.CertMode {
-	case "dns", "http", "tls":
-		lego, err := mylego.New(s.Lego)
-		if err != nil {
-			log.Print(err)
-		}
-		// Xray-core supports the OcspStapling certification hot renew
-		_, _, _, _, err = lego.RenewCert()
-		if err != nil {
-			log.Print(err)
-		}
-		cert, key, ca, err := GetCertFile(s.Lego)
-		if err != nil {
-			fmt.Print(err)
-		}
-	
-		tlsConfig, err := TLSServerConfig(ca, cert, key, s.MutualTLS)
-		if err != nil {
-			return err
-		}		
-		s.opt.TLSConfig = tlsConfig
-		err = s.Stop()
-		if err != nil {
-			fmt.Printf("failed to stop DTLS listener %s, err: %s", s.id,err)
-		}
-		err = s.Start()
-		if err != nil {
-			fmt.Printf("failed to start DTLS listener %s, err: %s", s.id,err)
-		}
-	}
-	return nil
+	return renewCertificates(s.Lego, s.Certificates)
 }
 
 // NewAdminListener returns an instance of an admin service listener.
@@ -85,8 +65,7 @@ func NewAdminListener(id, addr string, opt AdminListenerOptions) (*AdminListener
 	switch opt.Transport {
 	case "tcp", "":
 		opt.Transport = "tcp"
-	case "quic":
-		opt.Transport = "quic"
+	case "quic", "unix":
 	default:
 		return nil, fmt.Errorf("unknown protocol: '%s'", opt.Transport)
 	}
@@ -98,15 +77,37 @@ func NewAdminListener(id, addr string, opt AdminListenerOptions) (*AdminListener
 		mux:  http.NewServeMux(),
 	}
 	// Serve metrics.
-	l.mux.Handle("/routedns/vars", expvar.Handler())
+	if opt.Tenant != "" {
+		l.mux.Handle("/routedns/vars", tenantVarsHandler(opt.Tenant))
+	} else {
+		l.mux.Handle("/routedns/vars", expvar.Handler())
+	}
+
+	// Serve liveness and readiness probes.
+	health := newHealthHandler(opt.Health)
+	l.mux.HandleFunc("/healthz", health.live)
+	l.mux.HandleFunc("/readyz", health.ready)
+
+	// Serve endpoints registered by other elements
+	adminHandlersMu.Lock()
+	for pattern, h := range adminHandlers {
+		if opt.Tenant != "" && !tenantAdminPattern(opt.Tenant, pattern) {
+			continue
+		}
+		l.mux.Handle(pattern, h)
+	}
+	adminHandlersMu.Unlock()
 	return l, nil
 }
 
 // Start the admin server.
 func (s *AdminListener) Start() error {
 	Log.WithFields(logrus.Fields{"id": s.id, "protocol": s.opt.Transport, "addr": s.addr}).Info("starting listener")
-	if s.opt.Transport == "quic" {
+	switch s.opt.Transport {
+	case "quic":
 		return s.startQUIC()
+	case "unix":
+		return s.startUnix()
 	}
 	return s.startTCP()
 }
@@ -121,7 +122,7 @@ func (s *AdminListener) startTCP() error {
 		WriteTimeout: adminServerTimeout,
 	}
 
-	ln, err := net.Listen("tcp", s.addr)
+	ln, err := listenStream("tcp", s.addr, socketOptions{})
 	if err != nil {
 		return err
 	}
@@ -129,6 +130,22 @@ func (s *AdminListener) startTCP() error {
 	return s.httpServer.ServeTLS(ln, "", "")
 }
 
+// Start the admin server on a unix domain socket. Access is controlled by the
+// permissions of the socket file, so there's no TLS.
+func (s *AdminListener) startUnix() error {
+	s.httpServer = &http.Server{
+		Handler:      s.mux,
+		ReadTimeout:  adminServerTimeout,
+		WriteTimeout: adminServerTimeout,
+	}
+	ln, _, err := listenUnix("unix", s.addr, socketOptions{socketMode: s.opt.SocketMode, socketGroup: s.opt.SocketGroup})
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	return s.httpServer.Serve(ln)
+}
+
 // Start the admin server with QUIC transport.
 func (s *AdminListener) startQUIC() error {
 	s.quicServer = &http3.Server{
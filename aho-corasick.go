@@ -0,0 +1,136 @@
+package rdns
+
+import "sort"
+
+// Aho-Corasick automaton to find all occurrences of a set of literal strings in
+// a text in a single pass. Each string carries a value that is reported when the
+// string is found. States and transitions are stored in flat slices to keep the
+// automaton compact for large numbers of strings.
+type ahoCorasick struct {
+	states []acState
+	edges  []acEdge
+	values []acValue
+}
+
+type acState struct {
+	edges    int32 // Index of the first transition in edges
+	numEdges int32
+	fail     int32 // State to continue with if there's no transition
+	output   int32 // Nearest state (this or one reached via fail) with values, -1 if none
+	value    int32 // First value of this state in values, -1 if none
+}
+
+type acEdge struct {
+	b    byte
+	next int32
+}
+
+type acValue struct {
+	v    int32
+	next int32 // Next value of the same state, -1 if none
+}
+
+// Builds an automaton for a list of strings. The values are reported when the
+// string with the same index is found. Empty strings are ignored.
+func newAhoCorasick(patterns []string, values []int32) *ahoCorasick {
+	// Build the trie first with map-based transitions, it's flattened once complete
+	children := []map[byte]int32{{}}
+	stateValues := [][]int32{nil}
+	for i, p := range patterns {
+		if p == "" {
+			continue
+		}
+		s := int32(0)
+		for j := 0; j < len(p); j++ {
+			next, ok := children[s][p[j]]
+			if !ok {
+				next = int32(len(children))
+				children = append(children, map[byte]int32{})
+				stateValues = append(stateValues, nil)
+				children[s][p[j]] = next
+			}
+			s = next
+		}
+		stateValues[s] = append(stateValues[s], values[i])
+	}
+
+	ac := &ahoCorasick{states: make([]acState, len(children))}
+	for s, c := range children {
+		state := &ac.states[s]
+		state.edges = int32(len(ac.edges))
+		state.numEdges = int32(len(c))
+		for b, next := range c {
+			ac.edges = append(ac.edges, acEdge{b, next})
+		}
+		edges := ac.edges[state.edges:]
+		sort.Slice(edges, func(i, j int) bool { return edges[i].b < edges[j].b })
+
+		state.value = -1
+		for i := len(stateValues[s]) - 1; i >= 0; i-- {
+			ac.values = append(ac.values, acValue{stateValues[s][i], state.value})
+			state.value = int32(len(ac.values) - 1)
+		}
+	}
+
+	// Set the fail and output links in breadth-first order so they're always
+	// computed for the shorter strings first
+	queue := []int32{0}
+	ac.states[0].output = -1
+	if ac.states[0].value >= 0 {
+		ac.states[0].output = 0
+	}
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+		for _, e := range ac.stateEdges(s) {
+			child := &ac.states[e.next]
+			if s != 0 {
+				child.fail = ac.step(ac.states[s].fail, e.b)
+			}
+			child.output = ac.states[child.fail].output
+			if child.value >= 0 {
+				child.output = e.next
+			}
+			queue = append(queue, e.next)
+		}
+	}
+	return ac
+}
+
+func (ac *ahoCorasick) stateEdges(s int32) []acEdge {
+	state := ac.states[s]
+	return ac.edges[state.edges : state.edges+state.numEdges]
+}
+
+// Returns the state reached from s with the next byte b.
+func (ac *ahoCorasick) step(s int32, b byte) int32 {
+	for {
+		edges := ac.stateEdges(s)
+		i := sort.Search(len(edges), func(i int) bool { return edges[i].b >= b })
+		if i < len(edges) && edges[i].b == b {
+			return edges[i].next
+		}
+		if s == 0 {
+			return 0
+		}
+		s = ac.states[s].fail
+	}
+}
+
+// Appends the values of all strings found in text to res and returns the result.
+// Values may be reported more than once if a string occurs multiple times.
+func (ac *ahoCorasick) find(text string, res []int32) []int32 {
+	s := int32(0)
+	for i := 0; i < len(text); i++ {
+		s = ac.step(s, text[i])
+		for o := ac.states[s].output; o >= 0; o = ac.states[ac.states[o].fail].output {
+			for v := ac.states[o].value; v >= 0; v = ac.values[v].next {
+				res = append(res, ac.values[v].v)
+			}
+			if o == 0 {
+				break
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,68 @@
+package rdns
+
+import (
+	"github.com/miekg/dns"
+)
+
+// Default TTL of the synthesized HINFO record in responses to ANY queries.
+const defaultAnyMinimizeTTL = 3600
+
+// AnyMinimize is a resolver that answers queries for QTYPE=ANY with a single
+// synthesized HINFO record as per rfc8482 rather than forwarding them. This
+// avoids large responses that can be abused for amplification. All other
+// queries are passed to the upstream resolver.
+type AnyMinimize struct {
+	id       string
+	resolver Resolver
+	opt      AnyMinimizeOptions
+}
+
+var _ Resolver = &AnyMinimize{}
+
+// AnyMinimizeOptions contains options for the ANY query minimizer.
+type AnyMinimizeOptions struct {
+	// TTL of the HINFO record, default 3600.
+	TTL uint32
+}
+
+// NewAnyMinimize returns a new instance of an ANY query minimizer.
+func NewAnyMinimize(id string, resolver Resolver, opt AnyMinimizeOptions) *AnyMinimize {
+	if opt.TTL == 0 {
+		opt.TTL = defaultAnyMinimizeTTL
+	}
+	return &AnyMinimize{id: id, resolver: resolver, opt: opt}
+}
+
+// Resolve a DNS query. ANY queries are answered with a HINFO record, everything
+// else is forwarded to the upstream resolver.
+func (r *AnyMinimize) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 || q.Question[0].Qtype != dns.TypeANY {
+		return r.resolver.Resolve(q, ci)
+	}
+	question := q.Question[0]
+	logger(r.id, q, ci).Debug("responding to ANY query with HINFO")
+	a := new(dns.Msg)
+	a.SetReply(q)
+	a.RecursionAvailable = true
+	a.Answer = []dns.RR{
+		&dns.HINFO{
+			Hdr: dns.RR_Header{
+				Name:   question.Name,
+				Rrtype: dns.TypeHINFO,
+				Class:  question.Qclass,
+				Ttl:    r.opt.TTL,
+			},
+			Cpu: "RFC8482",
+		},
+	}
+	return a, nil
+}
+
+func (r *AnyMinimize) String() string {
+	return r.id
+}
+
+// Check Cert
+func (s *AnyMinimize) CertMonitor() error {
+	return nil
+}
@@ -0,0 +1,34 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnyMinimize(t *testing.T) {
+	upstream := new(TestResolver)
+	r := NewAnyMinimize("test-any", upstream, AnyMinimizeOptions{})
+
+	// ANY queries are answered with HINFO without going upstream
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeANY)
+	a, err := r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 0, upstream.HitCount())
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Len(t, a.Answer, 1)
+	hinfo, ok := a.Answer[0].(*dns.HINFO)
+	require.True(t, ok)
+	require.Equal(t, "example.com.", hinfo.Hdr.Name)
+	require.Equal(t, "RFC8482", hinfo.Cpu)
+	require.Equal(t, "", hinfo.Os)
+	require.Equal(t, uint32(3600), hinfo.Hdr.Ttl)
+
+	// Other queries are forwarded
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+}
@@ -2,14 +2,21 @@ package api
 
 import (
 	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	rdns "github.com/folbricht/routedns"
 	"github.com/heimdalr/dag"
+	"github.com/miekg/dns"
 	"github.com/pion/dtls/v2"
 	"github.com/sirupsen/logrus"
 	"github.com/xtls/xray-core/common/task"
@@ -34,20 +41,249 @@ type Manager struct {
 	Tasks     []periodicTask
 }
 
-func GetDTLSServerConfig(l *listener) (*dtls.Config, error) {
-	cert, key, ca, err := rdns.GetCertFile(&l.Lego)
+func GetDTLSServerConfig(id string, l *listener, acme *acmeClients) (*dtls.Config, *rdns.TLSCertificates, error) {
+	certs, _, ca, err := listenerCertificates(id, l, acme)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	dtlsConfig, err := rdns.DTLSServerConfig(ca, "", "", l.MutualTLS)
+	if err != nil {
+		return nil, nil, err
+	}
+	dtlsConfig.GetCertificate = certs.GetDTLSCertificate
+	policy, err := clientCertPolicy(l)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !policy.Empty() {
+		dtlsConfig.VerifyPeerCertificate = policy.VerifyPeerCertificate
 	}
-	return rdns.DTLSServerConfig(ca, cert, key, l.MutualTLS)
+	return dtlsConfig, certs, nil
 }
 
-func GetTLSServerConfig(l *listener) (*tls.Config, error) {
-	cert, key, ca, err := rdns.GetCertFile(&l.Lego)
+func GetTLSServerConfig(id string, l *listener, acme *acmeClients) (*tls.Config, *rdns.TLSCertificates, error) {
+	certs, acmeClient, ca, err := listenerCertificates(id, l, acme)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	tlsConfig, err := rdns.TLSServerConfig(ca, "", "", l.MutualTLS)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig.GetCertificate = certs.GetCertificate
+	if acmeClient != nil {
+		acmeClient.ConfigureTLS(tlsConfig)
+	}
+	opt, err := tlsServerOptions(l)
+	if err != nil {
+		return nil, nil, err
+	}
+	opt.Apply(tlsConfig)
+	policy, err := clientCertPolicy(l)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !policy.Empty() {
+		tlsConfig.VerifyPeerCertificate = policy.VerifyPeerCertificate
+	}
+	return tlsConfig, certs, nil
+}
+
+// Loads the certificates of a listener, the primary one from "cert" followed
+// by any additional ones. Also returns the ACME client if the primary certificate
+// is obtained with the built-in challenge solvers, and the CA file for client
+// certificates.
+func listenerCertificates(id string, l *listener, acme *acmeClients) (*rdns.TLSCertificates, *rdns.ACMEClient, string, error) {
+	var (
+		files      []rdns.CertificateFiles
+		acmeClient *rdns.ACMEClient
+		ca         string
+	)
+	switch l.Lego.CertMode {
+	case "http", "tls":
+		var err error
+		acmeClient, err = acme.get(id, l)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		files = append(files, acmeClient.CertificateFiles())
+		ca = l.Lego.CaFile
+	default:
+		cert, key, caFile, err := rdns.GetCertFile(&l.Lego)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		files = append(files, rdns.CertificateFiles{CertFile: cert, KeyFile: key})
+		ca = caFile
+	}
+	for i := range l.Certs {
+		cert, key, _, err := rdns.GetCertFile(&l.Certs[i])
+		if err != nil {
+			return nil, nil, "", err
+		}
+		files = append(files, rdns.CertificateFiles{CertFile: cert, KeyFile: key})
+	}
+	certs, err := rdns.NewTLSCertificates(id, files, l.Lego.RejectUnknownSni)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if acmeClient != nil {
+		acmeClient.AddCertificates(certs)
+	}
+	return certs, acmeClient, ca, nil
+}
+
+// Default time between ACME certificate renewal checks.
+const defaultACMERenewInterval = 12 * time.Hour
+
+// ACME clients for listener certificates that are obtained with the built-in
+// challenge solvers, by domain. Listeners using the same domain share a client
+// so the certificate is only requested once.
+type acmeClients struct {
+	clients map[string]*rdns.ACMEClient
+	tasks   []periodicTask
+}
+
+func newACMEClients() *acmeClients {
+	return &acmeClients{clients: make(map[string]*rdns.ACMEClient)}
+}
+
+// Returns the ACME client for the certificate of a listener and creates a
+// renewal task for it if it's new.
+func (c *acmeClients) get(id string, l *listener) (*rdns.ACMEClient, error) {
+	if client, ok := c.clients[l.Lego.CertDomain]; ok {
+		return client, nil
 	}
-	return rdns.TLSServerConfig(ca, cert, key, l.MutualTLS)
+	challenge := rdns.ACMEChallengeHTTP
+	if l.Lego.CertMode == "tls" {
+		challenge = rdns.ACMEChallengeTLSALPN
+	}
+	client, err := rdns.NewACMEClient(id, rdns.ACMEOptions{
+		Domains:      []string{l.Lego.CertDomain},
+		Email:        l.Lego.Email,
+		Challenge:    challenge,
+		DirectoryURL: l.ACMEDirectory,
+		StorageDir:   acmeStorageDir(),
+		HTTPAddress:  l.ACMEHTTPAddress,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listener '%s': %w", id, err)
+	}
+	c.clients[l.Lego.CertDomain] = client
+
+	interval := defaultACMERenewInterval
+	if l.Lego.UpdatePeriodic > 0 {
+		interval = time.Duration(l.Lego.UpdatePeriodic) * time.Minute
+	}
+	c.tasks = append(c.tasks, periodicTask{
+		Tag: "acme renew",
+		Periodic: &task.Periodic{
+			Interval: interval,
+			Execute: func() error {
+				// Errors are only logged, the periodic task would stop otherwise
+				if err := client.Renew(); err != nil {
+					rdns.Log.WithField("id", id).WithError(err).Error("failed to renew certificate")
+				}
+				return nil
+			},
+		},
+	})
+	return client, nil
+}
+
+// Returns the directory certificates are stored in, the same used by lego
+// for the other certificate modes.
+func acmeStorageDir() string {
+	if dir := os.Getenv("XRAY_LOCATION_CONFIG"); dir != "" {
+		return filepath.Join(dir, "cert")
+	}
+	if dir, err := os.Getwd(); err == nil {
+		return filepath.Join(dir, "cert")
+	}
+	return "cert"
+}
+
+// Default time between checks for changed certificate files.
+const defaultCertReloadInterval = time.Minute
+
+// Returns a task that reloads the certificates of a listener when their files
+// change, for example when renewed by an external tool.
+func certReloadTask(l *listener, certs *rdns.TLSCertificates) periodicTask {
+	interval := defaultCertReloadInterval
+	if l.CertReloadInterval > 0 {
+		interval = time.Duration(l.CertReloadInterval) * time.Second
+	}
+	return periodicTask{
+		Tag: "cert reload",
+		Periodic: &task.Periodic{
+			Interval: interval,
+			Execute: func() error {
+				// Errors are only logged, the periodic task would stop otherwise
+				if err := certs.Reload(); err != nil {
+					rdns.Log.WithError(err).Error("failed to reload certificates")
+				}
+				return nil
+			},
+		},
+	}
+}
+
+// Returns the client certificate policy of a listener. Rules only apply when
+// client certificates are required.
+func clientCertPolicy(l *listener) (rdns.ClientCertPolicy, error) {
+	policy := rdns.ClientCertPolicy{
+		CommonNames:  l.AllowedClientCN,
+		SANs:         l.AllowedClientSAN,
+		Fingerprints: l.AllowedClientFingerprint,
+	}
+	if !policy.Empty() && !l.MutualTLS {
+		return policy, errors.New("allowed client certificates require mutual-tls")
+	}
+	return policy, nil
+}
+
+// Parses the TLS protocol options of a listener.
+func tlsServerOptions(l *listener) (rdns.TLSServerOptions, error) {
+	var (
+		opt rdns.TLSServerOptions
+		err error
+	)
+	if opt.MinVersion, err = rdns.ParseTLSVersion(l.TLSMinVersion); err != nil {
+		return opt, fmt.Errorf("tls-min-version: %w", err)
+	}
+	if opt.MaxVersion, err = rdns.ParseTLSVersion(l.TLSMaxVersion); err != nil {
+		return opt, fmt.Errorf("tls-max-version: %w", err)
+	}
+	if opt.MinVersion != 0 && opt.MaxVersion != 0 && opt.MinVersion > opt.MaxVersion {
+		return opt, errors.New("tls-min-version is greater than tls-max-version")
+	}
+	if opt.CipherSuites, err = rdns.ParseCipherSuites(l.TLSCipherSuites); err != nil {
+		return opt, fmt.Errorf("tls-cipher-suites: %w", err)
+	}
+	if opt.CurvePreferences, err = rdns.ParseCurvePreferences(l.TLSCurvePreferences); err != nil {
+		return opt, fmt.Errorf("tls-curve-preferences: %w", err)
+	}
+	opt.NextProtos = l.ALPN
+	return opt, nil
+}
+
+// Returns the authenticators for the HTTP clients of a DoH or DoWS listener.
+func dohAuthFromConfig(id string, l listener, resolvers map[string]rdns.Resolver) ([]rdns.DoHAuth, error) {
+	var auth []rdns.DoHAuth
+	if len(l.Frontend.BasicAuth) > 0 || len(l.Frontend.BearerTokens) > 0 {
+		auth = append(auth, rdns.StaticDoHAuth{
+			Users:  l.Frontend.BasicAuth,
+			Tokens: l.Frontend.BearerTokens,
+		})
+	}
+	if l.Frontend.AuthPanel != "" {
+		panel, ok := resolvers[l.Frontend.AuthPanel].(*rdns.Panellist)
+		if !ok {
+			return nil, fmt.Errorf("listener '%s' auth-panel '%s' is not a blocklist-panel group", id, l.Frontend.AuthPanel)
+		}
+		auth = append(auth, panel)
+	}
+	return auth, nil
 }
 
 func GetTLSClientConfig(r *resolver) (*tls.Config, error) {
@@ -58,6 +294,58 @@ func GetTLSClientConfig(r *resolver) (*tls.Config, error) {
 	return rdns.TLSClientConfig(ca, cert, key, r.ServerName)
 }
 
+// Assigns blocklist-panel groups to the panel-rotate groups that use them. A
+// single panel-rotate without "panels" uses all blocklist-panel groups that
+// aren't used by another panel-rotate, as in earlier versions.
+func assignPanels(groups map[string]group) error {
+	var (
+		panels   []string
+		legacy   []string
+		assigned = make(map[string]string)
+	)
+	for id, g := range groups {
+		switch g.Type {
+		case "blocklist-panel":
+			panels = append(panels, id)
+		case "panel-rotate":
+			if len(g.Panels) == 0 {
+				legacy = append(legacy, id)
+			}
+			for _, panel := range g.Panels {
+				if groups[panel].Type != "blocklist-panel" {
+					return fmt.Errorf("panel '%s' of '%s' is not a blocklist-panel group", panel, id)
+				}
+				if other, ok := assigned[panel]; ok {
+					return fmt.Errorf("blocklist-panel '%s' is used by '%s' and '%s'", panel, other, id)
+				}
+				assigned[panel] = id
+			}
+		}
+	}
+	var unassigned []string
+	for _, id := range panels {
+		if _, ok := assigned[id]; !ok {
+			unassigned = append(unassigned, id)
+		}
+	}
+	if len(unassigned) == 0 {
+		return nil
+	}
+	sort.Strings(unassigned)
+	switch len(legacy) {
+	case 0:
+		return fmt.Errorf("blocklist-panel groups %v aren't used by any panel-rotate", unassigned)
+	case 1:
+	default:
+		sort.Strings(legacy)
+		return fmt.Errorf("panel-rotate groups %v need to list their blocklist-panel groups in 'panels'", legacy)
+	}
+	g := groups[legacy[0]]
+	g.Panels = unassigned
+	groups[legacy[0]] = g
+	return nil
+}
+
 func (config *Config) GetPanelManager(logLevel uint32, asseturl string) (*Manager, error) {
 	// Set the log level in the library package
 	if logLevel > 6 {
@@ -83,6 +371,10 @@ func (config *Config) GetPanelManager(logLevel uint32, asseturl string) (*Manage
 
 	rdns.Log.SetLevel(logrus.Level(logLevel))
 
+	// Only close what this config starts, not what a previous one did
+	onClose = nil
+	rdns.ResetAdminHandlers()
+
 	// Map to hold all the resolvers extracted from the config, key'ed by resolver ID. It
 	// holds configured resolvers, groups, as well as routers (since they all implement
 	// rdns.Resolver)
@@ -106,6 +398,11 @@ func (config *Config) GetPanelManager(logLevel uint32, asseturl string) (*Manage
 				}})
 		}
 	}
+	proxies, err := instantiateProxies(config.Proxies)
+	if err != nil {
+		return nil, err
+	}
+
 	// Add all types of nodes to a DAG, this is to find duplicates. Then populate the edges (dependencies).
 	graph := dag.NewDAG()
 	edges := make(map[string][]string)
@@ -115,29 +412,27 @@ func (config *Config) GetPanelManager(logLevel uint32, asseturl string) (*Manage
 		if err != nil {
 			return nil, err
 		}
+		if v.OverflowResolver != "" {
+			edges[id] = append(edges[id], v.OverflowResolver)
+		}
 	}
 
-	var pgm []string
-	var pm []string
+	if err := assignPanels(config.Groups); err != nil {
+		return nil, err
+	}
 	for id, v := range config.Groups {
 		node := &Node{id, v}
-		if v.Type == "blocklist-panel" {
-			pgm = append(pgm, id)
-		}
-		if v.Type == "panel-rotate" {
-			pm = append(pm, id)
-		}
 		_, err := graph.AddVertex(node)
 		if err != nil {
 			return nil, err
 		}
-		edges[id] = append(v.Resolvers, v.AllowListResolver, v.BlockListResolver, v.LimitResolver, v.RetryResolver)
-	}
-
-	if len(pgm) > 0 && len(pm) == 0 {
-		return nil, fmt.Errorf("%d blocklist-panel found but panel-rotate not found", len(pgm))
-	} else if len(pgm) > 0 && len(pm) > 1 {
-		return nil, fmt.Errorf("currently only one panel-rotate is supported, found %d", len(pgm))
+		edges[id] = append(v.Resolvers, v.AllowListResolver, v.BlockListResolver, v.LimitResolver, v.RetryResolver, v.BanResolver, v.QuarantineResolver, v.MaintenanceResolver)
+		edges[id] = append(edges[id], v.Panels...)
+		for _, a := range v.CategoryAction {
+			if a.Resolver != "" && !slices.Contains(edges[id], a.Resolver) {
+				edges[id] = append(edges[id], a.Resolver)
+			}
+		}
 	}
 	
 	for id, v := range config.Routers {
@@ -192,26 +487,37 @@ func (config *Config) GetPanelManager(logLevel uint32, asseturl string) (*Manage
 				}
 			}
 			if r, ok := node.value.(router); ok {
-				if err := instantiateRouter(id, r, resolvers); err != nil {
+				if err := instantiateRouter(id, r, resolvers, proxies); err != nil {
 					return nil, err
 				}
 			}
+			closeOnReload(resolvers[id])
 			if err := graph.DeleteVertex(id); err != nil {
 				return nil, err
 			}
 		}
 	}
-	if len(pgm) > 0 && len(pm) > 0 {
-		if pr, ok := resolvers[pm[0]].(*rdns.PanelRotate); ok {
-			for id := range pgm {
-				pr.PanelResolvers = append(pr.PanelResolvers, resolvers[pgm[id]])
-				delete(resolvers, pgm[id])
+	// Named routes can be re-pointed at runtime, but only at elements that
+	// don't lead back to the router, those would send queries in a loop
+	for id := range config.Routers {
+		router, ok := resolvers[id].(*rdns.Router)
+		if !ok {
+			continue
+		}
+		targets := make(map[string]rdns.Resolver)
+		for rid, r := range resolvers {
+			if rid != id && !reaches(edges, rid, id) {
+				targets[rid] = r
 			}
 		}
+		router.SetResolvers(targets)
 	}
 
 	// Build the Listeners last as they can point to routers, groups or resolvers directly.
 	var listeners []rdns.Listener
+	acme := newACMEClients()
+	limits := tenantLimits(config.Tenants)
+	tlsPorts := sharedTLSPorts(config.Listeners)
 	for id, l := range config.Listeners {
 		resolver, ok := resolvers[l.Resolver]
 		// All Listeners should route queries (except the admin service).
@@ -223,7 +529,91 @@ func (config *Config) GetPanelManager(logLevel uint32, asseturl string) (*Manage
 			return nil, err
 		}
 
-		opt := rdns.ListenOptions{AllowedNet: allowedNet}
+		trustedProxies, err := parseCIDRList(l.TrustedProxies)
+		if err != nil {
+			return nil, err
+		}
+		if len(l.ClientIPHeaders) > 0 && len(trustedProxies) == 0 {
+			return nil, fmt.Errorf("listener '%s' sets client-ip-headers without trusted-proxies", id)
+		}
+
+		var socketMode uint64
+		if l.SocketMode != "" {
+			socketMode, err = strconv.ParseUint(l.SocketMode, 8, 32)
+			if err != nil {
+				return nil, fmt.Errorf("listener '%s' has invalid socket-mode '%s': %w", id, l.SocketMode, err)
+			}
+		}
+		padding, err := rdns.ParsePaddingPolicy(l.Padding, l.PaddingBlockSize)
+		if err != nil {
+			return nil, fmt.Errorf("listener '%s': %w", id, err)
+		}
+
+		var tsigKeys map[string]string
+		if len(l.TSIGKeys) > 0 {
+			tsigKeys = make(map[string]string)
+			for name, secret := range l.TSIGKeys {
+				if _, err := base64.StdEncoding.DecodeString(secret); err != nil {
+					return nil, fmt.Errorf("invalid secret for tsig key '%s' in listener '%s': %w", name, id, err)
+				}
+				tsigKeys[dns.CanonicalName(name)] = secret
+			}
+		}
+
+		queryTimeout := config.QueryTimeout
+		if l.QueryTimeout > 0 {
+			queryTimeout = l.QueryTimeout
+		}
+		opt := rdns.ListenOptions{
+			AllowedNet:   allowedNet,
+			QueryTimeout: time.Duration(queryTimeout) * time.Second,
+			Workers:      l.Workers,
+
+			MaxConnections:       l.MaxConnections,
+			MaxConnectionQueries: l.MaxConnectionQueries,
+			IdleTimeout:          time.Duration(l.IdleTimeout) * time.Second,
+			MaxQPS:               l.MaxQPS,
+			Limits:               limits[l.tenant],
+
+			CaptureEDNS0: l.CaptureEDNS0,
+
+			TrustedProxies:  trustedProxies,
+			ClientIPHeaders: l.ClientIPHeaders,
+
+			SocketMode:  os.FileMode(socketMode),
+			SocketGroup: l.SocketGroup,
+
+			Transparent: l.Transparent,
+
+			Padding: padding,
+
+			TSIGKeys: tsigKeys,
+
+			SharePort: tlsPorts[tlsPortAddress(l)] > 1,
+		}
+		if l.MACLookup || len(l.MACStatic) > 0 {
+			static := make(map[string]net.HardwareAddr)
+			for ip, s := range l.MACStatic {
+				mac, err := net.ParseMAC(s)
+				if err != nil {
+					return nil, fmt.Errorf("invalid mac address for '%s' in listener '%s': %w", ip, id, err)
+				}
+				static[ip] = mac
+			}
+			opt.MACTable = rdns.NewMACTable(rdns.MACTableOptions{
+				Static:     static,
+				StaticOnly: !l.MACLookup,
+			})
+		}
+		if l.Transparent && l.Protocol != "udp" && l.Protocol != "tcp" {
+			return nil, fmt.Errorf("listener '%s' is transparent, which is only supported by udp and tcp listeners", id)
+		}
+		if l.Workers > 1 && l.Protocol != "udp" && l.Protocol != "tcp" {
+			return nil, fmt.Errorf("listener '%s' uses workers, which are only supported by udp and tcp listeners", id)
+		}
+		if (l.QUICRetry || l.QUICRetryThreshold > 0) && l.Protocol != "doq" {
+			return nil, fmt.Errorf("listener '%s' uses quic-retry, which is only supported by doq listeners", id)
+		}
 
 		switch l.Protocol {
 		case "tcp":
@@ -253,22 +643,60 @@ func (config *Config) GetPanelManager(logLevel uint32, asseturl string) (*Manage
 					},
 				})
 			}
+		case "unix", "unixgram":
+			if l.Address == "" {
+				return nil, fmt.Errorf("listener '%s' requires the path of the socket as address", id)
+			}
+			listeners = append(listeners, rdns.NewDNSListener(id, l.Address, l.Protocol, opt, resolver))
 		case "admin":
-			tlsConfig, err := GetTLSServerConfig(&l)
-			// tlsConfig, err := rdns.TLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
-			if err != nil {
-				return nil, err
+			var (
+				tlsConfig *tls.Config
+				certs     *rdns.TLSCertificates
+			)
+			if l.Transport == "unix" {
+				if l.Address == "" {
+					return nil, fmt.Errorf("listener '%s' requires the path of the socket as address", id)
+				}
+			} else {
+				tlsConfig, certs, err = GetTLSServerConfig(id, &l, acme)
+				if err != nil {
+					return nil, err
+				}
+			}
+			health := rdns.HealthCheckOptions{
+				Query:   l.HealthQuery,
+				Timeout: time.Duration(l.HealthTimeout) * time.Millisecond,
+			}
+			if l.HealthQueryType != "" {
+				qtype, ok := dns.StringToType[strings.ToUpper(l.HealthQueryType)]
+				if !ok {
+					return nil, fmt.Errorf("listener '%s' has invalid health-query-type '%s'", id, l.HealthQueryType)
+				}
+				health.Type = qtype
+			}
+			for _, name := range l.HealthResolvers {
+				r, ok := resolvers[name]
+				if !ok {
+					return nil, fmt.Errorf("listener '%s' references non-existent health resolver '%s'", id, name)
+				}
+				health.Resolvers = append(health.Resolvers, r)
 			}
 			opt := rdns.AdminListenerOptions{
 				TLSConfig:     tlsConfig,
 				ListenOptions: opt,
 				Transport:     l.Transport,
+				Health:        health,
+				Tenant:        l.tenant,
 			}
 			ln, err := rdns.NewAdminListener(id, l.Address, opt)
 			if err != nil {
 				return nil, err
 			}
 			ln.Lego = &l.Lego
+			ln.Certificates = certs
+			if certs != nil {
+				tasks = append(tasks, certReloadTask(&l, certs))
+			}
 			ln.MutualTLS = l.MutualTLS
 			listeners = append(listeners, ln)
 			if l.Lego.CertMode != "" && l.Lego.CertMode != "none" {
@@ -282,12 +710,16 @@ func (config *Config) GetPanelManager(logLevel uint32, asseturl string) (*Manage
 			}
 		case "dot":
 			l.Address = rdns.AddressWithDefault(l.Address, rdns.DoTPort)
-			tlsConfig, err := GetTLSServerConfig(&l)
+			tlsConfig, certs, err := GetTLSServerConfig(id, &l, acme)
 			if err != nil {
 				return nil, err
 			}
 			ln := rdns.NewDoTListener(id, l.Address, rdns.DoTListenerOptions{TLSConfig: tlsConfig, ListenOptions: opt}, resolver)
 			ln.Lego = &l.Lego
+			ln.Certificates = certs
+			if certs != nil {
+				tasks = append(tasks, certReloadTask(&l, certs))
+			}
 			ln.MutualTLS = l.MutualTLS
 			listeners = append(listeners, ln)
 			if l.Lego.CertMode != "" && l.Lego.CertMode != "none" {
@@ -301,12 +733,16 @@ func (config *Config) GetPanelManager(logLevel uint32, asseturl string) (*Manage
 			}
 		case "dtls":
 			l.Address = rdns.AddressWithDefault(l.Address, rdns.DTLSPort)
-			dtlsConfig, err := GetDTLSServerConfig(&l)
+			dtlsConfig, certs, err := GetDTLSServerConfig(id, &l, acme)
 			if err != nil {
 				return nil, err
 			}
 			ln := rdns.NewDTLSListener(id, l.Address, rdns.DTLSListenerOptions{DTLSConfig: dtlsConfig, ListenOptions: opt, MutualTLS: l.MutualTLS}, resolver)
 			ln.Lego = &l.Lego
+			ln.Certificates = certs
+			if certs != nil {
+				tasks = append(tasks, certReloadTask(&l, certs))
+			}
 			listeners = append(listeners, ln)
 			if l.Lego.CertMode != "" && l.Lego.CertMode != "none" {
 				tasks = append(tasks, periodicTask{
@@ -323,14 +759,17 @@ func (config *Config) GetPanelManager(logLevel uint32, asseturl string) (*Manage
 			} else if l.Transport == "quic" {
 				l.Address = rdns.AddressWithDefault(l.Address, rdns.DohQuicPort)
 			}
-			var tlsConfig *tls.Config
+			var (
+				tlsConfig *tls.Config
+				certs     *rdns.TLSCertificates
+			)
 			if l.NoTLS {
 				if l.Transport == "quic" {
 					return nil, errors.New("no-tls is not supported for doh servers with quic transport")
 				}
 			} else {
 				fmt.Println("p4")
-				tlsConfig, err = GetTLSServerConfig(&l)
+				tlsConfig, certs, err = GetTLSServerConfig(id, &l, acme)
 				if err != nil {
 					return nil, err
 				}
@@ -342,18 +781,33 @@ func (config *Config) GetPanelManager(logLevel uint32, asseturl string) (*Manage
 					return nil, fmt.Errorf("listener '%s' trusted-proxy '%s': %v", id, l.Frontend.HTTPProxyNet, err)
 				}
 			}
+			auth, err := dohAuthFromConfig(id, l, resolvers)
+			if err != nil {
+				return nil, err
+			}
 			opt := rdns.DoHListenerOptions{
 				TLSConfig:     tlsConfig,
 				ListenOptions: opt,
 				Transport:     l.Transport,
 				HTTPProxyNet:  httpProxyNet,
 				NoTLS:         l.NoTLS,
+				Auth:          auth,
+
+				MaxBodySize:          l.Frontend.MaxBodySize,
+				MaxHeaderSize:        l.Frontend.MaxHeaderSize,
+				Methods:              l.Frontend.AllowedMethods,
+				MaxConcurrentStreams: l.Frontend.MaxConcurrentStreams,
+				MaxConnectionRate:    l.Frontend.MaxConnectionRate,
 			}
 			ln, err := rdns.NewDoHListener(id, l.Address, opt, resolver)
 			if err != nil {
 				return nil, err
 			}
 			ln.Lego = &l.Lego
+			ln.Certificates = certs
+			if certs != nil {
+				tasks = append(tasks, certReloadTask(&l, certs))
+			}
 			ln.MutualTLS = l.MutualTLS
 			listeners = append(listeners, ln)
 			if l.Lego.CertMode != "" && l.Lego.CertMode != "none" {
@@ -365,15 +819,62 @@ func (config *Config) GetPanelManager(logLevel uint32, asseturl string) (*Manage
 					},
 				})
 			}
+		case "dows":
+			l.Address = rdns.AddressWithDefault(l.Address, rdns.DoHPort)
+			var (
+				tlsConfig *tls.Config
+				certs     *rdns.TLSCertificates
+			)
+			if !l.NoTLS {
+				tlsConfig, certs, err = GetTLSServerConfig(id, &l, acme)
+				if err != nil {
+					return nil, err
+				}
+			}
+			auth, err := dohAuthFromConfig(id, l, resolvers)
+			if err != nil {
+				return nil, err
+			}
+			opt := rdns.DoWSListenerOptions{
+				TLSConfig:     tlsConfig,
+				ListenOptions: opt,
+				NoTLS:         l.NoTLS,
+				Auth:          auth,
+			}
+			ln := rdns.NewDoWSListener(id, l.Address, opt, resolver)
+			ln.Lego = &l.Lego
+			ln.Certificates = certs
+			if certs != nil {
+				tasks = append(tasks, certReloadTask(&l, certs))
+			}
+			listeners = append(listeners, ln)
+			if l.Lego.CertMode != "" && l.Lego.CertMode != "none" {
+				tasks = append(tasks, periodicTask{
+					Tag: "cert monitor",
+					Periodic: &task.Periodic{
+						Interval: time.Duration(l.Lego.UpdatePeriodic) * time.Second * 60,
+						Execute:  ln.CertMonitor,
+					},
+				})
+			}
 		case "doq":
 			l.Address = rdns.AddressWithDefault(l.Address, rdns.DoQPort)
 
-			tlsConfig, err := GetTLSServerConfig(&l)
+			tlsConfig, certs, err := GetTLSServerConfig(id, &l, acme)
 			if err != nil {
 				return nil, err
 			}
-			ln := rdns.NewQUICListener(id, l.Address, rdns.DoQListenerOptions{TLSConfig: tlsConfig, ListenOptions: opt}, resolver)
+			ln := rdns.NewQUICListener(id, l.Address, rdns.DoQListenerOptions{
+				TLSConfig:      tlsConfig,
+				ListenOptions:  opt,
+				Retry:          l.QUICRetry,
+				RetryThreshold: l.QUICRetryThreshold,
+			}, resolver)
 			ln.Lego = &l.Lego
+			ln.Certificates = certs
+			if certs != nil {
+				tasks = append(tasks, certReloadTask(&l, certs))
+			}
 			ln.MutualTLS = l.MutualTLS
 			listeners = append(listeners, ln)
 			if l.Lego.CertMode != "" && l.Lego.CertMode != "none" {
@@ -389,6 +890,23 @@ func (config *Config) GetPanelManager(logLevel uint32, asseturl string) (*Manage
 			return nil, fmt.Errorf("unsupported protocol '%s' for listener '%s'", l.Protocol, id)
 		}
 	}
+	tasks = append(tasks, acme.tasks...)
+
+	for id, m := range config.MetricsPush {
+		pusher, err := rdns.NewMetricsPusher(id, rdns.MetricsPusherOptions{
+			Format:   m.Format,
+			Network:  m.Network,
+			Address:  m.Address,
+			Token:    m.Token,
+			Interval: time.Duration(m.Interval) * time.Second,
+			Prefix:   m.Prefix,
+			Tags:     m.Tags,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to start metrics push '%s': %w", id, err)
+		}
+		onClose = append(onClose, pusher.Stop)
+	}
 
 	return &Manager{
 		Running:   false,
@@ -401,6 +919,50 @@ func (config *Config) GetPanelManager(logLevel uint32, asseturl string) (*Manage
 	}, nil
 }
 
+// Counts the DoT and DoH listeners over TCP with TLS by address. Listeners
+// on the same address share the socket.
+func sharedTLSPorts(listeners map[string]listener) map[string]int {
+	ports := make(map[string]int)
+	for _, l := range listeners {
+		if addr := tlsPortAddress(l); addr != "" {
+			ports[addr]++
+		}
+	}
+	return ports
+}
+
+// Returns the address of a DoT or DoH listener over TCP with TLS, or an
+// empty string for other listeners.
+func tlsPortAddress(l listener) string {
+	switch {
+	case l.Protocol == "dot":
+		return rdns.AddressWithDefault(l.Address, rdns.DoTPort)
+	case l.Protocol == "doh" && l.Transport != "quic" && !l.NoTLS:
+		return rdns.AddressWithDefault(l.Address, rdns.DoHPort)
+	}
+	return ""
+}
+
+// Returns true if the element with ID to can be reached from the one with ID
+// from by following the edges of the dependency graph.
+func reaches(edges map[string][]string, from, to string) bool {
+	seen := make(map[string]struct{})
+	next := []string{from}
+	for len(next) > 0 {
+		id := next[len(next)-1]
+		next = next[:len(next)-1]
+		if id == to {
+			return true
+		}
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		next = append(next, edges[id]...)
+	}
+	return false
+}
+
 func (m *Manager) Close() error {
 	rdns.Log.Info("stopping")
 	for _, f := range m.OnClose {
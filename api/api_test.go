@@ -0,0 +1,188 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	rdns "github.com/folbricht/routedns"
+	"github.com/stretchr/testify/require"
+)
+
+// Loads a config from a string.
+func loadTestConfig(t *testing.T, config string) Config {
+	name := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(name, []byte(config), 0o600))
+	c, _, err := LoadConfig(name)
+	require.NoError(t, err)
+	return c
+}
+
+func TestRouterAdminTargets(t *testing.T) {
+	config := loadTestConfig(t, `
+[resolvers.upstream]
+address = "127.0.0.1:53"
+protocol = "udp"
+
+[routers.router]
+routes = [
+  { id = "default", resolver = "upstream" },
+]
+
+[groups.rotate]
+type = "fail-rotate"
+resolvers = ["router"]
+
+[listeners.local]
+address = "127.0.0.1:0"
+protocol = "udp"
+resolver = "rotate"
+`)
+	manager, err := config.GetPanelManager(0, t.TempDir())
+	require.NoError(t, err)
+	router := manager.Resolvers["router"].(*rdns.Router)
+
+	do := func(query string) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/routedns/router/router?"+query, nil))
+		return w.Code
+	}
+
+	// Resolvers that don't lead back to the router can be used
+	require.Equal(t, http.StatusNoContent, do("route=default&resolver=upstream"))
+
+	// The router itself or a group containing it would loop
+	require.Equal(t, http.StatusBadRequest, do("route=default&resolver=router"))
+	require.Equal(t, http.StatusBadRequest, do("route=default&resolver=rotate"))
+}
+
+func TestSharedTLSPorts(t *testing.T) {
+	config := loadTestConfig(t, `
+[listeners.dot]
+address = ":443"
+protocol = "dot"
+
+[listeners.doh]
+address = ":443"
+protocol = "doh"
+
+[listeners.dot-only]
+protocol = "dot"
+
+[listeners.doh-quic]
+address = ":443"
+protocol = "doh"
+transport = "quic"
+`)
+	ports := sharedTLSPorts(config.Listeners)
+	require.Equal(t, 2, ports[tlsPortAddress(config.Listeners["dot"])])
+	require.Equal(t, 1, ports[tlsPortAddress(config.Listeners["dot-only"])])
+	require.Equal(t, "", tlsPortAddress(config.Listeners["doh-quic"]))
+}
+
+func TestAssignPanels(t *testing.T) {
+	const panels = `
+[groups.panel-a]
+type = "blocklist-panel"
+resolvers = ["upstream"]
+
+[groups.panel-b]
+type = "blocklist-panel"
+resolvers = ["upstream"]
+`
+	tests := map[string]struct {
+		config string
+		panels map[string][]string
+		err    bool
+	}{
+		"single panel-rotate uses all panels": {
+			config: `
+[groups.rotate]
+type = "panel-rotate"
+resolvers = ["upstream"]
+`,
+			panels: map[string][]string{"rotate": {"panel-a", "panel-b"}},
+		},
+		"explicit assignment": {
+			config: `
+[groups.rotate-a]
+type = "panel-rotate"
+resolvers = ["upstream"]
+panels = ["panel-a"]
+
+[groups.rotate-b]
+type = "panel-rotate"
+resolvers = ["upstream"]
+panels = ["panel-b"]
+`,
+			panels: map[string][]string{"rotate-a": {"panel-a"}, "rotate-b": {"panel-b"}},
+		},
+		"remaining panels go to the panel-rotate without list": {
+			config: `
+[groups.rotate-a]
+type = "panel-rotate"
+resolvers = ["upstream"]
+panels = ["panel-a"]
+
+[groups.rotate]
+type = "panel-rotate"
+resolvers = ["upstream"]
+`,
+			panels: map[string][]string{"rotate-a": {"panel-a"}, "rotate": {"panel-b"}},
+		},
+		"no panel-rotate": {
+			err: true,
+		},
+		"unassigned panel": {
+			config: `
+[groups.rotate-a]
+type = "panel-rotate"
+resolvers = ["upstream"]
+panels = ["panel-a"]
+`,
+			err: true,
+		},
+		"panel used twice": {
+			config: `
+[groups.rotate-a]
+type = "panel-rotate"
+resolvers = ["upstream"]
+panels = ["panel-a", "panel-b"]
+
+[groups.rotate-b]
+type = "panel-rotate"
+resolvers = ["upstream"]
+panels = ["panel-a"]
+`,
+			err: true,
+		},
+		"several panel-rotate without list": {
+			config: `
+[groups.rotate-a]
+type = "panel-rotate"
+resolvers = ["upstream"]
+
+[groups.rotate-b]
+type = "panel-rotate"
+resolvers = ["upstream"]
+`,
+			err: true,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			config := loadTestConfig(t, panels+test.config)
+			err := assignPanels(config.Groups)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			for id, panels := range test.panels {
+				require.Equal(t, panels, config.Groups[id].Panels, id)
+			}
+		})
+	}
+}
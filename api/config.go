@@ -19,6 +19,18 @@ type Config struct {
 	Resolvers         map[string]resolver
 	Groups            map[string]group
 	Routers           map[string]router
+	Proxies           map[string]proxy
+	QueryTimeout      int `toml:"query-timeout"` // Default time in seconds a listener may spend resolving a query, 0 == unlimited
+	Privileges        privileges
+	MetricsPush       map[string]metricsPush `toml:"metrics-push"`
+	Tenants           map[string]tenant
+}
+
+// User to run as after starting, instead of root
+type privileges struct {
+	User             string
+	Group            string   // Defaults to the primary group of the user
+	KeepCapabilities []string `toml:"keep-capabilities"` // Defaults to CAP_NET_BIND_SERVICE
 }
 
 type listener struct {
@@ -33,12 +45,105 @@ type listener struct {
 	NoTLS      bool     `toml:"no-tls"` // Disable TLS in DoH servers
 	AllowedNet []string `toml:"allowed-net"`
 	Frontend   dohFrontend
-	Lego       M.CertConfig `toml:"cert"`
+	Lego       M.CertConfig   `toml:"cert"`
+	Certs      []M.CertConfig `toml:"certs"` // Additional certificates, selected by SNI
+
+	CertReloadInterval int `toml:"cert-reload-interval"` // Time in seconds between checks for changed certificate files
+
+	// Built-in ACME challenge solvers, used with cert modes "tls" and "http"
+	ACMEDirectory   string `toml:"acme-directory"`    // ACME directory URL, defaults to Let's Encrypt
+	ACMEHTTPAddress string `toml:"acme-http-address"` // Listen address for HTTP-01 challenges, defaults to ":80"
+
+	// TLS protocol options for DoT, DoH, DoQ and admin listeners
+	TLSMinVersion       string   `toml:"tls-min-version"`       // Minimum TLS version, "1.0" to "1.3"
+	TLSMaxVersion       string   `toml:"tls-max-version"`       // Maximum TLS version, "1.0" to "1.3"
+	TLSCipherSuites     []string `toml:"tls-cipher-suites"`     // Cipher suites for TLS 1.2 and below, by IANA name
+	TLSCurvePreferences []string `toml:"tls-curve-preferences"` // Elliptic curves in order of preference
+	ALPN                []string `toml:"alpn"`                  // ALPN protocols offered to clients
+
+	// Client certificates accepted with mutual-tls, in addition to being signed by the CA
+	AllowedClientCN          []string `toml:"allowed-client-cn"`          // Subject common names
+	AllowedClientSAN         []string `toml:"allowed-client-san"`         // DNS, email or URI subject alternative names
+	AllowedClientFingerprint []string `toml:"allowed-client-fingerprint"` // SHA-256 certificate fingerprints
+
+	QueryTimeout int `toml:"query-timeout"` // Time in seconds to resolve a query before responding with SERVFAIL. Overrides the global default
+	Workers      int // Number of sockets opened with SO_REUSEPORT for UDP and TCP listeners
+
+	// Connection limits for TCP, DoT, DoQ and DTLS listeners
+	MaxConnections       int `toml:"max-connections"`        // Maximum number of concurrent connections
+	MaxQPS               int `toml:"max-qps"`                // Maximum number of queries per second
+	MaxConnectionQueries int `toml:"max-connection-queries"` // Maximum number of queries per connection
+	IdleTimeout          int `toml:"idle-timeout"`           // Time in seconds before an idle connection is closed
+
+	// Client address validation for DoQ listeners
+	QUICRetry          bool `toml:"quic-retry"`           // Validate all client addresses with a Retry packet
+	QUICRetryThreshold int  `toml:"quic-retry-threshold"` // Connection attempts per second above which clients are sent a Retry packet
+
+	CaptureEDNS0 []uint16 `toml:"capture-edns0"` // EDNS0 option codes to capture for routing, removed from queries
+
+	// Client MAC address resolution on the local network
+	MACLookup bool              `toml:"mac-lookup"` // Read MAC addresses from the ARP/NDP table
+	MACStatic map[string]string `toml:"mac-static"` // MAC addresses by client IP
+
+	// Original client IP headers from proxies in front of DNS and DoQ listeners
+	TrustedProxies  []string `toml:"trusted-proxies"`   // CIDRs of proxies allowed to set the headers
+	ClientIPHeaders []string `toml:"client-ip-headers"` // Headers with the client IP, in order of preference
+
+	// Permissions of unix domain sockets
+	SocketMode  string `toml:"socket-mode"`  // File mode in octal, like "0660"
+	SocketGroup string `toml:"socket-group"` // Group name or ID owning the socket
+
+	Transparent bool // Accept queries redirected with TPROXY, for UDP and TCP listeners
+
+	// Response padding as per RFC8467
+	Padding          string // "none", "block", "random" or "maximal"
+	PaddingBlockSize int    `toml:"padding-block-size"` // Block size for "block" and "random", default 468
+
+	TSIGKeys map[string]string `toml:"tsig-keys"` // Base64-encoded TSIG secrets by key name, to verify signed queries with
+
+	// Readiness checks of admin listeners on /readyz
+	HealthResolvers []string `toml:"health-resolvers"`  // Resolvers, groups or routers to send a test query through
+	HealthQuery     string   `toml:"health-query"`      // Name to query, defaults to "."
+	HealthQueryType string   `toml:"health-query-type"` // Type to query, defaults to "NS" for "." and "A" otherwise
+	HealthTimeout   int      `toml:"health-timeout"`    // Time in milliseconds to wait for an answer, default 2000
+
+	// Set for listeners of a tenant, admin listeners only serve its metrics
+	tenant string
 }
 
 // DoH listener frontend options
 type dohFrontend struct {
 	HTTPProxyNet string `toml:"trusted-proxy"`
+
+	// Client authentication
+	BasicAuth    map[string]string `toml:"basic-auth"`    // Passwords by user name
+	BearerTokens []string          `toml:"bearer-tokens"` // Static bearer tokens
+	AuthPanel    string            `toml:"auth-panel"`    // ID of a blocklist-panel group whose user tokens are accepted
+
+	// HTTP limits
+	MaxBodySize          int      `toml:"max-body-size"`          // Maximum size of POST request bodies in bytes, default 65535
+	MaxHeaderSize        int      `toml:"max-header-size"`        // Maximum size of request headers in bytes, default 1MB
+	AllowedMethods       []string `toml:"allowed-methods"`        // "GET" and/or "POST", default both
+	MaxConcurrentStreams int      `toml:"max-concurrent-streams"` // Maximum number of concurrent HTTP/2 streams or HTTP/3 requests per connection
+	MaxConnectionRate    int      `toml:"max-connection-rate"`    // Maximum number of requests per second per connection
+}
+
+// Probes of the backends behind static responder answers
+type backendCheck struct {
+	Protocol  string // "tcp", "http" or "https"
+	Port      int
+	Path      string // Path of HTTP requests, default "/"
+	Host      string // Host header of HTTP requests
+	Interval  int    // Time in seconds between probes, default 10
+	Timeout   int    // Time in seconds to wait for a probe, default 2
+	Threshold int    // Number of consecutive results to change the state, default 2
+}
+
+// Static responder answer for clients in some countries or continents
+type geoAnswer struct {
+	Locations []string // Country or continent codes, like "DE" or "EU"
+	Answer    []string
+	Weights   []int // Weights of the A/AAAA records for "weighted" order
 }
 
 type resolver struct {
@@ -54,8 +159,49 @@ type resolver struct {
 	LocalAddr     string       `toml:"local-address"`
 	EDNS0UDPSize  uint16       `toml:"edns0-udp-size"` // UDP resolver option
 	QueryTimeout  int          `toml:"query-timeout"`  // Query timeout in seconds
+	TCPFallback   bool         `toml:"tcp-fallback"`   // Retry failed UDP queries over TCP
 	Lego          M.CertConfig `toml:"cert"`
 
+	ValidateResponses bool `toml:"validate-responses"` // Reject mismatched responses and remove out-of-bailiwick records, UDP and TCP resolvers
+
+	// TSIG key to sign queries to UDP and TCP resolvers with
+	TSIGName      string `toml:"tsig-name"`      // TSIG key name
+	TSIGAlgorithm string `toml:"tsig-algorithm"` // TSIG algorithm, default hmac-sha256
+	TSIGSecret    string `toml:"tsig-secret"`    // Base64-encoded TSIG secret
+
+	// Query padding as per RFC8467, for encrypted protocols
+	Padding          string // "none", "block" or "random"
+	PaddingBlockSize int    `toml:"padding-block-size"` // Block size for "block" and "random", default 128
+
+	// Connections to the upstream, for UDP, TCP, DoT, DTLS and DoWS resolvers
+	Connections           int  // Number of connections used in parallel, default 1
+	ConnectionMaxInflight int  `toml:"connection-max-inflight"` // Maximum number of queries in flight per connection, 0 == unlimited
+	ReconnectBackoff      int  `toml:"reconnect-backoff"`       // Time in milliseconds to wait before reconnecting after a failure, doubled on repeated failures
+	MaxReconnectBackoff   int  `toml:"max-reconnect-backoff"`   // Maximum time in milliseconds to wait before reconnecting, default 30000
+	InOrder               bool `toml:"in-order"`                // Send one query at a time per connection
+
+	KeepAlive int `toml:"keepalive"` // Keep connections to DoT, DoH and DoQ resolvers open with a query every N seconds
+
+	LoopGuard bool `toml:"loop-guard"` // Mark queries to detect when they loop back to a listener
+
+	DDR bool `toml:"ddr"` // Upgrade UDP and TCP resolvers to their designated encrypted resolver, RFC 9462
+
+	// Set for designated resolvers found with DDR, the certificate has to be valid for this IP
+	ddrVerifyIP net.IP
+
+	// Certificate hashes from a DNS stamp in the address, one has to be in the server certificate chain
+	stampHashes [][]byte
+
+	// Discovery of the upstream endpoints in DNS, for example the pods of a Kubernetes headless service
+	Discovery         string // "dns" to look up the addresses of the host in address, "srv" to look up the SRV records of the name in address
+	DiscoveryInterval int    `toml:"discovery-interval"` // Seconds between lookups, default 30
+
+	// Limit on concurrent queries
+	MaxInflight      int    `toml:"max-inflight"`      // Maximum number of queries in flight, 0 == unlimited
+	QueueSize        int    `toml:"queue-size"`        // Number of queries that can wait when max-inflight is reached
+	QueueTimeout     int    `toml:"queue-timeout"`     // Time in milliseconds a query may wait in the queue
+	OverflowResolver string `toml:"overflow-resolver"` // Resolver for queries that don't fit into the queue
+
 	// Proxy configuration
 	Socks5Address      string `toml:"socks5-address"`
 	Socks5Username     string `toml:"socks5-username"`
@@ -70,36 +216,56 @@ type doh struct {
 
 // Cache backend options
 type cacheBackend struct {
-	Type                 string // Cache backend type.Defaults to "memory"
-	Size                 int    // Max number of items to keep in the cache. Default 0 == unlimited. Deprecated, use backend
-	GCPeriod             int    `toml:"gc-period"` // Time-period (seconds) used to expire cached items
-	Filename             string // File to load/store cache content, optional, for "memory" type cache
-	SaveInterval         int    `toml:"save-interval"`           // Seconds to write the cache to file
-	RedisNetwork         string `toml:"redis-network"`           // The network type, either tcp or unix. Defaults to tcp.
-	RedisAddress         string `toml:"redis-address"`           // Address for redis cache
-	RedisUsername        string `toml:"redis-username"`          // Redis username
-	RedisPassword        string `toml:"redis-password"`          // Redis password
-	RedisDB              int    `toml:"redis-db"`                // Redis database to be selected after connecting to the server
-	RedisKeyPrefix       string `toml:"redis-key-prefix"`        // Prefix any cache entry
-	RedisMaxRetries      int    `toml:"redis-max-retries"`       // Maximum number of retries before giving up. Default is 3 retries; -1 (not 0) disables retries.
-	RedisMinRetryBackoff int    `toml:"redis-min-retry-backoff"` // Minimum back-off between each retry. Default is 8 milliseconds; -1 disables back-off.
-	RedisMaxRetryBackoff int    `toml:"redis-max-retry-backoff"` // Maximum back-off between each retry. Default is 512 milliseconds; -1 disables back-off.
+	Type                 string   // Cache backend type.Defaults to "memory"
+	Size                 int      // Max number of items to keep in the cache. Default 0 == unlimited. Deprecated, use backend
+	GCPeriod             int      `toml:"gc-period"` // Time-period (seconds) used to expire cached items
+	Filename             string   // File to load/store cache content, optional, for "memory" type cache
+	SaveInterval         int      `toml:"save-interval"` // Seconds to write the cache to file
+	Compress             bool     // Compress the cache file
+	Shards               int      // Number of independently locked partitions in a "memory" cache. Default 1
+	RedisNetwork         string   `toml:"redis-network"`           // The network type, either tcp or unix. Defaults to tcp.
+	RedisAddress         string   `toml:"redis-address"`           // Address for redis cache
+	RedisUsername        string   `toml:"redis-username"`          // Redis username
+	RedisPassword        string   `toml:"redis-password"`          // Redis password
+	RedisDB              int      `toml:"redis-db"`                // Redis database to be selected after connecting to the server
+	RedisKeyPrefix       string   `toml:"redis-key-prefix"`        // Prefix any cache entry
+	RedisMaxRetries      int      `toml:"redis-max-retries"`       // Maximum number of retries before giving up. Default is 3 retries; -1 (not 0) disables retries.
+	RedisMinRetryBackoff int      `toml:"redis-min-retry-backoff"` // Minimum back-off between each retry. Default is 8 milliseconds; -1 disables back-off.
+	RedisMaxRetryBackoff int      `toml:"redis-max-retry-backoff"` // Maximum back-off between each retry. Default is 512 milliseconds; -1 disables back-off.
+	RedisTopology        string   `toml:"redis-topology"`          // "standalone", "cluster" or "sentinel". Derived from the other options if empty
+	RedisAddresses       []string `toml:"redis-addresses"`         // Cluster node or sentinel addresses. Used instead of redis-address
+	RedisMasterName      string   `toml:"redis-master-name"`       // Name of the master for sentinel deployments
+	RedisSentinelUser    string   `toml:"redis-sentinel-username"` // Username to authenticate with sentinels
+	RedisSentinelPass    string   `toml:"redis-sentinel-password"` // Password to authenticate with sentinels
+	RedisTLS             bool     `toml:"redis-tls"`               // Connect to redis using TLS
+	RedisCA              string   `toml:"redis-ca"`                // CA certificate file to validate the redis server certificate
+	RedisClientCrt       string   `toml:"redis-client-crt"`        // Client certificate file for TLS client authentication
+	RedisClientKey       string   `toml:"redis-client-key"`        // Client key file for TLS client authentication
+	RedisServerName      string   `toml:"redis-server-name"`       // Server name expected in the redis server certificate
+	RedisPoolSize        int      `toml:"redis-pool-size"`         // Maximum number of connections per node. Default 10 per CPU
+	RedisMinIdleConns    int      `toml:"redis-min-idle-conns"`    // Minimum number of idle connections kept open per node
+	RedisWriteBehind     bool     `toml:"redis-write-behind"`      // Queue writes and send them asynchronously in batches
+	RedisBatchReads      bool     `toml:"redis-batch-reads"`       // Send concurrent lookups in pipelined batches
+	RedisBatchSize       int      `toml:"redis-batch-size"`        // Maximum number of commands per pipeline. Default 100
+	RedisBatchDelay      int      `toml:"redis-batch-delay"`       // Maximum time in milliseconds to wait for a batch to fill. Default 5
+	RedisQueueSize       int      `toml:"redis-queue-size"`        // Maximum number of queued writes with redis-write-behind. Default 10000
 }
 
 type group struct {
-	Resolvers  []string
-	Type       string
-	Replace    []rdns.ReplaceOperation // only used by "replace" type
-	ECSOp      string                  `toml:"ecs-op"`      // ECS modifier operation, "add", "delete", "privacy"
-	ECSAddress net.IP                  `toml:"ecs-address"` // ECS address. If empty for "add", uses the client IP. Ignored for "privacy" and "delete"
-	ECSPrefix4 uint8                   `toml:"ecs-prefix4"` // ECS IPv4 address prefix, 0-32. Used for "add" and "privacy"
-	ECSPrefix6 uint8                   `toml:"ecs-prefix6"` // ECS IPv6 address prefix, 0-128. Used for "add" and "privacy"
-	TTLMin     uint32                  `toml:"ttl-min"`     // TTL minimum to apply to responses in the TTL-modifier
-	TTLMax     uint32                  `toml:"ttl-max"`     // TTL maximum to apply to responses in the TTL-modifier
-	TTLSelect  string                  `toml:"ttl-select"`  // Modifier selection function, "lowest", "highest", "average", "first", "last", "random"
-	EDNS0Op    string                  `toml:"edns0-op"`    // EDNS0 modifier operation, "add" or "delete"
-	EDNS0Code  uint16                  `toml:"edns0-code"`  // EDNS0 modifier option code
-	EDNS0Data  []byte                  `toml:"edns0-data"`  // EDNS0 modifier option data
+	Resolvers    []string
+	Type         string
+	QueryTimeout int                     `toml:"query-timeout"` // Time in seconds the group may take to resolve a query, 0 == unlimited
+	Replace      []rdns.ReplaceOperation // only used by "replace" type
+	ECSOp        string                  `toml:"ecs-op"`      // ECS modifier operation, "add", "delete", "privacy"
+	ECSAddress   net.IP                  `toml:"ecs-address"` // ECS address. If empty for "add", uses the client IP. Ignored for "privacy" and "delete"
+	ECSPrefix4   uint8                   `toml:"ecs-prefix4"` // ECS IPv4 address prefix, 0-32. Used for "add" and "privacy"
+	ECSPrefix6   uint8                   `toml:"ecs-prefix6"` // ECS IPv6 address prefix, 0-128. Used for "add" and "privacy"
+	TTLMin       uint32                  `toml:"ttl-min"`     // TTL minimum to apply to responses in the TTL-modifier
+	TTLMax       uint32                  `toml:"ttl-max"`     // TTL maximum to apply to responses in the TTL-modifier
+	TTLSelect    string                  `toml:"ttl-select"`  // Modifier selection function, "lowest", "highest", "average", "first", "last", "random"
+	EDNS0Op      string                  `toml:"edns0-op"`    // EDNS0 modifier operation, "add" or "delete"
+	EDNS0Code    uint16                  `toml:"edns0-code"`  // EDNS0 modifier option code
+	EDNS0Data    []byte                  `toml:"edns0-data"`  // EDNS0 modifier option data
 
 	// Failover/Failback options
 	ResetAfter    int  `toml:"reset-after"`    // Time in seconds after which to reset resolvers in fail-back and random groups, default 60.
@@ -107,15 +273,17 @@ type group struct {
 
 	// Cache options
 	Backend                  *cacheBackend
-	GCPeriod                 int               `toml:"gc-period"`                   // Time-period (seconds) used to expire cached items in the "cache" type. Deprecated, use backend
-	CacheSize                int               `toml:"cache-size"`                  // Max number of items to keep in the cache. Default 0 == unlimited. Deprecated, use backend
-	CacheNegativeTTL         uint32            `toml:"cache-negative-ttl"`          // TTL to apply to negative responses, default 60.
-	CacheAnswerShuffle       string            `toml:"cache-answer-shuffle"`        // Algorithm to use for modifying the response order of cached items
-	CacheHardenBelowNXDOMAIN bool              `toml:"cache-harden-below-nxdomain"` // Return NXDOMAIN if an NXDOMAIN is cached for a parent domain
-	CacheFlushQuery          string            `toml:"cache-flush-query"`           // Flush the cache when a query for this name is received
-	PrefetchTrigger          uint32            `toml:"cache-prefetch-trigger"`      // Prefetch when the TTL of a query has fallen below this value
-	PrefetchEligible         uint32            `toml:"cache-prefetch-eligible"`     // Only records with TTL greater than this are considered for prefetch
-	CacheRcodeMaxTTL         map[string]uint32 `toml:"cache-rcode-max-ttl"`         // Rcode specific max TTL to keep in the cache
+	GCPeriod                 int               `toml:"gc-period"`                     // Time-period (seconds) used to expire cached items in the "cache" type. Deprecated, use backend
+	CacheSize                int               `toml:"cache-size"`                    // Max number of items to keep in the cache. Default 0 == unlimited. Deprecated, use backend
+	CacheNegativeTTL         uint32            `toml:"cache-negative-ttl"`            // TTL to apply to negative responses, default 60.
+	CacheAnswerShuffle       string            `toml:"cache-answer-shuffle"`          // Algorithm to use for modifying the response order of cached items
+	CacheHardenBelowNXDOMAIN bool              `toml:"cache-harden-below-nxdomain"`   // Return NXDOMAIN if an NXDOMAIN is cached for a parent domain
+	CacheFlushQuery          string            `toml:"cache-flush-query"`             // Flush the cache when a query for this name is received
+	PrefetchTrigger          uint32            `toml:"cache-prefetch-trigger"`        // Prefetch when the TTL of a query has fallen below this value
+	PrefetchEligible         uint32            `toml:"cache-prefetch-eligible"`       // Only records with TTL greater than this are considered for prefetch
+	PrefetchMaxConcurrent    int               `toml:"cache-prefetch-max-concurrent"` // Maximum number of prefetch queries in flight, default 0 == unlimited
+	PrefetchExclude          []string          `toml:"cache-prefetch-exclude"`        // Domains that are never prefetched
+	CacheRcodeMaxTTL         map[string]uint32 `toml:"cache-rcode-max-ttl"`           // Rcode specific max TTL to keep in the cache
 
 	// Blocklist options
 	Blocklist []string // Blocklist rules, only used by "blocklist" type
@@ -125,8 +293,24 @@ type group struct {
 
 	// Blocklist-panel options
 	Panel        api.Config `toml:"api"`
+	PanelType    string     `toml:"panel-type"` // "sspanel" (default), "v2board" or "rest"
 	PanelRefresh int        `toml:"panel-refresh"`
-	// PanelResolvers []string
+	PanelCache   string     `toml:"cache-dir"`         // Where to store panel data to start when the panel is unreachable
+	PanelDryRun  bool       `toml:"user-sync-dry-run"` // Only log changes of the user list without applying them
+	PanelSession int        `toml:"session-ttl"`       // Minutes of inactivity after which user IPs are no longer allowed, 0 allows them permanently
+
+	// Identify panel users by a token in the TLS server name or DoH path
+	PanelUserDomain string `toml:"user-domain"`
+	PanelUserPath   string `toml:"user-path"`
+
+	// Per-user usage statistics reported by blocklist-panel
+	PanelStatsInterval    int    `toml:"stats-interval"`     // Minutes between reports, disabled if 0
+	PanelStatsWebhook     string `toml:"stats-webhook"`      // URL to POST the statistics to
+	PanelStatsTopDomains  int    `toml:"stats-top-domains"`  // Number of top domains per user, default 10
+	PanelStatsOnlineUsers bool   `toml:"stats-online-users"` // Report active user IPs to the panel
+
+	// Panel-rotate options
+	Panels []string `toml:"panels"` // blocklist-panel groups to rotate over
 
 	// Blocklist-v2 options
 	Filter              bool     // Filter response records rather than return NXDOMAIN
@@ -140,10 +324,23 @@ type group struct {
 	AllowlistFormat     string   `toml:"allowlist-format"` // only used for static allowlists in the config
 	AllowlistSource     []list   `toml:"allowlist-source"`
 	AllowlistRefresh    int      `toml:"allowlist-refresh"`
+	AllowlistLearnCNAME int      `toml:"allowlist-learn-cname"`
 	LocationDB          string   `toml:"location-db"` // GeoIP database file for response blocklist. Default "/usr/share/GeoIP/GeoLite2-City.mmdb"
 	Inverted            bool     // Only allow IPs on the blocklist. Supported in response-blocklist-ip and response-blocklist-name
 	AllowRemoteIpDB     bool     `toml:"allow-remote-db"` // allow to get ip from remote
 
+	// Actions for matches by category in blocklist-v2
+	CategoryAction []categoryAction `toml:"category-action"`
+	Audit          bool             // Only log and count matches in blocklist-v2, don't block them
+
+	// Local reverse lookups in blocklist-v2 and blocklist-panel
+	SpoofPTR        string `toml:"spoof-ptr"`         // Name for reverse lookups of spoofed IPs
+	LocalPrivatePTR bool   `toml:"local-private-ptr"` // Answer reverse lookups of private address space locally
+
+	// Response-blocklist-name options
+	Sections          []string // Response sections to inspect, "answer", "authority" and "additional"
+	TerminalCNAMEOnly bool     `toml:"terminal-cname-only"` // Only match the last CNAME target of a chain
+
 	// Static responder options
 	Answer   []string
 	NS       []string
@@ -155,32 +352,152 @@ type group struct {
 	} `toml:"edns0-ede"` // Extended DNS Errors
 	Truncate bool `toml:"truncate"` // When true, TC-Bit is set
 
+	GeoAnswers []geoAnswer `toml:"geo-answer"` // Answers by client location, the database is set with location-db
+
+	AnswerOrder   string `toml:"answer-order"`   // Order of A/AAAA answer records, "round-robin", "random" or "weighted"
+	AnswerWeights []int  `toml:"answer-weights"` // Weights of the A/AAAA answer records for "weighted" order
+	AnswerCount   int    `toml:"answer-count"`   // Maximum number of A/AAAA records in an answer
+
+	BackendCheck *backendCheck `toml:"backend-check"` // Probe the A/AAAA answer addresses and leave out unhealthy ones
+
 	// Rate-limiting options
-	Requests      uint   // Number of requests allowed
-	Window        uint   // Time period in seconds for the requests
-	Prefix4       uint8  // Prefix bits to identify IPv4 client
-	Prefix6       uint8  // Prefix bits to identify IPv6 client
-	LimitResolver string `toml:"limit-resolver"` // Resolver to use when rate-limit exceeded
+	Requests       uint     // Number of requests allowed
+	Window         uint     // Time period in seconds for the requests
+	Prefix4        uint8    // Prefix bits to identify IPv4 client
+	Prefix6        uint8    // Prefix bits to identify IPv6 client
+	LimitResolver  string   `toml:"limit-resolver"`   // Resolver to use when rate-limit exceeded
+	LimitAction    string   `toml:"limit-action"`     // Action for rate-limited queries: "drop", "refuse", "truncate" or "forward"
+	LimitExempt    []string `toml:"limit-exempt"`     // Client networks (CIDR) that are not rate-limited
+	LimitKey       string   `toml:"limit-key"`        // Count queries by "client", "name" or "name-type"
+	LimitKeyLabels int      `toml:"limit-key-labels"` // Number of labels of the query name used for "name" and "name-type" keys
+
+	// Client-ban options, also uses Window, Prefix4 and Prefix6
+	Strikes     uint   // Number of abuse signals within the window that result in a ban
+	BanDuration uint   `toml:"ban-duration"` // Time in seconds a client remains banned
+	BanResolver string `toml:"ban-resolver"` // Resolver to use for queries from banned clients
+
+	// Maintenance options
+	MaintenanceResolver string `toml:"maintenance-resolver"` // Resolver for queries while in maintenance
+
+	// Query-quota options, also uses Prefix4 and Prefix6
+	QuotaHourly uint64                `toml:"quota-hourly"` // Number of queries allowed per hour, 0 is unlimited
+	QuotaDaily  uint64                `toml:"quota-daily"`  // Number of queries allowed per day, 0 is unlimited
+	QuotaUsers  map[string]quotaLimit `toml:"quota-users"`  // Limits for individual panel users by user ID
+
+	// Client-stats options, also uses Window, Prefix4 and Prefix6
+	MaxClients int `toml:"max-clients"` // Maximum number of users and clients tracked
+
+	// Tunnel-detector options, also uses Window
+	TunnelThreshold          int      `toml:"score-threshold"`       // Number of signals needed to consider a query suspicious
+	TunnelDomainLabels       int      `toml:"domain-labels"`         // Number of labels that form the domain, the rest is the subdomain
+	TunnelMaxEntropy         float64  `toml:"max-entropy"`           // Subdomain entropy (bits per character) above which the query is scored
+	TunnelMaxLabelLength     int      `toml:"max-label-length"`      // Label length above which the query is scored
+	TunnelMaxUniqueSubdomain int      `toml:"max-unique-subdomains"` // Unique subdomains per domain and window above which the query is scored
+	TunnelSuspiciousTypes    []string `toml:"suspicious-types"`      // Query types that are scored
+	TunnelAction             string   `toml:"action"`                // "log", "block" or "route"
+	QuarantineResolver       string   `toml:"quarantine-resolver"`   // Resolver for suspicious queries with action "route"
+
+	// Fastest options
+	ProbeInterval int  `toml:"probe-interval"` // Time in seconds between queries sent to all resolvers to measure their latency, default 60
+	RaceAll       bool `toml:"race-all"`       // Send every query to all resolvers
 
 	// Fastest-TCP probe options
-	Port          int
-	WaitAll       bool   `toml:"wait-all"`        // Wait for all probes to return and respond with a sorted list. Generally slower
-	SuccessTTLMin uint32 `toml:"success-ttl-min"` // Set the TTL of records that were probed successfully
+	Port                int
+	WaitAll             bool   `toml:"wait-all"`              // Wait for all probes to return and respond with a sorted list. Generally slower
+	SuccessTTLMin       uint32 `toml:"success-ttl-min"`       // Set the TTL of records that were probed successfully
+	Family              string `toml:"family"`                // Address family to prefer, "prefer-v4", "prefer-v6" or "balanced"
+	MaxConcurrentProbes int    `toml:"max-concurrent-probes"` // Maximum number of probes in flight, unlimited if 0
+	ProbeCacheTTL       int    `toml:"probe-cache-ttl"`       // Time in seconds probe results are re-used, not cached if 0
 
 	// Response Collapse options
 	NullRCode int `toml:"null-rcode"` // Response code if after collapsing, no answers are left
 
+	// Any-minimize options
+	AnyTTL uint32 `toml:"any-ttl"` // TTL of the HINFO record in responses to ANY queries, default 3600
+
+	// Response re-routing options
+	RerouteResolver string `toml:"reroute-resolver"` // Resolver for queries with a response that matches the blocklist
+
 	// Truncate-Retry options
 	RetryResolver string `toml:"retry-resolver"`
 
+	// Request-Dedup options
+	DedupIgnoreECS     bool  `toml:"ignore-ecs"`     // Deduplicate queries regardless of their ECS option
+	DedupClientPrefix4 uint8 `toml:"client-prefix4"` // Only deduplicate queries from the same IPv4 client network if set
+	DedupClientPrefix6 uint8 `toml:"client-prefix6"` // Only deduplicate queries from the same IPv6 client network if set
+	DedupMaxWait       int   `toml:"max-wait"`       // Maximum time in milliseconds a duplicate waits for the first answer
+
 	// Syslog options
-	Network     string `toml:"network"`  // "udp", "tcp", "unix"
+	Network     string `toml:"network"`  // "udp", "tcp", "tls", "unix"
 	Address     string `toml:"address"`  // Endpoint address, defaults to local syslog server
 	Priority    string `toml:"priority"` // Syslog priority, "emergency", "alert", "critical", "error", "warning", "notice", "info", "debug"
 	Tag         string `toml:"tag"`
 	LogRequest  bool   `toml:"log-request"`  // Logs request records to syslog
 	LogResponse bool   `toml:"log-response"` // Logs response records to syslog
 	Verbose     bool   `toml:"verbose"`      // When logging responses, include types that don't match the query type
+
+	StructuredData bool   `toml:"structured-data"` // Use RFC 5424 format with structured data
+	QueueSize      int    `toml:"queue-size"`      // Number of messages queued for sending
+	CA             string `toml:"ca"`              // CA to validate the syslog server certificate with network "tls"
+	ClientKey      string `toml:"client-key"`
+	ClientCrt      string `toml:"client-crt"`
+	ServerName     string `toml:"server-name"` // TLS server name presented in the server certificate
+
+	// Query log sampling options
+	SampleRate        uint64           `toml:"sample-rate"`         // Log one in every N queries
+	AlwaysLogFailures bool             `toml:"always-log-failures"` // Log failed, dropped and non-NOERROR queries regardless of sampling
+	SampleOverrides   []sampleOverride `toml:"sample-override"`     // Sampling rates for specific client networks
+
+	// Local-zones options
+	Zones         []string // Additional zones to answer locally
+	Exclude       []string // Default zones to forward anyway
+	NoDefaults    bool     `toml:"no-defaults"`    // Only answer the zones in "zones" locally
+	UpdateKeys    []string `toml:"update-keys"`    // Names of TSIG keys allowed to send dynamic updates
+	RecordsFile   string   `toml:"records-file"`   // File to persist records added with dynamic updates
+	TransferAllow []string `toml:"transfer-allow"` // Networks of secondaries allowed to transfer the zones
+	TransferKeys  []string `toml:"transfer-keys"`  // Names of TSIG keys zone transfers have to be signed with
+
+	// Chaos options, probabilities between 0 and 1
+	LatencyProbability  float64 `toml:"latency-probability"`  // Probability of delaying a query
+	Latency             int     `toml:"latency"`              // Delay in milliseconds
+	LatencyJitter       int     `toml:"latency-jitter"`       // Random delay in milliseconds added to the latency
+	TimeoutProbability  float64 `toml:"timeout-probability"`  // Probability of a query timing out
+	ChaosTimeout        int     `toml:"timeout"`              // Time in milliseconds before a query times out, default 2000
+	ServfailProbability float64 `toml:"servfail-probability"` // Probability of responding with SERVFAIL
+	TruncateProbability float64 `toml:"truncate-probability"` // Probability of responding with a truncated response
+
+	// DDR options
+	DDRTarget    string        `toml:"ddr-target"`    // Name of the designated resolver, has to be in the listener certificates
+	DDREndpoints []ddrEndpoint `toml:"ddr-endpoint"`  // Encrypted endpoints to advertise, in order of preference
+	DDRIPv4Hint  []string      `toml:"ddr-ipv4-hint"` // Addresses of the target
+	DDRIPv6Hint  []string      `toml:"ddr-ipv6-hint"`
+	DDRTTL       uint32        `toml:"ddr-ttl"` // TTL of the SVCB records, default 3600
+}
+
+// Encrypted endpoint advertised by a "ddr" group
+type ddrEndpoint struct {
+	Protocol string `toml:"protocol"` // "dot", "doq", "doh" or "doh3"
+	Port     uint16 `toml:"port"`
+	Path     string `toml:"path"` // URI template for DoH, default "/dns-query{?dns}"
+}
+
+// What a blocklist does with matches in a category
+type categoryAction struct {
+	Category string `toml:"category"`
+	Action   string `toml:"action"`   // "block", "log" or "redirect"
+	Resolver string `toml:"resolver"` // Resolver for "redirect"
+}
+
+// Per-client sampling rate for query logs
+type sampleOverride struct {
+	Source string `toml:"source"` // Client network in CIDR notation
+	Rate   uint64 `toml:"rate"`
+}
+
+// Per-user limits for query-quota
+type quotaLimit struct {
+	Hourly uint64 `toml:"hourly"`
+	Daily  uint64 `toml:"daily"`
 }
 
 // Block/Allowlist items for blocklist-v2
@@ -191,6 +508,23 @@ type list struct {
 	Panel        *api.Config
 	CacheDir     string `toml:"cache-dir"`     // Where to store copies of remote blocklists for faster startup
 	AllowFailure bool   `toml:"allow-failure"` // Don't fail on error and keep using the prior ruleset
+	MaxAge       int    `toml:"max-age"`       // Time in seconds after the last successful load the list is stale
+	StaleAction  string `toml:"stale-action"`  // "alert" or "servfail" for stale lists
+	AsyncLoad    bool   `toml:"async-load"`    // Load the list in the background rather than delay the startup
+	FailClosed   bool   `toml:"fail-closed"`   // Fail queries with SERVFAIL until an async-load list is loaded
+	Watch        bool   `toml:"watch"`         // Reload a local file source when it changes
+	Category     string `toml:"category"`      // Category of the rules in the list, like "ads" or "malware"
+	Audit        bool   `toml:"audit"`         // Only log and count matches of the list, don't block them
+
+	// Zone transfer options for "axfr" sources
+	TSIGName      string `toml:"tsig-name"`      // TSIG key name used to sign transfer requests
+	TSIGAlgorithm string `toml:"tsig-algorithm"` // TSIG algorithm, default hmac-sha256
+	TSIGSecret    string `toml:"tsig-secret"`    // Base64-encoded TSIG secret
+	NotifyAddress string `toml:"notify-address"` // Listen address for NOTIFY messages from the primary
+
+	// Signaled by zone transfer loaders on NOTIFY and by watched files when
+	// they change, set for blocklist-v2 only
+	notify chan struct{}
 }
 
 type router struct {
@@ -198,6 +532,7 @@ type router struct {
 }
 
 type route struct {
+	ID            string // Optional, names the route so it can be changed on the admin listener
 	Type          string // Deprecated, use "Types" instead
 	Types         []string
 	Class         string
@@ -209,7 +544,39 @@ type route struct {
 	DoHPath       string   `toml:"doh-path"` // DoH query path if received over DoH (regexp)
 	Resolver      string
 	Listener      string // ID of the listener that received the original request
-	TLSServerName string `toml:"servername"` // TLS servername
+	TLSServerName string `toml:"servername"`      // TLS servername
+	TLSClientName string `toml:"tls-client-name"` // Name in the client certificate (regexp)
+	Proxy         string // ID of the outbound proxy for upstream traffic, or "direct"
+	MAC           string // MAC address of the client resolved by the listener (regexp)
+	OriginalDst   string `toml:"original-dst"`      // Original destination of queries intercepted by a transparent listener (CIDR)
+	EDNS0Option   uint16 `toml:"edns0-option"`      // Code of an EDNS0 option captured by the listener
+	EDNS0Data     string `toml:"edns0-data"`        // Hex-encoded option data (regexp)
+	NameList      []list `toml:"name-list-source"`  // Lists of names the query needs to be in, in blocklist formats
+	NameRefresh   int    `toml:"name-list-refresh"` // Time in seconds between reloads of the name lists
+	Tag           string // Tag added by an earlier route the query needs to have
+	AddTag        string `toml:"add-tag"` // Tag added to matching queries
+	Priority      int    // Routes with higher priority are evaluated first
+	Continue      bool   // Apply proxy and tag, then continue with the next route
+}
+
+// Outbound SOCKS5 proxy that routes can send their upstream traffic through.
+type proxy struct {
+	Address      string
+	Username     string
+	Password     string
+	ResolveLocal bool   `toml:"resolve-local"` // Resolve DNS server address locally, not on the proxy
+	LocalAddr    string `toml:"local-address"`
+}
+
+// Periodic push of the metrics to statsd or InfluxDB
+type metricsPush struct {
+	Format   string            // "statsd" or "influxdb"
+	Network  string            // "udp" or "tcp", defaults to "udp"
+	Address  string            // host:port, or the URL of the InfluxDB write endpoint
+	Token    string            // InfluxDB API token
+	Interval int               // Time in seconds between pushes
+	Prefix   string            // Metric name prefix or InfluxDB measurement
+	Tags     map[string]string // Tags added to InfluxDB points
 }
 
 // LoadConfig reads a config file and returns the decoded structure.
@@ -225,7 +592,10 @@ func LoadConfig(name ...string) (Config, string, error) {
 		// Set ASSET Path and Config Path for XrayR
 		b.WriteString("\n")
 	}
-	_, err := toml.DecodeReader(b, &c)
+	if _, err := toml.DecodeReader(b, &c); err != nil {
+		return c, u, err
+	}
+	err := c.loadTenants()
 	return c, u, err
 }
 
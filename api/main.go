@@ -1,14 +1,17 @@
 package api
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	syslog "github.com/RackSec/srslog"
-	"github.com/XrayR-project/XrayR/api/sspanel"
 	rdns "github.com/folbricht/routedns"
 	"github.com/heimdalr/dag"
 	"github.com/miekg/dns"
@@ -34,7 +37,13 @@ func (n Node) ID() string {
 // Functions to call on shutdown
 var onClose []func()
 
-
+// Registers anything that holds connections or runs background loops to be
+// closed when the config is replaced or the manager shut down.
+func closeOnReload(v any) {
+	if c, ok := v.(io.Closer); ok {
+		onClose = append(onClose, func() { c.Close() })
+	}
+}
 
 // Instantiate a group object based on configuration and add to the map of resolvers by ID.
 func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) error {
@@ -65,9 +74,17 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		if len(gr) != 1 {
 			return fmt.Errorf("type panel-rotate only supports one resolver in '%s'", id)
 		}
-		resolvers[id] = rdns.NewPanelRotate(id, gr[0])
+		var panels []rdns.Resolver
+		for _, panel := range g.Panels {
+			panels = append(panels, resolvers[panel])
+		}
+		resolvers[id] = rdns.NewPanelRotate(id, gr[0], panels...)
 	case "fastest":
-		resolvers[id] = rdns.NewFastest(id, gr...)
+		opt := rdns.FastestOptions{
+			ProbeInterval: time.Duration(g.ProbeInterval) * time.Second,
+			RaceAll:       g.RaceAll,
+		}
+		resolvers[id] = rdns.NewFastest(id, opt, gr...)
 	case "random":
 		opt := rdns.RandomOptions{
 			ResetAfter:    time.Duration(time.Duration(g.ResetAfter) * time.Second),
@@ -104,6 +121,9 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 			return fmt.Errorf("static allowlist can't be used with 'source' in '%s'", id)
 		}
 		var blocklistDB rdns.BlocklistDB
+		// Reloads the blocklist when a zone transfer source receives a NOTIFY or
+		// a watched file changes
+		notify := make(chan struct{}, 1)
 		if len(g.Blocklist) > 0 {
 			blocklistDB, err = newBlocklistDB(list{Name: id, Format: g.BlocklistFormat}, g.Blocklist)
 			if err != nil {
@@ -112,6 +132,7 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		} else {
 			var dbs []rdns.BlocklistDB
 			for _, s := range g.BlocklistSource {
+				s.notify = notify
 				db, err := newBlocklistDB(s, nil)
 				if err != nil {
 					return fmt.Errorf("%s: %w", id, err)
@@ -150,6 +171,21 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 			AllowListResolver: resolvers[g.AllowListResolver],
 			AllowlistDB:       allowlistDB,
 			AllowlistRefresh:  time.Duration(g.AllowlistRefresh) * time.Second,
+
+			AllowlistLearnCNAME: time.Duration(g.AllowlistLearnCNAME) * time.Second,
+			Audit:               g.Audit,
+			SpoofPTR: rdns.SpoofPTROptions{
+				Name:         g.SpoofPTR,
+				LocalPrivate: g.LocalPrivatePTR,
+			},
+		}
+		if opt.CategoryActions, err = categoryActions(id, g.CategoryAction, resolvers); err != nil {
+			return err
+		}
+		for _, s := range g.BlocklistSource {
+			if s.NotifyAddress != "" || s.Watch {
+				opt.BlocklistNotify = notify
+			}
 		}
 		resolvers[id], err = rdns.NewBlocklist(id, gr[0], opt)
 		if err != nil {
@@ -164,10 +200,14 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		// 	return fmt.Errorf("type blocklist-panel only supports one resolver in '%s'", id)
 		// }
 
-		ApiClient := sspanel.New(&g.Panel)
+		ApiClient, err := rdns.NewPanelAPI(g.PanelType, &g.Panel)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
 		loader := rdns.NewPanelLoader(ApiClient, rdns.PanelLoaderOptions{
 			AllowlistFormat: g.AllowlistFormat,
 			BlocklistFormat: g.BlocklistFormat,
+			CacheDir:        g.PanelCache,
 		})
 		panelDB, err := loader.Get()
 		if err != nil {
@@ -181,11 +221,28 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 			AllowListResolver:   resolvers[g.AllowListResolver],
 			BlockListResolver:   resolvers[g.BlockListResolver],
 			IpAllowListResolver: resolvers[g.IpAllowListResolver],
-		}
-		resolvers[id], err = rdns.NewPanellist(id, gr[0], opt)
+			UserIdentity: rdns.PanelUserIdentity{
+				Domain: g.PanelUserDomain,
+				Path:   g.PanelUserPath,
+			},
+			UserSyncDryRun: g.PanelDryRun,
+			SessionTTL:     time.Duration(g.PanelSession) * time.Minute,
+			Stats: rdns.PanelStatsOptions{
+				Interval:          time.Duration(g.PanelStatsInterval) * time.Minute,
+				Webhook:           g.PanelStatsWebhook,
+				TopDomains:        g.PanelStatsTopDomains,
+				ReportOnlineUsers: g.PanelStatsOnlineUsers,
+			},
+			SpoofPTR: rdns.SpoofPTROptions{
+				Name:         g.SpoofPTR,
+				LocalPrivate: g.LocalPrivatePTR,
+			},
+		}
+		panellist, err := rdns.NewPanellist(id, gr[0], opt)
 		if err != nil {
 			return err
 		}
+		resolvers[id] = panellist
 	case "replace":
 		if len(gr) != 1 {
 			return fmt.Errorf("type replace only supports one resolver in '%s'", id)
@@ -226,27 +283,46 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		if len(gr) != 1 {
 			return fmt.Errorf("type truncate-retry only supports one resolver in '%s'", id)
 		}
-		retryResolver := resolvers[g.RetryResolver]
-		if retryResolver == nil {
-			return errors.New("type truncate-retry requires 'retry-resolver' option")
+		var retryResolver rdns.Resolver
+		if g.RetryResolver != "" {
+			var ok bool
+			retryResolver, ok = resolvers[g.RetryResolver]
+			if !ok {
+				return fmt.Errorf("retry-resolver '%s' not found in '%s'", g.RetryResolver, id)
+			}
 		}
 		opt := rdns.TruncateRetryOptions{}
-		resolvers[id] = rdns.NewTruncateRetry(id, gr[0], retryResolver, opt)
+		resolvers[id], err = rdns.NewTruncateRetry(id, gr[0], retryResolver, opt)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
 	case "request-dedup":
 		if len(gr) != 1 {
 			return fmt.Errorf("type request-dedup only supports one resolver in '%s'", id)
 		}
-		resolvers[id] = rdns.NewRequestDedup(id, gr[0])
+		opt := rdns.RequestDedupOptions{
+			IgnoreECS:     g.DedupIgnoreECS,
+			ClientPrefix4: g.DedupClientPrefix4,
+			ClientPrefix6: g.DedupClientPrefix6,
+			MaxWait:       time.Duration(g.DedupMaxWait) * time.Millisecond,
+		}
+		resolvers[id] = rdns.NewRequestDedup(id, gr[0], opt)
 	case "fastest-tcp":
 		if len(gr) != 1 {
 			return fmt.Errorf("type fastest-tcp only supports one resolver in '%s'", id)
 		}
 		opt := rdns.FastestTCPOptions{
-			Port:          g.Port,
-			WaitAll:       g.WaitAll,
-			SuccessTTLMin: g.SuccessTTLMin,
+			Port:                g.Port,
+			WaitAll:             g.WaitAll,
+			SuccessTTLMin:       g.SuccessTTLMin,
+			Family:              g.Family,
+			MaxConcurrentProbes: g.MaxConcurrentProbes,
+			ProbeCacheTTL:       time.Duration(g.ProbeCacheTTL) * time.Second,
+		}
+		resolvers[id], err = rdns.NewFastestTCP(id, gr[0], opt)
+		if err != nil {
+			return err
 		}
-		resolvers[id] = rdns.NewFastestTCP(id, gr[0], opt)
 	case "ecs-modifier":
 		if len(gr) != 1 {
 			return fmt.Errorf("type ecs-modifier only supports one resolver in '%s'", id)
@@ -310,14 +386,37 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		default:
 			return fmt.Errorf("unsupported syslog priority %q", g.Priority)
 		}
+		network := g.Network
+		var tlsConfig *tls.Config
+		if network == "tls" {
+			network = "tcp"
+			tlsConfig, err = rdns.TLSClientConfig(g.CA, g.ClientCrt, g.ClientKey, g.ServerName)
+			if err != nil {
+				return err
+			}
+		}
 		opt := rdns.SyslogOptions{
-			Network:     g.Network,
-			Address:     g.Address,
-			Priority:    priority,
-			Tag:         g.Tag,
-			LogRequest:  g.LogRequest,
-			LogResponse: g.LogResponse,
-			Verbose:     g.Verbose,
+			Network:        network,
+			Address:        g.Address,
+			Priority:       priority,
+			Tag:            g.Tag,
+			LogRequest:     g.LogRequest,
+			LogResponse:    g.LogResponse,
+			Verbose:        g.Verbose,
+			TLSConfig:      tlsConfig,
+			StructuredData: g.StructuredData,
+			QueueSize:      g.QueueSize,
+			Sampling: rdns.LogSamplerOptions{
+				Rate:              g.SampleRate,
+				AlwaysLogFailures: g.AlwaysLogFailures,
+			},
+		}
+		for _, o := range g.SampleOverrides {
+			_, ipNet, err := net.ParseCIDR(o.Source)
+			if err != nil {
+				return fmt.Errorf("invalid sample-override source in '%s': %w", id, err)
+			}
+			opt.Sampling.Overrides = append(opt.Sampling.Overrides, rdns.LogSampleOverride{Net: ipNet, Rate: o.Rate})
 		}
 		resolvers[id] = rdns.NewSyslog(id, gr[0], opt)
 	case "cache":
@@ -342,15 +441,17 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		}
 
 		opt := rdns.CacheOptions{
-			GCPeriod:            time.Duration(g.GCPeriod) * time.Second,
-			Capacity:            g.CacheSize,
-			NegativeTTL:         g.CacheNegativeTTL,
-			CacheRcodeMaxTTL:    cacheRcodeMaxTTL,
-			ShuffleAnswerFunc:   shuffleFunc,
-			HardenBelowNXDOMAIN: g.CacheHardenBelowNXDOMAIN,
-			FlushQuery:          g.CacheFlushQuery,
-			PrefetchTrigger:     g.PrefetchTrigger,
-			PrefetchEligible:    g.PrefetchEligible,
+			GCPeriod:              time.Duration(g.GCPeriod) * time.Second,
+			Capacity:              g.CacheSize,
+			NegativeTTL:           g.CacheNegativeTTL,
+			CacheRcodeMaxTTL:      cacheRcodeMaxTTL,
+			ShuffleAnswerFunc:     shuffleFunc,
+			HardenBelowNXDOMAIN:   g.CacheHardenBelowNXDOMAIN,
+			FlushQuery:            g.CacheFlushQuery,
+			PrefetchTrigger:       g.PrefetchTrigger,
+			PrefetchEligible:      g.PrefetchEligible,
+			PrefetchMaxConcurrent: g.PrefetchMaxConcurrent,
+			PrefetchExclude:       g.PrefetchExclude,
 		}
 		if g.Backend != nil {
 			var backend rdns.CacheBackend
@@ -361,8 +462,10 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 					GCPeriod:     time.Duration(g.Backend.GCPeriod) * time.Second,
 					Filename:     g.Backend.Filename,
 					SaveInterval: time.Duration(g.Backend.SaveInterval) * time.Second,
+					Compress:     g.Backend.Compress,
+					Shards:       g.Backend.Shards,
 				})
-				onClose = append(onClose, func() { backend.Close() })
+				closeOnReload(backend)
 			case "redis":
 				minRetryBackoff := time.Duration(g.Backend.RedisMinRetryBackoff) * time.Millisecond
 				if g.Backend.RedisMinRetryBackoff == -1 {
@@ -372,10 +475,31 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 				if g.Backend.RedisMaxRetryBackoff == -1 {
 					maxRetryBackoff = -1
 				}
+				switch g.Backend.RedisTopology {
+				case "", rdns.RedisStandalone, rdns.RedisCluster, rdns.RedisSentinel:
+				default:
+					return fmt.Errorf("unsupported redis-topology %q", g.Backend.RedisTopology)
+				}
+				if g.Backend.RedisTopology == rdns.RedisSentinel && g.Backend.RedisMasterName == "" {
+					return fmt.Errorf("redis-topology %q requires redis-master-name", rdns.RedisSentinel)
+				}
+				addrs := g.Backend.RedisAddresses
+				if len(addrs) == 0 && g.Backend.RedisAddress != "" {
+					addrs = []string{g.Backend.RedisAddress}
+				}
+				if g.Backend.RedisNetwork == "unix" && len(addrs) > 1 {
+					return errors.New("redis-network 'unix' only supports a single address")
+				}
+				var tlsConfig *tls.Config
+				if g.Backend.RedisTLS {
+					tlsConfig, err = rdns.TLSClientConfig(g.Backend.RedisCA, g.Backend.RedisClientCrt, g.Backend.RedisClientKey, g.Backend.RedisServerName)
+					if err != nil {
+						return err
+					}
+				}
 				backend = rdns.NewRedisBackend(rdns.RedisBackendOptions{
-					RedisOptions: redis.Options{
-						Network:               g.Backend.RedisNetwork,
-						Addr:                  g.Backend.RedisAddress,
+					UniversalOptions: redis.UniversalOptions{
+						Addrs:                 addrs,
 						Username:              g.Backend.RedisUsername,
 						Password:              g.Backend.RedisPassword,
 						DB:                    g.Backend.RedisDB,
@@ -383,9 +507,23 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 						MaxRetries:            g.Backend.RedisMaxRetries,
 						MinRetryBackoff:       minRetryBackoff,
 						MaxRetryBackoff:       maxRetryBackoff,
+						PoolSize:              g.Backend.RedisPoolSize,
+						MinIdleConns:          g.Backend.RedisMinIdleConns,
+						TLSConfig:             tlsConfig,
+						MasterName:            g.Backend.RedisMasterName,
+						SentinelUsername:      g.Backend.RedisSentinelUser,
+						SentinelPassword:      g.Backend.RedisSentinelPass,
 					},
-					KeyPrefix: g.Backend.RedisKeyPrefix,
+					Topology:    g.Backend.RedisTopology,
+					Network:     g.Backend.RedisNetwork,
+					KeyPrefix:   g.Backend.RedisKeyPrefix,
+					WriteBehind: g.Backend.RedisWriteBehind,
+					BatchReads:  g.Backend.RedisBatchReads,
+					BatchSize:   g.Backend.RedisBatchSize,
+					BatchDelay:  time.Duration(g.Backend.RedisBatchDelay) * time.Millisecond,
+					QueueSize:   g.Backend.RedisQueueSize,
 				})
+				closeOnReload(backend)
 			default:
 				return fmt.Errorf("unsupported cache backend %q", g.Backend.Type)
 			}
@@ -396,28 +534,9 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		if len(gr) != 1 {
 			return fmt.Errorf("type response-blocklist-ip only supports one resolver in '%s'", id)
 		}
-		if len(g.Blocklist) > 0 && len(g.BlocklistSource) > 0 {
-			return fmt.Errorf("static blocklist can't be used with 'blocklist-source' in '%s'", id)
-		}
-		var blocklistDB rdns.IPBlocklistDB
-		if len(g.Blocklist) > 0 {
-			blocklistDB, err = newIPBlocklistDB(list{Name: id, Format: g.BlocklistFormat}, g.LocationDB, g.Blocklist)
-			if err != nil {
-				return err
-			}
-		} else {
-			var dbs []rdns.IPBlocklistDB
-			for _, s := range g.BlocklistSource {
-				db, err := newIPBlocklistDB(s, g.LocationDB, nil)
-				if err != nil {
-					return fmt.Errorf("%s: %w", id, err)
-				}
-				dbs = append(dbs, db)
-			}
-			blocklistDB, err = rdns.NewMultiIPDB(dbs...)
-			if err != nil {
-				return err
-			}
+		blocklistDB, err := ipBlocklistDBFromConfig(id, g)
+		if err != nil {
+			return err
 		}
 		opt := rdns.ResponseBlocklistIPOptions{
 			BlocklistResolver: resolvers[g.BlockListResolver],
@@ -430,6 +549,25 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		if err != nil {
 			return err
 		}
+	case "response-reroute":
+		if len(gr) != 1 {
+			return fmt.Errorf("type response-reroute only supports one resolver in '%s'", id)
+		}
+		rerouteResolver, ok := resolvers[g.RerouteResolver]
+		if !ok {
+			return fmt.Errorf("reroute-resolver '%s' not found in '%s'", g.RerouteResolver, id)
+		}
+		db, err := ipBlocklistDBFromConfig(id, g)
+		if err != nil {
+			return err
+		}
+		opt := rdns.ResponseRerouteOptions{
+			RerouteResolver: rerouteResolver,
+			DB:              db,
+			Refresh:         time.Duration(g.BlocklistRefresh) * time.Second,
+			Inverted:        g.Inverted,
+		}
+		resolvers[id] = rdns.NewResponseReroute(id, gr[0], opt)
 	case "response-blocklist-name":
 		if len(gr) != 1 {
 			return fmt.Errorf("type response-blocklist-name only supports one resolver in '%s'", id)
@@ -462,6 +600,9 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 			BlocklistDB:       blocklistDB,
 			BlocklistRefresh:  time.Duration(g.BlocklistRefresh) * time.Second,
 			Inverted:          g.Inverted,
+			Sections:          g.Sections,
+			TerminalCNAMEOnly: g.TerminalCNAMEOnly,
+			Filter:            g.Filter,
 		}
 		resolvers[id], err = rdns.NewResponseBlocklistName(id, gr[0], opt)
 		if err != nil {
@@ -557,6 +698,34 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 			RCode:        g.RCode,
 			Truncate:     g.Truncate,
 			EDNS0Options: edns0Options,
+
+			AnswerOrder:   rdns.AnswerOrder(g.AnswerOrder),
+			AnswerWeights: g.AnswerWeights,
+			AnswerCount:   g.AnswerCount,
+		}
+		if c := g.BackendCheck; c != nil {
+			opt.BackendCheck = &rdns.BackendCheckOptions{
+				Protocol:  c.Protocol,
+				Port:      c.Port,
+				Path:      c.Path,
+				Host:      c.Host,
+				Interval:  time.Duration(c.Interval) * time.Second,
+				Timeout:   time.Duration(c.Timeout) * time.Second,
+				Threshold: c.Threshold,
+			}
+		}
+		if len(g.GeoAnswers) > 0 {
+			for _, geo := range g.GeoAnswers {
+				opt.GeoAnswers = append(opt.GeoAnswers, rdns.GeoAnswer{
+					Locations: geo.Locations,
+					Answer:    geo.Answer,
+					Weights:   geo.Weights,
+				})
+			}
+			opt.GeoLookup, err = rdns.NewGeoLookup(g.LocationDB)
+			if err != nil {
+				return fmt.Errorf("%s: %w", id, err)
+			}
 		}
 		resolvers[id], err = rdns.NewStaticResolver(id, opt)
 		if err != nil {
@@ -567,6 +736,14 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 			return fmt.Errorf("type response-minimize only supports one resolver in '%s'", id)
 		}
 		resolvers[id] = rdns.NewResponseMinimize(id, gr[0])
+	case "any-minimize":
+		if len(gr) != 1 {
+			return fmt.Errorf("type any-minimize only supports one resolver in '%s'", id)
+		}
+		opt := rdns.AnyMinimizeOptions{
+			TTL: g.AnyTTL,
+		}
+		resolvers[id] = rdns.NewAnyMinimize(id, gr[0], opt)
 	case "response-collapse":
 		if len(gr) != 1 {
 			return fmt.Errorf("type response-collapse only supports one resolver in '%s'", id)
@@ -577,42 +754,299 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		resolvers[id] = rdns.NewResponseCollapse(id, gr[0], opt)
 	case "drop":
 		resolvers[id] = rdns.NewDropResolver(id)
+	case "local-zones":
+		if len(gr) != 1 {
+			return fmt.Errorf("type local-zones only supports one resolver in '%s'", id)
+		}
+		transferAllow, err := parseCIDRList(g.TransferAllow)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+		opt := rdns.LocalZonesOptions{
+			Zones:         g.Zones,
+			Exclude:       g.Exclude,
+			NoDefaults:    g.NoDefaults,
+			UpdateKeys:    g.UpdateKeys,
+			RecordsFile:   g.RecordsFile,
+			TransferAllow: transferAllow,
+			TransferKeys:  g.TransferKeys,
+		}
+		resolvers[id], err = rdns.NewLocalZones(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+	case "chaos":
+		if len(gr) != 1 {
+			return fmt.Errorf("type chaos only supports one resolver in '%s'", id)
+		}
+		opt := rdns.ChaosOptions{
+			LatencyProbability:  g.LatencyProbability,
+			Latency:             time.Duration(g.Latency) * time.Millisecond,
+			LatencyJitter:       time.Duration(g.LatencyJitter) * time.Millisecond,
+			TimeoutProbability:  g.TimeoutProbability,
+			Timeout:             time.Duration(g.ChaosTimeout) * time.Millisecond,
+			ServfailProbability: g.ServfailProbability,
+			TruncateProbability: g.TruncateProbability,
+		}
+		resolvers[id], err = rdns.NewChaos(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+	case "ddr":
+		if len(gr) != 1 {
+			return fmt.Errorf("type ddr only supports one resolver in '%s'", id)
+		}
+		opt := rdns.DDROptions{
+			Target: g.DDRTarget,
+			TTL:    g.DDRTTL,
+		}
+		for _, ep := range g.DDREndpoints {
+			opt.Endpoints = append(opt.Endpoints, rdns.DDREndpoint{
+				Protocol: ep.Protocol,
+				Port:     ep.Port,
+				DoHPath:  ep.Path,
+			})
+		}
+		for _, s := range g.DDRIPv4Hint {
+			ip := net.ParseIP(s)
+			if ip == nil || ip.To4() == nil {
+				return fmt.Errorf("invalid ddr-ipv4-hint '%s' in '%s'", s, id)
+			}
+			opt.IPv4Hint = append(opt.IPv4Hint, ip)
+		}
+		for _, s := range g.DDRIPv6Hint {
+			ip := net.ParseIP(s)
+			if ip == nil || ip.To4() != nil {
+				return fmt.Errorf("invalid ddr-ipv6-hint '%s' in '%s'", s, id)
+			}
+			opt.IPv6Hint = append(opt.IPv6Hint, ip)
+		}
+		resolvers[id], err = rdns.NewDDR(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
 	case "rate-limiter":
 		if len(gr) != 1 {
 			return fmt.Errorf("type rate-limiter only supports one resolver in '%s'", id)
 		}
+		action := rdns.RateLimitAction(g.LimitAction)
+		switch action {
+		case "", rdns.RateLimitDrop, rdns.RateLimitRefuse, rdns.RateLimitTruncate:
+		case rdns.RateLimitForward:
+			if g.LimitResolver == "" {
+				return fmt.Errorf("limit-action %q requires limit-resolver in '%s'", action, id)
+			}
+		default:
+			return fmt.Errorf("unsupported limit-action %q in '%s'", action, id)
+		}
+		key := rdns.RateLimitKey(g.LimitKey)
+		switch key {
+		case "", rdns.RateLimitKeyClient, rdns.RateLimitKeyName, rdns.RateLimitKeyNameType:
+		default:
+			return fmt.Errorf("unsupported limit-key %q in '%s'", key, id)
+		}
+		exempt, err := parseCIDRList(g.LimitExempt)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
 		opt := rdns.RateLimiterOptions{
 			Requests:      g.Requests,
 			Window:        g.Window,
 			Prefix4:       g.Prefix4,
 			Prefix6:       g.Prefix6,
 			LimitResolver: resolvers[g.LimitResolver],
+			Action:        action,
+			Exempt:        exempt,
+			Key:           key,
+			KeyLabels:     g.LimitKeyLabels,
 		}
 		resolvers[id] = rdns.NewRateLimiter(id, gr[0], opt)
 
+	case "client-ban":
+		if len(gr) != 1 {
+			return fmt.Errorf("type client-ban only supports one resolver in '%s'", id)
+		}
+		opt := rdns.ClientBanOptions{
+			Strikes:     g.Strikes,
+			Window:      time.Duration(g.Window) * time.Second,
+			BanDuration: time.Duration(g.BanDuration) * time.Second,
+			BanResolver: resolvers[g.BanResolver],
+			Prefix4:     g.Prefix4,
+			Prefix6:     g.Prefix6,
+		}
+		resolvers[id] = rdns.NewClientBan(id, gr[0], opt)
+
+	case "maintenance":
+		if len(gr) != 1 {
+			return fmt.Errorf("type maintenance only supports one resolver in '%s'", id)
+		}
+		var opt rdns.MaintenanceOptions
+		if g.MaintenanceResolver != "" {
+			r, ok := resolvers[g.MaintenanceResolver]
+			if !ok {
+				return fmt.Errorf("maintenance-resolver '%s' not found in '%s'", g.MaintenanceResolver, id)
+			}
+			opt.MaintenanceResolver = r
+		}
+		resolvers[id] = rdns.NewMaintenance(id, gr[0], opt)
+
+	case "query-quota":
+		if len(gr) != 1 {
+			return fmt.Errorf("type query-quota only supports one resolver in '%s'", id)
+		}
+		users := make(map[string]rdns.QuotaLimits, len(g.QuotaUsers))
+		for user, limits := range g.QuotaUsers {
+			users[user] = rdns.QuotaLimits{Hourly: limits.Hourly, Daily: limits.Daily}
+		}
+		opt := rdns.QueryQuotaOptions{
+			QuotaLimits: rdns.QuotaLimits{Hourly: g.QuotaHourly, Daily: g.QuotaDaily},
+			Users:       users,
+			Prefix4:     g.Prefix4,
+			Prefix6:     g.Prefix6,
+		}
+		resolvers[id] = rdns.NewQueryQuota(id, gr[0], opt)
+
+	case "client-stats":
+		if len(gr) != 1 {
+			return fmt.Errorf("type client-stats only supports one resolver in '%s'", id)
+		}
+		opt := rdns.ClientStatsOptions{
+			Window:     time.Duration(g.Window) * time.Second,
+			Prefix4:    g.Prefix4,
+			Prefix6:    g.Prefix6,
+			MaxClients: g.MaxClients,
+		}
+		resolvers[id] = rdns.NewClientStats(id, gr[0], opt)
+
+	case "tunnel-detector":
+		if len(gr) != 1 {
+			return fmt.Errorf("type tunnel-detector only supports one resolver in '%s'", id)
+		}
+		action := rdns.TunnelAction(g.TunnelAction)
+		switch action {
+		case "", rdns.TunnelActionLog, rdns.TunnelActionBlock:
+		case rdns.TunnelActionRoute:
+			if g.QuarantineResolver == "" {
+				return fmt.Errorf("action %q requires quarantine-resolver in '%s'", action, id)
+			}
+		default:
+			return fmt.Errorf("unsupported action %q in '%s'", action, id)
+		}
+		var types []uint16
+		for _, t := range g.TunnelSuspiciousTypes {
+			qtype, ok := dns.StringToType[strings.ToUpper(t)]
+			if !ok {
+				return fmt.Errorf("invalid query type %q in '%s'", t, id)
+			}
+			types = append(types, qtype)
+		}
+		opt := rdns.TunnelDetectorOptions{
+			Threshold:           g.TunnelThreshold,
+			DomainLabels:        g.TunnelDomainLabels,
+			MaxEntropy:          g.TunnelMaxEntropy,
+			MaxLabelLength:      g.TunnelMaxLabelLength,
+			MaxUniqueSubdomains: g.TunnelMaxUniqueSubdomain,
+			Window:              time.Duration(g.Window) * time.Second,
+			SuspiciousTypes:     types,
+			Action:              action,
+			QuarantineResolver:  resolvers[g.QuarantineResolver],
+		}
+		resolvers[id] = rdns.NewTunnelDetector(id, gr[0], opt)
+
 	default:
 		return fmt.Errorf("unsupported group type '%s' for group '%s'", g.Type, id)
 	}
+
+	// Limit the time the group can take to answer if a timeout is configured
+	if g.QueryTimeout > 0 {
+		opt := rdns.TimeoutOptions{
+			Timeout: time.Duration(g.QueryTimeout) * time.Second,
+		}
+		resolvers[id] = rdns.NewTimeout(id, resolvers[id], opt)
+	}
 	return nil
 }
 
 // Instantiate a router object based on configuration and add to the map of resolvers by ID.
-func instantiateRouter(id string, r router, resolvers map[string]rdns.Resolver) error {
+func instantiateRouter(id string, r router, resolvers map[string]rdns.Resolver, proxies map[string]*rdns.Socks5Dialer) error {
 	router := rdns.NewRouter(id)
+	routeIDs := make(map[string]struct{})
 	for _, route := range r.Routes {
-		resolver, ok := resolvers[route.Resolver]
-		if !ok {
-			return fmt.Errorf("router '%s' references non-existent resolver or group '%s'", id, route.Resolver)
+		if route.ID != "" {
+			if _, ok := routeIDs[route.ID]; ok {
+				return fmt.Errorf("router '%s' has more than one route with id '%s'", id, route.ID)
+			}
+			routeIDs[route.ID] = struct{}{}
+		}
+		var resolver rdns.Resolver
+		if route.Continue {
+			if route.Resolver != "" {
+				return fmt.Errorf("router '%s' has a route with continue and resolver '%s'", id, route.Resolver)
+			}
+		} else {
+			var ok bool
+			resolver, ok = resolvers[route.Resolver]
+			if !ok {
+				return fmt.Errorf("router '%s' references non-existent resolver or group '%s'", id, route.Resolver)
+			}
 		}
 		types := route.Types
 		if route.Type != "" { // Support the deprecated "Type" by just adding it to "Types" if defined
 			types = append(types, route.Type)
 		}
-		r, err := rdns.NewRoute(route.Name, route.Class, types, route.Weekdays, route.Before, route.After, route.Source, route.DoHPath, route.Listener, route.TLSServerName, resolver)
+		r, err := rdns.NewRoute(route.Name, route.Class, types, route.Weekdays, route.Before, route.After, route.Source, route.DoHPath, route.Listener, route.TLSServerName, route.TLSClientName, resolver)
 		if err != nil {
 			return fmt.Errorf("failure parsing routes for router '%s' : %s", id, err.Error())
 		}
 		r.Invert(route.Invert)
+		if route.MAC != "" {
+			if err := r.MatchMAC(route.MAC); err != nil {
+				return fmt.Errorf("failure parsing routes for router '%s' : %s", id, err.Error())
+			}
+		}
+		if route.OriginalDst != "" {
+			if err := r.MatchOriginalDst(route.OriginalDst); err != nil {
+				return fmt.Errorf("failure parsing routes for router '%s' : %s", id, err.Error())
+			}
+		}
+		if route.EDNS0Option != 0 {
+			if err := r.MatchEDNS0(route.EDNS0Option, route.EDNS0Data); err != nil {
+				return fmt.Errorf("failure parsing routes for router '%s' : %s", id, err.Error())
+			}
+		} else if route.EDNS0Data != "" {
+			return fmt.Errorf("router '%s' uses edns0-data without edns0-option", id)
+		}
+		if route.Proxy != "" {
+			dialer, ok := proxies[route.Proxy]
+			if !ok {
+				return fmt.Errorf("router '%s' references non-existent proxy '%s'", id, route.Proxy)
+			}
+			r.SetProxy(dialer)
+		}
+		if len(route.NameList) > 0 {
+			var dbs []rdns.BlocklistDB
+			for _, l := range route.NameList {
+				db, err := newBlocklistDB(l, nil)
+				if err != nil {
+					return fmt.Errorf("failure parsing routes for router '%s' : %s", id, err.Error())
+				}
+				dbs = append(dbs, db)
+			}
+			db, err := rdns.NewMultiDB(dbs...)
+			if err != nil {
+				return err
+			}
+			r.MatchNameDB(db, time.Duration(route.NameRefresh)*time.Second)
+		}
+		r.SetID(route.ID)
+		r.MatchTag(route.Tag)
+		r.AddTag(route.AddTag)
+		r.SetPriority(route.Priority)
+		if route.Continue {
+			if err := r.SetContinue(); err != nil {
+				return fmt.Errorf("failure parsing routes for router '%s' : %s", id, err.Error())
+			}
+		}
 		router.Add(r)
 	}
 	resolvers[id] = router
@@ -635,29 +1069,127 @@ func newBlocklistDB(l list, rules []string) (rdns.BlocklistDB, error) {
 		switch loc.Scheme {
 		case "http", "https":
 			opt := rdns.HTTPLoaderOptions{
-				CacheDir:     l.CacheDir,
-				AllowFailure: l.AllowFailure,
+				CacheDir: l.CacheDir,
 			}
 			loader = rdns.NewHTTPLoader(l.Source, opt)
 		case "":
-			opt := rdns.FileLoaderOptions{
-				AllowFailure: l.AllowFailure,
+			opt := rdns.FileLoaderOptions{}
+			if l.Watch {
+				if l.notify == nil {
+					return nil, fmt.Errorf("watch is not supported for source '%s'", l.Source)
+				}
+				opt.Notify = l.notify
 			}
 			loader = rdns.NewFileLoader(l.Source, opt)
+		case "axfr":
+			opt := rdns.XFRLoaderOptions{
+				TSIGName:      l.TSIGName,
+				TSIGAlgorithm: l.TSIGAlgorithm,
+				TSIGSecret:    l.TSIGSecret,
+				NotifyAddress: l.NotifyAddress,
+				Notify:        l.notify,
+			}
+			server := rdns.AddressWithDefault(loc.Host, rdns.PlainDNSPort)
+			xfr, err := rdns.NewXFRLoader(server, strings.TrimPrefix(loc.Path, "/"), opt)
+			if err != nil {
+				return nil, fmt.Errorf("source '%s': %w", l.Source, err)
+			}
+			loader = xfr
+			// Zones are turned into domain rules
+			if l.Format == "" {
+				l.Format = "domain"
+			}
 		default:
 			return nil, fmt.Errorf("unsupported scheme '%s' in '%s'", loc.Scheme, l.Source)
 		}
+		closeOnReload(loader)
+		if loader, err = newMonitoredLoader(name, l, loader); err != nil {
+			return nil, err
+		}
 	}
+	var newDB func() (rdns.BlocklistDB, error)
 	switch l.Format {
 	case "regexp", "":
-		return rdns.NewRegexpDB(name, loader)
+		newDB = func() (rdns.BlocklistDB, error) { return rdns.NewRegexpDB(name, loader) }
 	case "domain":
-		return rdns.NewDomainDB(name, loader)
+		newDB = func() (rdns.BlocklistDB, error) { return rdns.NewDomainDB(name, loader) }
 	case "hosts":
-		return rdns.NewHostsDB(name, loader)
+		newDB = func() (rdns.BlocklistDB, error) { return rdns.NewHostsDB(name, loader) }
 	default:
 		return nil, fmt.Errorf("unsupported format '%s'", l.Format)
 	}
+	if l.Category != "" {
+		load := newDB
+		newDB = func() (rdns.BlocklistDB, error) {
+			db, err := load()
+			if err != nil {
+				return nil, err
+			}
+			return rdns.NewCategoryDB(l.Category, db), nil
+		}
+	}
+	if l.Audit {
+		load := newDB
+		newDB = func() (rdns.BlocklistDB, error) {
+			db, err := load()
+			if err != nil {
+				return nil, err
+			}
+			return rdns.NewAuditDB(db), nil
+		}
+	}
+	if l.AsyncLoad && len(rules) == 0 {
+		db := rdns.NewAsyncDB(name, newDB, rdns.AsyncDBOptions{FailClosed: l.FailClosed})
+		closeOnReload(db)
+		return db, nil
+	}
+	return newDB()
+}
+
+// Returns the actions of a blocklist by category.
+func categoryActions(id string, actions []categoryAction, resolvers map[string]rdns.Resolver) (map[string]rdns.CategoryAction, error) {
+	if len(actions) == 0 {
+		return nil, nil
+	}
+	m := make(map[string]rdns.CategoryAction)
+	for _, a := range actions {
+		if a.Category == "" {
+			return nil, fmt.Errorf("missing category in category-action of '%s'", id)
+		}
+		action := rdns.CategoryAction{Action: a.Action}
+		switch a.Action {
+		case rdns.CategoryActionBlock, rdns.CategoryActionLog:
+		case rdns.CategoryActionRedirect:
+			action.Resolver = resolvers[a.Resolver]
+			if action.Resolver == nil {
+				return nil, fmt.Errorf("category '%s' in '%s' requires a resolver for action '%s'", a.Category, id, a.Action)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported action '%s' for category '%s' in '%s'", a.Action, a.Category, id)
+		}
+		m[a.Category] = action
+	}
+	return m, nil
+}
+
+// Returns the IP database of a group from its static blocklist or blocklist
+// sources.
+func ipBlocklistDBFromConfig(id string, g group) (rdns.IPBlocklistDB, error) {
+	if len(g.Blocklist) > 0 && len(g.BlocklistSource) > 0 {
+		return nil, fmt.Errorf("static blocklist can't be used with 'blocklist-source' in '%s'", id)
+	}
+	if len(g.Blocklist) > 0 {
+		return newIPBlocklistDB(list{Name: id, Format: g.BlocklistFormat}, g.LocationDB, g.Blocklist)
+	}
+	var dbs []rdns.IPBlocklistDB
+	for _, s := range g.BlocklistSource {
+		db, err := newIPBlocklistDB(s, g.LocationDB, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", id, err)
+		}
+		dbs = append(dbs, db)
+	}
+	return rdns.NewMultiIPDB(dbs...)
 }
 
 func newIPBlocklistDB(l list, locationDB string, rules []string) (rdns.IPBlocklistDB, error) {
@@ -676,20 +1208,23 @@ func newIPBlocklistDB(l list, locationDB string, rules []string) (rdns.IPBlockli
 		switch loc.Scheme {
 		case "http", "https":
 			opt := rdns.HTTPLoaderOptions{
-				CacheDir:     l.CacheDir,
-				AllowFailure: l.AllowFailure,
+				CacheDir: l.CacheDir,
 			}
 			loader = rdns.NewHTTPLoader(l.Source, opt)
 		case "":
-			opt := rdns.FileLoaderOptions{
-				AllowFailure: l.AllowFailure,
-			}
-			loader = rdns.NewFileLoader(l.Source, opt)
+			loader = rdns.NewFileLoader(l.Source, rdns.FileLoaderOptions{})
 		default:
 			return nil, fmt.Errorf("unsupported scheme '%s' in '%s'", loc.Scheme, l.Source)
 		}
+		closeOnReload(loader)
+		if loader, err = newMonitoredLoader(name, l, loader); err != nil {
+			return nil, err
+		}
 	}
 
+	if l.AsyncLoad {
+		return nil, fmt.Errorf("async-load is not supported for IP lists in '%s'", l.Source)
+	}
 	switch l.Format {
 	case "cidr", "":
 		return rdns.NewCidrDB(name, loader)
@@ -700,6 +1235,23 @@ func newIPBlocklistDB(l list, locationDB string, rules []string) (rdns.IPBlockli
 	}
 }
 
+// Wraps the loader of a list source to record its refresh status. Failures
+// are allowed by the monitor rather than the loader itself so they're recorded.
+func newMonitoredLoader(name string, l list, loader rdns.BlocklistLoader) (rdns.BlocklistLoader, error) {
+	switch l.StaleAction {
+	case "", rdns.StaleActionAlert, rdns.StaleActionServfail:
+	default:
+		return nil, fmt.Errorf("unsupported stale-action '%s' for '%s'", l.StaleAction, l.Source)
+	}
+	return rdns.NewMonitoredLoader(loader, rdns.MonitoredLoaderOptions{
+		Name:         name,
+		Source:       l.Source,
+		AllowFailure: l.AllowFailure,
+		MaxAge:       time.Duration(l.MaxAge) * time.Second,
+		StaleAction:  l.StaleAction,
+	}), nil
+}
+
 func printVersion() {
 	fmt.Println("Build: ", rdns.BuildNumber)
 	fmt.Println("Build Time: ", rdns.BuildTime)
@@ -1,16 +1,67 @@
 package api
 
 import (
+	"crypto/tls"
+	"encoding/base64"
 	"fmt"
 	"net"
+	"net/url"
 	"time"
 
 	rdns "github.com/folbricht/routedns"
+	"github.com/sirupsen/logrus"
 )
 
 // Instantiates an rdns.Resolver from a resolver config
 func instantiateResolver(id string, r resolver, resolvers map[string]rdns.Resolver) error {
 	var err error
+
+	// Take the protocol and address from a DNS stamp
+	if rdns.IsStamp(r.Address) {
+		if r, err = resolverFromStamp(id, r); err != nil {
+			return fmt.Errorf("resolver '%s': %w", id, err)
+		}
+	}
+
+	// Padding of queries sent over encrypted protocols
+	padding, err := rdns.ParsePaddingPolicy(r.Padding, r.PaddingBlockSize)
+	if err != nil {
+		return fmt.Errorf("resolver '%s': %w", id, err)
+	}
+	if padding.Mode == rdns.PaddingMaximal {
+		return fmt.Errorf("resolver '%s': padding mode '%s' is only supported in listeners", id, padding.Mode)
+	}
+
+	pipeline := rdns.PipelineOptions{
+		MaxInflight:         r.ConnectionMaxInflight,
+		Connections:         r.Connections,
+		ReconnectBackoff:    time.Duration(r.ReconnectBackoff) * time.Millisecond,
+		MaxReconnectBackoff: time.Duration(r.MaxReconnectBackoff) * time.Millisecond,
+		InOrder:             r.InOrder,
+	}
+	keepAlive := time.Duration(r.KeepAlive) * time.Second
+
+	// Find the endpoints in DNS and create a resolver for each of them
+	if r.Discovery != "" {
+		resolvers[id], err = instantiateDiscovery(id, r)
+		if err != nil {
+			return fmt.Errorf("resolver '%s': %w", id, err)
+		}
+		return wrapResolver(id, r, resolvers)
+	}
+
+	if r.DDR && r.Protocol != "udp" && r.Protocol != "tcp" {
+		return fmt.Errorf("resolver '%s': ddr is only supported for udp and tcp resolvers", id)
+	}
+	if r.TSIGName != "" {
+		if r.Protocol != "udp" && r.Protocol != "tcp" || r.DDR {
+			return fmt.Errorf("resolver '%s': tsig is only supported for udp and tcp resolvers without ddr", id)
+		}
+		if _, err := base64.StdEncoding.DecodeString(r.TSIGSecret); err != nil || r.TSIGSecret == "" {
+			return fmt.Errorf("resolver '%s': invalid tsig-secret", id)
+		}
+	}
+
 	switch r.Protocol {
 
 	case "doq":
@@ -20,11 +71,14 @@ func instantiateResolver(id string, r resolver, resolvers map[string]rdns.Resolv
 		if err != nil {
 			return err
 		}
+		setVerifyConnection(r, tlsConfig)
 		opt := rdns.DoQClientOptions{
 			BootstrapAddr: r.BootstrapAddr,
 			LocalAddr:     net.ParseIP(r.LocalAddr),
 			TLSConfig:     tlsConfig,
 			QueryTimeout:  time.Duration(r.QueryTimeout) * time.Second,
+			Padding:       padding,
+			KeepAlive:     keepAlive,
 			Lego:          &r.Lego,
 		}
 		resolvers[id], err = rdns.NewDoQClient(id, r.Address, opt)
@@ -38,14 +92,18 @@ func instantiateResolver(id string, r resolver, resolvers map[string]rdns.Resolv
 		if err != nil {
 			return err
 		}
+		setVerifyConnection(r, tlsConfig)
 		opt := rdns.DoTClientOptions{
 			BootstrapAddr: r.BootstrapAddr,
 			LocalAddr:     net.ParseIP(r.LocalAddr),
 			TLSConfig:     tlsConfig,
 			QueryTimeout:  time.Duration(r.QueryTimeout) * time.Second,
+			Pipeline:      pipeline,
+			Padding:       padding,
 			Dialer:        socks5DialerFromConfig(r),
 			Lego:          &r.Lego,
 		}
+		opt.Pipeline.KeepAlive = keepAlive
 		resolvers[id], err = rdns.NewDoTClient(id, r.Address, opt)
 		if err != nil {
 			return err
@@ -63,12 +121,32 @@ func instantiateResolver(id string, r resolver, resolvers map[string]rdns.Resolv
 			DTLSConfig:    dtlsConfig,
 			UDPSize:       r.EDNS0UDPSize,
 			QueryTimeout:  time.Duration(r.QueryTimeout) * time.Second,
+			Pipeline:      pipeline,
+			Padding:       padding,
 			Lego:          &r.Lego,
 		}
 		resolvers[id], err = rdns.NewDTLSClient(id, r.Address, opt)
 		if err != nil {
 			return err
 		}
+	case "dows":
+		tlsConfig, err := rdns.TLSClientConfig(r.CA, r.ClientCrt, r.ClientKey, r.ServerName)
+		if err != nil {
+			return err
+		}
+		opt := rdns.DoWSClientOptions{
+			BootstrapAddr: r.BootstrapAddr,
+			LocalAddr:     net.ParseIP(r.LocalAddr),
+			TLSConfig:     tlsConfig,
+			QueryTimeout:  time.Duration(r.QueryTimeout) * time.Second,
+			Pipeline:      pipeline,
+			Padding:       padding,
+			Dialer:        socks5DialerFromConfig(r),
+		}
+		resolvers[id], err = rdns.NewDoWSClient(id, r.Address, opt)
+		if err != nil {
+			return err
+		}
 	case "doh":
 		r.Address = rdns.AddressWithDefault(r.Address, rdns.DoHPort)
 
@@ -76,6 +154,7 @@ func instantiateResolver(id string, r resolver, resolvers map[string]rdns.Resolv
 		if err != nil {
 			return err
 		}
+		setVerifyConnection(r, tlsConfig)
 		opt := rdns.DoHClientOptions{
 			Method:        r.DoH.Method,
 			TLSConfig:     tlsConfig,
@@ -83,6 +162,8 @@ func instantiateResolver(id string, r resolver, resolvers map[string]rdns.Resolv
 			Transport:     r.Transport,
 			LocalAddr:     net.ParseIP(r.LocalAddr),
 			QueryTimeout:  time.Duration(r.QueryTimeout) * time.Second,
+			Padding:       padding,
+			KeepAlive:     keepAlive,
 			Dialer:        socks5DialerFromConfig(r),
 			Lego:          &r.Lego,
 		}
@@ -97,18 +178,273 @@ func instantiateResolver(id string, r resolver, resolvers map[string]rdns.Resolv
 			LocalAddr:    net.ParseIP(r.LocalAddr),
 			UDPSize:      r.EDNS0UDPSize,
 			QueryTimeout: time.Duration(r.QueryTimeout) * time.Second,
+			TCPFallback:  r.TCPFallback,
+			Pipeline:     pipeline,
 			Dialer:       socks5DialerFromConfig(r),
+
+			ValidateResponses: r.ValidateResponses,
+
+			TSIGName:      r.TSIGName,
+			TSIGAlgorithm: r.TSIGAlgorithm,
+			TSIGSecret:    r.TSIGSecret,
 		}
 		resolvers[id], err = rdns.NewDNSClient(id, r.Address, r.Protocol, opt)
 		if err != nil {
 			return err
 		}
+
+		// Upgrade to the designated encrypted resolver if there is one
+		if r.DDR {
+			resolvers[id], err = instantiateDDRUpgrade(id, r, resolvers[id])
+			if err != nil {
+				return fmt.Errorf("resolver '%s': %w", id, err)
+			}
+		}
 	default:
 		return fmt.Errorf("unsupported protocol '%s' for resolver '%s'", r.Protocol, id)
 	}
+	return wrapResolver(id, r, resolvers)
+}
+
+// Wraps a resolver in the loop guard and inflight limiter if configured.
+func wrapResolver(id string, r resolver, resolvers map[string]rdns.Resolver) error {
+	// Mark queries with the instance ID to detect loops back to a listener
+	if r.LoopGuard {
+		resolvers[id] = rdns.NewLoopGuard(id, resolvers[id])
+	}
+
+	// Limit the number of concurrent queries to this upstream if configured
+	if r.MaxInflight > 0 {
+		opt := rdns.InflightLimiterOptions{
+			MaxInflight:  r.MaxInflight,
+			QueueSize:    r.QueueSize,
+			QueueTimeout: time.Duration(r.QueueTimeout) * time.Millisecond,
+		}
+		if r.OverflowResolver != "" {
+			overflow, ok := resolvers[r.OverflowResolver]
+			if !ok {
+				return fmt.Errorf("overflow-resolver '%s' not found in resolver '%s'", r.OverflowResolver, id)
+			}
+			opt.OverflowResolver = overflow
+		}
+		resolvers[id] = rdns.NewInflightLimiter(id, resolvers[id], opt)
+	} else if r.OverflowResolver != "" {
+		return fmt.Errorf("overflow-resolver requires max-inflight in resolver '%s'", id)
+	}
 	return nil
 }
 
+// Instantiates a resolver that discovers its endpoints in DNS. The resolvers
+// of the endpoints are created from the same config, with the discovered
+// address as bootstrap address, or as address for plain DNS and SRV records.
+func instantiateDiscovery(id string, r resolver) (rdns.Resolver, error) {
+	var name, port string
+	switch r.Protocol {
+	case "doh", "dows":
+		if r.Discovery == "srv" {
+			return nil, fmt.Errorf("discovery with srv records is not supported for protocol '%s'", r.Protocol)
+		}
+		u, err := url.Parse(r.Address)
+		if err != nil {
+			return nil, err
+		}
+		name = u.Hostname()
+	case "udp", "tcp", "doq", "dot", "dtls":
+		if r.Discovery == "srv" {
+			name = r.Address
+			break
+		}
+		var defaultPort string
+		switch r.Protocol {
+		case "doq":
+			defaultPort = rdns.DoQPort
+		case "dot":
+			defaultPort = rdns.DoTPort
+		case "dtls":
+			defaultPort = rdns.DTLSPort
+		default:
+			defaultPort = rdns.PlainDNSPort
+		}
+		var err error
+		name, port, err = net.SplitHostPort(rdns.AddressWithDefault(r.Address, defaultPort))
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported protocol '%s'", r.Protocol)
+	}
+
+	// The loop guard and limiter apply to all endpoints together. Keepalives
+	// are disabled since the resolvers of endpoints that go away aren't closed.
+	endpoint := r
+	endpoint.Discovery = ""
+	endpoint.LoopGuard = false
+	endpoint.MaxInflight = 0
+	endpoint.OverflowResolver = ""
+	endpoint.KeepAlive = 0
+
+	opt := rdns.DiscoveryOptions{
+		Mode:     r.Discovery,
+		Name:     name,
+		Interval: time.Duration(r.DiscoveryInterval) * time.Second,
+		NewResolver: func(ep rdns.DiscoveredEndpoint) (rdns.Resolver, error) {
+			cfg := endpoint
+			switch {
+			case ep.IP == nil:
+				cfg.Address = ep.Address()
+			case cfg.Protocol == "udp" || cfg.Protocol == "tcp":
+				cfg.Address = net.JoinHostPort(ep.IP.String(), port)
+			default:
+				cfg.BootstrapAddr = ep.IP.String()
+			}
+			endpointID := fmt.Sprintf("%s[%s]", id, ep.Address())
+			resolvers := make(map[string]rdns.Resolver)
+			if err := instantiateResolver(endpointID, cfg, resolvers); err != nil {
+				return nil, err
+			}
+			return resolvers[endpointID], nil
+		},
+	}
+	discovery, err := rdns.NewDiscovery(id, opt)
+	if err != nil {
+		return nil, err
+	}
+	return discovery, nil
+}
+
+// Instantiates a resolver that upgrades a plain DNS resolver to its designated
+// resolver. The designated resolvers are created from the same config, and
+// their certificate has to be valid for the IP of the plain resolver.
+func instantiateDDRUpgrade(id string, r resolver, plain rdns.Resolver) (rdns.Resolver, error) {
+	host, _, err := net.SplitHostPort(r.Address)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("ddr requires an IP address, not '%s'", host)
+	}
+
+	// The loop guard and limiter apply to the upgraded resolver as a whole
+	designated := r
+	designated.DDR = false
+	designated.Discovery = ""
+	designated.LoopGuard = false
+	designated.MaxInflight = 0
+	designated.OverflowResolver = ""
+	designated.ServerName = ""
+	designated.ddrVerifyIP = ip
+
+	opt := rdns.DDRUpgradeOptions{
+		NewResolver: func(d rdns.DesignatedResolver) (rdns.Resolver, error) {
+			cfg := designated
+			cfg.Address = d.Address()
+			cfg.Protocol = d.Protocol
+			switch d.Protocol {
+			case "doh":
+				cfg.Transport = "tcp"
+			case "doh3":
+				cfg.Protocol = "doh"
+				cfg.Transport = "quic"
+			}
+			cfg.BootstrapAddr = ""
+			if len(d.Hints) > 0 {
+				cfg.BootstrapAddr = d.Hints[0].String()
+			}
+			designatedID := fmt.Sprintf("%s[%s]", id, d.Protocol)
+			resolvers := make(map[string]rdns.Resolver)
+			if err := instantiateResolver(designatedID, cfg, resolvers); err != nil {
+				return nil, err
+			}
+			return resolvers[designatedID], nil
+		},
+	}
+	return rdns.NewDDRUpgrade(id, plain, opt)
+}
+
+// Sets additional checks of the server certificate, for designated resolvers
+// and servers with certificate hashes in their stamp.
+func setVerifyConnection(r resolver, tlsConfig *tls.Config) {
+	switch {
+	case r.ddrVerifyIP != nil:
+		tlsConfig.VerifyConnection = rdns.DDRVerifyConnection(r.ddrVerifyIP)
+	case len(r.stampHashes) > 0:
+		tlsConfig.VerifyConnection = rdns.StampVerifyConnection(r.stampHashes)
+	}
+}
+
+// Returns the resolver config with protocol, address and bootstrap address
+// taken from the DNS stamp in the address. The protocol is optional, but has
+// to match the stamp if set. Plain DNS stamps can be used with UDP or TCP.
+func resolverFromStamp(id string, r resolver) (resolver, error) {
+	stamp, err := rdns.ParseStamp(r.Address)
+	if err != nil {
+		return r, err
+	}
+	var protocol string
+	switch stamp.Protocol {
+	case rdns.StampPlain:
+		protocol = "udp"
+		if r.Protocol == "tcp" {
+			protocol = "tcp"
+		}
+	case rdns.StampDoT:
+		protocol = "dot"
+	case rdns.StampDoQ:
+		protocol = "doq"
+	case rdns.StampDoH:
+		protocol = "doh"
+	default:
+		return r, fmt.Errorf("unsupported stamp protocol %s", stamp.Protocol)
+	}
+	if r.Protocol != "" && r.Protocol != protocol {
+		return r, fmt.Errorf("protocol '%s' doesn't match the %s stamp", r.Protocol, stamp.Protocol)
+	}
+	address, bootstrapAddr, err := stamp.Endpoint()
+	if err != nil {
+		return r, err
+	}
+	r.Protocol = protocol
+	r.Address = address
+	if r.BootstrapAddr == "" {
+		r.BootstrapAddr = bootstrapAddr
+	}
+	r.stampHashes = stamp.Hashes
+	rdns.Log.WithFields(logrus.Fields{
+		"id":        id,
+		"protocol":  protocol,
+		"address":   address,
+		"dnssec":    stamp.Props&rdns.StampDNSSEC != 0,
+		"no-log":    stamp.Props&rdns.StampNoLog != 0,
+		"no-filter": stamp.Props&rdns.StampNoFilter != 0,
+	}).Debug("resolver configured from stamp")
+	return r, nil
+}
+
+// Returns the outbound proxies routes can use, by ID. The reserved ID "direct"
+// maps to nil, meaning no proxy.
+func instantiateProxies(cfg map[string]proxy) (map[string]*rdns.Socks5Dialer, error) {
+	proxies := map[string]*rdns.Socks5Dialer{"direct": nil}
+	for id, p := range cfg {
+		if id == "direct" {
+			return nil, fmt.Errorf("proxy id '%s' is reserved", id)
+		}
+		if p.Address == "" {
+			return nil, fmt.Errorf("no address for proxy '%s'", id)
+		}
+		proxies[id] = rdns.NewSocks5Dialer(
+			p.Address,
+			rdns.Socks5DialerOptions{
+				Username:     p.Username,
+				Password:     p.Password,
+				UDPTimeout:   5 * time.Second,
+				ResolveLocal: p.ResolveLocal,
+				LocalAddr:    net.ParseIP(p.LocalAddr),
+			})
+	}
+	return proxies, nil
+}
+
 // Returns a dialer if a socks5 proxy is configured, nil otherwise
 func socks5DialerFromConfig(cfg resolver) rdns.Dialer {
 	if cfg.Socks5Address == "" {
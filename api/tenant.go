@@ -0,0 +1,236 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	rdns "github.com/folbricht/routedns"
+)
+
+// Separate configuration hosted in the same process, like that of a customer.
+// The listeners, resolvers, groups, routers and proxies of a tenant are loaded
+// from its own files and get IDs prefixed with the tenant name, so they can't
+// conflict with other tenants and their metrics and logs are kept apart.
+type tenant struct {
+	Config []string // Config files of the tenant
+
+	// Limits of the tenant, shared by all its listeners and caches
+	MaxQPS         int `toml:"max-qps"`         // Maximum number of queries per second
+	MaxConnections int `toml:"max-connections"` // Maximum number of concurrent connections
+	MaxCacheSize   int `toml:"max-cache-size"`  // Maximum number of items in each cache
+}
+
+var validTenantName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// Loads the config files of all tenants and adds their elements.
+func (c *Config) loadTenants() error {
+	for name, t := range c.Tenants {
+		if !validTenantName.MatchString(name) {
+			return fmt.Errorf("invalid tenant name '%s'", name)
+		}
+		if len(t.Config) == 0 {
+			return fmt.Errorf("tenant '%s' has no config files", name)
+		}
+		// Decoded without loading tenants since they can't be nested
+		b := new(bytes.Buffer)
+		for _, fn := range t.Config {
+			if err := LoadFile(b, fn); err != nil {
+				return fmt.Errorf("tenant '%s': %w", name, err)
+			}
+			b.WriteString("\n")
+		}
+		var tc Config
+		if _, err := toml.DecodeReader(b, &tc); err != nil {
+			return fmt.Errorf("tenant '%s': %w", name, err)
+		}
+		if err := limitCaches(tc, t.MaxCacheSize); err != nil {
+			return fmt.Errorf("tenant '%s': %w", name, err)
+		}
+		if err := c.addTenant(name, tc); err != nil {
+			return fmt.Errorf("tenant '%s': %w", name, err)
+		}
+	}
+	return nil
+}
+
+// TenantFiles returns the config files of all tenants, sorted by tenant.
+func (c Config) TenantFiles() []string {
+	names := make([]string, 0, len(c.Tenants))
+	for name := range c.Tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var files []string
+	for _, name := range names {
+		files = append(files, c.Tenants[name].Config...)
+	}
+	return files
+}
+
+// Adds the elements of a tenant to the config with prefixed IDs, and updates
+// the references between them.
+func (c *Config) addTenant(name string, tc Config) error {
+	switch {
+	case len(tc.Tenants) > 0:
+		return errors.New("tenants can't be nested")
+	case tc.BootstrapResolver.Address != "":
+		return errors.New("bootstrap-resolver is only supported in the main config")
+	case tc.Privileges.User != "":
+		return errors.New("privileges are only supported in the main config")
+	case len(tc.MetricsPush) > 0:
+		return errors.New("metrics-push is only supported in the main config")
+	}
+	id := func(id string) string {
+		if id == "" {
+			return ""
+		}
+		return rdns.TenantID(name, id)
+	}
+	ids := func(ids []string) []string {
+		var out []string
+		for _, s := range ids {
+			out = append(out, id(s))
+		}
+		return out
+	}
+	if c.Listeners == nil {
+		c.Listeners = make(map[string]listener)
+	}
+	if c.Resolvers == nil {
+		c.Resolvers = make(map[string]resolver)
+	}
+	if c.Groups == nil {
+		c.Groups = make(map[string]group)
+	}
+	if c.Routers == nil {
+		c.Routers = make(map[string]router)
+	}
+	if c.Proxies == nil {
+		c.Proxies = make(map[string]proxy)
+	}
+	for k, l := range tc.Listeners {
+		l.Resolver = id(l.Resolver)
+		l.HealthResolvers = ids(l.HealthResolvers)
+		l.Frontend.AuthPanel = id(l.Frontend.AuthPanel)
+		if l.QueryTimeout == 0 {
+			l.QueryTimeout = tc.QueryTimeout
+		}
+		l.tenant = name
+		if err := addUnique(c.Listeners, id(k), l); err != nil {
+			return err
+		}
+	}
+	for k, r := range tc.Resolvers {
+		r.OverflowResolver = id(r.OverflowResolver)
+		if err := addUnique(c.Resolvers, id(k), r); err != nil {
+			return err
+		}
+	}
+	for k, g := range tc.Groups {
+		g.Resolvers = ids(g.Resolvers)
+		g.Panels = ids(g.Panels)
+		g.BlockListResolver = id(g.BlockListResolver)
+		g.AllowListResolver = id(g.AllowListResolver)
+		g.IpAllowListResolver = id(g.IpAllowListResolver)
+		g.LimitResolver = id(g.LimitResolver)
+		g.BanResolver = id(g.BanResolver)
+		g.MaintenanceResolver = id(g.MaintenanceResolver)
+		g.QuarantineResolver = id(g.QuarantineResolver)
+		g.RerouteResolver = id(g.RerouteResolver)
+		g.RetryResolver = id(g.RetryResolver)
+		actions := make([]categoryAction, 0, len(g.CategoryAction))
+		for _, a := range g.CategoryAction {
+			a.Resolver = id(a.Resolver)
+			actions = append(actions, a)
+		}
+		g.CategoryAction = actions
+		if err := addUnique(c.Groups, id(k), g); err != nil {
+			return err
+		}
+	}
+	for k, r := range tc.Routers {
+		routes := make([]route, 0, len(r.Routes))
+		for _, rt := range r.Routes {
+			rt.Resolver = id(rt.Resolver)
+			if rt.Proxy != "direct" {
+				rt.Proxy = id(rt.Proxy)
+			}
+			// Listener IDs are matched with a regexp, limit it to the
+			// listeners of the tenant
+			if rt.Listener != "" {
+				if rest, ok := strings.CutPrefix(rt.Listener, "^"); ok {
+					rt.Listener = "^" + regexp.QuoteMeta(name+".") + "(?:" + rest + ")"
+				} else {
+					rt.Listener = "^" + regexp.QuoteMeta(name+".") + ".*(?:" + rt.Listener + ")"
+				}
+			}
+			routes = append(routes, rt)
+		}
+		r.Routes = routes
+		if err := addUnique(c.Routers, id(k), r); err != nil {
+			return err
+		}
+	}
+	for k, p := range tc.Proxies {
+		if err := addUnique(c.Proxies, id(k), p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Limits the size of all memory caches of a tenant. Caches without size or
+// with a larger one get the maximum size.
+func limitCaches(tc Config, max int) error {
+	if max <= 0 {
+		return nil
+	}
+	for id, g := range tc.Groups {
+		if g.Type != "cache" {
+			continue
+		}
+		if g.Backend == nil {
+			if g.CacheSize <= 0 || g.CacheSize > max {
+				g.CacheSize = max
+			}
+			tc.Groups[id] = g
+			continue
+		}
+		if g.Backend.Type != "" && g.Backend.Type != "memory" {
+			return fmt.Errorf("cache '%s': max-cache-size is only supported with memory backends", id)
+		}
+		if g.Backend.Size <= 0 || g.Backend.Size > max {
+			g.Backend.Size = max
+		}
+	}
+	return nil
+}
+
+// Returns the limits shared by the listeners of each tenant that has any.
+func tenantLimits(tenants map[string]tenant) map[string]*rdns.ListenerLimits {
+	limits := make(map[string]*rdns.ListenerLimits)
+	for name, t := range tenants {
+		if t.MaxQPS <= 0 && t.MaxConnections <= 0 {
+			continue
+		}
+		limits[name] = rdns.NewListenerLimits(name, rdns.ListenerLimitsOptions{
+			MaxQPS:         t.MaxQPS,
+			MaxConnections: t.MaxConnections,
+		})
+	}
+	return limits
+}
+
+// Adds an element to the config, failing if the ID is already used.
+func addUnique[T any](m map[string]T, id string, v T) error {
+	if _, ok := m[id]; ok {
+		return fmt.Errorf("duplicate id '%s'", id)
+	}
+	m[id] = v
+	return nil
+}
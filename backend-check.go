@@ -0,0 +1,223 @@
+package rdns
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// BackendChecker probes the backends of a service periodically, so that
+// addresses of unhealthy backends can be left out of answers.
+type BackendChecker struct {
+	id      string
+	opt     BackendCheckOptions
+	client  *http.Client
+	targets []*backendTarget
+	byIP    map[string]*backendTarget
+	metrics *BackendCheckMetrics
+
+	// Closed to stop probing
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// BackendCheckOptions define how backends are probed.
+type BackendCheckOptions struct {
+	// "tcp" to open a connection, "http" or "https" to send a GET request that
+	// has to be answered with a 2xx or 3xx status. Certificates of HTTPS
+	// backends aren't verified.
+	Protocol string
+
+	// Port to probe on the backends.
+	Port int
+
+	// Path and Host header of HTTP requests. Default to "/" and the address of
+	// the backend.
+	Path string
+	Host string
+
+	// Time between probes of a backend. Defaults to 10 seconds.
+	Interval time.Duration
+
+	// Time to wait for a probe to complete. Defaults to 2 seconds.
+	Timeout time.Duration
+
+	// Number of consecutive failed or successful probes before a backend is
+	// considered unhealthy or healthy again. Defaults to 2.
+	Threshold int
+}
+
+type BackendCheckMetrics struct {
+	// Number of backends currently unhealthy.
+	unhealthy *expvar.Int
+	// Failed probes by backend.
+	failure *expvar.Map
+}
+
+type backendTarget struct {
+	ip string
+
+	mu      sync.RWMutex
+	healthy bool
+	streak  int // Consecutive probe results contradicting the state
+}
+
+// NewBackendChecker returns a checker for the backends with the given IPs and
+// starts probing them. All backends are considered healthy until probes fail.
+func NewBackendChecker(id string, ips []net.IP, opt BackendCheckOptions) (*BackendChecker, error) {
+	switch opt.Protocol {
+	case "tcp", "http", "https":
+	default:
+		return nil, fmt.Errorf("unsupported health check protocol '%s'", opt.Protocol)
+	}
+	if opt.Port <= 0 || opt.Port > 65535 {
+		return nil, fmt.Errorf("invalid health check port %d", opt.Port)
+	}
+	if opt.Path == "" {
+		opt.Path = "/"
+	}
+	if opt.Interval == 0 {
+		opt.Interval = 10 * time.Second
+	}
+	if opt.Timeout == 0 {
+		opt.Timeout = 2 * time.Second
+	}
+	if opt.Threshold == 0 {
+		opt.Threshold = 2
+	}
+	c := &BackendChecker{
+		id:   id,
+		opt:  opt,
+		byIP: make(map[string]*backendTarget),
+		stop: make(chan struct{}),
+		client: &http.Client{
+			Timeout: opt.Timeout,
+			Transport: &http.Transport{
+				TLSClientConfig:   &tls.Config{InsecureSkipVerify: true, ServerName: opt.Host},
+				DisableKeepAlives: true,
+			},
+			// A redirect means the backend is up, no need to follow it
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		metrics: &BackendCheckMetrics{
+			unhealthy: getVarInt("backend-check", id, "unhealthy"),
+			failure:   getVarMap("backend-check", id, "failure"),
+		},
+	}
+	for _, ip := range ips {
+		key := ip.String()
+		if _, ok := c.byIP[key]; ok {
+			continue
+		}
+		t := &backendTarget{ip: key, healthy: true}
+		c.byIP[key] = t
+		c.targets = append(c.targets, t)
+	}
+	for _, t := range c.targets {
+		go c.probeLoop(t)
+	}
+	return c, nil
+}
+
+// Healthy returns false if the backend with the IP failed its probes. IPs
+// that aren't probed are always healthy.
+func (c *BackendChecker) Healthy(ip net.IP) bool {
+	t, ok := c.byIP[ip.String()]
+	if !ok {
+		return true
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.healthy
+}
+
+// Close stops probing the backends.
+func (c *BackendChecker) Close() error {
+	c.closeOnce.Do(func() { close(c.stop) })
+	return nil
+}
+
+// Probes a backend periodically until the checker is closed.
+func (c *BackendChecker) probeLoop(t *backendTarget) {
+	ticker := time.NewTicker(c.opt.Interval)
+	defer ticker.Stop()
+	for {
+		c.update(t, c.probe(t.ip))
+		select {
+		case <-ticker.C:
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Records the result of a probe, changing the state of the backend after
+// enough consecutive results.
+func (c *BackendChecker) update(t *backendTarget, err error) {
+	log := Log.WithFields(logrus.Fields{"id": c.id, "backend": t.ip})
+	if err != nil {
+		c.metrics.failure.Add(t.ip, 1)
+		log.WithError(err).Debug("health check failed")
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if (err == nil) == t.healthy {
+		t.streak = 0
+		return
+	}
+	t.streak++
+	if t.streak < c.opt.Threshold {
+		return
+	}
+	t.streak = 0
+	t.healthy = err == nil
+	if t.healthy {
+		c.metrics.unhealthy.Add(-1)
+		log.Info("backend is healthy")
+	} else {
+		c.metrics.unhealthy.Add(1)
+		log.WithError(err).Warn("backend is unhealthy")
+	}
+}
+
+// Sends a single probe to a backend.
+func (c *BackendChecker) probe(ip string) error {
+	addr := net.JoinHostPort(ip, strconv.Itoa(c.opt.Port))
+	if c.opt.Protocol == "tcp" {
+		conn, err := net.DialTimeout("tcp", addr, c.opt.Timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.opt.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.opt.Protocol+"://"+addr+c.opt.Path, nil)
+	if err != nil {
+		return err
+	}
+	if c.opt.Host != "" {
+		req.Host = c.opt.Host
+	}
+	req.Header.Set("User-Agent", "routedns")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package rdns
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticResolverBackendCheck(t *testing.T) {
+	// Only the backend on 127.0.0.1 is up, 127.0.0.2 refuses connections
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	r, err := NewStaticResolver("test-static-backends", StaticResolverOptions{
+		Answer: []string{"IN A 127.0.0.1", "IN A 127.0.0.2"},
+		BackendCheck: &BackendCheckOptions{
+			Protocol:  "tcp",
+			Port:      port,
+			Interval:  10 * time.Millisecond,
+			Threshold: 1,
+		},
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("app.example.com.", dns.TypeA)
+	require.Eventually(t, func() bool {
+		a, err := r.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		return len(a.Answer) == 1 && a.Answer[0].(*dns.A).A.String() == "127.0.0.1"
+	}, time.Second, 10*time.Millisecond)
+
+	// If all backends are down, all are returned
+	ln.Close()
+	require.Eventually(t, func() bool {
+		a, err := r.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		return len(a.Answer) == 2
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestBackendCheckHTTP(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/healthz", r.URL.Path)
+		require.Equal(t, "app.example.com", r.Host)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+
+	c, err := NewBackendChecker("test-backend-check", nil, BackendCheckOptions{
+		Protocol: "http",
+		Port:     p,
+		Path:     "/healthz",
+		Host:     "app.example.com",
+	})
+	require.NoError(t, err)
+	require.NoError(t, c.probe("127.0.0.1"))
+	status = http.StatusServiceUnavailable
+	require.Error(t, c.probe("127.0.0.1"))
+
+	_, err = NewBackendChecker("test-backend-check", nil, BackendCheckOptions{Protocol: "icmp", Port: 1})
+	require.Error(t, err)
+}
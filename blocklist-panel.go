@@ -2,13 +2,17 @@ package rdns
 
 import (
 	"errors"
+	"expvar"
+	"fmt"
+	"math/rand"
 	"net"
 	"reflect"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/XrayR-project/XrayR/api"
-	"github.com/XrayR-project/XrayR/service/controller"
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
 	"github.com/txthinking/socks5"
@@ -37,6 +41,26 @@ type PanellistOptions struct {
 	// alternative resolver rather than the default upstream one.
 	IpAllowListResolver Resolver
 
+	// Identify users by a token in the TLS server name or DoH path. Queries from
+	// identified users are not subject to the IP allowlist.
+	UserIdentity PanelUserIdentity
+
+	// Collect and report per-user usage statistics.
+	Stats PanelStatsOptions
+
+	// Only log changes of the panel user list without applying them.
+	UserSyncDryRun bool
+
+	// Allow client IPs only until they have been inactive for this long
+	// instead of permanently. Sessions are learned from the user IPs and
+	// online users in the panel, and clients identified by their token.
+	// Networks of users in the panel are always allowed.
+	SessionTTL time.Duration
+
+	// Answer reverse lookups of spoofed IPs, including the panel's Spoof
+	// list, and private address space locally.
+	SpoofPTR SpoofPTROptions
+
 	// Rules that override the blocklist rules, effectively negate them.
 	// IpAllowlistDB IPBlocklistDB
 }
@@ -45,7 +69,8 @@ type PanelDB struct {
 	AllowlistDB   BlocklistDB
 	BlocklistDB   BlocklistDB
 	IpAllowlistDB IPBlocklistDB
-	Socks5Dialer  Socks5Dialer
+	Users         *PanelUserDB
+	Socks5Dialer  *Socks5Dialer
 	Spoof         []net.IP
 }
 
@@ -55,46 +80,121 @@ type Panellist struct {
 	id string
 	PanellistOptions
 	resolver Resolver
-	mu       sync.RWMutex
 	metrics  *BlocklistMetrics
+	stats    *panelStats
+	sessions *panelSessions
+	spoofPTR *spoofPTR
+
+	refreshMetrics *panelRefreshMetrics
+
+	// Current panel database. It's replaced as a whole when the panel
+	// data changes so queries never need to lock it.
+	db atomic.Pointer[PanelDB]
+
+	// Node info and user list received from the panel that couldn't be
+	// applied. The panel answers with 304 until they change again, so
+	// they're applied from here with the following refreshes.
+	pendingNodeInfo *api.NodeInfo
+	pendingUsers    *[]api.UserInfo
+
+	// Closed to stop the background refresh, session and stats loops
+	stop      chan struct{}
+	closeOnce sync.Once
 }
 
 var _ Resolver = &Panellist{}
 
 // NewBlocklist returns a new instance of a blocklist resolver.
 func NewPanellist(id string, resolver Resolver, opt PanellistOptions) (*Panellist, error) {
+	if opt.Stats.TopDomains == 0 {
+		opt.Stats.TopDomains = 10
+	}
 	panellist := &Panellist{
 		id:               id,
 		resolver:         resolver,
 		PanellistOptions: opt,
 		metrics:          NewBlocklistMetrics(id),
+		refreshMetrics:   newPanelRefreshMetrics(id),
+		spoofPTR:         newSpoofPTR(opt.SpoofPTR),
+		stop:             make(chan struct{}),
+	}
+	panellist.db.Store(opt.DB)
+	if opt.Loader != nil && opt.Loader.opt.UserList != nil {
+		panellist.refreshMetrics.allowlistSize.Set(int64(len(panelUserNetworks(*opt.Loader.opt.UserList))))
+	}
+	if opt.SessionTTL > 0 {
+		panellist.sessions = newPanelSessions(opt.SessionTTL)
+		if opt.Loader != nil && opt.Loader.opt.UserList != nil {
+			panellist.sessions.addUsers(*opt.Loader.opt.UserList)
+		}
+		go panellist.sessionExpireLoop()
 	}
 
 	// Start the refresh goroutines if we have a list and a refresh period was given
 
 	if panellist.DB != nil && panellist.Refresh > 0 {
 		go panellist.refreshLoop(panellist.Refresh)
+	} else if panellist.DB != nil && panellist.Loader != nil && panellist.Loader.FromDisk() {
+		// Started with data from disk, keep trying to reach the panel
+		go panellist.refreshLoop(panelRetryInterval)
+	}
+	if panellist.Stats.Interval > 0 {
+		panellist.stats = newPanelStats()
+		go panellist.statsLoop()
 	}
 	return panellist, nil
 }
 
 // Resolve a DNS query by first checking the query against the provided matcher.
 // Queries that do not match are passed on to the next resolver.
-func (r *Panellist) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dialer) (*dns.Msg, error) {
+func (r *Panellist) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	if len(q.Question) < 1 {
 		return nil, errors.New("no question in query")
 	}
 	question := q.Question[0]
 	log := logger(r.id, q, ci)
 
-	r.mu.RLock()
-	allowlistDB := r.DB.AllowlistDB
-	blocklistDB := r.DB.BlocklistDB
-	ipallowlistDB := r.DB.IpAllowlistDB
-	r.mu.RUnlock()
+	db := r.db.Load()
+	allowlistDB := db.AllowlistDB
+	blocklistDB := db.BlocklistDB
+	ipallowlistDB := db.IpAllowlistDB
+	// Queries are sent upstream through the proxy provided by the panel, if any
+	if db.Socks5Dialer != nil {
+		ci.Dialer = db.Socks5Dialer
+	}
+
+	// Users identified by their token don't need to be on the ipallowlist
+	user, identified := r.UserIdentity.identify(db.Users, &ci)
+	if identified {
+		log = log.WithField("user", ci.User)
+		if r.sessions != nil {
+			r.sessions.add(ci.SourceIP, user)
+		}
+	}
+
+	// With sessions, the IP needs to have been used by a user recently, or be
+	// in the network of a user
+	if r.sessions != nil && !identified {
+		if user, identified = r.sessions.touch(ci.SourceIP, db.Users); !identified {
+			user, identified = db.Users.LookupNet(ci.SourceIP)
+		}
+		if identified {
+			ci.User = strconv.Itoa(user.ID)
+			log = log.WithField("user", ci.User)
+		} else {
+			if r.IpAllowListResolver != nil {
+				log.WithField("resolver", r.IpAllowListResolver).Debug("client has no session, forwarding to allowlist-resolver")
+				return r.IpAllowListResolver.Resolve(q, ci)
+			}
+			r.metrics.blocked.Add(1)
+			ci.Trace.SetBlocked()
+			log.Debug("blocking client without session")
+			return servfail(q), nil
+		}
+	}
 
 	// Forward to upstream or the optional ipallowlist-resolver immediately if there's a match in the ipallowlist
-	if ipallowlistDB != nil {
+	if ipallowlistDB != nil && !identified {
 		curip := ci.SourceIP
 		if ip4 := curip.To4(); ip4 != nil {
 			curip = ip4
@@ -106,24 +206,53 @@ func (r *Panellist) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5D
 
 			if r.IpAllowListResolver != nil {
 				log.WithField("resolver", ipallowlistDB).Debug("client not on allowlist, forwarding to allowlist-resolver")
-				return r.IpAllowListResolver.Resolve(q, ci, &r.DB.Socks5Dialer)
+				return r.IpAllowListResolver.Resolve(q, ci)
 			}
 
 			r.metrics.blocked.Add(1)
+			ci.Trace.SetBlocked()
 			log.Debug("blocking client")
 			q.Rcode = dns.RcodeServerFailure;
 			return q, nil
 		}
 	}
 
+	// Otherwise look the user up by the IP or network registered in the panel
+	if !identified {
+		if user, identified = db.Users.LookupIP(ci.SourceIP); identified {
+			ci.User = strconv.Itoa(user.ID)
+			log = log.WithField("user", ci.User)
+		}
+	}
+
+	if identified {
+		ci.Trace.SetUser(ci.User)
+		if user.Quota != (QuotaLimits{}) {
+			ci.Quota = &user.Quota
+		}
+	}
+
+	// Answer reverse lookups of spoofed IPs and private address space locally
+	if a, ok := r.spoofPTR.answer(q, db.Spoof); ok {
+		log.Debug("responding to reverse lookup locally")
+		return a, nil
+	}
+
 	ips, names, match, ok := blocklistDB.Match(question)
+	if r.stats != nil && identified {
+		r.stats.query(user, ci.SourceIP, question.Name, ok)
+	}
 	if ok {
 		log = log.WithFields(logrus.Fields{"list": match.List, "rule": match.Rule})
 		r.metrics.blocked.Add(1)
+		ci.Trace.SetBlocked()
 
 		// If we got names for the PTR query, respond to it
 		if question.Qtype == dns.TypePTR && len(names) > 0 {
 			log.Debug("responding with ptr blocklist from blocklist")
+			if r.SpoofPTR.Name != "" {
+				names = []string{r.SpoofPTR.Name}
+			}
 			if len(names) > maxPTRResponses {
 				names = names[:maxPTRResponses]
 			}
@@ -134,7 +263,7 @@ func (r *Panellist) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5D
 		if r.BlockListResolver != nil {
 			log.WithField("resolver", r.BlockListResolver.String()).Debug("matched blocklist, forwarding")
 
-			return r.BlockListResolver.Resolve(q, ci, &r.DB.Socks5Dialer)
+			return r.BlockListResolver.Resolve(q, ci)
 		}
 
 		answer := new(dns.Msg)
@@ -169,6 +298,7 @@ func (r *Panellist) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5D
 		if len(spoof) > 0 {
 			log.Debug("spoofing response")
 			answer.Answer = spoof
+			r.spoofPTR.add(spoof)
 			return answer, nil
 		}
 
@@ -185,7 +315,7 @@ func (r *Panellist) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5D
 			r.metrics.allowed.Add(1)
 			if r.AllowListResolver != nil {
 				log.WithField("resolver", r.AllowListResolver.String()).Debug("matched allowlist, forwarding")
-				return r.AllowListResolver.Resolve(q, ci, &r.DB.Socks5Dialer)
+				return r.AllowListResolver.Resolve(q, ci)
 			}
 
 			answer := new(dns.Msg)
@@ -225,12 +355,12 @@ func (r *Panellist) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5D
 		}
 	}
 
-	if r.DB.Spoof != nil {
+	if db.Spoof != nil {
 		answer := new(dns.Msg)
 		answer.SetReply(q)
 		var hardSpoof []dns.RR
 		// We have an IP address to return, make sure it's of the right type. If not return NXDOMAIN.
-		for _, ip := range r.DB.Spoof {
+		for _, ip := range db.Spoof {
 			if ip4 := ip.To4(); len(ip4) == net.IPv4len && question.Qtype == dns.TypeA {
 				hardSpoof = append(hardSpoof, &dns.A{
 					Hdr: dns.RR_Header{
@@ -263,127 +393,332 @@ func (r *Panellist) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5D
 	// Didn't match anything, pass it on to the next resolver
 	log.WithField("resolver", r.resolver.String()).Debug("forwarding unmodified query to resolver")
 	r.metrics.allowed.Add(1)
-	return r.resolver.Resolve(q, ci, &r.DB.Socks5Dialer)
+	return r.resolver.Resolve(q, ci)
 }
 
 func (r *Panellist) String() string {
 	return r.id
 }
 
+var _ DoHAuth = &Panellist{}
+
+// Authenticate accepts the token of a panel user, as bearer token or as
+// password of any HTTP Basic user, and returns the user ID.
+func (r *Panellist) Authenticate(user, secret string) (string, bool) {
+	db := r.db.Load()
+	if db == nil {
+		return "", false
+	}
+	u, ok := db.Users.Lookup(secret)
+	if !ok {
+		return "", false
+	}
+	return strconv.Itoa(u.ID), true
+}
+
 // Check Cert
 func (s *Panellist) CertMonitor() error {
 	return nil
 }
 
-func (r *Panellist) refreshLoop(refresh time.Duration) (err error) {
-	for {
-		time.Sleep(refresh)
-		log := Log.WithField("id", r.id)
-		log.Debug("reloading IP allowlist")
-
-		if err != nil {
-			log.WithError(err).Error("failed to load rules")
-			continue
+// Close stops refreshing the panel data, expiring sessions and reporting
+// statistics. Connections of the clients to the proxy of the panel are
+// closed.
+func (r *Panellist) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.stop)
+		if db := r.db.Load(); db != nil && db.Socks5Dialer != nil {
+			db.Socks5Dialer.Close()
 		}
+	})
+	return nil
+}
 
-		// First fetch Node Info
-		var nodeInfoChanged = true
-		newNodeInfo, err := r.Loader.API.GetNodeInfo()
-		if err != nil {
-			if err.Error() == api.NodeNotModified {
-				nodeInfoChanged = false
-				newNodeInfo = r.Loader.opt.NodeInfo
-			} else {
-				log.WithError(err).Error("failed to load Panel rules")
-				continue
+// Waits for the given time, returns false if the panel was closed meanwhile.
+func (r *Panellist) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-r.stop:
+		return false
+	}
+}
+
+// Time between attempts to reach the panel when started with data from disk
+// and no refresh period is configured.
+const panelRetryInterval = time.Minute
+
+// First retry delay after a failed refresh, doubled with every consecutive
+// failure up to the refresh period.
+const panelRetryMin = 10 * time.Second
+
+type panelRefreshMetrics struct {
+	// Count of refreshes.
+	refresh *expvar.Int
+	// Count of refreshes where at least one request to the panel failed.
+	refreshError *expvar.Int
+	// Count of failed node info requests.
+	nodeError *expvar.Int
+	// Count of failed user list requests.
+	userError *expvar.Int
+	// Unix time of the last refresh without errors.
+	lastSuccess *expvar.Int
+	// Number of user IPs and networks in the IP allowlist.
+	allowlistSize *expvar.Int
+	// Number of active sessions.
+	sessions *expvar.Int
+}
+
+func newPanelRefreshMetrics(id string) *panelRefreshMetrics {
+	return &panelRefreshMetrics{
+		refresh:       getVarInt("panel", id, "refresh"),
+		refreshError:  getVarInt("panel", id, "refresh-error"),
+		nodeError:     getVarInt("panel", id, "node-error"),
+		userError:     getVarInt("panel", id, "user-error"),
+		lastSuccess:   getVarInt("panel", id, "last-success"),
+		allowlistSize: getVarInt("panel", id, "allowlist-size"),
+		sessions:      getVarInt("panel", id, "sessions"),
+	}
+}
+
+// Refreshes the panel data periodically. Failed refreshes are retried with
+// exponential backoff and every delay has some jitter so that many nodes
+// don't hit the panel at the same time.
+func (r *Panellist) refreshLoop(refresh time.Duration) {
+	var failures int
+	for r.sleep(panelRefreshDelay(refresh, failures)) {
+		if r.refresh() {
+			failures = 0
+			if r.Refresh == 0 {
+				return
 			}
+		} else {
+			failures++
+		}
+	}
+}
+
+// Returns the time to wait before the next refresh, after a number of
+// consecutive failures.
+func panelRefreshDelay(refresh time.Duration, failures int) time.Duration {
+	delay := refresh
+	if failures > 0 {
+		delay = panelRetryMin << min(failures-1, 16)
+		if delay > refresh {
+			delay = refresh
 		}
+	}
+	// Up to 10% jitter in either direction
+	jitter := time.Duration(rand.Int63n(int64(delay)/5+1)) - delay/10
+	return delay + jitter
+}
 
-		// Update User
-		var usersChanged = true
-		newUserInfo, err := r.Loader.API.GetUserList()
-		if err != nil {
-			if err.Error() == api.UserNotModified {
-				usersChanged = false
-				newUserInfo = r.Loader.opt.UserList
-			} else {
-				log.WithError(err).Error("failed to load Panel user list")
-				continue
-			}
+// Applies changes of the panel user list to the next database. The IP allowlist
+// and user database are replaced together or not at all. Returns true if the
+// changes were applied.
+func (r *Panellist) syncUsers(next *PanelDB, oldUsers, newUsers []api.UserInfo) (bool, error) {
+	log := Log.WithField("id", r.id)
+	changes := diffPanelUsers(oldUsers, newUsers)
+	if changes.empty() {
+		// Quotas aren't part of the user info and may have changed alone
+		if _, ok := r.Loader.API.(PanelUserQuotaAPI); ok && !r.UserSyncDryRun {
+			next.Users = newPanelUserDBFromAPI(r.Loader.API, newUsers)
 		}
+		return true, nil
+	}
+	msg := "applying"
+	if r.UserSyncDryRun {
+		msg = "dry-run, not applying"
+	}
+	for _, u := range changes.added {
+		log.WithFields(logrus.Fields{"uid": u.UID, "ip": u.Passwd}).Debug(msg + " added user")
+	}
+	for _, u := range changes.changed {
+		log.WithFields(logrus.Fields{"uid": u.UID, "ip": u.Passwd}).Debug(msg + " changed user")
+	}
+	for _, u := range changes.removed {
+		log.WithFields(logrus.Fields{"uid": u.UID, "ip": u.Passwd}).Debug(msg + " removed user")
+	}
+	log.WithFields(logrus.Fields{
+		"added":   len(changes.added),
+		"changed": len(changes.changed),
+		"removed": len(changes.removed),
+		"dry-run": r.UserSyncDryRun,
+	}).Info("panel user list changed")
+	if r.UserSyncDryRun {
+		return false, nil
+	}
 
-		// If nodeInfo changed
-		if nodeInfoChanged {
-			if !reflect.DeepEqual(r.Loader.opt.NodeInfo.RouteDNS, newNodeInfo.RouteDNS) {
-				if !reflect.DeepEqual(r.Loader.opt.NodeInfo.RouteDNS.Socks5, newNodeInfo.RouteDNS.Socks5) {
-					if newNodeInfo.RouteDNS.Socks5.Socks5Address != "" {
-						timeout := 5 * time.Second
-						client, err := socks5.NewClient(
-							newNodeInfo.RouteDNS.Socks5.Socks5Address,
-							newNodeInfo.RouteDNS.Socks5.Username,
-							newNodeInfo.RouteDNS.Socks5.Password,
-							0,
-							int(timeout),
-						)
-						if err == nil {
-							r.DB.Socks5Dialer = Socks5Dialer{Client: client, opt: Socks5DialerOptions{
-								Username:     newNodeInfo.RouteDNS.Socks5.Username,
-								Password:     newNodeInfo.RouteDNS.Socks5.Password,
-								TCPTimeout:   0,
-								UDPTimeout:   5 * time.Second,
-								ResolveLocal: newNodeInfo.RouteDNS.Socks5.ResolveLocal,
-								LocalAddr:    net.ParseIP(newNodeInfo.RouteDNS.Socks5.LocalAddr),
-							}}
-						}
-					}
-					nodeInfoChanged = true
-				}
-				if !reflect.DeepEqual(r.Loader.opt.NodeInfo.RouteDNS.Allow, newNodeInfo.RouteDNS.Allow) {
-					r.DB.AllowlistDB.Reload()
-					nodeInfoChanged = true
-				}
-				if !reflect.DeepEqual(r.Loader.opt.NodeInfo.RouteDNS.Block, newNodeInfo.RouteDNS.Block) {
-					r.DB.BlocklistDB.Reload()
-					nodeInfoChanged = true
-				}
-			} else {
-				nodeInfoChanged = false
+	networks := panelUserNetworks(newUsers)
+	db, err := newCidrDBXFromList("iplist", networks, r.Loader)
+	if err != nil {
+		return false, err
+	}
+	next.IpAllowlistDB = db
+	next.Users = newPanelUserDBFromAPI(r.Loader.API, newUsers)
+	r.refreshMetrics.allowlistSize.Set(int64(len(networks)))
+	if r.sessions != nil {
+		r.sessions.addUsers(changes.added)
+		r.sessions.addUsers(changes.changed)
+	}
+	return true, nil
+}
+
+// Applies the changes to the node info to the next database. Nothing is
+// changed unless all of the lists could be loaded.
+func (r *Panellist) applyNodeInfo(next *PanelDB, oldNodeInfo, newNodeInfo *api.NodeInfo) error {
+	n := *next
+	if !reflect.DeepEqual(oldNodeInfo.RouteDNS.Socks5, newNodeInfo.RouteDNS.Socks5) {
+		n.Socks5Dialer = nil
+		if newNodeInfo.RouteDNS.Socks5.Socks5Address != "" {
+			timeout := 5 * time.Second
+			client, err := socks5.NewClient(
+				newNodeInfo.RouteDNS.Socks5.Socks5Address,
+				newNodeInfo.RouteDNS.Socks5.Username,
+				newNodeInfo.RouteDNS.Socks5.Password,
+				0,
+				int(timeout),
+			)
+			if err == nil {
+				n.Socks5Dialer = &Socks5Dialer{Client: client, opt: Socks5DialerOptions{
+					Username:     newNodeInfo.RouteDNS.Socks5.Username,
+					Password:     newNodeInfo.RouteDNS.Socks5.Password,
+					TCPTimeout:   0,
+					UDPTimeout:   5 * time.Second,
+					ResolveLocal: newNodeInfo.RouteDNS.Socks5.ResolveLocal,
+					LocalAddr:    net.ParseIP(newNodeInfo.RouteDNS.Socks5.LocalAddr),
+				}}
 			}
 		}
+	}
+	if !reflect.DeepEqual(oldNodeInfo.RouteDNS.Allow, newNodeInfo.RouteDNS.Allow) {
+		db, err := getDB("allow", r.Loader)
+		if err != nil {
+			return fmt.Errorf("failed to load allowlist: %w", err)
+		}
+		n.AllowlistDB = db
+	}
+	if !reflect.DeepEqual(oldNodeInfo.RouteDNS.Block, newNodeInfo.RouteDNS.Block) {
+		db, err := getDB("block", r.Loader)
+		if err != nil {
+			return fmt.Errorf("failed to load blocklist: %w", err)
+		}
+		n.BlocklistDB = db
+	}
+	*next = n
+	return nil
+}
+
+// Fetches the node info and user list from the panel and applies the parts
+// that changed. A failure of one request doesn't prevent applying the other.
+// Returns false if any request failed.
+func (r *Panellist) refresh() bool {
+	log := Log.WithField("id", r.id)
+	log.Debug("refreshing panel data")
+	r.refreshMetrics.refresh.Add(1)
+
+	oldNodeInfo := r.Loader.opt.NodeInfo
+	oldUserInfo := r.Loader.opt.UserList
+
+	nodeInfoChanged, usersChanged := true, true
+	nodeOK, usersOK := true, true
+	newNodeInfo, err := r.Loader.API.GetNodeInfo()
+	if err != nil {
+		nodeInfoChanged = false
+		newNodeInfo = oldNodeInfo
+		if err.Error() == api.NodeNotModified && r.pendingNodeInfo != nil {
+			nodeInfoChanged = true
+			newNodeInfo = r.pendingNodeInfo
+		} else if err.Error() != api.NodeNotModified {
+			nodeOK = false
+			r.refreshMetrics.nodeError.Add(1)
+			log.WithError(err).Error("failed to load Panel rules")
+		}
+	}
+	newUserInfo, err := r.Loader.API.GetUserList()
+	if err != nil {
+		usersChanged = false
+		newUserInfo = oldUserInfo
+		if err.Error() == api.UserNotModified && r.pendingUsers != nil {
+			usersChanged = true
+			newUserInfo = r.pendingUsers
+		} else if err.Error() != api.UserNotModified {
+			usersOK = false
+			r.refreshMetrics.userError.Add(1)
+			log.WithError(err).Error("failed to load Panel user list")
+		}
+	}
 
-		var deleted, added []api.UserInfo
-		if usersChanged {
-			deleted, added = controller.CompareUserList(r.Loader.opt.UserList, newUserInfo)
-			if len(deleted) > 0 {
-				deletedUsers := make([]string, len(deleted))
-				for i, u := range deleted {
-					deletedUsers[i] = u.Passwd
-				}
-				r.mu.Lock()
-				err := r.DB.IpAllowlistDB.Remove(deletedUsers)
-				r.mu.Unlock()
-				if err != nil {
-					log.Print(err)
-				}
-			}
-			if len(added) > 0 {
-				addedUsers := make([]string, len(deleted))
-				for i, u := range deleted {
-					addedUsers[i] = u.Passwd
-				}
-				r.mu.Lock()
-				err = r.DB.IpAllowlistDB.Add(addedUsers)
-				r.mu.Unlock()
-				if err != nil {
-					log.Print(err)
-				}
+	// Build a new database from the current one, replacing the parts that
+	// changed, and swap it in once complete
+	next := *r.db.Load()
+	oldDialer := next.Socks5Dialer
+	r.Loader.opt.NodeInfo = newNodeInfo
+	r.Loader.opt.UserList = newUserInfo
+
+	if nodeInfoChanged && !reflect.DeepEqual(oldNodeInfo.RouteDNS, newNodeInfo.RouteDNS) {
+		if err := r.applyNodeInfo(&next, oldNodeInfo, newNodeInfo); err != nil {
+			nodeOK = false
+			r.refreshMetrics.nodeError.Add(1)
+			log.WithError(err).Error("failed to apply Panel rules")
+			r.Loader.opt.NodeInfo = oldNodeInfo
+			r.pendingNodeInfo = newNodeInfo
+		} else {
+			r.pendingNodeInfo = nil
+		}
+	}
+
+	if usersChanged {
+		applied, err := r.syncUsers(&next, *oldUserInfo, *newUserInfo)
+		if err != nil {
+			usersOK = false
+			r.refreshMetrics.userError.Add(1)
+			log.WithError(err).Error("failed to apply Panel user list")
+			r.pendingUsers = newUserInfo
+		} else {
+			r.pendingUsers = nil
+		}
+		// Keep the old list unless the changes were applied so they're
+		// retried with the next refresh
+		if !applied {
+			r.Loader.opt.UserList = oldUserInfo
+		}
+	}
+
+	r.db.Store(&next)
+
+	// Let the clients close their connections to a proxy that was replaced
+	if oldDialer != nil && oldDialer != next.Socks5Dialer {
+		oldDialer.Close()
+	}
+
+	// Re-learn sessions from the users the panel currently sees online
+	if r.sessions != nil {
+		if onlineAPI, ok := r.Loader.API.(PanelOnlineUsersAPI); ok {
+			online, err := onlineAPI.GetOnlineUsers()
+			switch {
+			case err == errNotModified:
+			case err != nil:
+				log.WithError(err).Error("failed to load online users from panel")
+			default:
+				r.sessions.addOnline(*online, next.Users)
 			}
 		}
-		log.Printf("%d user deleted, %d user added", len(deleted), len(added))
+	}
 
-		r.mu.Lock()
-		r.Loader.opt.UserList = newUserInfo
-		r.Loader.opt.NodeInfo = newNodeInfo
-		r.mu.Unlock()
+	if !nodeOK || !usersOK {
+		r.refreshMetrics.refreshError.Add(1)
+		return false
+	}
+	r.refreshMetrics.lastSuccess.Set(time.Now().Unix())
+
+	// Keep the copy on disk current, this also replaces data loaded from
+	// disk on startup once the panel is reachable
+	if r.Loader.opt.CacheDir != "" && (nodeInfoChanged || usersChanged || r.Loader.fromDisk) {
+		if err := r.Loader.writeToDisk(newNodeInfo, newUserInfo); err != nil {
+			log.WithError(err).Warn("failed to write panel data to disk")
+		}
 	}
+	r.Loader.fromDisk = false
+	return true
 }
@@ -0,0 +1,144 @@
+package rdns
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPanellistRefreshPartialFailure(t *testing.T) {
+	var nodeFails atomic.Bool
+	users := atomic.Value{}
+	users.Store(`[{"id":1,"ip":"192.168.1.1"}]`)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/node":
+			if nodeFails.Load() {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(`{"block":{"type":"domain","domains":["domain:ads.com"]}}`))
+		case "/users":
+			w.Write([]byte(users.Load().(string)))
+		}
+	}))
+	defer srv.Close()
+
+	panel, err := NewPanelAPI(PanelTypeREST, &api.Config{APIHost: srv.URL, NodeID: 1})
+	require.NoError(t, err)
+	loader := NewPanelLoader(panel, PanelLoaderOptions{AllowlistFormat: "domainx", BlocklistFormat: "domainx"})
+	db, err := loader.Get()
+	require.NoError(t, err)
+	r, err := NewPanellist("test-panel-refresh", new(TestResolver), PanellistOptions{Loader: loader, DB: db})
+	require.NoError(t, err)
+
+	// The node info request fails, but the new user is still applied
+	nodeFails.Store(true)
+	users.Store(`[{"id":1,"ip":"192.168.1.1"},{"id":2,"ip":"192.168.1.2"}]`)
+	require.False(t, r.refresh())
+	_, ok := r.db.Load().Users.LookupIP(net.ParseIP("192.168.1.2"))
+	require.True(t, ok)
+	require.Equal(t, int64(1), r.refreshMetrics.nodeError.Value())
+	require.Equal(t, int64(0), r.refreshMetrics.userError.Value())
+
+	// Both succeed
+	nodeFails.Store(false)
+	require.True(t, r.refresh())
+	require.NotZero(t, r.refreshMetrics.lastSuccess.Value())
+}
+
+func TestPanelRefreshDelay(t *testing.T) {
+	within := func(d, expected time.Duration) {
+		require.GreaterOrEqual(t, d, expected-expected/10)
+		require.LessOrEqual(t, d, expected+expected/10)
+	}
+	for i := 0; i < 100; i++ {
+		within(panelRefreshDelay(time.Hour, 0), time.Hour)
+		within(panelRefreshDelay(time.Hour, 1), panelRetryMin)
+		within(panelRefreshDelay(time.Hour, 3), 4*panelRetryMin)
+		within(panelRefreshDelay(time.Hour, 100), time.Hour)
+	}
+}
+
+func TestPanellistUserSync(t *testing.T) {
+	users := []api.UserInfo{{UID: 1, Passwd: "192.168.1.1"}}
+	loader := &PanelLoader{opt: PanelLoaderOptions{UserList: &users}}
+	db := &PanelDB{Users: NewPanelUserDB(users)}
+	r, err := NewPanellist("test-panel-sync", new(TestResolver), PanellistOptions{Loader: loader, DB: db, UserSyncDryRun: true})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), r.refreshMetrics.allowlistSize.Value())
+
+	// Changes are only logged in dry-run mode
+	newUsers := []api.UserInfo{{UID: 2, Passwd: "192.168.1.2"}, {UID: 3, Passwd: "invalid"}}
+	next := *db
+	applied, err := r.syncUsers(&next, users, newUsers)
+	require.NoError(t, err)
+	require.False(t, applied)
+	require.Equal(t, db.Users, next.Users)
+
+	// Apply the changes, the user with the invalid IP doesn't prevent it
+	r.UserSyncDryRun = false
+	applied, err = r.syncUsers(&next, users, newUsers)
+	require.NoError(t, err)
+	require.True(t, applied)
+	_, ok := next.IpAllowlistDB.Match(net.ParseIP("192.168.1.2").To4())
+	require.True(t, ok)
+	_, ok = next.IpAllowlistDB.Match(net.ParseIP("192.168.1.1").To4())
+	require.False(t, ok)
+	_, ok = next.Users.LookupIP(net.ParseIP("192.168.1.1"))
+	require.False(t, ok)
+	require.Equal(t, int64(1), r.refreshMetrics.allowlistSize.Value())
+}
+
+func TestPanellistRefreshNodeFailure(t *testing.T) {
+	node := atomic.Value{}
+	node.Store(`{"block":{"type":"domain","domains":["domain:ads.com"]}}`)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/node":
+			body := node.Load().(string)
+			tag := strconv.Quote(strconv.Itoa(len(body)))
+			if r.Header.Get("If-None-Match") == tag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", tag)
+			w.Write([]byte(body))
+		case "/users":
+			w.Write([]byte(`[{"id":1,"ip":"192.168.1.1"}]`))
+		}
+	}))
+	defer srv.Close()
+
+	panel, err := NewPanelAPI(PanelTypeREST, &api.Config{APIHost: srv.URL, NodeID: 1})
+	require.NoError(t, err)
+	loader := NewPanelLoader(panel, PanelLoaderOptions{AllowlistFormat: "domainx", BlocklistFormat: "domainx"})
+	db, err := loader.Get()
+	require.NoError(t, err)
+	r, err := NewPanellist("test-panel-node-failure", new(TestResolver), PanellistOptions{Loader: loader, DB: db})
+	require.NoError(t, err)
+	blocklist := r.db.Load().BlocklistDB
+
+	// The new blocklist can't be loaded, the old one stays in place
+	node.Store(`{"block":{"type":"domain","domains":["regexp:("]}}`)
+	require.False(t, r.refresh())
+	require.Equal(t, blocklist, r.db.Load().BlocklistDB)
+	require.Equal(t, int64(1), r.refreshMetrics.nodeError.Value())
+
+	// The panel reports no change, the failed node info is tried again
+	require.False(t, r.refresh())
+	require.Equal(t, int64(2), r.refreshMetrics.nodeError.Value())
+
+	// Valid rules from the panel are applied
+	node.Store(`{"block":{"type":"domain","domains":["domain:tracker.com"]}}`)
+	require.True(t, r.refresh())
+	require.NotEqual(t, blocklist, r.db.Load().BlocklistDB)
+	require.Nil(t, r.pendingNodeInfo)
+}
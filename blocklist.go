@@ -1,9 +1,12 @@
 package rdns
 
 import (
+	"encoding/json"
 	"errors"
 	"expvar"
 	"net"
+	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,13 +15,24 @@ import (
 )
 
 // Blocklist is a resolver that returns NXDOMAIN or a spoofed IP for every query that
-// matches. Everything else is passed through to another resolver.
+// matches. Everything else is passed through to another resolver. Temporary rules
+// that expire after a time-to-live can be added on the admin listener, they apply
+// on top of the blocklist and are kept across reloads.
 type Blocklist struct {
 	id string
 	BlocklistOptions
 	resolver Resolver
-	mu       sync.RWMutex
 	metrics  *BlocklistMetrics
+
+	blocklistDB *dbRef[BlocklistDB]
+	allowlistDB *dbRef[BlocklistDB]
+	temporaryDB *TemporaryDB
+	learnedDB   *TemporaryDB // CNAME targets learned from allowlisted responses
+	spoofPTR    *spoofPTR
+
+	// Closed to stop the refresh loops
+	stop      chan struct{}
+	closeOnce sync.Once
 }
 
 var _ Resolver = &Blocklist{}
@@ -33,6 +47,10 @@ type BlocklistOptions struct {
 	// Refresh period for the blocklist. Disabled if 0.
 	BlocklistRefresh time.Duration
 
+	// Optional, reload the blocklist when signaled, for example by a zone
+	// transfer loader that received a NOTIFY.
+	BlocklistNotify <-chan struct{}
+
 	// Optional, send anything that matches the allowlist to an
 	// alternative resolver rather than the default upstream one.
 	AllowListResolver Resolver
@@ -42,13 +60,53 @@ type BlocklistOptions struct {
 
 	// Refresh period for the allowlist. Disabled if 0.
 	AllowlistRefresh time.Duration
+
+	// Allowlist the CNAME targets in responses to allowlisted queries for this
+	// long, so aliases of allowed names, like CDN names, aren't blocked.
+	// Disabled if 0.
+	AllowlistLearnCNAME time.Duration
+
+	// Actions for queries matching a rule or list in a category, by category.
+	// Queries matching rules without category, or in a category without
+	// action, are blocked.
+	CategoryActions map[string]CategoryAction
+
+	// Only log and count matches, without blocking them, to evaluate lists
+	// for false positives before enforcing them.
+	Audit bool
+
+	// Answer reverse lookups of spoofed IPs and private address space locally.
+	SpoofPTR SpoofPTROptions
 }
 
+// CategoryAction is what a blocklist does with queries matching a rule or list
+// in a category.
+type CategoryAction struct {
+	// One of CategoryActionBlock, CategoryActionLog or CategoryActionRedirect.
+	Action string
+
+	// Resolver to send queries to with CategoryActionRedirect.
+	Resolver Resolver
+}
+
+// Actions for blocklist matches in a category.
+const (
+	CategoryActionBlock    = "block"    // Block the query like any other match
+	CategoryActionLog      = "log"      // Only log the match and forward the query
+	CategoryActionRedirect = "redirect" // Send the query to an alternative resolver
+)
+
 type BlocklistMetrics struct {
 	// Blocked queries count.
 	blocked *expvar.Int
 	// Allowed queries count.
 	allowed *expvar.Int
+	// Matching queries that were only logged and not blocked.
+	logged *expvar.Int
+	// Matching queries by category.
+	category *expvar.Map
+	// Matching queries in audit mode by list.
+	audit *expvar.Map
 }
 
 const (
@@ -58,8 +116,11 @@ const (
 
 func NewBlocklistMetrics(id string) *BlocklistMetrics {
 	return &BlocklistMetrics{
-		allowed: getVarInt("router", id, "allow"),
-		blocked: getVarInt("router", id, "deny"),
+		allowed:  getVarInt("router", id, "allow"),
+		blocked:  getVarInt("router", id, "deny"),
+		logged:   getVarInt("router", id, "log-only"),
+		category: getVarMap("router", id, "category"),
+		audit:    getVarMap("router", id, "audit"),
 	}
 }
 
@@ -70,10 +131,19 @@ func NewBlocklist(id string, resolver Resolver, opt BlocklistOptions) (*Blocklis
 		resolver:         resolver,
 		BlocklistOptions: opt,
 		metrics:          NewBlocklistMetrics(id),
+		blocklistDB:      newDBRef(opt.BlocklistDB),
+		allowlistDB:      newDBRef(opt.AllowlistDB),
+		temporaryDB:      NewTemporaryDB(id),
+		spoofPTR:         newSpoofPTR(opt.SpoofPTR),
+		stop:             make(chan struct{}),
 	}
+	if opt.AllowlistLearnCNAME > 0 {
+		blocklist.learnedDB = NewTemporaryDB("learned-cname")
+	}
+	registerAdminHandler("/routedns/blocklist/"+id, blocklist)
 
 	// Start the refresh goroutines if we have a list and a refresh period was given
-	if blocklist.BlocklistDB != nil && blocklist.BlocklistRefresh > 0 {
+	if blocklist.BlocklistDB != nil && (blocklist.BlocklistRefresh > 0 || blocklist.BlocklistNotify != nil) {
 		go blocklist.refreshLoopBlocklist(blocklist.BlocklistRefresh)
 	}
 	if blocklist.AllowlistDB != nil && blocklist.AllowlistRefresh > 0 {
@@ -84,78 +154,115 @@ func NewBlocklist(id string, resolver Resolver, opt BlocklistOptions) (*Blocklis
 
 // Resolve a DNS query by first checking the query against the provided matcher.
 // Queries that do not match are passed on to the next resolver.
-func (r *Blocklist) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dialer) (*dns.Msg, error) {
+func (r *Blocklist) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	if len(q.Question) < 1 {
 		return nil, errors.New("no question in query")
 	}
 	question := q.Question[0]
 	log := logger(r.id, q, ci)
 
-	r.mu.RLock()
-	blocklistDB := r.BlocklistDB
-	allowlistDB := r.AllowlistDB
-	r.mu.RUnlock()
+	blocklistDB := r.blocklistDB.Load()
+	allowlistDB := r.allowlistDB.Load()
 
-	// Forward to upstream or the optional allowlist-resolver immediately if there's a match in the allowlist
-	if allowlistDB != nil {
-		if ips, _, match, ok := allowlistDB.Match(question); ok {
-			log = log.WithFields(logrus.Fields{"list": match.List, "rule": match.Rule})
-			r.metrics.allowed.Add(1)
-			if r.AllowListResolver != nil {
-				log.WithField("resolver", r.AllowListResolver.String()).Debug("matched allowlist, forwarding")
-				return r.AllowListResolver.Resolve(q, ci, PanelSocksDialer)
-			}
+	// Fail queries while a critical list is stale, rather than serve outdated rules
+	if dbUnhealthy(blocklistDB) {
+		log.Warn("blocklist is stale, responding with servfail")
+		return servfail(q), nil
+	}
 
-			answer := new(dns.Msg)
-			answer.SetReply(q)
-			var allowSpoof []dns.RR
-			// We have an IP address to return, make sure it's of the right type. If not return NXDOMAIN.
-			for _, ip := range ips {
-				if ip4 := ip.To4(); len(ip4) == net.IPv4len && question.Qtype == dns.TypeA {
-					allowSpoof = append(allowSpoof, &dns.A{
-						Hdr: dns.RR_Header{
-							Name:   question.Name,
-							Rrtype: dns.TypeA,
-							Class:  question.Qclass,
-							Ttl:    3600,
-						},
-						A: ip,
-					})
-				} else if len(ip) == net.IPv6len && question.Qtype == dns.TypeAAAA {
-					allowSpoof = append(allowSpoof, &dns.AAAA{
-						Hdr: dns.RR_Header{
-							Name:   question.Name,
-							Rrtype: dns.TypeAAAA,
-							Class:  question.Qclass,
-							Ttl:    3600,
-						},
-						AAAA: ip,
-					})
-				}
-			}
-			if len(allowSpoof) > 0 {
-				log.Debug("spoofing response")
-				answer.Answer = allowSpoof
-				return answer, nil
+	// Answer reverse lookups of spoofed IPs and private address space locally
+	if a, ok := r.spoofPTR.answer(q, nil); ok {
+		log.Debug("responding to reverse lookup locally")
+		return a, nil
+	}
+
+	// Forward to upstream or the optional allowlist-resolver immediately if there's a match in the allowlist,
+	// or the name is a CNAME target of an allowlisted name
+	if ips, match, ok := r.matchAllowlist(allowlistDB, question); ok {
+		log = log.WithFields(logrus.Fields{"list": match.List, "rule": match.Rule})
+		r.metrics.allowed.Add(1)
+		if r.AllowListResolver != nil {
+			log.WithField("resolver", r.AllowListResolver.String()).Debug("matched allowlist, forwarding")
+			return r.learnCNAMEs(r.AllowListResolver.Resolve(q, ci))
+		}
+
+		answer := new(dns.Msg)
+		answer.SetReply(q)
+		var allowSpoof []dns.RR
+		// We have an IP address to return, make sure it's of the right type. If not return NXDOMAIN.
+		for _, ip := range ips {
+			if ip4 := ip.To4(); len(ip4) == net.IPv4len && question.Qtype == dns.TypeA {
+				allowSpoof = append(allowSpoof, &dns.A{
+					Hdr: dns.RR_Header{
+						Name:   question.Name,
+						Rrtype: dns.TypeA,
+						Class:  question.Qclass,
+						Ttl:    3600,
+					},
+					A: ip,
+				})
+			} else if len(ip) == net.IPv6len && question.Qtype == dns.TypeAAAA {
+				allowSpoof = append(allowSpoof, &dns.AAAA{
+					Hdr: dns.RR_Header{
+						Name:   question.Name,
+						Rrtype: dns.TypeAAAA,
+						Class:  question.Qclass,
+						Ttl:    3600,
+					},
+					AAAA: ip,
+				})
 			}
 		}
+		if len(allowSpoof) > 0 {
+			log.Debug("spoofing response")
+			answer.Answer = allowSpoof
+			return answer, nil
+		}
+		log.WithField("resolver", r.resolver.String()).Debug("matched allowlist, forwarding")
+		return r.learnCNAMEs(r.resolver.Resolve(q, ci))
 	}
-	
-	
 
-	ips, names, match, ok := blocklistDB.Match(question)
+	ips, names, match, ok := r.temporaryDB.Match(question)
+	if !ok {
+		ips, names, match, ok = blocklistDB.Match(question)
+	}
 	if !ok {
 		// Didn't match anything, pass it on to the next resolver
 		log.WithField("resolver", r.resolver.String()).Debug("forwarding unmodified query to resolver")
 		r.metrics.allowed.Add(1)
-		return r.resolver.Resolve(q, ci, PanelSocksDialer)
+		return r.resolver.Resolve(q, ci)
 	}
 	log = log.WithFields(logrus.Fields{"list": match.List, "rule": match.Rule})
+	if match.Category != "" {
+		log = log.WithField("category", match.Category)
+		r.metrics.category.Add(match.Category, 1)
+	}
+	action := r.CategoryActions[match.Category]
+	if r.Audit || match.Audit {
+		log.WithField("resolver", r.resolver.String()).Info("matched blocklist in audit mode, forwarding")
+		r.metrics.logged.Add(1)
+		r.metrics.audit.Add(match.List, 1)
+		return r.resolver.Resolve(q, ci)
+	}
+	if action.Action == CategoryActionLog {
+		log.WithField("resolver", r.resolver.String()).Info("matched blocklist in log-only mode, forwarding")
+		r.metrics.logged.Add(1)
+		return r.resolver.Resolve(q, ci)
+	}
 	r.metrics.blocked.Add(1)
+	ci.Trace.SetBlocked()
+
+	if action.Action == CategoryActionRedirect {
+		log.WithField("resolver", action.Resolver.String()).Debug("matched blocklist category, forwarding")
+		return action.Resolver.Resolve(q, ci)
+	}
 
 	// If we got names for the PTR query, respond to it
 	if question.Qtype == dns.TypePTR && len(names) > 0 {
 		log.Debug("responding with ptr blocklist from blocklist")
+		if r.SpoofPTR.Name != "" {
+			names = []string{r.SpoofPTR.Name}
+		}
 		if len(names) > maxPTRResponses {
 			names = names[:maxPTRResponses]
 		}
@@ -165,7 +272,7 @@ func (r *Blocklist) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5D
 	// If an optional blocklist-resolver was given, send the query to that instead of returning NXDOMAIN.
 	if r.BlocklistResolver != nil {
 		log.WithField("resolver", r.BlocklistResolver.String()).Debug("matched blocklist, forwarding")
-		return r.BlocklistResolver.Resolve(q, ci, PanelSocksDialer)
+		return r.BlocklistResolver.Resolve(q, ci)
 	}
 
 	answer := new(dns.Msg)
@@ -200,6 +307,7 @@ func (r *Blocklist) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5D
 	if len(spoof) > 0 {
 		log.Debug("spoofing response")
 		answer.Answer = spoof
+		r.spoofPTR.add(spoof)
 		return answer, nil
 	}
 
@@ -218,34 +326,136 @@ func (s *Blocklist) CertMonitor() error {
 	return nil
 }
 
+// Returns the match of a query in the allowlist or the learned CNAME targets.
+func (r *Blocklist) matchAllowlist(allowlistDB BlocklistDB, question dns.Question) ([]net.IP, *BlocklistMatch, bool) {
+	if allowlistDB != nil {
+		if ips, _, match, ok := allowlistDB.Match(question); ok {
+			return ips, match, true
+		}
+	}
+	if r.learnedDB != nil {
+		if _, _, match, ok := r.learnedDB.Match(question); ok {
+			return nil, match, true
+		}
+	}
+	return nil, nil, false
+}
+
+// Adds the CNAME targets in the response to an allowlisted query to the learned
+// allowlist, if enabled.
+func (r *Blocklist) learnCNAMEs(a *dns.Msg, err error) (*dns.Msg, error) {
+	if r.learnedDB == nil || a == nil {
+		return a, err
+	}
+	var targets []string
+	for _, rr := range a.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			targets = append(targets, cname.Target)
+		}
+	}
+	if len(targets) == 0 {
+		return a, err
+	}
+	if err := r.learnedDB.Add(targets, r.AllowlistLearnCNAME); err != nil {
+		Log.WithField("id", r.id).WithError(err).Warn("failed to learn cname targets")
+	}
+	return a, err
+}
+
+// AddRules adds temporary rules in domain blocklist format that expire after
+// the given time-to-live.
+func (r *Blocklist) AddRules(rules []string, ttl time.Duration) error {
+	return r.temporaryDB.Add(rules, ttl)
+}
+
+// RemoveRules removes temporary rules before they expire.
+func (r *Blocklist) RemoveRules(rules []string) {
+	r.temporaryDB.Remove(rules)
+}
+
+// ServeHTTP lists the temporary rules on GET. POST adds the rules given in
+// the "rule" parameter with the time-to-live in the "ttl" parameter, DELETE
+// removes them.
+func (r *Blocklist) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.temporaryDB.Rules())
+	case http.MethodPost:
+		rules := params["rule"]
+		if len(rules) == 0 {
+			http.Error(w, "missing rule parameter", http.StatusBadRequest)
+			return
+		}
+		ttl, err := time.ParseDuration(params.Get("ttl"))
+		if err != nil {
+			http.Error(w, "invalid ttl parameter", http.StatusBadRequest)
+			return
+		}
+		if err := r.AddRules(rules, ttl); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		Log.WithFields(logrus.Fields{"id": r.id, "rules": strings.Join(rules, ","), "ttl": ttl}).Info("added temporary blocklist rules")
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		rules := params["rule"]
+		if len(rules) == 0 {
+			http.Error(w, "missing rule parameter", http.StatusBadRequest)
+			return
+		}
+		r.RemoveRules(rules)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Close stops reloading the lists.
+func (r *Blocklist) Close() error {
+	r.closeOnce.Do(func() { close(r.stop) })
+	return nil
+}
+
 func (r *Blocklist) refreshLoopBlocklist(refresh time.Duration) {
 	for {
-		time.Sleep(refresh)
+		// Without refresh period, only reload when notified
+		var timer <-chan time.Time
+		if refresh > 0 {
+			timer = time.After(refresh)
+		}
+		select {
+		case <-timer:
+		case <-r.BlocklistNotify:
+		case <-r.stop:
+			return
+		}
 		log := Log.WithField("id", r.id)
 		log.Debug("reloading blocklist")
-		db, err := r.BlocklistDB.Reload()
+		db, err := r.blocklistDB.Load().Reload()
 		if err != nil {
 			log.WithError(err).Error("failed to load rules")
 			continue
 		}
-		r.mu.Lock()
-		r.BlocklistDB = db
-		r.mu.Unlock()
+		r.blocklistDB.Store(db)
 	}
 }
 
 func (r *Blocklist) refreshLoopAllowlist(refresh time.Duration) {
 	for {
-		time.Sleep(refresh)
+		select {
+		case <-time.After(refresh):
+		case <-r.stop:
+			return
+		}
 		log := Log.WithField("id", r.id)
 		log.Debug("reloading allowlist")
-		db, err := r.AllowlistDB.Reload()
+		db, err := r.allowlistDB.Load().Reload()
 		if err != nil {
 			log.WithError(err).Error("failed to load rules")
 			continue
 		}
-		r.mu.Lock()
-		r.AllowlistDB = db
-		r.mu.Unlock()
+		r.allowlistDB.Store(db)
 	}
 }
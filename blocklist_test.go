@@ -1,7 +1,9 @@
 package rdns
 
 import (
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
@@ -27,13 +29,13 @@ func TestBlocklistRegexp(t *testing.T) {
 
 	// First query a domain not blocked. Should be passed through to the resolver
 	q.SetQuestion("test.com.", dns.TypeA)
-	_, err = b.Resolve(q, ci, nil)
+	_, err = b.Resolve(q, ci)
 	require.NoError(t, err)
 	require.Equal(t, 1, r.HitCount())
 
 	// One domain from the blocklist should come back with NXDOMAIN
 	q.SetQuestion("x.evil.test.", dns.TypeA)
-	a, err := b.Resolve(q, ci, nil)
+	a, err := b.Resolve(q, ci)
 	require.NoError(t, err)
 	require.Equal(t, 1, r.HitCount())
 	require.Equal(t, dns.RcodeNameError, a.Rcode)
@@ -65,20 +67,210 @@ func TestBlocklistAllow(t *testing.T) {
 
 	// First query a domain not blocked. Should be passed through to the resolver
 	q.SetQuestion("test.com.", dns.TypeA)
-	_, err = b.Resolve(q, ci, nil)
+	_, err = b.Resolve(q, ci)
 	require.NoError(t, err)
 	require.Equal(t, 1, r.HitCount())
 
 	// One domain from the blocklist should come back with NXDOMAIN
 	q.SetQuestion("x.evil.test.", dns.TypeA)
-	a, err := b.Resolve(q, ci, nil)
+	a, err := b.Resolve(q, ci)
 	require.NoError(t, err)
 	require.Equal(t, 1, r.HitCount())
 	require.Equal(t, dns.RcodeNameError, a.Rcode)
 
 	// One domain blocklist that also matches the allowlist should go through
 	q.SetQuestion("good.evil.test.", dns.TypeA)
-	_, err = b.Resolve(q, ci, nil)
+	_, err = b.Resolve(q, ci)
 	require.NoError(t, err)
 	require.Equal(t, 2, r.HitCount())
 }
+
+// Loader with rules that can be changed while a blocklist is using it.
+type testReloadLoader struct {
+	mu    sync.Mutex
+	rules []string
+	err   error
+}
+
+func (l *testReloadLoader) Load() ([]string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return nil, l.err
+	}
+	return l.rules, nil
+}
+
+func (l *testReloadLoader) fail(err error) {
+	l.mu.Lock()
+	l.err = err
+	l.mu.Unlock()
+}
+
+func (l *testReloadLoader) set(rules []string) {
+	l.mu.Lock()
+	l.rules = rules
+	l.mu.Unlock()
+}
+
+func TestBlocklistReload(t *testing.T) {
+	var ci ClientInfo
+	r := new(TestResolver)
+
+	loader := &testReloadLoader{rules: []string{`(^|\.)evil\.test`}}
+	m, err := NewRegexpDB("testlist", loader)
+	require.NoError(t, err)
+
+	opt := BlocklistOptions{
+		BlocklistDB:      m,
+		BlocklistRefresh: 10 * time.Millisecond,
+	}
+	b, err := NewBlocklist("test-bl", r, opt)
+	require.NoError(t, err)
+
+	blocked := func(name string) bool {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		a, err := b.Resolve(q, ci)
+		require.NoError(t, err)
+		return a.Rcode == dns.RcodeNameError
+	}
+	require.True(t, blocked("x.evil.test."))
+	require.False(t, blocked("x.bad.test."))
+
+	// Keep querying while the rules are replaced, the new database should be
+	// used once it's loaded
+	loader.set([]string{`(^|\.)bad\.test`})
+	require.Eventually(t, func() bool {
+		return blocked("x.bad.test.") && !blocked("x.evil.test.")
+	}, time.Second, time.Millisecond)
+}
+
+func TestBlocklistAllowLearnCNAME(t *testing.T) {
+	var ci ClientInfo
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			if q.Question[0].Name == "www.good.test." {
+				a.Answer = []dns.RR{
+					&dns.CNAME{
+						Hdr:    dns.RR_Header{Name: "www.good.test.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+						Target: "good.cdn.test.",
+					},
+				}
+			}
+			return a, nil
+		},
+	}
+	blockDB, err := NewDomainDB("testlist", NewStaticLoader([]string{".cdn.test"}))
+	require.NoError(t, err)
+	allowDB, err := NewDomainDB("testlist", NewStaticLoader([]string{"www.good.test"}))
+	require.NoError(t, err)
+	b, err := NewBlocklist("test-bl-learn", r, BlocklistOptions{
+		BlocklistDB:         blockDB,
+		AllowlistDB:         allowDB,
+		AllowlistLearnCNAME: time.Hour,
+	})
+	require.NoError(t, err)
+
+	resolve := func(name string) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		a, err := b.Resolve(q, ci)
+		require.NoError(t, err)
+		return a
+	}
+
+	// The CDN name is blocked until the allowlisted name pointing to it is resolved
+	require.Equal(t, dns.RcodeNameError, resolve("good.cdn.test.").Rcode)
+	require.Equal(t, dns.RcodeSuccess, resolve("www.good.test.").Rcode)
+	require.Equal(t, dns.RcodeSuccess, resolve("good.cdn.test.").Rcode)
+	require.Equal(t, dns.RcodeNameError, resolve("other.cdn.test.").Rcode)
+}
+
+func TestBlocklistCategoryActions(t *testing.T) {
+	var ci ClientInfo
+	upstream := new(TestResolver)
+	redirect := new(TestResolver)
+
+	// One list with categories per rule, one with a category for the whole list
+	feedDB, err := NewDomainDB("feed", NewStaticLoader([]string{
+		"ads.test $category=ads",
+		"adult.test $category=adult",
+		"malware.test $category=malware",
+		"other.test",
+	}))
+	require.NoError(t, err)
+	trackingDB, err := NewDomainDB("tracking", NewStaticLoader([]string{"tracker.test"}))
+	require.NoError(t, err)
+	db, err := NewMultiDB(feedDB, NewCategoryDB("tracking", trackingDB))
+	require.NoError(t, err)
+
+	b, err := NewBlocklist("test-bl-category", upstream, BlocklistOptions{
+		BlocklistDB: db,
+		CategoryActions: map[string]CategoryAction{
+			"ads":      {Action: CategoryActionLog},
+			"tracking": {Action: CategoryActionLog},
+			"adult":    {Action: CategoryActionRedirect, Resolver: redirect},
+			"malware":  {Action: CategoryActionBlock},
+		},
+	})
+	require.NoError(t, err)
+
+	resolve := func(name string) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		a, err := b.Resolve(q, ci)
+		require.NoError(t, err)
+		return a
+	}
+
+	// Log-only categories are forwarded upstream
+	require.Equal(t, dns.RcodeSuccess, resolve("ads.test.").Rcode)
+	require.Equal(t, dns.RcodeSuccess, resolve("tracker.test.").Rcode)
+	require.Equal(t, 2, upstream.HitCount())
+
+	// Redirected categories go to the alternative resolver
+	resolve("adult.test.")
+	require.Equal(t, 1, redirect.HitCount())
+
+	// Blocked categories and rules without category are blocked
+	require.Equal(t, dns.RcodeNameError, resolve("malware.test.").Rcode)
+	require.Equal(t, dns.RcodeNameError, resolve("other.test.").Rcode)
+	require.Equal(t, 2, upstream.HitCount())
+}
+
+func TestBlocklistAudit(t *testing.T) {
+	var ci ClientInfo
+	upstream := new(TestResolver)
+
+	enforcedDB, err := NewDomainDB("enforced", NewStaticLoader([]string{"block.test"}))
+	require.NoError(t, err)
+	newDB, err := NewDomainDB("new", NewStaticLoader([]string{"block.test", "maybe.test"}))
+	require.NoError(t, err)
+
+	// The list in audit mode comes first, it must not hide the match of the enforced list
+	db, err := NewMultiDB(NewAuditDB(newDB), enforcedDB)
+	require.NoError(t, err)
+	b, err := NewBlocklist("test-bl-audit", upstream, BlocklistOptions{BlocklistDB: db})
+	require.NoError(t, err)
+
+	resolve := func(b *Blocklist, name string) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		a, err := b.Resolve(q, ci)
+		require.NoError(t, err)
+		return a
+	}
+	require.Equal(t, dns.RcodeSuccess, resolve(b, "maybe.test.").Rcode)
+	require.Equal(t, 1, upstream.HitCount())
+	require.Equal(t, dns.RcodeNameError, resolve(b, "block.test.").Rcode)
+	require.Equal(t, 1, upstream.HitCount())
+
+	// The whole blocklist in audit mode
+	b, err = NewBlocklist("test-bl-audit-all", upstream, BlocklistOptions{BlocklistDB: enforcedDB, Audit: true})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, resolve(b, "block.test.").Rcode)
+	require.Equal(t, 2, upstream.HitCount())
+}
@@ -0,0 +1,109 @@
+package rdns
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// AsyncDB is a blocklist database that loads its rules in the background, so
+// large lists don't delay the startup. Until the list is loaded, queries
+// either don't match (fail-open) or fail with SERVFAIL (fail-closed) in
+// blocklists using it. A failed load is retried until it succeeds.
+type AsyncDB struct {
+	name string
+	load func() (BlocklistDB, error)
+	opt  AsyncDBOptions
+	db   atomic.Pointer[BlocklistDB]
+
+	// Closed to stop retrying the load
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+var _ BlocklistDB = &AsyncDB{}
+
+// AsyncDBOptions holds options for background-loaded blocklist databases.
+type AsyncDBOptions struct {
+	// Fail queries until the list is loaded, rather than not matching them.
+	FailClosed bool
+
+	// Time to wait before retrying a failed load. Defaults to 1 minute.
+	RetryInterval time.Duration
+}
+
+// NewAsyncDB returns a database that is populated in the background with the
+// database returned by the load function.
+func NewAsyncDB(name string, load func() (BlocklistDB, error), opt AsyncDBOptions) *AsyncDB {
+	if opt.RetryInterval <= 0 {
+		opt.RetryInterval = time.Minute
+	}
+	m := &AsyncDB{name: name, load: load, opt: opt, stop: make(chan struct{})}
+	go m.loadLoop()
+	return m
+}
+
+func (m *AsyncDB) loadLoop() {
+	log := Log.WithField("list", m.name)
+	for {
+		start := time.Now()
+		db, err := m.load()
+		if err == nil {
+			m.db.Store(&db)
+			log.WithField("load-time", time.Since(start)).Info("completed loading blocklist in background")
+			return
+		}
+		log.WithError(err).Error("failed to load blocklist in background, retrying")
+		select {
+		case <-time.After(m.opt.RetryInterval):
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// Close stops retrying a failed load.
+func (m *AsyncDB) Close() error {
+	m.closeOnce.Do(func() { close(m.stop) })
+	return nil
+}
+
+// Reload returns a new instance of the database with the rules loaded again.
+// If the initial load is still in progress, the database itself is returned.
+func (m *AsyncDB) Reload() (BlocklistDB, error) {
+	db := m.db.Load()
+	if db == nil {
+		return m, nil
+	}
+	return (*db).Reload()
+}
+
+func (m *AsyncDB) Match(q dns.Question) ([]net.IP, []string, *BlocklistMatch, bool) {
+	db := m.db.Load()
+	if db == nil {
+		return nil, nil, nil, false
+	}
+	return (*db).Match(q)
+}
+
+// Loaded returns true once the rules are loaded.
+func (m *AsyncDB) Loaded() bool {
+	return m.db.Load() != nil
+}
+
+// Unhealthy returns true if the list isn't loaded yet and fails closed, or if
+// the loaded list is unhealthy.
+func (m *AsyncDB) Unhealthy() bool {
+	db := m.db.Load()
+	if db == nil {
+		return m.opt.FailClosed
+	}
+	return dbUnhealthy(*db)
+}
+
+func (m *AsyncDB) String() string {
+	return m.name
+}
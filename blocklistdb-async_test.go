@@ -0,0 +1,59 @@
+package rdns
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAsyncDB(t *testing.T) {
+	release := make(chan struct{})
+	var attempts atomic.Int32
+	load := func() (BlocklistDB, error) {
+		<-release
+		// The first attempt fails and is retried
+		if attempts.Add(1) == 1 {
+			return nil, errors.New("failed")
+		}
+		return NewDomainDB("test-async", NewStaticLoader([]string{"evil.test"}))
+	}
+	db := NewAsyncDB("test-async", load, AsyncDBOptions{FailClosed: true, RetryInterval: 10 * time.Millisecond})
+	q := dns.Question{Name: "evil.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	// Nothing matches and queries fail until the list is loaded
+	_, _, _, ok := db.Match(q)
+	require.False(t, ok)
+	require.True(t, db.Unhealthy())
+	reloaded, err := db.Reload()
+	require.NoError(t, err)
+	require.Equal(t, db, reloaded)
+
+	close(release)
+	require.Eventually(t, db.Loaded, time.Second, 5*time.Millisecond)
+	require.Equal(t, int32(2), attempts.Load())
+	_, _, _, ok = db.Match(q)
+	require.True(t, ok)
+	require.False(t, db.Unhealthy())
+}
+
+func TestAsyncDBClose(t *testing.T) {
+	var attempts atomic.Int32
+	load := func() (BlocklistDB, error) {
+		attempts.Add(1)
+		return nil, errors.New("failed")
+	}
+	db := NewAsyncDB("test-async", load, AsyncDBOptions{RetryInterval: 10 * time.Millisecond})
+	require.Eventually(t, func() bool { return attempts.Load() > 1 }, time.Second, 5*time.Millisecond)
+
+	// Failed loads aren't retried once closed
+	require.NoError(t, db.Close())
+	time.Sleep(20 * time.Millisecond)
+	n := attempts.Load()
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, n, attempts.Load())
+	require.False(t, db.Loaded())
+}
@@ -0,0 +1,48 @@
+package rdns
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// AuditDB wraps a blocklist database whose matches are only logged and
+// counted, but not blocked, for example to evaluate a new list against real
+// traffic for false positives before enforcing it.
+type AuditDB struct {
+	db BlocklistDB
+}
+
+var _ BlocklistDB = &AuditDB{}
+
+// NewAuditDB returns a database that marks the matches of db as audit-only.
+func NewAuditDB(db BlocklistDB) *AuditDB {
+	return &AuditDB{db: db}
+}
+
+func (m *AuditDB) Reload() (BlocklistDB, error) {
+	db, err := m.db.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return NewAuditDB(db), nil
+}
+
+// Unhealthy returns false, lists in audit mode never fail queries.
+func (m *AuditDB) Unhealthy() bool {
+	return false
+}
+
+func (m *AuditDB) Match(q dns.Question) ([]net.IP, []string, *BlocklistMatch, bool) {
+	ips, names, match, ok := m.db.Match(q)
+	if ok && match != nil {
+		audited := *match
+		audited.Audit = true
+		match = &audited
+	}
+	return ips, names, match, ok
+}
+
+func (m *AuditDB) String() string {
+	return m.db.String()
+}
@@ -0,0 +1,49 @@
+package rdns
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// CategoryDB wraps a blocklist database and tags its matches with a category,
+// like "ads" or "malware", unless the rule that matched has a category of its
+// own.
+type CategoryDB struct {
+	category string
+	db       BlocklistDB
+}
+
+var _ BlocklistDB = &CategoryDB{}
+
+// NewCategoryDB returns a database that tags the matches of db with category.
+func NewCategoryDB(category string, db BlocklistDB) *CategoryDB {
+	return &CategoryDB{category: category, db: db}
+}
+
+func (m *CategoryDB) Reload() (BlocklistDB, error) {
+	db, err := m.db.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return NewCategoryDB(m.category, db), nil
+}
+
+// Unhealthy returns true if the wrapped database is unhealthy.
+func (m *CategoryDB) Unhealthy() bool {
+	return dbUnhealthy(m.db)
+}
+
+func (m *CategoryDB) Match(q dns.Question) ([]net.IP, []string, *BlocklistMatch, bool) {
+	ips, names, match, ok := m.db.Match(q)
+	if ok && match != nil && match.Category == "" {
+		tagged := *match
+		tagged.Category = m.category
+		match = &tagged
+	}
+	return ips, names, match, ok
+}
+
+func (m *CategoryDB) String() string {
+	return m.db.String()
+}
@@ -3,9 +3,13 @@ package rdns
 import (
 	"fmt"
 	"net"
+	"slices"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/miekg/dns"
+	"golang.org/x/net/idna"
 )
 
 // DomainDB holds a list of domain strings (potentially with wildcards). Matching
@@ -13,10 +17,21 @@ import (
 // domain.com: matches just domain.com and not subdomains
 // .domain.com: matches domain.com and all subdomains
 // *.domain.com: matches all subdomains but not domain.com
+// *.zip: matches all names in a top-level domain
+// ||domain.com^: same as .domain.com, the anchors used in adblock lists
+//
+// Rules and query names are matched case-insensitively. Internationalized
+// domain names in rules are converted to their punycode form, so they match
+// the names that are queried.
+//
+// Rules can have an expiry time, like "domain.com $expires=2024-01-02T15:04:05Z",
+// after which they no longer match, and a category like "domain.com $category=ads".
 type DomainDB struct {
-	name   string
-	root   node
-	loader BlocklistLoader
+	name       string
+	root       node
+	loader     BlocklistLoader
+	expiry     map[string]time.Time // Expiry time of rules that expire
+	categories map[string]string    // Category of rules that have one
 }
 
 type node map[string]node
@@ -30,11 +45,37 @@ func NewDomainDB(name string, loader BlocklistLoader) (*DomainDB, error) {
 		return nil, err
 	}
 	root := make(node)
+	expiry := make(map[string]time.Time)
+	categories := make(map[string]string)
+	permanent := make(map[string]struct{})
+	now := time.Now()
 	for _, r := range rules {
-		r = strings.TrimSpace(r)
+		r, opt, err := parseRuleOptions(strings.TrimSpace(r))
+		if err != nil {
+			return nil, err
+		}
+		r, err = normalizeDomainRule(r)
+		if err != nil {
+			return nil, err
+		}
+		expires := opt.expires
+		if opt.category != "" {
+			categories[r] = opt.category
+		}
 
-		// Strip trailing . in case the list has FQDN names with . suffixes.
-		r = strings.TrimSuffix(r, ".")
+		// Skip rules that expired already, and keep track of the ones that
+		// don't expire in case the same rule is also listed with expiry.
+		if !expires.IsZero() {
+			if expires.Before(now) {
+				continue
+			}
+			if _, ok := permanent[r]; !ok && expires.After(expiry[r]) {
+				expiry[r] = expires
+			}
+		} else {
+			permanent[r] = struct{}{}
+			delete(expiry, r)
+		}
 
 		// Break up the domain into its parts and iterate backwards over them, building
 		// a graph of maps
@@ -56,15 +97,20 @@ func NewDomainDB(name string, loader BlocklistLoader) (*DomainDB, error) {
 			n = subNode
 		}
 	}
-	return &DomainDB{name, root, loader}, nil
+	return &DomainDB{name, root, loader, expiry, categories}, nil
 }
 
 func (m *DomainDB) Reload() (BlocklistDB, error) {
 	return NewDomainDB(m.name, m.loader)
 }
 
+// Unhealthy returns true if the list is stale and queries should fail.
+func (m *DomainDB) Unhealthy() bool {
+	return loaderUnhealthy(m.loader)
+}
+
 func (m *DomainDB) Match(q dns.Question) ([]net.IP, []string, *BlocklistMatch, bool) {
-	s := strings.TrimSuffix(q.Name, ".")
+	s := strings.ToLower(strings.TrimSuffix(q.Name, "."))
 	var matched []string
 	parts := strings.Split(s, ".")
 	n := m.root
@@ -76,32 +122,77 @@ func (m *DomainDB) Match(q dns.Question) ([]net.IP, []string, *BlocklistMatch, b
 		}
 		matched = append(matched, part)
 		if _, ok := subNode[""]; ok { // exact and sub-domain match
-			return nil,
-				nil,
-				&BlocklistMatch{
-					List: m.name,
-					Rule: matchedDomainParts(".", matched),
-				},
-				true
+			if rule := matchedDomainParts(".", slices.Clone(matched)); !m.expired(rule) {
+				return nil, nil, m.match(rule), true
+			}
 		}
 		if _, ok := subNode["*"]; ok && i > 0 { // wildcard match on sub-domains
-			return nil,
-				nil,
-				&BlocklistMatch{
-					List: m.name,
-					Rule: matchedDomainParts("*.", matched),
-				},
-				true
+			if rule := matchedDomainParts("*.", slices.Clone(matched)); !m.expired(rule) {
+				return nil, nil, m.match(rule), true
+			}
 		}
 		n = subNode
 	}
-	return nil,
-		nil,
-		&BlocklistMatch{
-			List: m.name,
-			Rule: matchedDomainParts("", matched),
-		},
-		len(n) == 0 // exact match
+	rule := matchedDomainParts("", matched)
+	return nil, nil, m.match(rule), len(n) == 0 && !m.expired(rule) // exact match
+}
+
+func (m *DomainDB) match(rule string) *BlocklistMatch {
+	return &BlocklistMatch{
+		List:     m.name,
+		Rule:     rule,
+		Category: m.categories[rule],
+	}
+}
+
+// Brings a rule in domain format into the form it's stored in: lower-case,
+// without trailing dot, adblock anchors replaced and internationalized names
+// in punycode.
+func normalizeDomainRule(r string) (string, error) {
+	// Strip trailing . in case the list has FQDN names with . suffixes.
+	r = strings.TrimSuffix(r, ".")
+
+	// Adblock-style "||domain.com^" matches the domain and all sub-domains
+	if strings.HasPrefix(r, "||") {
+		r = "." + strings.TrimSuffix(strings.TrimPrefix(r, "||"), "^")
+	}
+	r = strings.ToLower(r)
+
+	// Convert internationalized names to punycode, mapping look-alike forms
+	// like full-width characters the same way they are mapped on lookup
+	if !isASCII(r) {
+		var prefix string
+		switch {
+		case strings.HasPrefix(r, "*."):
+			prefix, r = "*.", r[2:]
+		case strings.HasPrefix(r, "."):
+			prefix, r = ".", r[1:]
+		}
+		name, err := idna.Lookup.ToASCII(r)
+		if err != nil {
+			return "", fmt.Errorf("invalid blocklist item: '%s': %w", r, err)
+		}
+		r = prefix + name
+	}
+	return r, nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if the rule has an expiry time that has passed.
+func (m *DomainDB) expired(rule string) bool {
+	if len(m.expiry) == 0 {
+		return false
+	}
+	expires, ok := m.expiry[rule]
+	return ok && time.Now().After(expires)
 }
 
 func (m *DomainDB) String() string {
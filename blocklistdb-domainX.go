@@ -16,13 +16,24 @@ import (
 // domain.com: matches just domain.com and not subdomains
 // .domain.com: matches domain.com and all subdomains
 // *.domain.com: matches all subdomains but not domain.com
+//
+// Rules can be followed by one or more IPs, separated by whitespace, to spoof
+// the response for matching queries instead of blocking them, for example
+// "domain:ads.com 10.0.0.1 fd00::1".
 type DomainXDB struct {
 	name   string
 	// root   nodeX
 	domains *router.DomainMatcher
+	spoof   []domainXSpoof
 	loader *PanelLoader
 }
 
+// Rules that share the same spoof IPs.
+type domainXSpoof struct {
+	ips     []net.IP
+	domains *router.DomainMatcher
+}
+
 var _ BlocklistDB = &DomainXDB{}
 
 
@@ -46,19 +57,55 @@ func NewDomainXDB(name string, loader *PanelLoader) (*DomainXDB, error) {
 	sort.Slice(domains, lessFunc)
 
 	Domains := []*router.Domain{}
+	spoofDomains := make(map[string][]*router.Domain)
+	spoofIPs := make(map[string][]net.IP)
 	for _, domain := range domains {
-		rules, err := conf.ParseDomainRule(domain)
+		fields := strings.Fields(domain)
+		if len(fields) == 0 {
+			continue
+		}
+		rules, err := conf.ParseDomainRule(fields[0])
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse domain rule: %s, err: %S", domain, err)
+			return nil, fmt.Errorf("failed to parse domain rule: %s, err: %s", domain, err)
 		}
-		Domains = append(Domains, rules...)
+		if len(fields) == 1 {
+			Domains = append(Domains, rules...)
+			continue
+		}
+		var ips []net.IP
+		for _, f := range fields[1:] {
+			ip := net.ParseIP(f)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid spoof IP '%s' in domain rule: %s", f, domain)
+			}
+			ips = append(ips, ip)
+		}
+		key := strings.Join(fields[1:], " ")
+		spoofDomains[key] = append(spoofDomains[key], rules...)
+		spoofIPs[key] = ips
 	}
 	DomainMatcher, err := router.NewMphMatcherGroup(Domains)
 	if err != nil {
 		return nil, fmt.Errorf("failed to build domain matcher : %s", err)
 	}
 
-	return &DomainXDB{name, DomainMatcher, loader}, nil
+	// Rules with spoof IPs are grouped by IPs, there are typically only a few
+	// distinct targets, one per category
+	keys := make([]string, 0, len(spoofDomains))
+	for key := range spoofDomains {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var spoof []domainXSpoof
+	for _, key := range keys {
+		matcher, err := router.NewMphMatcherGroup(spoofDomains[key])
+		if err != nil {
+			return nil, fmt.Errorf("failed to build domain matcher : %s", err)
+		}
+		spoof = append(spoof, domainXSpoof{ips: spoofIPs[key], domains: matcher})
+	}
+
+	return &DomainXDB{name, DomainMatcher, spoof, loader}, nil
 }
 
 func (m *DomainXDB) Reload() (BlocklistDB, error) {
@@ -67,7 +114,11 @@ func (m *DomainXDB) Reload() (BlocklistDB, error) {
 
 func (m *DomainXDB) Match(q dns.Question) ([]net.IP, []string, *BlocklistMatch, bool) {
 	s := strings.TrimSuffix(q.Name, ".")
-	
+	for _, sp := range m.spoof {
+		if sp.domains.ApplyDomain(s) {
+			return sp.ips, nil, &BlocklistMatch{List: m.name, Rule: s}, true
+		}
+	}
 
 	return nil,
 		nil,
@@ -0,0 +1,49 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDomainXDBSpoof(t *testing.T) {
+	loader := &PanelLoader{opt: PanelLoaderOptions{
+		Type: "block",
+		NodeInfo: &api.NodeInfo{RouteDNS: &api.RouteDns{Block: api.RouteDnsConfig{
+			Domains: []string{
+				"domain:ads.com",
+				"domain:adult.com 10.0.0.1 fd00::1",
+				"domain:gambling.com 10.0.0.2",
+				"full:casino.com 10.0.0.2",
+			},
+		}}},
+	}}
+	db, err := NewDomainXDB("block", loader)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		match bool
+		ips   []net.IP
+	}{
+		{name: "www.ads.com.", match: true},
+		{name: "adult.com.", match: true, ips: []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")}},
+		{name: "x.gambling.com.", match: true, ips: []net.IP{net.ParseIP("10.0.0.2")}},
+		{name: "casino.com.", match: true, ips: []net.IP{net.ParseIP("10.0.0.2")}},
+		{name: "www.casino.com."},
+		{name: "example.com."},
+	}
+	for _, test := range tests {
+		ips, _, _, ok := db.Match(dns.Question{Name: test.name, Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		require.Equal(t, test.match, ok, test.name)
+		require.Equal(t, test.ips, ips, test.name)
+	}
+
+	// Invalid spoof IP
+	loader.opt.NodeInfo.RouteDNS.Block.Domains = []string{"domain:ads.com not-an-ip"}
+	_, err = NewDomainXDB("block", loader)
+	require.Error(t, err)
+}
@@ -1,7 +1,9 @@
 package rdns
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
@@ -52,6 +54,86 @@ func TestDomainDB(t *testing.T) {
 	}
 }
 
+func TestDomainDBExpiry(t *testing.T) {
+	future := time.Now().Add(time.Hour)
+	loader := NewStaticLoader([]string{
+		"domain1.com $expires=" + future.Format(time.RFC3339),
+		".domain2.com $expires=2020-01-01T00:00:00Z", // expired already
+		".domain3.com $expires=1577836800",           // expired, but the rule below doesn't expire
+		"x.domain3.com",
+		fmt.Sprintf("*.domain4.com $expires=%d", future.Unix()),
+	})
+
+	m, err := NewDomainDB("testlist", loader)
+	require.NoError(t, err)
+
+	tests := []struct {
+		q     string
+		match bool
+	}{
+		{"domain1.com.", true},
+		{"domain2.com.", false},
+		{"sub.domain2.com.", false},
+		{"domain3.com.", false},
+		{"x.domain3.com.", true},
+		{"sub.domain4.com.", true},
+	}
+	for _, test := range tests {
+		q := dns.Question{Name: test.q, Qtype: dns.TypeA, Qclass: dns.ClassINET}
+		_, _, _, ok := m.Match(q)
+		require.Equal(t, test.match, ok, "query: %s", test.q)
+	}
+
+	// Rules stop matching once they expire
+	m.expiry["domain1.com"] = time.Now().Add(-time.Second)
+	_, _, _, ok := m.Match(dns.Question{Name: "domain1.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	require.False(t, ok)
+
+	// Invalid expiry
+	_, err = NewDomainDB("testlist", NewStaticLoader([]string{"domain1.com $expires=tomorrow"}))
+	require.Error(t, err)
+}
+
+func TestDomainDBNormalize(t *testing.T) {
+	loader := NewStaticLoader([]string{
+		"*.zip",           // entire TLD
+		"||tracker.test^", // adblock anchors, domain and sub-domains
+		"UPPER.test",      // case-insensitive
+		"pаypal.test",     // Cyrillic "а", a homograph of paypal.test
+		".ｅｖｉｌ.test",      // full-width characters, mapped to "evil"
+		"*.bücher.test",
+	})
+	m, err := NewDomainDB("testlist", loader)
+	require.NoError(t, err)
+
+	tests := []struct {
+		q     string
+		match bool
+	}{
+		{"evil.zip.", true},
+		{"sub.evil.zip.", true},
+		{"zip.", false},
+		{"tracker.test.", true},
+		{"sub.tracker.test.", true},
+		{"upper.test.", true},
+		{"Upper.Test.", true},
+
+		// only the punycode form of the homograph matches, not the real name
+		{"xn--pypal-4ve.test.", true},
+		{"XN--PYPAL-4VE.TEST.", true},
+		{"paypal.test.", false},
+
+		{"evil.test.", true},
+		{"www.xn--bcher-kva.test.", true},
+		{"www.bucher.test.", false},
+	}
+	for _, test := range tests {
+		q := dns.Question{Name: test.q, Qtype: dns.TypeA, Qclass: dns.ClassINET}
+		_, _, _, ok := m.Match(q)
+		require.Equal(t, test.match, ok, "query: %s", test.q)
+	}
+}
+
 func TestDomainDBError(t *testing.T) {
 	tests := []struct {
 		name string
@@ -86,6 +86,11 @@ func (m *HostsDB) Reload() (BlocklistDB, error) {
 	return NewHostsDB(m.name, m.loader)
 }
 
+// Unhealthy returns true if the list is stale and queries should fail.
+func (m *HostsDB) Unhealthy() bool {
+	return loaderUnhealthy(m.loader)
+}
+
 func (m *HostsDB) Match(q dns.Question) ([]net.IP, []string, *BlocklistMatch, bool) {
 	if q.Qtype == dns.TypePTR {
 		names, ok := m.ptrMap[q.Name]
@@ -30,12 +30,39 @@ func (m MultiDB) Reload() (BlocklistDB, error) {
 	return NewMultiDB(newDBs...)
 }
 
+// Unhealthy returns true if any of the lists is unhealthy.
+func (m MultiDB) Unhealthy() bool {
+	for _, db := range m.dbs {
+		if dbUnhealthy(db) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns the first match of the lists. Matches of lists in audit mode
+// are only returned if no other list matches, so they don't hide matches of
+// lists that are enforced.
 func (m MultiDB) Match(q dns.Question) ([]net.IP, []string, *BlocklistMatch, bool) {
+	var (
+		auditIPs   []net.IP
+		auditNames []string
+		audit      *BlocklistMatch
+	)
 	for _, db := range m.dbs {
 		if ip, name, match, ok := db.Match(q); ok {
+			if match != nil && match.Audit {
+				if audit == nil {
+					auditIPs, auditNames, audit = ip, name, match
+				}
+				continue
+			}
 			return ip, name, match, ok
 		}
 	}
+	if audit != nil {
+		return auditIPs, auditNames, audit, true
+	}
 	return nil, nil, nil, false
 }
 
@@ -3,16 +3,39 @@ package rdns
 import (
 	"net"
 	"regexp"
+	"regexp/syntax"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/miekg/dns"
 )
 
 // RegexpDB holds a list of regular expressions against which it evaluates DNS queries.
+// To avoid evaluating every expression for every query, literal strings that must be
+// present in any name matching an expression are extracted and combined into a single
+// automaton. Only expressions with a literal found in the name, or those without
+// literals, are evaluated.
+//
+// Rules can have an expiry time, like "(^|\.)domain\.com\.$ $expires=2024-01-02T15:04:05Z",
+// after which they no longer match, and a category like "(^|\.)domain\.com\.$ $category=ads".
 type RegexpDB struct {
 	name   string
 	rules  []*regexp.Regexp
 	loader BlocklistLoader
+
+	// Expiry time of every rule, zero for rules that don't expire. Nil if no
+	// rule expires.
+	expiry []time.Time
+
+	// Category of every rule, empty for rules without. Nil if no rule has one.
+	categories []string
+
+	// Finds the indexes of rules with a required literal in a name
+	literals *ahoCorasick
+
+	// Indexes of rules without a literal, these are always evaluated
+	unfiltered []int32
 }
 
 var _ BlocklistDB = &RegexpDB{}
@@ -23,30 +46,93 @@ func NewRegexpDB(name string, loader BlocklistLoader) (*RegexpDB, error) {
 	if err != nil {
 		return nil, err
 	}
-	var filters []*regexp.Regexp
+	db := &RegexpDB{name: name, loader: loader}
+	var (
+		literals []string
+		indexes  []int32
+	)
+	var (
+		now           = time.Now()
+		expiry        []time.Time
+		categories    []string
+		anyExpires    bool
+		anyCategories bool
+	)
 	for _, r := range rules {
 		r = strings.TrimSpace(r)
 		if r == "" || strings.HasPrefix(r, "#") {
 			continue
 		}
+		r, opt, err := parseRuleOptions(r)
+		if err != nil {
+			return nil, err
+		}
+		expires := opt.expires
+		if !expires.IsZero() && expires.Before(now) {
+			continue
+		}
 		re, err := regexp.Compile(r)
 		if err != nil {
 			return nil, err
 		}
-		filters = append(filters, re)
-	}
+		i := int32(len(db.rules))
+		db.rules = append(db.rules, re)
+		expiry = append(expiry, expires)
+		anyExpires = anyExpires || !expires.IsZero()
+		categories = append(categories, opt.category)
+		anyCategories = anyCategories || opt.category != ""
 
-	return &RegexpDB{name, filters, loader}, nil
+		parsed, err := syntax.Parse(r, syntax.Perl)
+		if err != nil {
+			return nil, err
+		}
+		if literal := requiredLiteral(parsed.Simplify()); literal != "" {
+			literals = append(literals, literal)
+			indexes = append(indexes, i)
+		} else {
+			db.unfiltered = append(db.unfiltered, i)
+		}
+	}
+	if anyExpires {
+		db.expiry = expiry
+	}
+	if anyCategories {
+		db.categories = categories
+	}
+	db.literals = newAhoCorasick(literals, indexes)
+	return db, nil
 }
 
 func (m *RegexpDB) Reload() (BlocklistDB, error) {
 	return NewRegexpDB(m.name, m.loader)
 }
 
+// Unhealthy returns true if the list is stale and queries should fail.
+func (m *RegexpDB) Unhealthy() bool {
+	return loaderUnhealthy(m.loader)
+}
+
 func (m *RegexpDB) Match(q dns.Question) ([]net.IP, []string, *BlocklistMatch, bool) {
-	for _, rule := range m.rules {
+	// Evaluate the candidates in the order of the rules so the first matching
+	// rule is reported
+	var buf [32]int32
+	candidates := m.literals.find(q.Name, buf[:0])
+	candidates = append(candidates, m.unfiltered...)
+	slices.Sort(candidates)
+	for i, c := range candidates {
+		if i > 0 && c == candidates[i-1] {
+			continue
+		}
+		rule := m.rules[c]
+		if m.expiry != nil && !m.expiry[c].IsZero() && time.Now().After(m.expiry[c]) {
+			continue
+		}
 		if rule.MatchString(q.Name) {
-			return nil, nil, &BlocklistMatch{List: m.name, Rule: rule.String()}, true
+			match := &BlocklistMatch{List: m.name, Rule: rule.String()}
+			if m.categories != nil {
+				match.Category = m.categories[c]
+			}
+			return nil, nil, match, true
 		}
 	}
 	return nil, nil, nil, false
@@ -55,3 +141,42 @@ func (m *RegexpDB) Match(q dns.Question) ([]net.IP, []string, *BlocklistMatch, b
 func (m *RegexpDB) String() string {
 	return "Regexp"
 }
+
+// Returns a literal string that is part of every string matched by the expression,
+// or an empty string if there is none. The longest such literal is returned.
+func requiredLiteral(re *syntax.Regexp) string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return ""
+		}
+		return string(re.Rune)
+	case syntax.OpCapture, syntax.OpPlus:
+		return requiredLiteral(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min > 0 {
+			return requiredLiteral(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		// Adjacent literals form a longer one
+		var longest, run string
+		for _, sub := range re.Sub {
+			if sub.Op == syntax.OpLiteral && sub.Flags&syntax.FoldCase == 0 {
+				run += string(sub.Rune)
+				continue
+			}
+			if len(run) > len(longest) {
+				longest = run
+			}
+			run = ""
+			if literal := requiredLiteral(sub); len(literal) > len(longest) {
+				longest = literal
+			}
+		}
+		if len(run) > len(longest) {
+			longest = run
+		}
+		return longest
+	}
+	return ""
+}
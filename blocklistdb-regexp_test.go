@@ -0,0 +1,92 @@
+package rdns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegexpDB(t *testing.T) {
+	loader := NewStaticLoader([]string{
+		`(^|\.)evil\.test\.$`,   // literal "evil.test."
+		`^ads?[0-9]+\.`,         // literal "ad"
+		`(?i)tracker`,           // case-insensitive, no literal
+		`^(foo|bar)\.example\.`, // literal ".example."
+		`\.(com|net)\.$`,        // no literal in common
+		`x+y{2,}z`,              // literal "yyz"
+	})
+	m, err := NewRegexpDB("testlist", loader)
+	require.NoError(t, err)
+
+	tests := []struct {
+		q     string
+		match bool
+	}{
+		{"evil.test.", true},
+		{"www.evil.test.", true},
+		{"notevil.test.", false},
+		{"ads12.domain.org.", true},
+		{"ad1.domain.org.", true},
+		{"x.ad1.domain.org.", false},
+		{"TRACKER.domain.org.", true},
+		{"bar.example.org.", true},
+		{"baz.example.org.", false},
+		{"baz.example.com.", true},
+		{"xxyyyz.org.", true},
+		{"xyz.org.", false},
+	}
+	for _, test := range tests {
+		q := dns.Question{Name: test.q, Qtype: dns.TypeA, Qclass: dns.ClassINET}
+		_, _, match, ok := m.Match(q)
+		require.Equal(t, test.match, ok, test.q)
+		if ok {
+			// Confirm the rule that matched by evaluating it on its own
+			require.Regexp(t, match.Rule, test.q)
+		}
+	}
+}
+
+func TestRegexpDBExpiry(t *testing.T) {
+	loader := NewStaticLoader([]string{
+		`^expired\. $expires=2020-01-01T00:00:00Z`,
+		`^temporary\. $expires=` + time.Now().Add(time.Hour).Format(time.RFC3339),
+		`^permanent\.`,
+	})
+	m, err := NewRegexpDB("testlist", loader)
+	require.NoError(t, err)
+	require.Len(t, m.rules, 2)
+
+	_, _, _, ok := m.Match(dns.Question{Name: "expired.test."})
+	require.False(t, ok)
+	_, _, _, ok = m.Match(dns.Question{Name: "temporary.test."})
+	require.True(t, ok)
+
+	// Rules stop matching once they expire
+	m.expiry[0] = time.Now().Add(-time.Second)
+	_, _, _, ok = m.Match(dns.Question{Name: "temporary.test."})
+	require.False(t, ok)
+	_, _, _, ok = m.Match(dns.Question{Name: "permanent.test."})
+	require.True(t, ok)
+}
+
+func TestRegexpDBFirstRule(t *testing.T) {
+	// The first matching rule is reported, no matter which rules have literals
+	loader := NewStaticLoader([]string{
+		`\.test\.$`,
+		`evil`,
+	})
+	m, err := NewRegexpDB("testlist", loader)
+	require.NoError(t, err)
+	_, _, match, ok := m.Match(dns.Question{Name: "evil.test."})
+	require.True(t, ok)
+	require.Equal(t, `\.test\.$`, match.Rule)
+}
+
+func TestAhoCorasick(t *testing.T) {
+	ac := newAhoCorasick([]string{"he", "she", "his", "hers", ""}, []int32{0, 1, 2, 3, 4})
+	require.ElementsMatch(t, []int32{1, 0, 3}, ac.find("ushers", nil))
+	require.ElementsMatch(t, []int32{2}, ac.find("this", nil))
+	require.Empty(t, ac.find("xyz", nil))
+}
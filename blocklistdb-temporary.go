@@ -0,0 +1,155 @@
+package rdns
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TemporaryDB holds domain rules that are added at runtime with a time-to-live,
+// for example to block a domain during an incident. Rules use the same format
+// as the domain blocklist and no longer match once they expired, without a
+// separate cleanup.
+type TemporaryDB struct {
+	name string
+
+	mu    sync.RWMutex
+	rules map[string]time.Time // Expiry time by rule
+}
+
+var _ BlocklistDB = &TemporaryDB{}
+
+// TemporaryRule is a rule with its expiry time.
+type TemporaryRule struct {
+	Rule    string    `json:"rule"`
+	Expires time.Time `json:"expires"`
+}
+
+// NewTemporaryDB returns a new, empty instance of a temporary rule database.
+func NewTemporaryDB(name string) *TemporaryDB {
+	return &TemporaryDB{
+		name:  name,
+		rules: make(map[string]time.Time),
+	}
+}
+
+// Add rules that expire after the given time-to-live. Adding a rule that
+// exists already updates its expiry time.
+func (m *TemporaryDB) Add(rules []string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("invalid ttl '%s'", ttl)
+	}
+	expires := time.Now().Add(ttl)
+	var parsed []string
+	for _, r := range rules {
+		r = strings.TrimSpace(r)
+		if strings.HasPrefix(r, "#") || r == "" {
+			continue
+		}
+		r, err := normalizeDomainRule(r)
+		if err != nil {
+			return err
+		}
+		if strings.ContainsAny(r, " \t") || strings.Contains(strings.TrimPrefix(r, "*."), "*") {
+			return fmt.Errorf("invalid rule '%s'", r)
+		}
+		parsed = append(parsed, r)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prune()
+	for _, r := range parsed {
+		m.rules[r] = expires
+	}
+	return nil
+}
+
+// Remove rules before they expire.
+func (m *TemporaryDB) Remove(rules []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range rules {
+		if r, err := normalizeDomainRule(strings.TrimSpace(r)); err == nil {
+			delete(m.rules, r)
+		}
+	}
+}
+
+// Rules returns all rules that haven't expired yet, sorted by rule.
+func (m *TemporaryDB) Rules() []TemporaryRule {
+	now := time.Now()
+	m.mu.RLock()
+	list := make([]TemporaryRule, 0, len(m.rules))
+	for r, expires := range m.rules {
+		if now.Before(expires) {
+			list = append(list, TemporaryRule{Rule: r, Expires: expires})
+		}
+	}
+	m.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Rule < list[j].Rule })
+	return list
+}
+
+// Reload returns the database itself since the rules aren't loaded from a source.
+func (m *TemporaryDB) Reload() (BlocklistDB, error) {
+	return m, nil
+}
+
+func (m *TemporaryDB) Match(q dns.Question) ([]net.IP, []string, *BlocklistMatch, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.rules) == 0 {
+		return nil, nil, nil, false
+	}
+	now := time.Now()
+	s := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+	match := func(rule string) (*BlocklistMatch, bool) {
+		expires, ok := m.rules[rule]
+		if !ok || !now.Before(expires) {
+			return nil, false
+		}
+		return &BlocklistMatch{List: m.name, Rule: rule}, true
+	}
+
+	// Exact match
+	if match, ok := match(s); ok {
+		return nil, nil, match, true
+	}
+	// Exact and sub-domain matches on the name and all its parents, wildcard
+	// matches on the parents only
+	for name := s; name != ""; {
+		if match, ok := match("." + name); ok {
+			return nil, nil, match, true
+		}
+		if name != s {
+			if match, ok := match("*." + name); ok {
+				return nil, nil, match, true
+			}
+		}
+		i := strings.Index(name, ".")
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+	}
+	return nil, nil, nil, false
+}
+
+func (m *TemporaryDB) String() string {
+	return "Temporary"
+}
+
+// Removes expired rules. Must be called with the write lock held.
+func (m *TemporaryDB) prune() {
+	now := time.Now()
+	for r, expires := range m.rules {
+		if !now.Before(expires) {
+			delete(m.rules, r)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package rdns
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTemporaryDB(t *testing.T) {
+	m := NewTemporaryDB("test")
+	require.NoError(t, m.Add([]string{"domain1.com", ".domain2.com.", "*.domain3.com"}, time.Hour))
+	require.Error(t, m.Add([]string{"domain1.com"}, 0))
+	require.Error(t, m.Add([]string{"sub.*.com"}, time.Hour))
+
+	tests := []struct {
+		q     string
+		match bool
+	}{
+		{"domain1.com.", true},
+		{"x.domain1.com.", false},
+		{"domain2.com.", true},
+		{"sub.domain2.com.", true},
+		{"domain3.com.", false},
+		{"sub.domain3.com.", true},
+		{"unblocked.test.", false},
+	}
+	for _, test := range tests {
+		q := dns.Question{Name: test.q, Qtype: dns.TypeA, Qclass: dns.ClassINET}
+		_, _, _, ok := m.Match(q)
+		require.Equal(t, test.match, ok, "query: %s", test.q)
+	}
+	require.Len(t, m.Rules(), 3)
+
+	// Removed and expired rules don't match
+	m.Remove([]string{"domain1.com"})
+	m.rules["*.domain3.com"] = time.Now().Add(-time.Second)
+	_, _, _, ok := m.Match(dns.Question{Name: "domain1.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	require.False(t, ok)
+	_, _, _, ok = m.Match(dns.Question{Name: "sub.domain3.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	require.False(t, ok)
+	require.Equal(t, []TemporaryRule{{Rule: ".domain2.com", Expires: m.rules[".domain2.com"]}}, m.Rules())
+}
+
+func TestBlocklistTemporaryRules(t *testing.T) {
+	var ci ClientInfo
+	upstream := new(TestResolver)
+	db, err := NewDomainDB("testlist", NewStaticLoader(nil))
+	require.NoError(t, err)
+	b, err := NewBlocklist("test-temporary", upstream, BlocklistOptions{BlocklistDB: db})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("incident.test.", dns.TypeA)
+	a, err := b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+
+	// Add a rule on the admin endpoint
+	rec := httptest.NewRecorder()
+	b.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/?rule=incident.test&ttl=1h", nil))
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	a, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+
+	rec = httptest.NewRecorder()
+	b.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	var rules []TemporaryRule
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&rules))
+	require.Len(t, rules, 1)
+	require.Equal(t, "incident.test", rules[0].Rule)
+
+	// Invalid TTL
+	rec = httptest.NewRecorder()
+	b.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/?rule=incident.test&ttl=soon", nil))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// Remove it again
+	rec = httptest.NewRecorder()
+	b.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/?rule=incident.test", nil))
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	a, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+}
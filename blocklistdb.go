@@ -2,7 +2,12 @@ package rdns
 
 import (
 	"fmt"
+	"io"
 	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -24,8 +29,10 @@ type BlocklistDB interface {
 // information about what rule matched, what list it was from etc. Used mostly
 // for logging.
 type BlocklistMatch struct {
-	List string // Identifier or name of the blocklist
-	Rule string // Identifier for the rule that matched
+	List     string // Identifier or name of the blocklist
+	Rule     string // Identifier for the rule that matched
+	Category string // Category of the rule or list, like "ads", if known
+	Audit    bool   // The list is in audit mode, the match is logged but not blocked
 }
 
 func (m *BlocklistMatch) GetList() string {
@@ -41,3 +48,79 @@ func (m *BlocklistMatch) GetRule() string {
 	}
 	return m.Rule
 }
+
+// dbRef holds a database that is replaced when it's reloaded while queries are
+// being matched against it. Readers get the current database without locking.
+type dbRef[T any] struct {
+	p atomic.Pointer[T]
+}
+
+func newDBRef[T any](db T) *dbRef[T] {
+	r := new(dbRef[T])
+	r.Store(db)
+	return r
+}
+
+// Load returns the current database.
+func (r *dbRef[T]) Load() T {
+	return *r.p.Load()
+}
+
+// Store replaces the current database.
+func (r *dbRef[T]) Store(db T) {
+	r.p.Store(&db)
+}
+
+// Time to wait before closing a database that was replaced, giving queries
+// that still use it time to complete.
+const dbCloseDelay = 10 * time.Second
+
+// Closes a replaced database once it's no longer used.
+func closeReplacedDB(db io.Closer) {
+	time.AfterFunc(dbCloseDelay, func() { db.Close() })
+}
+
+// Options that can follow a rule in domain and regexp lists, each starting
+// with "$", like "domain.com $expires=2024-01-02T15:04:05Z $category=ads".
+type ruleOptions struct {
+	// Time after which the rule no longer matches, in RFC 3339 format or as
+	// Unix timestamp. Zero for rules that don't expire.
+	expires time.Time
+
+	// Category of the rule, like "ads" or "malware".
+	category string
+}
+
+// Splits the options off a rule.
+func parseRuleOptions(r string) (string, ruleOptions, error) {
+	var opt ruleOptions
+	for {
+		i := strings.LastIndex(r, "$")
+		if i < 1 || (r[i-1] != ' ' && r[i-1] != '\t') {
+			return r, opt, nil
+		}
+		key, value, ok := strings.Cut(r[i+1:], "=")
+		if !ok {
+			// Not an option, but part of the rule like a regexp anchor
+			return r, opt, nil
+		}
+		rule := strings.TrimSpace(r[:i])
+		switch key {
+		case "expires":
+			if t, err := time.Parse(time.RFC3339, value); err == nil {
+				opt.expires = t
+				break
+			}
+			sec, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return "", opt, fmt.Errorf("invalid expiry time in rule '%s'", rule)
+			}
+			opt.expires = time.Unix(sec, 0)
+		case "category":
+			opt.category = value
+		default:
+			return "", opt, fmt.Errorf("unknown option '%s' in rule '%s'", key, rule)
+		}
+		r = rule
+	}
+}
@@ -3,6 +3,11 @@ package rdns
 import (
 	"bufio"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
 )
 
 // FileLoader reads blocklist rules from a local file. Used to refresh blocklists
@@ -11,18 +16,33 @@ type FileLoader struct {
 	filename    string
 	opt         FileLoaderOptions
 	lastSuccess []string
+
+	// Closed to stop watching the file
+	stop      chan struct{}
+	closeOnce sync.Once
 }
 
 // FileLoaderOptions holds options for file blocklist loaders.
 type FileLoaderOptions struct {
 	// Don't fail when trying to load the list
 	AllowFailure bool
+
+	// Signaled when the file was changed. The file isn't watched if nil.
+	Notify chan<- struct{}
 }
 
 var _ BlocklistLoader = &FileLoader{}
 
+// Time to wait for more changes to a watched file before signaling, so a file
+// that's written in several steps is only reloaded once.
+const fileWatchDelay = 500 * time.Millisecond
+
 func NewFileLoader(filename string, opt FileLoaderOptions) *FileLoader {
-	return &FileLoader{filename, opt, nil}
+	l := &FileLoader{filename: filename, opt: opt, stop: make(chan struct{})}
+	if opt.Notify != nil {
+		go l.watch()
+	}
+	return l
 }
 
 func (l *FileLoader) Load() (rules []string, err error) {
@@ -53,3 +73,55 @@ func (l *FileLoader) Load() (rules []string, err error) {
 	log.Trace("completed loading blocklist")
 	return rules, scanner.Err()
 }
+
+// Close stops watching the file.
+func (l *FileLoader) Close() error {
+	l.closeOnce.Do(func() { close(l.stop) })
+	return nil
+}
+
+// Watches the file for changes and signals them. The directory is watched
+// rather than the file itself, so files that are replaced by renaming another
+// one over them are picked up as well.
+func (l *FileLoader) watch() {
+	log := Log.WithField("file", l.filename)
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.WithError(err).Error("failed to watch blocklist")
+		return
+	}
+	defer w.Close()
+	filename := filepath.Clean(l.filename)
+	if err := w.Add(filepath.Dir(filename)); err != nil {
+		log.WithError(err).Error("failed to watch blocklist")
+		return
+	}
+	var changed <-chan time.Time
+	for {
+		select {
+		case <-l.stop:
+			return
+		case e, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(e.Name) != filename || !e.Has(fsnotify.Write|fsnotify.Create|fsnotify.Rename) {
+				continue
+			}
+			changed = time.After(fileWatchDelay)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			log.WithError(err).Warn("error watching blocklist")
+		case <-changed:
+			changed = nil
+			log.Debug("blocklist file changed")
+			// Don't block if a reload is already pending
+			select {
+			case l.opt.Notify <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package rdns
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileLoaderWatch(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "blocklist")
+	require.NoError(t, os.WriteFile(filename, []byte("evil.test\n"), 0644))
+
+	notify := make(chan struct{}, 1)
+	l := NewFileLoader(filename, FileLoaderOptions{Notify: notify})
+	rules, err := l.Load()
+	require.NoError(t, err)
+	require.Equal(t, []string{"evil.test"}, rules)
+
+	// Give the watcher time to start, then replace the file
+	time.Sleep(100 * time.Millisecond)
+	tmp := filepath.Join(dir, "blocklist.tmp")
+	require.NoError(t, os.WriteFile(tmp, []byte("evil.test\nbad.test\n"), 0644))
+	require.NoError(t, os.Rename(tmp, filename))
+
+	select {
+	case <-notify:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no notification")
+	}
+	rules, err = l.Load()
+	require.NoError(t, err)
+	require.Equal(t, []string{"evil.test", "bad.test"}, rules)
+
+	// Other files in the directory are ignored
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "other"), []byte("x\n"), 0644))
+	select {
+	case <-notify:
+		t.Fatal("unexpected notification")
+	case <-time.After(fileWatchDelay + 200*time.Millisecond):
+	}
+}
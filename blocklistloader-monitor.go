@@ -0,0 +1,223 @@
+package rdns
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// MonitoredLoader wraps a blocklist loader and records the outcome of every
+// load, like the time of the last success, the number of rules and the number
+// of consecutive failures. The status of all monitored lists is available on
+// the admin listener. Lists that haven't been loaded successfully for longer
+// than MaxAge are considered stale, which is logged and, if configured, makes
+// blocklists using them answer with SERVFAIL.
+type MonitoredLoader struct {
+	loader  BlocklistLoader
+	opt     MonitoredLoaderOptions
+	metrics *MonitoredLoaderMetrics
+
+	mu          sync.Mutex
+	status      ListStatus
+	lastSuccess []string
+	alerted     bool
+}
+
+var _ BlocklistLoader = &MonitoredLoader{}
+
+// MonitoredLoaderOptions holds options for monitored blocklist loaders.
+type MonitoredLoaderOptions struct {
+	// Name and source of the list, used in the status and metrics.
+	Name   string
+	Source string
+
+	// Don't fail when trying to load the list and continue with the rules of
+	// the last successful load.
+	AllowFailure bool
+
+	// Time after the last successful load the list is considered stale.
+	// Disabled if 0.
+	MaxAge time.Duration
+
+	// Action for stale lists, "alert" (default) or "servfail".
+	StaleAction string
+}
+
+// Actions for stale lists.
+const (
+	StaleActionAlert    = "alert"
+	StaleActionServfail = "servfail"
+)
+
+type MonitoredLoaderMetrics struct {
+	// Number of rules of the last successful load.
+	rules *expvar.Int
+	// Number of failed loads.
+	failure *expvar.Int
+	// Unix time of the last successful load.
+	lastSuccess *expvar.Int
+	// 1 if the list is stale, 0 otherwise.
+	stale *expvar.Int
+}
+
+// ListStatus holds the result of the recent loads of a list.
+type ListStatus struct {
+	Name                string    `json:"name"`
+	Source              string    `json:"source"`
+	LastAttempt         time.Time `json:"last-attempt"`
+	LastSuccess         time.Time `json:"last-success"`
+	Rules               int       `json:"rules"`
+	Delta               int       `json:"delta"`
+	Duration            string    `json:"duration"`
+	ConsecutiveFailures int       `json:"consecutive-failures"`
+	LastError           string    `json:"last-error,omitempty"`
+	Stale               bool      `json:"stale"`
+}
+
+// All monitored loaders, listed on the admin listener.
+var (
+	listMonitors   []*MonitoredLoader
+	listMonitorsMu sync.Mutex
+)
+
+// NewMonitoredLoader returns a loader that records the outcome of every load
+// of the given loader.
+func NewMonitoredLoader(loader BlocklistLoader, opt MonitoredLoaderOptions) *MonitoredLoader {
+	if opt.StaleAction == "" {
+		opt.StaleAction = StaleActionAlert
+	}
+	l := &MonitoredLoader{
+		loader: loader,
+		opt:    opt,
+		metrics: &MonitoredLoaderMetrics{
+			rules:       getVarInt("list", opt.Name, "rules"),
+			failure:     getVarInt("list", opt.Name, "failure"),
+			lastSuccess: getVarInt("list", opt.Name, "last-success"),
+			stale:       getVarInt("list", opt.Name, "stale"),
+		},
+		status: ListStatus{Name: opt.Name, Source: opt.Source},
+	}
+	listMonitorsMu.Lock()
+	listMonitors = append(listMonitors, l)
+	listMonitorsMu.Unlock()
+	registerAdminHandler("/routedns/lists", http.HandlerFunc(serveListStatus))
+	return l
+}
+
+func (l *MonitoredLoader) Load() ([]string, error) {
+	log := Log.WithFields(logrus.Fields{"list": l.opt.Name, "source": l.opt.Source})
+	start := time.Now()
+	rules, err := l.loader.Load()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.status.LastAttempt = start
+	l.status.Duration = time.Since(start).String()
+	if err != nil {
+		l.status.ConsecutiveFailures++
+		l.status.LastError = err.Error()
+		l.metrics.failure.Add(1)
+		l.checkStale(log)
+		if !l.opt.AllowFailure {
+			return nil, err
+		}
+		log.WithError(err).Warn("failed to load blocklist, continuing with previous ruleset")
+		return l.lastSuccess, nil
+	}
+	l.status.Delta = len(rules) - l.status.Rules
+	l.status.Rules = len(rules)
+	l.status.LastSuccess = start
+	l.status.ConsecutiveFailures = 0
+	l.status.LastError = ""
+	l.lastSuccess = rules
+	l.metrics.rules.Set(int64(len(rules)))
+	l.metrics.lastSuccess.Set(start.Unix())
+	l.checkStale(log)
+	return rules, nil
+}
+
+// Status returns the result of the recent loads of the list.
+func (l *MonitoredLoader) Status() ListStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := l.status
+	s.Stale = l.stale()
+	return s
+}
+
+// Stale returns true if the list wasn't loaded successfully within MaxAge.
+func (l *MonitoredLoader) Stale() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stale()
+}
+
+// Unhealthy returns true if the list is stale and blocklists using it should
+// answer with SERVFAIL.
+func (l *MonitoredLoader) Unhealthy() bool {
+	return l.opt.StaleAction == StaleActionServfail && l.Stale()
+}
+
+// Must be called with the lock held.
+func (l *MonitoredLoader) stale() bool {
+	if l.opt.MaxAge <= 0 || l.status.LastAttempt.IsZero() {
+		return false
+	}
+	return time.Since(l.status.LastSuccess) > l.opt.MaxAge
+}
+
+// Updates the stale metric and alerts once when the list becomes stale. Must
+// be called with the lock held.
+func (l *MonitoredLoader) checkStale(log *logrus.Entry) {
+	if !l.stale() {
+		l.metrics.stale.Set(0)
+		l.alerted = false
+		return
+	}
+	l.metrics.stale.Set(1)
+	if !l.alerted {
+		l.alerted = true
+		log.WithFields(logrus.Fields{
+			"last-success": l.status.LastSuccess,
+			"action":       l.opt.StaleAction,
+		}).Error("blocklist is stale")
+	}
+}
+
+// Lists the status of all monitored loaders.
+func serveListStatus(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	listMonitorsMu.Lock()
+	list := make([]ListStatus, 0, len(listMonitors))
+	for _, l := range listMonitors {
+		list = append(list, l.Status())
+	}
+	listMonitorsMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// Lists or databases that can be unhealthy, for example because they failed
+// to refresh for too long.
+type unhealthyChecker interface {
+	Unhealthy() bool
+}
+
+// Returns true if the loader of a list is unhealthy.
+func loaderUnhealthy(loader BlocklistLoader) bool {
+	c, ok := loader.(unhealthyChecker)
+	return ok && c.Unhealthy()
+}
+
+// Returns true if the blocklist database is unhealthy and queries should fail.
+func dbUnhealthy(db BlocklistDB) bool {
+	c, ok := db.(unhealthyChecker)
+	return ok && c.Unhealthy()
+}
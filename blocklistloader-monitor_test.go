@@ -0,0 +1,63 @@
+package rdns
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMonitoredLoader(t *testing.T) {
+	loader := &testReloadLoader{rules: []string{"evil.test", "bad.test"}}
+	l := NewMonitoredLoader(loader, MonitoredLoaderOptions{
+		Name:         "test-monitor",
+		AllowFailure: true,
+		MaxAge:       50 * time.Millisecond,
+		StaleAction:  StaleActionServfail,
+	})
+	db, err := NewDomainDB("test-monitor", l)
+	require.NoError(t, err)
+	s := l.Status()
+	require.Equal(t, 2, s.Rules)
+	require.Equal(t, 2, s.Delta)
+	require.False(t, s.LastSuccess.IsZero())
+
+	b, err := NewBlocklist("test-monitor-bl", new(TestResolver), BlocklistOptions{BlocklistDB: db})
+	require.NoError(t, err)
+	rcode := func() int {
+		q := new(dns.Msg)
+		q.SetQuestion("evil.test.", dns.TypeA)
+		a, err := b.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		return a.Rcode
+	}
+	require.Equal(t, dns.RcodeNameError, rcode())
+
+	// Failures are recorded, the previous rules are used
+	loader.fail(errors.New("download failed"))
+	rules, err := l.Load()
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+	s = l.Status()
+	require.Equal(t, 1, s.ConsecutiveFailures)
+	require.Equal(t, "download failed", s.LastError)
+	require.False(t, s.Stale)
+
+	// Once the list is stale, the blocklist fails queries
+	time.Sleep(60 * time.Millisecond)
+	require.True(t, l.Stale())
+	require.Equal(t, dns.RcodeServerFailure, rcode())
+
+	// A successful load clears it
+	loader.fail(nil)
+	loader.set([]string{"evil.test"})
+	_, err = l.Load()
+	require.NoError(t, err)
+	s = l.Status()
+	require.Equal(t, 0, s.ConsecutiveFailures)
+	require.Equal(t, -1, s.Delta)
+	require.False(t, s.Stale)
+	require.Equal(t, dns.RcodeNameError, rcode())
+}
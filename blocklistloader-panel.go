@@ -1,23 +1,23 @@
 package rdns
 
 import (
-	"bufio"
 	"crypto/sha256"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
 	"time"
 
 	"github.com/XrayR-project/XrayR/api"
-	"github.com/XrayR-project/XrayR/api/sspanel"
 	"github.com/txthinking/socks5"
+	xdns "github.com/xtls/xray-core/app/dns"
+	"github.com/xtls/xray-core/infra/conf"
 )
 
 // HTTPLoader reads blocklist rules from a server via HTTP(S).
 type PanelLoader struct {
-	API         *sspanel.APIClient
+	API         PanelAPI
 	opt         PanelLoaderOptions
 	fromDisk    bool
 	lastSuccess []string
@@ -41,8 +41,8 @@ var _ BlocklistLoader = &PanelLoader{}
 
 // const httpTimeout = 30 * time.Minute
 
-func NewPanelLoader(api *sspanel.APIClient, opt PanelLoaderOptions) *PanelLoader {
-	return &PanelLoader{api, opt, opt.CacheDir != "", nil}
+func NewPanelLoader(api PanelAPI, opt PanelLoaderOptions) *PanelLoader {
+	return &PanelLoader{api, opt, false, nil}
 }
 
 func (l *PanelLoader) Load() (rules []string, err error) {
@@ -82,17 +82,17 @@ func getDB(Type string, loader *PanelLoader) (BlocklistDB, error) {
 }
 
 func (l *PanelLoader) Get() (RouteDNS *PanelDB, err error) {
-	log := Log.WithField("NodeID", l.API.NodeID)
+	log := Log.WithField("NodeID", l.API.Describe().NodeID)
 	log.Trace("loading blocklist")
 
 	start := time.Now()
 
-	l.API.NodeType = "Http"
-	Nodes, err := l.API.GetNodeInfo()
+	Nodes, userList, err := l.fetch()
 	if err != nil {
 		return nil, err
 	}
 	l.opt.NodeInfo = Nodes
+	l.opt.UserList = userList
 
 	var client *socks5.Client
 	isdialer := false
@@ -111,12 +111,6 @@ func (l *PanelLoader) Get() (RouteDNS *PanelDB, err error) {
 		isdialer = true
 	}
 
-	userList, err := l.API.GetUserList()
-	if err != nil {
-		return nil, err
-	}
-	l.opt.UserList = userList
-
 	AllowlistDB, err := getDB("allow", l)
 	if err != nil {
 		return nil, err
@@ -151,9 +145,10 @@ func (l *PanelLoader) Get() (RouteDNS *PanelDB, err error) {
 		AllowlistDB:   AllowlistDB,
 		BlocklistDB:   BlocklistDB,
 		IpAllowlistDB: IPAllowlistDB,
+		Users:         newPanelUserDBFromAPI(l.API, *userList),
 	}
 	if isdialer {
-		res.Socks5Dialer = Socks5Dialer{Client: client, opt: Socks5DialerOptions{
+		res.Socks5Dialer = &Socks5Dialer{Client: client, opt: Socks5DialerOptions{
 			Username:     Nodes.RouteDNS.Socks5.Username,
 			Password:     Nodes.RouteDNS.Socks5.Password,
 			TCPTimeout:   0,
@@ -165,32 +160,104 @@ func (l *PanelLoader) Get() (RouteDNS *PanelDB, err error) {
 	return res, nil
 }
 
-// Loads a cached version of the list from disk. The filename is made by hashing the URL with SHA256
-// and the file is expect to be in cache-dir.
-func (l *PanelLoader) loadFromDisk() ([]string, error) {
-	f, err := os.Open(l.cacheFilename())
+// Fetches the node configuration and user list from the panel. If the panel
+// can't be reached, the last data that was successfully fetched is loaded from
+// the cache-dir instead, if there is one.
+func (l *PanelLoader) fetch() (*api.NodeInfo, *[]api.UserInfo, error) {
+	nodes, err := l.API.GetNodeInfo()
+	var users *[]api.UserInfo
+	if err == nil {
+		users, err = l.API.GetUserList()
+	}
+	if err == nil {
+		l.fromDisk = false
+		if l.opt.CacheDir != "" {
+			if err := l.writeToDisk(nodes, users); err != nil {
+				Log.WithError(err).Warn("failed to write panel data to disk")
+			}
+		}
+		return nodes, users, nil
+	}
+	if l.opt.CacheDir == "" {
+		return nil, nil, err
+	}
+	nodes, users, cacheErr := l.loadFromDisk()
+	if cacheErr != nil {
+		Log.WithError(cacheErr).Warn("failed to load panel data from disk")
+		return nil, nil, err
+	}
+	Log.WithError(err).WithField("file", l.cacheFilename()).Warn("failed to load panel data, using copy from disk")
+	l.fromDisk = true
+	return nodes, users, nil
+}
+
+// FromDisk returns true if the current data was loaded from the cache-dir
+// because the panel could not be reached.
+func (l *PanelLoader) FromDisk() bool {
+	return l.fromDisk
+}
+
+// Data stored in the cache-dir. Host rules can't be serialized as they are, so
+// they're stored separately as map of rule to addresses.
+type panelCache struct {
+	NodeID     int
+	NodeType   string
+	RouteDNS   api.RouteDns
+	AllowHosts map[string][]string
+	BlockHosts map[string][]string
+	Users      []api.UserInfo
+}
+
+// Loads a cached version of the panel data from disk. The filename is made by
+// hashing the API host and node ID with SHA256 and the file is expected to be
+// in cache-dir.
+func (l *PanelLoader) loadFromDisk() (*api.NodeInfo, *[]api.UserInfo, error) {
+	b, err := os.ReadFile(l.cacheFilename())
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	var c panelCache
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, nil, err
 	}
-	defer f.Close()
-	var rules []string
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		rules = append(rules, scanner.Text())
+	routeDNS := c.RouteDNS
+	if routeDNS.Allow.Hosts, err = hostsFromMap(c.AllowHosts); err != nil {
+		return nil, nil, err
 	}
-	return rules, scanner.Err()
+	if routeDNS.Block.Hosts, err = hostsFromMap(c.BlockHosts); err != nil {
+		return nil, nil, err
+	}
+	nodes := &api.NodeInfo{NodeID: c.NodeID, NodeType: c.NodeType, RouteDNS: &routeDNS}
+	return nodes, &c.Users, nil
 }
 
-func (l *PanelLoader) writeToDisk(rules []string) (err error) {
-	f, err := ioutil.TempFile(l.opt.CacheDir, "routedns")
+func (l *PanelLoader) writeToDisk(nodes *api.NodeInfo, users *[]api.UserInfo) (err error) {
+	c := panelCache{NodeID: nodes.NodeID, NodeType: nodes.NodeType}
+	if nodes.RouteDNS != nil {
+		c.RouteDNS = *nodes.RouteDNS
+		c.RouteDNS.Allow.Hosts = nil
+		c.RouteDNS.Block.Hosts = nil
+		if c.AllowHosts, err = hostsToMap(nodes.RouteDNS.Allow.Hosts); err != nil {
+			return err
+		}
+		if c.BlockHosts, err = hostsToMap(nodes.RouteDNS.Block.Hosts); err != nil {
+			return err
+		}
+	}
+	if users != nil {
+		c.Users = *users
+	}
+	b, err := json.Marshal(c)
 	if err != nil {
-		return
+		return err
 	}
-	fb := bufio.NewWriter(f)
 
+	f, err := os.CreateTemp(l.opt.CacheDir, "routedns")
+	if err != nil {
+		return
+	}
 	defer func() {
 		tmpFileName := f.Name()
-		fb.Flush()
 		f.Close() // Close the file before trying to rename (Windows needs it)
 		if err == nil {
 			err = os.Rename(tmpFileName, l.cacheFilename())
@@ -198,17 +265,58 @@ func (l *PanelLoader) writeToDisk(rules []string) (err error) {
 		// Make sure to clean up even if the move above was successful
 		os.Remove(tmpFileName)
 	}()
+	_, err = f.Write(b)
+	return err
+}
 
-	for _, r := range rules {
-		if _, err := fb.WriteString(r + "\n"); err != nil {
-			return err
+// Returns the name of the cache file, which is the SHA265 of API host and node
+// ID in the cache-dir.
+func (l *PanelLoader) cacheFilename() string {
+	info := l.API.Describe()
+	name := fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%s|%d", info.APIHost, info.NodeID))))
+	return filepath.Join(l.opt.CacheDir, name)
+}
+
+// Prefixes of host rules by matching type, to turn mappings back into rules.
+var hostMatchingPrefix = map[xdns.DomainMatchingType]string{
+	xdns.DomainMatchingType_Full:      "full:",
+	xdns.DomainMatchingType_Subdomain: "domain:",
+	xdns.DomainMatchingType_Keyword:   "keyword:",
+	xdns.DomainMatchingType_Regex:     "regexp:",
+}
+
+// Converts host rules into a map of rule to addresses. Rules referencing
+// geosite lists are expanded into individual rules.
+func hostsToMap(hosts *conf.HostsWrapper) (map[string][]string, error) {
+	if hosts == nil {
+		return nil, nil
+	}
+	mappings, err := hosts.Build()
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string][]string, len(mappings))
+	for _, mapping := range mappings {
+		rule := hostMatchingPrefix[mapping.Type] + mapping.Domain
+		if mapping.ProxiedDomain != "" {
+			m[rule] = []string{mapping.ProxiedDomain}
+			continue
+		}
+		for _, ip := range mapping.Ip {
+			m[rule] = append(m[rule], net.IP(ip).String())
 		}
 	}
-	return nil
+	return m, nil
 }
 
-// Returns the name of the list cache file, which is the SHA265 of url in the cache-dir.
-func (l *PanelLoader) cacheFilename() string {
-	name := fmt.Sprintf("%x", sha256.Sum256([]byte("")))
-	return filepath.Join(l.opt.CacheDir, name)
+func hostsFromMap(m map[string][]string) (*conf.HostsWrapper, error) {
+	if m == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	hosts := new(conf.HostsWrapper)
+	return hosts, json.Unmarshal(b, hosts)
 }
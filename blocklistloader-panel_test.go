@@ -0,0 +1,71 @@
+package rdns
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPanelLoaderCache(t *testing.T) {
+	available := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !available {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		switch r.URL.Path {
+		case "/node":
+			w.Write([]byte(`{
+				"allow":{"type":"hosts","hosts":{"domain:example.com":"10.0.0.1"}},
+				"block":{"type":"domain","domains":["domain:ads.com"]},
+				"spoof":["1.2.3.4"]
+			}`))
+		case "/users":
+			w.Write([]byte(`[{"id":2,"token":"t1","ip":"192.168.1.1"}]`))
+		}
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	opt := PanelLoaderOptions{
+		AllowlistFormat: "hostsx",
+		BlocklistFormat: "domainx",
+		CacheDir:        dir,
+	}
+	panel, err := NewPanelAPI(PanelTypeREST, &api.Config{APIHost: srv.URL, NodeID: 1})
+	require.NoError(t, err)
+
+	// Without cache, a panel outage is an error
+	available = false
+	_, err = NewPanelLoader(panel, PanelLoaderOptions{AllowlistFormat: "hostsx", BlocklistFormat: "domainx"}).Get()
+	require.Error(t, err)
+
+	// Load from the panel, which writes the data to disk
+	available = true
+	loader := NewPanelLoader(panel, opt)
+	_, err = loader.Get()
+	require.NoError(t, err)
+	require.False(t, loader.FromDisk())
+
+	// Now load from disk while the panel is unavailable
+	available = false
+	loader = NewPanelLoader(panel, opt)
+	db, err := loader.Get()
+	require.NoError(t, err)
+	require.True(t, loader.FromDisk())
+
+	require.Equal(t, []net.IP{net.ParseIP("1.2.3.4")}, db.Spoof)
+	_, _, _, ok := db.BlocklistDB.Match(dns.Question{Name: "www.ads.com.", Qtype: dns.TypeA})
+	require.True(t, ok)
+	ips, _, _, ok := db.AllowlistDB.Match(dns.Question{Name: "www.example.com.", Qtype: dns.TypeA})
+	require.True(t, ok)
+	require.Equal(t, "10.0.0.1", ips[0].String())
+	u, ok := db.Users.LookupIP(net.ParseIP("192.168.1.1"))
+	require.True(t, ok)
+	require.Equal(t, 2, u.ID)
+}
@@ -0,0 +1,325 @@
+package rdns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// XFRLoader reads blocklist rules from a zone, typically a response policy zone
+// (RPZ), by acting as secondary server for it. The zone is transferred from the
+// primary with AXFR on the first load, and later updated with IXFR, which
+// falls back to a full transfer if the primary doesn't support it. Optionally,
+// NOTIFY messages from the primary trigger an immediate reload.
+//
+// Names in the zone are turned into rules in the "domain" format, relative to
+// the zone. Wildcards like *.example.com.rpz.example. block subdomains only.
+// Names with a rpz-passthru. CNAME, as well as RPZ triggers other than the
+// query name, like rpz-ip or rpz-nsdname, are skipped.
+type XFRLoader struct {
+	server string
+	zone   string
+	opt    XFRLoaderOptions
+
+	mu      sync.Mutex
+	serial  uint32
+	records map[string]dns.RR
+	loaded  bool
+
+	// Listener for NOTIFY messages, nil if not enabled
+	notifySrv  *dns.Server
+	notifyConn net.PacketConn
+	closeOnce  sync.Once
+}
+
+// XFRLoaderOptions holds options for zone transfer blocklist loaders.
+type XFRLoaderOptions struct {
+	// TSIG key used to sign transfer requests. NOTIFY messages have to be
+	// signed with it as well. Not signed if empty.
+	TSIGName      string
+	TSIGAlgorithm string
+	TSIGSecret    string
+
+	// Listen address (UDP) for NOTIFY messages from the primary. NOTIFY isn't
+	// supported if empty.
+	NotifyAddress string
+
+	// Signaled when a NOTIFY for the zone is received from the primary.
+	Notify chan<- struct{}
+
+	// Don't fail when trying to load the list
+	AllowFailure bool
+}
+
+var _ BlocklistLoader = &XFRLoader{}
+
+// Timeout for a zone transfer.
+const xfrTimeout = time.Minute
+
+// NewXFRLoader returns a loader for a zone on a primary server, given as
+// host:port.
+func NewXFRLoader(server, zone string, opt XFRLoaderOptions) (*XFRLoader, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		return nil, err
+	}
+	if opt.TSIGName != "" {
+		opt.TSIGName = dns.Fqdn(opt.TSIGName)
+		if opt.TSIGAlgorithm == "" {
+			opt.TSIGAlgorithm = dns.HmacSHA256
+		}
+		opt.TSIGAlgorithm = dns.Fqdn(opt.TSIGAlgorithm)
+	}
+	l := &XFRLoader{
+		server:  server,
+		zone:    dns.CanonicalName(zone),
+		opt:     opt,
+		records: make(map[string]dns.RR),
+	}
+	if opt.NotifyAddress != "" {
+		if opt.Notify == nil {
+			return nil, errors.New("notify is not supported for this blocklist")
+		}
+		pc, err := net.ListenPacket("udp", opt.NotifyAddress)
+		if err != nil {
+			return nil, err
+		}
+		srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(l.notifyHandler)}
+		if opt.TSIGName != "" {
+			srv.TsigSecret = map[string]string{opt.TSIGName: opt.TSIGSecret}
+		}
+		l.notifySrv = srv
+		l.notifyConn = pc
+		go func() {
+			if err := srv.ActivateAndServe(); err != nil && !errors.Is(err, net.ErrClosed) {
+				Log.WithError(err).WithField("addr", opt.NotifyAddress).Error("failed to start notify listener")
+			}
+		}()
+	}
+	return l, nil
+}
+
+// Close stops the listener for NOTIFY messages.
+func (l *XFRLoader) Close() error {
+	if l.notifySrv == nil {
+		return nil
+	}
+	l.closeOnce.Do(func() {
+		// The server may not be running yet, closing the socket stops it
+		// from starting
+		if err := l.notifySrv.Shutdown(); err != nil {
+			l.notifyConn.Close()
+		}
+	})
+	return nil
+}
+
+func (l *XFRLoader) Load() (rules []string, err error) {
+	log := Log.WithFields(logrus.Fields{"server": l.server, "zone": l.zone})
+	log.Trace("loading blocklist")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.transfer(); err != nil {
+		if !l.opt.AllowFailure || !l.loaded {
+			return nil, err
+		}
+		// Continue with the current content of the zone
+		log.WithError(err).Warn("failed to transfer zone, continuing with previous ruleset")
+	}
+	return l.rules(), nil
+}
+
+// Brings the zone up to date, with IXFR if there's a copy of it already and
+// AXFR otherwise.
+func (l *XFRLoader) transfer() error {
+	log := Log.WithFields(logrus.Fields{"server": l.server, "zone": l.zone})
+
+	m := new(dns.Msg)
+	if l.loaded {
+		m.SetIxfr(l.zone, l.serial, ".", ".")
+	} else {
+		m.SetAxfr(l.zone)
+	}
+	t := &dns.Transfer{
+		DialTimeout:  xfrTimeout,
+		ReadTimeout:  xfrTimeout,
+		WriteTimeout: xfrTimeout,
+	}
+	if l.opt.TSIGName != "" {
+		t.TsigSecret = map[string]string{l.opt.TSIGName: l.opt.TSIGSecret}
+		m.SetTsig(l.opt.TSIGName, l.opt.TSIGAlgorithm, 300, time.Now().Unix())
+	}
+	env, err := t.In(m, l.server)
+	if err != nil {
+		return err
+	}
+	var rrs []dns.RR
+	for e := range env {
+		if e.Error != nil {
+			return e.Error
+		}
+		rrs = append(rrs, e.RR...)
+	}
+	if len(rrs) == 0 {
+		return errors.New("empty zone transfer")
+	}
+	soa, ok := rrs[0].(*dns.SOA)
+	if !ok {
+		return errors.New("zone transfer doesn't start with SOA")
+	}
+
+	switch {
+	case l.loaded && len(rrs) == 1:
+		// IXFR response with just the SOA, the zone is up to date
+		log.WithField("serial", soa.Serial).Trace("zone is up to date")
+		return nil
+	case len(rrs) > 2 && isSOA(rrs[1]) && l.loaded:
+		// Incremental: sequences of deleted records starting with the old SOA,
+		// followed by added records starting with the new SOA
+		add := true
+		for _, rr := range rrs[1 : len(rrs)-1] {
+			if isSOA(rr) {
+				add = !add
+				continue
+			}
+			if add {
+				l.records[recordKey(rr)] = rr
+			} else {
+				delete(l.records, recordKey(rr))
+			}
+		}
+		log.WithField("serial", soa.Serial).Debug("applied incremental zone transfer")
+	default:
+		// Full zone, framed by the SOA
+		l.records = make(map[string]dns.RR, len(rrs))
+		for _, rr := range rrs[1 : len(rrs)-1] {
+			l.records[recordKey(rr)] = rr
+		}
+		log.WithField("serial", soa.Serial).Debug("applied full zone transfer")
+	}
+	l.serial = soa.Serial
+	l.loaded = true
+	return nil
+}
+
+// Returns the blocklist rules for the names in the zone.
+func (l *XFRLoader) rules() []string {
+	passthru := make(map[string]struct{})
+	names := make(map[string]struct{})
+	for _, rr := range l.records {
+		name := dns.CanonicalName(rr.Header().Name)
+		if name == l.zone || !dns.IsSubDomain(l.zone, name) {
+			continue
+		}
+		name = strings.TrimSuffix(name, "."+l.zone)
+		if isRPZTrigger(name) {
+			continue
+		}
+		if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Target, "rpz-passthru.") {
+			passthru[name] = struct{}{}
+			continue
+		}
+		names[name] = struct{}{}
+	}
+	rules := make([]string, 0, len(names))
+	for name := range names {
+		if _, ok := passthru[name]; ok {
+			continue
+		}
+		rules = append(rules, name)
+	}
+	return rules
+}
+
+// Handles NOTIFY messages from the primary by signaling that the zone changed.
+func (l *XFRLoader) notifyHandler(w dns.ResponseWriter, q *dns.Msg) {
+	log := Log.WithFields(logrus.Fields{"zone": l.zone, "client": w.RemoteAddr()})
+	if q.Opcode != dns.OpcodeNotify || len(q.Question) != 1 || dns.CanonicalName(q.Question[0].Name) != l.zone {
+		a := new(dns.Msg)
+		a.SetRcode(q, dns.RcodeRefused)
+		_ = w.WriteMsg(a)
+		return
+	}
+	if !l.fromPrimary(w.RemoteAddr()) {
+		log.Warn("refusing notify from unknown server")
+		a := new(dns.Msg)
+		a.SetRcode(q, dns.RcodeRefused)
+		_ = w.WriteMsg(a)
+		return
+	}
+	// With a key for the zone, messages have to be signed with it and the
+	// response is signed as well. Without, signed messages are refused since
+	// they can't be verified.
+	tsig := q.IsTsig()
+	if (tsig == nil && l.opt.TSIGName != "") || (tsig != nil && (tsig.Hdr.Name != l.opt.TSIGName || w.TsigStatus() != nil)) {
+		log.WithError(w.TsigStatus()).Warn("refusing notify without valid signature")
+		a := new(dns.Msg)
+		a.SetRcode(q, dns.RcodeNotAuth)
+		_ = w.WriteMsg(a)
+		return
+	}
+	log.Debug("received notify")
+	a := new(dns.Msg)
+	a.SetReply(q)
+	a.Authoritative = true
+	if tsig != nil {
+		a.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+	}
+	_ = w.WriteMsg(a)
+
+	// Don't block if a reload is already pending
+	select {
+	case l.opt.Notify <- struct{}{}:
+	default:
+	}
+}
+
+// Returns true if the address belongs to the primary server.
+func (l *XFRLoader) fromPrimary(addr net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	host, _, _ := net.SplitHostPort(l.server)
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.Equal(udpAddr.IP)
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return false
+	}
+	for _, ip := range ips {
+		if ip.Equal(udpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true for RPZ names that trigger on something other than the query
+// name, like rpz-ip or rpz-nsdname. Those are identified by their last label.
+func isRPZTrigger(name string) bool {
+	labels := dns.SplitDomainName(name)
+	return len(labels) > 0 && strings.HasPrefix(strings.ToLower(labels[len(labels)-1]), "rpz-")
+}
+
+func isSOA(rr dns.RR) bool {
+	_, ok := rr.(*dns.SOA)
+	return ok
+}
+
+// Identifies a record independent of its TTL, which can differ between the
+// copy that was added and the one that's deleted in an IXFR.
+func recordKey(rr dns.RR) string {
+	rr = dns.Copy(rr)
+	rr.Header().Ttl = 0
+	rr.Header().Name = dns.CanonicalName(rr.Header().Name)
+	return fmt.Sprint(rr)
+}
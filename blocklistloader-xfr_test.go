@@ -0,0 +1,189 @@
+package rdns
+
+import (
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Test primary serving a zone with AXFR and IXFR.
+type testXFRServer struct {
+	soa     func(serial uint32) dns.RR
+	serial  uint32
+	records []dns.RR
+	ixfr    []dns.RR // Incremental transfer to the current serial
+	queries []uint16
+}
+
+func (s *testXFRServer) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
+	s.queries = append(s.queries, q.Question[0].Qtype)
+	var rrs []dns.RR
+	switch q.Question[0].Qtype {
+	case dns.TypeIXFR:
+		if s.ixfr != nil {
+			rrs = append([]dns.RR{s.soa(s.serial)}, s.ixfr...)
+			rrs = append(rrs, s.soa(s.serial))
+			break
+		}
+		fallthrough
+	case dns.TypeAXFR:
+		rrs = append([]dns.RR{s.soa(s.serial)}, s.records...)
+		rrs = append(rrs, s.soa(s.serial))
+	}
+	ch := make(chan *dns.Envelope, 1)
+	tr := new(dns.Transfer)
+	go func() {
+		ch <- &dns.Envelope{RR: rrs}
+		close(ch)
+	}()
+	_ = tr.Out(w, q, ch)
+	w.Hijack()
+	_ = w.Close()
+}
+
+func TestXFRLoader(t *testing.T) {
+	rr := func(s string) dns.RR {
+		r, err := dns.NewRR(s)
+		require.NoError(t, err)
+		return r
+	}
+	primary := &testXFRServer{
+		soa: func(serial uint32) dns.RR {
+			soa := rr("rpz.test. 300 IN SOA ns.rpz.test. admin.rpz.test. 1 3600 600 86400 60").(*dns.SOA)
+			soa.Serial = serial
+			return soa
+		},
+		serial: 1,
+		records: []dns.RR{
+			rr("rpz.test. 300 IN NS ns.rpz.test."),
+			rr("bad.example.com.rpz.test. 300 IN CNAME ."),
+			rr("*.ads.example.com.rpz.test. 300 IN CNAME ."),
+			rr("good.example.com.rpz.test. 300 IN CNAME rpz-passthru."),
+			rr("32.1.0.0.10.rpz-ip.rpz.test. 300 IN CNAME ."),
+		},
+	}
+
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	srv := &dns.Server{Addr: addr, Net: "tcp", Handler: primary}
+	go srv.ListenAndServe()
+	defer srv.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+
+	notifyAddr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	notify := make(chan struct{}, 1)
+	l, err := NewXFRLoader(addr, "rpz.test", XFRLoaderOptions{NotifyAddress: notifyAddr, Notify: notify})
+	require.NoError(t, err)
+	defer l.Close()
+
+	// The first load is a full transfer
+	rules, err := l.Load()
+	require.NoError(t, err)
+	sort.Strings(rules)
+	require.Equal(t, []string{"*.ads.example.com", "bad.example.com"}, rules)
+
+	// Incremental update removing one name and adding another
+	primary.serial = 2
+	primary.ixfr = []dns.RR{
+		primary.soa(1),
+		rr("bad.example.com.rpz.test. 60 IN CNAME ."),
+		primary.soa(2),
+		rr("new.example.com.rpz.test. 300 IN CNAME *."),
+	}
+	rules, err = l.Load()
+	require.NoError(t, err)
+	sort.Strings(rules)
+	require.Equal(t, []string{"*.ads.example.com", "new.example.com"}, rules)
+	require.Equal(t, []uint16{dns.TypeAXFR, dns.TypeIXFR}, primary.queries)
+
+	// A NOTIFY from the primary signals a change
+	q := new(dns.Msg)
+	q.SetNotify("rpz.test.")
+	c := &dns.Client{Net: "udp", Dialer: &net.Dialer{LocalAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}}}
+	var a *dns.Msg
+	require.Eventually(t, func() bool {
+		a, _, err = c.Exchange(q, notifyAddr)
+		return err == nil
+	}, time.Second, 50*time.Millisecond)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	select {
+	case <-notify:
+	case <-time.After(time.Second):
+		t.Fatal("no notification")
+	}
+
+	// NOTIFY for a different zone is refused
+	q.SetNotify("other.test.")
+	a, _, err = c.Exchange(q, notifyAddr)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+}
+
+func TestXFRLoaderNotifyTSIG(t *testing.T) {
+	notifyAddr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	secret := "c2VjcmV0a2V5c2VjcmV0a2V5"
+	l, err := NewXFRLoader("127.0.0.1:53", "rpz.test", XFRLoaderOptions{
+		TSIGName:      "rpz-key",
+		TSIGSecret:    secret,
+		NotifyAddress: notifyAddr,
+		Notify:        make(chan struct{}, 1),
+	})
+	require.NoError(t, err)
+	defer l.Close()
+	require.Equal(t, "rpz-key.", l.opt.TSIGName)
+
+	notify := func(keyName, secret string) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetNotify("rpz.test.")
+		if keyName != "" {
+			q.SetTsig(keyName, dns.HmacSHA256, 300, time.Now().Unix())
+		}
+		c := &dns.Client{
+			Net:        "udp",
+			Dialer:     &net.Dialer{LocalAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}},
+			TsigSecret: map[string]string{keyName: secret},
+		}
+		var a *dns.Msg
+		require.Eventually(t, func() bool {
+			a, _, err = c.Exchange(q, notifyAddr)
+			return a != nil
+		}, time.Second, 50*time.Millisecond)
+		return a
+	}
+
+	// Signed with the key of the zone, the response is signed as well
+	a := notify("rpz-key.", secret)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.NotNil(t, a.IsTsig())
+
+	// Wrong secret or other key
+	require.Equal(t, dns.RcodeNotAuth, notify("rpz-key.", "d3JvbmdrZXl3cm9uZ2tleQ==").Rcode)
+	require.Equal(t, dns.RcodeNotAuth, notify("other-key.", secret).Rcode)
+
+	// Unsigned messages are refused when there's a key
+	require.Equal(t, dns.RcodeNotAuth, notify("", "").Rcode)
+}
+
+func TestXFRLoaderClose(t *testing.T) {
+	notifyAddr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	opt := XFRLoaderOptions{NotifyAddress: notifyAddr, Notify: make(chan struct{}, 1)}
+	l, err := NewXFRLoader("127.0.0.1:53", "rpz.test", opt)
+	require.NoError(t, err)
+
+	// The address is in use until the loader is closed
+	_, err = NewXFRLoader("127.0.0.1:53", "rpz.test", opt)
+	require.Error(t, err)
+	l.Close()
+	l.Close()
+	l, err = NewXFRLoader("127.0.0.1:53", "rpz.test", opt)
+	require.NoError(t, err)
+	l.Close()
+}
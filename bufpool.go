@@ -0,0 +1,99 @@
+package rdns
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Size of buffers in the pool. Large enough for most messages, including a
+// length prefix. Larger messages use a buffer allocated for them.
+const pooledBufferSize = 4096
+
+// Buffers grown beyond this size are not returned to the pool to avoid holding
+// on to large amounts of memory.
+const maxPooledBufferSize = 2 + dns.MaxMsgSize
+
+// Pool of buffers used to pack and read DNS messages in listeners and clients.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, pooledBufferSize)
+		return &b
+	},
+}
+
+// Returns a buffer from the pool. It should be released with putBuffer once
+// it's no longer used.
+func getBuffer() *[]byte {
+	return bufferPool.Get().(*[]byte)
+}
+
+// Returns a buffer to the pool.
+func putBuffer(b *[]byte) {
+	if cap(*b) > maxPooledBufferSize {
+		return
+	}
+	*b = (*b)[:cap(*b)]
+	bufferPool.Put(b)
+}
+
+// Packs a DNS message into a pooled buffer, optionally preceded by the 2 byte
+// length prefix used by stream transports. The returned slice is only valid
+// until the buffer is released.
+func packBuffer(m *dns.Msg, buf *[]byte, lengthPrefix bool) ([]byte, error) {
+	offset := 0
+	if lengthPrefix {
+		offset = 2
+	}
+	b := (*buf)[:cap(*buf)]
+	p, err := m.PackBuffer(b[offset:])
+	if err != nil {
+		return nil, err
+	}
+	// PackBuffer allocates a new slice if the message doesn't fit. Grow the
+	// buffer so it can be used for large messages next time.
+	if len(p) > 0 && &p[0] != &b[offset] {
+		b = make([]byte, offset+len(p))
+		copy(b[offset:], p)
+		*buf = b
+	}
+	if lengthPrefix {
+		binary.BigEndian.PutUint16(b, uint16(len(p)))
+	}
+	return b[:offset+len(p)], nil
+}
+
+// Reads n bytes into a pooled buffer, growing it if needed. The returned
+// slice is only valid until the buffer is released.
+func readBuffer(r io.Reader, buf *[]byte, n int) ([]byte, error) {
+	if cap(*buf) < n {
+		*buf = make([]byte, n)
+	}
+	b := (*buf)[:n]
+	_, err := io.ReadFull(r, b)
+	return b, err
+}
+
+// Reads everything from r into a pooled buffer, up to limit bytes. The
+// returned slice is only valid until the buffer is released.
+func readAllBuffer(r io.Reader, buf *[]byte, limit int) ([]byte, error) {
+	b := (*buf)[:0]
+	for len(b) < limit {
+		if len(b) == cap(b) {
+			b = append(b, 0)[:len(b)]
+		}
+		n, err := r.Read(b[len(b):min(cap(b), limit)])
+		b = b[:len(b)+n]
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			*buf = b
+			return nil, err
+		}
+	}
+	*buf = b
+	return b, nil
+}
@@ -0,0 +1,59 @@
+package rdns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPackBuffer(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	// Small message, packed into the pooled buffer with length prefix
+	b, err := packBuffer(q, buf, true)
+	require.NoError(t, err)
+	require.Equal(t, len(b)-2, int(binary.BigEndian.Uint16(b)))
+	m := new(dns.Msg)
+	require.NoError(t, m.Unpack(b[2:]))
+	require.Equal(t, q.Question, m.Question)
+
+	// A message that's larger than the buffer causes it to grow
+	a := new(dns.Msg)
+	a.SetReply(q)
+	for i := 0; i < 300; i++ {
+		a.Answer = append(a.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+			A:   []byte{192, 168, 1, byte(i)},
+		})
+	}
+	a.Compress = false
+	b, err = packBuffer(a, buf, false)
+	require.NoError(t, err)
+	require.Greater(t, len(b), pooledBufferSize)
+	require.GreaterOrEqual(t, cap(*buf), len(b))
+	m = new(dns.Msg)
+	require.NoError(t, m.Unpack(b))
+	require.Len(t, m.Answer, 300)
+}
+
+func TestReadAllBuffer(t *testing.T) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	data := bytes.Repeat([]byte{1}, 2*pooledBufferSize)
+	b, err := readAllBuffer(bytes.NewReader(data), buf, dns.MaxMsgSize)
+	require.NoError(t, err)
+	require.Equal(t, data, b)
+
+	// Reads stop at the limit
+	b, err = readAllBuffer(bytes.NewReader(data), buf, 100)
+	require.NoError(t, err)
+	require.Len(t, b, 100)
+}
@@ -1,7 +1,9 @@
 package rdns
 
 import (
-	"os"
+	"fmt"
+	"hash/fnv"
+	"io"
 	"sync"
 	"time"
 
@@ -10,9 +12,16 @@ import (
 )
 
 type memoryBackend struct {
+	shards  []*memoryShard
+	opt     MemoryBackendOptions
+	metrics *cacheSnapshotMetrics
+}
+
+// memoryShard is a slice of the cache with its own lock. Queries are
+// distributed over the shards by hashing the cache key.
+type memoryShard struct {
 	lru *lruCache
 	mu  sync.Mutex
-	opt MemoryBackendOptions
 }
 
 type MemoryBackendOptions struct {
@@ -27,6 +36,14 @@ type MemoryBackendOptions struct {
 
 	// Write the file in an interval. Only write on shutdown if not set
 	SaveInterval time.Duration
+
+	// Compress the content of the file
+	Compress bool
+
+	// Number of independently locked partitions of the cache. Reduces lock
+	// contention under high query load. The capacity is divided evenly between
+	// shards and the LRU order is maintained per shard. Default 1.
+	Shards int
 }
 
 var _ CacheBackend = (*memoryBackend)(nil)
@@ -35,11 +52,24 @@ func NewMemoryBackend(opt MemoryBackendOptions) *memoryBackend {
 	if opt.GCPeriod == 0 {
 		opt.GCPeriod = time.Minute
 	}
+	if opt.Shards < 1 {
+		opt.Shards = 1
+	}
+	// Split the capacity over all shards, rounding up so the total is never
+	// lower than what was asked for.
+	capacity := opt.Capacity
+	if capacity > 0 {
+		capacity = (capacity + opt.Shards - 1) / opt.Shards
+	}
 	b := &memoryBackend{
-		lru: newLRUCache(opt.Capacity),
-		opt: opt,
+		shards: make([]*memoryShard, opt.Shards),
+		opt:    opt,
+	}
+	for i := range b.shards {
+		b.shards[i] = &memoryShard{lru: newLRUCache(capacity)}
 	}
 	if opt.Filename != "" {
+		b.metrics = newCacheSnapshotMetrics(opt.Filename)
 		b.loadFromFile(opt.Filename)
 	}
 	go b.startGC(opt.GCPeriod)
@@ -48,9 +78,10 @@ func NewMemoryBackend(opt MemoryBackendOptions) *memoryBackend {
 }
 
 func (b *memoryBackend) Store(query *dns.Msg, item *cacheAnswer) {
-	b.mu.Lock()
-	b.lru.add(query, item)
-	b.mu.Unlock()
+	shard := b.shardFor(query)
+	shard.mu.Lock()
+	shard.lru.add(query, item)
+	shard.mu.Unlock()
 }
 
 func (b *memoryBackend) Lookup(q *dns.Msg) (*dns.Msg, bool, bool) {
@@ -58,14 +89,15 @@ func (b *memoryBackend) Lookup(q *dns.Msg) (*dns.Msg, bool, bool) {
 	var timestamp time.Time
 	var prefetchEligible bool
 	var expiry time.Time
-	b.mu.Lock()
-	if a := b.lru.get(q); a != nil {
-		answer = a.Msg.Copy()
+	shard := b.shardFor(q)
+	shard.mu.Lock()
+	if a := shard.lru.get(q); a != nil {
+		answer = a.Msg
 		timestamp = a.Timestamp
 		prefetchEligible = a.PrefetchEligible
 		expiry = a.Expiry
 	}
-	b.mu.Unlock()
+	shard.mu.Unlock()
 
 	// Return a cache-miss if there's no answer record in the map
 	if answer == nil {
@@ -79,7 +111,8 @@ func (b *memoryBackend) Lookup(q *dns.Msg) (*dns.Msg, bool, bool) {
 	}
 
 	// Make a copy of the response before returning it. Some later
-	// elements might make changes.
+	// elements might make changes. Cached messages are never modified
+	// in place, so it's safe to copy outside the lock.
 	answer = answer.Copy()
 	answer.Id = q.Id
 
@@ -108,17 +141,20 @@ func (b *memoryBackend) Lookup(q *dns.Msg) (*dns.Msg, bool, bool) {
 }
 
 func (b *memoryBackend) Evict(queries ...*dns.Msg) {
-	b.mu.Lock()
 	for _, query := range queries {
-		b.lru.delete(query)
+		shard := b.shardFor(query)
+		shard.mu.Lock()
+		shard.lru.delete(query)
+		shard.mu.Unlock()
 	}
-	b.mu.Unlock()
 }
 
 func (b *memoryBackend) Flush() {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	b.lru.reset()
+	for _, shard := range b.shards {
+		shard.mu.Lock()
+		shard.lru.reset()
+		shard.mu.Unlock()
+	}
 }
 
 // Runs every period time and evicts all items from the cache that are
@@ -131,25 +167,31 @@ func (b *memoryBackend) startGC(period time.Duration) {
 		time.Sleep(period)
 		now := time.Now()
 		var total, removed int
-		b.mu.Lock()
-		b.lru.deleteFunc(func(a *cacheAnswer) bool {
-			if now.After(a.Expiry) {
-				removed++
-				return true
-			}
-			return false
-		})
-		total = b.lru.size()
-		b.mu.Unlock()
+		for _, shard := range b.shards {
+			shard.mu.Lock()
+			shard.lru.deleteFunc(func(a *cacheAnswer) bool {
+				if now.After(a.Expiry) {
+					removed++
+					return true
+				}
+				return false
+			})
+			total += shard.lru.size()
+			shard.mu.Unlock()
+		}
 
 		Log.WithFields(logrus.Fields{"total": total, "removed": removed}).Trace("cache garbage collection")
 	}
 }
 
 func (b *memoryBackend) Size() int {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	return b.lru.size()
+	var total int
+	for _, shard := range b.shards {
+		shard.mu.Lock()
+		total += shard.lru.size()
+		shard.mu.Unlock()
+	}
+	return total
 }
 
 func (b *memoryBackend) Close() error {
@@ -160,41 +202,59 @@ func (b *memoryBackend) Close() error {
 }
 
 func (b *memoryBackend) writeToFile(filename string) error {
-	b.mu.Lock()
-	defer b.mu.Unlock()
 	log := Log.WithField("filename", filename)
 	log.Info("writing cache file")
-	f, err := os.Create(filename)
+	start := time.Now()
+	err := writeCacheSnapshot(filename, b.opt.Compress, func(w io.Writer) error {
+		for _, shard := range b.shards {
+			shard.mu.Lock()
+			err := shard.lru.serialize(w)
+			shard.mu.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		log.WithError(err).Warn("failed to create cache file")
-		return err
-	}
-	defer f.Close()
-
-	if err := b.lru.serialize(f); err != nil {
+		b.metrics.saveError.Add(1)
 		log.WithError(err).Warn("failed to persist cache to disk")
 		return err
 	}
+	b.metrics.save.Add(1)
+	recordSnapshotTime(b.metrics.saveTime, start)
 	return nil
 }
 
-func (b *memoryBackend) loadFromFile(filename string) error {
-	b.mu.Lock()
-	defer b.mu.Unlock()
+func (b *memoryBackend) loadFromFile(filename string) (err error) {
 	log := Log.WithField("filename", filename)
 	log.Info("reading cache file")
-	f, err := os.Open(filename)
-	if err != nil {
-		log.WithError(err).Warn("failed to open cache file")
-		return err
-	}
-	defer f.Close()
+	start := time.Now()
 
-	if err := b.lru.deserialize(f); err != nil {
-		log.WithError(err).Warn("failed to read cache from disk")
-		return err
-	}
-	return nil
+	// A snapshot that can't be read must not prevent startup
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+			b.Flush()
+		}
+		if err != nil {
+			b.metrics.loadError.Add(1)
+			log.WithError(err).Warn("failed to read cache from disk")
+			return
+		}
+		recordSnapshotTime(b.metrics.loadTime, start)
+	}()
+
+	// Records are distributed over the shards as they're read so the file
+	// format doesn't depend on the number of shards.
+	return readCacheSnapshot(filename, func(r io.Reader) error {
+		return deserializeCacheItems(r, func(item *cacheItem) {
+			shard := b.shardForKey(item.Key)
+			shard.mu.Lock()
+			shard.lru.addKey(item.Key, item.Answer)
+			shard.mu.Unlock()
+		})
+	})
 }
 
 func (b *memoryBackend) intervalSave() {
@@ -206,3 +266,25 @@ func (b *memoryBackend) intervalSave() {
 		b.writeToFile(b.opt.Filename)
 	}
 }
+
+// Returns the shard responsible for the given query.
+func (b *memoryBackend) shardFor(q *dns.Msg) *memoryShard {
+	if len(b.shards) == 1 {
+		return b.shards[0]
+	}
+	return b.shardForKey(lruKeyFromQuery(q))
+}
+
+func (b *memoryBackend) shardForKey(key lruKey) *memoryShard {
+	if len(b.shards) == 1 {
+		return b.shards[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key.Question.Name))
+	h.Write([]byte{
+		byte(key.Question.Qtype >> 8), byte(key.Question.Qtype),
+		byte(key.Question.Qclass >> 8), byte(key.Question.Qclass),
+	})
+	h.Write([]byte(key.Net))
+	return b.shards[h.Sum32()%uint32(len(b.shards))]
+}
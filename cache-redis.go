@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
@@ -13,21 +14,133 @@ import (
 )
 
 type redisBackend struct {
-	client *redis.Client
+	client redis.UniversalClient
 	opt    RedisBackendOptions
+
+	writes chan redisWrite
+	reads  chan redisRead
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Cache record waiting to be written to redis in a batch.
+type redisWrite struct {
+	key   string
+	value []byte
+	ttl   time.Duration
+}
+
+// Pending lookup, answered by the read batcher.
+type redisRead struct {
+	key    string
+	result chan redisReadResult
+}
+
+type redisReadResult struct {
+	value string
+	err   error
 }
 
 type RedisBackendOptions struct {
+	// Connection options for a single server.
+	//
+	// Deprecated: Use UniversalOptions, which also supports clusters and
+	// sentinels. Only used if UniversalOptions has no address.
 	RedisOptions redis.Options
-	KeyPrefix    string
+
+	// Connection options. Depending on Topology, they are used to connect to a
+	// single server, a cluster or a set of sentinels.
+	UniversalOptions redis.UniversalOptions
+
+	// Redis deployment type, one of RedisStandalone, RedisCluster or RedisSentinel.
+	// If empty, it is derived from the options: MasterName selects sentinel,
+	// more than one address selects cluster.
+	Topology string
+
+	// Network type for standalone servers, either tcp or unix. Defaults to tcp.
+	Network string
+
+	KeyPrefix string
+
+	// Queue cache writes and return immediately rather than waiting for redis
+	// to confirm them. Queued writes are sent in pipelined batches.
+	WriteBehind bool
+
+	// Collect concurrent lookups and send them to redis in pipelined batches.
+	// This reduces round trips at the cost of up to BatchDelay added latency.
+	BatchReads bool
+
+	// Maximum number of commands sent in one pipeline. Default 100.
+	BatchSize int
+
+	// Maximum time to wait for a batch to fill up before it's sent. Default 5ms.
+	BatchDelay time.Duration
+
+	// Number of writes that can be queued with WriteBehind. Writes are dropped
+	// if the queue is full. Default 10000.
+	QueueSize int
 }
 
+// Supported redis deployment topologies.
+const (
+	RedisStandalone = "standalone"
+	RedisCluster    = "cluster"
+	RedisSentinel   = "sentinel"
+)
+
 var _ CacheBackend = (*redisBackend)(nil)
 
 func NewRedisBackend(opt RedisBackendOptions) *redisBackend {
+	topology := opt.Topology
+	if topology == "" {
+		switch {
+		case opt.UniversalOptions.MasterName != "":
+			topology = RedisSentinel
+		case len(opt.UniversalOptions.Addrs) > 1:
+			topology = RedisCluster
+		default:
+			topology = RedisStandalone
+		}
+	}
+	var client redis.UniversalClient
+	switch {
+	case len(opt.UniversalOptions.Addrs) == 0 && opt.RedisOptions.Addr != "":
+		client = redis.NewClient(&opt.RedisOptions)
+	case topology == RedisCluster:
+		client = redis.NewClusterClient(opt.UniversalOptions.Cluster())
+	case topology == RedisSentinel:
+		client = redis.NewFailoverClient(opt.UniversalOptions.Failover())
+	default:
+		simple := opt.UniversalOptions.Simple()
+		simple.Network = opt.Network
+		client = redis.NewClient(simple)
+	}
+	if opt.BatchSize <= 0 {
+		opt.BatchSize = 100
+	}
+	if opt.BatchDelay <= 0 {
+		opt.BatchDelay = 5 * time.Millisecond
+	}
+	if opt.QueueSize <= 0 {
+		opt.QueueSize = 10000
+	}
 	b := &redisBackend{
-		client: redis.NewClient(&opt.RedisOptions),
+		client: client,
 		opt:    opt,
+		done:   make(chan struct{}),
+	}
+	if opt.WriteBehind {
+		b.writes = make(chan redisWrite, opt.QueueSize)
+		b.wg.Add(1)
+		go b.writeLoop()
+	}
+	if opt.BatchReads {
+		b.reads = make(chan redisRead, opt.BatchSize)
+		b.wg.Add(1)
+		go b.readLoop()
 	}
 	return b
 }
@@ -41,7 +154,16 @@ func (b *redisBackend) Store(query *dns.Msg, item *cacheAnswer) {
 		Log.WithError(err).Error("failed to marshal cache record")
 		return
 	}
-	if err := b.client.Set(ctx, key, value, time.Until(item.Expiry)).Err(); err != nil {
+	ttl := time.Until(item.Expiry)
+	if b.writes != nil {
+		select {
+		case b.writes <- redisWrite{key: key, value: value, ttl: ttl}:
+		default:
+			Log.Warn("redis write queue full, dropping cache record")
+		}
+		return
+	}
+	if err := b.client.Set(ctx, key, value, ttl).Err(); err != nil {
 		Log.WithError(err).Error("failed to write to redis")
 	}
 }
@@ -50,7 +172,7 @@ func (b *redisBackend) Lookup(q *dns.Msg) (*dns.Msg, bool, bool) {
 	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
 	defer cancel()
 	key := b.keyFromQuery(q)
-	value, err := b.client.Get(ctx, key).Result()
+	value, err := b.get(ctx, key)
 	if err != nil {
 		if errors.Is(err, redis.Nil) { // Return a cache-miss if there's no such key
 			return nil, false, false
@@ -102,6 +224,7 @@ func (b *redisBackend) Flush() {
 func (b *redisBackend) Size() int {
 	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
 	defer cancel()
+	// The cluster client adds up the DBSIZE of all masters
 	size, err := b.client.DBSize(ctx).Result()
 	if err != nil {
 		Log.WithError(err).Error("failed to run dbsize command on redis")
@@ -109,8 +232,134 @@ func (b *redisBackend) Size() int {
 	return int(size)
 }
 
+// Close stops the batchers and closes the connections to redis. Queued writes
+// are sent first. It can be called more than once.
 func (b *redisBackend) Close() error {
-	return b.client.Close()
+	b.closeOnce.Do(func() {
+		close(b.done)
+		b.wg.Wait()
+		b.closeErr = b.client.Close()
+	})
+	return b.closeErr
+}
+
+// Reads a single key, either directly or through the read batcher.
+func (b *redisBackend) get(ctx context.Context, key string) (string, error) {
+	if b.reads == nil {
+		return b.client.Get(ctx, key).Result()
+	}
+	req := redisRead{key: key, result: make(chan redisReadResult, 1)}
+	select {
+	case b.reads <- req:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	select {
+	case res := <-req.result:
+		return res.value, res.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// Collects queued writes and sends them in pipelined batches until the
+// backend is closed. Pending writes are flushed before returning.
+func (b *redisBackend) writeLoop() {
+	defer b.wg.Done()
+	batch := make([]redisWrite, 0, b.opt.BatchSize)
+	ticker := time.NewTicker(b.opt.BatchDelay)
+	defer ticker.Stop()
+	for {
+		select {
+		case w := <-b.writes:
+			batch = append(batch, w)
+			if len(batch) < b.opt.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case <-b.done:
+			for {
+				select {
+				case w := <-b.writes:
+					batch = append(batch, w)
+				default:
+					b.flushWrites(batch)
+					return
+				}
+			}
+		}
+		b.flushWrites(batch)
+		batch = batch[:0]
+	}
+}
+
+func (b *redisBackend) flushWrites(batch []redisWrite) {
+	if len(batch) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := b.client.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, w := range batch {
+			p.Set(ctx, w.key, w.value, w.ttl)
+		}
+		return nil
+	})
+	if err != nil {
+		Log.WithError(err).WithField("records", len(batch)).Error("failed to write to redis")
+	}
+}
+
+// Collects concurrent lookups and sends them in pipelined batches.
+func (b *redisBackend) readLoop() {
+	defer b.wg.Done()
+	batch := make([]redisRead, 0, b.opt.BatchSize)
+	for {
+		// Wait for the first read of a batch, then give others a short
+		// time to join.
+		select {
+		case r := <-b.reads:
+			batch = append(batch, r)
+		case <-b.done:
+			return
+		}
+		timer := time.NewTimer(b.opt.BatchDelay)
+	collect:
+		for len(batch) < b.opt.BatchSize {
+			select {
+			case r := <-b.reads:
+				batch = append(batch, r)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+		b.flushReads(batch)
+		batch = batch[:0]
+	}
+}
+
+func (b *redisBackend) flushReads(batch []redisRead) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	cmds := make([]*redis.StringCmd, len(batch))
+	_, err := b.client.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for i, r := range batch {
+			cmds[i] = p.Get(ctx, r.key)
+		}
+		return nil
+	})
+	for i, r := range batch {
+		if cmds[i] == nil {
+			r.result <- redisReadResult{err: err}
+			continue
+		}
+		value, err := cmds[i].Result()
+		r.result <- redisReadResult{value: value, err: err}
+	}
 }
 
 // Build a key string to be used in redis.
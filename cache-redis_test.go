@@ -0,0 +1,230 @@
+package rdns
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+)
+
+// Minimal in-memory redis server speaking RESP2, with just the commands used
+// by the cache backend.
+type testRedisServer struct {
+	ln net.Listener
+
+	mu    sync.Mutex
+	data  map[string]string
+	slots string // reply to CLUSTER SLOTS, if part of a cluster
+}
+
+func newTestRedisServer(t *testing.T) *testRedisServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &testRedisServer{ln: ln, data: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *testRedisServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *testRedisServer) get(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.data[key]
+	return v, ok
+}
+
+func (s *testRedisServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readRESPArray(r)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		var reply string
+		switch strings.ToUpper(args[0]) {
+		case "HELLO":
+			reply = "-ERR unknown command 'HELLO'\r\n"
+		case "PING":
+			reply = "+PONG\r\n"
+		case "GET":
+			if v, ok := s.data[args[1]]; ok {
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+			} else {
+				reply = "$-1\r\n"
+			}
+		case "SET":
+			s.data[args[1]] = args[2]
+			reply = "+OK\r\n"
+		case "DEL":
+			var n int
+			for _, k := range args[1:] {
+				if _, ok := s.data[k]; ok {
+					delete(s.data, k)
+					n++
+				}
+			}
+			reply = fmt.Sprintf(":%d\r\n", n)
+		case "DBSIZE":
+			reply = fmt.Sprintf(":%d\r\n", len(s.data))
+		case "CLUSTER":
+			reply = s.slots
+		default: // CLIENT, SELECT, AUTH
+			reply = "+OK\r\n"
+		}
+		s.mu.Unlock()
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// Reads a command sent as array of bulk strings.
+func readRESPArray(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args = append(args, string(b[:size]))
+	}
+	return args, nil
+}
+
+func testRedisAnswer(q *dns.Msg) *cacheAnswer {
+	a := new(dns.Msg)
+	a.SetReply(q)
+	a.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IP{192, 0, 2, 1},
+	}}
+	return &cacheAnswer{Msg: a, Timestamp: time.Now(), Expiry: time.Now().Add(time.Minute)}
+}
+
+func TestRedisBackendBatching(t *testing.T) {
+	srv := newTestRedisServer(t)
+	b := NewRedisBackend(RedisBackendOptions{
+		UniversalOptions: redis.UniversalOptions{Addrs: []string{srv.Addr()}},
+		KeyPrefix:        "test-",
+		WriteBehind:      true,
+		BatchReads:       true,
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	b.Store(q, testRedisAnswer(q))
+
+	// Queued writes are sent when the backend is closed
+	require.NoError(t, b.Close())
+	_, ok := srv.get(b.keyFromQuery(q))
+	require.True(t, ok)
+
+	// Closing again doesn't panic
+	require.NoError(t, b.Close())
+
+	// Concurrent lookups are answered through the read batcher
+	b = NewRedisBackend(RedisBackendOptions{
+		UniversalOptions: redis.UniversalOptions{Addrs: []string{srv.Addr()}},
+		KeyPrefix:        "test-",
+		BatchReads:       true,
+	})
+	defer b.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a, _, ok := b.Lookup(q)
+			require.True(t, ok)
+			require.Len(t, a.Answer, 1)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRedisBackendDeprecatedOptions(t *testing.T) {
+	srv := newTestRedisServer(t)
+
+	// Single server given with the deprecated options
+	b := NewRedisBackend(RedisBackendOptions{
+		RedisOptions: redis.Options{Addr: srv.Addr()},
+		KeyPrefix:    "test-",
+	})
+	defer b.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	b.Store(q, testRedisAnswer(q))
+	_, ok := srv.get(b.keyFromQuery(q))
+	require.True(t, ok)
+	a, _, ok := b.Lookup(q)
+	require.True(t, ok)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, 1, b.Size())
+}
+
+func TestRedisBackendClusterSize(t *testing.T) {
+	// Two masters, each serving half of the slots
+	srv1 := newTestRedisServer(t)
+	srv2 := newTestRedisServer(t)
+	var slots strings.Builder
+	slots.WriteString("*2\r\n")
+	for i, srv := range []*testRedisServer{srv1, srv2} {
+		host, port, err := net.SplitHostPort(srv.Addr())
+		require.NoError(t, err)
+		fmt.Fprintf(&slots, "*3\r\n:%d\r\n:%d\r\n*3\r\n$%d\r\n%s\r\n:%s\r\n$2\r\nn%d\r\n", i*8192, i*8192+8191, len(host), host, port, i)
+	}
+	for i, srv := range []*testRedisServer{srv1, srv2} {
+		srv.slots = slots.String()
+		srv.data[fmt.Sprintf("key%d", i)] = "value"
+	}
+	srv2.data["key2"] = "value"
+
+	b := NewRedisBackend(RedisBackendOptions{
+		UniversalOptions: redis.UniversalOptions{Addrs: []string{srv1.Addr(), srv2.Addr()}},
+	})
+	defer b.Close()
+	require.Equal(t, 3, b.Size())
+}
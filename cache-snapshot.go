@@ -0,0 +1,198 @@
+package rdns
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Cache snapshots start with a header identifying the format, followed by the
+// cache items. Snapshots written by older versions have no header and contain
+// only the items, they're still read but written in the current format.
+//
+// Header layout, all numbers big-endian:
+//
+//	magic    [8]byte "RDNSCACH"
+//	version  uint16
+//	flags    uint16
+//	length   uint64  number of bytes following the header
+//	checksum uint32  CRC32 (IEEE) of the bytes following the header
+const (
+	cacheSnapshotMagic      = "RDNSCACH"
+	cacheSnapshotVersion    = 1
+	cacheSnapshotHeaderSize = 8 + 2 + 2 + 8 + 4
+
+	// Items are gzip compressed
+	cacheSnapshotCompressed = 1 << 0
+)
+
+type cacheSnapshotHeader struct {
+	Version  uint16
+	Flags    uint16
+	Length   uint64
+	Checksum uint32
+}
+
+type cacheSnapshotMetrics struct {
+	// Count of snapshots written.
+	save *expvar.Int
+	// Count of snapshots that failed to be written.
+	saveError *expvar.Int
+	// Time in milliseconds it took to write the last snapshot.
+	saveTime *expvar.Int
+	// Count of snapshots that failed to be read.
+	loadError *expvar.Int
+	// Time in milliseconds it took to read the last snapshot.
+	loadTime *expvar.Int
+}
+
+func newCacheSnapshotMetrics(filename string) *cacheSnapshotMetrics {
+	return &cacheSnapshotMetrics{
+		save:      getVarInt("cache-snapshot", filename, "save"),
+		saveError: getVarInt("cache-snapshot", filename, "save-error"),
+		saveTime:  getVarInt("cache-snapshot", filename, "save-time"),
+		loadError: getVarInt("cache-snapshot", filename, "load-error"),
+		loadTime:  getVarInt("cache-snapshot", filename, "load-time"),
+	}
+}
+
+// Counts the bytes written and calculates their checksum.
+type checksumWriter struct {
+	w     io.Writer
+	crc   hash.Hash32
+	count uint64
+}
+
+func (w *checksumWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.crc.Write(p[:n])
+	w.count += uint64(n)
+	return n, err
+}
+
+// Writes a cache snapshot. The content is written to a temporary file first which
+// replaces the snapshot file once complete, so a failure or crash while writing
+// never leaves a partial snapshot behind.
+func writeCacheSnapshot(filename string, compress bool, write func(io.Writer) error) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+
+	// Reserve space for the header, it's written once the length and checksum are known
+	if _, err := f.Write(make([]byte, cacheSnapshotHeaderSize)); err != nil {
+		return err
+	}
+	cw := &checksumWriter{w: f, crc: crc32.NewIEEE()}
+	bw := bufio.NewWriter(cw)
+	header := cacheSnapshotHeader{Version: cacheSnapshotVersion}
+	if compress {
+		header.Flags |= cacheSnapshotCompressed
+		zw := gzip.NewWriter(bw)
+		if err := write(zw); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	} else if err := write(bw); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	header.Length = cw.count
+	header.Checksum = cw.crc.Sum32()
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte(cacheSnapshotMagic)); err != nil {
+		return err
+	}
+	if err := binary.Write(f, binary.BigEndian, header); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// Reads a cache snapshot. The checksum is verified before any items are passed
+// to read, so a corrupt snapshot is rejected as a whole.
+func readCacheSnapshot(filename string, read func(io.Reader) error) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(cacheSnapshotMagic))
+	if _, err := io.ReadFull(f, magic); err != nil || !bytes.Equal(magic, []byte(cacheSnapshotMagic)) {
+		// Snapshot written by an older version without header
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return read(bufio.NewReader(f))
+	}
+
+	var header cacheSnapshotHeader
+	if err := binary.Read(f, binary.BigEndian, &header); err != nil {
+		return fmt.Errorf("invalid snapshot header: %w", err)
+	}
+	if header.Version > cacheSnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", header.Version)
+	}
+
+	// Verify the content before loading it
+	crc := crc32.NewIEEE()
+	n, err := io.Copy(crc, f)
+	if err != nil {
+		return err
+	}
+	if uint64(n) != header.Length {
+		return fmt.Errorf("snapshot truncated, expected %d bytes, got %d", header.Length, n)
+	}
+	if crc.Sum32() != header.Checksum {
+		return errors.New("snapshot checksum mismatch")
+	}
+	if _, err := f.Seek(cacheSnapshotHeaderSize, io.SeekStart); err != nil {
+		return err
+	}
+
+	var r io.Reader = bufio.NewReader(f)
+	if header.Flags&cacheSnapshotCompressed != 0 {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	return read(r)
+}
+
+// Records the duration of a snapshot operation in milliseconds.
+func recordSnapshotTime(v *expvar.Int, start time.Time) {
+	v.Set(time.Since(start).Milliseconds())
+}
@@ -21,6 +21,10 @@ type Cache struct {
 	resolver Resolver
 	metrics  *CacheMetrics
 	backend  CacheBackend
+
+	// Prefetch queries currently in flight, by cache key
+	prefetchMu       sync.Mutex
+	prefetchInflight map[lruKey]struct{}
 }
 
 type CacheMetrics struct {
@@ -30,6 +34,15 @@ type CacheMetrics struct {
 	miss *expvar.Int
 	// Current cache entry count.
 	entries *expvar.Int
+	// Prefetch queries sent upstream.
+	prefetch *expvar.Int
+	// Prefetched responses that refreshed the cache.
+	prefetchHit *expvar.Int
+	// Prefetched responses that failed or were discarded.
+	prefetchMiss *expvar.Int
+	// Prefetches skipped because of the concurrency limit or a prefetch
+	// for the same record already in flight.
+	prefetchSkip *expvar.Int
 }
 
 var _ Resolver = &Cache{}
@@ -74,6 +87,13 @@ type CacheOptions struct {
 	// Only records with at least PrefetchEligible seconds TTL are eligible to be prefetched.
 	PrefetchEligible uint32
 
+	// Maximum number of prefetch queries in flight at the same time. Further
+	// prefetches are skipped until some complete. Default 0, which means no limit.
+	PrefetchMaxConcurrent int
+
+	// Records for these domains and their subdomains are never prefetched.
+	PrefetchExclude []string
+
 	// Cache backend used to store records.
 	Backend CacheBackend
 }
@@ -100,10 +120,20 @@ func NewCache(id string, resolver Resolver, opt CacheOptions) *Cache {
 		id:           id,
 		resolver:     resolver,
 		metrics: &CacheMetrics{
-			hit:     getVarInt("cache", id, "hit"),
-			miss:    getVarInt("cache", id, "miss"),
-			entries: getVarInt("cache", id, "entries"),
+			hit:          getVarInt("cache", id, "hit"),
+			miss:         getVarInt("cache", id, "miss"),
+			entries:      getVarInt("cache", id, "entries"),
+			prefetch:     getVarInt("cache", id, "prefetch"),
+			prefetchHit:  getVarInt("cache", id, "prefetch-hit"),
+			prefetchMiss: getVarInt("cache", id, "prefetch-miss"),
+			prefetchSkip: getVarInt("cache", id, "prefetch-skip"),
 		},
+		prefetchInflight: make(map[lruKey]struct{}),
+	}
+	// Normalize a copy of the names, the options are the caller's
+	c.PrefetchExclude = make([]string, 0, len(opt.PrefetchExclude))
+	for _, name := range opt.PrefetchExclude {
+		c.PrefetchExclude = append(c.PrefetchExclude, dns.Fqdn(name))
 	}
 	if c.NegativeTTL == 0 {
 		c.NegativeTTL = 60
@@ -130,7 +160,7 @@ func NewCache(id string, resolver Resolver, opt CacheOptions) *Cache {
 
 // Resolve a DNS query by first checking an internal cache for existing
 // results
-func (r *Cache) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dialer) (*dns.Msg, error) {
+func (r *Cache) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	if len(q.Question) < 1 {
 		return nil, errors.New("no question in query")
 	}
@@ -138,7 +168,7 @@ func (r *Cache) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Diale
 	// it's not actually supported by servers. If we do get one of those,
 	// just pass it through and bypass caching.
 	if len(q.Question) > 1 {
-		return r.resolver.Resolve(q, ci, PanelSocksDialer)
+		return r.resolver.Resolve(q, ci)
 	}
 
 	log := logger(r.id, q, ci)
@@ -156,36 +186,13 @@ func (r *Cache) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Diale
 	if ok {
 		log.Debug("cache-hit")
 		r.metrics.hit.Add(1)
+		ci.Trace.SetCacheHit()
 
 		// If prefetch is enabled and the TTL has fallen below the trigger time, send
 		// a concurrent query upstream (to refresh the cached record)
-		if prefetchEligible && r.CacheOptions.PrefetchTrigger > 0 {
+		if prefetchEligible && r.CacheOptions.PrefetchTrigger > 0 && !r.prefetchExcluded(q) {
 			if min, ok := minTTL(a); ok && min < r.CacheOptions.PrefetchTrigger {
-				prefetchQ := q.Copy()
-				go func() {
-					log.Debug("prefetching record")
-
-					// Send the same query upstream
-					prefetchA, err := r.resolver.Resolve(prefetchQ, ci, PanelSocksDialer)
-					if err != nil || prefetchA == nil {
-						return
-					}
-
-					// Don't cache truncated responses
-					if prefetchA.Truncated {
-						return
-					}
-
-					// If the prefetched record has a lower TTL than what we had already, there
-					// is no point in storing it in the cache. This can happen when the upstream
-					// resolver also uses caching.
-					if prefetchAMin, ok := minTTL(prefetchA); !ok || prefetchAMin < min {
-						return
-					}
-
-					// Put the upstream response into the cache and return it.
-					r.storeInCache(prefetchQ, prefetchA)
-				}()
+				r.prefetch(q, ci, min)
 			}
 		}
 
@@ -196,7 +203,7 @@ func (r *Cache) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Diale
 	log.WithField("resolver", r.resolver.String()).Debug("cache-miss, forwarding")
 
 	// Get a response from upstream
-	a, err := r.resolver.Resolve(q.Copy(), ci, PanelSocksDialer)
+	a, err := r.resolver.Resolve(q.Copy(), ci)
 	if err != nil || a == nil {
 		return nil, err
 	}
@@ -216,6 +223,70 @@ func (r *Cache) String() string {
 	return r.id
 }
 
+// Sends the query upstream in the background and refreshes the cache with the
+// response. Only one prefetch per record is in flight at any time.
+func (r *Cache) prefetch(q *dns.Msg, ci ClientInfo, min uint32) {
+	key := lruKeyFromQuery(q)
+	r.prefetchMu.Lock()
+	_, inflight := r.prefetchInflight[key]
+	limited := r.PrefetchMaxConcurrent > 0 && len(r.prefetchInflight) >= r.PrefetchMaxConcurrent
+	if inflight || limited {
+		r.prefetchMu.Unlock()
+		r.metrics.prefetchSkip.Add(1)
+		return
+	}
+	r.prefetchInflight[key] = struct{}{}
+	r.prefetchMu.Unlock()
+
+	log := logger(r.id, q, ci)
+	prefetchQ := q.Copy()
+	r.metrics.prefetch.Add(1)
+	go func() {
+		defer func() {
+			r.prefetchMu.Lock()
+			delete(r.prefetchInflight, key)
+			r.prefetchMu.Unlock()
+		}()
+		log.Debug("prefetching record")
+
+		// Send the same query upstream
+		prefetchA, err := r.resolver.Resolve(prefetchQ, ci)
+		if err != nil || prefetchA == nil {
+			r.metrics.prefetchMiss.Add(1)
+			return
+		}
+
+		// Don't cache truncated responses
+		if prefetchA.Truncated {
+			r.metrics.prefetchMiss.Add(1)
+			return
+		}
+
+		// If the prefetched record has a lower TTL than what we had already, there
+		// is no point in storing it in the cache. This can happen when the upstream
+		// resolver also uses caching.
+		if prefetchAMin, ok := minTTL(prefetchA); !ok || prefetchAMin < min {
+			r.metrics.prefetchMiss.Add(1)
+			return
+		}
+
+		// Put the upstream response into the cache and return it.
+		r.storeInCache(prefetchQ, prefetchA)
+		r.metrics.prefetchHit.Add(1)
+	}()
+}
+
+// Returns true if the query name is excluded from prefetching.
+func (r *Cache) prefetchExcluded(q *dns.Msg) bool {
+	name := q.Question[0].Name
+	for _, domain := range r.PrefetchExclude {
+		if dns.IsSubDomain(domain, name) {
+			return true
+		}
+	}
+	return false
+}
+
 // Check Cert
 func (s *Cache) CertMonitor() error {
 	return nil
@@ -231,20 +302,23 @@ func (r *Cache) answerFromCache(q *dns.Msg) (*dns.Msg, bool, bool) {
 		return a, prefetchEligible, true
 	}
 
-	// We couldn't find it in the cache, but a parent domain may already be with NXDOMAIN.
-	// Return that instead if enabled.
+	// We couldn't find it in the cache, but the name or a parent domain may
+	// already be cached with NXDOMAIN, which applies to all query types and
+	// names below it (RFC2308, RFC8020). Return that instead if enabled.
 	if r.HardenBelowNXDOMAIN {
-		name := q.Question[0].Name
-		newQ := q.Copy()
-		fragments := strings.Split(name, ".")
-		for i := 1; i < len(fragments)-1; i++ {
+		newQ := nameQuery(q)
+		fragments := strings.Split(q.Question[0].Name, ".")
+		for i := 0; i < len(fragments)-1; i++ {
 			newQ.Question[0].Name = strings.Join(fragments[i:], ".")
-			if a, _, ok := r.backend.Lookup(newQ); ok {
-				if a.Rcode == dns.RcodeNameError {
-					return nxdomain(q), false, true
-				}
-				break
+			a, _, ok := r.backend.Lookup(newQ)
+			if !ok || a.Rcode != dns.RcodeNameError {
+				continue
 			}
+			if i == 0 {
+				a.Question = q.Question
+				return a, false, true
+			}
+			return nxdomain(q), false, true
 		}
 	}
 
@@ -257,6 +331,12 @@ func (r *Cache) storeInCache(query, answer *dns.Msg) {
 	// Prepare an item for the cache, without expiry for now
 	item := &cacheAnswer{Msg: answer, Timestamp: now}
 
+	// Negative responses are cached for the lower of the SOA TTL and its MINIMUM
+	// field as per RFC2308. Adjust the SOA so the TTL is counted down correctly.
+	if isNegativeAnswer(answer) {
+		capSOATTL(answer)
+	}
+
 	// Find the lowest TTL in the response, this determines the expiry for the whole answer in the cache.
 	min, ok := minTTL(answer)
 
@@ -290,6 +370,43 @@ func (r *Cache) storeInCache(query, answer *dns.Msg) {
 
 	// Store it in the cache
 	r.backend.Store(query, item)
+
+	// NXDOMAIN responses are also stored for the name alone so they can be used
+	// to answer queries of any type for the name and names below it. Not if
+	// there are records in the answer, the NXDOMAIN is then for the target of a
+	// CNAME. NODATA responses are only valid for the type that was queried.
+	if r.HardenBelowNXDOMAIN && answer.Rcode == dns.RcodeNameError && len(answer.Answer) == 0 && query.Question[0].Qtype != dns.TypeNone {
+		r.backend.Store(nameQuery(query), item)
+	}
+}
+
+// Returns a query for the same name without type. It's used as cache key for
+// negative responses that apply to all types of a name.
+func nameQuery(q *dns.Msg) *dns.Msg {
+	nq := q.Copy()
+	nq.Question[0].Qtype = dns.TypeNone
+	return nq
+}
+
+// Returns true if the response is NXDOMAIN or NODATA.
+func isNegativeAnswer(answer *dns.Msg) bool {
+	switch answer.Rcode {
+	case dns.RcodeNameError:
+		return true
+	case dns.RcodeSuccess:
+		return len(answer.Answer) == 0
+	}
+	return false
+}
+
+// Limits the TTL of SOA records in the authority section to their MINIMUM
+// field. The result is the TTL of negative responses as defined in RFC2308.
+func capSOATTL(answer *dns.Msg) {
+	for _, rr := range answer.Ns {
+		if soa, ok := rr.(*dns.SOA); ok && soa.Minttl < soa.Hdr.Ttl {
+			soa.Hdr.Ttl = soa.Minttl
+		}
+	}
 }
 
 // Find the lowest TTL in all resource records (except OPT).
@@ -1,7 +1,10 @@
 package rdns
 
 import (
+	"fmt"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -39,7 +42,7 @@ func TestCache(t *testing.T) {
 
 	// First query should be a cache-miss and be passed on to the upstream resolver
 	q.SetQuestion("example.com.", dns.TypeA)
-	a, err := c.Resolve(q, ci, nil)
+	a, err := c.Resolve(q, ci)
 	require.NoError(t, err)
 	require.Equal(t, 1, r.HitCount())
 	require.Equal(t, uint32(3600), a.Answer[0].Header().Ttl)
@@ -47,7 +50,7 @@ func TestCache(t *testing.T) {
 	time.Sleep(time.Second)
 
 	// Second one should come from the cache and should have a lower TTL
-	a, err = c.Resolve(q, ci, nil)
+	a, err = c.Resolve(q, ci)
 	require.NoError(t, err)
 	require.Equal(t, 1, r.HitCount())
 	require.True(t, a.Answer[0].Header().Ttl < answerTTL)
@@ -55,7 +58,7 @@ func TestCache(t *testing.T) {
 	// Different question should go through to upstream again, low TTL
 	answerTTL = 1
 	q.SetQuestion("example2.com.", dns.TypeA)
-	a, err = c.Resolve(q, ci, nil)
+	a, err = c.Resolve(q, ci)
 	require.NoError(t, err)
 	require.Equal(t, 2, r.HitCount())
 	require.Equal(t, answerTTL, a.Answer[0].Header().Ttl)
@@ -64,7 +67,7 @@ func TestCache(t *testing.T) {
 
 	// TTL should have expired now, so this should be a cache-miss and be sent upstream
 	q.SetQuestion("example2.com.", dns.TypeA)
-	_, err = c.Resolve(q, ci, nil)
+	_, err = c.Resolve(q, ci)
 	require.NoError(t, err)
 	require.Equal(t, 3, r.HitCount())
 }
@@ -89,12 +92,12 @@ func TestCacheNXDOMAIN(t *testing.T) {
 	// First query should be a cache-miss and be passed on to the upstream resolver
 	// Since it's an NXDOMAIN it should end up in the cache as well, with default TTL
 	q.SetQuestion("example.com.", dns.TypeA)
-	_, err := c.Resolve(q, ci, nil)
+	_, err := c.Resolve(q, ci)
 	require.NoError(t, err)
 	require.Equal(t, 1, r.HitCount())
 
 	// Second one should be returned from the cache
-	_, err = c.Resolve(q, ci, nil)
+	_, err = c.Resolve(q, ci)
 	require.NoError(t, err)
 	require.Equal(t, 1, r.HitCount())
 }
@@ -119,14 +122,14 @@ func TestCacheHardenBelowNXDOMAIN(t *testing.T) {
 
 	// Cache an NXDOMAIN for the parent domain
 	q.SetQuestion("example.com.", dns.TypeA)
-	_, err := c.Resolve(q, ci, nil)
+	_, err := c.Resolve(q, ci)
 	require.NoError(t, err)
 	require.Equal(t, 1, r.HitCount())
 
 	// A sub-domain query should also return NXDOMAIN based on the cached
 	// record for the parent if HardenBelowNXDOMAIN is enabled.
 	q.SetQuestion("not.exist.example.com.", dns.TypeA)
-	a, err := c.Resolve(q, ci, nil)
+	a, err := c.Resolve(q, ci)
 	require.NoError(t, err)
 	require.Equal(t, 1, r.HitCount())
 	require.Equal(t, dns.RcodeNameError, a.Rcode)
@@ -205,10 +208,259 @@ func TestCacheNoTruncated(t *testing.T) {
 
 	// Both queries should hit the upstream resolver
 	q.SetQuestion("example.com.", dns.TypeA)
-	_, err := c.Resolve(q, ci, nil)
+	_, err := c.Resolve(q, ci)
 	require.NoError(t, err)
 	require.Equal(t, 1, r.HitCount())
-	_, err = c.Resolve(q, ci, nil)
+	_, err = c.Resolve(q, ci)
 	require.NoError(t, err)
 	require.Equal(t, 2, r.HitCount())
 }
+
+func TestCacheMemoryBackendShards(t *testing.T) {
+	var ci ClientInfo
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{
+				&dns.A{
+					Hdr: dns.RR_Header{
+						Name:   q.Question[0].Name,
+						Rrtype: dns.TypeA,
+						Class:  dns.ClassINET,
+						Ttl:    3600,
+					},
+					A: net.IP{127, 0, 0, 1},
+				},
+			}
+			return a, nil
+		},
+	}
+
+	backend := NewMemoryBackend(MemoryBackendOptions{Shards: 4})
+	c := NewCache("test-cache", r, CacheOptions{Backend: backend})
+
+	// Fill the cache, every query goes upstream once
+	for i := 0; i < 100; i++ {
+		q := new(dns.Msg)
+		q.SetQuestion(fmt.Sprintf("test%d.com.", i), dns.TypeA)
+		_, err := c.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 100, r.HitCount())
+	require.Equal(t, 100, backend.Size())
+
+	// Repeat the queries, all should be served from the cache
+	for i := 0; i < 100; i++ {
+		q := new(dns.Msg)
+		q.SetQuestion(fmt.Sprintf("test%d.com.", i), dns.TypeA)
+		a, err := c.Resolve(q, ci)
+		require.NoError(t, err)
+		require.Equal(t, q.Question[0].Name, a.Answer[0].Header().Name)
+	}
+	require.Equal(t, 100, r.HitCount())
+
+	backend.Flush()
+	require.Equal(t, 0, backend.Size())
+}
+
+func TestCacheNegativeSOA(t *testing.T) {
+	var ci ClientInfo
+	q := new(dns.Msg)
+	rcode := dns.RcodeNameError
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetRcode(q, rcode)
+			a.Ns = []dns.RR{
+				&dns.SOA{
+					Hdr: dns.RR_Header{
+						Name:   "example.com.",
+						Rrtype: dns.TypeSOA,
+						Class:  dns.ClassINET,
+						Ttl:    3600,
+					},
+					Ns:     "ns.example.com.",
+					Mbox:   "hostmaster.example.com.",
+					Minttl: 1,
+				},
+			}
+			return a, nil
+		},
+	}
+
+	c := NewCache("test-cache", r, CacheOptions{HardenBelowNXDOMAIN: true})
+
+	// NXDOMAIN should be cached for the lower of SOA TTL and MINIMUM
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err := c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r.HitCount())
+
+	// With hardening, NXDOMAIN applies to all types of the name
+	q.SetQuestion("example.com.", dns.TypeAAAA)
+	a, err := c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r.HitCount())
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Equal(t, dns.TypeAAAA, a.Question[0].Qtype)
+
+	// Once MINIMUM has passed, the record should have expired
+	time.Sleep(time.Second)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, r.HitCount())
+
+	// NODATA is only cached for the type that was queried
+	rcode = dns.RcodeSuccess
+	q.SetQuestion("nodata.example.net.", dns.TypeA)
+	_, err = c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 3, r.HitCount())
+	_, err = c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 3, r.HitCount())
+	q.SetQuestion("nodata.example.net.", dns.TypeAAAA)
+	_, err = c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 4, r.HitCount())
+}
+
+func TestCacheNXDOMAINWithCNAME(t *testing.T) {
+	var ci ClientInfo
+	q := new(dns.Msg)
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetRcode(q, dns.RcodeNameError)
+			a.Answer = []dns.RR{
+				&dns.CNAME{
+					Hdr:    dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+					Target: "missing.example.net.",
+				},
+			}
+			return a, nil
+		},
+	}
+	c := NewCache("test-cache", r, CacheOptions{HardenBelowNXDOMAIN: true})
+
+	q.SetQuestion("alias.example.com.", dns.TypeA)
+	_, err := c.Resolve(q, ci)
+	require.NoError(t, err)
+	_, err = c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r.HitCount())
+
+	// The NXDOMAIN is for the CNAME target, other types of the name and names
+	// below it aren't answered from the cache
+	q.SetQuestion("alias.example.com.", dns.TypeAAAA)
+	_, err = c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, r.HitCount())
+	q.SetQuestion("sub.alias.example.com.", dns.TypeA)
+	_, err = c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 3, r.HitCount())
+}
+
+func TestCachePrefetch(t *testing.T) {
+	var ci ClientInfo
+	q := new(dns.Msg)
+	var answerTTL uint32 = 10
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{
+				&dns.A{
+					Hdr: dns.RR_Header{
+						Name:   q.Question[0].Name,
+						Rrtype: dns.TypeA,
+						Class:  dns.ClassINET,
+						Ttl:    answerTTL,
+					},
+					A: net.IP{127, 0, 0, 1},
+				},
+			}
+			return a, nil
+		},
+	}
+
+	opt := CacheOptions{
+		PrefetchTrigger:  20,
+		PrefetchEligible: 5,
+		PrefetchExclude:  []string{"excluded.com"},
+	}
+	c := NewCache("test-cache-prefetch", r, opt)
+
+	// The options of the caller are left alone
+	require.Equal(t, []string{"excluded.com"}, opt.PrefetchExclude)
+
+	// First query goes upstream, the second is a cache-hit that triggers a prefetch
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err := c.Resolve(q, ci)
+	require.NoError(t, err)
+	_, err = c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return c.metrics.prefetchHit.Value() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// Excluded domains are never prefetched
+	q.SetQuestion("www.excluded.com.", dns.TypeA)
+	_, err = c.Resolve(q, ci)
+	require.NoError(t, err)
+	_, err = c.Resolve(q, ci)
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, int64(1), c.metrics.prefetch.Value())
+}
+
+func TestCacheMemoryBackendSnapshot(t *testing.T) {
+	fill := func(b *memoryBackend) {
+		for i := 0; i < 10; i++ {
+			q := new(dns.Msg)
+			q.SetQuestion(fmt.Sprintf("test%d.com.", i), dns.TypeA)
+			a := new(dns.Msg)
+			a.SetReply(q)
+			b.Store(q, &cacheAnswer{
+				Timestamp: time.Now(),
+				Expiry:    time.Now().Add(time.Hour),
+				Msg:       a,
+			})
+		}
+	}
+
+	for _, compress := range []bool{false, true} {
+		filename := filepath.Join(t.TempDir(), "cache.json")
+		opt := MemoryBackendOptions{Filename: filename, Compress: compress}
+
+		b := NewMemoryBackend(opt)
+		fill(b)
+		require.NoError(t, b.Close())
+
+		// A new backend is initialized from the snapshot
+		b = NewMemoryBackend(opt)
+		require.Equal(t, 10, b.Size())
+
+		// A corrupt snapshot is ignored as a whole
+		data, err := os.ReadFile(filename)
+		require.NoError(t, err)
+		data[len(data)-10] ^= 0xff
+		require.NoError(t, os.WriteFile(filename, data, 0600))
+		b = NewMemoryBackend(opt)
+		require.Equal(t, 0, b.Size())
+	}
+
+	// Snapshots without header, written by older versions, are loaded
+	filename := filepath.Join(t.TempDir(), "cache.json")
+	b := NewMemoryBackend(MemoryBackendOptions{})
+	fill(b)
+	f, err := os.Create(filename)
+	require.NoError(t, err)
+	require.NoError(t, b.shards[0].lru.serialize(f))
+	require.NoError(t, f.Close())
+	b = NewMemoryBackend(MemoryBackendOptions{Filename: filename})
+	require.Equal(t, 10, b.Size())
+}
@@ -0,0 +1,117 @@
+package rdns
+
+import (
+	"errors"
+	"expvar"
+	"math/rand"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Chaos is a resolver for testing that injects failures at random, to see how
+// failover groups, caches and clients behave when an upstream misbehaves. It
+// can add latency to queries, let them time out, respond with SERVFAIL or
+// with a truncated response. Queries that aren't failed are forwarded to the
+// upstream resolver.
+type Chaos struct {
+	id       string
+	resolver Resolver
+	opt      ChaosOptions
+	metrics  *ChaosMetrics
+}
+
+var _ Resolver = &Chaos{}
+
+// ChaosOptions contains the probabilities, between 0 and 1, of failures and
+// how they are injected. The probabilities of timeouts, SERVFAIL and truncated
+// responses can't add up to more than 1, latency is added independently.
+type ChaosOptions struct {
+	// Probability of delaying a query by Latency plus a random duration of up
+	// to LatencyJitter.
+	LatencyProbability float64
+	Latency            time.Duration
+	LatencyJitter      time.Duration
+
+	// Probability of a query timing out after Timeout, default 2 seconds.
+	TimeoutProbability float64
+	Timeout            time.Duration
+
+	// Probability of responding with SERVFAIL.
+	ServfailProbability float64
+
+	// Probability of responding with an empty, truncated response.
+	TruncateProbability float64
+}
+
+type ChaosMetrics struct {
+	// Injected failures by type.
+	injected *expvar.Map
+}
+
+// NewChaos returns a new instance of a resolver that injects failures.
+func NewChaos(id string, resolver Resolver, opt ChaosOptions) (*Chaos, error) {
+	for _, p := range []float64{opt.LatencyProbability, opt.TimeoutProbability, opt.ServfailProbability, opt.TruncateProbability} {
+		if p < 0 || p > 1 {
+			return nil, errors.New("probabilities have to be between 0 and 1")
+		}
+	}
+	if opt.TimeoutProbability+opt.ServfailProbability+opt.TruncateProbability > 1 {
+		return nil, errors.New("probabilities of timeouts, servfail and truncated responses add up to more than 1")
+	}
+	if opt.Timeout == 0 {
+		opt.Timeout = defaultQueryTimeout
+	}
+	return &Chaos{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		metrics: &ChaosMetrics{
+			injected: getVarMap("chaos", id, "injected"),
+		},
+	}, nil
+}
+
+// Resolve a DNS query, or fail it at random.
+func (r *Chaos) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	log := logger(r.id, q, ci)
+	if r.opt.LatencyProbability > 0 && rand.Float64() < r.opt.LatencyProbability {
+		delay := r.opt.Latency
+		if r.opt.LatencyJitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(r.opt.LatencyJitter)))
+		}
+		r.metrics.injected.Add("latency", 1)
+		log.WithField("delay", delay).Debug("injecting latency")
+		time.Sleep(delay)
+	}
+
+	p := rand.Float64()
+	switch {
+	case p < r.opt.TimeoutProbability:
+		r.metrics.injected.Add("timeout", 1)
+		log.Debug("injecting timeout")
+		time.Sleep(r.opt.Timeout)
+		return nil, QueryTimeoutError{q}
+	case p < r.opt.TimeoutProbability+r.opt.ServfailProbability:
+		r.metrics.injected.Add("servfail", 1)
+		log.Debug("injecting servfail")
+		return servfail(q), nil
+	case p < r.opt.TimeoutProbability+r.opt.ServfailProbability+r.opt.TruncateProbability:
+		r.metrics.injected.Add("truncate", 1)
+		log.Debug("injecting truncated response")
+		a := new(dns.Msg)
+		a.SetReply(q)
+		a.Truncated = true
+		return a, nil
+	}
+	return r.resolver.Resolve(q, ci)
+}
+
+func (r *Chaos) String() string {
+	return r.id
+}
+
+// Check Cert
+func (r *Chaos) CertMonitor() error {
+	return nil
+}
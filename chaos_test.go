@@ -0,0 +1,62 @@
+package rdns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChaos(t *testing.T) {
+	var ci ClientInfo
+	upstream := new(TestResolver)
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	// Nothing injected by default
+	r, err := NewChaos("test-chaos", upstream, ChaosOptions{})
+	require.NoError(t, err)
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Equal(t, 1, upstream.HitCount())
+
+	// Always respond with SERVFAIL
+	r, err = NewChaos("test-chaos", upstream, ChaosOptions{ServfailProbability: 1})
+	require.NoError(t, err)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeServerFailure, a.Rcode)
+	require.Equal(t, 1, upstream.HitCount())
+
+	// Always truncate
+	r, err = NewChaos("test-chaos", upstream, ChaosOptions{TruncateProbability: 1})
+	require.NoError(t, err)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.True(t, a.Truncated)
+	require.Empty(t, a.Answer)
+
+	// Always time out
+	r, err = NewChaos("test-chaos", upstream, ChaosOptions{TimeoutProbability: 1, Timeout: 10 * time.Millisecond})
+	require.NoError(t, err)
+	_, err = r.Resolve(q, ci)
+	require.ErrorAs(t, err, &QueryTimeoutError{})
+	require.Equal(t, 1, upstream.HitCount())
+
+	// Always add latency
+	r, err = NewChaos("test-chaos", upstream, ChaosOptions{LatencyProbability: 1, Latency: 50 * time.Millisecond})
+	require.NoError(t, err)
+	start := time.Now()
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	require.Equal(t, 2, upstream.HitCount())
+
+	// Invalid probabilities
+	_, err = NewChaos("test-chaos", upstream, ChaosOptions{ServfailProbability: 0.6, TruncateProbability: 0.6})
+	require.Error(t, err)
+	_, err = NewChaos("test-chaos", upstream, ChaosOptions{LatencyProbability: 2})
+	require.Error(t, err)
+}
@@ -82,6 +82,7 @@ func NewCidrDB(name string, loader BlocklistLoader) (*CidrDB, error) {
 		ip6:    new(ipBlocklistTrie),
 		loader: loader,
 	}
+	var ip4, ip6 []*net.IPNet
 	for _, r := range rules {
 		r = strings.TrimSpace(r)
 		if strings.HasPrefix(r, "#") || r == "" {
@@ -100,11 +101,13 @@ func NewCidrDB(name string, loader BlocklistLoader) (*CidrDB, error) {
 			return nil, err
 		}
 		if addr := ip.To4(); addr == nil {
-			db.ip6.add(n)
+			ip6 = append(ip6, n)
 		} else {
-			db.ip4.add(n)
+			ip4 = append(ip4, n)
 		}
 	}
+	db.ip4.build(ip4)
+	db.ip6.build(ip6)
 	return db, nil
 }
 
@@ -127,12 +127,10 @@ func ToCidrList(ips conf.StringList) ([]*router.GeoIP, error) {
 // NewCidrDB returns a new instance of a matcher for a list of networks.
 // func NewCidrDBX(name string, IPs conf.StringList, loader *PanelLoader) (*CidrDBX, error) {
 func NewCidrDBX(name string, loader *PanelLoader) (*CidrDBX, error) {
+	return newCidrDBXFromList(name, panelUserNetworks(*loader.opt.UserList), loader)
+}
 
-	IPs := conf.StringList{}
-
-	for _, user := range *loader.opt.UserList {
-		IPs = append(IPs, user.Passwd)
-	}
+func newCidrDBXFromList(name string, IPs conf.StringList, loader *PanelLoader) (*CidrDBX, error) {
 	container := new(router.GeoIPMatcherContainer)
 	geoipList, err := ToCidrList(IPs)
 	if err != nil {
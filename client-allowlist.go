@@ -13,8 +13,13 @@ type ClientAllowlist struct {
 	id string
 	ClientAllowlistOptions
 	resolver Resolver
-	mu       sync.RWMutex
 	metrics  *BlocklistMetrics
+
+	allowlistDB *dbRef[IPBlocklistDB]
+
+	// Closed to stop the refresh loop
+	stop      chan struct{}
+	closeOnce sync.Once
 }
 
 var _ Resolver = &ClientAllowlist{}
@@ -37,6 +42,8 @@ func NewClientAllowlist(id string, resolver Resolver, opt ClientAllowlistOptions
 		resolver:               resolver,
 		ClientAllowlistOptions: opt,
 		metrics:                NewBlocklistMetrics(id),
+		allowlistDB:            newDBRef(opt.AllowlistDB),
+		stop:                   make(chan struct{}),
 	}
 
 	// Start the refresh goroutines if we have a list and a refresh period was given
@@ -49,20 +56,20 @@ func NewClientAllowlist(id string, resolver Resolver, opt ClientAllowlistOptions
 // Resolve a DNS query after checking the client's IP against a allowlist. Responds with
 // REFUSED if the client IP is on the allowlist, or sends the query to an alternative
 // resolver if one is configured.
-func (r *ClientAllowlist) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dialer) (*dns.Msg, error) {
-	if match, ok := r.AllowlistDB.Match(ci.SourceIP); ok {
+func (r *ClientAllowlist) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if match, ok := r.allowlistDB.Load().Match(ci.SourceIP); ok {
 		log := Log.WithFields(logrus.Fields{"id": r.id, "qname": qName(q), "list": match.List, "rule": match.Rule, "ip": ci.SourceIP})
 		r.metrics.blocked.Add(1)
 		if r.AllowlistResolver != nil {
 			log.WithField("resolver", r.AllowlistResolver).Debug("client not on allowlist, forwarding to allowlist-resolver")
-			return r.AllowlistResolver.Resolve(q, ci, PanelSocksDialer)
+			return r.AllowlistResolver.Resolve(q, ci)
 		}
 		log.Debug("blocking client")
 		return refused(q), nil
 	}
 
 	r.metrics.allowed.Add(1)
-	return r.resolver.Resolve(q, ci, PanelSocksDialer)
+	return r.resolver.Resolve(q, ci)
 }
 
 func (r *ClientAllowlist) String() string {
@@ -75,22 +82,34 @@ func (s *ClientAllowlist) CertMonitor() error {
 }
 
 func (r *ClientAllowlist) GetIPBlocklistDB() IPBlocklistDB {
-	return r.ClientAllowlistOptions.AllowlistDB
+	return r.allowlistDB.Load()
+}
+
+// Close stops reloading the allowlist and closes its database.
+func (r *ClientAllowlist) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.stop)
+		closeReplacedDB(r.allowlistDB.Load())
+	})
+	return nil
 }
 
 func (r *ClientAllowlist) refreshLoopAllowlist(refresh time.Duration) {
 	for {
-		time.Sleep(refresh)
+		select {
+		case <-time.After(refresh):
+		case <-r.stop:
+			return
+		}
 		log := Log.WithField("id", r.id)
 		log.Debug("reloading allowlist")
-		db, err := r.AllowlistDB.Reload()
+		old := r.allowlistDB.Load()
+		db, err := old.Reload()
 		if err != nil {
 			Log.WithError(err).Error("failed to load rules")
 			continue
 		}
-		r.mu.Lock()
-		r.AllowlistDB.Close()
-		r.AllowlistDB = db
-		r.mu.Unlock()
+		r.allowlistDB.Store(db)
+		closeReplacedDB(old)
 	}
 }
@@ -0,0 +1,305 @@
+package rdns
+
+import (
+	"encoding/json"
+	"expvar"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// ClientBan is a resolver that tracks abuse signals per client network and
+// temporarily bans clients that exceed a threshold. Queries from banned clients
+// are refused or sent to an alternative resolver until the ban expires.
+//
+// Abuse signals are responses from the upstream resolver that indicate the
+// client misbehaved: REFUSED (i.e. rate-limited or blocked), FORMERR
+// (malformed query) and dropped queries (no response).
+type ClientBan struct {
+	id string
+	ClientBanOptions
+	resolver Resolver
+	metrics  *ClientBanMetrics
+
+	mu      sync.Mutex
+	strikes map[string]*banStrikes
+	banned  map[string]*BannedClient
+
+	// Closed to stop expiring strikes and bans
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+var _ Resolver = &ClientBan{}
+
+type ClientBanOptions struct {
+	// Number of abuse signals within Window that result in a ban. Default 10.
+	Strikes uint
+
+	// Time period in which strikes are counted. Default 1 minute.
+	Window time.Duration
+
+	// How long a client remains banned. Default 10 minutes.
+	BanDuration time.Duration
+
+	// Optional, send queries from banned clients to this resolver rather than
+	// responding with REFUSED.
+	BanResolver Resolver
+
+	// Netmask to identify IP4 and IP6 clients, default 32 and 128.
+	Prefix4 uint8
+	Prefix6 uint8
+}
+
+type ClientBanMetrics struct {
+	// Count of abuse signals.
+	strike *expvar.Int
+	// Count of bans.
+	ban *expvar.Int
+	// Count of queries from banned clients.
+	blocked *expvar.Int
+	// Number of currently banned clients.
+	banned *expvar.Int
+}
+
+// BannedClient is a client network that is currently banned.
+type BannedClient struct {
+	Network string    `json:"network"`
+	Reason  string    `json:"reason"`
+	Since   time.Time `json:"since"`
+	Until   time.Time `json:"until"`
+}
+
+type banStrikes struct {
+	count   uint
+	expiry  time.Time
+	reasons map[string]uint
+}
+
+// NewClientBan returns a new instance of a client ban resolver.
+func NewClientBan(id string, resolver Resolver, opt ClientBanOptions) *ClientBan {
+	if opt.Strikes == 0 {
+		opt.Strikes = 10
+	}
+	if opt.Window == 0 {
+		opt.Window = time.Minute
+	}
+	if opt.BanDuration == 0 {
+		opt.BanDuration = 10 * time.Minute
+	}
+	if opt.Prefix4 == 0 {
+		opt.Prefix4 = 32
+	}
+	if opt.Prefix6 == 0 {
+		opt.Prefix6 = 128
+	}
+	r := &ClientBan{
+		id:               id,
+		ClientBanOptions: opt,
+		resolver:         resolver,
+		strikes:          make(map[string]*banStrikes),
+		banned:           make(map[string]*BannedClient),
+		stop:             make(chan struct{}),
+		metrics: &ClientBanMetrics{
+			strike:  getVarInt("client-ban", id, "strike"),
+			ban:     getVarInt("client-ban", id, "ban"),
+			blocked: getVarInt("client-ban", id, "blocked"),
+			banned:  getVarInt("client-ban", id, "banned"),
+		},
+	}
+	registerAdminHandler("/routedns/client-ban/"+id, r)
+	go r.expireLoop()
+	return r
+}
+
+// Resolve a DNS query unless the client is banned and record abuse signals in the response.
+func (r *ClientBan) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	log := logger(r.id, q, ci)
+	key := r.clientKey(ci.SourceIP)
+
+	if r.isBanned(key) {
+		r.metrics.blocked.Add(1)
+		if r.BanResolver != nil {
+			log.WithField("resolver", r.BanResolver).Debug("client banned, forwarding to ban-resolver")
+			return r.BanResolver.Resolve(q, ci)
+		}
+		log.Debug("client banned, refusing")
+		return refused(q), nil
+	}
+
+	a, err := r.resolver.Resolve(q, ci)
+	if err != nil {
+		// Upstream failures are not the client's fault
+		return a, err
+	}
+	switch {
+	case a == nil:
+		r.strike(key, "dropped")
+	case a.Rcode == dns.RcodeRefused:
+		r.strike(key, "refused")
+	case a.Rcode == dns.RcodeFormatError:
+		r.strike(key, "malformed")
+	}
+	return a, err
+}
+
+func (r *ClientBan) String() string {
+	return r.id
+}
+
+// Check Cert
+func (r *ClientBan) CertMonitor() error {
+	return nil
+}
+
+// Ban adds a client network to the ban list for the configured duration.
+func (r *ClientBan) Ban(network, reason string) {
+	now := time.Now()
+	r.mu.Lock()
+	r.banned[network] = &BannedClient{
+		Network: network,
+		Reason:  reason,
+		Since:   now,
+		Until:   now.Add(r.BanDuration),
+	}
+	delete(r.strikes, network)
+	r.metrics.banned.Set(int64(len(r.banned)))
+	r.mu.Unlock()
+	r.metrics.ban.Add(1)
+	Log.WithFields(logrus.Fields{"id": r.id, "client": network, "reason": reason}).Info("banning client")
+}
+
+// Unban removes a client network from the ban list.
+func (r *ClientBan) Unban(network string) {
+	r.mu.Lock()
+	delete(r.banned, network)
+	r.metrics.banned.Set(int64(len(r.banned)))
+	r.mu.Unlock()
+}
+
+// Banned returns the list of currently banned clients.
+func (r *ClientBan) Banned() []BannedClient {
+	now := time.Now()
+	r.mu.Lock()
+	list := make([]BannedClient, 0, len(r.banned))
+	for _, b := range r.banned {
+		if now.Before(b.Until) {
+			list = append(list, *b)
+		}
+	}
+	r.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Since.Before(list[j].Since) })
+	return list
+}
+
+// ServeHTTP lists banned clients on GET and unbans the client network given
+// in the "network" parameter on DELETE.
+func (r *ClientBan) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.Banned())
+	case http.MethodDelete:
+		network := req.URL.Query().Get("network")
+		if network == "" {
+			http.Error(w, "missing network parameter", http.StatusBadRequest)
+			return
+		}
+		r.Unban(network)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *ClientBan) isBanned(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.banned[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(b.Until) {
+		delete(r.banned, key)
+		r.metrics.banned.Set(int64(len(r.banned)))
+		return false
+	}
+	return true
+}
+
+// Records an abuse signal for a client and bans it once the threshold is reached.
+func (r *ClientBan) strike(key, reason string) {
+	r.metrics.strike.Add(1)
+	now := time.Now()
+	r.mu.Lock()
+	s, ok := r.strikes[key]
+	if !ok || now.After(s.expiry) {
+		s = &banStrikes{expiry: now.Add(r.Window), reasons: make(map[string]uint)}
+		r.strikes[key] = s
+	}
+	s.count++
+	s.reasons[reason]++
+	ban := s.count >= r.Strikes
+	banReason := mostFrequent(s.reasons)
+	r.mu.Unlock()
+	if ban {
+		r.Ban(key, banReason)
+	}
+}
+
+// Close stops expiring strikes and bans.
+func (r *ClientBan) Close() error {
+	r.closeOnce.Do(func() { close(r.stop) })
+	return nil
+}
+
+// Removes expired strikes and bans.
+func (r *ClientBan) expireLoop() {
+	for {
+		select {
+		case <-time.After(r.Window):
+		case <-r.stop:
+			return
+		}
+		now := time.Now()
+		r.mu.Lock()
+		for k, s := range r.strikes {
+			if now.After(s.expiry) {
+				delete(r.strikes, k)
+			}
+		}
+		for k, b := range r.banned {
+			if now.After(b.Until) {
+				delete(r.banned, k)
+			}
+		}
+		r.metrics.banned.Set(int64(len(r.banned)))
+		r.mu.Unlock()
+	}
+}
+
+// Applies the configured netmask to the client IP to identify the client network.
+func (r *ClientBan) clientKey(ip net.IP) string {
+	if ip4 := ip.To4(); len(ip4) == net.IPv4len {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(int(r.Prefix4), 32)), Mask: net.CIDRMask(int(r.Prefix4), 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(int(r.Prefix6), 128)), Mask: net.CIDRMask(int(r.Prefix6), 128)}).String()
+}
+
+func mostFrequent(m map[string]uint) string {
+	var (
+		max  uint
+		name string
+	)
+	for k, v := range m {
+		if v > max || (v == max && k < name) {
+			max, name = v, k
+		}
+	}
+	return name
+}
@@ -0,0 +1,57 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientBan(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	ci := ClientInfo{SourceIP: net.ParseIP("192.168.1.1")}
+
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			return refused(q), nil
+		},
+	}
+	opt := ClientBanOptions{
+		Strikes:     3,
+		Window:      time.Minute,
+		BanDuration: time.Minute,
+	}
+	b := NewClientBan("test-ban", r, opt)
+
+	// The first queries are passed upstream and counted as strikes
+	for i := 0; i < 3; i++ {
+		_, err := b.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 3, r.HitCount())
+
+	// The client is now banned and doesn't reach upstream anymore
+	a, err := b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+	require.Equal(t, 3, r.HitCount())
+
+	banned := b.Banned()
+	require.Len(t, banned, 1)
+	require.Equal(t, "192.168.1.1/32", banned[0].Network)
+	require.Equal(t, "refused", banned[0].Reason)
+
+	// Other clients are unaffected
+	_, err = b.Resolve(q, ClientInfo{SourceIP: net.ParseIP("192.168.1.2")})
+	require.NoError(t, err)
+	require.Equal(t, 4, r.HitCount())
+
+	// Lift the ban
+	b.Unban("192.168.1.1/32")
+	_, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 5, r.HitCount())
+}
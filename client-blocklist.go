@@ -13,8 +13,13 @@ type ClientBlocklist struct {
 	id string
 	ClientBlocklistOptions
 	resolver Resolver
-	mu       sync.RWMutex
 	metrics  *BlocklistMetrics
+
+	blocklistDB *dbRef[IPBlocklistDB]
+
+	// Closed to stop the refresh loop
+	stop      chan struct{}
+	closeOnce sync.Once
 }
 
 var _ Resolver = &ClientBlocklist{}
@@ -38,6 +43,8 @@ func NewClientBlocklist(id string, resolver Resolver, opt ClientBlocklistOptions
 		resolver:               resolver,
 		ClientBlocklistOptions: opt,
 		metrics:                NewBlocklistMetrics(id),
+		blocklistDB:            newDBRef(opt.BlocklistDB),
+		stop:                   make(chan struct{}),
 	}
 
 	// Start the refresh goroutines if we have a list and a refresh period was given
@@ -50,20 +57,21 @@ func NewClientBlocklist(id string, resolver Resolver, opt ClientBlocklistOptions
 // Resolve a DNS query after checking the client's IP against a blocklist. Responds with
 // REFUSED if the client IP is on the blocklist, or sends the query to an alternative
 // resolver if one is configured.
-func (r *ClientBlocklist) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dialer) (*dns.Msg, error) {
-	if match, ok := r.BlocklistDB.Match(ci.SourceIP); ok {
+func (r *ClientBlocklist) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if match, ok := r.blocklistDB.Load().Match(ci.SourceIP); ok {
 		log := Log.WithFields(logrus.Fields{"id": r.id, "qname": qName(q), "list": match.List, "rule": match.Rule, "ip": ci.SourceIP})
 		r.metrics.blocked.Add(1)
+		ci.Trace.SetBlocked()
 		if r.BlocklistResolver != nil {
 			log.WithField("resolver", r.BlocklistResolver).Debug("client on blocklist, forwarding to blocklist-resolver")
-			return r.BlocklistResolver.Resolve(q, ci, PanelSocksDialer)
+			return r.BlocklistResolver.Resolve(q, ci)
 		}
 		log.Debug("blocking client")
 		return refused(q), nil
 	}
 
 	r.metrics.allowed.Add(1)
-	return r.resolver.Resolve(q, ci, PanelSocksDialer)
+	return r.resolver.Resolve(q, ci)
 }
 
 func (r *ClientBlocklist) String() string {
@@ -76,22 +84,34 @@ func (s *ClientBlocklist) CertMonitor() error {
 }
 
 func (r *ClientBlocklist) GetIPBlocklistDB() IPBlocklistDB {
-		return r.ClientBlocklistOptions.BlocklistDB
+	return r.blocklistDB.Load()
+}
+
+// Close stops reloading the blocklist and closes its database.
+func (r *ClientBlocklist) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.stop)
+		closeReplacedDB(r.blocklistDB.Load())
+	})
+	return nil
 }
 
 func (r *ClientBlocklist) refreshLoopBlocklist(refresh time.Duration) {
 	for {
-		time.Sleep(refresh)
+		select {
+		case <-time.After(refresh):
+		case <-r.stop:
+			return
+		}
 		log := Log.WithField("id", r.id)
 		log.Debug("reloading blocklist")
-		db, err := r.BlocklistDB.Reload()
+		old := r.blocklistDB.Load()
+		db, err := old.Reload()
 		if err != nil {
 			Log.WithError(err).Error("failed to load rules")
 			continue
 		}
-		r.mu.Lock()
-		r.BlocklistDB.Close()
-		r.BlocklistDB = db
-		r.mu.Unlock()
+		r.blocklistDB.Store(db)
+		closeReplacedDB(old)
 	}
 }
@@ -0,0 +1,75 @@
+package rdns
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Headers used by proxies and CDNs to pass on the original client IP, in
+// order of preference. Used when a listener trusts proxies but doesn't
+// configure its own list.
+var defaultClientIPHeaders = []string{
+	"X-Real-IP",        // nginx
+	"CF-Connecting-IP", // Cloudflare
+	"X-Forwarded-For",  // General use
+	"True-Client-IP",   // Akamai
+	"X-Original-Forwarded-For",
+}
+
+// Returns the IP of the client. Headers with the original client IP are only
+// used if the peer is a trusted proxy, otherwise any client could spoof its
+// address by sending them.
+func clientIP(peer net.Addr, req *http.Request, opt ListenOptions) net.IP {
+	var peerIP net.IP
+	switch addr := peer.(type) {
+	case *net.TCPAddr:
+		peerIP = addr.IP
+	case *net.UDPAddr:
+		peerIP = addr.IP
+	case *transparentAddr:
+		peerIP = addr.IP
+	}
+	if req == nil || peerIP == nil || !isTrustedProxy(opt.TrustedProxies, peerIP) {
+		return peerIP
+	}
+	headers := opt.ClientIPHeaders
+	if len(headers) == 0 {
+		headers = defaultClientIPHeaders
+	}
+	for _, header := range headers {
+		value := req.Header.Get(header)
+		if value == "" || len(value) >= 1024 {
+			continue
+		}
+		if ip := lastUntrustedHop(strings.Split(value, ","), opt.TrustedProxies); ip != nil {
+			return ip
+		}
+	}
+	return peerIP
+}
+
+// Returns the client IP from a list of hops as found in X-Forwarded-For, where
+// each proxy appends the address it received the request from. The list is
+// walked from the end, skipping trusted proxies, since anything before the
+// first untrusted hop could have been provided by the client. If all hops
+// are trusted, the first one is the client. Returns nil if a hop is invalid.
+func lastUntrustedHop(hops []string, trusted []*net.IPNet) net.IP {
+	var ip net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip = net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil || !isTrustedProxy(trusted, ip) {
+			return ip
+		}
+	}
+	return ip
+}
+
+func isTrustedProxy(trusted []*net.IPNet, ip net.IP) bool {
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package rdns
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIP(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	trusted := ListenOptions{TrustedProxies: []*net.IPNet{proxies}}
+	proxy := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+	client := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+
+	tests := []struct {
+		name     string
+		peer     net.Addr
+		headers  map[string]string
+		opt      ListenOptions
+		expected string
+	}{
+		{
+			name:     "no request",
+			peer:     client,
+			opt:      trusted,
+			expected: "192.0.2.1",
+		},
+		{
+			name:     "headers ignored without trusted proxies",
+			peer:     proxy,
+			headers:  map[string]string{"X-Real-IP": "198.51.100.1"},
+			expected: "10.0.0.1",
+		},
+		{
+			name:     "headers ignored from untrusted peer",
+			peer:     client,
+			headers:  map[string]string{"X-Real-IP": "198.51.100.1"},
+			opt:      trusted,
+			expected: "192.0.2.1",
+		},
+		{
+			name:     "header from trusted proxy",
+			peer:     proxy,
+			headers:  map[string]string{"X-Real-IP": "198.51.100.1"},
+			opt:      trusted,
+			expected: "198.51.100.1",
+		},
+		{
+			name:     "default header priority",
+			peer:     proxy,
+			headers:  map[string]string{"X-Forwarded-For": "198.51.100.2", "CF-Connecting-IP": "198.51.100.1"},
+			opt:      trusted,
+			expected: "198.51.100.1",
+		},
+		{
+			name:    "configured header priority",
+			peer:    proxy,
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.2", "CF-Connecting-IP": "198.51.100.1"},
+			opt: ListenOptions{
+				TrustedProxies:  trusted.TrustedProxies,
+				ClientIPHeaders: []string{"X-Forwarded-For"},
+			},
+			expected: "198.51.100.2",
+		},
+		{
+			name:     "forwarded chain skips trusted hops",
+			peer:     proxy,
+			headers:  map[string]string{"X-Forwarded-For": "203.0.113.1, 198.51.100.1, 10.0.0.2"},
+			opt:      trusted,
+			expected: "198.51.100.1",
+		},
+		{
+			name:     "invalid header",
+			peer:     proxy,
+			headers:  map[string]string{"X-Real-IP": "invalid"},
+			opt:      trusted,
+			expected: "10.0.0.1",
+		},
+	}
+	for _, test := range tests {
+		var req *http.Request
+		if test.headers != nil {
+			req = &http.Request{Header: make(http.Header)}
+			for k, v := range test.headers {
+				req.Header.Set(k, v)
+			}
+		}
+		ip := clientIP(test.peer, req, test.opt)
+		require.Equal(t, test.expected, ip.String(), test.name)
+	}
+}
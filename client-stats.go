@@ -0,0 +1,330 @@
+package rdns
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ClientStats is a resolver that keeps rolling counters of queries, blocked
+// queries, NXDOMAIN responses, cache hits and traffic per panel user or client
+// network over a time window. The counters are available on the admin
+// listener, for example to investigate abuse or report usage. Blocked queries
+// and cache hits are only counted for blocklists and caches that come after
+// this element.
+type ClientStats struct {
+	id string
+	ClientStatsOptions
+	resolver Resolver
+
+	mu      sync.Mutex
+	clients map[string]*clientStatsEntry
+	now     func() time.Time
+}
+
+var _ Resolver = &ClientStats{}
+
+type ClientStatsOptions struct {
+	// Time the counters cover. Defaults to 24 hours.
+	Window time.Duration
+
+	// Netmask to identify IP4 and IP6 clients without user, default 32 and 128.
+	Prefix4 uint8
+	Prefix6 uint8
+
+	// Maximum number of users and clients tracked. Queries from others are
+	// counted under the key "other". Defaults to 10000.
+	MaxClients int
+}
+
+// ClientCounters holds the counts of a user or client network over the window.
+type ClientCounters struct {
+	Key       string `json:"key"`
+	Queries   uint64 `json:"queries"`
+	Blocked   uint64 `json:"blocked"`
+	NXDomain  uint64 `json:"nxdomain"`
+	CacheHits uint64 `json:"cache-hits"`
+	Bytes     uint64 `json:"bytes"`
+}
+
+// ClientStatsPage is a page of the counters of all users and clients.
+type ClientStatsPage struct {
+	Total   int              `json:"total"`
+	Offset  int              `json:"offset"`
+	Clients []ClientCounters `json:"clients"`
+}
+
+// Number of buckets the window is divided into.
+const clientStatsBuckets = 24
+
+// Key under which clients are counted once MaxClients is reached.
+const clientStatsOtherKey = "other"
+
+// Counters of a user or client, with one bucket per fraction of the window.
+type clientStatsEntry struct {
+	buckets [clientStatsBuckets]ClientCounters
+	last    int64 // Index of the bucket that was updated last
+}
+
+// NewClientStats returns a new instance of a client statistics resolver.
+func NewClientStats(id string, resolver Resolver, opt ClientStatsOptions) *ClientStats {
+	if opt.Window <= 0 {
+		opt.Window = 24 * time.Hour
+	}
+	if opt.Prefix4 == 0 {
+		opt.Prefix4 = 32
+	}
+	if opt.Prefix6 == 0 {
+		opt.Prefix6 = 128
+	}
+	if opt.MaxClients <= 0 {
+		opt.MaxClients = 10000
+	}
+	r := &ClientStats{
+		id:                 id,
+		ClientStatsOptions: opt,
+		resolver:           resolver,
+		clients:            make(map[string]*clientStatsEntry),
+		now:                time.Now,
+	}
+	registerAdminHandler("/routedns/client-stats/"+id, r)
+	return r
+}
+
+// Resolve a DNS query with the upstream resolver and count it.
+func (r *ClientStats) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if ci.Trace == nil {
+		ci.Trace = new(QueryTrace)
+	}
+	a, err := r.resolver.Resolve(q, ci)
+
+	c := ClientCounters{
+		Queries: 1,
+		Bytes:   uint64(q.Len()),
+	}
+	if ci.Trace.Blocked() {
+		c.Blocked = 1
+	}
+	if ci.Trace.CacheHit() {
+		c.CacheHits = 1
+	}
+	if a != nil {
+		c.Bytes += uint64(a.Len())
+		// Blocked queries are only counted as blocked, not as NXDOMAIN
+		if a.Rcode == dns.RcodeNameError && c.Blocked == 0 {
+			c.NXDomain = 1
+		}
+	}
+	r.count(r.key(ci), c)
+	return a, err
+}
+
+func (r *ClientStats) String() string {
+	return r.id
+}
+
+// Check Cert
+func (r *ClientStats) CertMonitor() error {
+	return nil
+}
+
+// Stats returns the counters of all users and clients with queries in the
+// window, sorted by the given field in descending order, or by key.
+func (r *ClientStats) Stats(sortBy string) []ClientCounters {
+	r.mu.Lock()
+	idx := r.bucket()
+	list := make([]ClientCounters, 0, len(r.clients))
+	for key, e := range r.clients {
+		if idx-e.last >= clientStatsBuckets {
+			delete(r.clients, key)
+			continue
+		}
+		e.advance(idx)
+		sum := ClientCounters{Key: key}
+		for _, b := range e.buckets {
+			sum.Queries += b.Queries
+			sum.Blocked += b.Blocked
+			sum.NXDomain += b.NXDomain
+			sum.CacheHits += b.CacheHits
+			sum.Bytes += b.Bytes
+		}
+		list = append(list, sum)
+	}
+	r.mu.Unlock()
+
+	value := func(c ClientCounters) uint64 {
+		switch sortBy {
+		case "blocked":
+			return c.Blocked
+		case "nxdomain":
+			return c.NXDomain
+		case "cache-hits":
+			return c.CacheHits
+		case "bytes":
+			return c.Bytes
+		default:
+			return c.Queries
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if sortBy != "key" {
+			if vi, vj := value(list[i]), value(list[j]); vi != vj {
+				return vi > vj
+			}
+		}
+		return list[i].Key < list[j].Key
+	})
+	return list
+}
+
+// Reset clears the counters of a user or client.
+func (r *ClientStats) Reset(key string) {
+	r.mu.Lock()
+	delete(r.clients, key)
+	r.mu.Unlock()
+}
+
+// ServeHTTP lists the counters on GET, a page at a time with the "offset"
+// and "limit" parameters, sorted by the "sort" parameter. With "format=csv",
+// the counters are returned as CSV rather than JSON. DELETE resets the
+// counters of the user or client network given in the "key" parameter.
+func (r *ClientStats) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		params := req.URL.Query()
+		offset, limit := 0, 100
+		var err error
+		if s := params.Get("offset"); s != "" {
+			if offset, err = strconv.Atoi(s); err != nil || offset < 0 {
+				http.Error(w, "invalid offset parameter", http.StatusBadRequest)
+				return
+			}
+		}
+		if s := params.Get("limit"); s != "" {
+			if limit, err = strconv.Atoi(s); err != nil || limit < 1 {
+				http.Error(w, "invalid limit parameter", http.StatusBadRequest)
+				return
+			}
+		}
+		list := r.Stats(params.Get("sort"))
+		page := ClientStatsPage{Total: len(list), Offset: offset, Clients: []ClientCounters{}}
+		if offset < len(list) {
+			page.Clients = list[offset:min(offset+limit, len(list))]
+		}
+		if params.Get("format") == "csv" {
+			w.Header().Set("Content-Type", "text/csv")
+			cw := csv.NewWriter(w)
+			cw.Write([]string{"key", "queries", "blocked", "nxdomain", "cache-hits", "bytes"})
+			for _, c := range page.Clients {
+				cw.Write([]string{
+					c.Key,
+					strconv.FormatUint(c.Queries, 10),
+					strconv.FormatUint(c.Blocked, 10),
+					strconv.FormatUint(c.NXDomain, 10),
+					strconv.FormatUint(c.CacheHits, 10),
+					strconv.FormatUint(c.Bytes, 10),
+				})
+			}
+			cw.Flush()
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	case http.MethodDelete:
+		key := req.URL.Query().Get("key")
+		if key == "" {
+			http.Error(w, "missing key parameter", http.StatusBadRequest)
+			return
+		}
+		r.Reset(key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Adds the counts of a query to the current bucket of a user or client.
+func (r *ClientStats) count(key string, c ClientCounters) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	idx := r.bucket()
+	e, ok := r.clients[key]
+	if !ok {
+		if len(r.clients) >= r.MaxClients {
+			r.expire(idx)
+		}
+		if len(r.clients) >= r.MaxClients {
+			key = clientStatsOtherKey
+			e = r.clients[key]
+		}
+		if e == nil {
+			e = &clientStatsEntry{last: idx}
+			r.clients[key] = e
+		}
+	}
+	e.advance(idx)
+	b := &e.buckets[idx%clientStatsBuckets]
+	b.Queries += c.Queries
+	b.Blocked += c.Blocked
+	b.NXDomain += c.NXDomain
+	b.CacheHits += c.CacheHits
+	b.Bytes += c.Bytes
+}
+
+// Removes users and clients without queries in the window. Must be called
+// with the lock held.
+func (r *ClientStats) expire(idx int64) {
+	for key, e := range r.clients {
+		if idx-e.last >= clientStatsBuckets {
+			delete(r.clients, key)
+		}
+	}
+}
+
+// Returns the index of the current bucket.
+func (r *ClientStats) bucket() int64 {
+	return r.now().UnixNano() / int64(r.Window/clientStatsBuckets)
+}
+
+// Returns the key to count the query under, the panel user if known, or the
+// client network.
+func (r *ClientStats) key(ci ClientInfo) string {
+	if ci.User != "" {
+		return "user:" + ci.User
+	}
+	if user := ci.Trace.User(); user != "" {
+		return "user:" + user
+	}
+	return clientNetwork(ci.SourceIP, r.Prefix4, r.Prefix6)
+}
+
+// Clears the buckets that are older than the window.
+func (e *clientStatsEntry) advance(idx int64) {
+	if idx <= e.last {
+		return
+	}
+	if idx-e.last >= clientStatsBuckets {
+		e.buckets = [clientStatsBuckets]ClientCounters{}
+	} else {
+		for i := e.last + 1; i <= idx; i++ {
+			e.buckets[i%clientStatsBuckets] = ClientCounters{}
+		}
+	}
+	e.last = idx
+}
+
+// Returns the network of the client IP in CIDR notation, with the given
+// prefix lengths for IPv4 and IPv6.
+func clientNetwork(ip net.IP, prefix4, prefix6 uint8) string {
+	if ip4 := ip.To4(); len(ip4) == net.IPv4len {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(int(prefix4), 32)), Mask: net.CIDRMask(int(prefix4), 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(int(prefix6), 128)), Mask: net.CIDRMask(int(prefix6), 128)}).String()
+}
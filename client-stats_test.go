@@ -0,0 +1,91 @@
+package rdns
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientStats(t *testing.T) {
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			if q.Question[0].Name == "nx.test." {
+				a.Rcode = dns.RcodeNameError
+			}
+			return a, nil
+		},
+	}
+	db, err := NewDomainDB("testlist", NewStaticLoader([]string{"block.test"}))
+	require.NoError(t, err)
+	bl, err := NewBlocklist("test-stats-bl", upstream, BlocklistOptions{BlocklistDB: db})
+	require.NoError(t, err)
+	stats := NewClientStats("test-stats", bl, ClientStatsOptions{Window: time.Hour})
+	now := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	stats.now = func() time.Time { return now }
+
+	resolve := func(name string, ci ClientInfo) {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		_, err := stats.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	client := ClientInfo{SourceIP: net.ParseIP("192.168.1.1")}
+	user := ClientInfo{SourceIP: net.ParseIP("192.168.1.1"), User: "42"}
+
+	resolve("example.test.", client)
+	resolve("block.test.", client)
+	resolve("nx.test.", client)
+	resolve("example.test.", user)
+
+	list := stats.Stats("")
+	require.Len(t, list, 2)
+	require.Equal(t, "192.168.1.1/32", list[0].Key)
+	require.Equal(t, uint64(3), list[0].Queries)
+	require.Equal(t, uint64(1), list[0].Blocked)
+	require.Equal(t, uint64(1), list[0].NXDomain)
+	require.NotZero(t, list[0].Bytes)
+	require.Equal(t, "user:42", list[1].Key)
+
+	// Counts roll out of the window
+	now = now.Add(40 * time.Minute)
+	resolve("example.test.", user)
+	now = now.Add(30 * time.Minute)
+	list = stats.Stats("")
+	require.Len(t, list, 1)
+	require.Equal(t, "user:42", list[0].Key)
+	require.Equal(t, uint64(1), list[0].Queries)
+
+	// Pages from the admin endpoint, in JSON and CSV
+	resolve("example.test.", client)
+	resolve("example.test.", client)
+	rec := httptest.NewRecorder()
+	stats.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?offset=1&limit=1", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var page ClientStatsPage
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&page))
+	require.Equal(t, 2, page.Total)
+	require.Len(t, page.Clients, 1)
+	require.Equal(t, "user:42", page.Clients[0].Key)
+
+	rec = httptest.NewRecorder()
+	stats.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?format=csv&sort=key", nil))
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	require.Len(t, lines, 3)
+	require.Equal(t, "key,queries,blocked,nxdomain,cache-hits,bytes", lines[0])
+	require.True(t, strings.HasPrefix(lines[1], "192.168.1.1/32,2,0,0,0,"))
+
+	// Reset a client
+	rec = httptest.NewRecorder()
+	stats.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/?key=user:42", nil))
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	require.Len(t, stats.Stats(""), 1)
+}
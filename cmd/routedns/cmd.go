@@ -1,12 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"os"
-	"os/signal"
 	"path"
-	"syscall"
 	"time"
 
 	rdns "github.com/folbricht/routedns"
@@ -15,8 +15,9 @@ import (
 )
 
 type options struct {
-	logLevel uint32
-	version  bool
+	logLevel    uint32
+	version     bool
+	watchConfig time.Duration
 }
 
 func main() {
@@ -42,13 +43,15 @@ arguments.
 		Example: `  routedns config.toml`,
 		Args:    cobra.MinimumNArgs(0),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return start(opt, args)
+			return run(opt, args)
 		},
 		SilenceUsage: true,
 	}
 
 	cmd.Flags().Uint32VarP(&opt.logLevel, "log-level", "l", 4, "log level; 0=None .. 6=Trace")
 	cmd.Flags().BoolVarP(&opt.version, "version", "v", false, "Prints code version string")
+	cmd.Flags().DurationVar(&opt.watchConfig, "watch-config", 0, "interval to check the config files for changes and reload them, 0 to disable")
+	addPlatformCommands(cmd)
 
 	if err := cmd.Execute(); err != nil {
 		os.Exit(1)
@@ -56,10 +59,119 @@ arguments.
 
 }
 
-// Functions to call on shutdown
-var onClose []func()
+// Time the listening sockets are held after the listeners of a reloaded config
+// were started, so the new listeners can take them over before the sockets they
+// don't use are closed.
+const socketHoldTime = 5 * time.Second
 
-func start(opt options, args []string) error {
+// Runs routedns until it's stopped by a signal. If enabled, the config files are
+// checked for changes periodically and routedns is restarted in-process with
+// the new config, keeping the listening sockets open. Unlike a handoff to a new
+// process, this also works when running as PID 1 in a container, for example
+// with the config in a Kubernetes ConfigMap.
+func run(opt options, args []string) error {
+	if opt.watchConfig == 0 {
+		return start(opt, args, nil, nil)
+	}
+	signalled := make(chan struct{})
+	go func() {
+		waitForSignal()
+		close(signalled)
+	}()
+	var release func()
+	for {
+		sum, err := configChecksum(args)
+		if err != nil {
+			return err
+		}
+		stop := make(chan struct{})
+		reload := make(chan struct{})
+		var held func()
+		go func() {
+			defer close(stop)
+			if watchConfig(args, sum, opt.watchConfig, signalled) {
+				// Keep the sockets open while the old listeners are stopped,
+				// they'd have to be bound again otherwise
+				held = rdns.HoldSockets()
+				close(reload)
+			}
+		}()
+		started := func() {
+			if release != nil {
+				time.AfterFunc(socketHoldTime, release)
+			}
+		}
+		err = start(opt, args, stop, started)
+		if release != nil {
+			// Give up the sockets held for the listeners of this config if
+			// that didn't happen yet, a following reload holds its own
+			release()
+		}
+		if err != nil {
+			return err
+		}
+		select {
+		case <-reload:
+			rdns.Log.Info("config changed, reloading")
+			release = held
+		default:
+			return nil
+		}
+	}
+}
+
+// Blocks until the config files change to a config that can be loaded, or done
+// is closed. Returns true if the config changed.
+func watchConfig(args []string, sum []byte, interval time.Duration, done <-chan struct{}) bool {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return false
+		case <-ticker.C:
+		}
+		newSum, err := configChecksum(args)
+		if err != nil {
+			rdns.Log.WithError(err).Warn("failed to read config")
+			continue
+		}
+		if bytes.Equal(newSum, sum) {
+			continue
+		}
+		sum = newSum
+		if _, _, err := api.LoadConfig(args...); err != nil {
+			rdns.Log.WithError(err).Error("config changed but can't be loaded, not reloading")
+			continue
+		}
+		return true
+	}
+}
+
+// Returns a checksum over the content of all config files, including those
+// of tenants.
+func configChecksum(args []string) ([]byte, error) {
+	h := sha256.New()
+	for _, name := range args {
+		if err := api.LoadFile(h, name); err != nil {
+			return nil, err
+		}
+	}
+	// The tenants are known even if their config can't be loaded, errors
+	// are reported when the config is loaded
+	config, _, _ := api.LoadConfig(args...)
+	for _, name := range config.TenantFiles() {
+		if err := api.LoadFile(h, name); err != nil {
+			return nil, err
+		}
+	}
+	return h.Sum(nil), nil
+}
+
+// Runs routedns with the given config files until it's stopped by a signal,
+// or until the stop channel is closed if it's not nil. If set, started is
+// called once the listeners are started.
+func start(opt options, args []string, stop <-chan struct{}, started func()) error {
 	// Set the log level in the library package
 	if opt.logLevel > 6 {
 		return fmt.Errorf("invalid log level: %d", opt.logLevel)
@@ -84,28 +196,76 @@ func start(opt options, args []string) error {
 		return err
 	}
 
+	// Stop running as root now that the configuration is loaded. Listeners keep
+	// the capability to bind to privileged ports unless configured otherwise.
+	if p := config.Privileges; p.User != "" {
+		keep := p.KeepCapabilities
+		if keep == nil {
+			keep = []string{"CAP_NET_BIND_SERVICE"}
+		}
+		if err := rdns.DropPrivileges(p.User, p.Group, keep); err != nil {
+			return err
+		}
+	}
+
 	for i := range manager.Tasks {
 		rdns.Log.Info("Start %s periodic task", manager.Tasks[i].Tag)
 		go manager.Tasks[i].Start()
 	}
 
-	// Start the listeners
+	// Start the listeners, and restart them if they fail until they're stopped
+	stopping := make(chan struct{})
 	for _, l := range manager.Listeners {
 		go func(l rdns.Listener) {
 			for {
 				err := l.Start()
+				select {
+				case <-stopping:
+					return
+				default:
+				}
 				rdns.Log.WithError(err).Error("listener failed")
-				time.Sleep(time.Second)
+				select {
+				case <-time.After(time.Second):
+				case <-stopping:
+					return
+				}
 			}
 		}(l)
 	}
 
-	// Graceful shutdown
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
-	<-sig
+	if started != nil {
+		started()
+	}
+
+	// If this process was started to take over the sockets of a running instance,
+	// tell the old one to shut down now that the listeners are up.
+	stopHandoffParent()
+
+	if stop != nil {
+		<-stop
+	} else {
+		waitForSignal()
+	}
 	rdns.Log.Info("stopping")
-	for _, f := range onClose {
+
+	// Stop accepting queries and give those in flight a moment to complete
+	close(stopping)
+	stopped := make(chan struct{})
+	go func() {
+		for _, l := range manager.Listeners {
+			_ = l.Stop()
+		}
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+	}
+	for i := range manager.Tasks {
+		_ = manager.Tasks[i].Close()
+	}
+	for _, f := range manager.OnClose {
 		f()
 	}
 
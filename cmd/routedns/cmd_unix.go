@@ -0,0 +1,45 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	rdns "github.com/folbricht/routedns"
+	"github.com/spf13/cobra"
+)
+
+func addPlatformCommands(cmd *cobra.Command) {}
+
+// Makes sure the previous process is only stopped once, not again when the
+// config is reloaded.
+var stopHandoffParentOnce sync.Once
+
+// Tells the process that handed off its sockets to this one to shut down, if
+// there is one.
+func stopHandoffParent() {
+	stopHandoffParentOnce.Do(func() {
+		if ppid := rdns.HandoffParent(); ppid != 0 {
+			rdns.Log.WithField("pid", ppid).Info("took over listening sockets, stopping previous process")
+			if err := syscall.Kill(ppid, syscall.SIGTERM); err != nil {
+				rdns.Log.WithError(err).Error("failed to stop previous process")
+			}
+		}
+	})
+}
+
+// Blocks until the process is asked to stop. SIGUSR2 starts a new process that
+// takes over the listening sockets for a zero-downtime restart, this one is
+// stopped once it's ready.
+func waitForSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
+	for s := <-sig; s == syscall.SIGUSR2; s = <-sig {
+		if _, err := rdns.Handoff(); err != nil {
+			rdns.Log.WithError(err).Error("failed to hand off listening sockets")
+		}
+	}
+}
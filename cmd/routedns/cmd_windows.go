@@ -0,0 +1,221 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	rdns "github.com/folbricht/routedns"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// Adds the commands to manage routedns as Windows service.
+func addPlatformCommands(cmd *cobra.Command) {
+	var (
+		name string
+		opt  options
+	)
+	serviceCmd := &cobra.Command{
+		Use:   "service",
+		Short: "Manage routedns as Windows service",
+	}
+	serviceCmd.PersistentFlags().StringVarP(&name, "name", "n", "routedns", "name of the service")
+
+	installCmd := &cobra.Command{
+		Use:   "install <config> [<config>..]",
+		Short: "Install the service, starting automatically with the given config",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return installService(name, opt, args)
+		},
+		SilenceUsage: true,
+	}
+	installCmd.Flags().Uint32VarP(&opt.logLevel, "log-level", "l", 4, "log level; 0=None .. 6=Trace")
+
+	uninstallCmd := &cobra.Command{
+		Use:   "uninstall",
+		Short: "Remove the service",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return uninstallService(name)
+		},
+		SilenceUsage: true,
+	}
+
+	runCmd := &cobra.Command{
+		Use:   "run <config> [<config>..]",
+		Short: "Run as service, used by the service control manager",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runService(name, opt, args)
+		},
+		SilenceUsage: true,
+	}
+	runCmd.Flags().Uint32VarP(&opt.logLevel, "log-level", "l", 4, "log level; 0=None .. 6=Trace")
+
+	serviceCmd.AddCommand(installCmd, uninstallCmd, runCmd)
+	cmd.AddCommand(serviceCmd)
+}
+
+// Handoffs to a new process are not supported on Windows.
+func stopHandoffParent() {}
+
+// Blocks until the process is interrupted.
+func waitForSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	<-sig
+}
+
+// Registers the service with the service control manager, as well as an event
+// log source of the same name.
+func installService(name string, opt options, configs []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args := []string{"service", "run", "--name", name, "--log-level", strconv.Itoa(int(opt.logLevel))}
+	for _, c := range configs {
+		// The service doesn't run in the current directory
+		abs, err := filepath.Abs(c)
+		if err != nil {
+			return err
+		}
+		args = append(args, abs)
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(name); err == nil {
+		s.Close()
+		return fmt.Errorf("service '%s' already exists", name)
+	}
+	s, err := m.CreateService(name, exe, mgr.Config{
+		DisplayName: "RouteDNS",
+		Description: "DNS stub resolver, proxy and router",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := eventlog.InstallAsEventCreate(name, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		_ = s.Delete()
+		return fmt.Errorf("failed to install event log source: %w", err)
+	}
+	fmt.Printf("service '%s' installed\n", name)
+	return nil
+}
+
+// Removes the service and its event log source.
+func uninstallService(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service '%s' is not installed: %w", name, err)
+	}
+	defer s.Close()
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	if err := eventlog.Remove(name); err != nil {
+		return fmt.Errorf("failed to remove event log source: %w", err)
+	}
+	fmt.Printf("service '%s' removed\n", name)
+	return nil
+}
+
+// Runs routedns under the control of the service control manager, logging to
+// the event log.
+func runService(name string, opt options, configs []string) error {
+	elog, err := eventlog.Open(name)
+	if err != nil {
+		return err
+	}
+	defer elog.Close()
+	rdns.Log.AddHook(eventlogHook{elog})
+
+	return svc.Run(name, &service{opt: opt, configs: configs})
+}
+
+// Handles requests of the service control manager.
+type service struct {
+	opt     options
+	configs []string
+}
+
+func (s *service) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- start(s.opt, s.configs, stop, nil)
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case err := <-done:
+			// Stopped by itself, most likely because of an invalid config
+			if err != nil {
+				rdns.Log.WithError(err).Error("failed to start")
+				return true, 1
+			}
+			return false, 0
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				close(stop)
+				select {
+				case <-done:
+				case <-time.After(10 * time.Second):
+				}
+				return false, 0
+			}
+		}
+	}
+}
+
+// Writes log entries to the Windows event log.
+type eventlogHook struct {
+	elog *eventlog.Log
+}
+
+func (h eventlogHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel, logrus.WarnLevel, logrus.InfoLevel}
+}
+
+func (h eventlogHook) Fire(e *logrus.Entry) error {
+	msg, err := e.String()
+	if err != nil {
+		return err
+	}
+	switch e.Level {
+	case logrus.InfoLevel:
+		return h.elog.Info(1, msg)
+	case logrus.WarnLevel:
+		return h.elog.Warning(1, msg)
+	default:
+		return h.elog.Error(1, msg)
+	}
+}
@@ -0,0 +1,102 @@
+package rdns
+
+import (
+	"expvar"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// limitListener is a net.Listener that limits the number of concurrent
+// connections. Connections beyond the limit are closed as soon as they're
+// accepted rather than waiting in the backlog.
+type limitListener struct {
+	net.Listener
+	sem      chan struct{}
+	limits   *ListenerLimits
+	rejected *expvar.Int
+}
+
+// Returns a listener that accepts at most max concurrent connections, and no
+// more than the shared limits allow. Rejected connections are counted in the
+// rejected metric. A max of 0 means no limit.
+func limitConnections(ln net.Listener, max int, limits *ListenerLimits, rejected *expvar.Int) net.Listener {
+	if max <= 0 && limits == nil {
+		return ln
+	}
+	l := &limitListener{
+		Listener: ln,
+		limits:   limits,
+		rejected: rejected,
+	}
+	if max > 0 {
+		l.sem = make(chan struct{}, max)
+	}
+	return l
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.acquire() {
+			return &limitConn{Conn: c, release: l.release}, nil
+		}
+		Log.WithField("client", c.RemoteAddr()).Debug("too many connections, closing connection")
+		l.rejected.Add(1)
+		c.Close()
+	}
+}
+
+func (l *limitListener) acquire() bool {
+	if l.sem != nil {
+		select {
+		case l.sem <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	if !l.limits.acquireConnection() {
+		if l.sem != nil {
+			<-l.sem
+		}
+		return false
+	}
+	return true
+}
+
+func (l *limitListener) release() {
+	l.limits.releaseConnection()
+	if l.sem != nil {
+		<-l.sem
+	}
+}
+
+// limitConn frees its slot in a limitListener when closed.
+type limitConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// Applies the per-connection limits of the options to a DNS server using
+// stream connections.
+func applyConnectionLimits(s *dns.Server, opt ListenOptions) {
+	if opt.IdleTimeout > 0 {
+		timeout := opt.IdleTimeout
+		s.IdleTimeout = func() time.Duration { return timeout }
+	}
+	if opt.MaxConnectionQueries > 0 {
+		s.MaxTCPQueries = opt.MaxConnectionQueries
+	}
+}
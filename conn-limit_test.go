@@ -0,0 +1,57 @@
+package rdns
+
+import (
+	"expvar"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimitConnections(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	rejected := new(expvar.Int)
+	ln := limitConnections(inner, 1, nil, rejected)
+	defer ln.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	// The first connection is accepted
+	c1, err := net.Dial("tcp", inner.Addr().String())
+	require.NoError(t, err)
+	defer c1.Close()
+	s1 := <-accepted
+
+	// The second is over the limit and closed by the server
+	c2, err := net.Dial("tcp", inner.Addr().String())
+	require.NoError(t, err)
+	defer c2.Close()
+	_ = c2.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = c2.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+	require.Equal(t, int64(1), rejected.Value())
+
+	// Once the first connection is closed, a new one is accepted
+	require.NoError(t, s1.Close())
+	c3, err := net.Dial("tcp", inner.Addr().String())
+	require.NoError(t, err)
+	defer c3.Close()
+	select {
+	case s3 := <-accepted:
+		s3.Close()
+	case <-time.After(time.Second):
+		t.Fatal("connection not accepted")
+	}
+}
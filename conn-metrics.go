@@ -0,0 +1,194 @@
+package rdns
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// meterListener is a net.Listener that records the number of open
+// connections and the bytes transferred over them in the metrics of a
+// listener.
+type meterListener struct {
+	net.Listener
+	metrics *ListenerMetrics
+}
+
+// Returns a listener that updates the connection metrics. The listener is
+// returned unchanged if there are no metrics.
+func meterConnections(ln net.Listener, metrics *ListenerMetrics) net.Listener {
+	if metrics == nil || metrics.activeConns == nil {
+		return ln
+	}
+	return &meterListener{Listener: ln, metrics: metrics}
+}
+
+func (l *meterListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.metrics.activeConns.Add(1)
+	return &meterConn{Conn: c, metrics: l.metrics}, nil
+}
+
+// meterConn counts the bytes read and written, and removes itself from the
+// active connections when closed.
+type meterConn struct {
+	net.Conn
+	metrics *ListenerMetrics
+	once    sync.Once
+}
+
+func (c *meterConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.metrics.bytesIn.Add(int64(n))
+	return n, err
+}
+
+func (c *meterConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.metrics.bytesOut.Add(int64(n))
+	return n, err
+}
+
+func (c *meterConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { c.metrics.activeConns.Add(-1) })
+	return err
+}
+
+// handshakeListener wraps a TLS listener to record failed handshakes by
+// reason. The handshake happens on the first read or write.
+type handshakeListener struct {
+	net.Listener
+	metrics *ListenerMetrics
+}
+
+// Returns a TLS listener that counts handshake failures. The listener is
+// returned unchanged if there are no metrics.
+func meterHandshakes(ln net.Listener, metrics *ListenerMetrics) net.Listener {
+	if metrics == nil || metrics.handshakeErr == nil {
+		return ln
+	}
+	return &handshakeListener{Listener: ln, metrics: metrics}
+}
+
+func (l *handshakeListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tlsConn, ok := c.(*tls.Conn)
+	if !ok {
+		return c, nil
+	}
+	return &handshakeConn{Conn: tlsConn, metrics: l.metrics}, nil
+}
+
+// handshakeConn embeds the *tls.Conn so the connection state remains
+// available to handlers.
+type handshakeConn struct {
+	*tls.Conn
+	metrics *ListenerMetrics
+	once    sync.Once
+	err     error
+}
+
+func (c *handshakeConn) handshake() error {
+	c.once.Do(func() {
+		if c.err = c.Conn.Handshake(); c.err != nil {
+			reason := handshakeErrorReason(c.err)
+			c.metrics.handshakeErr.Add(reason, 1)
+			Log.WithField("client", c.RemoteAddr()).WithError(c.err).Debug("tls handshake failed")
+		}
+	})
+	return c.err
+}
+
+func (c *handshakeConn) Read(b []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *handshakeConn) Write(b []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+// Returns the reason of a failed TLS handshake as used in the metrics.
+func handshakeErrorReason(err error) string {
+	var recordErr tls.RecordHeaderError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &recordErr):
+		return "not-tls"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, syscall.ECONNRESET):
+		return "eof"
+	}
+	return handshakeErrorMessageReason(err.Error())
+}
+
+// Returns the reason of a failed TLS handshake from the error message. The
+// crypto/tls package doesn't export most of its errors, and the HTTP server
+// only logs them.
+func handshakeErrorMessageReason(msg string) string {
+	switch {
+	case strings.Contains(msg, "remote error"):
+		// The client aborted with an alert, typically because it didn't
+		// accept the certificate
+		return "client-alert"
+	case strings.Contains(msg, "does not look like a TLS handshake"),
+		strings.Contains(msg, "HTTP request to an HTTPS server"):
+		return "not-tls"
+	case strings.Contains(msg, "timeout"):
+		return "timeout"
+	case strings.HasSuffix(msg, "EOF"), strings.Contains(msg, "connection reset"):
+		return "eof"
+	case strings.Contains(msg, "version"):
+		return "version"
+	case strings.Contains(msg, "cipher"):
+		return "cipher"
+	case strings.Contains(msg, "application protocol"):
+		return "alpn"
+	case strings.Contains(msg, "certificate"):
+		return "certificate"
+	}
+	return "other"
+}
+
+// Returns a logger for http.Server that counts the TLS handshake errors it
+// reports, and passes everything else on to the log.
+func httpErrorLog(id string, metrics *ListenerMetrics) *log.Logger {
+	return log.New(httpErrorWriter{id: id, metrics: metrics}, "", 0)
+}
+
+type httpErrorWriter struct {
+	id      string
+	metrics *ListenerMetrics
+}
+
+func (w httpErrorWriter) Write(b []byte) (int, error) {
+	msg := strings.TrimSpace(string(b))
+	log := Log.WithField("id", w.id)
+	// Handshake errors are logged as "http: TLS handshake error from <addr>: <err>"
+	if _, after, ok := strings.Cut(msg, "TLS handshake error from "); ok {
+		client, reason, _ := strings.Cut(after, ": ")
+		w.metrics.handshakeErr.Add(handshakeErrorMessageReason(reason), 1)
+		log.WithField("client", client).Debug("tls handshake failed: " + reason)
+		return len(b), nil
+	}
+	log.Warn(msg)
+	return len(b), nil
+}
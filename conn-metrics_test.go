@@ -0,0 +1,64 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoTListenerConnectionMetrics(t *testing.T) {
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	s := NewDoTListener("test-conn-metrics", addr, DoTListenerOptions{TLSConfig: tlsServerConfig}, new(TestResolver))
+	go func() { _ = s.Start() }()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	metrics := NewListenerMetrics("listener", "test-conn-metrics").withConnections("test-conn-metrics")
+
+	// Send a query over DoT
+	tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "", "")
+	require.NoError(t, err)
+	c, err := NewDoTClient("test-dot", addr, DoTClientOptions{TLSConfig: tlsConfig})
+	require.NoError(t, err)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Greater(t, metrics.bytesIn.Value(), int64(0))
+	require.Greater(t, metrics.bytesOut.Value(), int64(0))
+	require.Equal(t, int64(1), metrics.activeConns.Value())
+
+	// A client that doesn't speak TLS fails the handshake
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	_, _ = conn.Read(make([]byte, 512))
+	conn.Close()
+	require.Eventually(t, func() bool {
+		return metrics.handshakeErr.Get("not-tls") != nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestHandshakeErrorMessageReason(t *testing.T) {
+	tests := map[string]string{
+		"tls: client offered only unsupported versions: [301]":           "version",
+		"tls: no cipher suite supported by both client and server":       "cipher",
+		"tls: client requested unsupported application protocols ([h2])": "alpn",
+		"tls: client didn't provide a certificate":                       "certificate",
+		"remote error: tls: bad certificate":                             "client-alert",
+		"tls: first record does not look like a TLS handshake":           "not-tls",
+		"read tcp 127.0.0.1:443->127.0.0.1:5000: i/o timeout":            "timeout",
+		"EOF":                  "eof",
+		"something unexpected": "other",
+	}
+	for msg, reason := range tests {
+		require.Equal(t, reason, handshakeErrorMessageReason(msg), msg)
+	}
+}
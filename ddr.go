@@ -0,0 +1,483 @@
+package rdns
+
+import (
+	"crypto/tls"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Name queried by clients to discover the designated resolvers of the resolver
+// they're using, RFC 9462.
+const ddrResolverName = "_dns.resolver.arpa."
+
+// DDR is a resolver that advertises encrypted endpoints of this instance to
+// clients as defined in RFC 9462, Discovery of Designated Resolvers. It answers
+// SVCB queries for _dns.resolver.arpa, as well as for _dns.<target> to let
+// clients that know the name of the resolver verify it. Other queries for
+// resolver.arpa are answered with NXDOMAIN, everything else is passed on to
+// the upstream resolver.
+type DDR struct {
+	id       string
+	resolver Resolver
+	opt      DDROptions
+	metrics  *DDRMetrics
+}
+
+var _ Resolver = &DDR{}
+
+// DDROptions contains the designated resolvers advertised to clients.
+type DDROptions struct {
+	// Name of the designated resolver, which has to be in the certificates of
+	// the listeners.
+	Target string
+
+	// Encrypted endpoints, in order of preference.
+	Endpoints []DDREndpoint
+
+	// Addresses of the target, to save clients a lookup.
+	IPv4Hint []net.IP
+	IPv6Hint []net.IP
+
+	// TTL of the SVCB records, default 3600.
+	TTL uint32
+}
+
+// DDREndpoint is an encrypted endpoint of a designated resolver.
+type DDREndpoint struct {
+	// "dot", "doq", "doh" for DoH over HTTP/2 or "doh3" for DoH over HTTP/3.
+	Protocol string
+
+	// Port of the endpoint, defaults to 853 for DoT and DoQ and 443 for DoH.
+	Port uint16
+
+	// URI template of DoH endpoints, default "/dns-query{?dns}".
+	DoHPath string
+}
+
+type DDRMetrics struct {
+	// Discovery queries answered.
+	answered *expvar.Int
+}
+
+// ALPN IDs of the protocols supported for designated resolvers.
+var ddrALPN = map[string]string{
+	"dot":  "dot",
+	"doq":  "doq",
+	"doh":  "h2",
+	"doh3": "h3",
+}
+
+const defaultDDRTTL = 3600
+
+// NewDDR returns a new instance of a resolver that advertises designated
+// resolvers.
+func NewDDR(id string, resolver Resolver, opt DDROptions) (*DDR, error) {
+	if opt.Target == "" {
+		return nil, errors.New("no target name for designated resolvers")
+	}
+	if len(opt.Endpoints) == 0 {
+		return nil, errors.New("no designated resolvers")
+	}
+	for _, ep := range opt.Endpoints {
+		if _, ok := ddrALPN[ep.Protocol]; !ok {
+			return nil, fmt.Errorf("unsupported protocol '%s' for designated resolver", ep.Protocol)
+		}
+	}
+	if opt.TTL == 0 {
+		opt.TTL = defaultDDRTTL
+	}
+	opt.Target = dns.Fqdn(strings.ToLower(opt.Target))
+	return &DDR{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		metrics: &DDRMetrics{
+			answered: getVarInt("ddr", id, "answered"),
+		},
+	}, nil
+}
+
+// Resolve a DNS query, answering discovery queries locally.
+func (r *DDR) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return r.resolver.Resolve(q, ci)
+	}
+	question := q.Question[0]
+	name := strings.ToLower(question.Name)
+	isDiscovery := name == ddrResolverName || name == "_dns."+r.opt.Target
+	if !isDiscovery && !dns.IsSubDomain("resolver.arpa.", name) {
+		return r.resolver.Resolve(q, ci)
+	}
+	log := logger(r.id, q, ci)
+	a := new(dns.Msg)
+	a.SetReply(q)
+	switch {
+	case !isDiscovery:
+		log.Debug("responding with nxdomain for resolver.arpa")
+		a.SetRcode(q, dns.RcodeNameError)
+	case question.Qtype == dns.TypeSVCB:
+		log.Debug("responding with designated resolvers")
+		r.metrics.answered.Add(1)
+		a.Answer = r.records(question.Name)
+	default:
+		log.Debug("responding with nodata for discovery query")
+	}
+	a.Authoritative = true
+	return a, nil
+}
+
+func (r *DDR) String() string {
+	return r.id
+}
+
+// Check Cert
+func (r *DDR) CertMonitor() error {
+	return nil
+}
+
+// Returns the SVCB records of the designated resolvers.
+func (r *DDR) records(name string) []dns.RR {
+	rrs := make([]dns.RR, 0, len(r.opt.Endpoints))
+	for i, ep := range r.opt.Endpoints {
+		svcb := &dns.SVCB{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeSVCB,
+				Class:  dns.ClassINET,
+				Ttl:    r.opt.TTL,
+			},
+			Priority: uint16(i + 1),
+			Target:   r.opt.Target,
+			Value: []dns.SVCBKeyValue{
+				&dns.SVCBAlpn{Alpn: []string{ddrALPN[ep.Protocol]}},
+			},
+		}
+		if ep.Port != 0 {
+			svcb.Value = append(svcb.Value, &dns.SVCBPort{Port: ep.Port})
+		}
+		if len(r.opt.IPv4Hint) > 0 {
+			svcb.Value = append(svcb.Value, &dns.SVCBIPv4Hint{Hint: r.opt.IPv4Hint})
+		}
+		if len(r.opt.IPv6Hint) > 0 {
+			svcb.Value = append(svcb.Value, &dns.SVCBIPv6Hint{Hint: r.opt.IPv6Hint})
+		}
+		if ep.Protocol == "doh" || ep.Protocol == "doh3" {
+			path := ep.DoHPath
+			if path == "" {
+				path = "/dns-query{?dns}"
+			}
+			svcb.Value = append(svcb.Value, &dns.SVCBDoHPath{Template: path})
+		}
+		rrs = append(rrs, svcb)
+	}
+	return rrs
+}
+
+// DDRUpgrade is a resolver that discovers the designated resolvers of a plain
+// DNS upstream as defined in RFC 9462, and sends queries to the first
+// encrypted one that works instead. Until a designated resolver is found,
+// queries go to the plain upstream. Once upgraded, queries are not sent
+// unencrypted anymore. The discovery is repeated periodically to follow
+// changes.
+type DDRUpgrade struct {
+	id    string
+	plain Resolver
+	opt   DDRUpgradeOptions
+
+	mu       sync.RWMutex
+	upgraded Resolver
+	current  DesignatedResolver
+
+	metrics *DDRUpgradeMetrics
+
+	// Closed to stop the discovery
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+var _ Resolver = &DDRUpgrade{}
+
+// DDRUpgradeOptions contains the settings of a DDRUpgrade resolver.
+type DDRUpgradeOptions struct {
+	// Creates the resolver for a designated resolver. It has to verify that
+	// the certificate of the designated resolver is valid for the IP of the
+	// plain upstream, see DDRVerifyConnection.
+	NewResolver func(DesignatedResolver) (Resolver, error)
+
+	// Time between discoveries, default 1 hour.
+	Interval time.Duration
+}
+
+// DesignatedResolver is an encrypted resolver discovered with DDR.
+type DesignatedResolver struct {
+	// "dot", "doq", "doh" for DoH over HTTP/2 or "doh3" for DoH over HTTP/3.
+	Protocol string
+	Target   string
+	Port     uint16
+
+	// URI template of DoH endpoints.
+	DoHPath string
+
+	// Addresses of the target, from the SVCB record.
+	Hints []net.IP
+}
+
+// Address returns the address to connect to, a URL for DoH.
+func (d DesignatedResolver) Address() string {
+	host := strings.TrimSuffix(d.Target, ".")
+	switch d.Protocol {
+	case "doh", "doh3":
+		path, _, _ := strings.Cut(d.DoHPath, "{")
+		return "https://" + net.JoinHostPort(host, fmt.Sprint(d.Port)) + path
+	default:
+		return net.JoinHostPort(host, fmt.Sprint(d.Port))
+	}
+}
+
+type DDRUpgradeMetrics struct {
+	// Set to 1 while queries are sent to a designated resolver.
+	upgraded *expvar.Int
+	// Discoveries that didn't find a working designated resolver.
+	discoveryErr *expvar.Int
+}
+
+const (
+	defaultDDRInterval = time.Hour
+	ddrRetryInterval   = time.Minute
+)
+
+// NewDDRUpgrade returns a new instance of a resolver that upgrades a plain
+// upstream to its designated resolver. The discovery is started right away
+// in the background.
+func NewDDRUpgrade(id string, plain Resolver, opt DDRUpgradeOptions) (*DDRUpgrade, error) {
+	if opt.NewResolver == nil {
+		return nil, errors.New("no function to create designated resolvers")
+	}
+	if opt.Interval == 0 {
+		opt.Interval = defaultDDRInterval
+	}
+	r := &DDRUpgrade{
+		id:    id,
+		plain: plain,
+		opt:   opt,
+		stop:  make(chan struct{}),
+		metrics: &DDRUpgradeMetrics{
+			upgraded:     getVarInt("ddr-upgrade", id, "upgraded"),
+			discoveryErr: getVarInt("ddr-upgrade", id, "discovery-error"),
+		},
+	}
+	go r.discoverLoop()
+	return r, nil
+}
+
+// Resolve a DNS query using the designated resolver if one was found, or the
+// plain upstream otherwise.
+func (r *DDRUpgrade) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	r.mu.RLock()
+	resolver := r.upgraded
+	r.mu.RUnlock()
+	if resolver == nil {
+		return r.plain.Resolve(q, ci)
+	}
+	return resolver.Resolve(q, ci)
+}
+
+func (r *DDRUpgrade) String() string {
+	return r.id
+}
+
+// Check Cert
+func (r *DDRUpgrade) CertMonitor() error {
+	return nil
+}
+
+// Close stops the discovery and closes the plain and designated resolvers.
+func (r *DDRUpgrade) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.stop)
+		r.mu.Lock()
+		if r.upgraded != nil {
+			closeResolver(r.upgraded)
+		}
+		r.mu.Unlock()
+		closeResolver(r.plain)
+	})
+	return nil
+}
+
+// Discovers the designated resolvers periodically until closed.
+func (r *DDRUpgrade) discoverLoop() {
+	log := Log.WithField("id", r.id)
+	for {
+		if err := r.discover(); err != nil {
+			r.metrics.discoveryErr.Add(1)
+			log.WithError(err).Warn("failed to discover designated resolver")
+		}
+		// Retry sooner while queries are still sent unencrypted
+		interval := r.opt.Interval
+		if !r.isUpgraded() {
+			interval = ddrRetryInterval
+		}
+		select {
+		case <-time.After(interval):
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+func (r *DDRUpgrade) isUpgraded() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.upgraded != nil
+}
+
+// Queries the plain upstream for its designated resolvers and switches to the
+// first one that answers a test query. The current designated resolver is kept
+// if it's still advertised.
+func (r *DDRUpgrade) discover() error {
+	q := new(dns.Msg)
+	q.SetQuestion(ddrResolverName, dns.TypeSVCB)
+	a, err := r.plain.Resolve(q, ClientInfo{})
+	if err != nil {
+		return err
+	}
+	if a.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("discovery query failed with %s", dns.RcodeToString[a.Rcode])
+	}
+	candidates := designatedResolvers(a)
+	if len(candidates) == 0 {
+		return errors.New("no supported designated resolvers")
+	}
+
+	r.mu.RLock()
+	current := r.current
+	upgraded := r.upgraded != nil
+	r.mu.RUnlock()
+
+	log := Log.WithField("id", r.id)
+	var errs []error
+	for _, d := range candidates {
+		if upgraded && d.Address() == current.Address() && d.Protocol == current.Protocol {
+			return nil
+		}
+		resolver, err := r.opt.NewResolver(d)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		// The test query fails if the designated resolver can't be verified
+		if _, err := resolver.Resolve(keepAliveQuery(), ClientInfo{}); err != nil {
+			closeResolver(resolver)
+			errs = append(errs, fmt.Errorf("%s %s: %w", d.Protocol, d.Address(), err))
+			continue
+		}
+		log.WithFields(logrus.Fields{"protocol": d.Protocol, "address": d.Address()}).Info("upgraded to designated resolver")
+		r.mu.Lock()
+		old := r.upgraded
+		r.upgraded = resolver
+		r.current = d
+		r.mu.Unlock()
+		if old != nil {
+			closeResolver(old)
+		}
+		r.metrics.upgraded.Set(1)
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+// Returns the supported designated resolvers in a discovery response, in order
+// of priority.
+func designatedResolvers(a *dns.Msg) []DesignatedResolver {
+	var records []*dns.SVCB
+	for _, rr := range a.Answer {
+		svcb, ok := rr.(*dns.SVCB)
+		// Alias mode (priority 0) isn't used for DDR
+		if !ok || svcb.Priority == 0 || svcb.Target == "." {
+			continue
+		}
+		records = append(records, svcb)
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Priority < records[j].Priority })
+
+	var resolvers []DesignatedResolver
+	for _, svcb := range records {
+		var (
+			alpn  []string
+			port  uint16
+			path  string
+			hints []net.IP
+		)
+		for _, kv := range svcb.Value {
+			switch kv := kv.(type) {
+			case *dns.SVCBAlpn:
+				alpn = kv.Alpn
+			case *dns.SVCBPort:
+				port = kv.Port
+			case *dns.SVCBDoHPath:
+				path = kv.Template
+			case *dns.SVCBIPv4Hint:
+				hints = append(hints, kv.Hint...)
+			case *dns.SVCBIPv6Hint:
+				hints = append(hints, kv.Hint...)
+			}
+		}
+		for _, id := range alpn {
+			d := DesignatedResolver{Target: svcb.Target, Port: port, Hints: hints}
+			switch id {
+			case "dot":
+				d.Protocol = "dot"
+			case "doq":
+				d.Protocol = "doq"
+			case "h2", "h3":
+				// DoH requires the path
+				if path == "" {
+					continue
+				}
+				d.Protocol = "doh"
+				if id == "h3" {
+					d.Protocol = "doh3"
+				}
+				d.DoHPath = path
+			default:
+				continue
+			}
+			if d.Port == 0 {
+				d.Port = 853
+				if d.Protocol == "doh" || d.Protocol == "doh3" {
+					d.Port = 443
+				}
+			}
+			resolvers = append(resolvers, d)
+		}
+	}
+	return resolvers
+}
+
+// DDRVerifyConnection returns a function for tls.Config.VerifyConnection that
+// checks that the certificate of a designated resolver is also valid for the
+// IP address of the plain resolver it was discovered through, as required by
+// RFC 9462 to prevent an attacker from redirecting clients to its own server.
+func DDRVerifyConnection(ip net.IP) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("no certificate from designated resolver")
+		}
+		for _, certIP := range cs.PeerCertificates[0].IPAddresses {
+			if certIP.Equal(ip) {
+				return nil
+			}
+		}
+		return fmt.Errorf("certificate of designated resolver is not valid for %s", ip)
+	}
+}
@@ -0,0 +1,120 @@
+package rdns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDDR(t *testing.T) {
+	var ci ClientInfo
+	upstream := new(TestResolver)
+	opt := DDROptions{
+		Target: "dns.example.com",
+		Endpoints: []DDREndpoint{
+			{Protocol: "dot"},
+			{Protocol: "doh", Port: 8443},
+		},
+		IPv4Hint: []net.IP{net.ParseIP("192.0.2.1")},
+	}
+	r, err := NewDDR("test-ddr", upstream, opt)
+	require.NoError(t, err)
+
+	// Discovery query
+	q := new(dns.Msg)
+	q.SetQuestion("_dns.resolver.arpa.", dns.TypeSVCB)
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 2)
+	require.Equal(t, 0, upstream.HitCount())
+
+	// The response is parsed into the designated resolvers in order
+	designated := designatedResolvers(a)
+	require.Equal(t, []DesignatedResolver{
+		{Protocol: "dot", Target: "dns.example.com.", Port: 853, Hints: []net.IP{net.ParseIP("192.0.2.1")}},
+		{Protocol: "doh", Target: "dns.example.com.", Port: 8443, DoHPath: "/dns-query{?dns}", Hints: []net.IP{net.ParseIP("192.0.2.1")}},
+	}, designated)
+	require.Equal(t, "dns.example.com:853", designated[0].Address())
+	require.Equal(t, "https://dns.example.com:8443/dns-query", designated[1].Address())
+
+	// Verified discovery with the name of the resolver
+	q.SetQuestion("_dns.dns.example.com.", dns.TypeSVCB)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 2)
+
+	// Other types and names in resolver.arpa
+	q.SetQuestion("_dns.resolver.arpa.", dns.TypeA)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Empty(t, a.Answer)
+	q.SetQuestion("test.resolver.arpa.", dns.TypeSVCB)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Equal(t, 0, upstream.HitCount())
+
+	// Everything else goes upstream
+	q.SetQuestion("test.com.", dns.TypeA)
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+
+	// Unsupported protocol
+	_, err = NewDDR("test-ddr", upstream, DDROptions{Target: "dns.example.com", Endpoints: []DDREndpoint{{Protocol: "udp"}}})
+	require.Error(t, err)
+}
+
+func TestDDRUpgrade(t *testing.T) {
+	var ci ClientInfo
+	server, err := NewDDR("test-ddr", new(TestResolver), DDROptions{
+		Target:    "dns.example.com",
+		Endpoints: []DDREndpoint{{Protocol: "doq"}, {Protocol: "dot"}},
+	})
+	require.NoError(t, err)
+	plain := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			return server.Resolve(q, ci)
+		},
+	}
+
+	// The DoQ endpoint fails, so the DoT endpoint is used
+	dot := new(TestResolver)
+	created := make(chan DesignatedResolver, 2)
+	opt := DDRUpgradeOptions{
+		NewResolver: func(d DesignatedResolver) (Resolver, error) {
+			created <- d
+			if d.Protocol == "doq" {
+				return &TestResolver{shouldFail: true}, nil
+			}
+			return dot, nil
+		},
+	}
+	r, err := NewDDRUpgrade("test-ddr-upgrade", plain, opt)
+	require.NoError(t, err)
+	require.Eventually(t, r.isUpgraded, time.Second, 10*time.Millisecond)
+	require.Equal(t, "doq", (<-created).Protocol)
+	require.Equal(t, "dot", (<-created).Protocol)
+
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, dot.HitCount()) // test query plus this one
+}
+
+func TestDDRVerifyConnection(t *testing.T) {
+	verify := DDRVerifyConnection(net.ParseIP("192.0.2.1"))
+	cert := &x509.Certificate{IPAddresses: []net.IP{net.ParseIP("192.0.2.1")}}
+	require.NoError(t, verify(tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}))
+
+	cert = &x509.Certificate{IPAddresses: []net.IP{net.ParseIP("192.0.2.2")}}
+	require.Error(t, verify(tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}))
+	require.Error(t, verify(tls.ConnectionState{}))
+}
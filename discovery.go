@@ -0,0 +1,290 @@
+package rdns
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Discovery is a resolver that finds its upstream endpoints in DNS, for example
+// the pods behind a Kubernetes headless service, and re-resolves them
+// periodically to follow changes. Queries are spread over the endpoints
+// round-robin, and failed over to the next endpoint on errors. A resolver is
+// created for every endpoint and re-used as long as the endpoint is found.
+type Discovery struct {
+	id  string
+	opt DiscoveryOptions
+
+	mu        sync.RWMutex
+	endpoints []discoveredResolver
+	next      atomic.Uint64
+
+	metrics *DiscoveryMetrics
+
+	// Closed to stop the periodic lookups
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+var _ Resolver = &Discovery{}
+
+// DiscoveryOptions contains the settings of a Discovery resolver.
+type DiscoveryOptions struct {
+	// "dns" looks up the addresses of Name, "srv" its SRV records. The
+	// priority and weight of SRV records are ignored, all targets are used.
+	Mode string
+	Name string
+
+	// Time between lookups, default 30 seconds.
+	Interval time.Duration
+
+	// Creates the resolver for an endpoint.
+	NewResolver func(DiscoveredEndpoint) (Resolver, error)
+
+	// Functions used to look up endpoints, default to those of the system
+	// resolver.
+	LookupIP  func(ctx context.Context, network, host string) ([]net.IP, error)
+	LookupSRV func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// DiscoveredEndpoint is an upstream endpoint found in DNS. Address lookups
+// provide an IP, SRV lookups a host and port.
+type DiscoveredEndpoint struct {
+	IP   net.IP
+	Host string
+	Port uint16
+}
+
+// Address returns the endpoint as IP, or as host:port for SRV records.
+func (e DiscoveredEndpoint) Address() string {
+	if e.IP != nil {
+		return e.IP.String()
+	}
+	return net.JoinHostPort(e.Host, strconv.Itoa(int(e.Port)))
+}
+
+type discoveredResolver struct {
+	address  string
+	resolver Resolver
+}
+
+type DiscoveryMetrics struct {
+	// Number of endpoints currently in use.
+	endpoints *expvar.Int
+	// Failed lookups.
+	refreshErr *expvar.Int
+	// Queries failed over to another endpoint.
+	failover *expvar.Int
+}
+
+const defaultDiscoveryInterval = 30 * time.Second
+
+// NewDiscovery returns a new instance of a resolver that discovers its
+// endpoints in DNS. The first lookup is done right away, but a failure isn't
+// fatal since the endpoints may not be up yet.
+func NewDiscovery(id string, opt DiscoveryOptions) (*Discovery, error) {
+	switch opt.Mode {
+	case "dns", "srv":
+	default:
+		return nil, fmt.Errorf("unsupported discovery mode '%s'", opt.Mode)
+	}
+	if opt.Name == "" {
+		return nil, errors.New("no name to discover endpoints")
+	}
+	if opt.NewResolver == nil {
+		return nil, errors.New("no function to create resolvers for endpoints")
+	}
+	if opt.Interval == 0 {
+		opt.Interval = defaultDiscoveryInterval
+	}
+	if opt.LookupIP == nil {
+		opt.LookupIP = net.DefaultResolver.LookupIP
+	}
+	if opt.LookupSRV == nil {
+		opt.LookupSRV = net.DefaultResolver.LookupSRV
+	}
+	r := &Discovery{
+		id:  id,
+		opt: opt,
+		metrics: &DiscoveryMetrics{
+			endpoints:  getVarInt("discovery", id, "endpoints"),
+			refreshErr: getVarInt("discovery", id, "refresh-error"),
+			failover:   getVarInt("discovery", id, "failover"),
+		},
+		stop: make(chan struct{}),
+	}
+	if err := r.refresh(); err != nil {
+		Log.WithFields(logrus.Fields{"id": id, "name": opt.Name}).WithError(err).Warn("failed to discover endpoints")
+	}
+	go r.refreshLoop()
+	return r, nil
+}
+
+// Resolve a DNS query using the next endpoint, failing over to the others on
+// error.
+func (r *Discovery) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	r.mu.RLock()
+	endpoints := r.endpoints
+	r.mu.RUnlock()
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no endpoints discovered for '%s'", r.opt.Name)
+	}
+	start := int(r.next.Add(1) % uint64(len(endpoints)))
+	var err error
+	for i := range endpoints {
+		e := endpoints[(start+i)%len(endpoints)]
+		if i > 0 {
+			r.metrics.failover.Add(1)
+		}
+		logger(r.id, q, ci).WithField("endpoint", e.address).Debug("forwarding query to discovered endpoint")
+		var a *dns.Msg
+		a, err = e.resolver.Resolve(q, ci)
+		if err == nil {
+			return a, nil
+		}
+		logger(r.id, q, ci).WithField("endpoint", e.address).WithError(err).Debug("discovered endpoint failed")
+	}
+	return nil, err
+}
+
+func (r *Discovery) String() string {
+	return r.id
+}
+
+// Check Cert
+func (r *Discovery) CertMonitor() error {
+	return nil
+}
+
+// Close stops the periodic lookups and closes the resolvers of the endpoints.
+func (r *Discovery) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.stop)
+		r.mu.Lock()
+		for _, e := range r.endpoints {
+			closeResolver(e.resolver)
+		}
+		r.endpoints = nil
+		r.mu.Unlock()
+	})
+	return nil
+}
+
+// Looks up the endpoints periodically until closed.
+func (r *Discovery) refreshLoop() {
+	ticker := time.NewTicker(r.opt.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.stop:
+			return
+		}
+		if err := r.refresh(); err != nil {
+			Log.WithFields(logrus.Fields{"id": r.id, "name": r.opt.Name}).WithError(err).Warn("failed to discover endpoints")
+		}
+	}
+}
+
+// Looks up the endpoints and updates the resolvers. The current endpoints are
+// kept if the lookup fails or returns none, to ride out DNS problems.
+func (r *Discovery) refresh() error {
+	found, err := r.lookup()
+	if err == nil && len(found) == 0 {
+		err = errors.New("no endpoints found")
+	}
+	if err != nil {
+		r.metrics.refreshErr.Add(1)
+		return err
+	}
+
+	r.mu.RLock()
+	current := make(map[string]Resolver, len(r.endpoints))
+	for _, e := range r.endpoints {
+		current[e.address] = e.resolver
+	}
+	r.mu.RUnlock()
+
+	endpoints := make([]discoveredResolver, 0, len(found))
+	for _, ep := range found {
+		address := ep.Address()
+		resolver, ok := current[address]
+		if !ok {
+			resolver, err = r.opt.NewResolver(ep)
+			if err != nil {
+				Log.WithFields(logrus.Fields{"id": r.id, "endpoint": address}).WithError(err).Warn("failed to create resolver for endpoint")
+				continue
+			}
+			Log.WithFields(logrus.Fields{"id": r.id, "endpoint": address}).Info("discovered endpoint")
+		}
+		endpoints = append(endpoints, discoveredResolver{address: address, resolver: resolver})
+	}
+	if len(endpoints) == 0 {
+		r.metrics.refreshErr.Add(1)
+		return errors.New("no usable endpoints found")
+	}
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].address < endpoints[j].address })
+
+	r.mu.Lock()
+	r.endpoints = endpoints
+	r.mu.Unlock()
+	r.metrics.endpoints.Set(int64(len(endpoints)))
+
+	// Close the resolvers of endpoints that went away
+	for _, e := range endpoints {
+		delete(current, e.address)
+	}
+	for _, resolver := range current {
+		closeResolver(resolver)
+	}
+	return nil
+}
+
+// Looks up the endpoints in DNS.
+func (r *Discovery) lookup() ([]DiscoveredEndpoint, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultQueryTimeout)
+	defer cancel()
+
+	var endpoints []DiscoveredEndpoint
+	seen := make(map[string]struct{})
+	add := func(ep DiscoveredEndpoint) {
+		if _, ok := seen[ep.Address()]; ok {
+			return
+		}
+		seen[ep.Address()] = struct{}{}
+		endpoints = append(endpoints, ep)
+	}
+	switch r.opt.Mode {
+	case "srv":
+		_, records, err := r.opt.LookupSRV(ctx, "", "", r.opt.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, srv := range records {
+			// A target of "." means the service isn't available
+			if srv.Target == "." {
+				continue
+			}
+			add(DiscoveredEndpoint{Host: srv.Target, Port: srv.Port})
+		}
+	default:
+		ips, err := r.opt.LookupIP(ctx, "ip", r.opt.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			add(DiscoveredEndpoint{IP: ip})
+		}
+	}
+	return endpoints, nil
+}
@@ -0,0 +1,137 @@
+package rdns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiscovery(t *testing.T) {
+	var ci ClientInfo
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	ips := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")}
+	var lookupErr error
+	upstreams := make(map[string]*TestResolver)
+	opt := DiscoveryOptions{
+		Mode: "dns",
+		Name: "upstream.default.svc.cluster.local",
+		LookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+			return ips, lookupErr
+		},
+		NewResolver: func(ep DiscoveredEndpoint) (Resolver, error) {
+			r := new(TestResolver)
+			upstreams[ep.Address()] = r
+			return r, nil
+		},
+	}
+	r, err := NewDiscovery("test-discovery", opt)
+	require.NoError(t, err)
+	require.Len(t, upstreams, 2)
+
+	// Queries are spread over the endpoints
+	for i := 0; i < 4; i++ {
+		_, err = r.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, upstreams["10.0.0.1"].HitCount())
+	require.Equal(t, 2, upstreams["10.0.0.2"].HitCount())
+
+	// A failed endpoint is skipped
+	upstreams["10.0.0.1"].SetFail(true)
+	for i := 0; i < 2; i++ {
+		_, err = r.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 4, upstreams["10.0.0.2"].HitCount())
+
+	// Endpoints that are still there keep their resolver
+	first := upstreams["10.0.0.2"]
+	ips = []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")}
+	require.NoError(t, r.refresh())
+	require.Len(t, upstreams, 3)
+	require.Same(t, first, upstreams["10.0.0.2"])
+	for i := 0; i < 2; i++ {
+		_, err = r.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 1, upstreams["10.0.0.3"].HitCount())
+	require.Equal(t, 5, upstreams["10.0.0.2"].HitCount())
+
+	// The endpoints are kept if the lookup fails
+	lookupErr = errors.New("lookup failed")
+	require.Error(t, r.refresh())
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+}
+
+func TestDiscoverySRV(t *testing.T) {
+	var endpoints []DiscoveredEndpoint
+	opt := DiscoveryOptions{
+		Mode: "srv",
+		Name: "_dns._udp.upstream.default.svc.cluster.local",
+		LookupSRV: func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+			return "", []*net.SRV{
+				{Target: "pod-1.upstream.default.svc.cluster.local.", Port: 5353},
+				{Target: "pod-2.upstream.default.svc.cluster.local.", Port: 5353},
+				{Target: "pod-1.upstream.default.svc.cluster.local.", Port: 5353},
+			}, nil
+		},
+		NewResolver: func(ep DiscoveredEndpoint) (Resolver, error) {
+			endpoints = append(endpoints, ep)
+			return new(TestResolver), nil
+		},
+	}
+	_, err := NewDiscovery("test-discovery", opt)
+	require.NoError(t, err)
+	require.Len(t, endpoints, 2)
+	require.Equal(t, "pod-1.upstream.default.svc.cluster.local.:5353", endpoints[0].Address())
+	require.Equal(t, "pod-2.upstream.default.svc.cluster.local.:5353", endpoints[1].Address())
+}
+
+// Test resolver that records being closed.
+type closeTestResolver struct {
+	TestResolver
+	closed atomic.Bool
+}
+
+func (r *closeTestResolver) Close() error {
+	r.closed.Store(true)
+	return nil
+}
+
+func TestDiscoveryClose(t *testing.T) {
+	ips := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")}
+	upstreams := make(map[string]*closeTestResolver)
+	opt := DiscoveryOptions{
+		Mode: "dns",
+		Name: "upstream.default.svc.cluster.local",
+		LookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+			return ips, nil
+		},
+		NewResolver: func(ep DiscoveredEndpoint) (Resolver, error) {
+			r := new(closeTestResolver)
+			upstreams[ep.Address()] = r
+			return r, nil
+		},
+	}
+	r, err := NewDiscovery("test-discovery", opt)
+	require.NoError(t, err)
+
+	// The resolver of an endpoint that went away is closed
+	ips = []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")}
+	require.NoError(t, r.refresh())
+	require.True(t, upstreams["10.0.0.1"].closed.Load())
+	require.False(t, upstreams["10.0.0.2"].closed.Load())
+
+	// Closing the discovery closes the resolvers of all endpoints
+	require.NoError(t, r.Close())
+	require.True(t, upstreams["10.0.0.2"].closed.Load())
+	require.True(t, upstreams["10.0.0.3"].closed.Load())
+}
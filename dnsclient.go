@@ -2,6 +2,7 @@ package rdns
 
 import (
 	"crypto/tls"
+	"expvar"
 	"net"
 	"strings"
 	"time"
@@ -17,6 +18,14 @@ type DNSClient struct {
 	net      string
 	pipeline *Pipeline // Pipeline also provides operation metrics.
 	opt      DNSClientOptions
+	metrics  *DNSClientMetrics
+
+	// Client for the same upstream over TCP, only set for UDP clients that fall
+	// back to TCP
+	tcp *DNSClient
+
+	// Pipelines for queries sent through a proxy provided by a panel
+	proxied *proxiedCache[*Pipeline]
 }
 
 type Dialer interface {
@@ -33,9 +42,33 @@ type DNSClientOptions struct {
 
 	QueryTimeout time.Duration
 
+	// Tuning of the pipeline that sends queries to the upstream
+	Pipeline PipelineOptions
+
+	// Retry UDP queries over TCP if they fail, for example on timeout, or if
+	// the upstream responds with FORMERR.
+	TCPFallback bool
+
+	// Reject responses that don't match the query and remove records outside
+	// the bailiwick of the query before they are passed on, and possibly cached.
+	ValidateResponses bool
+
 	// Optional dialer, e.g. proxy
 	Dialer           Dialer
 	PanelSocksDialer *Socks5Dialer
+
+	// TSIG key used to sign queries, and verify the responses with. Queries
+	// aren't signed if empty.
+	TSIGName      string
+	TSIGAlgorithm string
+	TSIGSecret    string
+}
+
+type DNSClientMetrics struct {
+	// Rejected responses by reason.
+	rejected *expvar.Map
+	// Records removed from responses for being out of bailiwick.
+	scrubbed *expvar.Int
 }
 
 var _ Resolver = &DNSClient{}
@@ -59,30 +92,135 @@ func NewDNSClient(id, endpoint, network string, opt DNSClientOptions) (*DNSClien
 		LocalAddr:        opt.LocalAddr,
 		Timeout:          opt.QueryTimeout,
 	}
-	return &DNSClient{
+	if opt.TSIGName != "" {
+		opt.TSIGName = dns.CanonicalName(opt.TSIGName)
+		if opt.TSIGAlgorithm == "" {
+			opt.TSIGAlgorithm = dns.HmacSHA256
+		}
+		opt.TSIGAlgorithm = dns.Fqdn(opt.TSIGAlgorithm)
+		opt.Pipeline.TSIGSecret = map[string]string{opt.TSIGName: opt.TSIGSecret}
+	}
+	d := &DNSClient{
 		id:       id,
 		net:      network,
 		endpoint: endpoint,
-		pipeline: NewPipeline(id, endpoint, client, opt.QueryTimeout),
+		pipeline: NewPipeline(id, endpoint, client, opt.QueryTimeout, opt.Pipeline),
 		opt:      opt,
-	}, nil
+		proxied:  newProxiedCache(func(p *Pipeline) { p.Close() }),
+		metrics: &DNSClientMetrics{
+			rejected: getVarMap("client", id, "rejected"),
+			scrubbed: getVarInt("client", id, "scrubbed"),
+		},
+	}
+	if opt.TCPFallback && network == "udp" {
+		tcpOpt := opt
+		tcpOpt.TCPFallback = false
+		tcp, err := NewDNSClient(id+"-tcp", endpoint, "tcp", tcpOpt)
+		if err != nil {
+			return nil, err
+		}
+		d.tcp = tcp
+	}
+	return d, nil
 }
 
 // Resolve a DNS query.
-func (d *DNSClient) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dialer) (*dns.Msg, error) {
-	// Packing a message is not always a read-only operation, make a copy
-	q = q.Copy()
-
-	logger(d.id, q, ci).WithFields(logrus.Fields{
+func (d *DNSClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	log := logger(d.id, q, ci).WithFields(logrus.Fields{
 		"resolver": d.endpoint,
 		"protocol": d.net,
-	}).Debug("querying upstream resolver")
+	})
+	log.Debug("querying upstream resolver")
+	a, err := d.resolve(q, ci)
+	if err == nil && d.opt.TSIGName != "" {
+		// The pipeline verified the signature, it isn't passed on
+		a.Extra = a.Extra[:len(a.Extra)-1]
+	}
+	if err == nil && d.opt.ValidateResponses {
+		err = d.validate(q, a, log)
+	}
+	if d.tcp != nil && (err != nil || a == nil || a.Rcode == dns.RcodeFormatError) {
+		log.WithError(err).Debug("udp query failed, retrying over tcp")
+		return d.tcp.Resolve(q, ci)
+	}
+	return a, err
+}
 
-	q = setUDPSize(q, d.opt.UDPSize)
+func (d *DNSClient) resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 
-	// Remove padding before sending over the wire in plain
-	stripPadding(q)
-	return d.pipeline.Resolve(q)
+	// The query is shared with other resolvers, only make a copy if the OPT
+	// record needs to be changed. Packing a message with an OPT record isn't
+	// a read-only operation either, the pipeline works on its own copy.
+	if d.opt.UDPSize > 0 || q.IsEdns0() != nil {
+		q = q.Copy()
+		setUDPSize(q, d.opt.UDPSize)
+
+		// Remove padding before sending over the wire in plain
+		stripPadding(q)
+	}
+	// The pipeline signs queries with a TSIG record
+	if d.opt.TSIGName != "" {
+		q = q.Copy()
+		q.SetTsig(d.opt.TSIGName, d.opt.TSIGAlgorithm, 300, time.Now().Unix())
+	}
+	if ci.Dialer != nil {
+		return d.proxiedPipeline(ci.Dialer).Resolve(q, ci.Deadline)
+	}
+	return d.pipeline.Resolve(q, ci.Deadline)
+}
+
+// Rejects a response that doesn't match the query and removes records outside
+// the bailiwick of the query from it.
+func (d *DNSClient) validate(q, a *dns.Msg, log *logrus.Entry) error {
+	if reason, ok := validateResponse(q, a); !ok {
+		d.metrics.rejected.Add(reason, 1)
+		log.WithField("reason", reason).Warn("rejected invalid response")
+		return InvalidResponseError{query: q, reason: reason}
+	}
+	if n := scrubResponse(q, a); n > 0 {
+		d.metrics.scrubbed.Add(int64(n))
+		log.WithField("records", n).Debug("removed out-of-bailiwick records from response")
+	}
+	return nil
+}
+
+// Returns the pipeline for queries sent through a SOCKS5 proxy, UDP queries use
+// UDP ASSOCIATE. Pipelines are kept per proxy so connections to it are reused
+// across queries.
+func (d *DNSClient) proxiedPipeline(dialer *Socks5Dialer) *Pipeline {
+	p, _ := d.proxied.get(dialer, func() (*Pipeline, error) {
+		client := GenericDNSClient{
+			Net:              d.net,
+			PanelSocksDialer: dialer,
+			TLSConfig:        &tls.Config{},
+			LocalAddr:        d.opt.LocalAddr,
+			Timeout:          d.opt.QueryTimeout,
+		}
+		return NewPipeline(d.id, d.endpoint, client, d.opt.QueryTimeout, d.opt.Pipeline), nil
+	})
+	return p
+}
+
+// TCPResolver returns a client for the same upstream and with the same options,
+// but using TCP. Returns the client itself if it already uses TCP.
+func (d *DNSClient) TCPResolver() (Resolver, error) {
+	if d.net == "tcp" {
+		return d, nil
+	}
+	if d.tcp != nil {
+		return d.tcp, nil
+	}
+	return NewDNSClient(d.id+"-tcp", d.endpoint, "tcp", d.opt)
+}
+
+// Close stops the pipelines of the client and closes their connections.
+func (d *DNSClient) Close() error {
+	d.pipeline.Close()
+	d.proxied.Close()
+	if d.tcp != nil {
+		d.tcp.Close()
+	}
+	return nil
 }
 
 func (d *DNSClient) String() string {
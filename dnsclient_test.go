@@ -1,7 +1,9 @@
 package rdns
 
 import (
+	"net"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
@@ -11,7 +13,7 @@ func TestDNSClientSimpleTCP(t *testing.T) {
 	d, _ := NewDNSClient("test-dns", "8.8.8.8:53", "tcp", DNSClientOptions{})
 	q := new(dns.Msg)
 	q.SetQuestion("google.com.", dns.TypeA)
-	r, err := d.Resolve(q, ClientInfo{}, nil)
+	r, err := d.Resolve(q, ClientInfo{})
 	require.NoError(t, err)
 	require.NotEmpty(t, r.Answer)
 }
@@ -20,7 +22,121 @@ func TestDNSClientSimpleUDP(t *testing.T) {
 	d, _ := NewDNSClient("test-dns", "8.8.8.8:53", "udp", DNSClientOptions{})
 	q := new(dns.Msg)
 	q.SetQuestion("google.com.", dns.TypeA)
-	r, err := d.Resolve(q, ClientInfo{}, nil)
+	r, err := d.Resolve(q, ClientInfo{})
 	require.NoError(t, err)
 	require.NotEmpty(t, r.Answer)
 }
+
+func TestDNSClientTCPFallback(t *testing.T) {
+	// Upstream that can't handle queries over UDP
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		a := new(dns.Msg)
+		a.SetReply(q)
+		if w.LocalAddr().Network() == "udp" {
+			a.Rcode = dns.RcodeFormatError
+		}
+		_ = w.WriteMsg(a)
+	})
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	udpSrv := &dns.Server{Addr: addr, Net: "udp", Handler: handler}
+	go udpSrv.ListenAndServe()
+	defer udpSrv.Shutdown()
+	tcpSrv := &dns.Server{Addr: addr, Net: "tcp", Handler: handler}
+	go tcpSrv.ListenAndServe()
+	defer tcpSrv.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	d, err := NewDNSClient("test-dns", addr, "udp", DNSClientOptions{})
+	require.NoError(t, err)
+	a, err := d.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeFormatError, a.Rcode)
+
+	d, err = NewDNSClient("test-dns", addr, "udp", DNSClientOptions{TCPFallback: true})
+	require.NoError(t, err)
+	a, err = d.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+}
+
+func TestDNSClientValidateResponses(t *testing.T) {
+	// Upstream that adds a record for an unrelated name to every response
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		a := new(dns.Msg)
+		a.SetReply(q)
+		a.Answer = []dns.RR{
+			&dns.A{Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.IP{192, 0, 2, 1}},
+			&dns.A{Hdr: dns.RR_Header{Name: "bank.test.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.IP{192, 0, 2, 2}},
+		}
+		_ = w.WriteMsg(a)
+	})
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	srv := &dns.Server{Addr: addr, Net: "udp", Handler: handler}
+	go srv.ListenAndServe()
+	defer srv.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	d, err := NewDNSClient("test-dns", addr, "udp", DNSClientOptions{})
+	require.NoError(t, err)
+	a, err := d.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 2)
+
+	d, err = NewDNSClient("test-dns-validate", addr, "udp", DNSClientOptions{ValidateResponses: true})
+	require.NoError(t, err)
+	a, err = d.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "test.com.", a.Answer[0].Header().Name)
+	require.Equal(t, int64(1), d.metrics.scrubbed.Value())
+}
+
+func TestDNSClientTSIG(t *testing.T) {
+	var keyName string
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			keyName = ci.TSIGKey
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	keys := map[string]string{"upstream.": "c2VjcmV0a2V5c2VjcmV0a2V5"}
+	s := NewDNSListener("test-ln", addr, "tcp", ListenOptions{TSIGKeys: keys}, upstream)
+	go func() { _ = s.Start() }()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	// Update signed by the client and verified by the listener
+	u := new(dns.Msg)
+	u.SetUpdate("lan.")
+	u.Insert([]dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "host.lan.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.IP{192, 0, 2, 1}}})
+	d, err := NewDNSClient("test-dns-tsig", addr, "tcp", DNSClientOptions{TSIGName: "Upstream", TSIGSecret: keys["upstream."]})
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		a, err := d.Resolve(u, ClientInfo{})
+		require.NoError(t, err)
+		require.Equal(t, dns.RcodeSuccess, a.Rcode)
+		require.Nil(t, a.IsTsig())
+		require.Equal(t, "upstream.", keyName)
+	}
+	require.Nil(t, u.IsTsig())
+
+	// The listener doesn't accept the wrong secret, and its response can't be
+	// verified
+	d, err = NewDNSClient("test-dns-tsig-invalid", addr, "tcp", DNSClientOptions{TSIGName: "upstream.", TSIGSecret: "d3JvbmdrZXl3cm9uZ2tleQ=="})
+	require.NoError(t, err)
+	_, err = d.Resolve(u, ClientInfo{})
+	require.Error(t, err)
+	require.Equal(t, 2, upstream.HitCount())
+}
@@ -3,10 +3,10 @@ package rdns
 import (
 	"crypto/tls"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
-	"strings"
+	"os"
+	"time"
 
 	"github.com/XrayR-project/XrayR/common/mylego"
 	"github.com/miekg/dns"
@@ -17,8 +17,12 @@ import (
 type DNSListener struct {
 	*dns.Server
 	id string
+	opt ListenOptions
 	Lego *mylego.CertConfig
 	MutualTLS bool
+
+	// Additional servers bound to the same address with SO_REUSEPORT, one per worker
+	workers []*dns.Server
 }
 
 var _ Listener = &DNSListener{}
@@ -26,52 +30,123 @@ var _ Listener = &DNSListener{}
 type ListenOptions struct {
 	// Network allowed to query this listener.
 	AllowedNet []*net.IPNet
+
+	// Maximum time to spend resolving a query before responding with SERVFAIL.
+	// The deadline is passed on to the resolvers so upstream clients can stop
+	// waiting. Default 0 means no limit.
+	QueryTimeout time.Duration
+
+	// Number of sockets to open on the listen address with SO_REUSEPORT, each
+	// served independently, to spread the load over several CPU cores. Only used
+	// by plain UDP and TCP listeners. Default 0 uses a single socket.
+	Workers int
+
+	// Maximum number of concurrent client connections. Connections beyond the
+	// limit are closed immediately. Only used by TCP, DoT, DoQ, DoWS and DTLS
+	// listeners.
+	// With several workers, the limit applies to each of them. Default 0 means
+	// no limit.
+	MaxConnections int
+
+	// Maximum number of queries per second the listener answers. Further
+	// queries are refused. Default 0 means no limit.
+	MaxQPS int
+
+	// Limits shared with other listeners, like those of a tenant. Nil if the
+	// listener has no shared limits.
+	Limits *ListenerLimits
+
+	// Maximum number of queries a client can send over a single connection
+	// before it's closed. Only used by TCP, DoT, DoQ, DoWS and DTLS listeners.
+	// Default 0 uses 128 for TCP, DoT and DTLS, and no limit for DoQ and DoWS.
+	MaxConnectionQueries int
+
+	// Time a connection can be idle before it's closed. It's also advertised to
+	// TCP and DoT clients that send the edns-tcp-keepalive option. Only used by
+	// TCP, DoT, DoQ, DoWS and DTLS listeners. Default 0 uses 8 seconds for TCP,
+	// DoT and DTLS, 2 seconds for DoQ and 1 minute for DoWS.
+	IdleTimeout time.Duration
+
+	// EDNS0 option codes to capture from queries into ClientInfo, for example
+	// device IDs added by CPEs. The options are removed from the query.
+	CaptureEDNS0 []uint16
+
+	// Optional lookup of the MAC address of clients on the local network.
+	MACTable *MACTable
+
+	// Networks of proxies in front of the listener that are trusted to pass on
+	// the original client IP in headers. Headers are ignored if empty. DoH
+	// listeners use it for the Forwarded and X-Forwarded-For headers.
+	TrustedProxies []*net.IPNet
+
+	// Headers with the original client IP, in order of preference. Defaults to
+	// X-Real-IP, CF-Connecting-IP, X-Forwarded-For, True-Client-IP and
+	// X-Original-Forwarded-For. Not used by DoH listeners.
+	ClientIPHeaders []string
+
+	// File mode and group (name or ID) of unix domain sockets. Defaults to the
+	// umask and group of the process.
+	SocketMode  os.FileMode
+	SocketGroup string
+
+	// Accept queries redirected to the listener with TPROXY, recording their
+	// original destination in ClientInfo. Only used by plain UDP and TCP
+	// listeners, and only supported on Linux.
+	Transparent bool
+
+	// Padding of responses as per rfc8467. By default, responses over DoT,
+	// DTLS, DoH, DoQ and DoWS are padded in blocks of 468 bytes and padding
+	// is removed from plain DNS responses.
+	Padding PaddingPolicy
+
+	// TSIG keys to verify signed queries with, base64-encoded secrets by
+	// fully qualified key name. Signed queries are answered with NOTAUTH if
+	// the key is unknown or the signature is invalid. Without keys, signed
+	// queries are passed on unchanged. Only used by plain UDP and TCP, DoT
+	// and DTLS listeners.
+	TSIGKeys map[string]string
+
+	// Share the TCP socket with other TLS listeners on the same address,
+	// connections are handed to the listeners by ALPN protocol. Only used by
+	// DoT and DoH listeners.
+	SharePort bool
 }
 
 func (s *DNSListener) CertMonitor() error {
-	switch s.Lego.CertMode {
-	case "dns", "http", "tls":
-		lego, err := mylego.New(s.Lego)
-		if err != nil {
-			log.Print(err)
-		}
-		// Xray-core supports the OcspStapling certification hot renew
-		_, _, _, _, err = lego.RenewCert()
-		if err != nil {
-			log.Print(err)
-		}
-		cert, key, ca, err := GetCertFile(s.Lego)
-		if err != nil {
-			fmt.Print(err)
-		}
-	
-		tlsConfig, err := TLSServerConfig(ca, cert, key, s.MutualTLS)
-		if err != nil {
-			return err
-		}		
-		s.TLSConfig = tlsConfig
-		err = s.Stop()
-		if err != nil {
-			fmt.Printf("failed to stop DTLS listener %s, err: %s", s.id,err)
-		}
-		err = s.Start()
-		if err != nil {
-			fmt.Printf("failed to start DTLS listener %s, err: %s", s.id,err)
-		}
-	}
-	return nil
+	return renewCertificates(s.Lego, nil)
 }
 
-// NewDNSListener returns an instance of either a UDP or TCP DNS listener.
+// NewDNSListener returns an instance of either a UDP or TCP DNS listener. With
+// "unix" or "unixgram" as network, it listens on a unix domain socket at the
+// path given as address instead.
 func NewDNSListener(id, addr, net string, opt ListenOptions, resolver Resolver) *DNSListener {
-	return &DNSListener{
-		id: id,
+	handler := listenHandler(id, net, addr, resolver, opt)
+	l := &DNSListener{
+		id:  id,
+		opt: opt,
 		Server: &dns.Server{
-			Addr:    addr,
-			Net:     net,
-			Handler: listenHandler(id, net, addr, resolver, opt.AllowedNet),
+			Addr:          addr,
+			Net:           net,
+			Handler:       handler,
+			TsigSecret:    opt.TSIGKeys,
+			MsgAcceptFunc: msgAcceptFunc(opt),
 		},
 	}
+	for i := 1; i < opt.Workers; i++ {
+		l.workers = append(l.workers, &dns.Server{
+			Addr:          addr,
+			Net:           net,
+			Handler:       handler,
+			TsigSecret:    opt.TSIGKeys,
+			MsgAcceptFunc: msgAcceptFunc(opt),
+		})
+	}
+	if net == "tcp" || net == "unix" {
+		for _, srv := range append([]*dns.Server{l.Server}, l.workers...) {
+			applyConnectionLimits(srv, opt)
+		}
+	}
+	return l
 }
 
 // Start the DNS listener.
@@ -80,10 +155,40 @@ func (s DNSListener) Start() error {
 		"id":       s.id,
 		"protocol": s.Net,
 		"addr":     s.Addr}).Info("starting listener")
-	return s.ListenAndServe()
+	rejected := getVarInt("listener", s.id, "connection-rejected")
+	metrics := NewListenerMetrics("listener", s.id).withConnections(s.id)
+	if len(s.workers) == 0 {
+		return activateAndServe(s.Server, socketOptions{
+			maxConnections: s.opt.MaxConnections,
+			limits:         s.opt.Limits,
+			rejected:       rejected,
+			socketMode:     s.opt.SocketMode,
+			socketGroup:    s.opt.SocketGroup,
+			transparent:    s.opt.Transparent,
+			metrics:        metrics,
+		})
+	}
+
+	// Serve on one socket per worker. If one fails, stop the rest so they can
+	// be restarted together.
+	servers := append([]*dns.Server{s.Server}, s.workers...)
+	errCh := make(chan error, len(servers))
+	for i, srv := range servers {
+		go func(srv *dns.Server, opt socketOptions) {
+			errCh <- activateAndServe(srv, opt)
+		}(srv, socketOptions{reusePort: true, worker: i, maxConnections: s.opt.MaxConnections, limits: s.opt.Limits, rejected: rejected, transparent: s.opt.Transparent, metrics: metrics})
+	}
+	err := <-errCh
+	for _, srv := range servers {
+		_ = srv.Shutdown()
+	}
+	return err
 }
 
 func (s DNSListener) Stop() error {
+	for _, srv := range s.workers {
+		_ = srv.Shutdown()
+	}
 	return s.Shutdown()
 }
 
@@ -91,45 +196,23 @@ func (s DNSListener) String() string {
 	return s.id
 }
 
-func getOriginalIP(w dns.ResponseWriter) net.IP {
-	// Try to get original IP from common CDN headers if available
+// Returns the IP of the client, considering CDN headers from trusted proxies.
+func getOriginalIP(w dns.ResponseWriter, opt ListenOptions) net.IP {
+	var req *http.Request
 	if r, ok := w.(interface{ Request() *http.Request }); ok {
-		req := r.Request()
-		if req != nil {
-			// Check common CDN headers in order of preference
-			headers := []string{
-				"x-real-ip",        // nginx
-				"CF-Connecting-IP", // Cloudflare
-				"X-Forwarded-For",  // General use
-				"True-Client-IP",   // Akamai
-				"X-Original-Forwarded-For",
-			}
-
-			for _, header := range headers {
-				if ip := req.Header.Get(header); ip != "" {
-					// Parse the IP address
-					if parsedIP := net.ParseIP(strings.TrimSpace(strings.Split(ip, ",")[0])); parsedIP != nil {
-						return parsedIP
-					}
-				}
-			}
-		}
-	}
-
-	// Fallback to direct connection IP if no CDN headers found
-	switch addr := w.RemoteAddr().(type) {
-	case *net.TCPAddr:
-		return addr.IP
-	case *net.UDPAddr:
-		return addr.IP
-	default:
-		return nil
+		req = r.Request()
 	}
+	return clientIP(w.RemoteAddr(), req, opt)
 }
 
 // DNS handler to forward all incoming requests to a given resolver.
-func listenHandler(id, protocol, addr string, r Resolver, allowedNet []*net.IPNet) dns.HandlerFunc {
-	metrics := NewListenerMetrics("listener", id)
+func listenHandler(id, protocol, addr string, r Resolver, opt ListenOptions) dns.HandlerFunc {
+	metrics := NewListenerMetrics("listener", id).withConnections(id)
+	idleTimeout := opt.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = defaultTCPIdleTimeout
+	}
+	allowQuery := queryLimit(opt)
 	return func(w dns.ResponseWriter, req *dns.Msg) {
 		var err error
 
@@ -141,6 +224,7 @@ func listenHandler(id, protocol, addr string, r Resolver, allowedNet []*net.IPNe
 			connState := r.ConnectionState()
 			if connState != nil {
 				ci.TLSServerName = connState.ServerName
+				ci.setTLSClientIdentity(connState)
 			}
 		}
 
@@ -152,25 +236,60 @@ func listenHandler(id, protocol, addr string, r Resolver, allowedNet []*net.IPNe
 		// }
 
 		// Get original client IP, considering CDN headers
-		ci.SourceIP = getOriginalIP(w)
+		ci.SourceIP = getOriginalIP(w, opt)
+		ci.EDNS0 = captureEDNS0(req, opt.CaptureEDNS0)
+		ci.MAC = opt.MACTable.Lookup(ci.SourceIP)
+		if opt.Transparent {
+			ci.OriginalDst = originalDst(w)
+		}
 
 		log := Log.WithFields(logrus.Fields{"id": id, "client": ci.SourceIP, "qname": qName(req), "protocol": protocol, "addr": addr})
 		log.Debug("received query")
 		metrics.query.Add(1)
 
+		// Bytes over stream connections are counted by the listener
+		datagram := protocol == "udp" || protocol == "unixgram"
+		if datagram {
+			metrics.bytesIn.Add(int64(req.Len()))
+		}
+
+		// The edns-tcp-keepalive option is only meaningful on stream connections
+		// and is an error over UDP as per rfc7828
+		keepalive := stripTCPKeepalive(req)
+
+		// The server verified the signature of signed queries if it knows the
+		// key. The signature isn't passed on.
+		tsig, tsigErr := verifiedTSIG(w, req, opt.TSIGKeys)
+		if tsig != nil {
+			ci.TSIGKey = tsig.Hdr.Name
+			req.Extra = req.Extra[:len(req.Extra)-1]
+		}
+
 		a := new(dns.Msg)
-		if isAllowed(allowedNet, ci.SourceIP) {
+		if keepalive && protocol == "udp" {
+			metrics.err.Add("keepalive", 1)
+			log.Debug("received edns-tcp-keepalive over udp")
+			a.SetRcode(req, dns.RcodeFormatError)
+		} else if tsigErr != nil {
+			metrics.err.Add("tsig", 1)
+			log.WithError(tsigErr).Debug("refusing signed query")
+			a.SetRcode(req, dns.RcodeNotAuth)
+		} else if !isAllowed(opt.AllowedNet, ci.SourceIP) {
+			metrics.err.Add("acl", 1)
+			log.Debug("refusing client ip")
+			a.SetRcode(req, dns.RcodeRefused)
+		} else if !allowQuery() {
+			metrics.err.Add("qps", 1)
+			log.Debug("query rate limit exceeded")
+			a.SetRcode(req, dns.RcodeRefused)
+		} else {
 			log.WithField("resolver", r.String()).Trace("forwarding query to resolver")
-			a, err = r.Resolve(req, ci, nil)
+			a, err = resolveIncoming(r, req, ci.WithTimeout(opt.QueryTimeout))
 			if err != nil {
 				metrics.err.Add("resolve", 1)
 				log.WithError(err).Error("failed to resolve")
 				a = servfail(req)
 			}
-		} else {
-			metrics.err.Add("acl", 1)
-			log.Debug("refusing client ip")
-			a.SetRcode(req, dns.RcodeRefused)
 		}
 
 		// A nil response from the resolvers means "drop", close the connection
@@ -180,14 +299,17 @@ func listenHandler(id, protocol, addr string, r Resolver, allowedNet []*net.IPNe
 			return
 		}
 
-		// If the client asked via DoT and EDNS0 is enabled, the response should be padded for extra security.
-		// See rfc7830 and rfc8467.
-		if protocol == "dot" || protocol == "dtls" {
-			padAnswer(req, a)
+		// Tell clients that asked for it how long the connection can stay open
+		if keepalive && (protocol == "tcp" || protocol == "dot") {
+			setTCPKeepalive(req, a, idleTimeout)
 		} else {
-			stripPadding(a)
+			stripTCPKeepalive(a)
 		}
 
+		// If the client asked via an encrypted protocol and EDNS0 is enabled, the response should be
+		// padded for extra security. See rfc7830 and rfc8467.
+		opt.Padding.apply(protocol, req, a)
+
 		// Check the response actually fits if the query was sent over UDP. If not, respond with TC flag.
 		if protocol == "udp" || protocol == "dtls" {
 			maxSize := dns.MinMsgSize
@@ -198,7 +320,30 @@ func listenHandler(id, protocol, addr string, r Resolver, allowedNet []*net.IPNe
 		}
 
 		metrics.response.Add(rCode(a), 1)
-		_ = w.WriteMsg(a)
+
+		// Sign the response with the key of the query
+		if tsig != nil {
+			a.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+		}
+
+		// Pack the response into a pooled buffer rather than letting WriteMsg
+		// allocate one. Signed responses are left to WriteMsg.
+		if a.IsTsig() != nil {
+			_ = w.WriteMsg(a)
+			return
+		}
+		buf := getBuffer()
+		defer putBuffer(buf)
+		out, err := packBuffer(a, buf, false)
+		if err != nil {
+			metrics.err.Add("pack", 1)
+			log.WithError(err).Error("failed to encode response")
+			return
+		}
+		n, _ := w.Write(out)
+		if datagram {
+			metrics.bytesOut.Add(int64(n))
+		}
 	}
 }
 
@@ -213,3 +358,42 @@ func isAllowed(allowedNet []*net.IPNet, ip net.IP) bool {
 	}
 	return false
 }
+
+// Returns the TSIG record of a signed query if the server verified it with one
+// of the keys, or an error if the query is signed but couldn't be verified.
+func verifiedTSIG(w dns.ResponseWriter, req *dns.Msg, keys map[string]string) (*dns.TSIG, error) {
+	// Without keys the server doesn't verify anything, signed queries are
+	// passed on as they are
+	tsig := req.IsTsig()
+	if tsig == nil || len(keys) == 0 {
+		return nil, nil
+	}
+	if _, ok := keys[tsig.Hdr.Name]; !ok {
+		return nil, fmt.Errorf("unknown tsig key '%s'", tsig.Hdr.Name)
+	}
+	if err := w.TsigStatus(); err != nil {
+		return nil, err
+	}
+	return tsig, nil
+}
+
+// Returns the function that decides which messages are passed to the handler.
+// Listeners with TSIG keys accept dynamic updates in addition to the queries
+// and NOTIFY messages accepted by default.
+func msgAcceptFunc(opt ListenOptions) dns.MsgAcceptFunc {
+	if len(opt.TSIGKeys) == 0 {
+		return dns.DefaultMsgAcceptFunc
+	}
+	return func(dh dns.Header) dns.MsgAcceptAction {
+		isResponse := dh.Bits&(1<<15) != 0
+		opcode := int(dh.Bits>>11) & 0xF
+		if opcode != dns.OpcodeUpdate || isResponse {
+			return dns.DefaultMsgAcceptFunc(dh)
+		}
+		// The zone section has to name exactly one zone
+		if dh.Qdcount != 1 {
+			return dns.MsgReject
+		}
+		return dns.MsgAccept
+	}
+}
@@ -0,0 +1,173 @@
+package rdns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSListenerWorkers(t *testing.T) {
+	upstream := new(TestResolver)
+
+	// Find a free port for the listener
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+
+	// Create the listener with several sockets on the same address
+	s := NewDNSListener("test-ln", addr, "udp", ListenOptions{Workers: 4}, upstream)
+	go func() {
+		err := s.Start()
+		require.NoError(t, err)
+	}()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	// Send queries from different source ports so they're spread over the sockets
+	q := new(dns.Msg)
+	q.SetQuestion("cloudflare.com.", dns.TypeA)
+	for i := 0; i < 8; i++ {
+		c := new(dns.Client)
+		_, _, err = c.Exchange(q, addr)
+		require.NoError(t, err)
+	}
+
+	// The upstream resolver should have seen all queries
+	require.Equal(t, 8, upstream.HitCount())
+}
+
+func TestDNSListenerTCPKeepalive(t *testing.T) {
+	var forwarded bool
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			for _, opt := range q.IsEdns0().Option {
+				if opt.Option() == dns.EDNS0TCPKEEPALIVE {
+					forwarded = true
+				}
+			}
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+
+	// Find a free port for the listeners
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+
+	opt := ListenOptions{IdleTimeout: 30 * time.Second}
+	tcp := NewDNSListener("test-ln", addr, "tcp", opt, upstream)
+	udp := NewDNSListener("test-ln", addr, "udp", opt, upstream)
+	for _, s := range []*DNSListener{tcp, udp} {
+		go func(s *DNSListener) {
+			err := s.Start()
+			require.NoError(t, err)
+		}(s)
+		defer s.Stop()
+	}
+	time.Sleep(time.Second)
+
+	q := new(dns.Msg)
+	q.SetQuestion("cloudflare.com.", dns.TypeA)
+	q.SetEdns0(1232, false)
+	q.IsEdns0().Option = append(q.IsEdns0().Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+
+	// Over TCP, the response carries the idle timeout in units of 100ms
+	c := &dns.Client{Net: "tcp"}
+	a, _, err := c.Exchange(q, addr)
+	require.NoError(t, err)
+	require.False(t, forwarded)
+	var keepalive *dns.EDNS0_TCP_KEEPALIVE
+	for _, opt := range a.IsEdns0().Option {
+		if k, ok := opt.(*dns.EDNS0_TCP_KEEPALIVE); ok {
+			keepalive = k
+		}
+	}
+	require.NotNil(t, keepalive)
+	require.Equal(t, uint16(300), keepalive.Timeout)
+
+	// The option is not allowed over UDP
+	c = &dns.Client{Net: "udp"}
+	a, _, err = c.Exchange(q, addr)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeFormatError, a.Rcode)
+}
+
+func TestDNSListenerTSIG(t *testing.T) {
+	var keyName string
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			keyName = ci.TSIGKey
+			require.Nil(t, q.IsTsig())
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	keys := map[string]string{"update.": "c2VjcmV0a2V5c2VjcmV0a2V5"}
+	s := NewDNSListener("test-ln", addr, "udp", ListenOptions{TSIGKeys: keys}, upstream)
+	go func() { _ = s.Start() }()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	// Signed query, the response is signed with the same key
+	c := &dns.Client{TsigSecret: keys}
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetTsig("update.", dns.HmacSHA256, 300, time.Now().Unix())
+	a, _, err := c.Exchange(q, addr)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.NotNil(t, a.IsTsig())
+	require.Equal(t, "update.", keyName)
+
+	// Query signed with the wrong secret
+	c = &dns.Client{TsigSecret: map[string]string{"update.": "d3JvbmdrZXl3cm9uZ2tleQ=="}}
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetTsig("update.", dns.HmacSHA256, 300, time.Now().Unix())
+	a, _, _ = c.Exchange(q, addr)
+	require.NotNil(t, a)
+	require.Equal(t, dns.RcodeNotAuth, a.Rcode)
+
+	// Unsigned queries are passed on without key
+	q = new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, _, err = new(dns.Client).Exchange(q, addr)
+	require.NoError(t, err)
+	require.Equal(t, "", keyName)
+	require.Equal(t, 2, upstream.HitCount())
+}
+
+func TestDNSListenerTSIGWithoutKeys(t *testing.T) {
+	var signed bool
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			signed = q.IsTsig() != nil
+			require.Equal(t, "", ci.TSIGKey)
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	s := NewDNSListener("test-ln", addr, "udp", ListenOptions{}, upstream)
+	go func() { _ = s.Start() }()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	// A listener without keys passes signed queries on unchanged
+	c := &dns.Client{TsigSecret: map[string]string{"update.": "c2VjcmV0a2V5c2VjcmV0a2V5"}}
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetTsig("update.", dns.HmacSHA256, 300, time.Now().Unix())
+	a, _, err := c.Exchange(q, addr)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.True(t, signed)
+}
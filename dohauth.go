@@ -0,0 +1,73 @@
+package rdns
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// DoHAuth authenticates clients of a DoH listener by the credentials in the
+// Authorization header, either HTTP Basic or a bearer token.
+type DoHAuth interface {
+	// Authenticate returns the name of the user the credentials belong to.
+	// The user is empty for bearer tokens.
+	Authenticate(user, secret string) (string, bool)
+}
+
+// StaticDoHAuth authenticates DoH clients with a fixed set of credentials.
+type StaticDoHAuth struct {
+	// Passwords of HTTP Basic users by name.
+	Users map[string]string
+
+	// Bearer tokens. Clients using them have no user name.
+	Tokens []string
+}
+
+var _ DoHAuth = StaticDoHAuth{}
+
+// Authenticate returns the user if the credentials are valid.
+func (a StaticDoHAuth) Authenticate(user, secret string) (string, bool) {
+	if user != "" {
+		password, ok := a.Users[user]
+		if !ok {
+			return "", false
+		}
+		return user, subtle.ConstantTimeCompare([]byte(password), []byte(secret)) == 1
+	}
+	for _, token := range a.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1 {
+			return "", true
+		}
+	}
+	return "", false
+}
+
+// Returns the credentials in the Authorization header of a request. Bearer
+// tokens are returned with an empty user.
+func dohCredentials(r *http.Request) (user, secret string, ok bool) {
+	if user, secret, ok = r.BasicAuth(); ok {
+		return user, secret, user != ""
+	}
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", "", false
+	}
+	token = strings.TrimSpace(token)
+	return "", token, token != ""
+}
+
+// Authenticates a request against a list of authenticators and returns the
+// user and the secret it presented. Succeeds if any of them accepts the
+// credentials.
+func authenticateDoH(auth []DoHAuth, r *http.Request) (user, secret string, ok bool) {
+	name, secret, ok := dohCredentials(r)
+	if !ok {
+		return "", "", false
+	}
+	for _, a := range auth {
+		if user, ok := a.Authenticate(name, secret); ok {
+			return user, secret, true
+		}
+	}
+	return "", "", false
+}
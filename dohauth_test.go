@@ -0,0 +1,71 @@
+package rdns
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticDoHAuth(t *testing.T) {
+	auth := StaticDoHAuth{
+		Users:  map[string]string{"alice": "secret"},
+		Tokens: []string{"token1"},
+	}
+	user, ok := auth.Authenticate("alice", "secret")
+	require.True(t, ok)
+	require.Equal(t, "alice", user)
+
+	_, ok = auth.Authenticate("alice", "wrong")
+	require.False(t, ok)
+	_, ok = auth.Authenticate("bob", "secret")
+	require.False(t, ok)
+
+	user, ok = auth.Authenticate("", "token1")
+	require.True(t, ok)
+	require.Equal(t, "", user)
+	_, ok = auth.Authenticate("", "secret")
+	require.False(t, ok)
+}
+
+func TestDoHListenerAuth(t *testing.T) {
+	upstream := new(TestResolver)
+	auth := StaticDoHAuth{
+		Users:  map[string]string{"alice": "secret"},
+		Tokens: []string{"token1"},
+	}
+	s, err := NewDoHListener("test-doh-auth", "", DoHListenerOptions{Auth: []DoHAuth{auth}}, upstream)
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	b, err := q.Pack()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		setAuth  func(r *http.Request)
+		expected int
+	}{
+		{"no credentials", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"wrong password", func(r *http.Request) { r.SetBasicAuth("alice", "wrong") }, http.StatusUnauthorized},
+		{"wrong token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer token2") }, http.StatusUnauthorized},
+		{"basic", func(r *http.Request) { r.SetBasicAuth("alice", "secret") }, http.StatusOK},
+		{"bearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer token1") }, http.StatusOK},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/dns-query", bytes.NewReader(b))
+		r.RemoteAddr = "192.0.2.1:1234"
+		test.setAuth(r)
+		w := httptest.NewRecorder()
+		s.dohHandler(w, r)
+		require.Equal(t, test.expected, w.Code, test.name)
+		if test.expected == http.StatusUnauthorized {
+			require.NotEmpty(t, w.Header().Values("WWW-Authenticate"), test.name)
+		}
+	}
+	require.Equal(t, 2, upstream.HitCount())
+}
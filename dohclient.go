@@ -7,7 +7,7 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"net"
 	"net/http"
@@ -44,6 +44,14 @@ type DoHClientOptions struct {
 
 	QueryTimeout time.Duration
 
+	// Padding of queries as per rfc8467. By default, queries are padded in
+	// blocks of 128 bytes.
+	Padding PaddingPolicy
+
+	// Open a connection right away and keep it open by sending a query at
+	// this interval. 0 means connections are opened on demand.
+	KeepAlive time.Duration
+
 	// Optional dialer, e.g. proxy
 	Dialer Dialer
 	Lego   *mylego.CertConfig
@@ -57,6 +65,10 @@ type DoHClient struct {
 	client   *http.Client
 	opt      DoHClientOptions
 	metrics  *ListenerMetrics
+
+	// HTTP clients for queries sent through a proxy selected by a route or
+	// provided by a panel
+	proxied *proxiedCache[*http.Client]
 }
 
 var _ Resolver = &DoHClient{}
@@ -79,6 +91,7 @@ func (s *DoHClient) CertMonitor() error {
 			log.Print(err)
 		}
 		s.opt.TLSConfig = tlsConfig
+		s.opt.KeepAlive = 0 // the existing client keeps the connection open already
 		nResolver, err := NewDoHClient(s.id, s.endpoint, s.opt)
 		if err != nil {
 			log.Print(err)
@@ -122,47 +135,70 @@ func NewDoHClient(id, endpoint string, opt DoHClientOptions) (*DoHClient, error)
 		opt.QueryTimeout = defaultQueryTimeout
 	}
 
-	return &DoHClient{
+	d := &DoHClient{
 		id:       id,
 		endpoint: endpoint,
 		template: template,
 		client:   client,
 		opt:      opt,
 		metrics:  NewListenerMetrics("client", id),
-	}, nil
+		proxied:  newProxiedCache(func(c *http.Client) { c.CloseIdleConnections() }),
+	}
+	if opt.KeepAlive > 0 {
+		go keepAliveUpstream(id, opt.KeepAlive, d)
+	}
+	return d, nil
 }
 
 // Resolve a DNS query.
-func (d *DoHClient) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dialer) (*dns.Msg, error) {
-	// Packing a message is not always a read-only operation, make a copy
-	q = q.Copy()
-
+func (d *DoHClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	logger(d.id, q, ci).WithFields(logrus.Fields{
 		"resolver": d.endpoint,
 		"protocol": "doh",
 		"method":   d.opt.Method,
 	}).Debug("querying upstream resolver")
 
-	// Add padding before sending the query over HTTPS
-	padQuery(q)
+	// Add padding before sending the query over HTTPS. Packing a message with
+	// an OPT record isn't a read-only operation, so copy those first. Queries
+	// without one can be packed as they are.
+	if q.IsEdns0() != nil {
+		q = q.Copy()
+		d.opt.Padding.applyQuery(q)
+	}
 
 	d.metrics.query.Add(1)
+	client := d.client
+	if ci.Dialer != nil && d.opt.Transport != "quic" {
+		var err error
+		client, err = d.proxiedClient(ci.Dialer)
+		if err != nil {
+			d.metrics.err.Add("proxy", 1)
+			return nil, err
+		}
+	}
 	switch d.opt.Method {
 	case "POST":
-		if PanelSocksDialer != nil {
-			tr, err := dohTcpPanelTransport(d.opt, PanelSocksDialer)
-			if err == nil {
-				d.client.Transport = tr
-			}
-		}
-		return d.ResolvePOST(q)
+		return d.resolvePOST(client, q, ci)
 	case "GET":
-		return d.ResolveGET(q)
+		return d.resolveGET(client, q, ci)
 	}
 	return nil, errors.New("unsupported method")
 }
 
-func dohTcpPanelTransport(opt DoHClientOptions, PanelSocksDialer *Socks5Dialer) (http.RoundTripper, error) {
+// Returns the HTTP client for queries sent through a SOCKS5 proxy. Clients are
+// kept per proxy so connections to it are reused across queries. Proxies
+// aren't supported with QUIC transport.
+func (d *DoHClient) proxiedClient(dialer *Socks5Dialer) (*http.Client, error) {
+	return d.proxied.get(dialer, func() (*http.Client, error) {
+		tr, err := dohTcpPanelTransport(d.opt, dialer)
+		if err != nil {
+			return nil, err
+		}
+		return &http.Client{Transport: tr}, nil
+	})
+}
+
+func dohTcpPanelTransport(opt DoHClientOptions, dialer *Socks5Dialer) (http.RoundTripper, error) {
 	tr := &http.Transport{
 		Proxy:                 http.ProxyFromEnvironment,
 		TLSClientConfig:       opt.TLSConfig,
@@ -179,7 +215,7 @@ func dohTcpPanelTransport(opt DoHClientOptions, PanelSocksDialer *Socks5Dialer)
 	}
 
 	// Use a custom dialer if a bootstrap address or local address was provided
-	if opt.BootstrapAddr != "" || opt.LocalAddr != nil || opt.Dialer != nil {
+	if opt.BootstrapAddr != "" || opt.LocalAddr != nil || dialer != nil {
 		d := net.Dialer{LocalAddr: &net.TCPAddr{IP: opt.LocalAddr}}
 		tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
 			if opt.BootstrapAddr != "" {
@@ -190,8 +226,8 @@ func dohTcpPanelTransport(opt DoHClientOptions, PanelSocksDialer *Socks5Dialer)
 				addr = net.JoinHostPort(opt.BootstrapAddr, port)
 			}
 
-			if PanelSocksDialer != nil {
-				return PanelSocksDialer.Dial(network, addr)
+			if dialer != nil {
+				return dialer.Dial(network, addr)
 			}
 
 			return d.DialContext(ctx, network, addr)
@@ -202,6 +238,10 @@ func dohTcpPanelTransport(opt DoHClientOptions, PanelSocksDialer *Socks5Dialer)
 
 // ResolvePOST resolves a DNS query via DNS-over-HTTP using the POST method.
 func (d *DoHClient) ResolvePOST(q *dns.Msg) (*dns.Msg, error) {
+	return d.resolvePOST(d.client, q, ClientInfo{})
+}
+
+func (d *DoHClient) resolvePOST(client *http.Client, q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	// Pack the DNS query into wire format
 	b, err := q.Pack()
 	if err != nil {
@@ -215,7 +255,7 @@ func (d *DoHClient) ResolvePOST(q *dns.Msg) (*dns.Msg, error) {
 		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), d.opt.QueryTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), ci.timeout(d.opt.QueryTimeout))
 	defer cancel()
 
 	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(b))
@@ -225,7 +265,7 @@ func (d *DoHClient) ResolvePOST(q *dns.Msg) (*dns.Msg, error) {
 	}
 	req.Header.Add("accept", "application/dns-message")
 	req.Header.Add("content-type", "application/dns-message")
-	resp, err := d.client.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		d.metrics.err.Add("post", 1)
 		return nil, err
@@ -236,6 +276,10 @@ func (d *DoHClient) ResolvePOST(q *dns.Msg) (*dns.Msg, error) {
 
 // ResolveGET resolves a DNS query via DNS-over-HTTP using the GET method.
 func (d *DoHClient) ResolveGET(q *dns.Msg) (*dns.Msg, error) {
+	return d.resolveGET(d.client, q, ClientInfo{})
+}
+
+func (d *DoHClient) resolveGET(client *http.Client, q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	// Pack the DNS query into wire format
 	b, err := q.Pack()
 	if err != nil {
@@ -252,7 +296,7 @@ func (d *DoHClient) ResolveGET(q *dns.Msg) (*dns.Msg, error) {
 		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), d.opt.QueryTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), ci.timeout(d.opt.QueryTimeout))
 	defer cancel()
 
 	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
@@ -261,7 +305,7 @@ func (d *DoHClient) ResolveGET(q *dns.Msg) (*dns.Msg, error) {
 		return nil, err
 	}
 	req.Header.Add("accept", "application/dns-message")
-	resp, err := d.client.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		d.metrics.err.Add("get", 1)
 		return nil, err
@@ -270,6 +314,16 @@ func (d *DoHClient) ResolveGET(q *dns.Msg) (*dns.Msg, error) {
 	return d.responseFromHTTP(resp)
 }
 
+// Close closes the connections of the client.
+func (d *DoHClient) Close() error {
+	d.client.CloseIdleConnections()
+	d.proxied.Close()
+	if c, ok := d.client.Transport.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
 func (d *DoHClient) String() string {
 	return d.id
 }
@@ -280,7 +334,9 @@ func (d *DoHClient) responseFromHTTP(resp *http.Response) (*dns.Msg, error) {
 		d.metrics.err.Add(fmt.Sprintf("http%d", resp.StatusCode), 1)
 		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
 	}
-	rb, err := ioutil.ReadAll(resp.Body)
+	buf := getBuffer()
+	defer putBuffer(buf)
+	rb, err := readAllBuffer(resp.Body, buf, dns.MaxMsgSize)
 	if err != nil {
 		d.metrics.err.Add("read", 1)
 		return nil, err
@@ -387,6 +443,7 @@ type quicConnection struct {
 	config    *quic.Config
 	mu        sync.Mutex
 	udpConn   *net.UDPConn
+	closed    bool
 }
 
 func newQuicConnection(hostname, rAddr string, lAddr net.IP, tlsConfig *tls.Config, config *quic.Config) (quic.EarlyConnection, error) {
@@ -4,13 +4,14 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"expvar"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/XrayR-project/XrayR/common/mylego"
@@ -18,6 +19,7 @@ import (
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
 )
 
 // Read/Write timeout in the DoH server
@@ -27,6 +29,7 @@ const dohServerTimeout = 10 * time.Second
 type DoHListener struct {
 	httpServer *http.Server
 	quicServer *http3.Server
+	quicLn     *quicListener
 
 	id   string
 	addr string
@@ -34,10 +37,22 @@ type DoHListener struct {
 	opt  DoHListenerOptions
 	Lego *mylego.CertConfig
 	MutualTLS bool
+
+	// Certificates served by the listener, reloaded by CertMonitor
+	Certificates *TLSCertificates
 	
 
 	handler http.Handler
 
+	// Networks of reverse proxies trusted to provide the client address
+	trusted []*net.IPNet
+
+	// Accepted HTTP methods
+	methods []string
+
+	// Checks the query rate limits
+	allowQuery func() bool
+
 	metrics *DoHListenerMetrics
 }
 
@@ -52,11 +67,36 @@ type DoHListenerOptions struct {
 
 	TLSConfig *tls.Config
 
-	// IP(v4/v6) subnet of known reverse proxies in front of this server.
+	// IP(v4/v6) subnet of known reverse proxies in front of this server. Used
+	// together with the TrustedProxies in ListenOptions.
 	HTTPProxyNet *net.IPNet
 
 	// Disable TLS on the server (insecure, for testing purposes only).
 	NoTLS bool
+
+	// Require clients to authenticate with HTTP Basic credentials or a bearer
+	// token accepted by any of these. Unauthenticated queries are rejected with
+	// 401. No authentication if empty.
+	Auth []DoHAuth
+
+	// Maximum size of the body of POST requests. Larger requests are rejected
+	// with 413. Defaults to 65535, the maximum size of a DNS message.
+	MaxBodySize int
+
+	// Maximum size of the request headers. Defaults to 1MB.
+	MaxHeaderSize int
+
+	// HTTP methods accepted from clients, GET and/or POST. Requests with other
+	// methods are rejected with 405. Defaults to both.
+	Methods []string
+
+	// Maximum number of concurrent HTTP/2 streams or HTTP/3 requests on a
+	// single connection. Default 0 uses 250 for HTTP/2 and 100 for HTTP/3.
+	MaxConcurrentStreams int
+
+	// Maximum number of requests per second on a single connection. Requests
+	// beyond the limit are rejected with 429. Default 0 means no limit.
+	MaxConnectionRate int
 }
 
 type DoHListenerMetrics struct {
@@ -65,53 +105,31 @@ type DoHListenerMetrics struct {
 	// HTTP method used for query.
 	get  *expvar.Int
 	post *expvar.Int
+
+	// Clients identified by proxy headers, and clients connecting directly.
+	proxied *expvar.Int
+	direct  *expvar.Int
 }
 
 func NewDoHListenerMetrics(id string) *DoHListenerMetrics {
-	return &DoHListenerMetrics{
+	m := &DoHListenerMetrics{
 		ListenerMetrics: ListenerMetrics{
 			query:    getVarInt("listener", id, "query"),
 			response: getVarMap("listener", id, "response"),
 			err:      getVarMap("listener", id, "error"),
 			drop:     getVarInt("listener", id, "drop"),
 		},
-		get:  getVarInt("listener", id, "get"),
-		post: getVarInt("listener", id, "post"),
+		get:     getVarInt("listener", id, "get"),
+		post:    getVarInt("listener", id, "post"),
+		proxied: getVarInt("listener", id, "proxied"),
+		direct:  getVarInt("listener", id, "direct"),
 	}
+	m.withConnections(id)
+	return m
 }
 
 func (s *DoHListener) CertMonitor() error {
-	switch s.Lego.CertMode {
-	case "dns", "http", "tls":
-		lego, err := mylego.New(s.Lego)
-		if err != nil {
-			log.Print(err)
-		}
-		// Xray-core supports the OcspStapling certification hot renew
-		_, _, _, _, err = lego.RenewCert()
-		if err != nil {
-			log.Print(err)
-		}
-		cert, key, ca, err := GetCertFile(s.Lego)
-		if err != nil {
-			fmt.Print(err)
-		}
-	
-		tlsConfig, err := TLSServerConfig(ca, cert, key, s.MutualTLS)
-		if err != nil {
-			return err
-		}		
-		s.opt.TLSConfig = tlsConfig
-		err = s.Stop()
-		if err != nil {
-			fmt.Printf("failed to stop DTLS listener %s, err: %s", s.id,err)
-		}
-		err = s.Start()
-		if err != nil {
-			fmt.Printf("failed to start DTLS listener %s, err: %s", s.id,err)
-		}
-	}
-	return nil
+	return renewCertificates(s.Lego, s.Certificates)
 }
 
 // NewDoHListener returns an instance of a DNS-over-HTTPS listener.
@@ -125,12 +143,37 @@ func NewDoHListener(id, addr string, opt DoHListenerOptions, resolver Resolver)
 		return nil, fmt.Errorf("unknown protocol: '%s'", opt.Transport)
 	}
 
+	if opt.MaxBodySize == 0 {
+		opt.MaxBodySize = dns.MaxMsgSize
+	}
+	if opt.MaxBodySize < 0 || opt.MaxBodySize > dns.MaxMsgSize {
+		return nil, fmt.Errorf("invalid max body size %d, must be at most %d", opt.MaxBodySize, dns.MaxMsgSize)
+	}
+	methods := []string{http.MethodGet, http.MethodPost}
+	if len(opt.Methods) > 0 {
+		methods = nil
+		for _, m := range opt.Methods {
+			m = strings.ToUpper(m)
+			if m != http.MethodGet && m != http.MethodPost {
+				return nil, fmt.Errorf("unsupported http method '%s'", m)
+			}
+			methods = append(methods, m)
+		}
+	}
+
 	l := &DoHListener{
 		id:      id,
 		addr:    addr,
 		r:       resolver,
 		opt:     opt,
 		metrics: NewDoHListenerMetrics(id),
+		trusted: opt.TrustedProxies,
+		methods: methods,
+
+		allowQuery: queryLimit(opt.ListenOptions),
+	}
+	if opt.HTTPProxyNet != nil {
+		l.trusted = append([]*net.IPNet{opt.HTTPProxyNet}, opt.TrustedProxies...)
 	}
 	l.handler = http.HandlerFunc(l.dohHandler)
 	return l, nil
@@ -148,40 +191,103 @@ func (s *DoHListener) Start() error {
 // Start the DoH server with TCP transport.
 func (s *DoHListener) startTCP() error {
 	s.httpServer = &http.Server{
-		Addr:         s.addr,
-		TLSConfig:    s.opt.TLSConfig,
-		Handler:      s.handler,
-		ReadTimeout:  dohServerTimeout,
-		WriteTimeout: dohServerTimeout,
+		Addr:           s.addr,
+		TLSConfig:      s.opt.TLSConfig,
+		Handler:        s.handler,
+		ReadTimeout:    dohServerTimeout,
+		WriteTimeout:   dohServerTimeout,
+		MaxHeaderBytes: s.opt.MaxHeaderSize,
+		ErrorLog:       httpErrorLog(s.id, &s.metrics.ListenerMetrics),
+	}
+	if s.opt.MaxConnectionRate > 0 {
+		s.httpServer.ConnContext = func(ctx context.Context, _ net.Conn) context.Context {
+			return withConnRateLimit(ctx, s.opt.MaxConnectionRate)
+		}
+	}
+	if s.opt.MaxConcurrentStreams > 0 && !s.opt.NoTLS {
+		if err := http2.ConfigureServer(s.httpServer, &http2.Server{
+			MaxConcurrentStreams: uint32(s.opt.MaxConcurrentStreams),
+		}); err != nil {
+			return err
+		}
 	}
 
-	ln, err := net.Listen("tcp", s.addr)
+	if s.opt.NoTLS {
+		ln, err := listenStream("tcp", s.addr, socketOptions{})
+		if err != nil {
+			return err
+		}
+		defer ln.Close()
+		return s.httpServer.Serve(meterConnections(ln, &s.metrics.ListenerMetrics))
+	}
+
+	var (
+		ln  net.Listener
+		err error
+	)
+	if s.opt.SharePort {
+		// Share the socket with a DoT listener on the same address,
+		// connections are told apart by ALPN
+		alpn := []string{"h2", "http/1.1"}
+		if s.opt.TLSConfig != nil && len(s.opt.TLSConfig.NextProtos) > 0 {
+			alpn = s.opt.TLSConfig.NextProtos
+		}
+		ln, err = listenTLS("tcp", s.addr, socketOptions{alpn: alpn})
+	} else {
+		ln, err = listenStream("tcp", s.addr, socketOptions{})
+	}
 	if err != nil {
 		return err
 	}
 	defer ln.Close()
-	if s.opt.NoTLS {
-		return s.httpServer.Serve(ln)
-	}
-	return s.httpServer.ServeTLS(ln, "", "")
+	return s.httpServer.ServeTLS(meterConnections(ln, &s.metrics.ListenerMetrics), "", "")
 }
 
 // Start the DoH server with QUIC transport.
 func (s *DoHListener) startQUIC() error {
 	s.quicServer = &http3.Server{
-		Addr:       s.addr,
-		TLSConfig:  s.opt.TLSConfig,
-		Handler:    s.handler,
-		QuicConfig: &quic.Config{},
+		Addr:           s.addr,
+		TLSConfig:      s.opt.TLSConfig,
+		Handler:        s.handler,
+		MaxHeaderBytes: s.opt.MaxHeaderSize,
+	}
+	if s.opt.MaxConnectionRate > 0 {
+		s.quicServer.ConnContext = func(ctx context.Context, _ quic.Connection) context.Context {
+			return withConnRateLimit(ctx, s.opt.MaxConnectionRate)
+		}
+	}
+
+	// Listen on a socket that can be shared with a DoQ listener on the same
+	// address, HTTP/3 connections are told apart by ALPN
+	tlsConfig := s.opt.TLSConfig.Clone()
+	tlsConfig.NextProtos = []string{http3.NextProtoH3}
+	ln, err := listenQUIC(s.addr, tlsConfig, quicListenOptions{
+		maxStreams: int64(s.opt.MaxConcurrentStreams),
+	})
+	if err != nil {
+		return err
+	}
+	s.quicLn = ln
+	for {
+		conn, err := ln.Accept(context.Background())
+		if errors.Is(err, quic.ErrServerClosed) {
+			return http.ErrServerClosed
+		}
+		if err != nil {
+			return err
+		}
+		go func() { _ = s.quicServer.ServeQUICConn(conn) }()
 	}
-	return s.quicServer.ListenAndServe()
 }
 
 // Stop the server.
 func (s *DoHListener) Stop() error {
 	Log.WithFields(logrus.Fields{"id": s.id, "protocol": "doh", "addr": s.addr}).Info("stopping listener")
 	if s.opt.Transport == "quic" {
-		return s.quicServer.Close()
+		if s.quicLn == nil {
+			return nil
+		}
+		return s.quicLn.Close()
 	}
 	return s.httpServer.Shutdown(context.Background())
 }
@@ -195,6 +301,19 @@ func (s *DoHListener) String() string {
 }
 
 func (s *DoHListener) dohHandler(w http.ResponseWriter, r *http.Request) {
+	s.metrics.activeStreams.Add(1)
+	defer s.metrics.activeStreams.Add(-1)
+	if !slices.Contains(s.methods, r.Method) {
+		s.metrics.err.Add("httpmethod", 1)
+		w.Header().Set("Allow", strings.Join(s.methods, ", "))
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !connRateAllow(r.Context()) {
+		s.metrics.err.Add("ratelimit", 1)
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
 	switch r.Method {
 	case "GET":
 		s.metrics.get.Add(1)
@@ -202,13 +321,17 @@ func (s *DoHListener) dohHandler(w http.ResponseWriter, r *http.Request) {
 	case "POST":
 		s.metrics.post.Add(1)
 		s.postHandler(w, r)
-	default:
-		s.metrics.err.Add("httpmethod", 1)
-		http.Error(w, "only GET and POST allowed", http.StatusMethodNotAllowed)
 	}
 }
 
 func (s *DoHListener) getHandler(w http.ResponseWriter, r *http.Request) {
+	// GET requests have no body, a client sending one is either broken or
+	// trying to smuggle a request past a proxy
+	if r.ContentLength > 0 || len(r.TransferEncoding) > 0 {
+		s.metrics.err.Add("body", 1)
+		http.Error(w, "unexpected request body", http.StatusBadRequest)
+		return
+	}
 	b64, ok := r.URL.Query()["dns"]
 	if !ok {
 		http.Error(w, "no dns query parameter found", http.StatusBadRequest)
@@ -227,8 +350,22 @@ func (s *DoHListener) getHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *DoHListener) postHandler(w http.ResponseWriter, r *http.Request) {
-	b, err := ioutil.ReadAll(r.Body)
+	if r.ContentLength > int64(s.opt.MaxBodySize) {
+		s.metrics.err.Add("body", 1)
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	body := http.MaxBytesReader(w, r.Body, int64(s.opt.MaxBodySize))
+	b, err := readAllBuffer(body, buf, s.opt.MaxBodySize+1)
 	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			s.metrics.err.Add("body", 1)
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -236,40 +373,89 @@ func (s *DoHListener) postHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // Extract the client address from the HTTP headers, accounting for known
-// reverse proxies.
+// reverse proxies. The Forwarded header (RFC 7239) is preferred over
+// X-Forwarded-For. Both can list several hops, the client is the last one
+// that isn't a trusted proxy since anything before it could have been
+// provided by the client itself.
 func (s *DoHListener) extractClientAddress(r *http.Request) net.IP {
 	client, _, _ := net.SplitHostPort(r.RemoteAddr)
 	clientIP := net.ParseIP(client)
 
-	// TODO: Prefer RFC 7239 Forwarded once https://github.com/golang/go/issues/30963
-	//       is resolved and provides a safe parser.
-	xForwardedFor := r.Header.Get("X-Forwarded-For")
-
-	// Simple case: No proxy (or empty/long X-Forwarded-For).
-	if s.opt.HTTPProxyNet == nil || xForwardedFor == "" || len(xForwardedFor) >= 1024 {
+	// Simple case: No proxy, or the request doesn't come from one.
+	if clientIP == nil || !isTrustedProxy(s.trusted, clientIP) {
+		s.metrics.direct.Add(1)
 		return clientIP
 	}
 
-	// If our client is a reverse proxy then use the last entry in X-Forwarded-For.
-	chain := strings.Split(xForwardedFor, ", ")
-	if clientIP != nil && s.opt.HTTPProxyNet.Contains(clientIP) {
-		if ip := net.ParseIP(chain[len(chain)-1]); ip != nil {
-			// Ignore XFF whe the client is local to the proxy.
-			if !ip.IsLoopback() {
-				return ip
-			}
+	hops, ok := forwardedFor(r.Header.Values("Forwarded"))
+	if !ok {
+		xForwardedFor := strings.Join(r.Header.Values("X-Forwarded-For"), ",")
+		if xForwardedFor == "" || len(xForwardedFor) >= 1024 {
+			s.metrics.direct.Add(1)
+			return clientIP
 		}
+		hops = strings.Split(xForwardedFor, ",")
+	}
+	ip := lastUntrustedHop(hops, s.trusted)
+
+	// Ignore the headers if they're invalid or the client is local to the proxy.
+	if ip == nil || ip.IsLoopback() {
+		s.metrics.direct.Add(1)
+		return clientIP
 	}
+	s.metrics.proxied.Add(1)
+	return ip
+}
 
-	// TODO: Decide whether to go deeper into the XFF chain (eg. two reverse proxies).
-	//       We have to be careful if we do, because then we're trusting an XFF that
-	//       may have been provided externally.
+// Returns the "for" parameters of RFC 7239 Forwarded headers, one per hop.
+// Returns false if there's no usable header. Addresses that can't be used
+// as client IP, like "unknown" or obfuscated identifiers, are returned as
+// they are and fail to parse later.
+func forwardedFor(headers []string) ([]string, bool) {
+	value := strings.Join(headers, ",")
+	if value == "" || len(value) >= 1024 {
+		return nil, false
+	}
+	var hops []string
+	for _, element := range strings.Split(value, ",") {
+		for _, pair := range strings.Split(element, ";") {
+			k, v, found := strings.Cut(strings.TrimSpace(pair), "=")
+			if !found || !strings.EqualFold(k, "for") {
+				continue
+			}
+			v = strings.Trim(v, `"`)
 
-	return clientIP
+			// Strip the port, IPv6 addresses are in brackets with or without port
+			if host, _, err := net.SplitHostPort(v); err == nil {
+				v = host
+			}
+			v = strings.TrimSuffix(strings.TrimPrefix(v, "["), "]")
+			hops = append(hops, v)
+		}
+	}
+	return hops, len(hops) > 0
 }
 
 func (s *DoHListener) parseAndRespond(b []byte, w http.ResponseWriter, r *http.Request) {
 	s.metrics.query.Add(1)
+	// Connections over TCP are metered by the listener, count only the DNS
+	// messages over QUIC
+	quicTransport := s.opt.Transport == "quic"
+	if quicTransport {
+		s.metrics.bytesIn.Add(int64(len(b)))
+	}
+	var user, secret string
+	if len(s.opt.Auth) > 0 {
+		var ok bool
+		user, secret, ok = authenticateDoH(s.opt.Auth, r)
+		if !ok {
+			s.metrics.err.Add("auth", 1)
+			w.Header().Add("WWW-Authenticate", `Basic realm="dns", charset="UTF-8"`)
+			w.Header().Add("WWW-Authenticate", `Bearer realm="dns"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
 	q := new(dns.Msg)
 	if err := q.Unpack(b); err != nil {
 		s.metrics.err.Add("unpack", 1)
@@ -292,7 +478,12 @@ func (s *DoHListener) parseAndRespond(b []byte, w http.ResponseWriter, r *http.R
 		DoHPath:       r.URL.Path,
 		TLSServerName: tlsServerName,
 		Listener:      s.id,
+		User:          user,
+		AuthSecret:    secret,
 	}
+	ci.setTLSClientIdentity(r.TLS)
+	ci.EDNS0 = captureEDNS0(q, s.opt.CaptureEDNS0)
+	ci.MAC = s.opt.MACTable.Lookup(ci.SourceIP)
 	log := Log.WithFields(logrus.Fields{
 		"id":       s.id,
 		"client":   ci.SourceIP,
@@ -306,17 +497,21 @@ func (s *DoHListener) parseAndRespond(b []byte, w http.ResponseWriter, r *http.R
 
 	var err error
 	a := new(dns.Msg)
-	if isAllowed(s.opt.AllowedNet, ci.SourceIP) {
+	if !isAllowed(s.opt.AllowedNet, ci.SourceIP) {
+		log.Debug("refusing client ip")
+		a.SetRcode(q, dns.RcodeRefused)
+	} else if !s.allowQuery() {
+		s.metrics.err.Add("qps", 1)
+		log.Debug("query rate limit exceeded")
+		a.SetRcode(q, dns.RcodeRefused)
+	} else {
 		log.WithField("resolver", s.r.String()).Debug("forwarding query to resolver")
-		a, err = s.r.Resolve(q, ci, nil)
+		a, err = resolveIncoming(s.r, q, ci.WithTimeout(s.opt.QueryTimeout))
 		if err != nil {
 			log.WithError(err).Error("failed to resolve")
 			a = new(dns.Msg)
 			a.SetRcode(q, dns.RcodeServerFailure)
 		}
-	} else {
-		log.Debug("refusing client ip")
-		a.SetRcode(q, dns.RcodeRefused)
 	}
 
 	// A nil response from the resolvers means "drop", return blank response
@@ -327,15 +522,53 @@ func (s *DoHListener) parseAndRespond(b []byte, w http.ResponseWriter, r *http.R
 	}
 
 	// Pad the packet according to rfc8467 and rfc7830
-	padAnswer(q, a)
+	s.opt.Padding.apply("doh", q, a)
 
 	s.metrics.response.Add(rCode(a), 1)
-	out, err := a.Pack()
+	buf := getBuffer()
+	defer putBuffer(buf)
+	out, err := packBuffer(a, buf, false)
 	if err != nil {
 		s.metrics.err.Add("pack", 1)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("content-type", "application/dns-message")
-	_, _ = w.Write(out)
+	n, _ := w.Write(out)
+	if quicTransport {
+		s.metrics.bytesOut.Add(int64(n))
+	}
+}
+
+type connRateKey struct{}
+
+// connRateLimit counts the requests on a connection in the current second.
+type connRateLimit struct {
+	limit int
+
+	mu     sync.Mutex
+	second int64
+	count  int
+}
+
+// Returns a connection context that limits the number of requests per second.
+func withConnRateLimit(ctx context.Context, limit int) context.Context {
+	return context.WithValue(ctx, connRateKey{}, &connRateLimit{limit: limit})
+}
+
+// Returns false if the connection of a request has exceeded its rate limit.
+func connRateAllow(ctx context.Context) bool {
+	l, ok := ctx.Value(connRateKey{}).(*connRateLimit)
+	if !ok {
+		return true
+	}
+	now := time.Now().Unix()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now != l.second {
+		l.second = now
+		l.count = 0
+	}
+	l.count++
+	return l.count <= l.limit
 }
@@ -1,8 +1,12 @@
 package rdns
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -37,7 +41,7 @@ func TestDoHListenerSimple(t *testing.T) {
 	// Send a query to the client. This should be proxied through the listener and hit the test resolver.
 	q := new(dns.Msg)
 	q.SetQuestion("cloudflare.com.", dns.TypeA)
-	_, err = cPost.Resolve(q, ClientInfo{}, nil)
+	_, err = cPost.Resolve(q, ClientInfo{})
 	require.NoError(t, err)
 
 	// The upstream resolver should have seen the query
@@ -49,7 +53,7 @@ func TestDoHListenerSimple(t *testing.T) {
 	require.NoError(t, err)
 
 	// Send a query to the client. This should be proxied through the listener and hit the test resolver.
-	_, err = cGet.Resolve(q, ClientInfo{}, nil)
+	_, err = cGet.Resolve(q, ClientInfo{})
 	require.NoError(t, err)
 
 	// The upstream resolver should have seen the query
@@ -91,7 +95,7 @@ func TestDoHListenerMutual(t *testing.T) {
 	// Send a query to the client. This should be proxied through the listener and hit the test resolver.
 	q := new(dns.Msg)
 	q.SetQuestion("cloudflare.com.", dns.TypeA)
-	_, err = c.Resolve(q, ClientInfo{}, nil)
+	_, err = c.Resolve(q, ClientInfo{})
 	require.NoError(t, err)
 
 	// The upstream resolver should have seen the query
@@ -125,7 +129,7 @@ func TestDoHListenerMutualQUIC(t *testing.T) {
 	// Send a query to the client. This should be proxied through the listener and hit the test resolver.
 	q := new(dns.Msg)
 	q.SetQuestion("cloudflare.com.", dns.TypeA)
-	_, err = c.Resolve(q, ClientInfo{}, nil)
+	_, err = c.Resolve(q, ClientInfo{})
 	require.NoError(t, err)
 
 	// The upstream resolver should have seen the query
@@ -256,3 +260,131 @@ func TestIPv6Proxy(t *testing.T) {
 	client = s.extractClientAddress(r)
 	require.Equal(t, net.IPv4(10, 0, 1, 5), client)
 }
+
+func TestDoHListenerForwardedChain(t *testing.T) {
+	upstream := new(TestResolver)
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+
+	_, cdn, _ := net.ParseCIDR("10.0.0.0/24")
+	_, lb, _ := net.ParseCIDR("10.0.1.0/24")
+	opt := DoHListenerOptions{
+		TLSConfig:     tlsServerConfig,
+		HTTPProxyNet:  lb,
+		ListenOptions: ListenOptions{TrustedProxies: []*net.IPNet{cdn}},
+	}
+	s, err := NewDoHListener("test-doh-chain", addr, opt, upstream)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		headers  map[string][]string
+		expected string
+	}{
+		{
+			name:     "multi-hop X-Forwarded-For",
+			headers:  map[string][]string{"X-Forwarded-For": {"203.0.113.1, 192.168.1.2, 10.0.0.5"}},
+			expected: "192.168.1.2",
+		},
+		{
+			name:     "X-Forwarded-For in several headers",
+			headers:  map[string][]string{"X-Forwarded-For": {"192.168.1.2", "10.0.0.5"}},
+			expected: "192.168.1.2",
+		},
+		{
+			name:     "Forwarded header",
+			headers:  map[string][]string{"Forwarded": {`for=192.168.1.2;proto=https, for="10.0.0.5:443"`}},
+			expected: "192.168.1.2",
+		},
+		{
+			name:     "Forwarded IPv6 with port",
+			headers:  map[string][]string{"Forwarded": {`for="[2001:db8::1]:4711", for=10.0.0.5`}},
+			expected: "2001:db8::1",
+		},
+		{
+			name: "Forwarded preferred over X-Forwarded-For",
+			headers: map[string][]string{
+				"Forwarded":       {"for=192.168.1.2"},
+				"X-Forwarded-For": {"192.168.1.3"},
+			},
+			expected: "192.168.1.2",
+		},
+		{
+			name:     "Forwarded obfuscated",
+			headers:  map[string][]string{"Forwarded": {"for=_hidden"}},
+			expected: "10.0.1.1",
+		},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "https://www.example.com", nil)
+		r.RemoteAddr = "10.0.1.1:1234"
+		for k, values := range test.headers {
+			for _, v := range values {
+				r.Header.Add(k, v)
+			}
+		}
+		client := s.extractClientAddress(r)
+		require.Equal(t, test.expected, client.String(), test.name)
+	}
+	require.Equal(t, int64(5), s.metrics.proxied.Value())
+	require.Equal(t, int64(1), s.metrics.direct.Value())
+}
+
+func TestDoHListenerLimits(t *testing.T) {
+	upstream := new(TestResolver)
+	opt := DoHListenerOptions{
+		MaxBodySize:       64,
+		Methods:           []string{"post"},
+		MaxConnectionRate: 2,
+	}
+	s, err := NewDoHListener("test-doh-limits", "", opt, upstream)
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	b, err := q.Pack()
+	require.NoError(t, err)
+
+	ctx := withConnRateLimit(context.Background(), opt.MaxConnectionRate)
+	do := func(method string, body []byte) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(b), bytes.NewReader(body))
+		r.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		s.dohHandler(w, r.WithContext(ctx))
+		return w
+	}
+
+	// Only POST is allowed
+	w := do("GET", nil)
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	require.Equal(t, "POST", w.Header().Get("Allow"))
+
+	// Bodies beyond the limit are rejected
+	require.Equal(t, http.StatusRequestEntityTooLarge, do("POST", make([]byte, 65)).Code)
+
+	// The third request in the same second is over the connection rate. This
+	// could fail if the second changes between requests, rare enough to ignore.
+	require.Equal(t, http.StatusOK, do("POST", b).Code)
+	require.Equal(t, http.StatusTooManyRequests, do("POST", b).Code)
+	require.Equal(t, 1, upstream.HitCount())
+
+	// Other connections aren't affected
+	ctx = withConnRateLimit(context.Background(), opt.MaxConnectionRate)
+	require.Equal(t, http.StatusOK, do("POST", b).Code)
+	require.Equal(t, 2, upstream.HitCount())
+
+	// GET requests must not have a body
+	s, err = NewDoHListener("test-doh-limits", "", DoHListenerOptions{}, upstream)
+	require.NoError(t, err)
+	ctx = context.Background()
+	require.Equal(t, http.StatusBadRequest, do("GET", b).Code)
+	require.Equal(t, http.StatusOK, do("GET", nil).Code)
+
+	// Invalid options
+	_, err = NewDoHListener("test-doh-limits", "", DoHListenerOptions{Methods: []string{"PUT"}}, upstream)
+	require.Error(t, err)
+	_, err = NewDoHListener("test-doh-limits", "", DoHListenerOptions{MaxBodySize: 100000}, upstream)
+	require.Error(t, err)
+}
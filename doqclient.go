@@ -4,7 +4,6 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/binary"
-	"io"
 	"log"
 	"net"
 	"time"
@@ -19,7 +18,8 @@ import (
 )
 
 const (
-	DOQNoError = 0x00
+	DOQNoError       = 0x00
+	DOQExcessiveLoad = 0x04
 )
 
 // DoQClient is a DNS-over-QUIC resolver.
@@ -46,6 +46,14 @@ type DoQClientOptions struct {
 	TLSConfig *tls.Config
 
 	QueryTimeout time.Duration
+
+	// Padding of queries as per rfc8467. By default, queries are padded in
+	// blocks of 128 bytes.
+	Padding PaddingPolicy
+
+	// Open a connection right away and keep it open by sending a query at
+	// this interval. 0 means connections are opened on demand.
+	KeepAlive time.Duration
 	Lego          *M.CertConfig
 
 }
@@ -87,7 +95,7 @@ func NewDoQClient(id, endpoint string, opt DoQClientOptions) (*DoQClient, error)
 		opt.QueryTimeout = defaultQueryTimeout
 	}
 	log := Log.WithFields(logrus.Fields{"protocol": "doq", "endpoint": endpoint})
-	return &DoQClient{
+	d := &DoQClient{
 		id:               id,
 		endpoint:         endpoint,
 		DoQClientOptions: opt,
@@ -103,11 +111,15 @@ func NewDoQClient(id, endpoint string, opt DoQClientOptions) (*DoQClient, error)
 			},
 		},
 		metrics: NewListenerMetrics("client", id),
-	}, nil
+	}
+	if opt.KeepAlive > 0 {
+		go keepAliveUpstream(id, opt.KeepAlive, d)
+	}
+	return d, nil
 }
 
 // Resolve a DNS query.
-func (d *DoQClient) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dialer) (*dns.Msg, error) {
+func (d *DoQClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	logger(d.id, q, ci).WithFields(logrus.Fields{
 		"resolver": d.endpoint,
 		"protocol": "doq",
@@ -133,22 +145,23 @@ func (d *DoQClient) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5D
 			newOpt = append(newOpt, opt)
 		}
 		edns0.Option = newOpt
+
+		// Add padding to the query, it's been copied already
+		d.Padding.applyQuery(qc)
 	}
 
-	deadlineTime := time.Now().Add(d.DoQClientOptions.QueryTimeout)
+	deadlineTime := time.Now().Add(ci.timeout(d.DoQClientOptions.QueryTimeout))
 
-	// Encode the query
-	p, err := qc.Pack()
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	// Encode the query with a length prefix
+	b, err := packBuffer(qc, buf, true)
 	if err != nil {
 		d.metrics.err.Add("pack", 1)
 		return nil, err
 	}
 
-	// Add a length prefix
-	b := make([]byte, 2+len(p))
-	binary.BigEndian.PutUint16(b, uint16(len(p)))
-	copy(b[2:], p)
-
 	// Get a new stream in the connection
 	stream, err := d.connection.getStream(d.endpoint, d.log)
 	if err != nil {
@@ -177,8 +190,8 @@ func (d *DoQClient) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5D
 	}
 
 	// Read the response
-	b = make([]byte, length)
-	if _, err = io.ReadFull(stream, b); err != nil {
+	b, err = readBuffer(stream, buf, int(length))
+	if err != nil {
 		d.metrics.err.Add("read", 1)
 		return nil, err
 	}
@@ -208,9 +221,33 @@ func (d *DoQClient) String() string {
 	return d.id
 }
 
+// Close closes the connection to the upstream. Queries sent after that fail.
+func (d *DoQClient) Close() error {
+	d.connection.close()
+	return nil
+}
+
+// Closes the connection and its UDP socket, no new connection is opened after.
+func (s *quicConnection) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.EarlyConnection != nil {
+		_ = s.EarlyConnection.CloseWithError(DOQNoError, "")
+		s.EarlyConnection = nil
+	}
+	if s.udpConn != nil {
+		_ = s.udpConn.Close()
+		s.udpConn = nil
+	}
+}
+
 func (s *quicConnection) getStream(endpoint string, log *logrus.Entry) (quic.Stream, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.closed {
+		return nil, errors.New("connection closed")
+	}
 
 	// If we don't have a connection yet, make one
 	if s.EarlyConnection == nil {
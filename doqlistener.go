@@ -4,13 +4,12 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"expvar"
-	"fmt"
-	"io"
-	"log"
 	"net"
 	"net/http"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/XrayR-project/XrayR/common/mylego"
@@ -25,11 +24,22 @@ type DoQListener struct {
 	addr    string
 	r       Resolver
 	opt     DoQListenerOptions
-	ln      *quic.Listener
 	log     *logrus.Entry
 	metrics *DoQListenerMetrics
+	conns   atomic.Int64
 	Lego *mylego.CertConfig
 	MutualTLS bool
+
+	// Certificates served by the listener, reloaded by CertMonitor
+	Certificates *TLSCertificates
+
+	// Checks the query rate limits
+	allowQuery func() bool
+
+	// Protects the listener, which is set by Start and closed by Stop
+	mu      sync.Mutex
+	ln      *quicListener
+	stopped bool
 }
 
 var _ Listener = &DoQListener{}
@@ -39,6 +49,17 @@ type DoQListenerOptions struct {
 	ListenOptions
 
 	TLSConfig *tls.Config
+
+	// Validate the address of every client with a QUIC Retry packet before
+	// the handshake, at the cost of an additional round trip.
+	Retry bool
+
+	// Number of connection attempts per second from unvalidated addresses
+	// above which clients have to validate their address with a Retry packet.
+	// Protects against floods with spoofed source addresses while keeping
+	// handshakes short under normal load. Default 0 doesn't use Retry unless
+	// Retry is set.
+	RetryThreshold int
 }
 
 type DoQListenerMetrics struct {
@@ -48,10 +69,14 @@ type DoQListenerMetrics struct {
 	connection *expvar.Int
 	// Count of streams seen in all connections.
 	stream *expvar.Int
+	// Count of connection attempts that were sent a Retry packet.
+	retry *expvar.Int
+	// Count of connections closed because of the connection limit.
+	rejected *expvar.Int
 }
 
 func NewDoQListenerMetrics(id string) *DoQListenerMetrics {
-	return &DoQListenerMetrics{
+	m := &DoQListenerMetrics{
 		ListenerMetrics: ListenerMetrics{
 			query:    getVarInt("listener", id, "query"),
 			response: getVarMap("listener", id, "response"),
@@ -60,41 +85,15 @@ func NewDoQListenerMetrics(id string) *DoQListenerMetrics {
 		},
 		connection: getVarInt("listener", id, "session"),
 		stream:     getVarInt("listener", id, "stream"),
+		rejected:   getVarInt("listener", id, "connection-rejected"),
+		retry:      getVarInt("listener", id, "retry"),
 	}
+	m.withConnections(id)
+	return m
 }
 
 func (s *DoQListener) CertMonitor() error {
-	switch s.Lego.CertMode {
-	case "dns", "http", "tls":
-		lego, err := mylego.New(s.Lego)
-		if err != nil {
-			log.Print(err)
-		}
-		// Xray-core supports the OcspStapling certification hot renew
-		_, _, _, _, err = lego.RenewCert()
-		if err != nil {
-			log.Print(err)
-		}
-		cert, key, ca, err := GetCertFile(s.Lego)
-		if err != nil {
-			fmt.Print(err)
-		}
-	
-		tlsConfig, err := TLSServerConfig(ca, cert, key, s.MutualTLS)
-		if err != nil {
-			return err
-		}		
-		s.opt.TLSConfig = tlsConfig
-		err = s.Stop()
-		if err != nil {
-			fmt.Printf("failed to stop DTLS listener %s, err: %s", s.id,err)
-		}
-		err = s.Start()
-		if err != nil {
-			fmt.Printf("failed to start DTLS listener %s, err: %s", s.id,err)
-		}
-	}
-	return nil
+	return renewCertificates(s.Lego, s.Certificates)
 }
 
 // NewQuicListener returns an instance of a QUIC listener.
@@ -102,7 +101,9 @@ func NewQUICListener(id, addr string, opt DoQListenerOptions, resolver Resolver)
 	if opt.TLSConfig == nil {
 		opt.TLSConfig = new(tls.Config)
 	}
-	opt.TLSConfig.NextProtos = []string{"doq"}
+	if len(opt.TLSConfig.NextProtos) == 0 {
+		opt.TLSConfig.NextProtos = []string{"doq"}
+	}
 	l := &DoQListener{
 		id:      id,
 		addr:    addr,
@@ -110,82 +111,115 @@ func NewQUICListener(id, addr string, opt DoQListenerOptions, resolver Resolver)
 		opt:     opt,
 		log:     Log.WithFields(logrus.Fields{"id": id, "protocol": "doq", "addr": addr}),
 		metrics: NewDoQListenerMetrics(id),
+
+		allowQuery: queryLimit(opt.ListenOptions),
 	}
 	return l
 }
 
 // Start the QUIC server.
-func (s DoQListener) Start() error {
-	var err error
-	s.ln, err = quic.ListenAddr(s.addr, s.opt.TLSConfig, &quic.Config{})
+func (s *DoQListener) Start() error {
+	ln, err := listenQUIC(s.addr, s.opt.TLSConfig, quicListenOptions{
+		verifySourceAddress: s.verifySourceAddress(),
+	})
 	if err != nil {
 		return err
 	}
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return ln.Close()
+	}
+	s.ln = ln
+	s.mu.Unlock()
 	s.log.Info("starting listener")
 
 	for {
-		connection, err := s.ln.Accept(context.Background())
+		connection, err := ln.Accept(context.Background())
+		if errors.Is(err, quic.ErrServerClosed) {
+			return nil
+		}
 		if err != nil {
 			s.log.WithError(err).Warn("failed to accept")
 			continue
 		}
+		if s.opt.MaxConnections > 0 && s.conns.Add(1) > int64(s.opt.MaxConnections) {
+			s.conns.Add(-1)
+			s.log.WithField("client", connection.RemoteAddr()).Debug("too many connections, closing connection")
+			s.metrics.rejected.Add(1)
+			_ = connection.CloseWithError(DOQExcessiveLoad, "")
+			continue
+		}
+		if !s.opt.Limits.acquireConnection() {
+			if s.opt.MaxConnections > 0 {
+				s.conns.Add(-1)
+			}
+			s.log.WithField("client", connection.RemoteAddr()).Debug("too many connections, closing connection")
+			s.metrics.rejected.Add(1)
+			_ = connection.CloseWithError(DOQExcessiveLoad, "")
+			continue
+		}
 		s.log.Trace("started connection")
 
+		s.metrics.activeConns.Add(1)
 		go func() {
+			defer s.metrics.activeConns.Add(-1)
 			s.handleConnection(connection)
 			_ = connection.CloseWithError(DOQNoError, "")
+			if s.opt.MaxConnections > 0 {
+				s.conns.Add(-1)
+			}
+			s.opt.Limits.releaseConnection()
 			s.log.Trace("closing connection")
 		}()
 	}
 }
 
 // Stop the server.
-func (s DoQListener) Stop() error {
+func (s *DoQListener) Stop() error {
 	Log.WithFields(logrus.Fields{"protocol": "quic", "addr": s.addr}).Info("stopping listener")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+	if s.ln == nil {
+		return nil
+	}
 	return s.ln.Close()
 }
-func getQuicOriginalIP(w quic.Connection) net.IP {
-	// Try to get original IP from common CDN headers if available
-	if r, ok := w.(interface{ Request() *http.Request }); ok {
-		req := r.Request()
-		if req != nil {
-			// Check common CDN headers in order of preference
-			headers := []string{
-				"x-real-ip",        // nginx
-				"CF-Connecting-IP", // Cloudflare
-				"X-Forwarded-For",  // General use
-				"True-Client-IP",   // Akamai
-				"X-Original-Forwarded-For",
-			}
 
-			for _, header := range headers {
-				if ip := req.Header.Get(header); ip != "" {
-					// Parse the IP address
-					if parsedIP := net.ParseIP(strings.TrimSpace(strings.Split(ip, ",")[0])); parsedIP != nil {
-						return parsedIP
-					}
-				}
-			}
+// Returns the function that decides if a client has to validate its address
+// with a Retry packet, nil if Retry isn't used.
+func (s *DoQListener) verifySourceAddress() func(net.Addr) bool {
+	if !s.opt.Retry && s.opt.RetryThreshold <= 0 {
+		return nil
+	}
+	attempts := newQPSLimiter(s.opt.RetryThreshold)
+	return func(addr net.Addr) bool {
+		if s.opt.Retry || !attempts.allow() {
+			s.metrics.retry.Add(1)
+			return true
 		}
+		return false
 	}
+}
 
-	// Fallback to direct connection IP if no CDN headers found
-	switch addr := w.RemoteAddr().(type) {
-	case *net.TCPAddr:
-		return addr.IP
-	case *net.UDPAddr:
-		return addr.IP
-	default:
-		return nil
+// Returns the IP of the client, considering CDN headers from trusted proxies.
+func getQuicOriginalIP(w quic.Connection, opt ListenOptions) net.IP {
+	var req *http.Request
+	if r, ok := w.(interface{ Request() *http.Request }); ok {
+		req = r.Request()
 	}
+	return clientIP(w.RemoteAddr(), req, opt)
 }
-func (s DoQListener) handleConnection(connection quic.Connection) {
-	tlsServerName := connection.ConnectionState().TLS.ServerName
+
+func (s *DoQListener) handleConnection(connection quic.Connection) {
+	tlsState := connection.ConnectionState().TLS
 
 	ci := ClientInfo{
 		Listener:      s.id,
-		TLSServerName: tlsServerName,
+		TLSServerName: tlsState.ServerName,
 	}
+	ci.setTLSClientIdentity(&tlsState)
 	// switch addr := connection.RemoteAddr().(type) {
 	// case *net.TCPAddr:
 	// 	ci.SourceIP = addr.IP
@@ -194,7 +228,8 @@ func (s DoQListener) handleConnection(connection quic.Connection) {
 	// }
 
 	// Get original client IP, considering CDN headers
-	ci.SourceIP = getQuicOriginalIP(connection)
+	ci.SourceIP = getQuicOriginalIP(connection, s.opt.ListenOptions)
+	ci.MAC = s.opt.MACTable.Lookup(ci.SourceIP)
 
 	log := s.log.WithField("client", connection.RemoteAddr())
 
@@ -206,26 +241,37 @@ func (s DoQListener) handleConnection(connection quic.Connection) {
 	log.Trace("accepting incoming connection")
 	s.metrics.connection.Add(1)
 
-	for {
-		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second) // TODO: configurable
+	idleTimeout := s.opt.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = 2 * time.Second
+	}
+
+	// Wait for queries in flight to complete before the connection is closed
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for queries := 0; s.opt.MaxConnectionQueries == 0 || queries < s.opt.MaxConnectionQueries; queries++ {
+		ctx, cancel := context.WithTimeout(context.Background(), idleTimeout)
 		stream, err := connection.AcceptStream(ctx)
+		cancel()
 		if err != nil {
-			cancel()
 			break
 		}
 		log.WithField("stream", stream.StreamID()).Trace("opening stream")
+		wg.Add(1)
 		go func() {
+			defer wg.Done()
 			s.handleStream(stream, log, ci)
-			cancel()
 			log.WithField("stream", stream.StreamID()).Trace("closing stream")
 		}()
 	}
 }
 
-func (s DoQListener) handleStream(stream quic.Stream, log *logrus.Entry, ci ClientInfo) {
+func (s *DoQListener) handleStream(stream quic.Stream, log *logrus.Entry, ci ClientInfo) {
 	// DNS over QUIC uses one stream per query/response.
 	defer stream.Close()
 	s.metrics.stream.Add(1)
+	s.metrics.activeStreams.Add(1)
+	defer s.metrics.activeStreams.Add(-1)
 
 	// DoQ requires a length prefix, like TCP
 	var length uint16
@@ -235,14 +281,18 @@ func (s DoQListener) handleStream(stream quic.Stream, log *logrus.Entry, ci Clie
 		return
 	}
 
+	buf := getBuffer()
+	defer putBuffer(buf)
+
 	// Read the raw query
-	b := make([]byte, length)
 	_ = stream.SetReadDeadline(time.Now().Add(time.Second)) // TODO: configurable timeout
-	if _, err := io.ReadFull(stream, b); err != nil {
+	b, err := readBuffer(stream, buf, int(length))
+	if err != nil {
 		s.metrics.err.Add("read", 1)
 		log.WithError(err).Error("failed to read query")
 		return
 	}
+	s.metrics.bytesIn.Add(int64(2 + len(b)))
 
 	// Decode the query
 	q := new(dns.Msg)
@@ -267,35 +317,46 @@ func (s DoQListener) handleStream(stream quic.Stream, log *logrus.Entry, ci Clie
 		}
 	}
 
+	ci.EDNS0 = captureEDNS0(q, s.opt.CaptureEDNS0)
+
 	// Resolve the query using the next hop
-	a, err := s.r.Resolve(q, ci, nil)
-	if err != nil {
-		log.WithError(err).Error("failed to resolve")
+	var a *dns.Msg
+	if s.allowQuery() {
+		a, err = resolveIncoming(s.r, q, ci.WithTimeout(s.opt.QueryTimeout))
+		if err != nil {
+			log.WithError(err).Error("failed to resolve")
+			a = new(dns.Msg)
+			a.SetRcode(q, dns.RcodeServerFailure)
+		}
+	} else {
+		s.metrics.err.Add("qps", 1)
+		log.Debug("query rate limit exceeded")
 		a = new(dns.Msg)
-		a.SetRcode(q, dns.RcodeServerFailure)
+		a.SetRcode(q, dns.RcodeRefused)
 	}
 
-	p, err := a.Pack()
+	// Pad the packet according to rfc8467 and rfc7830
+	s.opt.Padding.apply("doq", q, a)
+
+	// Encode the response with a length prefix, re-using the query buffer
+	out, err := packBuffer(a, buf, true)
 	if err != nil {
 		log.WithError(err).Error("failed to encode response")
 		s.metrics.err.Add("encode", 1)
 		return
 	}
 
-	// Add a length prefix
-	out := make([]byte, 2+len(p))
-	binary.BigEndian.PutUint16(out, uint16(len(p)))
-	copy(out[2:], p)
-
 	// Send the response
 	_ = stream.SetWriteDeadline(time.Now().Add(time.Second)) // TODO: configurable timeout
-	if _, err = stream.Write(out); err != nil {
+	n, err := stream.Write(out)
+	s.metrics.bytesOut.Add(int64(n))
+	if err != nil {
 		s.metrics.err.Add("send", 1)
 		log.WithError(err).Error("failed to send response")
 	}
 	s.metrics.response.Add(rCode(a), 1)
 }
 
-func (s DoQListener) String() string {
+func (s *DoQListener) String() string {
 	return s.id
 }
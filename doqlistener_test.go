@@ -0,0 +1,33 @@
+package rdns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoQListenerRetry(t *testing.T) {
+	upstream := new(TestResolver)
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	s := NewQUICListener("test-doq-retry", addr, DoQListenerOptions{TLSConfig: tlsServerConfig, Retry: true}, upstream)
+	go func() { _ = s.Start() }()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	// The client validates its address with the Retry packet and gets an answer
+	tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "", "")
+	require.NoError(t, err)
+	c, err := NewDoQClient("test-doq", addr, DoQClientOptions{TLSConfig: tlsConfig})
+	require.NoError(t, err)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+	require.Equal(t, int64(1), s.metrics.retry.Value())
+}
@@ -19,6 +19,10 @@ type DoTClient struct {
 	pipeline *Pipeline
 	// Pipeline also provides operation metrics.
 	opt DoTClientOptions
+
+	// Pipelines for queries sent through a proxy selected by a route or
+	// provided by a panel
+	proxied *proxiedCache[*Pipeline]
 }
 
 // DoTClientOptions contains options used by the DNS-over-TLS resolver.
@@ -34,6 +38,13 @@ type DoTClientOptions struct {
 
 	QueryTimeout time.Duration
 
+	// Tuning of the pipeline that sends queries to the upstream
+	Pipeline PipelineOptions
+
+	// Padding of queries as per rfc8467. By default, queries are padded in
+	// blocks of 128 bytes.
+	Padding PaddingPolicy
+
 	// Optional dialer, e.g. proxy
 	Dialer Dialer
 	Lego   *mylego.CertConfig
@@ -60,6 +71,7 @@ func (s *DoTClient) CertMonitor() error {
 			log.Print(err)
 		}
 		s.opt.TLSConfig = tlsConfig
+		s.opt.Pipeline.KeepAlive = 0 // the existing client keeps its connections open already
 		nResolver, err := NewDoTClient(s.id, s.endpoint, s.opt)
 		if err != nil {
 			log.Print(err)
@@ -98,29 +110,49 @@ func NewDoTClient(id, endpoint string, opt DoTClientOptions) (*DoTClient, error)
 		opt:      opt,
 		id:       id,
 		endpoint: endpoint,
-		pipeline: NewPipeline(id, endpoint, client, opt.QueryTimeout),
+		pipeline: NewPipeline(id, endpoint, client, opt.QueryTimeout, opt.Pipeline),
+		proxied:  newProxiedCache(func(p *Pipeline) { p.Close() }),
 	}, nil
 }
 
 // Resolve a DNS query.
-func (d *DoTClient) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dialer) (*dns.Msg, error) {
-	// Packing a message is not always a read-only operation, make a copy
-	q = q.Copy()
-
+func (d *DoTClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	logger(d.id, q, ci).WithFields(logrus.Fields{
 		"resolver": d.endpoint,
 		"protocol": "dot",
 	}).Debug("querying upstream resolver")
 
-	// Add padding to the query before sending over TLS
-	padQuery(q)
-	if d.opt.PanelSocksDialer != nil {
+	// Add padding to the query before sending over TLS. Padding only applies
+	// to queries with an OPT record, those need to be copied first.
+	if q.IsEdns0() != nil {
+		q = q.Copy()
+		d.opt.Padding.applyQuery(q)
+	}
+	if ci.Dialer != nil {
+		return d.proxiedPipeline(ci.Dialer).Resolve(q, ci.Deadline)
+	}
+	return d.pipeline.Resolve(q, ci.Deadline)
+}
+
+// Returns the pipeline for queries sent through a SOCKS5 proxy. Pipelines are
+// kept per proxy so connections to it are reused across queries.
+func (d *DoTClient) proxiedPipeline(dialer *Socks5Dialer) *Pipeline {
+	p, _ := d.proxied.get(dialer, func() (*Pipeline, error) {
 		opt := d.opt
-		opt.Dialer = PanelSocksDialer
+		opt.Dialer = dialer
+		opt.BootstrapAddr = ""     // the endpoint is the bootstrap address already
+		opt.Pipeline.KeepAlive = 0 // connections are opened on demand
 		r, _ := NewDoTClient(d.id, d.endpoint, opt)
-		return r.pipeline.Resolve(q)
-	}
-	return d.pipeline.Resolve(q)
+		return r.pipeline, nil
+	})
+	return p
+}
+
+// Close stops the pipelines of the client and closes their connections.
+func (d *DoTClient) Close() error {
+	d.pipeline.Close()
+	d.proxied.Close()
+	return nil
 }
 
 func (d *DoTClient) String() string {
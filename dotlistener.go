@@ -2,8 +2,6 @@ package rdns
 
 import (
 	"crypto/tls"
-	"fmt"
-	"log"
 
 	"github.com/XrayR-project/XrayR/common/mylego"
 	"github.com/miekg/dns"
@@ -14,8 +12,12 @@ import (
 type DoTListener struct {
 	*dns.Server
 	id   string
+	opt  DoTListenerOptions
 	Lego *mylego.CertConfig
 	MutualTLS bool
+
+	// Certificates served by the listener, reloaded by CertMonitor
+	Certificates *TLSCertificates
 }
 
 var _ Listener = &DoTListener{}
@@ -29,57 +31,45 @@ type DoTListenerOptions struct {
 
 // Check Cert
 func (s *DoTListener) CertMonitor() error {
-	switch s.Lego.CertMode {
-	case "dns", "http", "tls":
-		lego, err := mylego.New(s.Lego)
-		if err != nil {
-			log.Print(err)
-		}
-		// Xray-core supports the OcspStapling certification hot renew
-		_, _, _, _, err = lego.RenewCert()
-		if err != nil {
-			log.Print(err)
-		}
-		cert, key, ca, err := GetCertFile(s.Lego)
-		if err != nil {
-			fmt.Print(err)
-		}
-
-		tlsConfig, err := TLSServerConfig(ca, cert, key, s.MutualTLS)
-		if err != nil {
-			return err
-		}
-
-		s.Server.TLSConfig = tlsConfig
-		err = s.Stop()
-		if err != nil {
-			fmt.Printf("failed to stop DTLS listener %s, err: %s", s.id, err)
-		}
-		err = s.Start()
-		if err != nil {
-			fmt.Printf("failed to start DTLS listener %s, err: %s", s.id, err)
-		}
-	}
-	return nil
+	return renewCertificates(s.Lego, s.Certificates)
 }
 
 // NewDoTListener returns an instance of a DNS-over-TLS listener.
 func NewDoTListener(id, addr string, opt DoTListenerOptions, resolver Resolver) *DoTListener {
-	return &DoTListener{
-		id: id,
+	l := &DoTListener{
+		id:  id,
+		opt: opt,
 		Server: &dns.Server{
-			Addr:      addr,
-			Net:       "tcp-tls",
-			TLSConfig: opt.TLSConfig,
-			Handler:   listenHandler(id, "dot", addr, resolver, opt.AllowedNet),
+			Addr:          addr,
+			Net:           "tcp-tls",
+			TLSConfig:     opt.TLSConfig,
+			Handler:       listenHandler(id, "dot", addr, resolver, opt.ListenOptions),
+			TsigSecret:    opt.TSIGKeys,
+			MsgAcceptFunc: msgAcceptFunc(opt.ListenOptions),
 		},
 	}
+	applyConnectionLimits(l.Server, opt.ListenOptions)
+	return l
 }
 
 // Start the Dot server.
 func (s DoTListener) Start() error {
 	Log.WithFields(logrus.Fields{"id": s.id, "protocol": "dot", "addr": s.Addr}).Info("starting listener")
-	return s.ListenAndServe()
+	var alpn []string
+	if s.opt.SharePort {
+		alpn = []string{"dot"}
+		if s.TLSConfig != nil {
+			alpn = append(alpn, s.TLSConfig.NextProtos...)
+		}
+	}
+	return activateAndServe(s.Server, socketOptions{
+		maxConnections: s.opt.MaxConnections,
+		limits:         s.opt.Limits,
+		rejected:       getVarInt("listener", s.id, "connection-rejected"),
+		metrics:        NewListenerMetrics("listener", s.id).withConnections(s.id),
+		alpn:           alpn,
+		alpnFallback:   true,
+	})
 }
 
 // Stop the server.
@@ -36,7 +36,7 @@ func TestDoTListenerSimple(t *testing.T) {
 	// Send a query to the client. This should be proxied through the listener and hit the test resolver.
 	q := new(dns.Msg)
 	q.SetQuestion("cloudflare.com.", dns.TypeA)
-	_, err = c.Resolve(q, ClientInfo{}, nil)
+	_, err = c.Resolve(q, ClientInfo{})
 	require.NoError(t, err)
 
 	// The upstream resolver should have seen the query
@@ -71,13 +71,59 @@ func TestDoTListenerMutual(t *testing.T) {
 	// Send a query to the client. This should be proxied through the listener and hit the test resolver.
 	q := new(dns.Msg)
 	q.SetQuestion("cloudflare.com.", dns.TypeA)
-	_, err = c.Resolve(q, ClientInfo{}, nil)
+	_, err = c.Resolve(q, ClientInfo{})
 	require.NoError(t, err)
 
 	// The upstream resolver should have seen the query
 	require.Equal(t, 1, upstream.HitCount())
 }
 
+func TestDoTListenerClientCertPolicy(t *testing.T) {
+	var clientName string
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			clientName = ci.TLSClientName
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("cloudflare.com.", dns.TypeA)
+	tlsClientConfig, err := TLSClientConfig("testdata/ca.crt", "testdata/client.crt", "testdata/client.key", "")
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		policy  ClientCertPolicy
+		allowed bool
+	}{
+		{policy: ClientCertPolicy{CommonNames: []string{"localhost"}}, allowed: true},
+		{policy: ClientCertPolicy{CommonNames: []string{"other"}, SANs: []string{"other.example.com"}}, allowed: false},
+	} {
+		addr, err := getLnAddress()
+		require.NoError(t, err)
+		tlsServerConfig, err := TLSServerConfig("testdata/ca.crt", "testdata/server.crt", "testdata/server.key", true)
+		require.NoError(t, err)
+		tlsServerConfig.VerifyPeerCertificate = test.policy.VerifyPeerCertificate
+		s := NewDoTListener("test-ln", addr, DoTListenerOptions{TLSConfig: tlsServerConfig}, upstream)
+		go s.Start()
+		time.Sleep(time.Second)
+
+		c, _ := NewDoTClient("test-dot", addr, DoTClientOptions{TLSConfig: tlsClientConfig})
+		clientName = ""
+		_, err = c.Resolve(q, ClientInfo{})
+		if test.allowed {
+			require.NoError(t, err)
+			require.Equal(t, "localhost", clientName)
+		} else {
+			require.Error(t, err)
+			require.Empty(t, clientName)
+		}
+		s.Stop()
+	}
+}
+
 func TestDoTListenerPadding(t *testing.T) {
 	// Define a listener that does not respond with padding
 	upstream, _ := NewDNSClient("test-dns", "8.8.8.8:53", "udp", DNSClientOptions{})
@@ -107,7 +153,7 @@ func TestDoTListenerPadding(t *testing.T) {
 	q := new(dns.Msg)
 	q.SetQuestion("google.com.", dns.TypeA)
 	q.SetEdns0(4096, false)
-	a, err := c.Resolve(q, ClientInfo{}, nil)
+	a, err := c.Resolve(q, ClientInfo{})
 	require.NoError(t, err)
 	edns0 := a.IsEdns0()
 	require.NotNil(t, edns0, "expected EDNS0 option in response")
@@ -122,7 +168,7 @@ func TestDoTListenerPadding(t *testing.T) {
 	// Send a query without the EDNS0 option. The response should not have an EDNS0 record.
 	q = new(dns.Msg)
 	q.SetQuestion("google.com.", dns.TypeA)
-	a, err = c.Resolve(q, ClientInfo{}, nil)
+	a, err = c.Resolve(q, ClientInfo{})
 	require.NoError(t, err)
 	edns0 = a.IsEdns0()
 	require.Nil(t, edns0, "unexpected EDNS0 option in response")
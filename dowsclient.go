@@ -0,0 +1,243 @@
+package rdns
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// DoWSClient is a DNS-over-WebSocket resolver. Queries and responses are sent
+// as binary WebSocket messages, one DNS message each, over a single pipelined
+// connection.
+type DoWSClient struct {
+	id       string
+	endpoint string
+	pipeline *Pipeline // Pipeline also provides operation metrics.
+	opt      DoWSClientOptions
+
+	// Pipelines for queries sent through a proxy provided by a panel
+	proxied *proxiedCache[*Pipeline]
+}
+
+// DoWSClientOptions contains options used by the DNS-over-WebSocket resolver.
+type DoWSClientOptions struct {
+	// Bootstrap address - IP to use for the service instead of looking up
+	// the service's hostname with potentially plain DNS.
+	BootstrapAddr string
+
+	// Local IP to use for outbound connections. If nil, a local address is chosen.
+	LocalAddr net.IP
+
+	TLSConfig *tls.Config
+
+	QueryTimeout time.Duration
+
+	// Tuning of the pipeline that sends queries to the upstream
+	Pipeline PipelineOptions
+
+	// Padding of queries as per rfc8467. By default, queries are padded in
+	// blocks of 128 bytes.
+	Padding PaddingPolicy
+
+	// Optional dialer, e.g. proxy
+	Dialer Dialer
+}
+
+var _ Resolver = &DoWSClient{}
+
+// Check Cert
+func (d *DoWSClient) CertMonitor() error {
+	return nil
+}
+
+// NewDoWSClient instantiates a new DNS-over-WebSocket resolver. The endpoint
+// is a ws:// or wss:// URL.
+func NewDoWSClient(id, endpoint string, opt DoWSClientOptions) (*DoWSClient, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "wss" && u.Scheme != "ws" {
+		return nil, fmt.Errorf("unsupported scheme '%s' in dows endpoint '%s'", u.Scheme, endpoint)
+	}
+	d := &DoWSClient{
+		id:       id,
+		endpoint: endpoint,
+		opt:      opt,
+		proxied:  newProxiedCache(func(p *Pipeline) { p.Close() }),
+	}
+	d.pipeline = NewPipeline(id, endpoint, d.dialer(opt.Dialer), opt.QueryTimeout, opt.Pipeline)
+	return d, nil
+}
+
+// Resolve a DNS query.
+func (d *DoWSClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	logger(d.id, q, ci).WithFields(logrus.Fields{
+		"resolver": d.endpoint,
+		"protocol": "dows",
+	}).Debug("querying upstream resolver")
+
+	// Add padding to the query before sending over TLS. Padding only applies
+	// to queries with an OPT record, those need to be copied first.
+	if q.IsEdns0() != nil {
+		q = q.Copy()
+		d.opt.Padding.applyQuery(q)
+	}
+	if ci.Dialer != nil {
+		return d.proxiedPipeline(ci.Dialer).Resolve(q, ci.Deadline)
+	}
+	return d.pipeline.Resolve(q, ci.Deadline)
+}
+
+// Returns the pipeline for queries sent through a SOCKS5 proxy. Pipelines are
+// kept per proxy so connections to it are reused across queries.
+func (d *DoWSClient) proxiedPipeline(dialer *Socks5Dialer) *Pipeline {
+	p, _ := d.proxied.get(dialer, func() (*Pipeline, error) {
+		return NewPipeline(d.id, d.endpoint, d.dialer(dialer), d.opt.QueryTimeout, d.opt.Pipeline), nil
+	})
+	return p
+}
+
+func (d *DoWSClient) dialer(dialer Dialer) wsDialer {
+	return wsDialer{
+		TLSConfig:     d.opt.TLSConfig,
+		BootstrapAddr: d.opt.BootstrapAddr,
+		LocalAddr:     d.opt.LocalAddr,
+		Timeout:       d.opt.QueryTimeout,
+		Dialer:        dialer,
+	}
+}
+
+// Close stops the pipelines of the client and closes their connections.
+func (d *DoWSClient) Close() error {
+	d.pipeline.Close()
+	d.proxied.Close()
+	return nil
+}
+
+func (d *DoWSClient) String() string {
+	return d.id
+}
+
+// wsDialer opens WebSocket connections for a Pipeline.
+type wsDialer struct {
+	TLSConfig     *tls.Config
+	BootstrapAddr string
+	LocalAddr     net.IP
+	Timeout       time.Duration
+	Dialer        Dialer
+}
+
+var _ DNSDialer = wsDialer{}
+
+// Dial opens a WebSocket connection to the endpoint URL. If a bootstrap address
+// is set, the connection is made to it while the hostname of the URL is still
+// used in the TLS handshake and Host header.
+func (d wsDialer) Dial(endpoint string) (*dns.Conn, error) {
+	timeout := d.Timeout
+	if timeout == 0 {
+		timeout = defaultQueryTimeout
+	}
+	nd := &net.Dialer{LocalAddr: &net.TCPAddr{IP: d.LocalAddr}}
+	wd := websocket.Dialer{
+		TLSClientConfig:  d.TLSConfig,
+		HandshakeTimeout: timeout,
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if d.BootstrapAddr != "" {
+				_, port, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, err
+				}
+				addr = net.JoinHostPort(d.BootstrapAddr, port)
+			}
+			if d.Dialer != nil {
+				return d.Dialer.Dial(network, addr)
+			}
+			return nd.DialContext(ctx, network, addr)
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ws, resp, err := wd.DialContext(ctx, endpoint, nil)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("websocket handshake with '%s' failed with status %d: %w", endpoint, resp.StatusCode, err)
+		}
+		return nil, err
+	}
+	return &dns.Conn{Conn: &wsConn{Conn: ws}, UDPSize: dns.MaxMsgSize}, nil
+}
+
+// wsConn carries DNS messages in binary WebSocket messages. It implements
+// net.PacketConn so that dns.Conn treats it as message-oriented and doesn't
+// add length prefixes. Reads and writes are not safe for concurrent use by
+// more than one reader and one writer.
+type wsConn struct {
+	*websocket.Conn
+}
+
+var (
+	_ net.Conn       = &wsConn{}
+	_ net.PacketConn = &wsConn{}
+)
+
+// Read the next binary message into p. Other message types are skipped.
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		typ, r, err := c.NextReader()
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		if typ != websocket.BinaryMessage {
+			continue
+		}
+		n, err := io.ReadFull(r, p)
+		switch err {
+		case io.ErrUnexpectedEOF, io.EOF:
+			return n, nil
+		case nil:
+			// The buffer is full, make sure there's nothing left in the message
+			if _, err := r.Read(make([]byte, 1)); err != io.EOF {
+				return n, io.ErrShortBuffer
+			}
+			return n, nil
+		default:
+			return n, err
+		}
+	}
+}
+
+// Write p as one binary message.
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, err := c.Read(p)
+	return n, c.RemoteAddr(), err
+}
+
+func (c *wsConn) WriteTo(p []byte, _ net.Addr) (int, error) {
+	return c.Write(p)
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
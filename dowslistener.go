@@ -0,0 +1,320 @@
+package rdns
+
+import (
+	"context"
+	"crypto/tls"
+	"expvar"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/XrayR-project/XrayR/common/mylego"
+	"github.com/gorilla/websocket"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Time a DNS-over-WebSocket connection can be idle before it's closed if no
+// other timeout is given.
+const dowsIdleTimeout = time.Minute
+
+// DoWSListener is a DNS listener/server for DNS-over-WebSocket. Clients open a
+// WebSocket connection on any path and send queries as binary messages, one
+// DNS message each. Responses are sent back on the same connection in the
+// order they complete, so several queries can be in flight at a time.
+type DoWSListener struct {
+	httpServer *http.Server
+	upgrader   websocket.Upgrader
+
+	id      string
+	addr    string
+	r       Resolver
+	opt     DoWSListenerOptions
+	log     *logrus.Entry
+	metrics *DoWSListenerMetrics
+	conns   atomic.Int64
+
+	// Checks the query rate limits
+	allowQuery func() bool
+
+	Lego *mylego.CertConfig
+
+	// Certificates served by the listener, reloaded by CertMonitor
+	Certificates *TLSCertificates
+}
+
+var _ Listener = &DoWSListener{}
+
+// DoWSListenerOptions contains options used by the DNS-over-WebSocket server.
+type DoWSListenerOptions struct {
+	ListenOptions
+
+	TLSConfig *tls.Config
+
+	// Disable TLS on the server, for example behind a CDN or reverse proxy
+	// that terminates TLS.
+	NoTLS bool
+
+	// Require clients to authenticate with HTTP Basic credentials or a bearer
+	// token in the upgrade request. No authentication if empty.
+	Auth []DoHAuth
+}
+
+type DoWSListenerMetrics struct {
+	ListenerMetrics
+
+	// Count of connections upgraded to WebSocket.
+	connection *expvar.Int
+	// Count of connections closed because of the connection limit.
+	rejected *expvar.Int
+}
+
+func NewDoWSListenerMetrics(id string) *DoWSListenerMetrics {
+	m := &DoWSListenerMetrics{
+		ListenerMetrics: ListenerMetrics{
+			query:    getVarInt("listener", id, "query"),
+			response: getVarMap("listener", id, "response"),
+			drop:     getVarInt("listener", id, "drop"),
+			err:      getVarMap("listener", id, "error"),
+		},
+		connection: getVarInt("listener", id, "session"),
+		rejected:   getVarInt("listener", id, "connection-rejected"),
+	}
+	m.withConnections(id)
+	return m
+}
+
+// NewDoWSListener returns an instance of a DNS-over-WebSocket listener.
+func NewDoWSListener(id, addr string, opt DoWSListenerOptions, resolver Resolver) *DoWSListener {
+	return &DoWSListener{
+		id:   id,
+		addr: addr,
+		r:    resolver,
+		opt:  opt,
+		upgrader: websocket.Upgrader{
+			HandshakeTimeout: dohServerTimeout,
+			// Browsers aren't the intended clients, accept any origin
+			CheckOrigin: func(*http.Request) bool { return true },
+		},
+		log:     Log.WithFields(logrus.Fields{"id": id, "protocol": "dows", "addr": addr}),
+		metrics: NewDoWSListenerMetrics(id),
+
+		allowQuery: queryLimit(opt.ListenOptions),
+	}
+}
+
+func (s *DoWSListener) CertMonitor() error {
+	return renewCertificates(s.Lego, s.Certificates)
+}
+
+// Start the DoWS server.
+func (s *DoWSListener) Start() error {
+	s.log.Info("starting listener")
+	s.httpServer = &http.Server{
+		Addr:              s.addr,
+		TLSConfig:         s.opt.TLSConfig,
+		Handler:           http.HandlerFunc(s.wsHandler),
+		ReadHeaderTimeout: dohServerTimeout,
+		ErrorLog:          httpErrorLog(s.id, &s.metrics.ListenerMetrics),
+	}
+	ln, err := listenStream("tcp", s.addr, socketOptions{})
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	ln = meterConnections(ln, &s.metrics.ListenerMetrics)
+	if s.opt.NoTLS {
+		return s.httpServer.Serve(ln)
+	}
+	return s.httpServer.ServeTLS(ln, "", "")
+}
+
+// Stop the server. Upgraded connections aren't tracked by the HTTP server,
+// they're closed when the clients go idle.
+func (s *DoWSListener) Stop() error {
+	s.log.Info("stopping listener")
+	if s.httpServer == nil {
+		return nil
+	}
+	return s.httpServer.Shutdown(context.Background())
+}
+
+func (s *DoWSListener) String() string {
+	return s.id
+}
+
+func (s *DoWSListener) wsHandler(w http.ResponseWriter, r *http.Request) {
+	ci := ClientInfo{
+		SourceIP: clientIP(remoteTCPAddr(r), r, s.opt.ListenOptions),
+		DoHPath:  r.URL.Path,
+		Listener: s.id,
+	}
+	if ci.SourceIP == nil {
+		s.metrics.err.Add("remoteaddr", 1)
+		http.Error(w, "Invalid RemoteAddr", http.StatusBadRequest)
+		return
+	}
+	if len(s.opt.Auth) > 0 {
+		user, secret, ok := authenticateDoH(s.opt.Auth, r)
+		if !ok {
+			s.metrics.err.Add("auth", 1)
+			w.Header().Add("WWW-Authenticate", `Basic realm="dns", charset="UTF-8"`)
+			w.Header().Add("WWW-Authenticate", `Bearer realm="dns"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		ci.User, ci.AuthSecret = user, secret
+	}
+	if r.TLS != nil {
+		ci.TLSServerName = r.TLS.ServerName
+		ci.setTLSClientIdentity(r.TLS)
+	}
+	ci.MAC = s.opt.MACTable.Lookup(ci.SourceIP)
+
+	log := s.log.WithField("client", ci.SourceIP)
+	if !isAllowed(s.opt.AllowedNet, ci.SourceIP) {
+		log.Debug("rejecting incoming connection")
+		s.metrics.drop.Add(1)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if s.opt.MaxConnections > 0 {
+		if s.conns.Add(1) > int64(s.opt.MaxConnections) {
+			s.conns.Add(-1)
+			log.Debug("too many connections, rejecting connection")
+			s.metrics.rejected.Add(1)
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		defer s.conns.Add(-1)
+	}
+	if !s.opt.Limits.acquireConnection() {
+		log.Debug("too many connections, rejecting connection")
+		s.metrics.rejected.Add(1)
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.opt.Limits.releaseConnection()
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already responded with an error
+		s.metrics.err.Add("upgrade", 1)
+		log.WithError(err).Debug("failed to upgrade connection")
+		return
+	}
+	defer ws.Close()
+	s.metrics.connection.Add(1)
+	log.Trace("accepted connection")
+	s.handleConnection(ws, ci, log)
+	log.Trace("closing connection")
+}
+
+// Reads queries from a connection until it's closed, goes idle or reaches the
+// query limit, and resolves them concurrently.
+func (s *DoWSListener) handleConnection(ws *websocket.Conn, ci ClientInfo, log *logrus.Entry) {
+	idleTimeout := s.opt.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = dowsIdleTimeout
+	}
+	ws.SetReadLimit(dns.MaxMsgSize)
+
+	// Responses are written by the goroutines resolving the queries, but only
+	// one may write at a time. Wait for them before closing the connection.
+	var (
+		wg      sync.WaitGroup
+		writeMu sync.Mutex
+	)
+	defer wg.Wait()
+	for queries := 0; s.opt.MaxConnectionQueries == 0 || queries < s.opt.MaxConnectionQueries; queries++ {
+		_ = ws.SetReadDeadline(time.Now().Add(idleTimeout))
+		typ, b, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if typ != websocket.BinaryMessage {
+			s.metrics.err.Add("messagetype", 1)
+			continue
+		}
+		q := new(dns.Msg)
+		if err := q.Unpack(b); err != nil {
+			s.metrics.err.Add("unpack", 1)
+			log.WithError(err).Debug("failed to decode query")
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a := s.resolve(q, ci, log)
+			if a == nil {
+				return
+			}
+			buf := getBuffer()
+			defer putBuffer(buf)
+			out, err := packBuffer(a, buf, false)
+			if err != nil {
+				s.metrics.err.Add("pack", 1)
+				log.WithError(err).Error("failed to encode response")
+				return
+			}
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			_ = ws.SetWriteDeadline(time.Now().Add(dohServerTimeout))
+			if err := ws.WriteMessage(websocket.BinaryMessage, out); err != nil {
+				s.metrics.err.Add("send", 1)
+				log.WithError(err).Debug("failed to send response")
+			}
+		}()
+	}
+}
+
+// Resolves a query received over the connection. Returns nil if the query is
+// to be dropped.
+func (s *DoWSListener) resolve(q *dns.Msg, ci ClientInfo, log *logrus.Entry) *dns.Msg {
+	log = log.WithFields(logrus.Fields{"qtype": qType(q), "qname": qName(q)})
+	log.Debug("received query")
+	s.metrics.query.Add(1)
+
+	// The connection is managed by WebSocket, edns-tcp-keepalive doesn't apply
+	stripTCPKeepalive(q)
+	ci.EDNS0 = captureEDNS0(q, s.opt.CaptureEDNS0)
+
+	var a *dns.Msg
+	if s.allowQuery() {
+		var err error
+		log.WithField("resolver", s.r.String()).Trace("forwarding query to resolver")
+		a, err = resolveIncoming(s.r, q, ci.WithTimeout(s.opt.QueryTimeout))
+		if err != nil {
+			s.metrics.err.Add("resolve", 1)
+			log.WithError(err).Error("failed to resolve")
+			a = servfail(q)
+		}
+	} else {
+		s.metrics.err.Add("qps", 1)
+		log.Debug("query rate limit exceeded")
+		a = new(dns.Msg)
+		a.SetRcode(q, dns.RcodeRefused)
+	}
+
+	// A nil response from the resolvers means "drop"
+	if a == nil {
+		s.metrics.drop.Add(1)
+		return nil
+	}
+
+	// Pad the packet according to rfc8467 and rfc7830
+	s.opt.Padding.apply("dows", q, a)
+
+	s.metrics.response.Add(rCode(a), 1)
+	return a
+}
+
+// Returns the address of the peer of an HTTP request.
+func remoteTCPAddr(r *http.Request) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return addr
+}
@@ -0,0 +1,97 @@
+package rdns
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoWSListenerSimple(t *testing.T) {
+	var ci ClientInfo
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, c ClientInfo) (*dns.Msg, error) {
+			ci = c
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+
+	// Find a free port for the listener
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+
+	// Create the listener
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+
+	s := NewDoWSListener("test-dows", addr, DoWSListenerOptions{TLSConfig: tlsServerConfig}, upstream)
+	go s.Start()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	// Make a client talking to the listener
+	tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "", "")
+	require.NoError(t, err)
+	c, err := NewDoWSClient("test-dows", "wss://"+addr+"/dns-ws", DoWSClientOptions{TLSConfig: tlsConfig})
+	require.NoError(t, err)
+
+	// Send several queries to the client. They should be proxied through the
+	// listener over the same connection and hit the test resolver.
+	for i := 0; i < 3; i++ {
+		q := new(dns.Msg)
+		q.SetQuestion("cloudflare.com.", dns.TypeA)
+		a, err := c.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		require.Equal(t, q.Id, a.Id)
+	}
+	require.Equal(t, 3, upstream.HitCount())
+	require.Equal(t, "/dns-ws", ci.DoHPath)
+	require.Equal(t, "127.0.0.1", ci.SourceIP.String())
+	require.Equal(t, int64(1), s.metrics.connection.Value())
+}
+
+func TestDoWSListenerAuth(t *testing.T) {
+	upstream := new(TestResolver)
+
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+
+	opt := DoWSListenerOptions{
+		NoTLS: true,
+		Auth:  []DoHAuth{StaticDoHAuth{Tokens: []string{"secret"}}},
+	}
+	s := NewDoWSListener("test-dows-auth", addr, opt, upstream)
+	go s.Start()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	// Without credentials, the upgrade is refused
+	_, resp, err := websocket.DefaultDialer.Dial("ws://"+addr+"/", nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// With a valid token, queries are answered
+	header := http.Header{"Authorization": []string{"Bearer secret"}}
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/", header)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	b, err := q.Pack()
+	require.NoError(t, err)
+	require.NoError(t, ws.WriteMessage(websocket.BinaryMessage, b))
+
+	typ, b, err := ws.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, websocket.BinaryMessage, typ)
+	a := new(dns.Msg)
+	require.NoError(t, a.Unpack(b))
+	require.Equal(t, q.Id, a.Id)
+	require.Equal(t, 1, upstream.HitCount())
+}
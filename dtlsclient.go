@@ -37,6 +37,13 @@ type DTLSClientOptions struct {
 	DTLSConfig *dtls.Config
 
 	QueryTimeout time.Duration
+
+	// Tuning of the pipeline that sends queries to the upstream
+	Pipeline PipelineOptions
+
+	// Padding of queries as per rfc8467. By default, queries are padded in
+	// blocks of 128 bytes.
+	Padding PaddingPolicy
 	Lego *mylego.CertConfig
 }
 
@@ -116,26 +123,33 @@ func NewDTLSClient(id, endpoint string, opt DTLSClientOptions) (*DTLSClient, err
 	return &DTLSClient{
 		id:       id,
 		endpoint: endpoint,
-		pipeline: NewPipeline(id, endpoint, client, opt.QueryTimeout),
+		pipeline: NewPipeline(id, endpoint, client, opt.QueryTimeout, opt.Pipeline),
 		opt:      opt,
 	}, nil
 }
 
 // Resolve a DNS query.
-func (d *DTLSClient) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dialer) (*dns.Msg, error) {
-	// Packing a message is not always a read-only operation, make a copy
-	q = q.Copy()
-
+func (d *DTLSClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	logger(d.id, q, ci).WithFields(logrus.Fields{
 		"resolver": d.endpoint,
 		"protocol": "dtls",
 	}).Debug("querying upstream resolver")
 
-	q = setUDPSize(q, d.opt.UDPSize)
+	// Only copy the query if the OPT record needs to be changed
+	if d.opt.UDPSize > 0 || q.IsEdns0() != nil {
+		q = q.Copy()
+		setUDPSize(q, d.opt.UDPSize)
 
-	// Add padding to the query before sending over TLS
-	padQuery(q)
-	return d.pipeline.Resolve(q)
+		// Add padding to the query before sending over TLS
+		d.opt.Padding.applyQuery(q)
+	}
+	return d.pipeline.Resolve(q, ci.Deadline)
+}
+
+// Close stops the pipeline of the client and closes its connection.
+func (d *DTLSClient) Close() error {
+	d.pipeline.Close()
+	return nil
 }
 
 func (d *DTLSClient) String() string {
@@ -3,13 +3,10 @@ package rdns
 import (
 	"bytes"
 	"context"
-	"fmt"
-	"log"
 	"net"
 	"strconv"
 	"time"
 
-	"github.com/XrayR-project/XrayR/common/mylego"
 	M "github.com/XrayR-project/XrayR/common/mylego"
 	"github.com/miekg/dns"
 	"github.com/pion/dtls/v2"
@@ -22,6 +19,9 @@ type DTLSListener struct {
 	id string
 	Lego     *M.CertConfig
 
+	// Certificates served by the listener, reloaded by CertMonitor
+	Certificates *TLSCertificates
+
 	opt DTLSListenerOptions
 }
 
@@ -37,49 +37,23 @@ type DTLSListenerOptions struct {
 
 // Check Cert
 func (s *DTLSListener) CertMonitor() error {
-	switch s.Lego.CertMode {
-	case "dns", "http", "tls":
-		lego, err := mylego.New(s.Lego)
-		if err != nil {
-			log.Print(err)
-		}
-		// Xray-core supports the OcspStapling certification hot renew
-		_, _, _, _, err = lego.RenewCert()
-		if err != nil {
-			log.Print(err)
-		}
-		cert, key, ca, err := GetCertFile(s.Lego)
-		if err != nil {
-			fmt.Print(err)
-		}
-	
-		dtlsConfig, err := DTLSServerConfig(ca, cert, key, s.opt.MutualTLS)
-		if err != nil {
-			return err
-		}		
-		s.opt.DTLSConfig = dtlsConfig
-		err = s.Stop()
-		if err != nil {
-			fmt.Printf("failed to stop DTLS listener %s, err: %s", s.id,err)
-		}
-		err = s.Start()
-		if err != nil {
-			fmt.Printf("failed to start DTLS listener %s, err: %s", s.id,err)
-		}
-	}
-	return nil
+	return renewCertificates(s.Lego, s.Certificates)
 }
 
 // NewDTLSListener returns an instance of a DNS-over-DTLS listener.
 func NewDTLSListener(id, addr string, opt DTLSListenerOptions, resolver Resolver) *DTLSListener {
-	return &DTLSListener{
+	l := &DTLSListener{
 		id: id,
 		Server: &dns.Server{
-			Addr:    addr,
-			Handler: listenHandler(id, "dtls", addr, resolver, opt.AllowedNet),
+			Addr:          addr,
+			Handler:       listenHandler(id, "dtls", addr, resolver, opt.ListenOptions),
+			TsigSecret:    opt.TSIGKeys,
+			MsgAcceptFunc: msgAcceptFunc(opt.ListenOptions),
 		},
 		opt: opt,
 	}
+	applyConnectionLimits(l.Server, opt.ListenOptions)
+	return l
 }
 
 // Start the DTLS server.
@@ -104,7 +78,9 @@ func (s *DTLSListener) Start() error {
 	if err != nil {
 		return err
 	}
-	s.Server.Listener = dtlsListener{listener}
+	metrics := NewListenerMetrics("listener", s.id).withConnections(s.id)
+	ln := meterConnections(dtlsListener{listener}, metrics)
+	s.Server.Listener = limitConnections(ln, s.opt.MaxConnections, s.opt.Limits, getVarInt("listener", s.id, "connection-rejected"))
 	return s.Server.ActivateAndServe()
 }
 
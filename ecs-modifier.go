@@ -27,7 +27,7 @@ func NewECSModifier(id string, resolver Resolver, f ECSModifierFunc) (*ECSModifi
 }
 
 // Resolve modifies the OPT EDNS0 record and passes it to the next resolver.
-func (r *ECSModifier) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dialer) (*dns.Msg, error) {
+func (r *ECSModifier) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	if len(q.Question) < 1 {
 		return nil, errors.New("no question in query")
 	}
@@ -38,7 +38,7 @@ func (r *ECSModifier) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks
 	}
 
 	// Pass it on upstream
-	return r.resolver.Resolve(q, ci, PanelSocksDialer)
+	return r.resolver.Resolve(q, ci)
 }
 
 func (r *ECSModifier) String() string {
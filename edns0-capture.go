@@ -0,0 +1,73 @@
+package rdns
+
+import (
+	"encoding/hex"
+
+	"github.com/miekg/dns"
+)
+
+// Removes the EDNS0 options with the given codes from a query and returns their
+// data by option code. Such options, like device IDs or MAC addresses added by
+// CPEs, identify the client to this resolver and are not forwarded upstream.
+// Returns nil if none of the options were found.
+func captureEDNS0(q *dns.Msg, codes []uint16) map[uint16][]byte {
+	if len(codes) == 0 {
+		return nil
+	}
+	edns0 := q.IsEdns0()
+	if edns0 == nil {
+		return nil
+	}
+	var captured map[uint16][]byte
+	options := edns0.Option[:0]
+	for _, opt := range edns0.Option {
+		if !containsCode(codes, opt.Option()) {
+			options = append(options, opt)
+			continue
+		}
+		if captured == nil {
+			captured = make(map[uint16][]byte)
+		}
+		captured[opt.Option()] = edns0Data(opt)
+	}
+	edns0.Option = options
+	return captured
+}
+
+// Returns the raw data of an EDNS0 option. Options with codes unknown to the dns
+// package are already available as raw data, others are packed first.
+func edns0Data(opt dns.EDNS0) []byte {
+	if local, ok := opt.(*dns.EDNS0_LOCAL); ok {
+		return local.Data
+	}
+	rr := &dns.OPT{
+		Hdr:    dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT},
+		Option: []dns.EDNS0{opt},
+	}
+	buf := make([]byte, dns.Len(rr))
+	n, err := dns.PackRR(rr, buf, 0, nil, false)
+	if err != nil {
+		return nil
+	}
+	// Skip the RR header (11 bytes for the root name) and the option code and length
+	return buf[15:n]
+}
+
+// Returns the captured EDNS0 option with the given code hex-encoded, and whether
+// it was present.
+func (ci ClientInfo) edns0Hex(code uint16) (string, bool) {
+	data, ok := ci.EDNS0[code]
+	if !ok {
+		return "", false
+	}
+	return hex.EncodeToString(data), true
+}
+
+func containsCode(codes []uint16, code uint16) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
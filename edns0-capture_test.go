@@ -0,0 +1,40 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaptureEDNS0(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(1232, false)
+	edns0 := q.IsEdns0()
+	edns0.Option = append(edns0.Option,
+		&dns.EDNS0_LOCAL{Code: 65001, Data: []byte("laptop")},
+		&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.IP{192, 168, 1, 0}},
+		&dns.EDNS0_LOCAL{Code: 65002, Data: []byte{1, 2}},
+	)
+
+	// Nothing is captured without codes
+	require.Nil(t, captureEDNS0(q, nil))
+	require.Len(t, edns0.Option, 3)
+
+	captured := captureEDNS0(q, []uint16{65001, dns.EDNS0SUBNET, 65003})
+	require.Equal(t, map[uint16][]byte{
+		65001:           []byte("laptop"),
+		dns.EDNS0SUBNET: {0, 1, 24, 0, 192, 168, 1},
+	}, captured)
+
+	// The captured options are removed from the query
+	require.Len(t, edns0.Option, 1)
+	require.Equal(t, uint16(65002), edns0.Option[0].Option())
+
+	// Queries without EDNS0
+	q = new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	require.Nil(t, captureEDNS0(q, []uint16{65001}))
+}
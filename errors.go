@@ -14,3 +14,36 @@ type QueryTimeoutError struct {
 func (e QueryTimeoutError) Error() string {
 	return fmt.Sprintf("query for '%s' timed out", qName(e.query))
 }
+
+// QueryOverloadError is returned when a query can't be sent to an upstream
+// resolver because it has too many queries in flight.
+type QueryOverloadError struct {
+	query    *dns.Msg
+	resolver Resolver
+}
+
+func (e QueryOverloadError) Error() string {
+	return fmt.Sprintf("query for '%s' not sent, too many queries in flight to '%s'", qName(e.query), e.resolver)
+}
+
+// InvalidResponseError is returned when an upstream resolver responds with a
+// message that doesn't match the query.
+type InvalidResponseError struct {
+	query  *dns.Msg
+	reason string
+}
+
+func (e InvalidResponseError) Error() string {
+	return fmt.Sprintf("invalid response for '%s': %s", qName(e.query), e.reason)
+}
+
+// QueryLoopError is returned when a query that was sent upstream by this
+// instance comes back to one of its listeners.
+type QueryLoopError struct {
+	query *dns.Msg
+	hops  int
+}
+
+func (e QueryLoopError) Error() string {
+	return fmt.Sprintf("query loop detected for '%s' after %d hops", qName(e.query), e.hops)
+}
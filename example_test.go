@@ -16,7 +16,7 @@ func Example_resolver() {
 	q.SetQuestion("google.com.", dns.TypeA)
 
 	// Resolve the query
-	a, _ := r.Resolve(q, rdns.ClientInfo{}, nil)
+	a, _ := r.Resolve(q, rdns.ClientInfo{})
 	fmt.Println(a)
 }
 
@@ -33,7 +33,7 @@ func Example_group() {
 	q.SetQuestion("google.com.", dns.TypeA)
 
 	// Resolve the query
-	a, _ := g.Resolve(q, rdns.ClientInfo{}, nil)
+	a, _ := g.Resolve(q, rdns.ClientInfo{})
 	fmt.Println(a)
 }
 
@@ -44,8 +44,8 @@ func Example_router() {
 
 	// Build a router that will send all "*.cloudflare.com" to the cloudflare
 	// resolver while everything else goes to the google resolver (default)
-	route1, _ := rdns.NewRoute(`\.cloudflare\.com\.$`, "", nil, nil, "", "", "", "", "", "", cloudflare)
-	route2, _ := rdns.NewRoute("", "", nil, nil, "", "", "", "", "", "", google)
+	route1, _ := rdns.NewRoute(`\.cloudflare\.com\.$`, "", nil, nil, "", "", "", "", "", "", "", cloudflare)
+	route2, _ := rdns.NewRoute("", "", nil, nil, "", "", "", "", "", "", "", google)
 	r := rdns.NewRouter("my-router")
 	r.Add(route1, route2)
 
@@ -54,6 +54,6 @@ func Example_router() {
 	q.SetQuestion("www.cloudflare.com.", dns.TypeA)
 
 	// Resolve the query
-	a, _ := r.Resolve(q, rdns.ClientInfo{}, nil)
+	a, _ := r.Resolve(q, rdns.ClientInfo{})
 	fmt.Println(a)
 }
@@ -73,7 +73,7 @@ func NewFailBack(id string, opt FailBackOptions, resolvers ...Resolver) *FailBac
 
 // Resolve a DNS query using a failover resolver group that switches to the next
 // resolver on error.
-func (r *FailBack) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dialer) (*dns.Msg, error) {
+func (r *FailBack) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	log := logger(r.id, q, ci)
 	var (
 		err error
@@ -83,7 +83,7 @@ func (r *FailBack) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Di
 		resolver, active := r.current()
 		log.WithField("resolver", resolver.String()).Debug("forwarding query to resolver")
 		r.metrics.route.Add(resolver.String(), 1)
-		a, err = resolver.Resolve(q, ci, PanelSocksDialer)
+		a, err = resolver.Resolve(q, ci)
 		if err == nil && r.isSuccessResponse(a) { // Return immediately if successful
 			return a, err
 		}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
@@ -22,6 +23,12 @@ type FastestTCP struct {
 	resolver Resolver
 	opt      FastestTCPOptions
 	port     string
+
+	// Limits the number of concurrent probes, nil if unlimited
+	sem chan struct{}
+
+	mu    sync.Mutex
+	cache map[string]tcpProbeCacheEntry // Probe results by IP
 }
 
 var _ Resolver = &FastestTCP{}
@@ -40,27 +47,69 @@ type FastestTCPOptions struct {
 	// TTL set on all RRs when TCP probing was successful. Can be used to
 	// ensure these are kept for longer in a cache and improve performance.
 	SuccessTTLMin uint32
+
+	// Address family to prefer, FamilyPreferV4, FamilyPreferV6 or
+	// FamilyBalanced. With a preference, queries for the other family are
+	// answered without IPs if the name has an IP of the preferred family that
+	// responds to a probe. Defaults to FamilyBalanced.
+	Family string
+
+	// Maximum number of probes in flight at a time, across all queries.
+	// Unlimited if 0.
+	MaxConcurrentProbes int
+
+	// Time the result of a probe is re-used for queries resolving to the same
+	// IP, rather than probing it again. Results are not cached if 0.
+	ProbeCacheTTL time.Duration
+}
+
+// Address family preferences of a FastestTCP resolver.
+const (
+	FamilyBalanced = "balanced"
+	FamilyPreferV4 = "prefer-v4"
+	FamilyPreferV6 = "prefer-v6"
+)
+
+// Number of cached probe results above which expired results are removed.
+const tcpProbeCacheCleanupSize = 1024
+
+type tcpProbeCacheEntry struct {
+	rtt    time.Duration
+	err    error
+	expiry time.Time
 }
 
 // NewFastestTCP returns a new instance of a TCP probe resolver.
-func NewFastestTCP(id string, resolver Resolver, opt FastestTCPOptions) *FastestTCP {
+func NewFastestTCP(id string, resolver Resolver, opt FastestTCPOptions) (*FastestTCP, error) {
 	port := strconv.Itoa(opt.Port)
 	if port == "0" {
 		port = "443"
 	}
-	return &FastestTCP{
+	switch opt.Family {
+	case "":
+		opt.Family = FamilyBalanced
+	case FamilyBalanced, FamilyPreferV4, FamilyPreferV6:
+	default:
+		return nil, fmt.Errorf("unsupported family preference '%s'", opt.Family)
+	}
+	r := &FastestTCP{
 		id:       id,
 		resolver: resolver,
 		opt:      opt,
 		port:     port,
+		cache:    make(map[string]tcpProbeCacheEntry),
 	}
+	if opt.MaxConcurrentProbes > 0 {
+		r.sem = make(chan struct{}, opt.MaxConcurrentProbes)
+	}
+	return r, nil
 }
 
 // Resolve a DNS query and order the response based on which IP was able to establish
 // a TCP connection the fastest.
-func (r *FastestTCP) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dialer) (*dns.Msg, error) {
+func (r *FastestTCP) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	log := logger(r.id, q, ci)
-	a, err := r.resolver.Resolve(q, ci, PanelSocksDialer)
+	a, err := r.resolver.Resolve(q, ci)
 	if err != nil {
 		return a, err
 	}
@@ -70,15 +119,22 @@ func (r *FastestTCP) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5
 	if question.Qtype != dns.TypeA && question.Qtype != dns.TypeAAAA {
 		return a, nil
 	}
-	fmt.Println("Responses")
-	fmt.Println(a)
 
 	// Extract the IP responses
-	var ipRRs []dns.RR
-	for _, rr := range a.Answer {
-		if rr.Header().Rrtype == question.Qtype {
-			ipRRs = append(ipRRs, rr)
+	ipRRs := rrsOfType(a.Answer, question.Qtype)
+
+	// Answer without IPs if the preferred family is reachable
+	if len(ipRRs) > 0 && r.preferOther(question.Qtype) && r.otherReachable(q, ci, log) {
+		log.WithField("family", r.opt.Family).Debug("preferred family is reachable, removing ips from response")
+		a = a.Copy()
+		answer := a.Answer[:0]
+		for _, rr := range a.Answer {
+			if rr.Header().Rrtype != question.Qtype {
+				answer = append(answer, rr)
+			}
 		}
+		a.Answer = answer
+		return a, nil
 	}
 
 	// If there's only one IP in the response, nothing to probe
@@ -112,6 +168,57 @@ func (r *FastestTCP) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5
 	return a, nil
 }
 
+// Returns true if the family preference is for the other family than the
+// query type.
+func (r *FastestTCP) preferOther(qtype uint16) bool {
+	return (r.opt.Family == FamilyPreferV4 && qtype == dns.TypeAAAA) ||
+		(r.opt.Family == FamilyPreferV6 && qtype == dns.TypeA)
+}
+
+// Resolves the query for the other family and returns true if one of its IPs
+// responds to a probe.
+func (r *FastestTCP) otherReachable(q *dns.Msg, ci ClientInfo, log logrus.FieldLogger) bool {
+	other := q.Copy()
+	if other.Question[0].Qtype == dns.TypeA {
+		other.Question[0].Qtype = dns.TypeAAAA
+	} else {
+		other.Question[0].Qtype = dns.TypeA
+	}
+	a, err := r.resolver.Resolve(other, ci)
+	if err != nil || a == nil {
+		return false
+	}
+	rrs := rrsOfType(a.Answer, other.Question[0].Qtype)
+	if len(rrs) == 0 {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	resultCh := r.probe(ctx, log.WithField("port", r.port), rrs)
+	for range rrs {
+		select {
+		case res := <-resultCh:
+			if res.err == nil {
+				return true
+			}
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return false
+}
+
+// Returns the records of a type.
+func rrsOfType(rrs []dns.RR, typ uint16) []dns.RR {
+	var list []dns.RR
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == typ {
+			list = append(list, rr)
+		}
+	}
+	return list
+}
+
 // Sets the TTL of the given RRs if the option was provided
 func (r *FastestTCP) setTTL(rrs ...dns.RR) {
 	for _, rr := range rrs {
@@ -182,10 +289,11 @@ type tcpProbeResult struct {
 }
 
 // Probes all IPs and returns a channel with responses in the order they succeed or fail.
+// IPs with a cached result aren't probed again, their result is delivered after the
+// time the cached probe took.
 func (r *FastestTCP) probe(ctx context.Context, log logrus.FieldLogger, rrs []dns.RR) <-chan tcpProbeResult {
-	resultCh := make(chan tcpProbeResult)
+	resultCh := make(chan tcpProbeResult, len(rrs))
 	for _, rr := range rrs {
-		var d net.Dialer
 		go func(rr dns.RR) {
 			var network, ip string
 			switch record := rr.(type) {
@@ -197,17 +305,80 @@ func (r *FastestTCP) probe(ctx context.Context, log logrus.FieldLogger, rrs []dn
 				resultCh <- tcpProbeResult{err: errors.New("unexpected resource type")}
 				return
 			}
-			start := time.Now()
-			log.WithField("ip", ip).Debug("sending tcp probe")
-			c, err := d.DialContext(ctx, network, net.JoinHostPort(ip, r.port))
-			if err != nil {
-				resultCh <- tcpProbeResult{err: err}
+			if e, ok := r.cachedProbe(ip); ok {
+				log.WithField("ip", ip).Debug("using cached tcp probe result")
+				if e.err == nil {
+					select {
+					case <-time.After(e.rtt):
+					case <-ctx.Done():
+						return
+					}
+				}
+				resultCh <- tcpProbeResult{rr: rr, err: e.err}
 				return
 			}
-			log.WithField("ip", ip).WithField("response-time", time.Since(start)).Debug("tcp probe finished")
-			defer c.Close()
-			resultCh <- tcpProbeResult{rr: rr}
+			rtt, err := r.dial(ctx, log, network, ip)
+			if ctx.Err() == nil {
+				// Don't cache probes that were cut short
+				r.cacheProbe(ip, rtt, err)
+			}
+			resultCh <- tcpProbeResult{rr: rr, err: err}
 		}(rr)
 	}
 	return resultCh
 }
+
+// Opens a TCP connection to the IP and returns the time it took.
+func (r *FastestTCP) dial(ctx context.Context, log logrus.FieldLogger, network, ip string) (time.Duration, error) {
+	if r.sem != nil {
+		select {
+		case r.sem <- struct{}{}:
+			defer func() { <-r.sem }()
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+	var d net.Dialer
+	start := time.Now()
+	log.WithField("ip", ip).Debug("sending tcp probe")
+	c, err := d.DialContext(ctx, network, net.JoinHostPort(ip, r.port))
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+	log.WithField("ip", ip).WithField("response-time", rtt).Debug("tcp probe finished")
+	c.Close()
+	return rtt, nil
+}
+
+// Returns the cached result of a probe of the IP, if any.
+func (r *FastestTCP) cachedProbe(ip string) (tcpProbeCacheEntry, bool) {
+	if r.opt.ProbeCacheTTL == 0 {
+		return tcpProbeCacheEntry{}, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.cache[ip]
+	if !ok || time.Now().After(e.expiry) {
+		return tcpProbeCacheEntry{}, false
+	}
+	return e, true
+}
+
+// Caches the result of a probe of the IP.
+func (r *FastestTCP) cacheProbe(ip string, rtt time.Duration, err error) {
+	if r.opt.ProbeCacheTTL == 0 {
+		return
+	}
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.cache) >= tcpProbeCacheCleanupSize {
+		for k, e := range r.cache {
+			if now.After(e.expiry) {
+				delete(r.cache, k)
+			}
+		}
+	}
+	r.cache[ip] = tcpProbeCacheEntry{rtt: rtt, err: err, expiry: now.Add(r.opt.ProbeCacheTTL)}
+}
@@ -0,0 +1,77 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFastestTCP(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	// Only 127.0.0.1 accepts connections
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			hdr := dns.RR_Header{Name: q.Question[0].Name, Rrtype: q.Question[0].Qtype, Class: dns.ClassINET, Ttl: 60}
+			switch q.Question[0].Qtype {
+			case dns.TypeA:
+				a.Answer = []dns.RR{
+					&dns.A{Hdr: hdr, A: net.ParseIP("127.0.0.2")},
+					&dns.A{Hdr: hdr, A: net.ParseIP("127.0.0.1")},
+				}
+			case dns.TypeAAAA:
+				a.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("2001:db8::1")}}
+			}
+			return a, nil
+		},
+	}
+
+	r, err := NewFastestTCP("test-tcp", upstream, FastestTCPOptions{
+		Port:          port,
+		WaitAll:       true,
+		Family:        FamilyPreferV4,
+		ProbeCacheTTL: time.Minute,
+	})
+	require.NoError(t, err)
+
+	// The failed probe of 127.0.0.2 fails the whole lookup, the response is returned as is
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+	a, err := r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 2)
+
+	// IPv4 is preferred and reachable, so there are no IPv6 addresses in the response
+	q.SetQuestion("test.com.", dns.TypeAAAA)
+	a, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Empty(t, a.Answer)
+
+	// The probe result is re-used after the listener is gone
+	ln.Close()
+	e, ok := r.cachedProbe("127.0.0.1")
+	require.True(t, ok)
+	require.NoError(t, e.err)
+	a, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Empty(t, a.Answer)
+
+	_, err = NewFastestTCP("test-tcp", upstream, FastestTCPOptions{Family: "prefer-v5", Port: port})
+	require.Error(t, err)
+}
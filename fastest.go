@@ -1,30 +1,91 @@
 package rdns
 
 import (
+	"sync"
+	"time"
+
 	"github.com/miekg/dns"
 )
 
-// Fastest is a resolver group that queries all resolvers concurrently for
-// the same query, then returns the fastest response only.
+// Weight of a new latency sample in the moving average of a resolver.
+const fastestLatencyWeight = 0.3
+
+// Latency recorded for a resolver that failed, pushing it back in the order.
+const fastestFailurePenalty = 5 * time.Second
+
+// Fastest is a resolver group that tracks the latency of its resolvers as an
+// exponentially weighted moving average and sends queries to the resolver that
+// is currently the fastest. All resolvers are queried concurrently for the
+// same query, and the fastest response used, until their latency is known, and
+// then periodically to update it. If the fastest resolver fails, the query is
+// sent to all others.
 type Fastest struct {
 	id        string
 	resolvers []Resolver
+	opt       FastestOptions
+
+	mu        sync.Mutex
+	latency   []time.Duration // Moving average per resolver, 0 if unknown
+	lastProbe time.Time
 }
 
-var _ Resolver = &FailRotate{}
+var _ Resolver = &Fastest{}
+
+// FastestOptions contain settings for the fastest resolver group.
+type FastestOptions struct {
+	// Time between queries that are sent to all resolvers to update their
+	// latency. Default 1 minute.
+	ProbeInterval time.Duration
+
+	// Send every query to all resolvers and return the fastest response, rather
+	// than using the latency of past queries.
+	RaceAll bool
+}
 
 // NewFastest returns a new instance of a resolver group that returns the fastest
 // response from all its resolvers.
-func NewFastest(id string, resolvers ...Resolver) *Fastest {
+func NewFastest(id string, opt FastestOptions, resolvers ...Resolver) *Fastest {
+	if opt.ProbeInterval == 0 {
+		opt.ProbeInterval = time.Minute
+	}
 	return &Fastest{
 		id:        id,
 		resolvers: resolvers,
+		opt:       opt,
+		latency:   make([]time.Duration, len(resolvers)),
+	}
+}
+
+// Resolve a DNS query by sending it to the fastest resolver, or to all and
+// returning the fastest non-error response.
+func (r *Fastest) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	log := logger(r.id, q, ci)
+
+	best, probe := r.pick()
+	if probe {
+		log.Trace("sending query to all resolvers")
+		return r.race(q, ci, -1)
+	}
+	resolver := r.resolvers[best]
+	log.WithField("resolver", resolver.String()).Trace("sending query to fastest resolver")
+	start := time.Now()
+	a, err := resolver.Resolve(q, ci)
+	if err == nil && (a == nil || a.Rcode != dns.RcodeServerFailure) {
+		r.record(best, time.Since(start))
+		return a, err
 	}
+	r.record(best, fastestFailurePenalty)
+	log.WithField("resolver", resolver.String()).WithError(err).Debug("resolver returned failure, sending query to all others")
+	if len(r.resolvers) == 1 {
+		return a, err
+	}
+	return r.race(q, ci, best)
 }
 
-// Resolve a DNS query by sending it to all resolvers and returning the fastest
-// non-error response
-func (r *Fastest) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dialer) (*dns.Msg, error) {
+// Sends the query to all resolvers except the one with the given index and
+// returns the first successful response. The latency of all responses is
+// recorded, including the ones that arrive after the first.
+func (r *Fastest) race(q *dns.Msg, ci ClientInfo, except int) (*dns.Msg, error) {
 	log := logger(r.id, q, ci)
 
 	type response struct {
@@ -36,10 +97,21 @@ func (r *Fastest) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dia
 	responseCh := make(chan response, len(r.resolvers))
 
 	// Send the query to all resolvers. The responses are collected in a buffered channel
-	for _, resolver := range r.resolvers {
-		resolver := resolver
+	var n int
+	for i, resolver := range r.resolvers {
+		if i == except {
+			continue
+		}
+		n++
+		i, resolver := i, resolver
 		go func() {
-			a, err := resolver.Resolve(q, ci, PanelSocksDialer)
+			start := time.Now()
+			a, err := resolver.Resolve(q, ci)
+			if err == nil && (a == nil || a.Rcode != dns.RcodeServerFailure) {
+				r.record(i, time.Since(start))
+			} else {
+				r.record(i, fastestFailurePenalty)
+			}
 			responseCh <- response{resolver, a, err}
 		}()
 	}
@@ -56,13 +128,52 @@ func (r *Fastest) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dia
 		log.WithField("resolver", resolver.String()).WithError(err).Debug("resolver returned failure, waiting for next response")
 
 		// If all responses were bad, return the last one
-		if i++; i >= len(r.resolvers) {
+		if i++; i >= n {
 			return a, err
 		}
 	}
 	return nil, nil // should never be reached
 }
 
+// Returns the index of the resolver with the lowest latency, or true if the
+// query should be sent to all resolvers.
+func (r *Fastest) pick() (int, bool) {
+	if r.opt.RaceAll || len(r.resolvers) == 1 {
+		return 0, len(r.resolvers) > 1
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.lastProbe) >= r.opt.ProbeInterval {
+		r.lastProbe = time.Now()
+		return 0, true
+	}
+	var best int
+	for i, l := range r.latency {
+		if l == 0 {
+			// Not measured yet
+			return 0, true
+		}
+		if l < r.latency[best] {
+			best = i
+		}
+	}
+	return best, false
+}
+
+// Adds a latency sample to the moving average of a resolver.
+func (r *Fastest) record(i int, d time.Duration) {
+	if d <= 0 {
+		d = 1 // 0 means not measured
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.latency[i] == 0 {
+		r.latency[i] = d
+		return
+	}
+	r.latency[i] = time.Duration(fastestLatencyWeight*float64(d) + (1-fastestLatencyWeight)*float64(r.latency[i]))
+}
+
 func (r *Fastest) String() string {
 	return r.id
 }
@@ -70,4 +181,4 @@ func (r *Fastest) String() string {
 // Check Cert
 func (s *Fastest) CertMonitor() error {
 	return nil
-}
\ No newline at end of file
+}
@@ -34,12 +34,12 @@ func TestFastest(t *testing.T) {
 	}
 	r2 := new(TestResolver) // fast resolver
 
-	g := NewFastest("fastest", r1, r2)
+	g := NewFastest("fastest", FastestOptions{}, r1, r2)
 	q := new(dns.Msg)
 	q.SetQuestion("test.com.", dns.TypeA)
 
 	// Send the first query, it should go to both and the fast response (with A record) should come back.
-	a, err := g.Resolve(q, ci, nil)
+	a, err := g.Resolve(q, ci)
 	require.NoError(t, err)
 
 	time.Sleep(time.Millisecond) // Wait to make sure both resolvers are actually hit before checking the hit-count
@@ -80,12 +80,12 @@ func TestFastestFail(t *testing.T) {
 		},
 	}
 
-	g := NewFastest("fastest", r1, r2)
+	g := NewFastest("fastest", FastestOptions{}, r1, r2)
 	q := new(dns.Msg)
 	q.SetQuestion("test.com.", dns.TypeA)
 
 	// We have a fast failing, and a slow succeeding one. Expect success
-	a, err := g.Resolve(q, ci, nil)
+	a, err := g.Resolve(q, ci)
 	require.NoError(t, err)
 
 	require.Equal(t, 1, r2.HitCount())
@@ -112,15 +112,54 @@ func TestFastestFailAll(t *testing.T) {
 		},
 	}
 
-	g := NewFastest("fastest", r1, r2)
+	g := NewFastest("fastest", FastestOptions{}, r1, r2)
 	q := new(dns.Msg)
 	q.SetQuestion("test.com.", dns.TypeA)
 
 	// Expect the response to be from the slow SERVFAIL
-	a, err := g.Resolve(q, ci, nil)
+	a, err := g.Resolve(q, ci)
 	require.NoError(t, err)
 
 	require.Equal(t, 1, r1.HitCount())
 	require.Equal(t, 1, r2.HitCount())
 	require.Equal(t, dns.RcodeServerFailure, a.Rcode)
 }
+
+func TestFastestLatency(t *testing.T) {
+	var ci ClientInfo
+	r1 := &TestResolver{ // slow resolver
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			time.Sleep(10 * time.Millisecond)
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+	r2 := new(TestResolver) // fast resolver
+
+	g := NewFastest("fastest", FastestOptions{ProbeInterval: time.Hour}, r1, r2)
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	// The first query goes to both to measure the latency
+	_, err := g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return r1.HitCount() == 1 }, time.Second, time.Millisecond)
+
+	// Once the slow response was recorded, queries only go to the fastest
+	time.Sleep(20 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		_, err = g.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 1, r1.HitCount())
+	require.Equal(t, 6, r2.HitCount())
+
+	// If the fastest fails, the query goes to the others
+	r2.ResolveFunc = func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+		return nil, errors.New("failed")
+	}
+	_, err = g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, r1.HitCount())
+}
@@ -9,6 +9,9 @@ import (
 	"github.com/oschwald/maxminddb-golang"
 )
 
+// GeoIP database used if no other is configured.
+const defaultGeoDBFile = "/usr/share/GeoIP/GeoLite2-City.mmdb"
+
 // GeoIPDB holds blocklist rules based on location. When an IP is queried,
 // its location is looked up in a database and the result is compared to the
 // blocklist rules.
@@ -33,7 +36,7 @@ func (db *GeoIPDB) Remove(rules []string) error {
 // NewGeoIPDB returns a new instance of a matcher for a location rules.
 func NewGeoIPDB(name string, loader BlocklistLoader, geoDBFile string) (*GeoIPDB, error) {
 	if geoDBFile == "" {
-		geoDBFile = "/usr/share/GeoIP/GeoLite2-City.mmdb"
+		geoDBFile = defaultGeoDBFile
 	}
 	geoDB, err := maxminddb.Open(geoDBFile)
 	if err != nil {
@@ -116,3 +119,38 @@ func (m *GeoIPDB) Close() error {
 func (m *GeoIPDB) String() string {
 	return "GeoIP-blocklist"
 }
+
+// GeoLocation is the location of an IP address in a GeoIP database.
+type GeoLocation struct {
+	Country   string // ISO 3166-1 country code, like "DE"
+	Continent string // Continent code, like "EU"
+}
+
+// GeoLookupFunc returns the location of an IP address.
+type GeoLookupFunc func(ip net.IP) (GeoLocation, error)
+
+// NewGeoLookup opens a GeoIP database in MaxMind format, like GeoLite2-Country
+// or GeoLite2-City, and returns a function to look up IPs in it.
+func NewGeoLookup(geoDBFile string) (GeoLookupFunc, error) {
+	if geoDBFile == "" {
+		geoDBFile = defaultGeoDBFile
+	}
+	geoDB, err := maxminddb.Open(geoDBFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open geo location database file: %w", err)
+	}
+	return func(ip net.IP) (GeoLocation, error) {
+		var record struct {
+			Continent struct {
+				Code string `maxminddb:"code"`
+			} `maxminddb:"continent"`
+			Country struct {
+				ISOCode string `maxminddb:"iso_code"`
+			} `maxminddb:"country"`
+		}
+		if err := geoDB.Lookup(ip, &record); err != nil {
+			return GeoLocation{}, err
+		}
+		return GeoLocation{Country: record.Country.ISOCode, Continent: record.Continent.Code}, nil
+	}, nil
+}
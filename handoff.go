@@ -0,0 +1,356 @@
+package rdns
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/miekg/dns"
+)
+
+// Environment variable used to pass listening sockets to a new process during a
+// zero-downtime restart. It holds a comma-separated list of network:address=fd.
+const handoffEnv = "ROUTEDNS_LISTEN_FDS"
+
+// Listening sockets by network:address. Holds sockets inherited from a parent
+// process as well as those opened by this one, so they can be passed on to a new
+// process or re-used when a listener is restarted. A socket is closed and
+// removed once the last listener using it is closed.
+var handoffSockets struct {
+	once  sync.Once
+	mu    sync.Mutex
+	files map[string]*os.File
+	refs  map[string]int
+
+	// Set if this process was started by another to take over its sockets
+	inherited bool
+}
+
+// Loads the sockets passed on by the parent process, if any.
+func loadInheritedSockets() {
+	handoffSockets.files = make(map[string]*os.File)
+	handoffSockets.refs = make(map[string]int)
+	env := os.Getenv(handoffEnv)
+	if env == "" {
+		return
+	}
+	handoffSockets.inherited = true
+	for _, item := range strings.Split(env, ",") {
+		i := strings.LastIndex(item, "=")
+		if i < 0 {
+			continue
+		}
+		fd, err := strconv.Atoi(item[i+1:])
+		if err != nil {
+			Log.WithField("socket", item).Warn("invalid inherited socket")
+			continue
+		}
+		handoffSockets.files[item[:i]] = os.NewFile(uintptr(fd), item[:i])
+	}
+	// Don't pass the sockets on to processes started by this one
+	os.Unsetenv(handoffEnv)
+}
+
+// Returns a socket file by key and takes a reference on it, or nil if there is
+// none. The reference is given up with releaseSocket.
+func handoffSocket(key string) *os.File {
+	handoffSockets.once.Do(loadInheritedSockets)
+	handoffSockets.mu.Lock()
+	defer handoffSockets.mu.Unlock()
+	f := handoffSockets.files[key]
+	if f != nil {
+		handoffSockets.refs[key]++
+	}
+	return f
+}
+
+// Records a socket so it can be passed on or re-used, with a reference for the
+// listener that opened it.
+func registerSocket(key string, c interface{ File() (*os.File, error) }) {
+	f, err := c.File()
+	if err != nil {
+		Log.WithError(err).WithField("socket", key).Warn("failed to register socket for handoff")
+		return
+	}
+	handoffSockets.mu.Lock()
+	handoffSockets.files[key] = f
+	handoffSockets.refs[key] = 1
+	handoffSockets.mu.Unlock()
+}
+
+// Gives up a reference on a socket. The socket is closed and no longer passed
+// on once there are none left.
+func releaseSocket(key string) {
+	handoffSockets.mu.Lock()
+	defer handoffSockets.mu.Unlock()
+	f := handoffSockets.files[key]
+	if f == nil {
+		return
+	}
+	handoffSockets.refs[key]--
+	if handoffSockets.refs[key] > 0 {
+		return
+	}
+	f.Close()
+	delete(handoffSockets.files, key)
+	delete(handoffSockets.refs, key)
+}
+
+// HoldSockets takes a reference on all listening sockets, so they stay open
+// while the listeners are stopped and started again with a new config. Queries
+// arriving meanwhile wait in the sockets. The returned function gives up the
+// references, closing the sockets the new listeners didn't take over.
+func HoldSockets() func() {
+	handoffSockets.once.Do(loadInheritedSockets)
+	handoffSockets.mu.Lock()
+	keys := make([]string, 0, len(handoffSockets.files))
+	for key := range handoffSockets.files {
+		handoffSockets.refs[key]++
+		keys = append(keys, key)
+	}
+	handoffSockets.mu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			for _, key := range keys {
+				releaseSocket(key)
+			}
+		})
+	}
+}
+
+// handoffListener gives up its reference on the socket when it's closed.
+type handoffListener struct {
+	net.Listener
+	key       string
+	closeOnce sync.Once
+}
+
+func (l *handoffListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() { releaseSocket(l.key) })
+	return err
+}
+
+// Options for opening listening sockets.
+type socketOptions struct {
+	// Set SO_REUSEPORT so several sockets can be bound to the same address.
+	reusePort bool
+
+	// Index of the socket when several are opened for the same address.
+	worker int
+
+	// Maximum number of concurrent connections on stream sockets, 0 for no limit.
+	maxConnections int
+
+	// Connection limits shared with other listeners, nil if there are none.
+	limits *ListenerLimits
+
+	// Counts connections closed because of the limit.
+	rejected *expvar.Int
+
+	// File mode and group of unix domain sockets.
+	socketMode  os.FileMode
+	socketGroup string
+
+	// Accept traffic redirected with TPROXY, see transparentControl.
+	transparent bool
+
+	// Metrics of the connections on stream sockets, optional.
+	metrics *ListenerMetrics
+
+	// ALPN protocols of a TLS listener, used to share the socket with other
+	// TLS listeners on the same address, see listenTLS. A fallback listener
+	// gets the connections that don't ask for any of the protocols served.
+	// Without protocols, the listener has the socket to itself.
+	alpn         []string
+	alpnFallback bool
+}
+
+// Key to identify a socket for handoff.
+func (o socketOptions) key(network, addr string) string {
+	if o.worker > 0 {
+		return fmt.Sprintf("%s:%s#%d", network, addr, o.worker)
+	}
+	return network + ":" + addr
+}
+
+func (o socketOptions) listenConfig() *net.ListenConfig {
+	var controls []func(network, address string, c syscall.RawConn) error
+	if o.reusePort {
+		controls = append(controls, reusePortControl)
+	}
+	if o.transparent {
+		controls = append(controls, transparentControl)
+	}
+	return &net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			for _, control := range controls {
+				if err := control(network, address, c); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// Opens a stream listener, or takes over an existing one with the same address
+// that was inherited from the parent process or opened before.
+func listenStream(network, addr string, opt socketOptions) (net.Listener, error) {
+	key := opt.key(network, addr)
+	if f := handoffSocket(key); f != nil {
+		ln, err := net.FileListener(f)
+		if err != nil {
+			releaseSocket(key)
+			return nil, err
+		}
+		return &handoffListener{Listener: ln, key: key}, nil
+	}
+	ln, err := opt.listenConfig().Listen(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := ln.(*net.TCPListener); ok {
+		registerSocket(key, c)
+	}
+	return &handoffListener{Listener: ln, key: key}, nil
+}
+
+// Opens a packet socket, or takes over an existing one with the same address
+// that was inherited from the parent process or opened before. The socket is
+// returned as is for the UDP features of *net.UDPConn, so the caller needs to
+// call releaseSocket with the key of the socket after closing it.
+func listenPacket(network, addr string, opt socketOptions) (net.PacketConn, error) {
+	key := opt.key(network, addr)
+	if f := handoffSocket(key); f != nil {
+		pc, err := net.FilePacketConn(f)
+		if err != nil {
+			releaseSocket(key)
+		}
+		return pc, err
+	}
+	pc, err := opt.listenConfig().ListenPacket(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := pc.(*net.UDPConn); ok {
+		registerSocket(key, c)
+	}
+	return pc, nil
+}
+
+// Opens the socket for a DNS server, using inherited sockets if available,
+// and starts serving queries on it.
+func activateAndServe(s *dns.Server, opt socketOptions) error {
+	switch s.Net {
+	case "udp", "udp4", "udp6":
+		pc, err := listenPacket(s.Net, s.Addr, opt)
+		if err != nil {
+			return err
+		}
+		// The server closes the socket when it's shut down
+		defer releaseSocket(opt.key(s.Net, s.Addr))
+		if opt.transparent {
+			if pc, err = newTransparentConn(pc); err != nil {
+				return err
+			}
+		}
+		s.PacketConn = pc
+	case "tcp", "tcp4", "tcp6":
+		ln, err := listenStream(s.Net, s.Addr, opt)
+		if err != nil {
+			return err
+		}
+		s.Listener = limitConnections(meterConnections(ln, opt.metrics), opt.maxConnections, opt.limits, opt.rejected)
+	case "tcp-tls", "tcp4-tls", "tcp6-tls":
+		if s.TLSConfig == nil || (len(s.TLSConfig.Certificates) == 0 && s.TLSConfig.GetCertificate == nil) {
+			return errors.New("neither Certificates nor GetCertificate set in config")
+		}
+		var (
+			ln  net.Listener
+			err error
+		)
+		network := strings.TrimSuffix(s.Net, "-tls")
+		if len(opt.alpn) > 0 {
+			ln, err = listenTLS(network, s.Addr, opt)
+		} else {
+			ln, err = listenStream(network, s.Addr, opt)
+		}
+		if err != nil {
+			return err
+		}
+		ln = limitConnections(meterConnections(ln, opt.metrics), opt.maxConnections, opt.limits, opt.rejected)
+		s.Listener = meterHandshakes(tls.NewListener(ln, s.TLSConfig), opt.metrics)
+	case "unix", "unixgram":
+		ln, pc, err := listenUnix(s.Net, s.Addr, opt)
+		if err != nil {
+			return err
+		}
+		if ln != nil {
+			s.Listener = limitConnections(meterConnections(ln, opt.metrics), opt.maxConnections, opt.limits, opt.rejected)
+		}
+		s.PacketConn = pc
+	default:
+		return s.ListenAndServe()
+	}
+	return s.ActivateAndServe()
+}
+
+// HandoffParent returns the process ID of the routedns process that started
+// this one to take over its sockets, or 0 if this process was started normally.
+func HandoffParent() int {
+	handoffSockets.once.Do(loadInheritedSockets)
+	if !handoffSockets.inherited {
+		return 0
+	}
+	return os.Getppid()
+}
+
+// Handoff starts a new instance of the running executable with the same
+// arguments, passing it all listening sockets. The new process serves queries
+// on the same sockets, so the current process can shut down without losing
+// any queries.
+func Handoff() (*os.Process, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	handoffSockets.once.Do(loadInheritedSockets)
+	handoffSockets.mu.Lock()
+	keys := make([]string, 0, len(handoffSockets.files))
+	for key := range handoffSockets.files {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	files := make([]*os.File, 0, len(keys))
+	sockets := make([]string, 0, len(keys))
+	for i, key := range keys {
+		files = append(files, handoffSockets.files[key])
+		// ExtraFiles start at fd 3 in the new process
+		sockets = append(sockets, fmt.Sprintf("%s=%d", key, 3+i))
+	}
+	handoffSockets.mu.Unlock()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), handoffEnv+"="+strings.Join(sockets, ","))
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	Log.WithField("pid", cmd.Process.Pid).Info("handed off listening sockets to new process")
+	return cmd.Process, nil
+}
@@ -0,0 +1,71 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandoffSocketRelease(t *testing.T) {
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	opt := socketOptions{}
+	key := opt.key("tcp", addr)
+
+	// A second listener on the address shares the socket
+	ln1, err := listenStream("tcp", addr, opt)
+	require.NoError(t, err)
+	ln2, err := listenStream("tcp", addr, opt)
+	require.NoError(t, err)
+	require.NoError(t, ln1.Close())
+	require.NotNil(t, handoffSocket(key))
+	releaseSocket(key)
+
+	// The socket is closed with the last listener and the address can be
+	// bound again
+	require.NoError(t, ln2.Close())
+	require.Nil(t, handoffSocket(key))
+	ln, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+	ln.Close()
+
+	// Packet sockets are released by the caller
+	addr, err = getUDPLnAddress()
+	require.NoError(t, err)
+	pc, err := listenPacket("udp", addr, opt)
+	require.NoError(t, err)
+	pc.Close()
+	releaseSocket(opt.key("udp", addr))
+	pc, err = net.ListenPacket("udp", addr)
+	require.NoError(t, err)
+	pc.Close()
+}
+
+func TestHoldSockets(t *testing.T) {
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	opt := socketOptions{}
+	key := opt.key("tcp", addr)
+
+	// A held socket stays open after its listener is closed and is taken over
+	// by the next listener on the address
+	ln1, err := listenStream("tcp", addr, opt)
+	require.NoError(t, err)
+	release := HoldSockets()
+	require.NoError(t, ln1.Close())
+	ln2, err := listenStream("tcp", addr, opt)
+	require.NoError(t, err)
+	release()
+	release()
+	require.NotNil(t, handoffSocket(key))
+	releaseSocket(key)
+
+	// Without a listener taking it over, the socket is closed on release
+	release = HoldSockets()
+	require.NoError(t, ln2.Close())
+	require.NotNil(t, handoffSocket(key))
+	releaseSocket(key)
+	release()
+	require.Nil(t, handoffSocket(key))
+}
@@ -0,0 +1,148 @@
+package rdns
+
+import (
+	"expvar"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// InflightLimiter is a resolver that limits the number of queries that are being
+// resolved concurrently by the resolver behind it. Queries beyond the limit wait
+// in a bounded queue for a slot to become available. Queries that don't fit in
+// the queue, or that have waited too long, are sent to an overflow resolver or
+// fail. A slow upstream then causes back-pressure instead of an ever growing
+// number of goroutines waiting on it.
+type InflightLimiter struct {
+	id       string
+	resolver Resolver
+	InflightLimiterOptions
+
+	slots   chan struct{}
+	queued  atomic.Int64
+	metrics *InflightLimiterMetrics
+}
+
+var _ Resolver = &InflightLimiter{}
+
+type InflightLimiterOptions struct {
+	// Maximum number of queries in flight. Required.
+	MaxInflight int
+
+	// Number of queries that can wait for a slot when the limit is reached.
+	// Queries that don't fit into the queue overflow immediately. Default 0.
+	QueueSize int
+
+	// Maximum time a query waits in the queue before it overflows. Default 1 second.
+	QueueTimeout time.Duration
+
+	// Optional resolver to send overflowing queries to. If not set, they fail
+	// with a QueryOverloadError.
+	OverflowResolver Resolver
+}
+
+type InflightLimiterMetrics struct {
+	// Count of queries.
+	query *expvar.Int
+	// Count of queries that had to wait for a slot.
+	queued *expvar.Int
+	// Count of queries that overflowed.
+	overflow *expvar.Int
+	// Number of queries currently in flight.
+	inflight *expvar.Int
+}
+
+// NewInflightLimiter returns a new instance of a resolver limiting the number of
+// concurrent queries to an upstream resolver.
+func NewInflightLimiter(id string, resolver Resolver, opt InflightLimiterOptions) *InflightLimiter {
+	if opt.QueueTimeout == 0 {
+		opt.QueueTimeout = time.Second
+	}
+	return &InflightLimiter{
+		id:                     id,
+		resolver:               resolver,
+		InflightLimiterOptions: opt,
+		slots:                  make(chan struct{}, opt.MaxInflight),
+		metrics: &InflightLimiterMetrics{
+			query:    getVarInt("inflight-limiter", id, "query"),
+			queued:   getVarInt("inflight-limiter", id, "queued"),
+			overflow: getVarInt("inflight-limiter", id, "overflow"),
+			inflight: getVarInt("inflight-limiter", id, "inflight"),
+		},
+	}
+}
+
+// Resolve a DNS query once a slot is available, or pass it to the overflow
+// resolver if there isn't one in time.
+func (r *InflightLimiter) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	log := logger(r.id, q, ci)
+	r.metrics.query.Add(1)
+
+	select {
+	case r.slots <- struct{}{}:
+	default:
+		if !r.wait(ci) {
+			return r.overflow(q, ci)
+		}
+	}
+	r.metrics.inflight.Add(1)
+	defer func() {
+		<-r.slots
+		r.metrics.inflight.Add(-1)
+	}()
+
+	log.WithField("resolver", r.resolver).Debug("forwarding query to resolver")
+	return r.resolver.Resolve(q, ci)
+}
+
+// Waits in the queue for a slot. Returns false if the queue is full or no slot
+// became available before the queue timeout or the query deadline.
+func (r *InflightLimiter) wait(ci ClientInfo) bool {
+	if r.queued.Add(1) > int64(r.QueueSize) {
+		r.queued.Add(-1)
+		return false
+	}
+	defer r.queued.Add(-1)
+	r.metrics.queued.Add(1)
+
+	timeout := r.QueueTimeout
+	if !ci.Deadline.IsZero() {
+		timeout = min(timeout, time.Until(ci.Deadline))
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (r *InflightLimiter) overflow(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	log := logger(r.id, q, ci)
+	r.metrics.overflow.Add(1)
+	if r.OverflowResolver != nil {
+		log.WithField("resolver", r.OverflowResolver).Debug("too many queries in flight, forwarding to overflow-resolver")
+		return r.OverflowResolver.Resolve(q, ci)
+	}
+	log.Debug("too many queries in flight, failing query")
+	return nil, QueryOverloadError{q, r.resolver}
+}
+
+// Close closes the limited resolver. The overflow resolver is left open, it's
+// used on its own as well.
+func (r *InflightLimiter) Close() error {
+	closeResolver(r.resolver)
+	return nil
+}
+
+func (r *InflightLimiter) String() string {
+	return r.id
+}
+
+// Check Cert of the upstream resolver
+func (s *InflightLimiter) CertMonitor() error {
+	return s.resolver.CertMonitor()
+}
@@ -0,0 +1,88 @@
+package rdns
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInflightLimiter(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Upstream blocks until released
+	var inflight atomic.Int32
+	release := make(chan struct{})
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			inflight.Add(1)
+			<-release
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+	overflow := new(TestResolver)
+	r := NewInflightLimiter("test-limiter", upstream, InflightLimiterOptions{
+		MaxInflight:      2,
+		QueueSize:        1,
+		QueueTimeout:     time.Second,
+		OverflowResolver: overflow,
+	})
+
+	// Fill the slots and the queue
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := r.Resolve(q, ClientInfo{})
+			require.NoError(t, err)
+		}()
+	}
+	require.Eventually(t, func() bool {
+		return inflight.Load() == 2 && r.queued.Load() == 1
+	}, time.Second, time.Millisecond)
+
+	// The next query overflows immediately
+	_, err := r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, overflow.HitCount())
+
+	// Once released, the queued query is sent upstream
+	close(release)
+	wg.Wait()
+	require.Equal(t, int32(3), inflight.Load())
+	require.Equal(t, 1, overflow.HitCount())
+}
+
+func TestInflightLimiterFailFast(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	var inflight atomic.Int32
+	release := make(chan struct{})
+	defer close(release)
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			inflight.Add(1)
+			<-release
+			return nil, nil
+		},
+	}
+	r := NewInflightLimiter("test-limiter", upstream, InflightLimiterOptions{
+		MaxInflight:  1,
+		QueueSize:    1,
+		QueueTimeout: 10 * time.Millisecond,
+	})
+	go r.Resolve(q, ClientInfo{})
+	require.Eventually(t, func() bool { return inflight.Load() == 1 }, time.Second, time.Millisecond)
+
+	// Waits in the queue, but there's no slot before the timeout
+	_, err := r.Resolve(q, ClientInfo{})
+	require.IsType(t, QueryOverloadError{}, err)
+}
@@ -1,192 +1,249 @@
 package rdns
 
-import "net"
+import (
+	"encoding/binary"
+	"math/bits"
+	"net"
+	"sort"
+)
 
 // Datastructure for efficient search of a list of CIDR addresses to see if
 // an IP is contained in one of the CIDR ranges in the list. While it uses
 // ideas from routing table implementations as described in
 // https://vincent.bernat.ch/en/blog/2017-ipv4-route-lookup-linux, it differs
 // in that it looks for the shortest prefix (biggest network match) since
-// it's sufficient to know if an IP is covered by one of the networks
+// it's sufficient to know if an IP is covered by one of the networks.
+//
+// The trie is path-compressed, nodes are only needed where networks branch off
+// so there are at most two nodes per network. Nodes are kept in a single slice
+// and reference each other by index which keeps them close together in memory
+// and avoids pointers the garbage collector would have to scan.
 type ipBlocklistTrie struct {
-	root *ipBlocklistNode
+	nodes []ipBlocklistNode // Index 0 is unused, it marks a missing node
+	root  int32
 }
 
 type ipBlocklistNode struct {
-	left, right *ipBlocklistNode
-	leaf        bool
+	addr     ipKey
+	prefix   uint8 // Number of leading bits in addr that are significant
+	leaf     bool  // Everything under the prefix is covered, there are no children
+	children [2]int32
 }
 
-func (t *ipBlocklistTrie) remove(n *net.IPNet) {
-    t.root = t.removeNode(t.root, n.IP, 0, len(n.IP)*8, 0)
+// IP address as 128 bits, left-aligned. IPv4 addresses use the first 32 bits.
+type ipKey struct {
+	hi, lo uint64
 }
 
-func (t *ipBlocklistTrie) removeNode(node *ipBlocklistNode, ip net.IP, bitIndex, size, level int) *ipBlocklistNode {
-    if node == nil {
-        return nil
-    }
+func newIPKey(ip net.IP) ipKey {
+	if addr := ip.To4(); addr != nil {
+		return ipKey{hi: uint64(binary.BigEndian.Uint32(addr)) << 32}
+	}
+	return ipKey{
+		hi: binary.BigEndian.Uint64(ip[:8]),
+		lo: binary.BigEndian.Uint64(ip[8:16]),
+	}
+}
 
-    if bitIndex == size {
-        // Check if this node is a leaf for the network
-        if node.leaf {
-            node.leaf = false
-            // If it's a leaf, and no children, we can remove this node
-            if node.left == nil && node.right == nil {
-                return nil
-            }
-        }
-        return node
-    }
+// Returns the n'th bit from the left.
+func (k ipKey) bit(n uint8) int {
+	if n < 64 {
+		return int(k.hi>>(63-n)) & 1
+	}
+	return int(k.lo>>(127-n)) & 1
+}
 
-    // Finding the bit at bitIndex in the IP
-    b := bit(ip, bitIndex)
+// Returns the key with all but the first n bits set to 0.
+func (k ipKey) mask(n uint8) ipKey {
+	switch {
+	case n == 0:
+		return ipKey{}
+	case n < 64:
+		return ipKey{hi: k.hi &^ (^uint64(0) >> n)}
+	case n == 64:
+		return ipKey{hi: k.hi}
+	case n < 128:
+		return ipKey{hi: k.hi, lo: k.lo &^ (^uint64(0) >> (n - 64))}
+	}
+	return k
+}
 
-    // Go to the appropriate child based on the bit
-    if b == 1 {
-        node.right = t.removeNode(node.right, ip, bitIndex+1, size, level+1)
-    } else {
-        node.left = t.removeNode(node.left, ip, bitIndex+1, size, level+1)
-    }
+// Returns the number of leading bits that are the same in both keys, up to max.
+func (k ipKey) commonPrefix(o ipKey, max uint8) uint8 {
+	n := 64 + bits.LeadingZeros64(k.lo^o.lo)
+	if x := k.hi ^ o.hi; x != 0 {
+		n = bits.LeadingZeros64(x)
+	}
+	return min(uint8(n), max)
+}
 
-    // If this node is a leaf node and has no children, it can be removed
-    if node.leaf && node.left == nil && node.right == nil {
-        return nil
-    }
+func (k ipKey) less(o ipKey) bool {
+	return k.hi < o.hi || (k.hi == o.hi && k.lo < o.lo)
+}
 
-    return node
+func (t *ipBlocklistTrie) newNode(n ipBlocklistNode) int32 {
+	if len(t.nodes) == 0 {
+		t.nodes = append(t.nodes, ipBlocklistNode{})
+	}
+	t.nodes = append(t.nodes, n)
+	return int32(len(t.nodes) - 1)
 }
 
-// Add a network to the trie with an identifier.
+// Add a network to the trie.
 func (t *ipBlocklistTrie) add(n *net.IPNet) {
-	if t.root == nil {
-		t.root = new(ipBlocklistNode)
+	prefix, _ := n.Mask.Size()
+	key := newIPKey(n.IP).mask(uint8(prefix))
+	t.root = t.insert(t.root, key, uint8(prefix))
+}
+
+// Inserts a network into the subtree starting at index i and returns the index
+// of the new subtree.
+func (t *ipBlocklistTrie) insert(i int32, key ipKey, prefix uint8) int32 {
+	if i == 0 {
+		return t.newNode(ipBlocklistNode{addr: key, prefix: prefix, leaf: true})
 	}
+	node := t.nodes[i]
+	common := node.addr.commonPrefix(key, min(node.prefix, prefix))
+	switch {
+	case common == node.prefix && node.leaf:
+		// Already covered by this or a shorter prefix
+		return i
+	case common == node.prefix && prefix == node.prefix:
+		// Same network as an existing branch, it now covers everything under it
+		t.nodes[i].leaf = true
+		t.nodes[i].children = [2]int32{}
+		return i
+	case common == node.prefix:
+		b := key.bit(node.prefix)
+		child := t.insert(node.children[b], key, prefix)
+		t.nodes[i].children[b] = child
+		return i
+	case common == prefix:
+		// The new network covers this whole subtree, replace it
+		return t.newNode(ipBlocklistNode{addr: key, prefix: prefix, leaf: true})
+	}
+	// The networks differ after the common prefix, branch off there
+	branch := ipBlocklistNode{addr: key.mask(common), prefix: common}
+	branch.children[node.addr.bit(common)] = i
+	branch.children[key.bit(common)] = t.newNode(ipBlocklistNode{addr: key, prefix: prefix, leaf: true})
+	return t.newNode(branch)
+}
+
+// Remove a network that was added to the trie before. Networks that are covered
+// by a shorter prefix are not stored and can't be removed on their own.
+func (t *ipBlocklistTrie) remove(n *net.IPNet) {
 	prefix, _ := n.Mask.Size()
-	p := t.root
-	for i := 0; i < prefix; i++ {
-		if p.leaf { // stop if we already have a shorter prefix than this
-			break
+	key := newIPKey(n.IP).mask(uint8(prefix))
+	t.root = t.delete(t.root, key, uint8(prefix))
+}
+
+// Removes a network from the subtree starting at index i and returns the index
+// of the new subtree. Nodes that are no longer referenced stay in the slice until
+// the trie is rebuilt.
+func (t *ipBlocklistTrie) delete(i int32, key ipKey, prefix uint8) int32 {
+	if i == 0 {
+		return 0
+	}
+	node := t.nodes[i]
+	if prefix < node.prefix || node.addr.commonPrefix(key, node.prefix) < node.prefix {
+		return i
+	}
+	if prefix == node.prefix {
+		if !node.leaf {
+			return i
 		}
-		b := bit(n.IP, i)
-		if b == 1 {
-			if p.right == nil {
-				p.right = new(ipBlocklistNode)
-			}
-			p = p.right
-		} else {
-			if p.left == nil {
-				p.left = new(ipBlocklistNode)
+		return 0
+	}
+	if node.leaf {
+		return i
+	}
+	b := key.bit(node.prefix)
+	node.children[b] = t.delete(node.children[b], key, prefix)
+	t.nodes[i].children = node.children
+
+	// Branches with only one remaining child are replaced by the child
+	switch {
+	case node.children[0] == 0:
+		return node.children[1]
+	case node.children[1] == 0:
+		return node.children[0]
+	}
+	return i
+}
+
+// Replaces the content of the trie with a list of networks. This is much faster
+// than adding them one by one and produces a trie with nodes in search order.
+func (t *ipBlocklistTrie) build(nets []*net.IPNet) {
+	type network struct {
+		key    ipKey
+		prefix uint8
+	}
+	list := make([]network, 0, len(nets))
+	for _, n := range nets {
+		prefix, _ := n.Mask.Size()
+		list = append(list, network{newIPKey(n.IP).mask(uint8(prefix)), uint8(prefix)})
+	}
+	// Sort by address, and shorter prefixes first so that networks covered by
+	// another come right after it
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].key != list[j].key {
+			return list[i].key.less(list[j].key)
+		}
+		return list[i].prefix < list[j].prefix
+	})
+	disjoint := list[:0]
+	for _, n := range list {
+		if len(disjoint) > 0 {
+			last := disjoint[len(disjoint)-1]
+			if last.key.commonPrefix(n.key, last.prefix) == last.prefix {
+				continue
 			}
-			p = p.left
 		}
+		disjoint = append(disjoint, n)
 	}
 
-	// Mark this as the leaf-node. We care about the shortest prefix
-	// so nothing should go past this when building the trie
-	p.left = nil
-	p.right = nil
-	p.leaf = true
+	t.nodes = make([]ipBlocklistNode, 1, 1+2*len(disjoint))
+	t.root = 0
+	if len(disjoint) == 0 {
+		return
+	}
+	var build func(list []network) int32
+	build = func(list []network) int32 {
+		if len(list) == 1 {
+			return t.newNode(ipBlocklistNode{addr: list[0].key, prefix: list[0].prefix, leaf: true})
+		}
+		// The list is sorted, so the first and last share the prefix of all of them
+		first, last := list[0], list[len(list)-1]
+		common := first.key.commonPrefix(last.key, min(first.prefix, last.prefix))
+		split := sort.Search(len(list), func(i int) bool { return list[i].key.bit(common) == 1 })
+		i := t.newNode(ipBlocklistNode{addr: first.key.mask(common), prefix: common})
+		left := build(list[:split])
+		right := build(list[split:])
+		t.nodes[i].children = [2]int32{left, right}
+		return i
+	}
+	t.root = build(disjoint)
 }
 
-// Returns true, the string representation of the network covering the IP, and the identifier.
+// Returns true and the string representation of the network covering
+// the IP.
 func (t *ipBlocklistTrie) hasIP(ip net.IP) (string, bool) {
-	if t.root == nil {
-		return "", false
-	}
-	p := t.root
-	size := 32
-	if addr := ip.To4(); addr == nil {
-		size = 128
-	} else {
+	if addr := ip.To4(); addr != nil {
 		ip = addr // make sure we use the 4-byte representation of an IPv4
 	}
-	for i := 0; i < size; i++ {
-		if p.leaf {
-			return ruleString(ip, i), true // برگرداندن شناسه در صورت وجود IP
+	key := newIPKey(ip)
+	for i := t.root; i != 0; {
+		node := &t.nodes[i]
+		if node.addr.commonPrefix(key, node.prefix) < node.prefix {
+			return "", false
 		}
-		b := bit(ip, i)
-		if b == 1 {
-			if p.right == nil {
-				return "", false
-			}
-			p = p.right
-		} else {
-			if p.left == nil {
-				return "", false
-			}
-			p = p.left
+		if node.leaf {
+			return ruleString(ip, int(node.prefix)), true
 		}
+		i = node.children[key.bit(node.prefix)]
 	}
-	// Todo Kontorol
-	return ruleString(ip, size), true
-}
-
-
-
-// // Add a network to the trie.
-// func (t *ipBlocklistTrie) add(n *net.IPNet) {
-// 	if t.root == nil {
-// 		t.root = new(ipBlocklistNode)
-// 	}
-// 	prefix, _ := n.Mask.Size()
-// 	p := t.root
-// 	for i := 0; i < prefix; i++ {
-// 		if p.leaf { // stop if we already have a shorter prefix than this
-// 			break
-// 		}
-// 		b := bit(n.IP, i)
-// 		if b == 1 {
-// 			if p.right == nil {
-// 				p.right = new(ipBlocklistNode)
-// 			}
-// 			p = p.right
-// 		} else {
-// 			if p.left == nil {
-// 				p.left = new(ipBlocklistNode)
-// 			}
-// 			p = p.left
-// 		}
-// 	}
-
-// 	// Mark this as the leaf-node. We care about the shortest prefix
-// 	// so nothing should go past this when building the trie
-// 	p.left = nil
-// 	p.right = nil
-// 	p.leaf = true
-// }
-
-// // Returns true and the string representation of the network covering
-// // the IP.
-// func (t *ipBlocklistTrie) hasIP(ip net.IP) (string, bool) {
-// 	if t.root == nil {
-// 		return "", false
-// 	}
-// 	p := t.root
-// 	size := 32
-// 	if addr := ip.To4(); addr == nil {
-// 		size = 128
-// 	} else {
-// 		ip = addr // make sure we use the 4-byte representation of an IPv4
-// 	}
-// 	for i := 0; i < size; i++ {
-// 		if p.leaf {
-// 			return ruleString(ip, i), true
-// 		}
-// 		b := bit(ip, i)
-// 		if b == 1 {
-// 			if p.right == nil {
-// 				return "", false
-// 			}
-// 			p = p.right
-// 		} else {
-// 			if p.left == nil {
-// 				return "", false
-// 			}
-// 			p = p.left
-// 		}
-// 	}
-// 	return ruleString(ip, size), true
-// }
+	return "", false
+}
 
 func ruleString(ip net.IP, maskBits int) string {
 	size := 32
@@ -200,24 +257,3 @@ func ruleString(ip net.IP, maskBits int) string {
 	}
 	return ipNet.String()
 }
-
-var bitMask = []byte{
-	128,
-	64,
-	32,
-	16,
-	8,
-	4,
-	2,
-	1,
-}
-
-// Returns n'th bit from an IP address from the left.
-func bit(ip net.IP, n int) int {
-	byteIndex := n / 8
-	bitIndex := n % 8
-	if (ip[byteIndex] & bitMask[bitIndex]) == 0 {
-		return 0
-	}
-	return 1
-}
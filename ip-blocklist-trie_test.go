@@ -0,0 +1,98 @@
+package rdns
+
+import (
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPBlocklistTrie(t *testing.T) {
+	var nets []*net.IPNet
+	for _, s := range []string{
+		"10.0.0.0/8",
+		"10.1.0.0/16", // covered by 10.0.0.0/8
+		"192.168.1.0/24",
+		"192.168.2.0/24",
+		"192.168.2.128/25", // covered by 192.168.2.0/24
+		"1.2.3.4/32",
+	} {
+		_, n, err := net.ParseCIDR(s)
+		require.NoError(t, err)
+		nets = append(nets, n)
+	}
+
+	tests := []struct {
+		ip   string
+		rule string
+	}{
+		{ip: "10.1.2.3", rule: "10.0.0.0/8"},
+		{ip: "192.168.1.10", rule: "192.168.1.0/24"},
+		{ip: "192.168.2.200", rule: "192.168.2.0/24"},
+		{ip: "1.2.3.4", rule: "1.2.3.4/32"},
+		{ip: "1.2.3.5"},
+		{ip: "192.168.3.1"},
+		{ip: "11.0.0.1"},
+	}
+
+	// Bulk-loaded and incrementally built tries should give the same results
+	var bulk, incremental ipBlocklistTrie
+	bulk.build(nets)
+	for i := len(nets) - 1; i >= 0; i-- {
+		incremental.add(nets[i])
+	}
+	for _, trie := range []*ipBlocklistTrie{&bulk, &incremental} {
+		for _, test := range tests {
+			rule, ok := trie.hasIP(net.ParseIP(test.ip))
+			require.Equal(t, test.rule != "", ok, test.ip)
+			require.Equal(t, test.rule, rule, test.ip)
+		}
+	}
+
+	// Remove a network
+	_, n, _ := net.ParseCIDR("192.168.1.0/24")
+	bulk.remove(n)
+	_, ok := bulk.hasIP(net.ParseIP("192.168.1.10"))
+	require.False(t, ok)
+	_, ok = bulk.hasIP(net.ParseIP("192.168.2.10"))
+	require.True(t, ok)
+}
+
+func TestIPBlocklistTrieRandom(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	var nets []*net.IPNet
+	for i := 0; i < 1000; i++ {
+		ip := make(net.IP, net.IPv6len)
+		rnd.Read(ip[:4]) // Keep most bits 0 so networks overlap
+		mask := net.CIDRMask(8+rnd.Intn(121), 128)
+		nets = append(nets, &net.IPNet{IP: ip.Mask(mask), Mask: mask})
+	}
+	var bulk, incremental ipBlocklistTrie
+	bulk.build(nets)
+	for _, n := range nets {
+		incremental.add(n)
+	}
+
+	for i := 0; i < 10000; i++ {
+		ip := make(net.IP, net.IPv6len)
+		rnd.Read(ip[:4])
+		if i%2 == 0 {
+			// Pick an address inside one of the networks
+			n := nets[rnd.Intn(len(nets))]
+			copy(ip, n.IP)
+			ip[15] |= byte(rnd.Intn(256)) &^ n.Mask[15]
+		}
+		var expected bool
+		for _, n := range nets {
+			if n.Contains(ip) {
+				expected = true
+				break
+			}
+		}
+		_, ok := bulk.hasIP(ip)
+		require.Equal(t, expected, ok, ip.String())
+		_, ok = incremental.hasIP(ip)
+		require.Equal(t, expected, ok, ip.String())
+	}
+}
@@ -0,0 +1,31 @@
+package rdns
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Returns the query sent to keep connections to an upstream open. It asks for
+// the root NS records which every resolver has cached.
+func keepAliveQuery() *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion(".", dns.TypeNS)
+	return q
+}
+
+// Sends a keepalive query to the upstream of a resolver right away, and then
+// periodically, to open a connection before the first query needs it and to
+// keep it from being closed when idle. Used by clients that don't send their
+// queries through a pipeline, runs forever.
+func keepAliveUpstream(id string, interval time.Duration, resolver Resolver) {
+	log := Log.WithField("id", id)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := resolver.Resolve(keepAliveQuery(), ClientInfo{}); err != nil {
+			log.WithError(err).Debug("keepalive query failed")
+		}
+		<-ticker.C
+	}
+}
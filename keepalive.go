@@ -0,0 +1,54 @@
+package rdns
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Idle timeout of client connections to stream listeners if not configured.
+// Same as the default used by the DNS server.
+const defaultTCPIdleTimeout = 8 * time.Second
+
+// Removes edns-tcp-keepalive options (rfc7828) from a message. Returns true if
+// there were any. The option only applies to the connection it was received on
+// and must not be forwarded.
+func stripTCPKeepalive(m *dns.Msg) bool {
+	edns0 := m.IsEdns0()
+	if edns0 == nil {
+		return false
+	}
+	var found bool
+	options := edns0.Option[:0]
+	for _, opt := range edns0.Option {
+		if opt.Option() == dns.EDNS0TCPKEEPALIVE {
+			found = true
+			continue
+		}
+		options = append(options, opt)
+	}
+	edns0.Option = options
+	return found
+}
+
+// Adds an edns-tcp-keepalive option to a response, telling the client how long
+// it can keep the connection open while idle, as per rfc7828. Any keepalive
+// options from upstream are replaced.
+func setTCPKeepalive(q, a *dns.Msg, idleTimeout time.Duration) {
+	edns0q := q.IsEdns0()
+	if edns0q == nil {
+		return
+	}
+	stripTCPKeepalive(a)
+	edns0a := a.IsEdns0()
+	if edns0a == nil {
+		a.SetEdns0(edns0q.UDPSize(), edns0q.Do())
+		edns0a = a.IsEdns0()
+	}
+	// The timeout is in units of 100 milliseconds
+	timeout := min(idleTimeout/(100*time.Millisecond), 0xffff)
+	edns0a.Option = append(edns0a.Option, &dns.EDNS0_TCP_KEEPALIVE{
+		Code:    dns.EDNS0TCPKEEPALIVE,
+		Timeout: uint16(timeout),
+	})
+}
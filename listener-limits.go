@@ -0,0 +1,147 @@
+package rdns
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ListenerLimits caps the queries and connections of several listeners
+// together, like all listeners of a tenant, so they can't use up the capacity
+// of the process. The limits of the individual listeners apply as well.
+type ListenerLimits struct {
+	id      string
+	qps     *qpsLimiter
+	conns   atomic.Int64
+	opt     ListenerLimitsOptions
+	metrics *ListenerLimitsMetrics
+}
+
+type ListenerLimitsOptions struct {
+	// Maximum number of queries per second over all listeners. Default 0
+	// means no limit.
+	MaxQPS int
+
+	// Maximum number of concurrent client connections over all listeners.
+	// Default 0 means no limit.
+	MaxConnections int
+}
+
+type ListenerLimitsMetrics struct {
+	// Queries refused because of the QPS limit.
+	queryRejected *expvar.Int
+	// Connections closed because of the connection limit.
+	connRejected *expvar.Int
+}
+
+// NewListenerLimits returns limits to be shared by listeners through their
+// ListenOptions. The ID is used in the metrics, tenants use their name.
+func NewListenerLimits(id string, opt ListenerLimitsOptions) *ListenerLimits {
+	return &ListenerLimits{
+		id:  id,
+		qps: newQPSLimiter(opt.MaxQPS),
+		opt: opt,
+		metrics: &ListenerLimitsMetrics{
+			queryRejected: getVarInt("tenant", id, "query-rejected"),
+			connRejected:  getVarInt("tenant", id, "connection-rejected"),
+		},
+	}
+}
+
+// Returns true if another query can be answered. Always true for nil limits.
+func (l *ListenerLimits) allowQuery() bool {
+	if l == nil || l.qps.allow() {
+		return true
+	}
+	l.metrics.queryRejected.Add(1)
+	return false
+}
+
+// Takes up a connection slot, returns false if all are in use. Connections
+// that got a slot have to release it when closed. Always true for nil limits.
+func (l *ListenerLimits) acquireConnection() bool {
+	if l == nil || l.opt.MaxConnections <= 0 {
+		return true
+	}
+	if l.conns.Add(1) > int64(l.opt.MaxConnections) {
+		l.conns.Add(-1)
+		l.metrics.connRejected.Add(1)
+		return false
+	}
+	return true
+}
+
+func (l *ListenerLimits) releaseConnection() {
+	if l == nil || l.opt.MaxConnections <= 0 {
+		return
+	}
+	l.conns.Add(-1)
+}
+
+// Returns a function that reports whether a query received by a listener is
+// within its own QPS limit and the limits it shares with other listeners.
+func queryLimit(opt ListenOptions) func() bool {
+	qps := newQPSLimiter(opt.MaxQPS)
+	return func() bool {
+		if !qps.allow() {
+			return false
+		}
+		// Queries refused by the shared limits don't count against the
+		// listener's own
+		if !opt.Limits.allowQuery() {
+			qps.giveBack()
+			return false
+		}
+		return true
+	}
+}
+
+// qpsLimiter is a token bucket that allows bursts of up to one second worth
+// of queries.
+type qpsLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// Returns a limiter for the given number of queries per second, or nil for no
+// limit.
+func newQPSLimiter(qps int) *qpsLimiter {
+	if qps <= 0 {
+		return nil
+	}
+	return &qpsLimiter{
+		rate:   float64(qps),
+		tokens: float64(qps),
+		last:   time.Now(),
+	}
+}
+
+// Returns true if a query can be answered. Always true for nil limiters.
+func (l *qpsLimiter) allow() bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// Returns the token taken by allow for a query that was refused after all.
+func (l *qpsLimiter) giveBack() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.tokens = min(l.rate, l.tokens+1)
+	l.mu.Unlock()
+}
@@ -0,0 +1,72 @@
+package rdns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenerLimits(t *testing.T) {
+	l := NewListenerLimits("test-limits", ListenerLimitsOptions{MaxQPS: 2, MaxConnections: 1})
+
+	// Bursts of up to a second worth of queries are allowed
+	require.True(t, l.allowQuery())
+	require.True(t, l.allowQuery())
+	require.False(t, l.allowQuery())
+	require.Equal(t, int64(1), l.metrics.queryRejected.Value())
+	time.Sleep(600 * time.Millisecond)
+	require.True(t, l.allowQuery())
+
+	require.True(t, l.acquireConnection())
+	require.False(t, l.acquireConnection())
+	l.releaseConnection()
+	require.True(t, l.acquireConnection())
+	require.Equal(t, int64(1), l.metrics.connRejected.Value())
+
+	// No limits
+	var none *ListenerLimits
+	require.True(t, none.allowQuery())
+	require.True(t, none.acquireConnection())
+}
+
+func TestQueryLimit(t *testing.T) {
+	limits := NewListenerLimits("test-query-limit", ListenerLimitsOptions{MaxQPS: 10})
+	allow := queryLimit(ListenOptions{MaxQPS: 1, Limits: limits})
+	other := queryLimit(ListenOptions{Limits: limits})
+
+	// Another listener uses up the shared limit
+	for i := 0; i < 10; i++ {
+		require.True(t, other())
+	}
+
+	// Queries refused by the shared limit leave the listener's own budget
+	// alone, so it allows a query once the shared limit has room again
+	require.False(t, allow())
+	time.Sleep(150 * time.Millisecond)
+	require.True(t, allow())
+}
+
+func TestDNSListenerMaxQPS(t *testing.T) {
+	upstream := new(TestResolver)
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+
+	// The listener allows more queries than the limits it shares
+	limits := NewListenerLimits("test-ln-qps", ListenerLimitsOptions{MaxQPS: 1})
+	s := NewDNSListener("test-ln-qps", addr, "udp", ListenOptions{MaxQPS: 2, Limits: limits}, upstream)
+	go func() { _ = s.Start() }()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	a, err := dns.Exchange(q, addr)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	a, err = dns.Exchange(q, addr)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+	require.Equal(t, 1, upstream.HitCount())
+}
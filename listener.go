@@ -4,6 +4,7 @@ import (
 	"expvar"
 	"fmt"
 	"net"
+	"time"
 )
 
 // Listener is an interface for a DNS listener.
@@ -26,9 +27,96 @@ type ClientInfo struct {
 	// TLS SNI server name
 	TLSServerName string
 
+	// Identity of the client certificate if the client sent one over TLS. The
+	// name is the subject common name, or the first subject alternative name if
+	// there's no common name. The fingerprint is the hex-encoded SHA-256 hash of
+	// the certificate.
+	TLSClientName        string
+	TLSClientFingerprint string
+
 	// Listener ID of the listener that first received the request. Can be
 	// used to route queries.
 	Listener string
+
+	// Name of the TSIG key the query was signed with, if the listener verified
+	// the signature. Empty for unsigned queries.
+	TSIGKey string
+
+	// Panel user the query belongs to, identified by a token in the TLS server
+	// name or DoH path. Set by the panel blocklist, or by DoH listeners that
+	// authenticate clients. Empty if unknown.
+	User string
+
+	// Query quota of the user from the panel, nil if the panel doesn't have
+	// one for the user. Used by query-quota elements.
+	Quota *QuotaLimits
+
+	// Password or bearer token the client authenticated with on a DoH listener.
+	// The panel blocklist uses it to identify users by their token.
+	AuthSecret string
+
+	// Data of EDNS0 options captured from the query by the listener, by option
+	// code. Used to identify devices behind a shared IP.
+	EDNS0 map[uint16][]byte
+
+	// MAC address of clients on the local network, if the listener resolves them.
+	MAC net.HardwareAddr
+
+	// Address the client originally sent the query to, before it was redirected
+	// to a transparent listener.
+	OriginalDst net.IP
+
+	// Optional proxy to use for queries sent upstream on behalf of this client.
+	// Set by elements such as the panel blocklist, resolvers that support it use
+	// it instead of their configured dialer.
+	Dialer *Socks5Dialer
+
+	// Tags added by routes that matched the query. Routes evaluated later can
+	// match on them.
+	Tags []string
+
+	// Time by which the query has to be answered. Zero if there is no deadline.
+	// Set by listeners and timeout groups, resolvers further down the chain can
+	// only shorten it.
+	Deadline time.Time
+
+	// Optional record of what happened to the query further down the chain,
+	// like whether it was blocked or answered from cache. Set by elements that
+	// report on queries, nil otherwise.
+	Trace *QueryTrace
+}
+
+// HasTag returns true if the query was tagged with the given tag.
+func (ci ClientInfo) HasTag(tag string) bool {
+	for _, t := range ci.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// WithTimeout returns a copy of the client info with the deadline set to the
+// given timeout from now, unless the existing deadline is earlier.
+func (ci ClientInfo) WithTimeout(timeout time.Duration) ClientInfo {
+	if timeout <= 0 {
+		return ci
+	}
+	deadline := time.Now().Add(timeout)
+	if ci.Deadline.IsZero() || deadline.Before(ci.Deadline) {
+		ci.Deadline = deadline
+	}
+	return ci
+}
+
+// Returns the time left until the deadline if it's sooner than the given
+// timeout, otherwise the timeout. Clients use it to stop waiting for the
+// upstream once the query has run out of time.
+func (ci ClientInfo) timeout(timeout time.Duration) time.Duration {
+	if ci.Deadline.IsZero() {
+		return timeout
+	}
+	return min(timeout, time.Until(ci.Deadline))
 }
 
 // Metrics that are available from listeners and clients.
@@ -43,6 +131,17 @@ type ListenerMetrics struct {
 	err *expvar.Map
 	// Maximum number of queries queued (optional).
 	maxQueueLen *expvar.Int
+
+	// Connection metrics, only available from listeners.
+	// Currently open client connections.
+	activeConns *expvar.Int
+	// Queries in progress on DoQ streams and DoH requests.
+	activeStreams *expvar.Int
+	// Failed TLS handshakes by reason.
+	handshakeErr *expvar.Map
+	// Bytes received from and sent to clients.
+	bytesIn  *expvar.Int
+	bytesOut *expvar.Int
 }
 
 func NewListenerMetrics(base string, id string) *ListenerMetrics {
@@ -54,3 +153,13 @@ func NewListenerMetrics(base string, id string) *ListenerMetrics {
 		maxQueueLen: getVarInt(base, id, "maxqueue"),
 	}
 }
+
+// Adds the metrics of client connections to the metrics of a listener.
+func (m *ListenerMetrics) withConnections(id string) *ListenerMetrics {
+	m.activeConns = getVarInt("listener", id, "active-connections")
+	m.activeStreams = getVarInt("listener", id, "active-streams")
+	m.handshakeErr = getVarMap("listener", id, "handshake-error")
+	m.bytesIn = getVarInt("listener", id, "bytes-in")
+	m.bytesOut = getVarInt("listener", id, "bytes-out")
+	return m
+}
@@ -0,0 +1,113 @@
+package rdns
+
+import (
+	"sort"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Answers a zone transfer request (AXFR, RFC 5936, or IXFR, RFC 1995) for a
+// local zone. Transfers are refused unless the client is allowed to make
+// them. Since no history of changes is kept, IXFR requests are answered with
+// the current SOA if the client is up to date, and with a full transfer in
+// AXFR format otherwise. The zone is sent in a single message.
+func (r *LocalZones) transfer(q *dns.Msg, ci ClientInfo, zone string) *dns.Msg {
+	log := logger(r.id, q, ci).WithFields(logrus.Fields{"zone": zone, "key": ci.TSIGKey})
+	question := q.Question[0]
+	a := new(dns.Msg)
+	a.SetReply(q)
+	if canonicalZone(question.Name) != zone {
+		a.Rcode = dns.RcodeNotAuth
+	} else if !r.transferAllowed(ci) {
+		a.Rcode = dns.RcodeRefused
+	}
+	if a.Rcode != dns.RcodeSuccess {
+		r.metrics.transfer.Add(dns.RcodeToString[a.Rcode], 1)
+		log.WithField("rcode", dns.RcodeToString[a.Rcode]).Debug("refusing zone transfer")
+		return a
+	}
+	a.Authoritative = true
+	a.Compress = true
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	soa := localZoneSOA(zone, r.serial)
+	if question.Qtype == dns.TypeIXFR && ixfrUpToDate(q, r.serial) {
+		log.Debug("secondary is up to date, responding with soa")
+		r.metrics.transfer.Add("uptodate", 1)
+		a.Answer = []dns.RR{soa}
+		return a
+	}
+	a.Answer = append(a.Answer, soa, localZoneNS(zone))
+	for _, rr := range r.zoneRecords(zone) {
+		a.Answer = append(a.Answer, dns.Copy(rr))
+	}
+	a.Answer = append(a.Answer, dns.Copy(soa))
+	log.WithField("records", len(a.Answer)).Debug("responding with zone transfer")
+	r.metrics.transfer.Add(dns.TypeToString[question.Qtype], 1)
+	return a
+}
+
+// Returns true if the client may transfer the zones. Clients have to be in
+// one of the allowed networks and, if keys are configured, have signed the
+// request with one of them.
+func (r *LocalZones) transferAllowed(ci ClientInfo) bool {
+	if len(r.TransferAllow) == 0 || !isAllowed(r.TransferAllow, ci.SourceIP) {
+		return false
+	}
+	if len(r.transferKeys) == 0 {
+		return true
+	}
+	_, ok := r.transferKeys[dns.CanonicalName(ci.TSIGKey)]
+	return ok && ci.TSIGKey != ""
+}
+
+// Returns the records in a zone, sorted by owner name. Records of names in
+// more specific local zones are left out. Must be called with the lock held.
+func (r *LocalZones) zoneRecords(zone string) []dns.RR {
+	names := make([]string, 0, len(r.records))
+	for name := range r.records {
+		if z, ok := r.zone(name); ok && z == zone {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var rrs []dns.RR
+	for _, name := range names {
+		rrs = append(rrs, r.records[name]...)
+	}
+	return rrs
+}
+
+// Returns true if the serial in the SOA record of an IXFR request isn't older
+// than the current one, using serial number arithmetic (RFC 1982).
+func ixfrUpToDate(q *dns.Msg, serial uint32) bool {
+	for _, rr := range q.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return int32(serial-soa.Serial) <= 0
+		}
+	}
+	return false
+}
+
+// Returns the NS record of a local zone, which names the zone itself like the
+// SOA record as recommended in RFC 6303.
+func localZoneNS(zone string) dns.RR {
+	return &dns.NS{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeNS,
+			Class:  dns.ClassINET,
+			Ttl:    10800,
+		},
+		Ns: zone,
+	}
+}
+
+// Returns true for zone transfer requests.
+func isTransfer(q *dns.Msg) bool {
+	qtype := q.Question[0].Qtype
+	return q.Opcode == dns.OpcodeQuery && (qtype == dns.TypeAXFR || qtype == dns.TypeIXFR)
+}
@@ -0,0 +1,294 @@
+package rdns
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Applies a dynamic update (RFC 2136) to a local zone and returns the
+// response. The zone section of the update is in the question of the message,
+// the prerequisites are in the answer section and the updates in the
+// authority section.
+func (r *LocalZones) update(q *dns.Msg, ci ClientInfo, zone string) *dns.Msg {
+	log := logger(r.id, q, ci).WithFields(logrus.Fields{"zone": zone, "key": ci.TSIGKey})
+	a := new(dns.Msg)
+	a.SetReply(q)
+	rcode := r.applyUpdate(q, ci, zone)
+	a.Rcode = rcode
+	r.metrics.update.Add(dns.RcodeToString[rcode], 1)
+	log.WithField("rcode", dns.RcodeToString[rcode]).Debug("dynamic update")
+	return a
+}
+
+func (r *LocalZones) applyUpdate(q *dns.Msg, ci ClientInfo, zone string) int {
+	if len(q.Question) != 1 || q.Question[0].Qtype != dns.TypeSOA {
+		return dns.RcodeFormatError
+	}
+	// Updates have to name the zone itself, not a name in it
+	if canonicalZone(q.Question[0].Name) != zone {
+		return dns.RcodeNotAuth
+	}
+	if _, ok := r.updateKeys[dns.CanonicalName(ci.TSIGKey)]; !ok || ci.TSIGKey == "" {
+		return dns.RcodeRefused
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if rcode := r.checkPrerequisites(q.Answer, zone); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+
+	// Apply the updates to a copy of the records, so nothing is changed if
+	// one of them is invalid or the records can't be written
+	records := make(map[string][]dns.RR, len(r.records))
+	for name, rrs := range r.records {
+		records[name] = append([]dns.RR(nil), rrs...)
+	}
+	for _, rr := range q.Ns {
+		if rcode := checkUpdate(rr, zone); rcode != dns.RcodeSuccess {
+			return rcode
+		}
+	}
+	for _, rr := range q.Ns {
+		applyUpdateRR(records, rr, zone)
+	}
+
+	if r.RecordsFile != "" {
+		if err := writeRecords(r.RecordsFile, records); err != nil {
+			Log.WithField("id", r.id).WithError(err).Error("failed to write records")
+			return dns.RcodeServerFailure
+		}
+	}
+	r.records = records
+	r.serial = nextSerial(r.serial)
+	return dns.RcodeSuccess
+}
+
+// Checks the prerequisites of an update as per RFC 2136 section 3.2. Must be
+// called with the lock held.
+func (r *LocalZones) checkPrerequisites(prereqs []dns.RR, zone string) int {
+	// RRsets that have to exist with exactly these records
+	rrsets := make(map[string][]dns.RR)
+	for _, rr := range prereqs {
+		h := rr.Header()
+		name := strings.ToLower(h.Name)
+		if h.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		if !dns.IsSubDomain(zone, name) {
+			return dns.RcodeNotZone
+		}
+		existing := r.records[name]
+		switch h.Class {
+		case dns.ClassANY:
+			if h.Rrtype == dns.TypeANY {
+				if len(existing) == 0 {
+					return dns.RcodeNameError
+				}
+			} else if len(rrsOfType(existing, h.Rrtype)) == 0 {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if h.Rrtype == dns.TypeANY {
+				if len(existing) > 0 {
+					return dns.RcodeYXDomain
+				}
+			} else if len(rrsOfType(existing, h.Rrtype)) > 0 {
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			key := name + "/" + dns.TypeToString[h.Rrtype]
+			rrsets[key] = append(rrsets[key], rr)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	for _, want := range rrsets {
+		h := want[0].Header()
+		have := rrsOfType(r.records[strings.ToLower(h.Name)], h.Rrtype)
+		if len(have) != len(want) {
+			return dns.RcodeNXRrset
+		}
+		for _, rr := range want {
+			if indexOfRR(have, rr) < 0 {
+				return dns.RcodeNXRrset
+			}
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// Checks an update record as per RFC 2136 section 3.4.1.
+func checkUpdate(rr dns.RR, zone string) int {
+	h := rr.Header()
+	if !dns.IsSubDomain(zone, strings.ToLower(h.Name)) {
+		return dns.RcodeNotZone
+	}
+	switch h.Class {
+	case dns.ClassINET:
+		if h.Rrtype == dns.TypeANY || h.Rrtype == dns.TypeAXFR || h.Rrtype == dns.TypeIXFR {
+			return dns.RcodeFormatError
+		}
+	case dns.ClassANY:
+		if h.Ttl != 0 || h.Rrtype == dns.TypeAXFR || h.Rrtype == dns.TypeIXFR {
+			return dns.RcodeFormatError
+		}
+	case dns.ClassNONE:
+		if h.Ttl != 0 || h.Rrtype == dns.TypeANY || h.Rrtype == dns.TypeAXFR || h.Rrtype == dns.TypeIXFR {
+			return dns.RcodeFormatError
+		}
+	default:
+		return dns.RcodeFormatError
+	}
+	return dns.RcodeSuccess
+}
+
+// Applies one update record as per RFC 2136 section 3.4.2. The SOA and NS
+// records of the zone aren't served from the records and can't be changed.
+func applyUpdateRR(records map[string][]dns.RR, rr dns.RR, zone string) {
+	h := rr.Header()
+	name := strings.ToLower(h.Name)
+	if name == zone && (h.Rrtype == dns.TypeSOA || h.Rrtype == dns.TypeNS) {
+		return
+	}
+	existing := records[name]
+	switch h.Class {
+	case dns.ClassINET:
+		// CNAME records can't coexist with other data
+		hasCNAME := len(rrsOfType(existing, dns.TypeCNAME)) > 0
+		if (hasCNAME && h.Rrtype != dns.TypeCNAME) || (!hasCNAME && h.Rrtype == dns.TypeCNAME && len(existing) > 0) {
+			return
+		}
+		rr = dns.Copy(rr)
+		rr.Header().Name = name
+		if i := indexOfRR(existing, rr); i >= 0 {
+			existing[i] = rr
+		} else if h.Rrtype == dns.TypeCNAME {
+			existing = []dns.RR{rr}
+		} else {
+			existing = append(existing, rr)
+		}
+	case dns.ClassANY:
+		if h.Rrtype == dns.TypeANY {
+			existing = nil
+		} else {
+			existing = removeRRs(existing, func(e dns.RR) bool { return e.Header().Rrtype == h.Rrtype })
+		}
+	case dns.ClassNONE:
+		existing = removeRRs(existing, func(e dns.RR) bool {
+			return e.Header().Rrtype == h.Rrtype && equalRData(e, rr)
+		})
+	}
+	if len(existing) == 0 {
+		delete(records, name)
+		return
+	}
+	records[name] = existing
+}
+
+// Returns the records for which remove returns false.
+func removeRRs(rrs []dns.RR, remove func(dns.RR) bool) []dns.RR {
+	var out []dns.RR
+	for _, rr := range rrs {
+		if !remove(rr) {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// Returns the index of the record with the same name, type and data, or -1.
+func indexOfRR(rrs []dns.RR, rr dns.RR) int {
+	for i, e := range rrs {
+		if e.Header().Rrtype == rr.Header().Rrtype && equalRData(e, rr) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Compares the name, type and data of two records, ignoring the class and
+// TTL which differ in the sections of an update.
+func equalRData(a, b dns.RR) bool {
+	b = dns.Copy(b)
+	b.Header().Class = a.Header().Class
+	return dns.IsDuplicate(a, b)
+}
+
+// Returns the serial after an update. Serials are based on the time so they
+// keep increasing across restarts without records file.
+func nextSerial(serial uint32) uint32 {
+	now := uint32(time.Now().Unix())
+	if now > serial {
+		return now
+	}
+	return serial + 1
+}
+
+// Loads the records written by earlier updates. A missing file isn't an
+// error.
+func (r *LocalZones) loadRecords() error {
+	f, err := os.Open(r.RecordsFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zp := dns.NewZoneParser(f, "", r.RecordsFile)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		name := strings.ToLower(rr.Header().Name)
+		if _, ok := r.zone(name); !ok {
+			return fmt.Errorf("record '%s' in '%s' isn't in a local zone", name, r.RecordsFile)
+		}
+		rr.Header().Name = name
+		r.records[name] = append(r.records[name], rr)
+	}
+	if err := zp.Err(); err != nil {
+		return err
+	}
+	if fi, err := f.Stat(); err == nil {
+		r.serial = uint32(fi.ModTime().Unix())
+	}
+	return nil
+}
+
+// Writes records in zone file format, sorted by name. The file is replaced
+// atomically.
+func writeRecords(filename string, records map[string][]dns.RR) error {
+	names := make([]string, 0, len(records))
+	for name := range records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		for _, rr := range records[name] {
+			b.WriteString(rr.String())
+			b.WriteString("\n")
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
@@ -0,0 +1,290 @@
+package rdns
+
+import (
+	"expvar"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// LocalZones is a resolver that answers queries for zones that should never
+// be forwarded to the public DNS locally, and passes everything else on to
+// another resolver. By default, these are the reverse zones of private,
+// loopback and documentation address space listed in RFC 6303 and served by
+// AS112, as well as special-use names like "onion." (RFC 7686) and
+// "home.arpa." (RFC 8375). Names below a zone are answered with NXDOMAIN, the
+// zone apex with NODATA, both with the zone's SOA record in the authority
+// section. Records can be added to the zones with signed dynamic updates
+// (RFC 2136), and the zones can be transferred to secondaries (AXFR/IXFR).
+type LocalZones struct {
+	id string
+	LocalZonesOptions
+	resolver     Resolver
+	zones        map[string]struct{}
+	updateKeys   map[string]struct{}
+	transferKeys map[string]struct{}
+	metrics      *LocalZonesMetrics
+
+	// Records added with dynamic updates by lower-case owner name, and the
+	// serial of the zones which changes with every update.
+	mu      sync.RWMutex
+	records map[string][]dns.RR
+	serial  uint32
+}
+
+var _ Resolver = &LocalZones{}
+
+type LocalZonesOptions struct {
+	// Additional zones to answer locally.
+	Zones []string
+
+	// Default zones to forward anyway, for example reverse zones of private
+	// address space served by a local DNS server.
+	Exclude []string
+
+	// Don't answer the default zones locally, only those in Zones.
+	NoDefaults bool
+
+	// Names of TSIG keys that are allowed to send dynamic updates. Updates
+	// are refused if they aren't signed with one of these keys, which have to
+	// be configured on the listener as well.
+	UpdateKeys []string
+
+	// File that records added with dynamic updates are written to, and loaded
+	// from on startup. Records are lost on restart without it.
+	RecordsFile string
+
+	// Networks of secondaries allowed to transfer the zones. Transfers are
+	// refused without.
+	TransferAllow []*net.IPNet
+
+	// Names of TSIG keys that zone transfers have to be signed with, in
+	// addition to coming from an allowed network. Optional.
+	TransferKeys []string
+}
+
+type LocalZonesMetrics struct {
+	// Queries answered locally.
+	answered *expvar.Int
+	// Dynamic updates by response code.
+	update *expvar.Map
+	// Zone transfers by type, or response code if refused.
+	transfer *expvar.Map
+}
+
+// Zones answered locally by default, RFC 6303 and special-use names.
+var defaultLocalZones = func() []string {
+	zones := []string{
+		// RFC 1918 private address space
+		"10.in-addr.arpa.",
+		"168.192.in-addr.arpa.",
+
+		// "This" network, loopback and link-local
+		"0.in-addr.arpa.",
+		"127.in-addr.arpa.",
+		"254.169.in-addr.arpa.",
+
+		// Documentation address space (TEST-NET-1/2/3) and broadcast
+		"2.0.192.in-addr.arpa.",
+		"100.51.198.in-addr.arpa.",
+		"113.0.203.in-addr.arpa.",
+		"255.255.255.255.in-addr.arpa.",
+
+		// IPv6 unspecified and loopback addresses
+		"0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.",
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.",
+
+		// IPv6 unique local, link-local and documentation address space
+		"c.f.ip6.arpa.",
+		"d.f.ip6.arpa.",
+		"8.e.f.ip6.arpa.",
+		"9.e.f.ip6.arpa.",
+		"a.e.f.ip6.arpa.",
+		"b.e.f.ip6.arpa.",
+		"8.b.d.0.1.0.0.2.ip6.arpa.",
+
+		// Special-use names
+		"onion.",
+		"invalid.",
+		"home.arpa.",
+	}
+	for i := 16; i <= 31; i++ {
+		zones = append(zones, strconv.Itoa(i)+".172.in-addr.arpa.")
+	}
+	// Shared address space for carrier-grade NAT (RFC 6598)
+	for i := 64; i <= 127; i++ {
+		zones = append(zones, strconv.Itoa(i)+".100.in-addr.arpa.")
+	}
+	return zones
+}()
+
+// NewLocalZones returns a new instance of a resolver for local zones.
+func NewLocalZones(id string, resolver Resolver, opt LocalZonesOptions) (*LocalZones, error) {
+	zones := make(map[string]struct{})
+	if !opt.NoDefaults {
+		for _, zone := range defaultLocalZones {
+			zones[zone] = struct{}{}
+		}
+	}
+	for _, zone := range opt.Zones {
+		zones[canonicalZone(zone)] = struct{}{}
+	}
+	for _, zone := range opt.Exclude {
+		delete(zones, canonicalZone(zone))
+	}
+	updateKeys := make(map[string]struct{})
+	for _, key := range opt.UpdateKeys {
+		updateKeys[dns.CanonicalName(key)] = struct{}{}
+	}
+	transferKeys := make(map[string]struct{})
+	for _, key := range opt.TransferKeys {
+		transferKeys[dns.CanonicalName(key)] = struct{}{}
+	}
+	r := &LocalZones{
+		id:                id,
+		LocalZonesOptions: opt,
+		resolver:          resolver,
+		zones:             zones,
+		updateKeys:        updateKeys,
+		transferKeys:      transferKeys,
+		records:           make(map[string][]dns.RR),
+		serial:            1,
+		metrics: &LocalZonesMetrics{
+			answered: getVarInt("local-zones", id, "answered"),
+			update:   getVarMap("local-zones", id, "update"),
+			transfer: getVarMap("local-zones", id, "transfer"),
+		},
+	}
+	if opt.RecordsFile != "" {
+		if err := r.loadRecords(); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Resolve a DNS query locally if it is in one of the zones, or forward it to
+// the upstream resolver.
+func (r *LocalZones) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return r.resolver.Resolve(q, ci)
+	}
+	question := q.Question[0]
+	zone, ok := r.zone(question.Name)
+	if !ok {
+		return r.resolver.Resolve(q, ci)
+	}
+	if q.Opcode == dns.OpcodeUpdate {
+		return r.update(q, ci, zone), nil
+	}
+	if isTransfer(q) {
+		return r.transfer(q, ci, zone), nil
+	}
+	r.metrics.answered.Add(1)
+	log := logger(r.id, q, ci).WithField("zone", zone)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	a := new(dns.Msg)
+	a.SetReply(q)
+	a.Authoritative = true
+	soa := localZoneSOA(zone, r.serial)
+	name := strings.ToLower(question.Name)
+	if rrs, ok := r.records[name]; ok {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == question.Qtype || rr.Header().Rrtype == dns.TypeCNAME {
+				a.Answer = append(a.Answer, dns.Copy(rr))
+			}
+		}
+		if len(a.Answer) > 0 {
+			log.Debug("responding with records of local zone")
+			// Keep the owner name as given in the query
+			for _, rr := range a.Answer {
+				rr.Header().Name = question.Name
+			}
+			return a, nil
+		}
+	}
+	switch {
+	case name == zone && question.Qtype == dns.TypeSOA:
+		log.Debug("responding with soa of local zone")
+		a.Answer = []dns.RR{soa}
+	case name == zone && question.Qtype == dns.TypeNS:
+		log.Debug("responding with ns of local zone")
+		a.Answer = []dns.RR{localZoneNS(zone)}
+	case name == zone || r.nameExists(name):
+		log.Debug("name in local zone without records of the type, responding with nodata")
+		a.Ns = []dns.RR{soa}
+	default:
+		log.Debug("name in local zone, responding with nxdomain")
+		a.SetRcode(q, dns.RcodeNameError)
+		a.Ns = []dns.RR{soa}
+	}
+	return a, nil
+}
+
+// Returns true if there are records for the name or names below it. Must be
+// called with the lock held.
+func (r *LocalZones) nameExists(name string) bool {
+	if _, ok := r.records[name]; ok {
+		return true
+	}
+	for owner := range r.records {
+		if strings.HasSuffix(owner, "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *LocalZones) String() string {
+	return r.id
+}
+
+// Check Cert
+func (r *LocalZones) CertMonitor() error {
+	return nil
+}
+
+// Returns the local zone a name is in, if any.
+func (r *LocalZones) zone(name string) (string, bool) {
+	name = canonicalZone(name)
+	for {
+		if _, ok := r.zones[name]; ok {
+			return name, true
+		}
+		i := strings.Index(name, ".")
+		if i < 0 || i == len(name)-1 {
+			return "", false
+		}
+		name = name[i+1:]
+	}
+}
+
+// Returns the SOA record of a local zone as recommended in RFC 6303.
+func localZoneSOA(zone string, serial uint32) dns.RR {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    10800,
+		},
+		Ns:      zone,
+		Mbox:    "nobody.invalid.",
+		Serial:  serial,
+		Refresh: 3600,
+		Retry:   1200,
+		Expire:  604800,
+		Minttl:  10800,
+	}
+}
+
+// Returns a zone name in lower case and fully qualified.
+func canonicalZone(zone string) string {
+	return dns.Fqdn(strings.ToLower(strings.TrimSpace(zone)))
+}
@@ -0,0 +1,225 @@
+package rdns
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalZones(t *testing.T) {
+	var ci ClientInfo
+	upstream := new(TestResolver)
+	r, err := NewLocalZones("test-local-zones", upstream, LocalZonesOptions{
+		Zones:   []string{"corp.example"},
+		Exclude: []string{"168.192.in-addr.arpa"},
+	})
+	require.NoError(t, err)
+
+	resolve := func(name string, qtype uint16) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		a, err := r.Resolve(q, ci)
+		require.NoError(t, err)
+		return a
+	}
+
+	// Names in local zones are answered with NXDOMAIN and the SOA
+	a := resolve("1.0.0.10.in-addr.arpa.", dns.TypePTR)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Len(t, a.Ns, 1)
+	require.Equal(t, "10.in-addr.arpa.", a.Ns[0].Header().Name)
+	require.Equal(t, dns.RcodeNameError, resolve("1.0.20.172.IN-ADDR.ARPA.", dns.TypePTR).Rcode)
+	require.Equal(t, dns.RcodeNameError, resolve("hidden.onion.", dns.TypeA).Rcode)
+	require.Equal(t, dns.RcodeNameError, resolve("printer.home.arpa.", dns.TypeA).Rcode)
+	require.Equal(t, dns.RcodeNameError, resolve("host.corp.example.", dns.TypeA).Rcode)
+
+	// The zone apex is answered with NODATA, or its SOA
+	a = resolve("onion.", dns.TypeA)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Empty(t, a.Answer)
+	require.Len(t, a.Ns, 1)
+	a = resolve("onion.", dns.TypeSOA)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, 0, upstream.HitCount())
+
+	// Excluded and other zones are forwarded
+	resolve("1.1.168.192.in-addr.arpa.", dns.TypePTR)
+	resolve("1.0.32.172.in-addr.arpa.", dns.TypePTR)
+	resolve("example.com.", dns.TypeA)
+	require.Equal(t, 3, upstream.HitCount())
+}
+
+func TestLocalZonesUpdate(t *testing.T) {
+	ci := ClientInfo{TSIGKey: "dhcp."}
+	recordsFile := filepath.Join(t.TempDir(), "records")
+	opt := LocalZonesOptions{
+		Zones:       []string{"lan."},
+		NoDefaults:  true,
+		UpdateKeys:  []string{"dhcp."},
+		RecordsFile: recordsFile,
+	}
+	r, err := NewLocalZones("test-local-zones-update", new(TestResolver), opt)
+	require.NoError(t, err)
+
+	update := func(r *LocalZones, ci ClientInfo, build func(u *dns.Msg)) int {
+		u := new(dns.Msg)
+		u.SetUpdate("lan.")
+		build(u)
+		a, err := r.Resolve(u, ci)
+		require.NoError(t, err)
+		return a.Rcode
+	}
+	resolve := func(r *LocalZones, name string, qtype uint16) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		a, err := r.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		return a
+	}
+	rr := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		require.NoError(t, err)
+		return rr
+	}
+
+	// Add records, only allowed with the right key
+	add := func(u *dns.Msg) {
+		u.Insert([]dns.RR{rr("host.lan. 300 IN A 192.168.1.10"), rr("host.lan. 300 IN AAAA fd00::10")})
+	}
+	require.Equal(t, dns.RcodeRefused, update(r, ClientInfo{}, add))
+	require.Equal(t, dns.RcodeRefused, update(r, ClientInfo{TSIGKey: "other."}, add))
+	serial := resolve(r, "lan.", dns.TypeSOA).Answer[0].(*dns.SOA).Serial
+	require.Equal(t, dns.RcodeSuccess, update(r, ci, add))
+	require.Greater(t, resolve(r, "lan.", dns.TypeSOA).Answer[0].(*dns.SOA).Serial, serial)
+
+	a := resolve(r, "HOST.lan.", dns.TypeA)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.True(t, a.Authoritative)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "192.168.1.10", a.Answer[0].(*dns.A).A.String())
+	require.Equal(t, "HOST.lan.", a.Answer[0].Header().Name)
+
+	// Existing names without records of the type and empty non-terminals
+	// are NODATA, other names NXDOMAIN
+	a = resolve(r, "host.lan.", dns.TypeMX)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Empty(t, a.Answer)
+	require.Equal(t, dns.RcodeSuccess, update(r, ci, func(u *dns.Msg) {
+		u.Insert([]dns.RR{rr("_acme-challenge.www.lan. 60 IN TXT token")})
+	}))
+	require.Equal(t, dns.RcodeSuccess, resolve(r, "www.lan.", dns.TypeA).Rcode)
+	require.Equal(t, dns.RcodeNameError, resolve(r, "other.lan.", dns.TypeA).Rcode)
+
+	// Prerequisites
+	require.Equal(t, dns.RcodeYXDomain, update(r, ci, func(u *dns.Msg) {
+		u.NameNotUsed([]dns.RR{rr("host.lan. A 0.0.0.0")})
+		add(u)
+	}))
+	require.Equal(t, dns.RcodeNXRrset, update(r, ci, func(u *dns.Msg) {
+		u.RRsetUsed([]dns.RR{rr("host.lan. MX 10 mail.lan.")})
+	}))
+	require.Equal(t, dns.RcodeNXRrset, update(r, ci, func(u *dns.Msg) {
+		u.Used([]dns.RR{rr("host.lan. A 192.168.1.11")})
+	}))
+	require.Equal(t, dns.RcodeNotZone, update(r, ci, func(u *dns.Msg) {
+		u.Insert([]dns.RR{rr("host.example.com. 300 IN A 192.168.1.10")})
+	}))
+
+	// Delete a record and an RRset, and check what is persisted
+	require.Equal(t, dns.RcodeSuccess, update(r, ci, func(u *dns.Msg) {
+		u.Used([]dns.RR{rr("host.lan. A 192.168.1.10")})
+		u.Remove([]dns.RR{rr("host.lan. A 192.168.1.10")})
+		u.RemoveRRset([]dns.RR{rr("_acme-challenge.www.lan. TXT token")})
+	}))
+	require.Empty(t, resolve(r, "host.lan.", dns.TypeA).Answer)
+	require.Len(t, resolve(r, "host.lan.", dns.TypeAAAA).Answer, 1)
+	require.Equal(t, dns.RcodeNameError, resolve(r, "www.lan.", dns.TypeA).Rcode)
+
+	// Records are loaded from the file on startup
+	r, err = NewLocalZones("test-local-zones-update", new(TestResolver), opt)
+	require.NoError(t, err)
+	require.Len(t, resolve(r, "host.lan.", dns.TypeAAAA).Answer, 1)
+	require.Empty(t, resolve(r, "host.lan.", dns.TypeA).Answer)
+
+	// Updates for names below a zone aren't accepted
+	u := new(dns.Msg)
+	u.SetUpdate("host.lan.")
+	a, err = r.Resolve(u, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNotAuth, a.Rcode)
+}
+
+func TestLocalZonesTransfer(t *testing.T) {
+	_, allowed, err := net.ParseCIDR("192.168.1.0/24")
+	require.NoError(t, err)
+	r, err := NewLocalZones("test-local-zones-transfer", new(TestResolver), LocalZonesOptions{
+		Zones:         []string{"lan.", "sub.lan."},
+		NoDefaults:    true,
+		UpdateKeys:    []string{"dhcp."},
+		TransferAllow: []*net.IPNet{allowed},
+	})
+	require.NoError(t, err)
+	secondary := ClientInfo{SourceIP: net.ParseIP("192.168.1.2")}
+
+	u := new(dns.Msg)
+	u.SetUpdate("lan.")
+	u.Insert([]dns.RR{
+		mustRR(t, "host.lan. 300 IN A 192.168.1.10"),
+		mustRR(t, "a.lan. 300 IN A 192.168.1.11"),
+	})
+	_, err = r.Resolve(u, ClientInfo{TSIGKey: "dhcp."})
+	require.NoError(t, err)
+	u = new(dns.Msg)
+	u.SetUpdate("sub.lan.")
+	u.Insert([]dns.RR{mustRR(t, "host.sub.lan. 300 IN A 192.168.1.12")})
+	_, err = r.Resolve(u, ClientInfo{TSIGKey: "dhcp."})
+	require.NoError(t, err)
+
+	transfer := func(ci ClientInfo, name string, qtype uint16, serial uint32) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		if qtype == dns.TypeIXFR {
+			q.Ns = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeSOA, Class: dns.ClassINET}, Serial: serial}}
+		}
+		a, err := r.Resolve(q, ci)
+		require.NoError(t, err)
+		return a
+	}
+
+	// Transfers are only allowed from the configured networks, and only for
+	// the zone apex
+	require.Equal(t, dns.RcodeRefused, transfer(ClientInfo{SourceIP: net.ParseIP("10.0.0.1")}, "lan.", dns.TypeAXFR, 0).Rcode)
+	require.Equal(t, dns.RcodeNotAuth, transfer(secondary, "host.lan.", dns.TypeAXFR, 0).Rcode)
+
+	// The zone starts and ends with the SOA, names of more specific zones
+	// are left out
+	a := transfer(secondary, "lan.", dns.TypeAXFR, 0)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Len(t, a.Answer, 5)
+	soa := a.Answer[0].(*dns.SOA)
+	require.Equal(t, dns.TypeNS, a.Answer[1].Header().Rrtype)
+	require.Equal(t, "a.lan.", a.Answer[2].Header().Name)
+	require.Equal(t, "host.lan.", a.Answer[3].Header().Name)
+	require.Equal(t, soa.Serial, a.Answer[4].(*dns.SOA).Serial)
+
+	// IXFR gets the current SOA if the secondary is up to date, the whole
+	// zone otherwise
+	a = transfer(secondary, "lan.", dns.TypeIXFR, soa.Serial)
+	require.Len(t, a.Answer, 1)
+	require.Len(t, transfer(secondary, "lan.", dns.TypeIXFR, soa.Serial-1).Answer, 5)
+
+	// With keys, transfers have to be signed as well
+	r.transferKeys = map[string]struct{}{"xfr.": {}}
+	require.Equal(t, dns.RcodeRefused, transfer(secondary, "lan.", dns.TypeAXFR, 0).Rcode)
+	secondary.TSIGKey = "xfr."
+	require.Equal(t, dns.RcodeSuccess, transfer(secondary, "lan.", dns.TypeAXFR, 0).Rcode)
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	require.NoError(t, err)
+	return rr
+}
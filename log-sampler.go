@@ -0,0 +1,72 @@
+package rdns
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// LogSampler decides which queries are logged by query-logging elements such as
+// syslog, so logging stays affordable at high query rates. One in every N
+// queries is logged, with N configurable per client network. Queries that
+// failed or were not answered with NOERROR, for example because they were
+// blocked, can be logged regardless.
+type LogSampler struct {
+	opt LogSamplerOptions
+	n   atomic.Uint64
+}
+
+// LogSamplerOptions contains the sampling settings of query-logging elements.
+type LogSamplerOptions struct {
+	// Log one in every Rate queries. All queries are logged if 0 or 1.
+	Rate uint64
+
+	// Always log queries that failed, were dropped, or answered with a response
+	// code other than NOERROR, like NXDOMAIN or REFUSED from blocklists.
+	AlwaysLogFailures bool
+
+	// Sampling rates for queries from specific client networks, overriding
+	// Rate. The first matching network is used.
+	Overrides []LogSampleOverride
+}
+
+// LogSampleOverride is the sampling rate for queries from a client network.
+type LogSampleOverride struct {
+	Net  *net.IPNet
+	Rate uint64
+}
+
+// NewLogSampler returns a new sampler for query logs.
+func NewLogSampler(opt LogSamplerOptions) *LogSampler {
+	return &LogSampler{opt: opt}
+}
+
+// Sample returns true if the query from the client is to be logged. Queries
+// that aren't sampled can still be logged by calling Notable once the response
+// is known.
+func (s *LogSampler) Sample(ci ClientInfo) bool {
+	if s == nil {
+		return true
+	}
+	rate := s.opt.Rate
+	for _, o := range s.opt.Overrides {
+		if o.Net.Contains(ci.SourceIP) {
+			rate = o.Rate
+			break
+		}
+	}
+	if rate <= 1 {
+		return true
+	}
+	return s.n.Add(1)%rate == 0
+}
+
+// Notable returns true if the query is to be logged regardless of sampling,
+// based on its response.
+func (s *LogSampler) Notable(a *dns.Msg, err error) bool {
+	if s == nil || !s.opt.AlwaysLogFailures {
+		return false
+	}
+	return err != nil || a == nil || a.Rcode != dns.RcodeSuccess
+}
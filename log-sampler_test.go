@@ -0,0 +1,52 @@
+package rdns
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogSampler(t *testing.T) {
+	_, override, err := net.ParseCIDR("192.168.1.0/24")
+	require.NoError(t, err)
+	s := NewLogSampler(LogSamplerOptions{
+		Rate:              10,
+		AlwaysLogFailures: true,
+		Overrides:         []LogSampleOverride{{Net: override, Rate: 1}},
+	})
+
+	// One in 10 queries is sampled
+	ci := ClientInfo{SourceIP: net.ParseIP("10.0.0.1")}
+	var sampled int
+	for i := 0; i < 100; i++ {
+		if s.Sample(ci) {
+			sampled++
+		}
+	}
+	require.Equal(t, 10, sampled)
+
+	// All queries from the override network are sampled
+	ci = ClientInfo{SourceIP: net.ParseIP("192.168.1.10")}
+	for i := 0; i < 10; i++ {
+		require.True(t, s.Sample(ci))
+	}
+
+	// Failures are always logged
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+	a := new(dns.Msg)
+	a.SetReply(q)
+	require.False(t, s.Notable(a, nil))
+	require.True(t, s.Notable(nil, nil))
+	require.True(t, s.Notable(nil, errors.New("failed")))
+	a.Rcode = dns.RcodeNameError
+	require.True(t, s.Notable(a, nil))
+
+	// Without a sampler, everything is logged
+	var none *LogSampler
+	require.True(t, none.Sample(ci))
+	require.False(t, none.Notable(a, nil))
+}
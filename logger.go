@@ -10,10 +10,20 @@ import (
 var Log = logrus.New()
 
 func logger(id string, q *dns.Msg, ci ClientInfo) *logrus.Entry {
-	return Log.WithFields(logrus.Fields{
+	fields := logrus.Fields{
 		"id":     id,
 		"client": ci.SourceIP,
 		"qtype":  dns.Type(q.Question[0].Qtype).String(),
 		"qname":  qName(q),
-	})
+	}
+	if ci.User != "" {
+		fields["user"] = ci.User
+	}
+	if ci.MAC != nil {
+		fields["mac"] = ci.MAC.String()
+	}
+	if ci.OriginalDst != nil {
+		fields["original-dst"] = ci.OriginalDst.String()
+	}
+	return Log.WithFields(fields)
 }
@@ -0,0 +1,150 @@
+package rdns
+
+import (
+	"bytes"
+	"crypto/rand"
+	"expvar"
+
+	"github.com/miekg/dns"
+)
+
+// LoopGuardOptionCode is the EDNS0 option code, from the local/experimental
+// range, that carries the IDs of RouteDNS instances a query passed through.
+const LoopGuardOptionCode = 65431
+
+// Maximum number of RouteDNS instances a query can pass through.
+const maxLoopGuardHops = 16
+
+// Length of an instance ID in the loop guard option.
+const loopGuardIDLen = 8
+
+// ID of this instance, added to queries sent upstream by a loop guard.
+var loopGuardID = func() []byte {
+	id := make([]byte, loopGuardIDLen)
+	_, _ = rand.Read(id)
+	return id
+}()
+
+// LoopGuard adds the ID of this instance to queries before they're passed to
+// the upstream resolver, in an EDNS0 option. If a misconfigured upstream sends
+// a query back to a listener of the same instance, the listener recognizes
+// its own ID and fails the query instead of forwarding it in circles until
+// all sockets are exhausted. Queries that passed through too many instances
+// are failed as well.
+type LoopGuard struct {
+	id       string
+	resolver Resolver
+	metrics  *LoopGuardMetrics
+}
+
+var _ Resolver = &LoopGuard{}
+
+type LoopGuardMetrics struct {
+	// Queries marked with the instance ID.
+	marked *expvar.Int
+}
+
+// NewLoopGuard returns a new instance of a loop guard.
+func NewLoopGuard(id string, resolver Resolver) *LoopGuard {
+	return &LoopGuard{
+		id:       id,
+		resolver: resolver,
+		metrics: &LoopGuardMetrics{
+			marked: getVarInt("loop-guard", id, "marked"),
+		},
+	}
+}
+
+// Resolve a DNS query after adding the instance ID to it.
+func (r *LoopGuard) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	// The query is shared with other resolvers, work on a copy
+	q = q.Copy()
+	edns0 := q.IsEdns0()
+	added := edns0 == nil
+	if added {
+		q.SetEdns0(1232, false)
+		edns0 = q.IsEdns0()
+	}
+	var opt *dns.EDNS0_LOCAL
+	for _, o := range edns0.Option {
+		if o, ok := o.(*dns.EDNS0_LOCAL); ok && o.Code == LoopGuardOptionCode {
+			opt = o
+			break
+		}
+	}
+	if opt == nil {
+		opt = &dns.EDNS0_LOCAL{Code: LoopGuardOptionCode}
+		edns0.Option = append(edns0.Option, opt)
+	}
+	if !loopGuardSeen(opt.Data) {
+		opt.Data = append(bytes.Clone(opt.Data), loopGuardID...)
+		r.metrics.marked.Add(1)
+	}
+
+	a, err := r.resolver.Resolve(q, ci)
+	if err != nil || a == nil {
+		return a, err
+	}
+	// Don't return an OPT record to a client that didn't send one
+	if added {
+		a.Extra = filterRRs(a.Extra, new(int), func(rr dns.RR) bool {
+			return rr.Header().Rrtype != dns.TypeOPT
+		})
+	}
+	return a, nil
+}
+
+// Close closes the guarded resolver.
+func (r *LoopGuard) Close() error {
+	closeResolver(r.resolver)
+	return nil
+}
+
+func (r *LoopGuard) String() string {
+	return r.id
+}
+
+// Check Cert
+func (r *LoopGuard) CertMonitor() error {
+	return nil
+}
+
+// Returns an error if a query received by a listener went through this
+// instance before, or through too many instances.
+func checkLoop(q *dns.Msg) error {
+	edns0 := q.IsEdns0()
+	if edns0 == nil {
+		return nil
+	}
+	for _, o := range edns0.Option {
+		o, ok := o.(*dns.EDNS0_LOCAL)
+		if !ok || o.Code != LoopGuardOptionCode {
+			continue
+		}
+		hops := len(o.Data) / loopGuardIDLen
+		if loopGuardSeen(o.Data) || hops >= maxLoopGuardHops {
+			return QueryLoopError{query: q, hops: hops}
+		}
+	}
+	return nil
+}
+
+// Returns true if the instance IDs in the loop guard option contain the ID
+// of this instance.
+func loopGuardSeen(data []byte) bool {
+	for i := 0; i+loopGuardIDLen <= len(data); i += loopGuardIDLen {
+		if bytes.Equal(data[i:i+loopGuardIDLen], loopGuardID) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolves a query received by a listener, unless it's looping. The deadline
+// set by the listener is enforced, see resolveByDeadline.
+func resolveIncoming(r Resolver, q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if err := checkLoop(q); err != nil {
+		return nil, err
+	}
+	return resolveByDeadline(r, q, ci)
+}
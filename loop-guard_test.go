@@ -0,0 +1,72 @@
+package rdns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoopGuard(t *testing.T) {
+	var forwarded *dns.Msg
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			forwarded = q
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.SetEdns0(1232, false)
+			return a, nil
+		},
+	}
+	r := NewLoopGuard("test-loop-guard", upstream)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	require.NoError(t, checkLoop(q))
+
+	// The query is marked and the OPT record added for it removed from the answer
+	a, err := r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Nil(t, a.IsEdns0())
+	require.Nil(t, q.IsEdns0())
+	require.ErrorAs(t, checkLoop(forwarded), &QueryLoopError{})
+
+	// Queries marked by other instances pass, this instance's ID is appended
+	q.SetEdns0(1232, false)
+	q.IsEdns0().Option = append(q.IsEdns0().Option, &dns.EDNS0_LOCAL{
+		Code: LoopGuardOptionCode,
+		Data: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+	})
+	require.NoError(t, checkLoop(q))
+	_, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	opt := forwarded.IsEdns0().Option[0].(*dns.EDNS0_LOCAL)
+	require.Len(t, opt.Data, 2*loopGuardIDLen)
+	require.ErrorAs(t, checkLoop(forwarded), &QueryLoopError{})
+
+	// Too many hops
+	q.IsEdns0().Option[0].(*dns.EDNS0_LOCAL).Data = make([]byte, maxLoopGuardHops*loopGuardIDLen)
+	require.ErrorAs(t, checkLoop(q), &QueryLoopError{})
+}
+
+func TestLoopGuardListener(t *testing.T) {
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+
+	// Listener with an upstream that points back at it
+	client, err := NewDNSClient("test-loop-client", addr, "udp", DNSClientOptions{})
+	require.NoError(t, err)
+	s := NewDNSListener("test-loop-ln", addr, "udp", ListenOptions{}, NewLoopGuard("test-loop-guard", client))
+	go func() { _ = s.Start() }()
+	defer s.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	// The looping query fails right away rather than timing out
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	c := new(dns.Client)
+	a, _, err := c.Exchange(q, addr)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeServerFailure, a.Rcode)
+}
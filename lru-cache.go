@@ -194,7 +194,8 @@ func (c *lruCache) serialize(w io.Writer) error {
 	return nil
 }
 
-func (c *lruCache) deserialize(r io.Reader) error {
+// Reads serialized cache items and calls the provided function for each valid one.
+func deserializeCacheItems(r io.Reader, f func(*cacheItem)) error {
 	dec := json.NewDecoder(r)
 	for dec.More() {
 		item := new(cacheItem)
@@ -205,7 +206,7 @@ func (c *lruCache) deserialize(r io.Reader) error {
 		if item.Key.Question.Name == "" || item.Answer == nil {
 			continue
 		}
-		c.addKey(item.Key, item.Answer)
+		f(item)
 	}
 	return nil
 }
@@ -0,0 +1,85 @@
+package rdns
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// MACTable resolves the MAC address of clients on the local network. Addresses
+// are looked up in a static map first, then in the neighbour (ARP/NDP) table of
+// the system which is cached and re-read once it's older than the refresh
+// interval. Only clients on a directly connected network can be found in the
+// neighbour table.
+type MACTable struct {
+	opt MACTableOptions
+
+	mu        sync.Mutex
+	neighbors map[string]net.HardwareAddr
+	loaded    time.Time
+	failed    bool
+}
+
+// MACTableOptions contain settings for the MAC address lookup.
+type MACTableOptions struct {
+	// MAC addresses by client IP, used before the neighbour table.
+	Static map[string]net.HardwareAddr
+
+	// Don't read the system neighbour table, only use the static map.
+	StaticOnly bool
+
+	// Time after which the neighbour table is read again. Defaults to 10 seconds.
+	RefreshInterval time.Duration
+}
+
+// NewMACTable returns a new MAC address lookup.
+func NewMACTable(opt MACTableOptions) *MACTable {
+	if opt.RefreshInterval == 0 {
+		opt.RefreshInterval = 10 * time.Second
+	}
+	static := make(map[string]net.HardwareAddr, len(opt.Static))
+	for ip, mac := range opt.Static {
+		if addr := net.ParseIP(ip); addr != nil {
+			ip = addr.String()
+		}
+		static[ip] = mac
+	}
+	opt.Static = static
+	return &MACTable{opt: opt}
+}
+
+// Lookup returns the MAC address of a client IP, or nil if it's not known.
+func (t *MACTable) Lookup(ip net.IP) net.HardwareAddr {
+	if t == nil || ip == nil {
+		return nil
+	}
+	key := ip.String()
+	if mac, ok := t.opt.Static[key]; ok {
+		return mac
+	}
+	if t.opt.StaticOnly {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if time.Since(t.loaded) > t.opt.RefreshInterval {
+		t.refresh()
+	}
+	return t.neighbors[key]
+}
+
+// Reads the neighbour table of the system. Failures are logged once, the table
+// is tried again after the refresh interval.
+func (t *MACTable) refresh() {
+	t.loaded = time.Now()
+	neighbors, err := readNeighbors()
+	if err != nil {
+		if !t.failed {
+			Log.WithError(err).Error("failed to read neighbour table")
+		}
+		t.failed = true
+		return
+	}
+	t.failed = false
+	t.neighbors = neighbors
+}
@@ -0,0 +1,68 @@
+package rdns
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+)
+
+// Neighbour table attributes and states, see linux/neighbour.h.
+const (
+	ndaDst         = 1
+	ndaLLAddr      = 2
+	nudIncomplete  = 0x01
+	nudFailed      = 0x20
+	nudNoARP       = 0x40
+	ndMsgLen       = 12
+	rtAttrAlignLen = 4
+)
+
+// Reads the ARP and NDP entries of the system via netlink and returns the MAC
+// addresses by IP.
+func readNeighbors() (map[string]net.HardwareAddr, error) {
+	b, err := syscall.NetlinkRIB(syscall.RTM_GETNEIGH, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(b)
+	if err != nil {
+		return nil, err
+	}
+	neighbors := make(map[string]net.HardwareAddr)
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWNEIGH || len(m.Data) < ndMsgLen {
+			continue
+		}
+		state := binary.NativeEndian.Uint16(m.Data[8:10])
+		if state&(nudIncomplete|nudFailed|nudNoARP) != 0 {
+			continue
+		}
+		var (
+			ip  net.IP
+			mac net.HardwareAddr
+		)
+		for attrs := m.Data[ndMsgLen:]; len(attrs) >= syscall.SizeofRtAttr; {
+			l := int(binary.NativeEndian.Uint16(attrs[0:2]))
+			if l < syscall.SizeofRtAttr || l > len(attrs) {
+				break
+			}
+			value := attrs[syscall.SizeofRtAttr:l]
+			switch binary.NativeEndian.Uint16(attrs[2:4]) {
+			case ndaDst:
+				ip = net.IP(append([]byte(nil), value...))
+			case ndaLLAddr:
+				mac = net.HardwareAddr(append([]byte(nil), value...))
+			}
+			l = (l + rtAttrAlignLen - 1) &^ (rtAttrAlignLen - 1)
+			if l > len(attrs) {
+				break
+			}
+			attrs = attrs[l:]
+		}
+		if ip == nil || len(mac) == 0 {
+			continue
+		}
+		neighbors[ip.String()] = mac
+	}
+	return neighbors, nil
+}
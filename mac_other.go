@@ -0,0 +1,12 @@
+//go:build !linux
+
+package rdns
+
+import (
+	"errors"
+	"net"
+)
+
+func readNeighbors() (map[string]net.HardwareAddr, error) {
+	return nil, errors.New("reading the neighbour table is not supported on this platform")
+}
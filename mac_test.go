@@ -0,0 +1,24 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMACTableStatic(t *testing.T) {
+	mac, err := net.ParseMAC("00:1a:2b:3c:4d:5e")
+	require.NoError(t, err)
+	table := NewMACTable(MACTableOptions{
+		Static:     map[string]net.HardwareAddr{"192.168.1.10": mac, "fd00::0010": mac},
+		StaticOnly: true,
+	})
+	require.Equal(t, mac, table.Lookup(net.ParseIP("192.168.1.10")))
+	require.Equal(t, mac, table.Lookup(net.ParseIP("fd00::10")))
+	require.Nil(t, table.Lookup(net.ParseIP("192.168.1.11")))
+
+	// A nil table doesn't resolve anything
+	var none *MACTable
+	require.Nil(t, none.Lookup(net.ParseIP("192.168.1.10")))
+}
@@ -0,0 +1,155 @@
+package rdns
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Maintenance is a resolver that passes queries on to its upstream resolver
+// until it's put into maintenance mode on the admin listener. While in
+// maintenance, queries are sent to an alternative resolver, typically a static
+// responder pointing clients to a parking page, or refused.
+type Maintenance struct {
+	id string
+	MaintenanceOptions
+	resolver Resolver
+	metrics  *MaintenanceMetrics
+
+	mu    sync.Mutex
+	state MaintenanceState
+}
+
+var _ Resolver = &Maintenance{}
+
+type MaintenanceOptions struct {
+	// Optional, resolver for queries while in maintenance. Queries are
+	// refused if not set.
+	MaintenanceResolver Resolver
+}
+
+type MaintenanceMetrics struct {
+	// Count of queries answered while in maintenance.
+	query *expvar.Int
+	// 1 while in maintenance, 0 otherwise.
+	enabled *expvar.Int
+}
+
+// MaintenanceState describes whether a maintenance group is in maintenance.
+type MaintenanceState struct {
+	Enabled bool      `json:"enabled"`
+	Reason  string    `json:"reason,omitempty"`
+	Since   time.Time `json:"since"`
+	Until   time.Time `json:"until"` // Zero if it lasts until disabled
+}
+
+// NewMaintenance returns a new instance of a maintenance resolver.
+func NewMaintenance(id string, resolver Resolver, opt MaintenanceOptions) *Maintenance {
+	r := &Maintenance{
+		id:                 id,
+		MaintenanceOptions: opt,
+		resolver:           resolver,
+		metrics: &MaintenanceMetrics{
+			query:   getVarInt("maintenance", id, "query"),
+			enabled: getVarInt("maintenance", id, "enabled"),
+		},
+	}
+	registerAdminHandler("/routedns/maintenance/"+id, r)
+	return r
+}
+
+// Resolve a DNS query with the upstream resolver, or the maintenance resolver
+// while in maintenance.
+func (r *Maintenance) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if !r.State().Enabled {
+		return r.resolver.Resolve(q, ci)
+	}
+	log := logger(r.id, q, ci)
+	r.metrics.query.Add(1)
+	if r.MaintenanceResolver != nil {
+		log.WithField("resolver", r.MaintenanceResolver).Debug("in maintenance, forwarding to maintenance-resolver")
+		return r.MaintenanceResolver.Resolve(q, ci)
+	}
+	log.Debug("in maintenance, refusing")
+	return refused(q), nil
+}
+
+func (r *Maintenance) String() string {
+	return r.id
+}
+
+// Check Cert
+func (r *Maintenance) CertMonitor() error {
+	return nil
+}
+
+// Enable puts the group into maintenance. It ends after the given duration,
+// or when disabled if the duration is 0.
+func (r *Maintenance) Enable(reason string, duration time.Duration) {
+	now := time.Now()
+	state := MaintenanceState{
+		Enabled: true,
+		Reason:  reason,
+		Since:   now,
+	}
+	if duration > 0 {
+		state.Until = now.Add(duration)
+	}
+	r.mu.Lock()
+	r.state = state
+	r.mu.Unlock()
+	r.metrics.enabled.Set(1)
+	Log.WithFields(logrus.Fields{"id": r.id, "reason": reason, "until": state.Until}).Info("entering maintenance")
+}
+
+// Disable ends the maintenance.
+func (r *Maintenance) Disable() {
+	r.mu.Lock()
+	r.state = MaintenanceState{}
+	r.mu.Unlock()
+	r.metrics.enabled.Set(0)
+	Log.WithField("id", r.id).Info("leaving maintenance")
+}
+
+// State returns whether the group is in maintenance, and since when.
+func (r *Maintenance) State() MaintenanceState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.state.Enabled && !r.state.Until.IsZero() && time.Now().After(r.state.Until) {
+		r.state = MaintenanceState{}
+		r.metrics.enabled.Set(0)
+	}
+	return r.state
+}
+
+// ServeHTTP returns the maintenance state on GET, enables maintenance on POST
+// with optional "reason" and "duration" parameters, and disables it on DELETE.
+func (r *Maintenance) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.State())
+	case http.MethodPost:
+		var duration time.Duration
+		if v := req.URL.Query().Get("duration"); v != "" {
+			var err error
+			duration, err = time.ParseDuration(v)
+			if err != nil || duration < 0 {
+				http.Error(w, "invalid duration parameter", http.StatusBadRequest)
+				return
+			}
+		}
+		r.Enable(req.URL.Query().Get("reason"), duration)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		r.Disable()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
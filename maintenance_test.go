@@ -0,0 +1,59 @@
+package rdns
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaintenance(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	upstream := new(TestResolver)
+	parking := new(TestResolver)
+	m := NewMaintenance("test-maintenance", upstream, MaintenanceOptions{MaintenanceResolver: parking})
+
+	// Queries go upstream until maintenance is enabled
+	_, err := m.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/routedns/maintenance/test-maintenance?reason=upgrade", nil))
+	require.Equal(t, http.StatusNoContent, w.Code)
+	require.True(t, m.State().Enabled)
+	require.Equal(t, "upgrade", m.State().Reason)
+
+	_, err = m.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+	require.Equal(t, 1, parking.HitCount())
+
+	w = httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/routedns/maintenance/test-maintenance", nil))
+	require.Equal(t, http.StatusNoContent, w.Code)
+	_, err = m.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 2, upstream.HitCount())
+
+	// Maintenance ends by itself after the duration, queries are refused
+	// without maintenance resolver
+	m = NewMaintenance("test-maintenance-refuse", upstream, MaintenanceOptions{})
+	m.Enable("", 100*time.Millisecond)
+	a, err := m.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+	time.Sleep(200 * time.Millisecond)
+	_, err = m.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 3, upstream.HitCount())
+
+	w = httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/routedns/maintenance/test-maintenance-refuse?duration=soon", nil))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -45,6 +45,15 @@ func refused(q *dns.Msg) *dns.Msg {
 	return responseWithCode(q, dns.RcodeRefused)
 }
 
+// Returns an empty response with the TC bit set, prompting the client to
+// retry over TCP.
+func truncated(q *dns.Msg) *dns.Msg {
+	a := new(dns.Msg)
+	a.SetReply(q)
+	a.Truncated = true
+	return a
+}
+
 // Build a response for a query with the given responce code.
 func responseWithCode(q *dns.Msg, rcode int) *dns.Msg {
 	a := new(dns.Msg)
@@ -73,21 +82,19 @@ func ptr(q *dns.Msg, names []string) *dns.Msg {
 	return a
 }
 
-// Changes the UDP size in the EDNS0 record and returns a
-// copy of the query. Adds an OPT record if there isn't one
-// already. If size is 0, the original query is returned.
-func setUDPSize(q *dns.Msg, size uint16) *dns.Msg {
+// Changes the UDP size in the EDNS0 record of the query in
+// place. Adds an OPT record if there isn't one already. If
+// size is 0, the query is left unchanged.
+func setUDPSize(q *dns.Msg, size uint16) {
 	if size == 0 {
-		return q
+		return
 	}
-	copy := q.Copy()
 	// Set the EDNS0 size. Adds an OPT record if there isn't
 	// one already
-	edns0 := copy.IsEdns0()
+	edns0 := q.IsEdns0()
 	if edns0 != nil {
 		edns0.SetUDPSize(size)
 	} else {
 		q.SetEdns0(size, false)
 	}
-	return copy
 }
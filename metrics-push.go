@@ -0,0 +1,289 @@
+package rdns
+
+import (
+	"bytes"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// MetricsPusher periodically sends the routedns metrics to a statsd server or
+// to InfluxDB in line protocol, for environments where the admin listener
+// can't be scraped. Counters are sent with their current value, as gauges in
+// statsd.
+type MetricsPusher struct {
+	id  string
+	opt MetricsPusherOptions
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// MetricsPusherOptions contains the settings of a metrics pusher.
+type MetricsPusherOptions struct {
+	// Format of the metrics, "statsd" or "influxdb".
+	Format string
+
+	// Network used to reach the server, "udp" or "tcp". Ignored for InfluxDB
+	// when Address is a URL. Defaults to "udp".
+	Network string
+
+	// Address of the server as host:port, or the http(s) URL of the InfluxDB
+	// write endpoint.
+	Address string
+
+	// Token sent in the Authorization header to the InfluxDB write endpoint.
+	Token string
+
+	// Time between pushes. Defaults to 10 seconds.
+	Interval time.Duration
+
+	// Prefix of the metric names in statsd, or the measurement name in
+	// InfluxDB. Defaults to "routedns".
+	Prefix string
+
+	// Tags added to every InfluxDB point, for example the name of the node.
+	Tags map[string]string
+}
+
+// A single metric value, identified by the kind of element, its ID, the name
+// of the counter and, for maps, the key.
+type pushedMetric struct {
+	kind, id, name, key string
+	value               string
+	isInt               bool
+}
+
+// Maximum size of a UDP packet with metrics.
+const metricsPushMaxPacket = 1400
+
+// NewMetricsPusher returns a new metrics pusher and starts sending metrics in
+// the background.
+func NewMetricsPusher(id string, opt MetricsPusherOptions) (*MetricsPusher, error) {
+	switch opt.Format {
+	case "statsd", "influxdb":
+	default:
+		return nil, fmt.Errorf("unsupported metrics format %q", opt.Format)
+	}
+	if opt.Address == "" {
+		return nil, errors.New("no address for metrics push")
+	}
+	if opt.Network == "" {
+		opt.Network = "udp"
+	}
+	if opt.Interval <= 0 {
+		opt.Interval = 10 * time.Second
+	}
+	if opt.Prefix == "" {
+		opt.Prefix = "routedns"
+	}
+	p := &MetricsPusher{
+		id:   id,
+		opt:  opt,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go p.pushLoop()
+	return p, nil
+}
+
+// Stop sends the metrics one last time and stops the pusher.
+func (p *MetricsPusher) Stop() {
+	close(p.stop)
+	<-p.done
+}
+
+func (p *MetricsPusher) pushLoop() {
+	defer close(p.done)
+	log := Log.WithFields(logrus.Fields{"id": p.id, "address": p.opt.Address})
+	ticker := time.NewTicker(p.opt.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.stop:
+			if err := p.Push(); err != nil {
+				log.WithError(err).Error("failed to push metrics")
+			}
+			return
+		}
+		if err := p.Push(); err != nil {
+			log.WithError(err).Error("failed to push metrics")
+		}
+	}
+}
+
+// Push sends the current metrics to the server.
+func (p *MetricsPusher) Push() error {
+	var lines []string
+	now := time.Now()
+	for _, m := range collectMetrics() {
+		switch p.opt.Format {
+		case "statsd":
+			lines = append(lines, p.statsdLine(m))
+		case "influxdb":
+			lines = append(lines, p.influxLine(m, now))
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	if strings.HasPrefix(p.opt.Address, "http://") || strings.HasPrefix(p.opt.Address, "https://") {
+		return p.postLines(lines)
+	}
+	return p.sendLines(lines)
+}
+
+// Sends the lines over a UDP or TCP connection. UDP packets are filled with
+// as many lines as fit.
+func (p *MetricsPusher) sendLines(lines []string) error {
+	conn, err := net.DialTimeout(p.opt.Network, p.opt.Address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if p.opt.Network == "udp" && buf.Len() > 0 && buf.Len()+len(line)+1 > metricsPushMaxPacket {
+			if _, err := conn.Write(buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	_, err = conn.Write(buf.Bytes())
+	return err
+}
+
+// Posts the lines to the InfluxDB write endpoint.
+func (p *MetricsPusher) postLines(lines []string) error {
+	req, err := http.NewRequest(http.MethodPost, p.opt.Address, strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if p.opt.Token != "" {
+		req.Header.Set("Authorization", "Token "+p.opt.Token)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Returns the metric in statsd format, as gauge.
+func (p *MetricsPusher) statsdLine(m pushedMetric) string {
+	parts := []string{p.opt.Prefix, m.kind, m.id, m.name}
+	if m.key != "" {
+		parts = append(parts, m.key)
+	}
+	for i := range parts {
+		parts[i] = statsdEscaper.Replace(parts[i])
+	}
+	return strings.Join(parts, ".") + ":" + m.value + "|g"
+}
+
+// Characters that aren't allowed in statsd metric names.
+var statsdEscaper = strings.NewReplacer(":", "_", "|", "_", "@", "_", " ", "_", "\n", "_")
+
+// Returns the metric in InfluxDB line protocol.
+func (p *MetricsPusher) influxLine(m pushedMetric, t time.Time) string {
+	tags := map[string]string{"kind": m.kind, "id": m.id, "name": m.name, "key": m.key}
+	for k, v := range p.opt.Tags {
+		tags[k] = v
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(influxMeasurementEscaper.Replace(p.opt.Prefix))
+	for _, k := range keys {
+		if tags[k] == "" {
+			continue
+		}
+		b.WriteString("," + influxTagEscaper.Replace(k) + "=" + influxTagEscaper.Replace(tags[k]))
+	}
+	b.WriteString(" value=" + m.value)
+	if m.isInt {
+		b.WriteString("i")
+	}
+	b.WriteString(" " + strconv.FormatInt(t.UnixNano(), 10))
+	return b.String()
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+)
+
+// Returns all numeric routedns metrics, sorted by name.
+func collectMetrics() []pushedMetric {
+	var metrics []pushedMetric
+	expvar.Do(func(kv expvar.KeyValue) {
+		fullname, ok := strings.CutPrefix(kv.Key, "routedns.")
+		if !ok {
+			return
+		}
+		// Names are in the form <kind>.<id>.<name>, where the ID can contain dots
+		first := strings.Index(fullname, ".")
+		last := strings.LastIndex(fullname, ".")
+		if first < 0 || first == last {
+			return
+		}
+		base := pushedMetric{kind: fullname[:first], id: fullname[first+1 : last], name: fullname[last+1:]}
+		switch v := kv.Value.(type) {
+		case *expvar.Map:
+			v.Do(func(kv expvar.KeyValue) {
+				m := base
+				m.key = kv.Key
+				if metricValue(&m, kv.Value) {
+					metrics = append(metrics, m)
+				}
+			})
+		default:
+			m := base
+			if metricValue(&m, v) {
+				metrics = append(metrics, m)
+			}
+		}
+	})
+	sort.Slice(metrics, func(i, j int) bool {
+		a, b := metrics[i], metrics[j]
+		return a.kind+"."+a.id+"."+a.name+"."+a.key < b.kind+"."+b.id+"."+b.name+"."+b.key
+	})
+	return metrics
+}
+
+// Sets the value of the metric if it's numeric.
+func metricValue(m *pushedMetric, v expvar.Var) bool {
+	switch v := v.(type) {
+	case *expvar.Int:
+		m.value, m.isInt = strconv.FormatInt(v.Value(), 10), true
+	case *expvar.Float:
+		m.value = strconv.FormatFloat(v.Value(), 'f', -1, 64)
+	default:
+		return false
+	}
+	return true
+}
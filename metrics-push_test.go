@@ -0,0 +1,50 @@
+package rdns
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsPushStatsd(t *testing.T) {
+	getVarInt("test-push", "statsd", "count").Set(5)
+	getVarMap("test-push", "statsd", "per-key").Add("a:b", 2)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	p, err := NewMetricsPusher("test", MetricsPusherOptions{
+		Format:   "statsd",
+		Address:  pc.LocalAddr().String(),
+		Interval: time.Hour,
+	})
+	require.NoError(t, err)
+	defer p.Stop()
+	require.NoError(t, p.Push())
+
+	// Read packets until the test metrics show up
+	var lines []string
+	buf := make([]byte, 2048)
+	require.NoError(t, pc.SetReadDeadline(time.Now().Add(time.Second)))
+	for !strings.Contains(strings.Join(lines, "\n"), "test-push") {
+		n, _, err := pc.ReadFrom(buf)
+		require.NoError(t, err)
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+	require.Contains(t, lines, "routedns.test-push.statsd.count:5|g")
+	require.Contains(t, lines, "routedns.test-push.statsd.per-key.a_b:2|g")
+}
+
+func TestMetricsPushInflux(t *testing.T) {
+	p := &MetricsPusher{opt: MetricsPusherOptions{
+		Prefix: "routedns",
+		Tags:   map[string]string{"node": "edge 1"},
+	}}
+	m := pushedMetric{kind: "listener", id: "local-dot", name: "query", value: "42", isInt: true}
+	line := p.influxLine(m, time.Unix(1, 0))
+	require.Equal(t, `routedns,id=local-dot,kind=listener,name=query,node=edge\ 1 value=42i 1000000000`, line)
+}
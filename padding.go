@@ -1,6 +1,11 @@
 package rdns
 
-import "github.com/miekg/dns"
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/miekg/dns"
+)
 
 //  QueryPaddingBlockSize is used to pad queries sent over DoT and DoH according to rfc8467
 const QueryPaddingBlockSize = 128
@@ -9,12 +14,108 @@ const QueryPaddingBlockSize = 128
 const ResponsePaddingBlockSize = 468
 
 // Fixed buffers to draw on for padding (rather than allocate every time)
-var respPadBuf [ResponsePaddingBlockSize]byte
-var queryPadBuf [QueryPaddingBlockSize]byte
+var respPadBuf [dns.MaxMsgSize]byte
+var queryPadBuf [dns.MaxMsgSize]byte
+
+// Padding strategies for queries and responses as per rfc8467. Queries
+// support all but "maximal".
+const (
+	// Remove any padding from responses.
+	PaddingNone = "none"
+
+	// Pad responses to a multiple of the block size.
+	PaddingBlock = "block"
+
+	// Pad responses with a random length below the block size.
+	PaddingRandom = "random"
+
+	// Pad responses to the maximum size the client accepts.
+	PaddingMaximal = "maximal"
+)
+
+// PaddingPolicy defines how a listener pads its responses. The zero value
+// pads responses sent over encrypted protocols in blocks of 468 bytes and
+// removes padding from all others.
+type PaddingPolicy struct {
+	// One of "none", "block", "random" or "maximal". Defaults to "block" for
+	// encrypted protocols and "none" for plain DNS.
+	Mode string
+
+	// Block size used by the "block" and "random" modes. Defaults to 468.
+	BlockSize int
+}
+
+// ParsePaddingPolicy validates the padding mode and block size from the
+// config.
+func ParsePaddingPolicy(mode string, blockSize int) (PaddingPolicy, error) {
+	switch mode {
+	case "", PaddingNone, PaddingBlock, PaddingRandom, PaddingMaximal:
+	default:
+		return PaddingPolicy{}, fmt.Errorf("unsupported padding mode '%s'", mode)
+	}
+	if blockSize < 0 || blockSize > dns.MaxMsgSize {
+		return PaddingPolicy{}, fmt.Errorf("invalid padding block size %d", blockSize)
+	}
+	return PaddingPolicy{Mode: mode, BlockSize: blockSize}, nil
+}
+
+// Applies the policy to a response sent over the given listener protocol.
+// Padding is only added if the query has an EDNS0 OPT record.
+func (p PaddingPolicy) apply(protocol string, q, a *dns.Msg) {
+	mode := p.Mode
+	if mode == "" {
+		switch protocol {
+		case "dot", "dtls", "doh", "doq", "dows":
+			mode = PaddingBlock
+		default:
+			mode = PaddingNone
+		}
+	}
+	blockSize := p.BlockSize
+	if blockSize == 0 {
+		blockSize = ResponsePaddingBlockSize
+	}
+	switch mode {
+	case PaddingBlock:
+		padAnswerLen(q, a, func(n int) int { return blockSize - n%blockSize })
+	case PaddingRandom:
+		padAnswerLen(q, a, func(int) int { return rand.Intn(blockSize) })
+	case PaddingMaximal:
+		padAnswerLen(q, a, func(n int) int { return dns.MaxMsgSize - n })
+	default:
+		stripPadding(a)
+	}
+}
+
+// Applies the policy to a query sent upstream over an encrypted protocol. The
+// zero value pads queries in blocks of 128 bytes. Padding is only added if the
+// query has an EDNS0 OPT record, which is modified, so the query has to be a
+// copy.
+func (p PaddingPolicy) applyQuery(q *dns.Msg) {
+	blockSize := p.BlockSize
+	if blockSize == 0 {
+		blockSize = QueryPaddingBlockSize
+	}
+	switch p.Mode {
+	case "", PaddingBlock:
+		padQueryLen(q, func(n int) int { return blockSize - n%blockSize })
+	case PaddingRandom:
+		padQueryLen(q, func(int) int { return rand.Intn(blockSize) })
+	default:
+		stripPadding(q)
+	}
+}
 
 // Add padding to an answer before it's sent back over DoH or DoT according to rfc8467.
 // Don't call this for un-encrypted responses as they should not be padded.
 func padAnswer(q, a *dns.Msg) {
+	padAnswerLen(q, a, func(n int) int { return ResponsePaddingBlockSize - n%ResponsePaddingBlockSize })
+}
+
+// Adds padding to an answer, with the length returned by padLen for the length
+// of the answer without padding. The padded answer is limited to the size the
+// client accepts.
+func padAnswerLen(q, a *dns.Msg, padLen func(int) int) {
 	edns0q := q.IsEdns0()
 	if edns0q == nil { // Don't pad if the client does not support EDNS0
 		return
@@ -44,22 +145,28 @@ func padAnswer(q, a *dns.Msg) {
 
 	// Calculate the desired padding length
 	len := a.Len()
-	padLen := ResponsePaddingBlockSize - len%ResponsePaddingBlockSize
+	n := padLen(len)
 
 	// If padding would make the packet larger than the request EDNS0 allows, we need
 	// to truncate it.
-	if len+padLen > int(edns0q.UDPSize()) {
-		padLen = int(edns0q.UDPSize()) - len
-		if padLen < 0 { // Still doesn't fit? Give up on padding
-			padLen = 0
-		}
+	if len+n > int(edns0q.UDPSize()) {
+		n = int(edns0q.UDPSize()) - len
 	}
-	paddingOpt.Padding = respPadBuf[0:padLen]
+	if n < 0 { // Still doesn't fit? Give up on padding
+		n = 0
+	}
+	paddingOpt.Padding = respPadBuf[0:n]
 }
 
 // Adds padding to a query that is to be sent over DoH or DoT. Padding length is according to rfc8467.
 // This should not be used for plain (unencrypted) DNS.
 func padQuery(q *dns.Msg) {
+	padQueryLen(q, func(n int) int { return QueryPaddingBlockSize - n%QueryPaddingBlockSize })
+}
+
+// Adds padding to a query, with the length returned by padLen for the length
+// of the query without padding.
+func padQueryLen(q *dns.Msg, padLen func(int) int) {
 	edns0q := q.IsEdns0()
 	if edns0q == nil { // Don't pad if the client does not support EDNS0
 		return
@@ -82,8 +189,14 @@ func padQuery(q *dns.Msg) {
 
 	// Calculate the desired padding length
 	len := q.Len()
-	padLen := QueryPaddingBlockSize - len%QueryPaddingBlockSize
-	paddingOpt.Padding = queryPadBuf[0:padLen]
+	n := padLen(len)
+	if len+n > dns.MaxMsgSize {
+		n = dns.MaxMsgSize - len
+	}
+	if n < 0 {
+		n = 0
+	}
+	paddingOpt.Padding = queryPadBuf[0:n]
 }
 
 // Remove padding from a query or response. Typically needed when sending a response that was received
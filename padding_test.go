@@ -120,3 +120,90 @@ func TestStripPaddingMulti(t *testing.T) {
 		require.Len(t, edns0.Option, test.lenAfterStrip)
 	}
 }
+
+func TestPaddingPolicy(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("google.com.", dns.TypeA)
+	q.SetEdns0(4096, false)
+
+	padded := func(p PaddingPolicy, protocol string) *dns.Msg {
+		a := new(dns.Msg)
+		a.SetReply(q)
+		a.SetEdns0(4096, false)
+		a.IsEdns0().Option = append(a.IsEdns0().Option, &dns.EDNS0_PADDING{Padding: make([]byte, 10)})
+		p.apply(protocol, q, a)
+		return a
+	}
+	paddingLen := func(a *dns.Msg) int {
+		for _, opt := range a.IsEdns0().Option {
+			if p, ok := opt.(*dns.EDNS0_PADDING); ok {
+				return len(p.Padding)
+			}
+		}
+		return -1
+	}
+
+	// By default, encrypted protocols are padded, plain DNS isn't
+	a := padded(PaddingPolicy{}, "doq")
+	require.Zero(t, a.Len()%ResponsePaddingBlockSize)
+	a = padded(PaddingPolicy{}, "udp")
+	require.Equal(t, -1, paddingLen(a))
+
+	// Custom block size, also applied to plain DNS
+	a = padded(PaddingPolicy{Mode: PaddingBlock, BlockSize: 256}, "tcp")
+	require.Zero(t, a.Len()%256)
+
+	// Padding disabled on an encrypted protocol
+	a = padded(PaddingPolicy{Mode: PaddingNone}, "dot")
+	require.Equal(t, -1, paddingLen(a))
+
+	// Random padding stays below the block size
+	for i := 0; i < 10; i++ {
+		a = padded(PaddingPolicy{Mode: PaddingRandom, BlockSize: 64}, "doh")
+		require.Less(t, paddingLen(a), 64)
+	}
+
+	// Maximal padding fills up to the size the client accepts
+	a = padded(PaddingPolicy{Mode: PaddingMaximal}, "dot")
+	require.Equal(t, 4096, a.Len())
+
+	_, err := ParsePaddingPolicy("blocks", 0)
+	require.Error(t, err)
+}
+
+func TestQueryPaddingPolicy(t *testing.T) {
+	padded := func(p PaddingPolicy) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion("google.com.", dns.TypeA)
+		q.SetEdns0(4096, false)
+		q.IsEdns0().Option = append(q.IsEdns0().Option, &dns.EDNS0_PADDING{Padding: make([]byte, 10)})
+		p.applyQuery(q)
+		return q
+	}
+	paddingLen := func(q *dns.Msg) int {
+		for _, opt := range q.IsEdns0().Option {
+			if p, ok := opt.(*dns.EDNS0_PADDING); ok {
+				return len(p.Padding)
+			}
+		}
+		return -1
+	}
+
+	// Default block size
+	q := padded(PaddingPolicy{})
+	require.Zero(t, q.Len()%QueryPaddingBlockSize)
+
+	// Custom block size
+	q = padded(PaddingPolicy{Mode: PaddingBlock, BlockSize: 256})
+	require.Zero(t, q.Len()%256)
+
+	// Random padding stays below the block size
+	for i := 0; i < 10; i++ {
+		q = padded(PaddingPolicy{Mode: PaddingRandom, BlockSize: 32})
+		require.Less(t, paddingLen(q), 32)
+	}
+
+	// Padding disabled, existing padding is removed
+	q = padded(PaddingPolicy{Mode: PaddingNone})
+	require.Equal(t, -1, paddingLen(q))
+}
@@ -0,0 +1,384 @@
+package rdns
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/XrayR-project/XrayR/api/sspanel"
+)
+
+// PanelAPI is the interface to a panel that provides the node configuration
+// and user list for panel blocklists. Implementations return an error with the
+// text api.NodeNotModified or api.UserNotModified when the data hasn't changed
+// since the last call.
+type PanelAPI interface {
+	GetNodeInfo() (*api.NodeInfo, error)
+	GetUserList() (*[]api.UserInfo, error)
+	ReportNodeOnlineUsers(onlineUser *[]api.OnlineUser) error
+	Describe() api.ClientInfo
+}
+
+var _ PanelAPI = &sspanel.APIClient{}
+
+// Panel types that can be used with NewPanelAPI.
+const (
+	PanelTypeSSPanel = "sspanel"
+	PanelTypeV2Board = "v2board"
+	PanelTypeREST    = "rest"
+)
+
+// NewPanelAPI returns a client for the given panel type.
+func NewPanelAPI(panelType string, cfg *api.Config) (PanelAPI, error) {
+	switch panelType {
+	case "", PanelTypeSSPanel:
+		c := sspanel.New(cfg)
+		c.NodeType = "Http"
+		return c, nil
+	case PanelTypeV2Board:
+		return NewV2BoardAPI(cfg), nil
+	case PanelTypeREST:
+		return NewRESTPanelAPI(cfg), nil
+	}
+	return nil, fmt.Errorf("unsupported panel type '%s'", panelType)
+}
+
+// HTTP client shared by the panel API implementations. It remembers the ETag
+// of every resource to only download data that changed.
+type panelHTTPClient struct {
+	cfg    api.Config
+	client *http.Client
+	header http.Header
+
+	mu    sync.Mutex
+	eTags map[string]string
+}
+
+func newPanelHTTPClient(cfg *api.Config) *panelHTTPClient {
+	timeout := 5 * time.Second
+	if cfg.Timeout > 0 {
+		timeout = time.Duration(cfg.Timeout) * time.Second
+	}
+	return &panelHTTPClient{
+		cfg:    *cfg,
+		client: &http.Client{Timeout: timeout},
+		header: make(http.Header),
+		eTags:  make(map[string]string),
+	}
+}
+
+// Fetches a resource and decodes it into v. Returns errNotModified if the
+// panel responded with 304.
+func (c *panelHTTPClient) get(path string, query url.Values, v any) error {
+	u := strings.TrimSuffix(c.cfg.APIHost, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	for k, vals := range c.header {
+		req.Header[k] = vals
+	}
+	c.mu.Lock()
+	if tag, ok := c.eTags[path]; ok {
+		req.Header.Set("If-None-Match", tag)
+	}
+	c.mu.Unlock()
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return errNotModified
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return fmt.Errorf("request %s failed with status code %d", path, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response of %s: %w", path, err)
+	}
+	if tag := resp.Header.Get("ETag"); tag != "" {
+		c.mu.Lock()
+		c.eTags[path] = tag
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// Sends v as JSON to the panel.
+func (c *panelHTTPClient) post(path string, query url.Values, v any) error {
+	u := strings.TrimSuffix(c.cfg.APIHost, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	for k, vals := range c.header {
+		req.Header[k] = vals
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("request %s failed with status code %d", path, resp.StatusCode)
+	}
+	return nil
+}
+
+var errNotModified = errors.New("not modified")
+
+// V2BoardAPI is a client for the UniProxy API of V2Board. The RouteDNS settings
+// of the node are read from the "routedns" object in the node configuration.
+// Users are identified by their UUID, V2Board doesn't provide IPs for them.
+type V2BoardAPI struct {
+	c *panelHTTPClient
+}
+
+var _ PanelAPI = &V2BoardAPI{}
+
+// NewV2BoardAPI returns a new V2Board client. The node type defaults to "vmess".
+func NewV2BoardAPI(cfg *api.Config) *V2BoardAPI {
+	c := newPanelHTTPClient(cfg)
+	if c.cfg.NodeType == "" {
+		c.cfg.NodeType = "vmess"
+	}
+	return &V2BoardAPI{c: c}
+}
+
+func (a *V2BoardAPI) query() url.Values {
+	return url.Values{
+		"token":     {a.c.cfg.Key},
+		"node_id":   {fmt.Sprint(a.c.cfg.NodeID)},
+		"node_type": {strings.ToLower(a.c.cfg.NodeType)},
+	}
+}
+
+// GetNodeInfo returns the node configuration.
+func (a *V2BoardAPI) GetNodeInfo() (*api.NodeInfo, error) {
+	var resp struct {
+		ServerPort uint32        `json:"server_port"`
+		RouteDNS   *api.RouteDns `json:"routedns"`
+	}
+	err := a.c.get("/api/v1/server/UniProxy/config", a.query(), &resp)
+	if err == errNotModified {
+		return nil, errors.New(api.NodeNotModified)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return panelNodeInfo(a.c.cfg, resp.ServerPort, resp.RouteDNS), nil
+}
+
+// GetUserList returns the users of the node.
+func (a *V2BoardAPI) GetUserList() (*[]api.UserInfo, error) {
+	var resp struct {
+		Users []struct {
+			ID          int    `json:"id"`
+			UUID        string `json:"uuid"`
+			SpeedLimit  uint64 `json:"speed_limit"`
+			DeviceLimit int    `json:"device_limit"`
+		} `json:"users"`
+	}
+	err := a.c.get("/api/v1/server/UniProxy/user", a.query(), &resp)
+	if err == errNotModified {
+		return nil, errors.New(api.UserNotModified)
+	}
+	if err != nil {
+		return nil, err
+	}
+	users := make([]api.UserInfo, 0, len(resp.Users))
+	for _, u := range resp.Users {
+		users = append(users, api.UserInfo{
+			UID:         u.ID,
+			UUID:        u.UUID,
+			SpeedLimit:  u.SpeedLimit * 1000000 / 8, // Mbps to Bps
+			DeviceLimit: u.DeviceLimit,
+		})
+	}
+	return &users, nil
+}
+
+// ReportNodeOnlineUsers reports the IPs of active users.
+func (a *V2BoardAPI) ReportNodeOnlineUsers(onlineUser *[]api.OnlineUser) error {
+	alive := make(map[int][]string)
+	for _, u := range *onlineUser {
+		alive[u.UID] = append(alive[u.UID], u.IP)
+	}
+	return a.c.post("/api/v1/server/UniProxy/alive", a.query(), alive)
+}
+
+// Describe returns a description of the client.
+func (a *V2BoardAPI) Describe() api.ClientInfo {
+	return api.ClientInfo{APIHost: a.c.cfg.APIHost, NodeID: a.c.cfg.NodeID, Key: a.c.cfg.Key, NodeType: a.c.cfg.NodeType}
+}
+
+// PanelUserQuotaAPI is implemented by panel APIs that provide query quotas for
+// users, see QueryQuota. It returns the quotas of the last user list fetched
+// by user ID.
+type PanelUserQuotaAPI interface {
+	UserQuotas() map[int]QuotaLimits
+}
+
+// Returns the user database for a user list, with the query quotas of the
+// users if the panel API provides them.
+func newPanelUserDBFromAPI(a PanelAPI, users []api.UserInfo) *PanelUserDB {
+	db := NewPanelUserDB(users)
+	if qa, ok := a.(PanelUserQuotaAPI); ok {
+		db.setQuotas(qa.UserQuotas())
+	}
+	return db
+}
+
+// RESTPanelAPI is a client for a generic panel API, for operators that write
+// their own backend. The key is sent as bearer token, the node ID as "node_id"
+// query parameter. It uses the following endpoints relative to the API host:
+//
+//	GET  /node   - RouteDNS settings of the node, in the same format as the
+//	               "routedns" object of the panel node configuration
+//	GET  /users  - List of users as [{"id":1,"email":"..","token":"..","ip":".."}],
+//	               optionally with "quota_hourly" and "quota_daily" query limits
+//	GET  /online - IPs users are currently connected from, as [{"id":1,"ip":".."}]
+//	POST /online - Active users as [{"id":1,"ip":".."}]
+type RESTPanelAPI struct {
+	c *panelHTTPClient
+
+	mu     sync.Mutex
+	quotas map[int]QuotaLimits
+}
+
+var _ PanelAPI = &RESTPanelAPI{}
+var _ PanelOnlineUsersAPI = &RESTPanelAPI{}
+var _ PanelUserQuotaAPI = &RESTPanelAPI{}
+
+// NewRESTPanelAPI returns a new client for a generic REST panel API.
+func NewRESTPanelAPI(cfg *api.Config) *RESTPanelAPI {
+	c := newPanelHTTPClient(cfg)
+	if cfg.Key != "" {
+		c.header.Set("Authorization", "Bearer "+cfg.Key)
+	}
+	return &RESTPanelAPI{c: c}
+}
+
+func (a *RESTPanelAPI) query() url.Values {
+	return url.Values{"node_id": {fmt.Sprint(a.c.cfg.NodeID)}}
+}
+
+// GetNodeInfo returns the node configuration.
+func (a *RESTPanelAPI) GetNodeInfo() (*api.NodeInfo, error) {
+	routeDNS := new(api.RouteDns)
+	err := a.c.get("/node", a.query(), routeDNS)
+	if err == errNotModified {
+		return nil, errors.New(api.NodeNotModified)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return panelNodeInfo(a.c.cfg, 0, routeDNS), nil
+}
+
+// GetUserList returns the users of the node.
+func (a *RESTPanelAPI) GetUserList() (*[]api.UserInfo, error) {
+	var resp []struct {
+		ID          int    `json:"id"`
+		Email       string `json:"email"`
+		Token       string `json:"token"`
+		IP          string `json:"ip"`
+		QuotaHourly uint64 `json:"quota_hourly"`
+		QuotaDaily  uint64 `json:"quota_daily"`
+	}
+	err := a.c.get("/users", a.query(), &resp)
+	if err == errNotModified {
+		return nil, errors.New(api.UserNotModified)
+	}
+	if err != nil {
+		return nil, err
+	}
+	users := make([]api.UserInfo, 0, len(resp))
+	quotas := make(map[int]QuotaLimits)
+	for _, u := range resp {
+		users = append(users, api.UserInfo{UID: u.ID, Email: u.Email, UUID: u.Token, Passwd: u.IP})
+		if u.QuotaHourly > 0 || u.QuotaDaily > 0 {
+			quotas[u.ID] = QuotaLimits{Hourly: u.QuotaHourly, Daily: u.QuotaDaily}
+		}
+	}
+	a.mu.Lock()
+	a.quotas = quotas
+	a.mu.Unlock()
+	return &users, nil
+}
+
+// UserQuotas returns the query quotas of the users in the last user list.
+func (a *RESTPanelAPI) UserQuotas() map[int]QuotaLimits {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.quotas
+}
+
+// ReportNodeOnlineUsers reports the IPs of active users.
+func (a *RESTPanelAPI) ReportNodeOnlineUsers(onlineUser *[]api.OnlineUser) error {
+	type online struct {
+		ID int    `json:"id"`
+		IP string `json:"ip"`
+	}
+	list := make([]online, 0, len(*onlineUser))
+	for _, u := range *onlineUser {
+		list = append(list, online{u.UID, u.IP})
+	}
+	return a.c.post("/online", a.query(), list)
+}
+
+// GetOnlineUsers returns the IPs users are currently connected from.
+func (a *RESTPanelAPI) GetOnlineUsers() (*[]api.OnlineUser, error) {
+	var resp []struct {
+		ID int    `json:"id"`
+		IP string `json:"ip"`
+	}
+	if err := a.c.get("/online", a.query(), &resp); err != nil {
+		return nil, err
+	}
+	online := make([]api.OnlineUser, 0, len(resp))
+	for _, u := range resp {
+		online = append(online, api.OnlineUser{UID: u.ID, IP: u.IP})
+	}
+	return &online, nil
+}
+
+// Describe returns a description of the client.
+func (a *RESTPanelAPI) Describe() api.ClientInfo {
+	return api.ClientInfo{APIHost: a.c.cfg.APIHost, NodeID: a.c.cfg.NodeID, Key: a.c.cfg.Key, NodeType: a.c.cfg.NodeType}
+}
+
+// Builds the node info for panels that only provide the RouteDNS settings.
+func panelNodeInfo(cfg api.Config, port uint32, routeDNS *api.RouteDns) *api.NodeInfo {
+	if routeDNS == nil {
+		routeDNS = new(api.RouteDns)
+	}
+	return &api.NodeInfo{
+		NodeType: cfg.NodeType,
+		NodeID:   cfg.NodeID,
+		Port:     port,
+		RouteDNS: routeDNS,
+	}
+}
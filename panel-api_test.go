@@ -0,0 +1,92 @@
+package rdns
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestV2BoardAPI(t *testing.T) {
+	var alive map[string][]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "secret", r.URL.Query().Get("token"))
+		require.Equal(t, "5", r.URL.Query().Get("node_id"))
+		require.Equal(t, "vmess", r.URL.Query().Get("node_type"))
+		switch r.URL.Path {
+		case "/api/v1/server/UniProxy/config":
+			if r.Header.Get("If-None-Match") == "v1" {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", "v1")
+			w.Write([]byte(`{"server_port":443,"routedns":{"block":{"type":"domain","domains":["ads.example.com"]},"spoof":["1.2.3.4"]}}`))
+		case "/api/v1/server/UniProxy/user":
+			w.Write([]byte(`{"users":[{"id":1,"uuid":"a-b-c","speed_limit":8}]}`))
+		case "/api/v1/server/UniProxy/alive":
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&alive))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	c, err := NewPanelAPI(PanelTypeV2Board, &api.Config{APIHost: srv.URL, NodeID: 5, Key: "secret"})
+	require.NoError(t, err)
+
+	node, err := c.GetNodeInfo()
+	require.NoError(t, err)
+	require.Equal(t, uint32(443), node.Port)
+	require.Equal(t, []string{"ads.example.com"}, node.RouteDNS.Block.Domains)
+	require.Equal(t, []string{"1.2.3.4"}, node.RouteDNS.Spoof)
+
+	// Unchanged node configuration
+	_, err = c.GetNodeInfo()
+	require.EqualError(t, err, api.NodeNotModified)
+
+	users, err := c.GetUserList()
+	require.NoError(t, err)
+	require.Equal(t, []api.UserInfo{{UID: 1, UUID: "a-b-c", SpeedLimit: 1000000}}, *users)
+
+	require.NoError(t, c.ReportNodeOnlineUsers(&[]api.OnlineUser{{UID: 1, IP: "192.168.1.1"}}))
+	require.Equal(t, map[string][]string{"1": {"192.168.1.1"}}, alive)
+}
+
+func TestRESTPanelAPI(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		require.Equal(t, "7", r.URL.Query().Get("node_id"))
+		switch r.URL.Path {
+		case "/node":
+			w.Write([]byte(`{"allow":{"type":"domain","domains":["example.com"]}}`))
+		case "/users":
+			w.Write([]byte(`[{"id":2,"email":"a@example.com","token":"t1","ip":"10.0.0.0/24","quota_daily":100}]`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	c, err := NewPanelAPI(PanelTypeREST, &api.Config{APIHost: srv.URL + "/", NodeID: 7, Key: "secret"})
+	require.NoError(t, err)
+
+	node, err := c.GetNodeInfo()
+	require.NoError(t, err)
+	require.Equal(t, []string{"example.com"}, node.RouteDNS.Allow.Domains)
+
+	users, err := c.GetUserList()
+	require.NoError(t, err)
+	require.Equal(t, []api.UserInfo{{UID: 2, Email: "a@example.com", UUID: "t1", Passwd: "10.0.0.0/24"}}, *users)
+
+	// The quotas of the users are passed on to the user database
+	db := newPanelUserDBFromAPI(c, *users)
+	u, ok := db.Lookup("t1")
+	require.True(t, ok)
+	require.Equal(t, QuotaLimits{Daily: 100}, u.Quota)
+
+	_, err = NewPanelAPI("unknown", &api.Config{})
+	require.Error(t, err)
+}
@@ -16,16 +16,17 @@ var _ Resolver = &PanelRotate{}
 
 // NewFastest returns a new instance of a resolver group that returns the fastest
 // response from all its resolvers.
-func NewPanelRotate(id string, resolvers Resolver) *PanelRotate {
+func NewPanelRotate(id string, resolvers Resolver, panels ...Resolver) *PanelRotate {
 	return &PanelRotate{
-		id:        id,
-		resolvers: resolvers,
+		id:             id,
+		resolvers:      resolvers,
+		PanelResolvers: panels,
 	}
 }
 
 // Resolve a DNS query by sending it to all resolvers and returning the fastest
 // non-error response
-func (r *PanelRotate) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dialer) (*dns.Msg, error) {
+func (r *PanelRotate) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	log := logger(r.id, q, ci)
 
 	type response struct {
@@ -40,7 +41,7 @@ func (r *PanelRotate) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks
 	for _, resolver := range r.PanelResolvers {
 		resolver := resolver
 		go func() {
-			a, err := resolver.Resolve(q, ci,PanelSocksDialer)
+			a, err := resolver.Resolve(q, ci)
 			responseCh <- response{resolver, a, err}
 		}()
 	}
@@ -58,7 +59,7 @@ func (r *PanelRotate) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks
 
 		// If all responses were bad, return the last one
 		if i++; i >= len(r.PanelResolvers) {
-			return r.resolvers.Resolve(q, ci, PanelSocksDialer)
+			return r.resolvers.Resolve(q, ci)
 		}
 	}
 	return nil, nil // should never be reached
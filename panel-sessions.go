@@ -0,0 +1,118 @@
+package rdns
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+// PanelOnlineUsersAPI is implemented by panel APIs that can list the IPs users
+// are currently connected from.
+type PanelOnlineUsersAPI interface {
+	GetOnlineUsers() (*[]api.OnlineUser, error)
+}
+
+// Session-based IP allowlist. Client IPs of panel users are allowed until they
+// have been inactive for the TTL, every query extends the session. Sessions are
+// learned from the user IPs and online users of the panel, and from clients
+// identified by their token. Networks of users in the panel can't be learned
+// and are always allowed.
+type panelSessions struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu   sync.Mutex
+	byIP map[string]*panelSession
+}
+
+type panelSession struct {
+	user   PanelUser
+	expiry time.Time
+}
+
+func newPanelSessions(ttl time.Duration) *panelSessions {
+	return &panelSessions{
+		ttl:  ttl,
+		now:  time.Now,
+		byIP: make(map[string]*panelSession),
+	}
+}
+
+// Starts or extends the session of a user for an IP.
+func (s *panelSessions) add(ip net.IP, user PanelUser) {
+	s.mu.Lock()
+	s.byIP[ip.String()] = &panelSession{user: user, expiry: s.now().Add(s.ttl)}
+	s.mu.Unlock()
+}
+
+// Returns the user of an active session for the IP and extends the session.
+// Sessions of users that are no longer in the panel's user list are removed.
+func (s *panelSessions) touch(ip net.IP, users *PanelUserDB) (PanelUser, bool) {
+	key := ip.String()
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.byIP[key]
+	if !ok {
+		return PanelUser{}, false
+	}
+	if now.After(session.expiry) {
+		delete(s.byIP, key)
+		return PanelUser{}, false
+	}
+	user, ok := users.LookupID(session.user.ID)
+	if !ok {
+		delete(s.byIP, key)
+		return PanelUser{}, false
+	}
+	session.user = user
+	session.expiry = now.Add(s.ttl)
+	return user, true
+}
+
+// Removes expired sessions and returns the number of active ones.
+func (s *panelSessions) expire() int {
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, session := range s.byIP {
+		if now.After(session.expiry) {
+			delete(s.byIP, k)
+		}
+	}
+	return len(s.byIP)
+}
+
+// Starts sessions for users with a single IP. Networks can't be learned as
+// sessions and are ignored.
+func (s *panelSessions) addUsers(users []api.UserInfo) {
+	for _, u := range users {
+		if ip := net.ParseIP(u.Passwd); ip != nil {
+			s.add(ip, PanelUser{ID: u.UID, Email: u.Email})
+		}
+	}
+}
+
+// Starts sessions for the online users reported by the panel.
+func (s *panelSessions) addOnline(online []api.OnlineUser, users *PanelUserDB) {
+	for _, o := range online {
+		ip := net.ParseIP(o.IP)
+		if ip == nil {
+			continue
+		}
+		user, ok := users.LookupID(o.UID)
+		if !ok {
+			continue
+		}
+		s.add(ip, user)
+	}
+}
+
+// Removes expired sessions periodically.
+func (r *Panellist) sessionExpireLoop() {
+	for r.sleep(r.SessionTTL) {
+		r.refreshMetrics.sessions.Set(int64(r.sessions.expire()))
+	}
+}
@@ -0,0 +1,77 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPanelSessions(t *testing.T) {
+	users := []api.UserInfo{
+		{UID: 1, UUID: "token-1", Passwd: "192.168.1.1"},
+		{UID: 2, UUID: "token-2", Passwd: "10.0.0.0/8"},
+	}
+	loader := &PanelLoader{opt: PanelLoaderOptions{UserList: &users}}
+	blocklistDB, err := NewRegexpDB("testlist", NewStaticLoader(nil))
+	require.NoError(t, err)
+	db := &PanelDB{
+		Users:       NewPanelUserDB(users),
+		BlocklistDB: blocklistDB,
+	}
+	upstream := new(TestResolver)
+	r, err := NewPanellist("test-panel-sessions", upstream, PanellistOptions{
+		Loader:       loader,
+		DB:           db,
+		SessionTTL:   time.Hour,
+		UserIdentity: PanelUserIdentity{Domain: "dns.example.com"},
+	})
+	require.NoError(t, err)
+	now := time.Now()
+	r.sessions.now = func() time.Time { return now }
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	resolve := func(ci ClientInfo) int {
+		a, err := r.Resolve(q, ci)
+		require.NoError(t, err)
+		return a.Rcode
+	}
+	user1 := ClientInfo{SourceIP: net.ParseIP("192.168.1.1")}
+	other := ClientInfo{SourceIP: net.ParseIP("192.168.1.2")}
+
+	// The user IP from the panel starts a session, networks are allowed
+	// without one
+	require.Equal(t, dns.RcodeSuccess, resolve(user1))
+	require.Equal(t, dns.RcodeSuccess, resolve(ClientInfo{SourceIP: net.ParseIP("10.0.0.1")}))
+	require.Equal(t, 1, r.sessions.expire())
+	require.Equal(t, dns.RcodeServerFailure, resolve(other))
+
+	// A client identified by token starts a session for its IP
+	require.Equal(t, dns.RcodeSuccess, resolve(ClientInfo{SourceIP: other.SourceIP, TLSServerName: "token-2.dns.example.com"}))
+	require.Equal(t, dns.RcodeSuccess, resolve(other))
+
+	// Sessions are extended by activity and expire when inactive
+	now = now.Add(50 * time.Minute)
+	require.Equal(t, dns.RcodeSuccess, resolve(user1))
+	now = now.Add(50 * time.Minute)
+	require.Equal(t, dns.RcodeSuccess, resolve(user1))
+	require.Equal(t, dns.RcodeServerFailure, resolve(other))
+	require.Equal(t, 1, r.sessions.expire())
+
+	// Online users reported by the panel are learned again
+	r.sessions.addOnline([]api.OnlineUser{{UID: 2, IP: "192.168.1.2"}, {UID: 3, IP: "192.168.1.3"}}, db.Users)
+	require.Equal(t, dns.RcodeSuccess, resolve(other))
+	require.Equal(t, dns.RcodeServerFailure, resolve(ClientInfo{SourceIP: net.ParseIP("192.168.1.3")}))
+
+	// Sessions of users removed from the panel end with the next query
+	next := *r.db.Load()
+	next.Users = NewPanelUserDB(users[:1])
+	r.db.Store(&next)
+	require.Equal(t, dns.RcodeServerFailure, resolve(other))
+	require.Equal(t, 1, r.sessions.expire())
+	require.Equal(t, dns.RcodeSuccess, resolve(user1))
+}
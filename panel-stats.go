@@ -0,0 +1,186 @@
+package rdns
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+// PanelStatsOptions define how per-user usage statistics are reported.
+type PanelStatsOptions struct {
+	// Time between reports. Statistics are not collected if 0.
+	Interval time.Duration
+
+	// Optional URL the statistics are sent to as JSON in a POST request.
+	Webhook string
+
+	// Number of most frequently queried domains reported per user. Default 10.
+	TopDomains int
+
+	// Report the IP addresses of active users to the panel as online users.
+	ReportOnlineUsers bool
+}
+
+// PanelStatsReport holds the usage statistics of all users that sent queries
+// in a reporting period.
+type PanelStatsReport struct {
+	ID    string           `json:"id"`
+	Node  int              `json:"node"`
+	Start time.Time        `json:"start"`
+	End   time.Time        `json:"end"`
+	Users []PanelUserStats `json:"users"`
+}
+
+// PanelUserStats holds the usage statistics of a single user.
+type PanelUserStats struct {
+	UID        int           `json:"uid"`
+	Email      string        `json:"email"`
+	Queries    uint64        `json:"queries"`
+	Blocked    uint64        `json:"blocked"`
+	TopDomains []DomainCount `json:"top-domains"`
+	IPs        []string      `json:"ips"`
+	domains    map[string]uint64
+	ips        map[string]struct{}
+}
+
+// DomainCount is the number of queries for a domain.
+type DomainCount struct {
+	Name  string `json:"name"`
+	Count uint64 `json:"count"`
+}
+
+// Limits the number of distinct domains and IPs tracked per user and period
+// to keep memory bounded for users querying random names.
+const (
+	panelStatsMaxDomains = 1000
+	panelStatsMaxIPs     = 64
+)
+
+// Collects usage statistics per user for one reporting period.
+type panelStats struct {
+	mu    sync.Mutex
+	start time.Time
+	users map[int]*PanelUserStats
+}
+
+func newPanelStats() *panelStats {
+	return &panelStats{start: time.Now(), users: make(map[int]*PanelUserStats)}
+}
+
+// Records a query of a user.
+func (s *panelStats) query(u PanelUser, ip net.IP, name string, blocked bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.users[u.ID]
+	if !ok {
+		st = &PanelUserStats{
+			UID:     u.ID,
+			Email:   u.Email,
+			domains: make(map[string]uint64),
+			ips:     make(map[string]struct{}),
+		}
+		s.users[u.ID] = st
+	}
+	st.Queries++
+	if blocked {
+		st.Blocked++
+	}
+	if _, ok := st.domains[name]; ok || len(st.domains) < panelStatsMaxDomains {
+		st.domains[name]++
+	}
+	if len(st.ips) < panelStatsMaxIPs && ip != nil {
+		st.ips[ip.String()] = struct{}{}
+	}
+}
+
+// Returns the statistics collected since the last call and starts a new period.
+func (s *panelStats) swap(topDomains int) PanelStatsReport {
+	s.mu.Lock()
+	users := s.users
+	start := s.start
+	s.users = make(map[int]*PanelUserStats)
+	s.start = time.Now()
+	s.mu.Unlock()
+
+	report := PanelStatsReport{Start: start, End: time.Now(), Users: make([]PanelUserStats, 0, len(users))}
+	for _, st := range users {
+		for name, count := range st.domains {
+			st.TopDomains = append(st.TopDomains, DomainCount{name, count})
+		}
+		sort.Slice(st.TopDomains, func(i, j int) bool {
+			if st.TopDomains[i].Count != st.TopDomains[j].Count {
+				return st.TopDomains[i].Count > st.TopDomains[j].Count
+			}
+			return st.TopDomains[i].Name < st.TopDomains[j].Name
+		})
+		if len(st.TopDomains) > topDomains {
+			st.TopDomains = st.TopDomains[:topDomains]
+		}
+		for ip := range st.ips {
+			st.IPs = append(st.IPs, ip)
+		}
+		sort.Strings(st.IPs)
+		report.Users = append(report.Users, *st)
+	}
+	sort.Slice(report.Users, func(i, j int) bool { return report.Users[i].UID < report.Users[j].UID })
+	return report
+}
+
+// Periodically sends the collected statistics to the webhook and panel.
+func (r *Panellist) statsLoop() {
+	for r.sleep(r.Stats.Interval) {
+		log := Log.WithField("id", r.id)
+		report := r.stats.swap(r.Stats.TopDomains)
+		report.ID = r.id
+		if r.Loader != nil && r.Loader.API != nil {
+			report.Node = r.Loader.API.Describe().NodeID
+		}
+		if len(report.Users) == 0 {
+			continue
+		}
+		if r.Stats.Webhook != "" {
+			if err := postPanelStats(r.Stats.Webhook, report); err != nil {
+				log.WithError(err).Error("failed to send usage statistics")
+			}
+		}
+		if r.Stats.ReportOnlineUsers && r.Loader != nil && r.Loader.API != nil {
+			var online []api.OnlineUser
+			for _, u := range report.Users {
+				for _, ip := range u.IPs {
+					online = append(online, api.OnlineUser{UID: u.UID, IP: ip})
+				}
+			}
+			if err := r.Loader.API.ReportNodeOnlineUsers(&online); err != nil {
+				log.WithError(err).Error("failed to report online users to panel")
+			}
+		}
+		log.WithField("users", len(report.Users)).Debug("reported usage statistics")
+	}
+}
+
+var panelStatsClient = &http.Client{Timeout: 10 * time.Second}
+
+func postPanelStats(url string, report PanelStatsReport) error {
+	b, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	resp, err := panelStatsClient.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code %d from %s", resp.StatusCode, url)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package rdns
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPanelStats(t *testing.T) {
+	s := newPanelStats()
+	alice := PanelUser{ID: 1, Email: "alice@example.com"}
+	bob := PanelUser{ID: 2, Email: "bob@example.com"}
+
+	ip := net.ParseIP("192.168.1.1")
+	s.query(alice, ip, "example.com.", false)
+	s.query(alice, ip, "Example.com.", false)
+	s.query(alice, net.ParseIP("192.168.1.2"), "ads.example.com.", true)
+	s.query(alice, ip, "other.com.", false)
+	s.query(bob, ip, "example.net.", false)
+
+	report := s.swap(2)
+	require.Len(t, report.Users, 2)
+	require.Equal(t, uint64(4), report.Users[0].Queries)
+	require.Equal(t, uint64(1), report.Users[0].Blocked)
+	require.Equal(t, []DomainCount{{"example.com", 2}, {"ads.example.com", 1}}, report.Users[0].TopDomains)
+	require.Equal(t, []string{"192.168.1.1", "192.168.1.2"}, report.Users[0].IPs)
+	require.Equal(t, "bob@example.com", report.Users[1].Email)
+
+	// Statistics start over after each report
+	require.Empty(t, s.swap(2).Users)
+
+	// Send the report to a webhook
+	var received PanelStatsReport
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+	}))
+	defer srv.Close()
+	require.NoError(t, postPanelStats(srv.URL, report))
+	require.Len(t, received.Users, 2)
+	require.Equal(t, uint64(4), received.Users[0].Queries)
+}
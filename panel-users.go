@@ -0,0 +1,217 @@
+package rdns
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/sirupsen/logrus"
+	"github.com/xtls/xray-core/infra/conf"
+)
+
+// PanelUser is a user account of the panel.
+type PanelUser struct {
+	ID    int
+	Email string
+
+	// Query quota from the panel, zero if there's none
+	Quota QuotaLimits
+}
+
+// PanelUserDB maps the tokens users put into the TLS server name or DoH path to
+// their panel accounts. This identifies users independent of their IP address,
+// for example when they're behind carrier-grade NAT. The token of a user is the
+// UUID of the panel account. Users can also be found by the IP address or
+// network registered in the panel.
+type PanelUserDB struct {
+	byID    map[int]PanelUser
+	byToken map[string]PanelUser
+	byIP    map[string]PanelUser
+	nets    []panelUserNet
+}
+
+type panelUserNet struct {
+	net  *net.IPNet
+	user PanelUser
+}
+
+// NewPanelUserDB returns a database of the users with a token.
+func NewPanelUserDB(users []api.UserInfo) *PanelUserDB {
+	db := &PanelUserDB{
+		byID:    make(map[int]PanelUser, len(users)),
+		byToken: make(map[string]PanelUser, len(users)),
+		byIP:    make(map[string]PanelUser, len(users)),
+	}
+	for _, u := range users {
+		user := PanelUser{ID: u.UID, Email: u.Email}
+		db.byID[u.UID] = user
+		if u.UUID != "" {
+			db.byToken[strings.ToLower(u.UUID)] = user
+		}
+		if ip := net.ParseIP(u.Passwd); ip != nil {
+			db.byIP[ip.String()] = user
+		} else if _, n, err := net.ParseCIDR(u.Passwd); err == nil {
+			db.nets = append(db.nets, panelUserNet{n, user})
+		}
+	}
+	return db
+}
+
+// Sets the query quotas of users by user ID. Only used on a new database, it
+// isn't safe to change one that's in use.
+func (db *PanelUserDB) setQuotas(quotas map[int]QuotaLimits) {
+	set := func(u PanelUser) PanelUser {
+		u.Quota = quotas[u.ID]
+		return u
+	}
+	for k, u := range db.byID {
+		db.byID[k] = set(u)
+	}
+	for k, u := range db.byToken {
+		db.byToken[k] = set(u)
+	}
+	for k, u := range db.byIP {
+		db.byIP[k] = set(u)
+	}
+	for i, n := range db.nets {
+		db.nets[i].user = set(n.user)
+	}
+}
+
+// Lookup returns the user with the given token.
+func (db *PanelUserDB) Lookup(token string) (PanelUser, bool) {
+	if db == nil || token == "" {
+		return PanelUser{}, false
+	}
+	u, ok := db.byToken[strings.ToLower(token)]
+	return u, ok
+}
+
+// LookupID returns the user with the given ID.
+func (db *PanelUserDB) LookupID(id int) (PanelUser, bool) {
+	if db == nil {
+		return PanelUser{}, false
+	}
+	u, ok := db.byID[id]
+	return u, ok
+}
+
+// LookupIP returns the user with the given IP address or the network
+// containing it.
+func (db *PanelUserDB) LookupIP(ip net.IP) (PanelUser, bool) {
+	if db == nil || ip == nil {
+		return PanelUser{}, false
+	}
+	if u, ok := db.byIP[ip.String()]; ok {
+		return u, true
+	}
+	return db.LookupNet(ip)
+}
+
+// LookupNet returns the user with a network containing the IP address. Users
+// with a single IP address aren't matched.
+func (db *PanelUserDB) LookupNet(ip net.IP) (PanelUser, bool) {
+	if db == nil || ip == nil {
+		return PanelUser{}, false
+	}
+	for _, n := range db.nets {
+		if n.net.Contains(ip) {
+			return n.user, true
+		}
+	}
+	return PanelUser{}, false
+}
+
+// PanelUserIdentity defines where users put their token when connecting.
+type PanelUserIdentity struct {
+	// Domain under which the token is the first label of the TLS server name,
+	// like "dns.example.com" for <token>.dns.example.com.
+	Domain string
+
+	// DoH path under which the token is the next element, like "/dns-query"
+	// for /dns-query/<token>.
+	Path string
+}
+
+// Returns the token of a client based on its TLS server name or DoH path, or
+// the secret it authenticated with on a DoH listener.
+func (p PanelUserIdentity) token(ci ClientInfo) string {
+	if p.Domain != "" && ci.TLSServerName != "" {
+		name := strings.ToLower(strings.TrimSuffix(ci.TLSServerName, "."))
+		suffix := "." + strings.ToLower(strings.Trim(p.Domain, "."))
+		if token, ok := strings.CutSuffix(name, suffix); ok && token != "" && !strings.Contains(token, ".") {
+			return token
+		}
+	}
+	if p.Path != "" && ci.DoHPath != "" {
+		prefix := strings.TrimSuffix(p.Path, "/") + "/"
+		if rest, ok := strings.CutPrefix(ci.DoHPath, prefix); ok {
+			token, _, _ := strings.Cut(rest, "/")
+			return token
+		}
+	}
+	return ci.AuthSecret
+}
+
+// Identifies the panel user of a query by its token and records it in the
+// client info.
+func (p PanelUserIdentity) identify(db *PanelUserDB, ci *ClientInfo) (PanelUser, bool) {
+	u, ok := db.Lookup(p.token(*ci))
+	if !ok {
+		return PanelUser{}, false
+	}
+	ci.User = strconv.Itoa(u.ID)
+	return u, true
+}
+
+// Returns the IPs and networks of the users for the IP allowlist. Users without
+// IP are skipped, as are users with an invalid one so they can't prevent the
+// allowlist from being built for everyone else.
+func panelUserNetworks(users []api.UserInfo) conf.StringList {
+	list := make(conf.StringList, 0, len(users))
+	for _, u := range users {
+		if u.Passwd == "" {
+			continue
+		}
+		if _, err := ToCidrList(conf.StringList{u.Passwd}); err != nil {
+			Log.WithFields(logrus.Fields{"uid": u.UID, "ip": u.Passwd}).WithError(err).Warn("ignoring panel user with invalid IP")
+			continue
+		}
+		list = append(list, u.Passwd)
+	}
+	return list
+}
+
+// Changes between two panel user lists, by user ID.
+type panelUserChanges struct {
+	added, removed, changed []api.UserInfo
+}
+
+func (c panelUserChanges) empty() bool {
+	return len(c.added) == 0 && len(c.removed) == 0 && len(c.changed) == 0
+}
+
+func diffPanelUsers(old, new []api.UserInfo) panelUserChanges {
+	var c panelUserChanges
+	byID := make(map[int]api.UserInfo, len(old))
+	for _, u := range old {
+		byID[u.UID] = u
+	}
+	for _, u := range new {
+		prev, ok := byID[u.UID]
+		switch {
+		case !ok:
+			c.added = append(c.added, u)
+		case prev != u:
+			c.changed = append(c.changed, u)
+		}
+		delete(byID, u.UID)
+	}
+	for _, u := range old {
+		if _, ok := byID[u.UID]; ok {
+			c.removed = append(c.removed, u)
+		}
+	}
+	return c
+}
@@ -0,0 +1,77 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPanelUserIdentity(t *testing.T) {
+	db := NewPanelUserDB([]api.UserInfo{
+		{UID: 1, Email: "a@example.com", UUID: "6F1D8A3E-0000-4000-8000-000000000001"},
+		{UID: 2, Email: "b@example.com", UUID: "6f1d8a3e-0000-4000-8000-000000000002"},
+		{UID: 3, Email: "c@example.com", Passwd: "10.0.0.0/24"},
+		{UID: 4, Email: "d@example.com", Passwd: "192.168.1.1"},
+	})
+	p := PanelUserIdentity{Domain: "dns.example.com.", Path: "/dns-query"}
+
+	tests := []struct {
+		ci   ClientInfo
+		user string
+	}{
+		{ci: ClientInfo{TLSServerName: "6f1d8a3e-0000-4000-8000-000000000001.dns.example.com"}, user: "1"},
+		{ci: ClientInfo{TLSServerName: "6F1D8A3E-0000-4000-8000-000000000002.DNS.example.com."}, user: "2"},
+		{ci: ClientInfo{DoHPath: "/dns-query/6f1d8a3e-0000-4000-8000-000000000002"}, user: "2"},
+		{ci: ClientInfo{DoHPath: "/dns-query/6f1d8a3e-0000-4000-8000-000000000001/extra"}, user: "1"},
+		{ci: ClientInfo{TLSServerName: "dns.example.com"}},
+		{ci: ClientInfo{TLSServerName: "x.6f1d8a3e-0000-4000-8000-000000000001.dns.example.com"}},
+		{ci: ClientInfo{TLSServerName: "unknown.dns.example.com"}},
+		{ci: ClientInfo{DoHPath: "/dns-query"}},
+		{ci: ClientInfo{DoHPath: "/other/6f1d8a3e-0000-4000-8000-000000000001"}},
+	}
+	for _, test := range tests {
+		ci := test.ci
+		_, ok := p.identify(db, &ci)
+		require.Equal(t, test.user != "", ok, test.ci)
+		require.Equal(t, test.user, ci.User, test.ci)
+	}
+
+	// Users registered with an IP or network in the panel
+	u, ok := db.LookupIP(net.ParseIP("10.0.0.5"))
+	require.True(t, ok)
+	require.Equal(t, 3, u.ID)
+	u, ok = db.LookupIP(net.ParseIP("192.168.1.1"))
+	require.True(t, ok)
+	require.Equal(t, 4, u.ID)
+	_, ok = db.LookupIP(net.ParseIP("192.168.1.2"))
+	require.False(t, ok)
+}
+
+func TestDiffPanelUsers(t *testing.T) {
+	old := []api.UserInfo{
+		{UID: 1, Passwd: "10.0.0.1"},
+		{UID: 2, Passwd: "10.0.0.2"},
+		{UID: 3, Passwd: "10.0.0.3"},
+	}
+	new := []api.UserInfo{
+		{UID: 1, Passwd: "10.0.0.1"},
+		{UID: 3, Passwd: "10.0.0.30"},
+		{UID: 4, Passwd: "10.0.0.4"},
+	}
+	c := diffPanelUsers(old, new)
+	require.Equal(t, []api.UserInfo{{UID: 4, Passwd: "10.0.0.4"}}, c.added)
+	require.Equal(t, []api.UserInfo{{UID: 3, Passwd: "10.0.0.30"}}, c.changed)
+	require.Equal(t, []api.UserInfo{{UID: 2, Passwd: "10.0.0.2"}}, c.removed)
+	require.True(t, diffPanelUsers(new, new).empty())
+
+	// Users without or with invalid IPs are left out of the allowlist
+	networks := panelUserNetworks([]api.UserInfo{
+		{UID: 1, Passwd: "10.0.0.1"},
+		{UID: 2},
+		{UID: 3, Passwd: "not-an-ip"},
+		{UID: 4, Passwd: "10.1.0.0/16"},
+	})
+	require.Equal(t, []string{"10.0.0.1", "10.1.0.0/16"}, []string(networks))
+}
@@ -1,6 +1,8 @@
 package rdns
 
 import (
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"net"
@@ -16,6 +18,9 @@ const defaultQueryTimeout = 2 * time.Second
 // Tear down an upstream connection if nothing has been received for this long.
 const idleTimeout = 10 * time.Second
 
+// Upper limit of the reconnect backoff if none is given.
+const defaultMaxReconnectBackoff = 30 * time.Second
+
 // Pipeline is a DNS client that is able to use pipelining for multiple requests over
 // one connection, handle out-of-order responses and deals with disconnects
 // gracefully. It opens a single connection on demand and uses it for all queries.
@@ -26,6 +31,50 @@ type Pipeline struct {
 	requests chan *request
 	metrics  *ListenerMetrics
 	timeout  time.Duration
+	opt      PipelineOptions
+
+	// Queries waiting to be sent, and queries sent but not answered yet, on
+	// all connections.
+	waiting  *expvar.Int
+	inflight *expvar.Int
+
+	// Keepalive queries sent
+	keepalive *expvar.Int
+
+	// Closed to stop the pipeline and close its connections
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// PipelineOptions contains options to tune how queries are sent to an upstream.
+type PipelineOptions struct {
+	// Maximum number of queries in flight on one connection. Further queries
+	// wait until a response is received or a query times out. 0 means no limit.
+	MaxInflight int
+
+	// Number of connections opened to the upstream in parallel, to avoid
+	// head-of-line blocking on a single connection. Defaults to 1.
+	Connections int
+
+	// Time to wait before opening a connection again after it failed. Doubled
+	// with every consecutive failure, up to MaxReconnectBackoff. Queries fail
+	// right away while waiting. 0 means no backoff.
+	ReconnectBackoff    time.Duration
+	MaxReconnectBackoff time.Duration
+
+	// Only send one query at a time on a connection, for upstreams that don't
+	// handle pipelined queries or out-of-order responses (RFC7766 6.2.1.1).
+	InOrder bool
+
+	// Open connections right away rather than with the first query, and keep
+	// them open by sending a query whenever nothing was sent for this long.
+	// Connections that are closed are opened again immediately. 0 means
+	// connections are opened on demand and closed when idle.
+	KeepAlive time.Duration
+
+	// Secrets of TSIG keys by name. Queries with a TSIG record for one of the
+	// keys are signed, and the signature of the response is verified.
+	TSIGSecret map[string]string
 }
 
 // DNSDialer is an abstraction for a dns.Client that returns a *dns.Conn.
@@ -34,47 +83,88 @@ type DNSDialer interface {
 }
 
 // NewPipeline returns an initialized (and running) DNS connection manager.
-func NewPipeline(id string, addr string, client DNSDialer, timeout time.Duration) *Pipeline {
+func NewPipeline(id string, addr string, client DNSDialer, timeout time.Duration, opt PipelineOptions) *Pipeline {
 	if timeout == 0 {
 		timeout = defaultQueryTimeout
 	}
+	if opt.Connections < 1 {
+		opt.Connections = 1
+	}
+	if opt.InOrder {
+		opt.MaxInflight = 1
+	}
+	if opt.MaxReconnectBackoff == 0 {
+		opt.MaxReconnectBackoff = defaultMaxReconnectBackoff
+	}
 	c := &Pipeline{
 		addr:     addr,
 		client:   client,
 		requests: make(chan *request),
 		metrics:  NewListenerMetrics("client", id),
 		timeout:  timeout,
+		opt:      opt,
+		waiting:  getVarInt("client", id, "waiting"),
+		inflight: getVarInt("client", id, "inflight"),
+
+		keepalive: getVarInt("client", id, "keepalive"),
+		closed:    make(chan struct{}),
+	}
+	for i := 0; i < opt.Connections; i++ {
+		go c.start()
 	}
-	go c.start()
 	return c
 }
 
-// Resolve a single query using this connection.
-func (c *Pipeline) Resolve(q *dns.Msg) (*dns.Msg, error) {
+// Resolve a single query using this connection. The query times out after
+// the pipeline's timeout or at the deadline, if one is given and it's sooner.
+func (c *Pipeline) Resolve(q *dns.Msg, deadline time.Time) (*dns.Msg, error) {
+	d := ClientInfo{Deadline: deadline}.timeout(c.timeout)
+	if d <= 0 {
+		c.metrics.err.Add("querytimeout", 1)
+		return nil, QueryTimeoutError{q}
+	}
 	r := newRequest(q)
 
-	timeout := time.NewTimer(c.timeout)
+	timeout := time.NewTimer(d)
 	defer timeout.Stop()
 
 	// Queue up the request or time out
+	c.waiting.Add(1)
 	select {
 	case c.requests <- r:
+		c.waiting.Add(-1)
 	case <-timeout.C:
+		c.waiting.Add(-1)
 		c.metrics.err.Add("querytimeout", 1)
 		return nil, QueryTimeoutError{q}
+	case <-c.closed:
+		c.waiting.Add(-1)
+		return nil, errPipelineClosed
 	}
 
 	// Wait for the request to complete or time out
 	select {
 	case <-r.done:
 	case <-timeout.C:
+		r.release() // let the connection send other queries in its place
 		c.metrics.err.Add("querytimeout", 1)
 		return nil, QueryTimeoutError{q}
+	case <-c.closed:
+		r.release()
+		return nil, errPipelineClosed
 	}
 
 	return r.waitFor()
 }
 
+// Close stops the pipeline and closes its connections. Queries sent after
+// that fail.
+func (c *Pipeline) Close() {
+	c.closeOnce.Do(func() { close(c.closed) })
+}
+
+var errPipelineClosed = errors.New("pipeline closed")
+
 // Starts a loop that will wait for queries and open an upstream connection on-demand, writing queries
 // and reading answers concurrently using the same connection. It also handles errors like idle
 // close from upstream.
@@ -82,41 +172,132 @@ func (c *Pipeline) start() {
 	var (
 		wg       sync.WaitGroup
 		inFlight inFlightQueue
+
+		// Reconnect backoff after failures to open a connection
+		backoff time.Duration
+		retryAt time.Time
+		dialErr error
 	)
 	log := Log.WithField("addr", c.addr)
-	for req := range c.requests { // Lazy connection. Only open a real connection if there's a request
+	for {
+		// Lazy connection. Only open a real connection if there's a request,
+		// unless connections are kept open.
+		var req *request
+		if c.opt.KeepAlive == 0 {
+			select {
+			case req = <-c.requests:
+			case <-c.closed:
+				return
+			}
+		} else {
+			select {
+			case <-c.closed:
+				return
+			default:
+			}
+		}
+		if req != nil && time.Now().Before(retryAt) {
+			req.markDone(nil, dialErr) // fail fast until it's time to reconnect
+			continue
+		}
 		done := make(chan struct{})
 		log.Trace("opening connection")
 		conn, err := c.client.Dial(c.addr)
 		if err != nil {
 			c.metrics.err.Add("open", 1)
 			log.WithError(err).Error("failed to open connection")
+			if c.opt.ReconnectBackoff > 0 {
+				backoff = min(max(2*backoff, c.opt.ReconnectBackoff), c.opt.MaxReconnectBackoff)
+				retryAt = time.Now().Add(backoff)
+				dialErr = err
+			}
+			if req == nil {
+				// Connections are kept open, wait before trying again
+				select {
+				case <-time.After(max(backoff, time.Second)):
+				case <-c.closed:
+					return
+				}
+				continue
+			}
 			req.markDone(nil, err)
 			continue
 		}
+		backoff = 0
 		wg.Add(2)
 
-		go func() { c.requests <- req }() // re-queue the request that triggered the upstream connection
+		if req != nil {
+			go func(req *request) { // re-queue the request that triggered the upstream connection
+				select {
+				case c.requests <- req:
+				case <-c.closed:
+					req.markDone(nil, errPipelineClosed)
+				}
+			}(req)
+		}
+
+		// Slots for queries in flight on this connection if limited
+		var slots chan struct{}
+		if c.opt.MaxInflight > 0 {
+			slots = make(chan struct{}, c.opt.MaxInflight)
+		}
 
 		go func() { // writer
+			var keepAlive <-chan time.Time
+			if c.opt.KeepAlive > 0 {
+				ticker := time.NewTicker(c.opt.KeepAlive)
+				defer ticker.Stop()
+				keepAlive = ticker.C
+			}
+			lastSent := time.Now()
 			for {
-				select {
-				case req := <-c.requests:
-					query := inFlight.add(req)
-					log.WithField("qname", qName(query)).Trace("sending query")
-					c.metrics.query.Add(1)
-					if err := conn.WriteMsg(query); err != nil {
-						req.markDone(nil, err) // fail the request
-						inFlight.get(query)    // clean up the in-flight queue so it doesn't keep growing
-						conn.Close()           // throw away this connection, should wake up the reader as well
+				// Wait for a free slot before accepting the next query
+				if slots != nil {
+					select {
+					case slots <- struct{}{}:
+					case <-done:
 						wg.Done()
-						c.metrics.err.Add("send_query", 1)
-						log.WithField("qname", qName(query)).WithError(err).Trace("failed sending query")
 						return
+					case <-c.closed:
+						conn.Close()
+						wg.Done()
+						return
+					}
+				}
+				var req *request
+				select {
+				case req = <-c.requests:
+					req.hold(slots, c.inflight)
+				case <-keepAlive:
+					// Keepalive queries don't take up a slot since nothing waits for them
+					if slots != nil {
+						<-slots
+					}
+					if time.Since(lastSent) < c.opt.KeepAlive {
+						continue
 					}
+					req = newRequest(keepAliveQuery())
+					c.keepalive.Add(1)
 				case <-done: // the reader ran into an error and we want to stop using this connection
 					wg.Done()
 					return
+				case <-c.closed:
+					conn.Close() // wakes up the reader
+					wg.Done()
+					return
+				}
+				lastSent = time.Now()
+				query := inFlight.add(req)
+				log.WithField("qname", qName(query)).Trace("sending query")
+				c.metrics.query.Add(1)
+				if err := c.writeMsg(conn, query, req); err != nil {
+					req.markDone(nil, err) // fail the request
+					inFlight.get(query)    // clean up the in-flight queue so it doesn't keep growing
+					conn.Close()           // throw away this connection, should wake up the reader as well
+					wg.Done()
+					c.metrics.err.Add("send_query", 1)
+					log.WithField("qname", qName(query)).WithError(err).Trace("failed sending query")
+					return
 				}
 			}
 		}()
@@ -127,7 +308,12 @@ func (c *Pipeline) start() {
 				// a reconnect in that case as well. This does create a very slight race however if the
 				// sender is using the connection right at the time of the timeout in the receiver.
 				_ = conn.SetReadDeadline(time.Now().Add(idleTimeout))
-				a, err := conn.ReadMsg()
+				raw, err := conn.ReadMsgHeader(nil)
+				var a *dns.Msg
+				if err == nil {
+					a = new(dns.Msg)
+					err = a.Unpack(raw)
+				}
 				if err != nil {
 					switch e := err.(type) {
 					case net.Error:
@@ -167,6 +353,12 @@ func (c *Pipeline) start() {
 					log.WithField("qname", qName(a)).Warn("unexpected answer received, ignoring")
 					continue
 				}
+				if err := c.verifyMsg(raw, a, req); err != nil {
+					c.metrics.err.Add("tsig", 1)
+					log.WithField("qname", qName(a)).WithError(err).Warn("invalid tsig signature")
+					req.markDone(nil, err)
+					continue
+				}
 				c.metrics.response.Add(rCode(a), 1)
 				req.markDone(a, nil)
 				ql := inFlight.maxQueueLen()
@@ -181,12 +373,63 @@ func (c *Pipeline) start() {
 	}
 }
 
+// Writes a query to the connection, and signs it if it has a TSIG record.
+// dns.Conn can sign queries as well, but includes the MAC of the previous
+// query on the connection, which only works for zone transfers.
+func (c *Pipeline) writeMsg(conn *dns.Conn, query *dns.Msg, req *request) error {
+	t := query.IsTsig()
+	if t == nil {
+		return conn.WriteMsg(query)
+	}
+	secret, ok := c.opt.TSIGSecret[t.Hdr.Name]
+	if !ok {
+		return dns.ErrSecret
+	}
+	out, mac, err := dns.TsigGenerate(query, secret, "", false)
+	if err != nil {
+		return err
+	}
+	req.mu.Lock()
+	req.tsigMAC = mac
+	req.mu.Unlock()
+	_, err = conn.Write(out)
+	return err
+}
+
+// Verifies the signature of the response to a signed query. Responses to
+// unsigned queries aren't checked.
+func (c *Pipeline) verifyMsg(raw []byte, a *dns.Msg, req *request) error {
+	req.mu.Lock()
+	mac := req.tsigMAC
+	req.mu.Unlock()
+	if mac == "" {
+		return nil
+	}
+	t := a.IsTsig()
+	if t == nil {
+		return errors.New("unsigned response to signed query")
+	}
+	secret, ok := c.opt.TSIGSecret[t.Hdr.Name]
+	if !ok {
+		return dns.ErrSecret
+	}
+	return dns.TsigVerify(raw, secret, mac, false)
+}
+
 // Request received from a client. It also contains the response and a channel that is
 // closed when the request is done.
 type request struct {
 	q, a *dns.Msg
 	err  error
 	done chan struct{}
+
+	// Connection slot and in-flight gauge held while the query is sent
+	mu       sync.Mutex
+	slots    chan struct{}
+	inflight *expvar.Int
+
+	// MAC of the signed query, needed to verify the response
+	tsigMAC string
 }
 
 func newRequest(q *dns.Msg) *request {
@@ -215,8 +458,33 @@ func (r *request) waitFor() (*dns.Msg, error) {
 	return r.a, r.err
 }
 
+// Marks the request as in flight, holding a slot of the connection if the
+// number of queries in flight is limited.
+func (r *request) hold(slots chan struct{}, inflight *expvar.Int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.slots = slots
+	r.inflight = inflight
+	inflight.Add(1)
+}
+
+// Releases the connection slot held by the request. Can be called more than once.
+func (r *request) release() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.slots != nil {
+		<-r.slots
+		r.slots = nil
+	}
+	if r.inflight != nil {
+		r.inflight.Add(-1)
+		r.inflight = nil
+	}
+}
+
 // Mark the request as complete.
 func (r *request) markDone(a *dns.Msg, err error) {
+	r.release()
 	if a != nil {
 		a.Id = r.q.Id // Fix the query ID in the answer to match the query
 	}
@@ -248,6 +516,10 @@ func (q *inFlightQueue) add(r *request) *dns.Msg {
 	q.requests[q.idCounter] = r
 	query := r.q.Copy()
 	query.Id = q.idCounter
+	// The signature of signed queries covers the original ID
+	if t := query.IsTsig(); t != nil {
+		t.OrigId = query.Id
+	}
 	if len(q.requests) > q.maxLen {
 		q.maxLen = len(q.requests)
 	}
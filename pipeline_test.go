@@ -2,6 +2,8 @@ package rdns
 
 import (
 	"errors"
+	"net"
+	"sync"
 	"testing"
 	"time"
 
@@ -20,20 +22,159 @@ func TestPipelineQueryTimeout(t *testing.T) {
 		time.Sleep(2 * time.Second)
 		return nil, errors.New("failed")
 	}
-	p := NewPipeline("test", "localhost:53", testDialer(df), time.Second)
+	p := NewPipeline("test", "localhost:53", testDialer(df), time.Second, PipelineOptions{})
 
 	q := new(dns.Msg)
 	q.SetQuestion("example.com.", dns.TypeA)
 
 	// Send some queries to start the pipeline
-	_, _ = p.Resolve(q)
-	_, _ = p.Resolve(q)
+	_, _ = p.Resolve(q, time.Time{})
+	_, _ = p.Resolve(q, time.Time{})
 
 	// Record when we sent the query in order to tell how long it took
 	start := time.Now()
-	_, err := p.Resolve(q)
+	_, err := p.Resolve(q, time.Time{})
 
 	// Make sure we get a timeout error and it took the right amount to come back
 	require.ErrorAs(t, err, &QueryTimeoutError{})
 	require.WithinDuration(t, start.Add(time.Second), time.Now(), 10*time.Millisecond)
 }
+
+func TestPipelineReconnectBackoff(t *testing.T) {
+	var dials int
+	df := func(address string) (*dns.Conn, error) {
+		dials++
+		return nil, errors.New("failed")
+	}
+	p := NewPipeline("test-backoff", "localhost:53", testDialer(df), time.Second, PipelineOptions{
+		ReconnectBackoff: time.Hour,
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// The second query fails without trying to connect again
+	_, err := p.Resolve(q, time.Time{})
+	require.Error(t, err)
+	_, err = p.Resolve(q, time.Time{})
+	require.Error(t, err)
+	require.NotErrorIs(t, err, QueryTimeoutError{})
+	require.Equal(t, 1, dials)
+}
+
+func TestPipelineInOrder(t *testing.T) {
+	// Upstream that answers queries after a delay and records the number
+	// of queries it received but didn't answer yet
+	var (
+		mu                  sync.Mutex
+		pending, maxPending int
+	)
+	df := func(address string) (*dns.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			conn := &dns.Conn{Conn: server}
+			for {
+				q, err := conn.ReadMsg()
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				pending++
+				maxPending = max(maxPending, pending)
+				mu.Unlock()
+				go func() {
+					time.Sleep(50 * time.Millisecond)
+					mu.Lock()
+					pending--
+					mu.Unlock()
+					a := new(dns.Msg)
+					a.SetReply(q)
+					_ = conn.WriteMsg(a)
+				}()
+			}
+		}()
+		return &dns.Conn{Conn: client}, nil
+	}
+
+	resolve := func(p *Pipeline) {
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				q := new(dns.Msg)
+				q.SetQuestion("example.com.", dns.TypeA)
+				_, err := p.Resolve(q, time.Time{})
+				require.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+	}
+
+	// Queries are pipelined by default
+	resolve(NewPipeline("test-pipelined", "localhost:53", testDialer(df), time.Second, PipelineOptions{}))
+	require.Greater(t, maxPending, 1)
+
+	// Only one query at a time when responses have to be in order
+	maxPending = 0
+	resolve(NewPipeline("test-in-order", "localhost:53", testDialer(df), time.Second, PipelineOptions{InOrder: true}))
+	require.Equal(t, 1, maxPending)
+}
+
+func TestPipelineKeepAlive(t *testing.T) {
+	// Upstream that answers all queries and forwards them to the test
+	queries := make(chan *dns.Msg, 10)
+	df := func(address string) (*dns.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			conn := &dns.Conn{Conn: server}
+			for {
+				q, err := conn.ReadMsg()
+				if err != nil {
+					return
+				}
+				queries <- q
+				a := new(dns.Msg)
+				a.SetReply(q)
+				_ = conn.WriteMsg(a)
+			}
+		}()
+		return &dns.Conn{Conn: client}, nil
+	}
+	NewPipeline("test-keepalive", "localhost:53", testDialer(df), time.Second, PipelineOptions{
+		KeepAlive: 100 * time.Millisecond,
+	})
+
+	// Without any queries from clients, the upstream should see keepalive queries
+	select {
+	case q := <-queries:
+		require.Equal(t, ".", q.Question[0].Name)
+		require.Equal(t, dns.TypeNS, q.Question[0].Qtype)
+	case <-time.After(time.Second):
+		t.Fatal("no keepalive query received")
+	}
+}
+
+func TestPipelineClose(t *testing.T) {
+	upstream := new(TestResolver)
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	s := NewDNSListener("test-ln", addr, "tcp", ListenOptions{}, upstream)
+	go func() { _ = s.Start() }()
+	defer s.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	p := NewPipeline("test-close", addr, GenericDNSClient{Net: "tcp"}, time.Second, PipelineOptions{})
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = p.Resolve(q, time.Time{})
+	require.NoError(t, err)
+
+	// Queries fail right away once the pipeline is closed
+	p.Close()
+	p.Close()
+	start := time.Now()
+	_, err = p.Resolve(q, time.Time{})
+	require.ErrorIs(t, err, errPipelineClosed)
+	require.Less(t, time.Since(start), 100*time.Millisecond)
+}
@@ -0,0 +1,127 @@
+package rdns
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Capabilities that can be kept after dropping privileges, by name.
+var capabilityNames = map[string]uintptr{
+	"CAP_CHOWN":            unix.CAP_CHOWN,
+	"CAP_DAC_OVERRIDE":     unix.CAP_DAC_OVERRIDE,
+	"CAP_DAC_READ_SEARCH":  unix.CAP_DAC_READ_SEARCH,
+	"CAP_NET_BIND_SERVICE": unix.CAP_NET_BIND_SERVICE,
+	"CAP_NET_ADMIN":        unix.CAP_NET_ADMIN,
+	"CAP_NET_RAW":          unix.CAP_NET_RAW,
+	"CAP_SYS_RESOURCE":     unix.CAP_SYS_RESOURCE,
+}
+
+// DropPrivileges switches the process to an unprivileged user and group,
+// keeping only the listed capabilities, like CAP_NET_BIND_SERVICE to be able
+// to bind listeners to ports below 1024. The group defaults to the primary
+// group of the user. Nothing is changed if the process already runs as the
+// user, for example after a handoff from a process that dropped its
+// privileges before.
+func DropPrivileges(userName, groupName string, keep []string) error {
+	uid, gid, err := lookupUserGroup(userName, groupName)
+	if err != nil {
+		return err
+	}
+	var caps []uintptr
+	for _, name := range keep {
+		c, ok := capabilityNames[strings.ToUpper(name)]
+		if !ok {
+			return fmt.Errorf("unsupported capability '%s'", name)
+		}
+		caps = append(caps, c)
+	}
+	if os.Getuid() == uid {
+		return nil
+	}
+
+	// Keep the permitted capabilities across the change of user. This, like the
+	// capabilities themselves, is a per-thread setting so it's applied to all
+	// threads of the process.
+	if _, _, e := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, unix.PR_SET_KEEPCAPS, 1, 0); e != 0 {
+		if e == syscall.ENOTSUP {
+			return errors.New("dropping privileges requires a binary built with CGO_ENABLED=0")
+		}
+		return fmt.Errorf("failed to keep capabilities: %w", e)
+	}
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("failed to set groups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("failed to set group: %w", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("failed to set user: %w", err)
+	}
+	if err := limitCapabilities(caps); err != nil {
+		return err
+	}
+	Log.WithFields(logrus.Fields{"uid": uid, "gid": gid, "capabilities": keep}).Info("dropped privileges")
+	return nil
+}
+
+// Restricts the capabilities of all threads to the given set. They're also
+// made ambient so a new process started during a handoff keeps them.
+func limitCapabilities(caps []uintptr) error {
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	for _, c := range caps {
+		data[c/32].Effective |= 1 << (c % 32)
+	}
+	for i := range data {
+		data[i].Permitted = data[i].Effective
+		data[i].Inheritable = data[i].Effective
+	}
+	if _, _, e := syscall.AllThreadsSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); e != 0 {
+		return fmt.Errorf("failed to set capabilities: %w", e)
+	}
+	for _, c := range caps {
+		if _, _, e := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, c); e != 0 {
+			return fmt.Errorf("failed to set ambient capabilities: %w", e)
+		}
+	}
+	return nil
+}
+
+// Returns the user and group IDs by name or numeric ID. Without group, the
+// primary group of the user is used.
+func lookupUserGroup(userName, groupName string) (int, int, error) {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		if u, err = user.LookupId(userName); err != nil {
+			return 0, 0, err
+		}
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return 0, 0, err
+	}
+	if groupName == "" {
+		return uid, gid, nil
+	}
+	g, err := user.LookupGroup(groupName)
+	if err != nil {
+		if g, err = user.LookupGroupId(groupName); err != nil {
+			return 0, 0, err
+		}
+	}
+	gid, err = strconv.Atoi(g.Gid)
+	return uid, gid, err
+}
@@ -0,0 +1,22 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookupUserGroup(t *testing.T) {
+	uid, gid, err := lookupUserGroup("0", "")
+	require.NoError(t, err)
+	require.Equal(t, 0, uid)
+	require.Equal(t, 0, gid)
+
+	_, _, err = lookupUserGroup("routedns-no-such-user", "")
+	require.Error(t, err)
+}
+
+func TestDropPrivilegesInvalidCapability(t *testing.T) {
+	err := DropPrivileges("0", "", []string{"CAP_NO_SUCH_THING"})
+	require.Error(t, err)
+}
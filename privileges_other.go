@@ -0,0 +1,9 @@
+//go:build !linux
+
+package rdns
+
+import "errors"
+
+func DropPrivileges(userName, groupName string, keep []string) error {
+	return errors.New("dropping privileges is not supported on this platform")
+}
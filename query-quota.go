@@ -0,0 +1,256 @@
+package rdns
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// QueryQuota is a resolver that limits the number of queries per user in an
+// hour and a day. Users identified by a panel blocklist have their own quota,
+// other clients are counted by client network. Queries exceeding the quota are
+// answered with REFUSED and an extended DNS error. Quotas reset at the start
+// of every hour and day.
+type QueryQuota struct {
+	id string
+	QueryQuotaOptions
+	resolver Resolver
+	metrics  *QueryQuotaMetrics
+
+	mu    sync.Mutex
+	hour  time.Time
+	day   time.Time
+	usage map[string]*QuotaUsage
+	now   func() time.Time
+}
+
+var _ Resolver = &QueryQuota{}
+
+// Maximum number of users and client networks whose queries are counted. Once
+// reached, those with the fewest queries in the day are dropped.
+const quotaMaxKeys = 100000
+
+// QuotaLimits defines the number of queries allowed per hour and day. A
+// limit of 0 means unlimited.
+type QuotaLimits struct {
+	Hourly uint64
+	Daily  uint64
+}
+
+type QueryQuotaOptions struct {
+	// Default limits for all users and clients.
+	QuotaLimits
+
+	// Limits for individual panel users by user ID, overriding the defaults.
+	// Quotas provided by the panel take precedence.
+	Users map[string]QuotaLimits
+
+	// Netmask to identify IP4 and IP6 clients without user, default 32 and 128.
+	Prefix4 uint8
+	Prefix6 uint8
+}
+
+type QueryQuotaMetrics struct {
+	// Count of queries.
+	query *expvar.Int
+	// Count of queries that exceeded the quota.
+	exceed *expvar.Int
+	// Count of queries that exceeded the quota by user or client network.
+	exceedUser *cappedVarMap
+}
+
+// QuotaUsage is the number of queries a user or client made in the current
+// hour and day.
+type QuotaUsage struct {
+	Key    string `json:"key"`
+	Hourly uint64 `json:"hourly"`
+	Daily  uint64 `json:"daily"`
+}
+
+// NewQueryQuota returns a new instance of a query quota resolver.
+func NewQueryQuota(id string, resolver Resolver, opt QueryQuotaOptions) *QueryQuota {
+	if opt.Prefix4 == 0 {
+		opt.Prefix4 = 32
+	}
+	if opt.Prefix6 == 0 {
+		opt.Prefix6 = 128
+	}
+	r := &QueryQuota{
+		id:                id,
+		QueryQuotaOptions: opt,
+		resolver:          resolver,
+		usage:             make(map[string]*QuotaUsage),
+		now:               time.Now,
+		metrics: &QueryQuotaMetrics{
+			query:      getVarInt("query-quota", id, "query"),
+			exceed:     getVarInt("query-quota", id, "exceed"),
+			exceedUser: getCappedVarMap("query-quota", id, "exceed-user"),
+		},
+	}
+	registerAdminHandler("/routedns/query-quota/"+id, r)
+	return r
+}
+
+// Resolve a DNS query unless the user or client exceeded its quota.
+func (r *QueryQuota) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	log := logger(r.id, q, ci)
+	r.metrics.query.Add(1)
+
+	key, limits := r.key(ci)
+	if !r.count(key, limits) {
+		r.metrics.exceed.Add(1)
+		r.metrics.exceedUser.Add(key, 1)
+		log.WithField("key", key).Debug("query quota exceeded, refusing")
+		return quotaExceeded(q), nil
+	}
+	log.WithField("resolver", r.resolver).Debug("forwarding query to resolver")
+	return r.resolver.Resolve(q, ci)
+}
+
+func (r *QueryQuota) String() string {
+	return r.id
+}
+
+// Check Cert
+func (r *QueryQuota) CertMonitor() error {
+	return nil
+}
+
+// Usage returns the query counts of all users and clients in the current
+// hour and day.
+func (r *QueryQuota) Usage() []QuotaUsage {
+	r.mu.Lock()
+	r.reset()
+	list := make([]QuotaUsage, 0, len(r.usage))
+	for _, u := range r.usage {
+		list = append(list, *u)
+	}
+	r.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list
+}
+
+// Reset clears the query counts of a user or client.
+func (r *QueryQuota) Reset(key string) {
+	r.mu.Lock()
+	delete(r.usage, key)
+	r.mu.Unlock()
+}
+
+// ServeHTTP lists the query counts on GET and resets the counts of the user
+// or client network given in the "key" parameter on DELETE.
+func (r *QueryQuota) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.Usage())
+	case http.MethodDelete:
+		key := req.URL.Query().Get("key")
+		if key == "" {
+			http.Error(w, "missing key parameter", http.StatusBadRequest)
+			return
+		}
+		r.Reset(key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Counts a query and returns false if it exceeds the quota.
+func (r *QueryQuota) count(key string, limits QuotaLimits) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reset()
+	// Users and clients without limits aren't counted
+	if limits.Hourly == 0 && limits.Daily == 0 {
+		return true
+	}
+	u, ok := r.usage[key]
+	if !ok {
+		if len(r.usage) >= quotaMaxKeys {
+			r.evict()
+		}
+		u = &QuotaUsage{Key: key}
+		r.usage[key] = u
+	}
+	if (limits.Hourly > 0 && u.Hourly >= limits.Hourly) || (limits.Daily > 0 && u.Daily >= limits.Daily) {
+		return false
+	}
+	u.Hourly++
+	u.Daily++
+	return true
+}
+
+// Drops the counts of users and clients with no more than the average number of
+// queries in the day, to make room for new ones. Those close to their limits
+// are kept, while most of those seen only once, like spoofed sources, go. Must
+// be called with the lock held.
+func (r *QueryQuota) evict() {
+	var total uint64
+	for _, u := range r.usage {
+		total += u.Daily
+	}
+	avg := total / uint64(len(r.usage))
+	for key, u := range r.usage {
+		if u.Daily <= avg {
+			delete(r.usage, key)
+		}
+	}
+}
+
+// Resets the hourly and daily counts once a new hour or day has started. Must
+// be called with the lock held.
+func (r *QueryQuota) reset() {
+	now := r.now()
+	hour := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 0, 0, now.Location())
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	switch {
+	case !day.Equal(r.day):
+		r.usage = make(map[string]*QuotaUsage)
+	case !hour.Equal(r.hour):
+		for _, u := range r.usage {
+			u.Hourly = 0
+		}
+	}
+	r.hour, r.day = hour, day
+}
+
+// Returns the key to count the query under and the limits that apply to it.
+// The quota of a user from the panel takes precedence over the configuration.
+func (r *QueryQuota) key(ci ClientInfo) (string, QuotaLimits) {
+	if ci.User != "" {
+		if ci.Quota != nil {
+			return "user:" + ci.User, *ci.Quota
+		}
+		if limits, ok := r.Users[ci.User]; ok {
+			return "user:" + ci.User, limits
+		}
+		return "user:" + ci.User, r.QuotaLimits
+	}
+	return clientNetwork(ci.SourceIP, r.Prefix4, r.Prefix6), r.QuotaLimits
+}
+
+// Returns a REFUSED response with an extended DNS error explaining the reason
+// if the client supports EDNS0.
+func quotaExceeded(q *dns.Msg) *dns.Msg {
+	a := refused(q)
+	if q.IsEdns0() == nil {
+		return a
+	}
+	opt := new(dns.OPT)
+	opt.Hdr.Name = "."
+	opt.Hdr.Rrtype = dns.TypeOPT
+	opt.SetUDPSize(dns.DefaultMsgSize)
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{
+		InfoCode:  dns.ExtendedErrorCodeProhibited,
+		ExtraText: "query quota exceeded",
+	})
+	a.Extra = append(a.Extra, opt)
+	return a
+}
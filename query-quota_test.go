@@ -0,0 +1,127 @@
+package rdns
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryQuota(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(4096, false)
+
+	r := new(TestResolver)
+	opt := QueryQuotaOptions{
+		QuotaLimits: QuotaLimits{Hourly: 2, Daily: 3},
+		Users: map[string]QuotaLimits{
+			"42": {Hourly: 1},
+		},
+	}
+	quota := NewQueryQuota("test-quota", r, opt)
+	now := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	quota.now = func() time.Time { return now }
+
+	resolve := func(ci ClientInfo) int {
+		a, err := quota.Resolve(q, ci)
+		require.NoError(t, err)
+		return a.Rcode
+	}
+	client := ClientInfo{SourceIP: net.ParseIP("192.168.1.1")}
+	user := ClientInfo{SourceIP: net.ParseIP("192.168.1.1"), User: "42"}
+
+	// Hourly quota of the client
+	require.Equal(t, dns.RcodeSuccess, resolve(client))
+	require.Equal(t, dns.RcodeSuccess, resolve(client))
+	a, err := quota.Resolve(q, client)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+	ede, ok := a.IsEdns0().Option[0].(*dns.EDNS0_EDE)
+	require.True(t, ok)
+	require.Equal(t, dns.ExtendedErrorCodeProhibited, ede.InfoCode)
+
+	// The user behind the same IP has its own quota
+	require.Equal(t, dns.RcodeSuccess, resolve(user))
+	require.Equal(t, dns.RcodeRefused, resolve(user))
+	require.Equal(t, 3, r.HitCount())
+
+	// Next hour, the daily quota still applies to the client
+	now = now.Add(time.Hour)
+	require.Equal(t, dns.RcodeSuccess, resolve(client))
+	require.Equal(t, dns.RcodeRefused, resolve(client))
+	require.Equal(t, dns.RcodeSuccess, resolve(user))
+
+	require.Equal(t, []QuotaUsage{
+		{Key: "192.168.1.1/32", Hourly: 1, Daily: 3},
+		{Key: "user:42", Hourly: 1, Daily: 2},
+	}, quota.Usage())
+
+	// Everything is reset the next day
+	now = now.Add(24 * time.Hour)
+	require.Equal(t, dns.RcodeSuccess, resolve(client))
+	require.Len(t, quota.Usage(), 1)
+
+	// Reset a client manually
+	quota.Reset("192.168.1.1/32")
+	require.Empty(t, quota.Usage())
+
+	// The quota of a user from the panel takes precedence
+	panelUser := ClientInfo{SourceIP: net.ParseIP("192.168.1.1"), User: "42", Quota: &QuotaLimits{Hourly: 2}}
+	require.Equal(t, dns.RcodeSuccess, resolve(panelUser))
+	require.Equal(t, dns.RcodeSuccess, resolve(panelUser))
+	require.Equal(t, dns.RcodeRefused, resolve(panelUser))
+}
+
+func TestQueryQuotaUsage(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	quota := NewQueryQuota("test-quota-usage", new(TestResolver), QueryQuotaOptions{
+		Users: map[string]QuotaLimits{"42": {Hourly: 2}},
+	})
+	// Half an hour off UTC, hours start at :00 local time
+	now := time.Date(2024, 1, 1, 10, 0, 0, 0, time.FixedZone("IST", 5*3600+1800))
+	quota.now = func() time.Time { return now }
+	user := ClientInfo{SourceIP: net.ParseIP("192.168.1.1"), User: "42"}
+
+	// Clients without limits aren't counted
+	_, err := quota.Resolve(q, ClientInfo{SourceIP: net.ParseIP("192.168.1.2")})
+	require.NoError(t, err)
+	require.Empty(t, quota.Usage())
+
+	_, err = quota.Resolve(q, user)
+	require.NoError(t, err)
+	now = now.Add(59 * time.Minute)
+	_, err = quota.Resolve(q, user)
+	require.NoError(t, err)
+	require.Equal(t, []QuotaUsage{{Key: "user:42", Hourly: 2, Daily: 2}}, quota.Usage())
+	now = now.Add(time.Minute)
+	require.Equal(t, []QuotaUsage{{Key: "user:42", Hourly: 0, Daily: 2}}, quota.Usage())
+
+	// Once full, clients with few queries are dropped first
+	quota.QuotaLimits = QuotaLimits{Daily: 100}
+	for i := 0; len(quota.usage) < quotaMaxKeys; i++ {
+		_, err = quota.Resolve(q, ClientInfo{SourceIP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))})
+		require.NoError(t, err)
+	}
+	_, err = quota.Resolve(q, ClientInfo{SourceIP: net.ParseIP("192.168.1.3")})
+	require.NoError(t, err)
+	require.Equal(t, []QuotaUsage{
+		{Key: "192.168.1.3/32", Hourly: 1, Daily: 1},
+		{Key: "user:42", Hourly: 0, Daily: 2},
+	}, quota.Usage())
+}
+
+func TestCappedVarMap(t *testing.T) {
+	m := getCappedVarMap("test", "capped", "exceed")
+	for i := 0; i < varMapMaxKeys+10; i++ {
+		m.Add(strconv.Itoa(i), 1)
+	}
+	m.Add("0", 1)
+	require.Equal(t, "2", m.m.Get("0").String())
+	require.Equal(t, "10", m.m.Get("other").String())
+	require.Nil(t, m.m.Get(strconv.Itoa(varMapMaxKeys)))
+}
@@ -0,0 +1,76 @@
+package rdns
+
+import (
+	"sync"
+)
+
+// QueryTrace collects what happened to a query further down the chain, for
+// elements that report on queries once they're answered, like client
+// statistics. It's only set in the ClientInfo by elements that need it, all
+// methods are safe to call on a nil trace.
+type QueryTrace struct {
+	mu       sync.Mutex
+	blocked  bool
+	cacheHit bool
+	user     string
+}
+
+// SetBlocked records that the query was blocked by a blocklist.
+func (t *QueryTrace) SetBlocked() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.blocked = true
+	t.mu.Unlock()
+}
+
+// SetCacheHit records that the query was answered from a cache.
+func (t *QueryTrace) SetCacheHit() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.cacheHit = true
+	t.mu.Unlock()
+}
+
+// SetUser records the panel user the query was identified as.
+func (t *QueryTrace) SetUser(user string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.user = user
+	t.mu.Unlock()
+}
+
+// Blocked returns true if the query was blocked.
+func (t *QueryTrace) Blocked() bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.blocked
+}
+
+// CacheHit returns true if the query was answered from a cache.
+func (t *QueryTrace) CacheHit() bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.cacheHit
+}
+
+// User returns the panel user the query was identified as, if any.
+func (t *QueryTrace) User() string {
+	if t == nil {
+		return ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.user
+}
@@ -0,0 +1,256 @@
+package rdns
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+// QUIC listeners with the same address share one UDP socket. Connections are
+// handed to the listener serving the ALPN protocol negotiated by the client,
+// "doq" for DoQ and "h3" for DoH over HTTP/3, so both can be offered on a
+// single port.
+var quicMuxes = struct {
+	mu sync.Mutex
+	m  map[string]*quicMux
+}{m: make(map[string]*quicMux)}
+
+// quicMux accepts the connections on a shared QUIC socket and passes them on
+// to the listeners by ALPN protocol.
+type quicMux struct {
+	addr string
+	pc   net.PacketConn
+	tr   *quic.Transport
+	ln   *quic.Listener
+
+	mu        sync.Mutex
+	listeners []*quicListener
+}
+
+// quicListener receives the connections for its ALPN protocols from a shared
+// QUIC socket.
+type quicListener struct {
+	mux       *quicMux
+	tlsConfig *tls.Config
+	opt       quicListenOptions
+	conns     chan quic.Connection
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Options of a listener on a shared QUIC socket.
+type quicListenOptions struct {
+	// Maximum number of concurrent streams per connection, 0 for the default.
+	// The highest value of all listeners on the socket applies since the
+	// protocol isn't known yet when the connection is set up.
+	maxStreams int64
+
+	// Decides if a client has to validate its address with a Retry packet,
+	// optional. Clients are asked to if any of the listeners on the socket
+	// requires it.
+	verifySourceAddress func(net.Addr) bool
+}
+
+// Returns a listener for QUIC connections using one of the ALPN protocols in
+// the TLS config. The UDP socket is opened by the first listener for the
+// address and closed with the last one.
+func listenQUIC(addr string, tlsConfig *tls.Config, opt quicListenOptions) (*quicListener, error) {
+	if len(tlsConfig.NextProtos) == 0 {
+		return nil, errors.New("no alpn protocol in tls config")
+	}
+	l := &quicListener{
+		tlsConfig: tlsConfig,
+		opt:       opt,
+		conns:     make(chan quic.Connection),
+		done:      make(chan struct{}),
+	}
+
+	quicMuxes.mu.Lock()
+	defer quicMuxes.mu.Unlock()
+	m, ok := quicMuxes.m[addr]
+	if !ok {
+		var err error
+		m, err = newQUICMux(addr)
+		if err != nil {
+			return nil, err
+		}
+		quicMuxes.m[addr] = m
+	}
+	if err := m.add(l); err != nil {
+		return nil, err
+	}
+	l.mux = m
+	return l, nil
+}
+
+func newQUICMux(addr string) (*quicMux, error) {
+	pc, err := listenPacket("udp", addr, socketOptions{})
+	if err != nil {
+		return nil, err
+	}
+	m := &quicMux{addr: addr, pc: pc}
+	m.tr = &quic.Transport{
+		Conn:                pc,
+		VerifySourceAddress: m.verifySourceAddress,
+	}
+	m.ln, err = m.tr.Listen(
+		&tls.Config{GetConfigForClient: m.tlsConfigForClient},
+		&quic.Config{GetConfigForClient: m.quicConfigForClient},
+	)
+	if err != nil {
+		m.tr.Close()
+		pc.Close()
+		releaseSocket(socketOptions{}.key("udp", addr))
+		return nil, err
+	}
+	go m.serve()
+	return m, nil
+}
+
+// Adds a listener, unless one of its protocols is already served.
+func (m *quicMux) add(l *quicListener) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, proto := range l.tlsConfig.NextProtos {
+		if m.listener(proto) != nil {
+			return fmt.Errorf("alpn protocol '%s' is already served on %s", proto, m.addr)
+		}
+	}
+	m.listeners = append(m.listeners, l)
+	return nil
+}
+
+// Removes a listener and returns true if it was the last one.
+func (m *quicMux) remove(l *quicListener) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, e := range m.listeners {
+		if e == l {
+			m.listeners = append(m.listeners[:i], m.listeners[i+1:]...)
+			break
+		}
+	}
+	return len(m.listeners) == 0
+}
+
+// Returns the listener for an ALPN protocol, or nil. Must be called with the
+// lock held.
+func (m *quicMux) listener(proto string) *quicListener {
+	for _, l := range m.listeners {
+		for _, p := range l.tlsConfig.NextProtos {
+			if p == proto {
+				return l
+			}
+		}
+	}
+	return nil
+}
+
+// Picks the TLS config of the listener for the first protocol offered by the
+// client that is served on the socket.
+func (m *quicMux) tlsConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, proto := range hello.SupportedProtos {
+		l := m.listener(proto)
+		if l == nil {
+			continue
+		}
+		config := l.tlsConfig
+		if config.GetConfigForClient != nil {
+			c, err := config.GetConfigForClient(hello)
+			if err != nil {
+				return nil, err
+			}
+			if c != nil {
+				config = c
+			}
+		}
+		config = config.Clone()
+		config.NextProtos = []string{proto}
+		return config, nil
+	}
+	return nil, fmt.Errorf("no listener for alpn protocols %v", hello.SupportedProtos)
+}
+
+func (m *quicMux) quicConfigForClient(*quic.ClientHelloInfo) (*quic.Config, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	conf := new(quic.Config)
+	for _, l := range m.listeners {
+		conf.MaxIncomingStreams = max(conf.MaxIncomingStreams, l.opt.maxStreams)
+	}
+	return conf, nil
+}
+
+func (m *quicMux) verifySourceAddress(addr net.Addr) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, l := range m.listeners {
+		if l.opt.verifySourceAddress != nil && l.opt.verifySourceAddress(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Accepts connections and hands them to the listener for their protocol
+// until the socket is closed.
+func (m *quicMux) serve() {
+	for {
+		conn, err := m.ln.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		m.mu.Lock()
+		l := m.listener(conn.ConnectionState().TLS.NegotiatedProtocol)
+		m.mu.Unlock()
+		if l == nil {
+			// The listener was closed during the handshake
+			_ = conn.CloseWithError(0, "")
+			continue
+		}
+		select {
+		case l.conns <- conn:
+		case <-l.done:
+			_ = conn.CloseWithError(0, "")
+		}
+	}
+}
+
+// Accept returns the next connection for one of the listener's protocols.
+func (l *quicListener) Accept(ctx context.Context) (quic.Connection, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, quic.ErrServerClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close stops accepting connections. The socket is closed along with the last
+// listener on it.
+func (l *quicListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		quicMuxes.mu.Lock()
+		defer quicMuxes.mu.Unlock()
+		if !l.mux.remove(l) {
+			return
+		}
+		delete(quicMuxes.m, l.mux.addr)
+		err = l.mux.ln.Close()
+		_ = l.mux.tr.Close()
+		_ = l.mux.pc.Close()
+		releaseSocket(socketOptions{}.key("udp", l.mux.addr))
+	})
+	return err
+}
@@ -0,0 +1,52 @@
+package rdns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQUICMuxSharedPort(t *testing.T) {
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+
+	// DoQ and DoH over HTTP/3 listeners on the same address
+	doqUpstream := new(TestResolver)
+	doq := NewQUICListener("test-mux-doq", addr, DoQListenerOptions{TLSConfig: tlsServerConfig.Clone()}, doqUpstream)
+	go func() { _ = doq.Start() }()
+	defer doq.Stop()
+	dohUpstream := new(TestResolver)
+	doh, err := NewDoHListener("test-mux-doh", addr, DoHListenerOptions{TLSConfig: tlsServerConfig.Clone(), Transport: "quic"}, dohUpstream)
+	require.NoError(t, err)
+	go func() { _ = doh.Start() }()
+	defer doh.Stop()
+	time.Sleep(time.Second)
+
+	tlsClientConfig, err := TLSClientConfig("testdata/ca.crt", "", "", "")
+	require.NoError(t, err)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Each client reaches the listener for its protocol
+	doqClient, err := NewDoQClient("test-mux-doq", addr, DoQClientOptions{TLSConfig: tlsClientConfig.Clone()})
+	require.NoError(t, err)
+	_, err = doqClient.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, doqUpstream.HitCount())
+	require.Equal(t, 0, dohUpstream.HitCount())
+
+	dohClient, err := NewDoHClient("test-mux-doh", "https://"+addr+"/dns-query", DoHClientOptions{TLSConfig: tlsClientConfig.Clone(), Transport: "quic"})
+	require.NoError(t, err)
+	_, err = dohClient.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, doqUpstream.HitCount())
+	require.Equal(t, 1, dohUpstream.HitCount())
+
+	// Only one listener can serve a protocol on the socket
+	err = NewQUICListener("test-mux-doq2", addr, DoQListenerOptions{TLSConfig: tlsServerConfig.Clone()}, doqUpstream).Start()
+	require.Error(t, err)
+}
@@ -48,7 +48,7 @@ func NewRandom(id string, opt RandomOptions, resolvers ...Resolver) *Random {
 }
 
 // Resolve a DNS query using a random resolver.
-func (r *Random) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dialer) (*dns.Msg, error) {
+func (r *Random) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	log := logger(r.id, q, ci)
 	for {
 		resolver := r.pick()
@@ -59,7 +59,7 @@ func (r *Random) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dial
 
 		r.metrics.route.Add(resolver.String(), 1)
 		log.WithField("resolver", resolver.String()).Debug("forwarding query to resolver")
-		a, err := resolver.Resolve(q, ci, PanelSocksDialer)
+		a, err := resolver.Resolve(q, ci)
 		if err == nil && r.isSuccessResponse(a) { // Return immediately if successful
 			return a, err
 		}
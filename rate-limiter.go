@@ -3,6 +3,7 @@ package rdns
 import (
 	"expvar"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -25,13 +26,36 @@ type RateLimiter struct {
 var _ Resolver = &RateLimiter{}
 
 type RateLimiterOptions struct {
-	Requests      uint     // Number of requests allwed per time period
-	Window        uint     // Time period in seconds
-	Prefix4       uint8    // Netmask to identify IP4 clients
-	Prefix6       uint8    // Netmask to identify IP6 clients
-	LimitResolver Resolver // Alternate resolver for rate-limited requests
+	Requests      uint            // Number of requests allwed per time period
+	Window        uint            // Time period in seconds
+	Prefix4       uint8           // Netmask to identify IP4 clients
+	Prefix6       uint8           // Netmask to identify IP6 clients
+	LimitResolver Resolver        // Alternate resolver for rate-limited requests
+	Action        RateLimitAction // What to do with rate-limited requests. Defaults to RateLimitDrop, or RateLimitForward if LimitResolver is set
+	Exempt        []*net.IPNet    // Client networks that are not rate-limited
+	Key           RateLimitKey    // What requests are counted by. Defaults to RateLimitKeyClient
+	KeyLabels     int             // Number of labels of the query name used in the key, counted from the root. Default 0 uses the full name
 }
 
+// RateLimitKey defines what requests are grouped by when counting them.
+type RateLimitKey string
+
+const (
+	RateLimitKeyClient   RateLimitKey = "client"    // Client network, as defined by Prefix4 and Prefix6
+	RateLimitKeyName     RateLimitKey = "name"      // Query name
+	RateLimitKeyNameType RateLimitKey = "name-type" // Query name and type
+)
+
+// RateLimitAction defines how a rate limiter responds to queries that exceed the limit.
+type RateLimitAction string
+
+const (
+	RateLimitDrop     RateLimitAction = "drop"     // Drop the query without response
+	RateLimitRefuse   RateLimitAction = "refuse"   // Respond with REFUSED
+	RateLimitTruncate RateLimitAction = "truncate" // Respond with an empty, truncated response to force the client to retry over TCP
+	RateLimitForward  RateLimitAction = "forward"  // Forward the query to the LimitResolver
+)
+
 type RateLimiterMetrics struct {
 	// Count of queries.
 	query *expvar.Int
@@ -39,6 +63,10 @@ type RateLimiterMetrics struct {
 	exceed *expvar.Int
 	// Count of dropped queries.
 	drop *expvar.Int
+	// Count of queries from exempt clients.
+	exempt *expvar.Int
+	// Count of queries that have exceeded the rate limit by key (client network or name).
+	exceedNet *cappedVarMap
 }
 
 // NewRateLimiterIP returns a new instance of a query rate limiter.
@@ -52,31 +80,44 @@ func NewRateLimiter(id string, resolver Resolver, opt RateLimiterOptions) *RateL
 	if opt.Prefix6 == 0 {
 		opt.Prefix6 = 56
 	}
+	if opt.Key == "" {
+		opt.Key = RateLimitKeyClient
+	}
+	if opt.Action == "" {
+		opt.Action = RateLimitDrop
+		if opt.LimitResolver != nil {
+			opt.Action = RateLimitForward
+		}
+	}
 	return &RateLimiter{
 		id:                 id,
 		resolver:           resolver,
 		RateLimiterOptions: opt,
 		metrics: &RateLimiterMetrics{
-			query:  getVarInt("router", id, "query"),
-			exceed: getVarInt("router", id, "exceed"),
-			drop:   getVarInt("router", id, "drop"),
+			query:     getVarInt("router", id, "query"),
+			exceed:    getVarInt("router", id, "exceed"),
+			drop:      getVarInt("router", id, "drop"),
+			exempt:    getVarInt("router", id, "exempt"),
+			exceedNet: getCappedVarMap("router", id, "exceed-net"),
 		},
 	}
 }
 
 // Resolve a DNS query while limiting the query rate per time period.
-func (r *RateLimiter) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dialer) (*dns.Msg, error) {
+func (r *RateLimiter) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	log := logger(r.id, q, ci)
 	r.metrics.query.Add(1)
 
-	// Apply the desired mask to the client IP to build a key it identify the client (network)
-	source := ci.SourceIP
-	if ip4 := source.To4(); len(ip4) == net.IPv4len {
-		source = source.Mask(net.CIDRMask(int(r.Prefix4), 32))
-	} else {
-		source = source.Mask(net.CIDRMask(int(r.Prefix6), 128))
+	// Clients in exempt networks are never limited
+	for _, n := range r.Exempt {
+		if n.Contains(ci.SourceIP) {
+			r.metrics.exempt.Add(1)
+			log.WithField("resolver", r.resolver).Debug("client exempt from rate-limit, forwarding query to resolver")
+			return r.resolver.Resolve(q, ci)
+		}
 	}
-	key := source.String()
+
+	key := r.key(q, ci)
 
 	// Calculate the current (fixed) window
 	windowID := time.Now().Unix() / int64(r.Window)
@@ -106,16 +147,55 @@ func (r *RateLimiter) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks
 
 	if reject {
 		r.metrics.exceed.Add(1)
-		if r.LimitResolver != nil {
+		r.metrics.exceedNet.Add(key, 1)
+		switch r.Action {
+		case RateLimitForward:
+			if r.LimitResolver == nil {
+				break
+			}
 			log.WithField("resolver", r.LimitResolver).Debug("rate-limit exceeded, forwarding to limit-resolver")
-			return r.LimitResolver.Resolve(q, ci, PanelSocksDialer)
+			return r.LimitResolver.Resolve(q, ci)
+		case RateLimitRefuse:
+			log.Debug("rate-limit exceeded, refusing")
+			return refused(q), nil
+		case RateLimitTruncate:
+			log.Debug("rate-limit exceeded, responding with truncated answer")
+			return truncated(q), nil
 		}
 		r.metrics.drop.Add(1)
 		log.Debug("rate-limit reached, dropping")
 		return nil, nil
 	}
 	log.WithField("resolver", r.resolver).Debug("forwarding query to resolver")
-	return r.resolver.Resolve(q, ci, PanelSocksDialer)
+	return r.resolver.Resolve(q, ci)
+}
+
+// Builds the key used to count requests.
+func (r *RateLimiter) key(q *dns.Msg, ci ClientInfo) string {
+	switch r.Key {
+	case RateLimitKeyName, RateLimitKeyNameType:
+		name := strings.ToLower(q.Question[0].Name)
+		// Only use the top-most labels to count queries for random subdomains
+		// of the same zone together
+		if r.KeyLabels > 0 {
+			if idx := dns.Split(name); len(idx) > r.KeyLabels {
+				name = name[idx[len(idx)-r.KeyLabels]:]
+			}
+		}
+		if r.Key == RateLimitKeyNameType {
+			return name + ":" + dns.Type(q.Question[0].Qtype).String()
+		}
+		return name
+	}
+
+	// Apply the desired mask to the client IP to build a key it identify the client (network)
+	source := ci.SourceIP
+	if ip4 := source.To4(); len(ip4) == net.IPv4len {
+		source = source.Mask(net.CIDRMask(int(r.Prefix4), 32))
+	} else {
+		source = source.Mask(net.CIDRMask(int(r.Prefix6), 128))
+	}
+	return source.String()
 }
 
 func (r *RateLimiter) String() string {
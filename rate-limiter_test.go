@@ -0,0 +1,74 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiterActions(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	ci := ClientInfo{SourceIP: net.ParseIP("192.168.1.1")}
+
+	_, exempt, _ := net.ParseCIDR("10.0.0.0/8")
+	r := &TestResolver{}
+	opt := RateLimiterOptions{
+		Requests: 1,
+		Action:   RateLimitTruncate,
+		Exempt:   []*net.IPNet{exempt},
+	}
+	rl := NewRateLimiter("test-rl", r, opt)
+
+	// First query is passed through, the second is over the limit
+	_, err := rl.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r.HitCount())
+	a, err := rl.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r.HitCount())
+	require.True(t, a.Truncated)
+
+	// Exempt clients are never limited
+	ci.SourceIP = net.ParseIP("10.1.1.1")
+	for i := 0; i < 3; i++ {
+		_, err = rl.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 4, r.HitCount())
+}
+
+func TestRateLimiterByName(t *testing.T) {
+	r := &TestResolver{}
+	opt := RateLimiterOptions{
+		Requests:  2,
+		Action:    RateLimitRefuse,
+		Key:       RateLimitKeyName,
+		KeyLabels: 2,
+	}
+	rl := NewRateLimiter("test-rl-name", r, opt)
+
+	// Random subdomains from different clients are counted against the zone
+	for i, name := range []string{"a.example.com.", "b.example.com.", "c.example.com."} {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		ci := ClientInfo{SourceIP: net.IPv4(10, 0, byte(i), 1)}
+		a, err := rl.Resolve(q, ci)
+		require.NoError(t, err)
+		if i < 2 {
+			require.Equal(t, dns.RcodeSuccess, a.Rcode)
+		} else {
+			require.Equal(t, dns.RcodeRefused, a.Rcode)
+		}
+	}
+	require.Equal(t, 2, r.HitCount())
+
+	// Other zones are not affected
+	q := new(dns.Msg)
+	q.SetQuestion("a.example.net.", dns.TypeA)
+	_, err := rl.Resolve(q, ClientInfo{SourceIP: net.IPv4(10, 0, 0, 1)})
+	require.NoError(t, err)
+	require.Equal(t, 3, r.HitCount())
+}
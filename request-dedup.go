@@ -2,7 +2,10 @@ package rdns
 
 import (
 	"encoding/binary"
+	"expvar"
+	"net"
 	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -14,6 +17,7 @@ type dedupKey struct {
 	ecs_ipv6_hi uint64
 	ecs_ipv6_lo uint64
 	ecs_mask    uint8
+	client      string
 }
 
 type inflightRequest struct {
@@ -30,29 +34,64 @@ type inflightRequest struct {
 type requestDedup struct {
 	id       string
 	resolver Resolver
+	opt      RequestDedupOptions
 	mu       sync.Mutex
 	inflight map[dedupKey]*inflightRequest
+	metrics  *RequestDedupMetrics
 }
 
 var _ Resolver = &requestDedup{}
 
-func NewRequestDedup(id string, resolver Resolver) *requestDedup {
+type RequestDedupOptions struct {
+	// Don't use the ECS option of queries to tell them apart. Queries for the
+	// same name and type but different ECS subnets are deduplicated.
+	IgnoreECS bool
+
+	// If non-zero, the client address masked to this many bits is part of the
+	// key. Only queries from the same client network are deduplicated.
+	ClientPrefix4 uint8
+	ClientPrefix6 uint8
+
+	// Maximum time a duplicate query waits for the first one to be answered.
+	// After that, it's sent upstream independently. Default 0, which means
+	// no limit.
+	MaxWait time.Duration
+}
+
+type RequestDedupMetrics struct {
+	// Count of queries.
+	query *expvar.Int
+	// Count of queries answered with the response of another query.
+	coalesced *expvar.Int
+	// Count of duplicate queries that timed out waiting and were sent upstream.
+	timeout *expvar.Int
+}
+
+func NewRequestDedup(id string, resolver Resolver, opt RequestDedupOptions) *requestDedup {
 	return &requestDedup{
 		id:       id,
 		resolver: resolver,
+		opt:      opt,
 		inflight: make(map[dedupKey]*inflightRequest),
+		metrics: &RequestDedupMetrics{
+			query:     getVarInt("request-dedup", id, "query"),
+			coalesced: getVarInt("request-dedup", id, "coalesced"),
+			timeout:   getVarInt("request-dedup", id, "timeout"),
+		},
 	}
 }
 
-func (r *requestDedup) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dialer) (*dns.Msg, error) {
+func (r *requestDedup) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	var (
 		ecsIPv4              uint32
 		ecsIPv6Lo, ecsIPv6Hi uint64
 		ecsMask              uint8
+		client               string
 	)
+	r.metrics.query.Add(1)
 
 	edns0 := q.IsEdns0()
-	if edns0 != nil {
+	if edns0 != nil && !r.opt.IgnoreECS {
 		// Find the ECS option
 		for _, opt := range edns0.Option {
 			ecs, ok := opt.(*dns.EDNS0_SUBNET)
@@ -70,6 +109,13 @@ func (r *requestDedup) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Sock
 			break
 		}
 	}
+	if ip := ci.SourceIP; ip != nil {
+		if ip4 := ip.To4(); len(ip4) == net.IPv4len && r.opt.ClientPrefix4 > 0 {
+			client = ip4.Mask(net.CIDRMask(int(r.opt.ClientPrefix4), 32)).String()
+		} else if len(ip4) != net.IPv4len && r.opt.ClientPrefix6 > 0 {
+			client = ip.Mask(net.CIDRMask(int(r.opt.ClientPrefix6), 128)).String()
+		}
+	}
 	k := dedupKey{
 		name:        q.Question[0].Name,
 		qtype:       q.Question[0].Qtype,
@@ -77,6 +123,7 @@ func (r *requestDedup) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Sock
 		ecs_ipv6_hi: ecsIPv6Hi,
 		ecs_ipv6_lo: ecsIPv6Lo,
 		ecs_mask:    ecsMask,
+		client:      client,
 	}
 
 	r.mu.Lock()
@@ -94,7 +141,20 @@ func (r *requestDedup) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Sock
 	// return the same answer.
 	if ok {
 		log.Debug("duplicated request, waiting for first answer")
-		<-req.done
+		if r.opt.MaxWait > 0 {
+			timer := time.NewTimer(r.opt.MaxWait)
+			select {
+			case <-req.done:
+				timer.Stop()
+			case <-timer.C:
+				r.metrics.timeout.Add(1)
+				log.WithField("resolver", r.resolver).Debug("timed out waiting for first answer, forwarding query to resolver")
+				return r.resolver.Resolve(q, ci)
+			}
+		} else {
+			<-req.done
+		}
+		r.metrics.coalesced.Add(1)
 		a, err := req.answer, req.err
 		// Return a copy of the answer as other elements might be modifying it
 		if a != nil {
@@ -105,7 +165,7 @@ func (r *requestDedup) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Sock
 	log.WithField("resolver", r.resolver).Debug("forwarding query to resolver")
 
 	// Not already in flight, make the request
-	a, err := r.resolver.Resolve(q, ci, PanelSocksDialer)
+	a, err := r.resolver.Resolve(q, ci)
 	req.answer = a
 	req.err = err
 	close(req.done) // release other goroutines waiting for the response
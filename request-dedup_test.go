@@ -18,7 +18,7 @@ func TestRequestDedup(t *testing.T) {
 		},
 	}
 
-	g := NewRequestDedup("test-dedup", r)
+	g := NewRequestDedup("test-dedup", r, RequestDedupOptions{})
 	q := new(dns.Msg)
 	q.SetQuestion("example.com.", dns.TypeA)
 
@@ -28,7 +28,7 @@ func TestRequestDedup(t *testing.T) {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			_, err := g.Resolve(q, ci, nil)
+			_, err := g.Resolve(q, ci)
 			require.NoError(t, err)
 		}()
 	}
@@ -37,3 +37,39 @@ func TestRequestDedup(t *testing.T) {
 	// Only one request should have hit the resolver
 	require.Equal(t, 1, r.HitCount())
 }
+
+func TestRequestDedupMaxWait(t *testing.T) {
+	var ci ClientInfo
+	var mu sync.Mutex
+	var hits int
+	release := make(chan struct{})
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			mu.Lock()
+			hits++
+			first := hits == 1
+			mu.Unlock()
+			if first {
+				<-release // the first query is stuck until released
+			}
+			return q, nil
+		},
+	}
+
+	g := NewRequestDedup("test-dedup-maxwait", r, RequestDedupOptions{MaxWait: 100 * time.Millisecond})
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	go g.Resolve(q, ci)
+	time.Sleep(50 * time.Millisecond)
+
+	// The duplicate should give up waiting and resolve independently
+	_, err := g.Resolve(q, ci)
+	require.NoError(t, err)
+	close(release)
+
+	mu.Lock()
+	require.Equal(t, 2, hits)
+	mu.Unlock()
+	require.Equal(t, int64(1), g.metrics.timeout.Value())
+}
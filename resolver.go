@@ -2,13 +2,22 @@ package rdns
 
 import (
 	"fmt"
+	"io"
 
 	"github.com/miekg/dns"
 )
 
 // Resolver is an interface to resolve DNS queries.
 type Resolver interface {
-	Resolve(*dns.Msg, ClientInfo, *Socks5Dialer) (*dns.Msg, error)
+	Resolve(*dns.Msg, ClientInfo) (*dns.Msg, error)
 	CertMonitor() error
 	fmt.Stringer
-}
\ No newline at end of file
+}
+
+// Closes a resolver that holds connections or runs background loops. Other
+// resolvers are left alone.
+func closeResolver(r Resolver) {
+	if c, ok := r.(io.Closer); ok {
+		c.Close()
+	}
+}
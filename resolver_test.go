@@ -24,7 +24,7 @@ func (r *TestResolver) GetIPBlocklistDB() (IPBlocklistDB) {
 	return nil
 }
 
-func (r *TestResolver) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dialer) (*dns.Msg, error) {
+func (r *TestResolver) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	r.hitCount++
 	if r.shouldFail {
 		return nil, errors.New("failed")
@@ -26,7 +26,12 @@ type ResponseBlocklistIP struct {
 	id string
 	ResponseBlocklistIPOptions
 	resolver Resolver
-	mu       sync.RWMutex
+
+	blocklistDB *dbRef[IPBlocklistDB]
+
+	// Closed to stop the refresh loop
+	stop      chan struct{}
+	closeOnce sync.Once
 }
 
 var _ Resolver = &ResponseBlocklistIP{}
@@ -50,7 +55,13 @@ type ResponseBlocklistIPOptions struct {
 
 // NewResponseBlocklistIP returns a new instance of a response blocklist resolver.
 func NewResponseBlocklistIP(id string, resolver Resolver, opt ResponseBlocklistIPOptions) (*ResponseBlocklistIP, error) {
-	blocklist := &ResponseBlocklistIP{id: id, resolver: resolver, ResponseBlocklistIPOptions: opt}
+	blocklist := &ResponseBlocklistIP{
+		id:                         id,
+		resolver:                   resolver,
+		ResponseBlocklistIPOptions: opt,
+		blocklistDB:                newDBRef(opt.BlocklistDB),
+		stop:                       make(chan struct{}),
+	}
 
 	// Start the refresh goroutines if we have a list and a refresh period was given
 	if blocklist.BlocklistDB != nil && blocklist.BlocklistRefresh > 0 {
@@ -61,8 +72,8 @@ func NewResponseBlocklistIP(id string, resolver Resolver, opt ResponseBlocklistI
 
 // Resolve a DNS query by first querying the upstream resolver, then checking any IP responses
 // against a blocklist. Responds with NXDOMAIN if the response IP is in the filter-list.
-func (r *ResponseBlocklistIP) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dialer) (*dns.Msg, error) {
-	answer, err := r.resolver.Resolve(q, ci, PanelSocksDialer)
+func (r *ResponseBlocklistIP) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	answer, err := r.resolver.Resolve(q, ci)
 	if err != nil || answer == nil {
 		return answer, err
 	}
@@ -70,9 +81,9 @@ func (r *ResponseBlocklistIP) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDiale
 		return answer, err
 	}
 	if r.Filter {
-		return r.filterMatch(q, answer, ci, PanelSocksDialer)
+		return r.filterMatch(q, answer, ci)
 	}
-	return r.blockIfMatch(q, answer, ci, PanelSocksDialer)
+	return r.blockIfMatch(q, answer, ci)
 }
 
 func (r *ResponseBlocklistIP) String() string {
@@ -84,24 +95,37 @@ func (s *ResponseBlocklistIP) CertMonitor() error {
 	return nil
 }
 
+// Close stops reloading the blocklist and closes its database.
+func (r *ResponseBlocklistIP) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.stop)
+		closeReplacedDB(r.blocklistDB.Load())
+	})
+	return nil
+}
+
 func (r *ResponseBlocklistIP) refreshLoopBlocklist(refresh time.Duration) {
 	for {
-		time.Sleep(refresh)
+		select {
+		case <-time.After(refresh):
+		case <-r.stop:
+			return
+		}
 		log := Log.WithField("id", r.id)
 		log.Debug("reloading blocklist")
-		db, err := r.BlocklistDB.Reload()
+		old := r.blocklistDB.Load()
+		db, err := old.Reload()
 		if err != nil {
 			Log.WithError(err).Error("failed to load rules")
 			continue
 		}
-		r.mu.Lock()
-		r.BlocklistDB.Close()
-		r.BlocklistDB = db
-		r.mu.Unlock()
+		r.blocklistDB.Store(db)
+		closeReplacedDB(old)
 	}
 }
 
-func (r *ResponseBlocklistIP) blockIfMatch(query, answer *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dialer) (*dns.Msg, error) {
+func (r *ResponseBlocklistIP) blockIfMatch(query, answer *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	db := r.blocklistDB.Load()
 	for _, records := range [][]dns.RR{answer.Answer, answer.Ns, answer.Extra} {
 		for _, rr := range records {
 			var ip net.IP
@@ -113,11 +137,12 @@ func (r *ResponseBlocklistIP) blockIfMatch(query, answer *dns.Msg, ci ClientInfo
 			default:
 				continue
 			}
-			if match, ok := r.BlocklistDB.Match(ip); ok != r.Inverted {
+			if match, ok := db.Match(ip); ok != r.Inverted {
 				log := logger(r.id, query, ci).WithFields(logrus.Fields{"list": match.GetList(), "rule": match.GetRule(), "ip": ip})
+				ci.Trace.SetBlocked()
 				if r.BlocklistResolver != nil {
 					log.WithField("resolver", r.BlocklistResolver).Debug("blocklist match, forwarding to blocklist-resolver")
-					return r.BlocklistResolver.Resolve(query, ci, PanelSocksDialer)
+					return r.BlocklistResolver.Resolve(query, ci)
 				}
 				log.Debug("blocking response")
 				return nxdomain(query), nil
@@ -127,14 +152,15 @@ func (r *ResponseBlocklistIP) blockIfMatch(query, answer *dns.Msg, ci ClientInfo
 	return answer, nil
 }
 
-func (r *ResponseBlocklistIP) filterMatch(query, answer *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dialer) (*dns.Msg, error) {
+func (r *ResponseBlocklistIP) filterMatch(query, answer *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	answer.Answer = r.filterRR(query, ci, answer.Answer)
 	// If there's nothing left after applying the filter, return NXDOMAIN or send to the alternative resolver
 	if len(answer.Answer) == 0 {
+		ci.Trace.SetBlocked()
 		log := Log.WithFields(logrus.Fields{"qname": qName(query)})
 		if r.BlocklistResolver != nil {
 			log.WithField("resolver", r.BlocklistResolver).Debug("no answers after filtering, forwarding to blocklist-resolver")
-			return r.BlocklistResolver.Resolve(query, ci, PanelSocksDialer)
+			return r.BlocklistResolver.Resolve(query, ci)
 		}
 		log.Debug("no answers after filtering, blocking response")
 		return nxdomain(query), nil
@@ -145,6 +171,7 @@ func (r *ResponseBlocklistIP) filterMatch(query, answer *dns.Msg, ci ClientInfo,
 }
 
 func (r *ResponseBlocklistIP) filterRR(query *dns.Msg, ci ClientInfo, rrs []dns.RR) []dns.RR {
+	db := r.blocklistDB.Load()
 	newRRs := make([]dns.RR, 0, len(rrs))
 	for _, rr := range rrs {
 		var ip net.IP
@@ -157,7 +184,7 @@ func (r *ResponseBlocklistIP) filterRR(query *dns.Msg, ci ClientInfo, rrs []dns.
 			newRRs = append(newRRs, rr)
 			continue
 		}
-		if match, ok := r.BlocklistDB.Match(ip); ok != r.Inverted {
+		if match, ok := db.Match(ip); ok != r.Inverted {
 			logger(r.id, query, ci).WithFields(logrus.Fields{"list": match.GetList(), "rule": match.GetRule(), "ip": ip}).Debug("filtering response")
 			continue
 		}
@@ -1,6 +1,7 @@
 package rdns
 
 import (
+	"fmt"
 	"strings"
 	"sync"
 	"time"
@@ -14,7 +15,12 @@ type ResponseBlocklistName struct {
 	id string
 	ResponseBlocklistNameOptions
 	resolver Resolver
-	mu       sync.RWMutex
+
+	blocklistDB *dbRef[BlocklistDB]
+
+	// Closed to stop the refresh loop
+	stop      chan struct{}
+	closeOnce sync.Once
 }
 
 var _ Resolver = &ResponseBlocklistName{}
@@ -30,11 +36,47 @@ type ResponseBlocklistNameOptions struct {
 
 	// Inverted behavior, only allow responses that can be found on at least one list.
 	Inverted bool
+
+	// Sections of the response to inspect, "answer", "authority" and
+	// "additional". Defaults to all of them.
+	Sections []string
+
+	// Only match the target of the last CNAME in a chain, not the aliases in
+	// between, which are often CDN names that are also used by other sites.
+	TerminalCNAMEOnly bool
+
+	// If true, removes matching records from the response rather than replying
+	// with NXDOMAIN. Records that belong to the target of a removed CNAME are
+	// removed as well. Only if no answer is left, the response is blocked.
+	Filter bool
 }
 
+// Sections of a response inspected by a response blocklist.
+const (
+	SectionAnswer     = "answer"
+	SectionAuthority  = "authority"
+	SectionAdditional = "additional"
+)
+
 // NewResponseBlocklistName returns a new instance of a response blocklist resolver.
 func NewResponseBlocklistName(id string, resolver Resolver, opt ResponseBlocklistNameOptions) (*ResponseBlocklistName, error) {
-	blocklist := &ResponseBlocklistName{id: id, resolver: resolver, ResponseBlocklistNameOptions: opt}
+	if len(opt.Sections) == 0 {
+		opt.Sections = []string{SectionAnswer, SectionAuthority, SectionAdditional}
+	}
+	for _, section := range opt.Sections {
+		switch section {
+		case SectionAnswer, SectionAuthority, SectionAdditional:
+		default:
+			return nil, fmt.Errorf("unsupported section '%s'", section)
+		}
+	}
+	blocklist := &ResponseBlocklistName{
+		id:                           id,
+		resolver:                     resolver,
+		ResponseBlocklistNameOptions: opt,
+		blocklistDB:                  newDBRef(opt.BlocklistDB),
+		stop:                         make(chan struct{}),
+	}
 
 	// Start the refresh goroutines if we have a list and a refresh period was given
 	if blocklist.BlocklistDB != nil && blocklist.BlocklistRefresh > 0 {
@@ -45,12 +87,15 @@ func NewResponseBlocklistName(id string, resolver Resolver, opt ResponseBlocklis
 
 // Resolve a DNS query by first querying the upstream resolver, then checking any responses with
 // strings against a blocklist. Responds with NXDOMAIN if the response matches the filter.
-func (r *ResponseBlocklistName) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dialer) (*dns.Msg, error) {
-	answer, err := r.resolver.Resolve(q, ci, PanelSocksDialer)
+func (r *ResponseBlocklistName) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	answer, err := r.resolver.Resolve(q, ci)
 	if err != nil || answer == nil {
 		return answer, err
 	}
-	return r.blockIfMatch(q, answer, ci, PanelSocksDialer)
+	if r.Filter {
+		return r.filterMatch(q, answer, ci)
+	}
+	return r.blockIfMatch(q, answer, ci)
 }
 
 func (r *ResponseBlocklistName) String() string {
@@ -62,51 +107,45 @@ func (s *ResponseBlocklistName) CertMonitor() error {
 	return nil
 }
 
+// Close stops reloading the blocklist.
+func (r *ResponseBlocklistName) Close() error {
+	r.closeOnce.Do(func() { close(r.stop) })
+	return nil
+}
+
 func (r *ResponseBlocklistName) refreshLoopBlocklist(refresh time.Duration) {
 	for {
-		time.Sleep(refresh)
+		select {
+		case <-time.After(refresh):
+		case <-r.stop:
+			return
+		}
 		log := Log.WithField("id", r.id)
 		log.Debug("reloading blocklist")
-		db, err := r.BlocklistDB.Reload()
+		db, err := r.blocklistDB.Load().Reload()
 		if err != nil {
 			Log.WithError(err).Error("failed to load rules")
 			continue
 		}
-		r.mu.Lock()
-		r.BlocklistDB = db
-		r.mu.Unlock()
+		r.blocklistDB.Store(db)
 	}
 }
 
-func (r *ResponseBlocklistName) blockIfMatch(query, answer *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dialer) (*dns.Msg, error) {
-	for _, records := range [][]dns.RR{answer.Answer, answer.Ns, answer.Extra} {
-		for _, rr := range records {
-			var name string
-			switch r := rr.(type) {
-			case *dns.CNAME:
-				name = r.Target
-			case *dns.MX:
-				name = r.Mx
-			case *dns.NS:
-				name = r.Ns
-			case *dns.PTR:
-				name = r.Ptr
-			case *dns.SRV:
-				name = r.Target
-			case *dns.HTTPS:
-				name = svcbString(&r.SVCB)
-			case *dns.TXT:
-				name = strings.Join(r.Txt, " ")
-			case *dns.SVCB:
-				name = svcbString(r)
-			default:
+func (r *ResponseBlocklistName) blockIfMatch(query, answer *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	db := r.blocklistDB.Load()
+	nonTerminal := r.nonTerminalCNAMEs(answer)
+	for _, records := range r.sections(answer) {
+		for _, rr := range *records {
+			name, ok := recordName(rr)
+			if !ok || nonTerminal[rr] {
 				continue
 			}
-			if _, _, rule, ok := r.BlocklistDB.Match(dns.Question{Name: name}); ok != r.Inverted {
+			if _, _, rule, ok := db.Match(dns.Question{Name: name}); ok != r.Inverted {
 				log := logger(r.id, query, ci).WithField("rule", rule.GetRule())
+				ci.Trace.SetBlocked()
 				if r.BlocklistResolver != nil {
 					log.WithField("resolver", r.BlocklistResolver).Debug("blocklist match, forwarding to blocklist-resolver")
-					return r.BlocklistResolver.Resolve(query, ci, PanelSocksDialer)
+					return r.BlocklistResolver.Resolve(query, ci)
 				}
 				log.Debug("blocking response")
 				return nxdomain(query), nil
@@ -116,6 +155,130 @@ func (r *ResponseBlocklistName) blockIfMatch(query, answer *dns.Msg, ci ClientIn
 	return answer, nil
 }
 
+func (r *ResponseBlocklistName) filterMatch(query, answer *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	db := r.blocklistDB.Load()
+	nonTerminal := r.nonTerminalCNAMEs(answer)
+	hadAnswers := len(answer.Answer) > 0
+
+	// Owner names of records that are removed along with a CNAME pointing to them
+	removedOwners := make(map[string]struct{})
+	for _, records := range r.sections(answer) {
+		filtered := make([]dns.RR, 0, len(*records))
+		for _, rr := range *records {
+			name, ok := recordName(rr)
+			if !ok || nonTerminal[rr] {
+				filtered = append(filtered, rr)
+				continue
+			}
+			if _, _, rule, ok := db.Match(dns.Question{Name: name}); ok != r.Inverted {
+				logger(r.id, query, ci).WithField("rule", rule.GetRule()).Debug("filtering response")
+				if cname, ok := rr.(*dns.CNAME); ok {
+					removedOwners[strings.ToLower(cname.Target)] = struct{}{}
+				}
+				continue
+			}
+			filtered = append(filtered, rr)
+		}
+		*records = filtered
+	}
+	answer.Answer = removeChained(answer.Answer, removedOwners)
+
+	// If there's nothing left after applying the filter, return NXDOMAIN or send to the alternative resolver
+	if hadAnswers && len(answer.Answer) == 0 {
+		ci.Trace.SetBlocked()
+		log := logger(r.id, query, ci)
+		if r.BlocklistResolver != nil {
+			log.WithField("resolver", r.BlocklistResolver).Debug("no answers after filtering, forwarding to blocklist-resolver")
+			return r.BlocklistResolver.Resolve(query, ci)
+		}
+		log.Debug("no answers after filtering, blocking response")
+		return nxdomain(query), nil
+	}
+	return answer, nil
+}
+
+// Returns the sections of a response that are inspected.
+func (r *ResponseBlocklistName) sections(answer *dns.Msg) []*[]dns.RR {
+	sections := make([]*[]dns.RR, 0, 3)
+	for _, section := range r.Sections {
+		switch section {
+		case SectionAnswer:
+			sections = append(sections, &answer.Answer)
+		case SectionAuthority:
+			sections = append(sections, &answer.Ns)
+		case SectionAdditional:
+			sections = append(sections, &answer.Extra)
+		}
+	}
+	return sections
+}
+
+// Returns the CNAME records in the answer that point to another CNAME, if only
+// terminal CNAMEs are matched.
+func (r *ResponseBlocklistName) nonTerminalCNAMEs(answer *dns.Msg) map[dns.RR]bool {
+	if !r.TerminalCNAMEOnly {
+		return nil
+	}
+	owners := make(map[string]struct{})
+	for _, rr := range answer.Answer {
+		if _, ok := rr.(*dns.CNAME); ok {
+			owners[strings.ToLower(rr.Header().Name)] = struct{}{}
+		}
+	}
+	nonTerminal := make(map[dns.RR]bool)
+	for _, rr := range answer.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			if _, ok := owners[strings.ToLower(cname.Target)]; ok {
+				nonTerminal[rr] = true
+			}
+		}
+	}
+	return nonTerminal
+}
+
+// Removes the records owned by the given names, and by the targets of CNAMEs
+// among them, following the chain.
+func removeChained(rrs []dns.RR, owners map[string]struct{}) []dns.RR {
+	for len(owners) > 0 {
+		next := make(map[string]struct{})
+		filtered := make([]dns.RR, 0, len(rrs))
+		for _, rr := range rrs {
+			if _, ok := owners[strings.ToLower(rr.Header().Name)]; ok {
+				if cname, ok := rr.(*dns.CNAME); ok {
+					next[strings.ToLower(cname.Target)] = struct{}{}
+				}
+				continue
+			}
+			filtered = append(filtered, rr)
+		}
+		rrs, owners = filtered, next
+	}
+	return rrs
+}
+
+// Returns the name in a record that is matched against the blocklist.
+func recordName(rr dns.RR) (string, bool) {
+	switch r := rr.(type) {
+	case *dns.CNAME:
+		return r.Target, true
+	case *dns.MX:
+		return r.Mx, true
+	case *dns.NS:
+		return r.Ns, true
+	case *dns.PTR:
+		return r.Ptr, true
+	case *dns.SRV:
+		return r.Target, true
+	case *dns.HTTPS:
+		return svcbString(&r.SVCB), true
+	case *dns.TXT:
+		return strings.Join(r.Txt, " "), true
+	case *dns.SVCB:
+		return svcbString(r), true
+	}
+	return "", false
+}
+
 // Format an SVCB (and HTTPS) record as string like so "TARGET key1=value1 key2=value2"
 // For example: ". alpn=h2,h3"
 func svcbString(rr *dns.SVCB) string {
@@ -0,0 +1,73 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseBlocklistName(t *testing.T) {
+	var ci ClientInfo
+	// Responds with a CNAME chain www.example.test -> cdn.test -> edge.tracker.test
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{
+				&dns.CNAME{Hdr: dns.RR_Header{Name: "www.example.test.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET}, Target: "cdn.test."},
+				&dns.CNAME{Hdr: dns.RR_Header{Name: "cdn.test.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET}, Target: "edge.tracker.test."},
+				&dns.A{Hdr: dns.RR_Header{Name: "edge.tracker.test.", Rrtype: dns.TypeA, Class: dns.ClassINET}, A: []byte{192, 0, 2, 1}},
+			}
+			a.Ns = []dns.RR{
+				&dns.NS{Hdr: dns.RR_Header{Name: "example.test.", Rrtype: dns.TypeNS, Class: dns.ClassINET}, Ns: "ns.bad.test."},
+			}
+			return a, nil
+		},
+	}
+	resolve := func(opt ResponseBlocklistNameOptions, rules ...string) *dns.Msg {
+		db, err := NewDomainDB("testlist", NewStaticLoader(rules))
+		require.NoError(t, err)
+		opt.BlocklistDB = db
+		b, err := NewResponseBlocklistName("test-rbn", upstream, opt)
+		require.NoError(t, err)
+		q := new(dns.Msg)
+		q.SetQuestion("www.example.test.", dns.TypeA)
+		a, err := b.Resolve(q, ci)
+		require.NoError(t, err)
+		return a
+	}
+
+	// Any section and any CNAME by default
+	require.Equal(t, dns.RcodeNameError, resolve(ResponseBlocklistNameOptions{}, "ns.bad.test").Rcode)
+	require.Equal(t, dns.RcodeNameError, resolve(ResponseBlocklistNameOptions{}, "cdn.test").Rcode)
+
+	// Limited to the answer section
+	opt := ResponseBlocklistNameOptions{Sections: []string{SectionAnswer}}
+	require.Equal(t, dns.RcodeSuccess, resolve(opt, "ns.bad.test").Rcode)
+
+	// Only the terminal CNAME target is matched
+	opt = ResponseBlocklistNameOptions{TerminalCNAMEOnly: true}
+	require.Equal(t, dns.RcodeSuccess, resolve(opt, "cdn.test").Rcode)
+	require.Equal(t, dns.RcodeNameError, resolve(opt, ".tracker.test").Rcode)
+
+	// Filtering the NS record keeps the answer
+	opt = ResponseBlocklistNameOptions{Filter: true}
+	a := resolve(opt, "ns.bad.test")
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Len(t, a.Answer, 3)
+	require.Empty(t, a.Ns)
+
+	// Filtering a CNAME removes the rest of the chain
+	a = resolve(opt, "edge.tracker.test")
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Len(t, a.Answer, 1)
+
+	// Nothing is left if the first CNAME is filtered
+	a = resolve(opt, "cdn.test")
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+
+	// Unknown sections are rejected
+	_, err := NewResponseBlocklistName("test-rbn", upstream, ResponseBlocklistNameOptions{Sections: []string{"question"}})
+	require.Error(t, err)
+}
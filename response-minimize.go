@@ -20,8 +20,8 @@ func NewResponseMinimize(id string, resolver Resolver) *ResponseMinimize {
 
 // Resolve a DNS query with the upstream resolver and strip out any extra or NS
 // records in the response.
-func (r *ResponseMinimize) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dialer) (*dns.Msg, error) {
-	answer, err := r.resolver.Resolve(q, ci,PanelSocksDialer)
+func (r *ResponseMinimize) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	answer, err := r.resolver.Resolve(q, ci)
 	if err != nil || answer == nil {
 		return answer, err
 	}
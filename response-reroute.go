@@ -0,0 +1,160 @@
+package rdns
+
+import (
+	"expvar"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// ResponseReroute is a resolver that sends queries to the upstream resolver
+// first, then checks the IPs in the answer against a database of networks or
+// GeoIP locations. If an IP matches, the query is sent to an alternative
+// resolver and its response is used instead. This allows for example to use a
+// local resolver for names that resolve to local IPs, and a foreign resolver
+// for everything else.
+type ResponseReroute struct {
+	id string
+	ResponseRerouteOptions
+	resolver Resolver
+	metrics  *ResponseRerouteMetrics
+
+	db *dbRef[IPBlocklistDB]
+
+	// Closed to stop the refresh loop
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+var _ Resolver = &ResponseReroute{}
+
+type ResponseRerouteOptions struct {
+	// Resolver that queries are sent to if the response matches the database.
+	RerouteResolver Resolver
+
+	DB IPBlocklistDB
+
+	// Refresh period for the database. Disabled if 0.
+	Refresh time.Duration
+
+	// Inverted behavior, re-route if an IP in the response doesn't match the
+	// database.
+	Inverted bool
+}
+
+type ResponseRerouteMetrics struct {
+	// Count of re-routed queries.
+	reroute *expvar.Int
+	// Count of re-routed queries that failed and were answered with the
+	// original response.
+	failure *expvar.Int
+}
+
+// NewResponseReroute returns a new instance of a response re-routing resolver.
+func NewResponseReroute(id string, resolver Resolver, opt ResponseRerouteOptions) *ResponseReroute {
+	r := &ResponseReroute{
+		id:                     id,
+		resolver:               resolver,
+		ResponseRerouteOptions: opt,
+		db:                     newDBRef(opt.DB),
+		stop:                   make(chan struct{}),
+		metrics: &ResponseRerouteMetrics{
+			reroute: getVarInt("response-reroute", id, "reroute"),
+			failure: getVarInt("response-reroute", id, "failure"),
+		},
+	}
+	if opt.Refresh > 0 {
+		go r.refreshLoop(opt.Refresh)
+	}
+	return r
+}
+
+// Resolve a DNS query with the upstream resolver and re-resolve it with the
+// alternative resolver if an IP in the answer matches the database. If the
+// alternative resolver fails, the original response is returned.
+func (r *ResponseReroute) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	a, err := r.resolver.Resolve(q, ci)
+	if err != nil || a == nil || a.Rcode != dns.RcodeSuccess {
+		return a, err
+	}
+	ip, match, ok := r.match(a)
+	if !ok {
+		return a, nil
+	}
+	log := logger(r.id, q, ci).WithFields(logrus.Fields{
+		"list":     match.GetList(),
+		"rule":     match.GetRule(),
+		"ip":       ip,
+		"resolver": r.RerouteResolver.String(),
+	})
+	log.Debug("response matched, re-routing query")
+	r.metrics.reroute.Add(1)
+	rerouted, err := r.RerouteResolver.Resolve(q, ci)
+	if err != nil || rerouted == nil {
+		r.metrics.failure.Add(1)
+		log.WithError(err).Debug("re-routed query failed, using original response")
+		return a, nil
+	}
+	return rerouted, nil
+}
+
+func (r *ResponseReroute) String() string {
+	return r.id
+}
+
+// Check Cert
+func (r *ResponseReroute) CertMonitor() error {
+	return nil
+}
+
+// Returns the first IP in the answer section that triggers a re-route.
+func (r *ResponseReroute) match(a *dns.Msg) (net.IP, *BlocklistMatch, bool) {
+	db := r.db.Load()
+	for _, rr := range a.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		if match, ok := db.Match(ip); ok != r.Inverted {
+			return ip, match, true
+		}
+	}
+	return nil, nil, false
+}
+
+// Close stops reloading the database and closes it.
+func (r *ResponseReroute) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.stop)
+		closeReplacedDB(r.db.Load())
+	})
+	return nil
+}
+
+func (r *ResponseReroute) refreshLoop(refresh time.Duration) {
+	for {
+		select {
+		case <-time.After(refresh):
+		case <-r.stop:
+			return
+		}
+		log := Log.WithField("id", r.id)
+		log.Debug("reloading database")
+		old := r.db.Load()
+		db, err := old.Reload()
+		if err != nil {
+			log.WithError(err).Error("failed to load rules")
+			continue
+		}
+		r.db.Store(db)
+		closeReplacedDB(old)
+	}
+}
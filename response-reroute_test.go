@@ -0,0 +1,60 @@
+package rdns
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseReroute(t *testing.T) {
+	// The upstream resolves names under local.test to a local IP
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			ip := "192.0.2.1"
+			if dns.IsSubDomain("local.test.", q.Question[0].Name) {
+				ip = "10.0.0.1"
+			}
+			a.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP(ip),
+			}}
+			return a, nil
+		},
+	}
+	foreign := new(TestResolver)
+
+	db, err := NewCidrDB("local", NewStaticLoader([]string{"10.0.0.0/8"}))
+	require.NoError(t, err)
+
+	// Re-route anything that doesn't resolve to a local IP
+	r := NewResponseReroute("test-reroute", upstream, ResponseRerouteOptions{
+		RerouteResolver: foreign,
+		DB:              db,
+		Inverted:        true,
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion("www.local.test.", dns.TypeA)
+	a, err := r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.1", a.Answer[0].(*dns.A).A.String())
+	require.Equal(t, 0, foreign.HitCount())
+
+	q.SetQuestion("www.other.test.", dns.TypeA)
+	_, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, foreign.HitCount())
+
+	// The original response is used if the alternative resolver fails
+	foreign.ResolveFunc = func(*dns.Msg, ClientInfo) (*dns.Msg, error) {
+		return nil, errors.New("failed")
+	}
+	a, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, "192.0.2.1", a.Answer[0].(*dns.A).A.String())
+}
@@ -0,0 +1,150 @@
+package rdns
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Reasons a response from an upstream resolver is rejected, used as error
+// message and as key in the metrics.
+const (
+	invalidNotResponse = "not-response"
+	invalidID          = "id"
+	invalidOpcode      = "opcode"
+	invalidQuestion    = "question"
+)
+
+// Checks that a response matches the query it answers. Returns the reason if
+// it doesn't.
+func validateResponse(q, a *dns.Msg) (string, bool) {
+	if !a.Response {
+		return invalidNotResponse, false
+	}
+	if a.Id != q.Id {
+		return invalidID, false
+	}
+	if a.Opcode != q.Opcode {
+		return invalidOpcode, false
+	}
+	// Error responses like FORMERR or REFUSED don't always echo the question,
+	// but those aren't cached.
+	if len(a.Question) == 0 && a.Rcode != dns.RcodeSuccess && a.Rcode != dns.RcodeNameError {
+		return "", true
+	}
+	if len(a.Question) != len(q.Question) {
+		return invalidQuestion, false
+	}
+	for i, question := range q.Question {
+		// Names are compared case-sensitively to not defeat 0x20 randomization
+		if a.Question[i] != question {
+			return invalidQuestion, false
+		}
+	}
+	return "", true
+}
+
+// Removes all records from a response that are outside the bailiwick of the
+// query and could be used to poison a cache. Records in the answer section
+// have to be for the query name or a name it's aliased to by CNAME or DNAME.
+// Records in the authority section have to be in a zone, defined by an SOA or
+// NS record, that is a parent of one of these names. Records in the additional
+// section have to be in one of these zones or below one of the names. Returns
+// the number of records that were removed.
+func scrubResponse(q, a *dns.Msg) int {
+	if len(q.Question) == 0 {
+		return 0
+	}
+	names := map[string]struct{}{strings.ToLower(q.Question[0].Name): {}}
+
+	// Follow the CNAME chain in the answer, regardless of the order of records
+	for added := true; added; {
+		added = false
+		for _, rr := range a.Answer {
+			cname, ok := rr.(*dns.CNAME)
+			if !ok {
+				continue
+			}
+			if _, ok := names[strings.ToLower(cname.Hdr.Name)]; !ok {
+				continue
+			}
+			target := strings.ToLower(cname.Target)
+			if _, ok := names[target]; !ok {
+				names[target] = struct{}{}
+				added = true
+			}
+		}
+	}
+	inChain := func(name string) bool {
+		_, ok := names[strings.ToLower(name)]
+		return ok
+	}
+	belowChain := func(name string) bool {
+		for n := range names {
+			if dns.IsSubDomain(n, name) {
+				return true
+			}
+		}
+		return false
+	}
+	aboveChain := func(name string) bool {
+		for n := range names {
+			if dns.IsSubDomain(name, n) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var removed int
+	a.Answer = filterRRs(a.Answer, &removed, func(rr dns.RR) bool {
+		// DNAME records are for a parent of the name they're aliasing
+		if rr.Header().Rrtype == dns.TypeDNAME {
+			return aboveChain(rr.Header().Name)
+		}
+		return inChain(rr.Header().Name)
+	})
+
+	// Zones the authority section may hold records for
+	var zones []string
+	for _, rr := range a.Ns {
+		switch rr.Header().Rrtype {
+		case dns.TypeSOA, dns.TypeNS:
+			if aboveChain(rr.Header().Name) {
+				zones = append(zones, rr.Header().Name)
+			}
+		}
+	}
+	inZone := func(name string) bool {
+		for _, zone := range zones {
+			if dns.IsSubDomain(zone, name) {
+				return true
+			}
+		}
+		return false
+	}
+	a.Ns = filterRRs(a.Ns, &removed, func(rr dns.RR) bool {
+		return inZone(rr.Header().Name)
+	})
+	a.Extra = filterRRs(a.Extra, &removed, func(rr dns.RR) bool {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			return true
+		}
+		return inZone(rr.Header().Name) || belowChain(rr.Header().Name)
+	})
+	return removed
+}
+
+// Returns the records for which keep returns true, and adds the number of
+// records that were removed to removed.
+func filterRRs(rrs []dns.RR, removed *int, keep func(dns.RR) bool) []dns.RR {
+	filtered := rrs[:0]
+	for _, rr := range rrs {
+		if keep(rr) {
+			filtered = append(filtered, rr)
+			continue
+		}
+		*removed++
+	}
+	return filtered
+}
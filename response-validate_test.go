@@ -0,0 +1,98 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateResponse(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("Example.com.", dns.TypeA)
+
+	a := new(dns.Msg)
+	a.SetReply(q)
+	_, ok := validateResponse(q, a)
+	require.True(t, ok)
+
+	// Not a response
+	b := a.Copy()
+	b.Response = false
+	reason, ok := validateResponse(q, b)
+	require.False(t, ok)
+	require.Equal(t, invalidNotResponse, reason)
+
+	// Different ID
+	b = a.Copy()
+	b.Id++
+	reason, ok = validateResponse(q, b)
+	require.False(t, ok)
+	require.Equal(t, invalidID, reason)
+
+	// Case of the name has to be preserved
+	b = a.Copy()
+	b.Question[0].Name = "example.com."
+	reason, ok = validateResponse(q, b)
+	require.False(t, ok)
+	require.Equal(t, invalidQuestion, reason)
+
+	// Missing question
+	b = a.Copy()
+	b.Question = nil
+	reason, ok = validateResponse(q, b)
+	require.False(t, ok)
+	require.Equal(t, invalidQuestion, reason)
+
+	// Missing question is fine in error responses
+	b.Rcode = dns.RcodeRefused
+	_, ok = validateResponse(q, b)
+	require.True(t, ok)
+}
+
+func TestScrubResponse(t *testing.T) {
+	rr := func(s string) dns.RR {
+		r, err := dns.NewRR(s)
+		require.NoError(t, err)
+		return r
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.com.", dns.TypeA)
+
+	a := new(dns.Msg)
+	a.SetReply(q)
+	a.Answer = []dns.RR{
+		rr("www.example.com. 60 IN CNAME web.EXAMPLE.net."),
+		rr("web.example.net. 60 IN A 192.0.2.1"),
+		rr("bank.example.org. 60 IN A 192.0.2.2"),
+	}
+	a.Ns = []dns.RR{
+		rr("example.net. 60 IN NS ns1.example.net."),
+		rr("example.org. 60 IN NS ns1.example.org."),
+	}
+	a.Extra = []dns.RR{
+		rr("ns1.example.net. 60 IN A 192.0.2.3"),
+		rr("ns1.example.org. 60 IN A 192.0.2.4"),
+	}
+	a.SetEdns0(1232, false)
+
+	require.Equal(t, 3, scrubResponse(q, a))
+	require.Equal(t, []dns.RR{
+		rr("www.example.com. 60 IN CNAME web.EXAMPLE.net."),
+		rr("web.example.net. 60 IN A 192.0.2.1"),
+	}, a.Answer)
+	require.Equal(t, []dns.RR{rr("example.net. 60 IN NS ns1.example.net.")}, a.Ns)
+	require.Len(t, a.Extra, 2)
+	require.NotNil(t, a.IsEdns0())
+
+	// NXDOMAIN with the SOA of a parent zone
+	q.SetQuestion("missing.example.com.", dns.TypeA)
+	a = new(dns.Msg)
+	a.SetRcode(q, dns.RcodeNameError)
+	a.Ns = []dns.RR{
+		rr("example.com. 60 IN SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 60"),
+		rr("a.example.com. 60 IN NSEC z.example.com. A"),
+	}
+	require.Equal(t, 0, scrubResponse(q, a))
+	require.Len(t, a.Ns, 2)
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+
+package rdns
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Sets SO_REUSEPORT on a socket before it's bound.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -7,12 +7,14 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
 type route struct {
+	id            string // Optional, identifies the route in the admin listener
 	types         []uint16
 	class         uint16
 	name          *regexp.Regexp
@@ -25,13 +27,52 @@ type route struct {
 	resolver      Resolver
 	listenerID    *regexp.Regexp
 	tlsServerName *regexp.Regexp
+	tlsClientName *regexp.Regexp
+
+	// Captured EDNS0 option the client info needs to have, its hex-encoded data
+	// is matched against edns0Data
+	edns0Code uint16
+	edns0Data *regexp.Regexp
+
+	// MAC address of the client (regexp), matches any client if nil
+	mac *regexp.Regexp
+
+	// Original destination of queries intercepted by a transparent listener
+	originalDst *net.IPNet
+
+	// List of names the query name needs to be in, matches any name if nil
+	nameDB *dbRef[BlocklistDB]
+
+	// Closed to stop reloading the name list
+	stop      chan struct{}
+	closeOnce sync.Once
+
+	// Outbound proxy for upstream traffic, only applied if proxySet is true
+	proxy    *Socks5Dialer
+	proxySet bool
+
+	// Tag the client info needs to carry, matches any query if empty
+	tag string
+
+	// Tag added to the client info of matching queries
+	addTag string
+
+	// Routes with higher priority are evaluated first
+	priority int
+
+	// Apply the route's changes to matching queries and evaluate the next
+	// routes instead of sending the query to a resolver
+	cont bool
+
+	// Runtime changes made through the admin listener, protected by the
+	// router's mutex
+	disabled bool
+	override Resolver
 }
 
-// NewRoute initializes a route from string parameters.
-func NewRoute(name, class string, types, weekdays []string, before, after, source, dohPath, listenerID, tlsServerName string, resolver Resolver) (*route, error) {
-	if resolver == nil {
-		return nil, errors.New("no resolver defined for route")
-	}
+// NewRoute initializes a route from string parameters. The resolver can only be
+// nil for routes that continue with the next route, see SetContinue.
+func NewRoute(name, class string, types, weekdays []string, before, after, source, dohPath, listenerID, tlsServerName, tlsClientName string, resolver Resolver) (*route, error) {
 	t, err := stringToType(types)
 	if err != nil {
 		return nil, err
@@ -68,6 +109,10 @@ func NewRoute(name, class string, types, weekdays []string, before, after, sourc
 	if err != nil {
 		return nil, err
 	}
+	tlsClientRe, err := regexp.Compile(tlsClientName)
+	if err != nil {
+		return nil, err
+	}
 	var sNet *net.IPNet
 	if source != "" {
 		_, sNet, err = net.ParseCIDR(source)
@@ -86,6 +131,7 @@ func NewRoute(name, class string, types, weekdays []string, before, after, sourc
 		dohPath:       dohRe,
 		listenerID:    listenerRe,
 		tlsServerName: tlsRe,
+		tlsClientName: tlsClientRe,
 		resolver:      resolver,
 	}, nil
 }
@@ -113,6 +159,29 @@ func (r *route) match(q *dns.Msg, ci ClientInfo) bool {
 	if !r.tlsServerName.MatchString(ci.TLSServerName) {
 		return r.inverted
 	}
+	if !r.tlsClientName.MatchString(ci.TLSClientName) {
+		return r.inverted
+	}
+	if r.mac != nil && (ci.MAC == nil || !r.mac.MatchString(ci.MAC.String())) {
+		return r.inverted
+	}
+	if r.originalDst != nil && !r.originalDst.Contains(ci.OriginalDst) {
+		return r.inverted
+	}
+	if r.tag != "" && !ci.HasTag(r.tag) {
+		return r.inverted
+	}
+	if r.nameDB != nil {
+		if _, _, _, ok := r.nameDB.Load().Match(question); !ok {
+			return r.inverted
+		}
+	}
+	if r.edns0Data != nil {
+		data, ok := ci.edns0Hex(r.edns0Code)
+		if !ok || !r.edns0Data.MatchString(data) {
+			return r.inverted
+		}
+	}
 	if len(r.weekdays) > 0 || r.before != nil || r.after != nil {
 		now := time.Now().Local()
 		hour := now.Hour()
@@ -144,11 +213,150 @@ func (r *route) Invert(value bool) {
 	r.inverted = value
 }
 
+// MatchEDNS0 limits the route to queries with an EDNS0 option that was captured
+// by the listener. The data of the option is hex-encoded and matched against a
+// regular expression, an empty expression matches any data.
+func (r *route) MatchEDNS0(code uint16, data string) error {
+	re, err := regexp.Compile(data)
+	if err != nil {
+		return err
+	}
+	r.edns0Code = code
+	r.edns0Data = re
+	return nil
+}
+
+// MatchMAC limits the route to clients with a MAC address, resolved by the
+// listener, that matches a regular expression. MAC addresses are in lowercase
+// and colon-separated, like 00:1a:2b:3c:4d:5e.
+func (r *route) MatchMAC(mac string) error {
+	re, err := regexp.Compile(mac)
+	if err != nil {
+		return err
+	}
+	r.mac = re
+	return nil
+}
+
+// MatchOriginalDst limits the route to queries intercepted by a transparent
+// listener that were originally sent to an address in the network.
+func (r *route) MatchOriginalDst(cidr string) error {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	r.originalDst = n
+	return nil
+}
+
+// MatchNameDB limits the route to queries for names in a list, like a
+// blocklist. This is more efficient than a regular expression for long lists
+// of domains. The list is reloaded periodically if refresh is greater than 0.
+func (r *route) MatchNameDB(db BlocklistDB, refresh time.Duration) {
+	r.nameDB = newDBRef(db)
+	if refresh > 0 {
+		r.stop = make(chan struct{})
+		go r.refreshLoopNameDB(refresh)
+	}
+}
+
+// Stops reloading the name list of the route, if any.
+func (r *route) close() {
+	r.closeOnce.Do(func() {
+		if r.stop != nil {
+			close(r.stop)
+		}
+	})
+}
+
+func (r *route) refreshLoopNameDB(refresh time.Duration) {
+	for {
+		select {
+		case <-time.After(refresh):
+		case <-r.stop:
+			return
+		}
+		log := Log.WithField("list", r.nameDB.Load().String())
+		log.Debug("reloading route name list")
+		db, err := r.nameDB.Load().Reload()
+		if err != nil {
+			log.WithError(err).Error("failed to load rules")
+			continue
+		}
+		r.nameDB.Store(db)
+	}
+}
+
+// SetProxy makes queries matching the route use the proxy for their upstream
+// traffic, replacing any proxy chosen before, for example by a panel. With a
+// nil dialer, queries are sent directly instead.
+func (r *route) SetProxy(d *Socks5Dialer) {
+	r.proxy = d
+	r.proxySet = true
+}
+
+// SetID names the route, so it can be changed at runtime through the admin
+// listener.
+func (r *route) SetID(id string) {
+	r.id = id
+}
+
+// Returns the resolver queries matching the route are sent to, which may have
+// been changed at runtime.
+func (r *route) currentResolver() Resolver {
+	if r.override != nil {
+		return r.override
+	}
+	return r.resolver
+}
+
+// MatchTag limits the route to queries that were tagged by an earlier route.
+func (r *route) MatchTag(tag string) {
+	r.tag = tag
+}
+
+// AddTag tags matching queries, so routes evaluated after this one, including
+// those in routers further down the pipeline, can match on the tag.
+func (r *route) AddTag(tag string) {
+	r.addTag = tag
+}
+
+// SetPriority sets the priority of the route. Routes with higher priority are
+// evaluated first, routes with the same priority in the order they're added.
+func (r *route) SetPriority(priority int) {
+	r.priority = priority
+}
+
+// SetContinue makes the route apply its proxy and tag to matching queries and
+// fall through to the next routes, rather than sending them to the resolver.
+func (r *route) SetContinue() error {
+	if r.resolver != nil {
+		return errors.New("route with continue can't have a resolver")
+	}
+	r.cont = true
+	return nil
+}
+
+// Applies the changes of the route to the client info of a matching query.
+func (r *route) apply(ci ClientInfo) ClientInfo {
+	if r.proxySet {
+		ci.Dialer = r.proxy
+	}
+	if r.addTag != "" && !ci.HasTag(r.addTag) {
+		// Copy the tags, the slice may be shared with the caller
+		ci.Tags = append(ci.Tags[:len(ci.Tags):len(ci.Tags)], r.addTag)
+	}
+	return ci
+}
+
 func (r *route) String() string {
 	if r.isDefault() {
 		return "(default)"
 	}
 	var fragments []string
+	if r.id != "" {
+		fragments = append(fragments, "id="+r.id)
+	}
 	if len(r.types) > 0 {
 		var types []string
 		for _, t := range r.types {
@@ -175,6 +383,24 @@ func (r *route) String() string {
 	if r.tlsServerName.String() != "" {
 		fragments = append(fragments, "servername="+r.tlsServerName.String())
 	}
+	if r.mac != nil {
+		fragments = append(fragments, "mac="+r.mac.String())
+	}
+	if r.originalDst != nil {
+		fragments = append(fragments, "original-dst="+r.originalDst.String())
+	}
+	if r.nameDB != nil {
+		fragments = append(fragments, "name-list="+r.nameDB.Load().String())
+	}
+	if r.edns0Data != nil {
+		fragments = append(fragments, fmt.Sprintf("edns0=%d:%s", r.edns0Code, r.edns0Data))
+	}
+	if r.tag != "" {
+		fragments = append(fragments, "tag="+r.tag)
+	}
+	if r.addTag != "" {
+		fragments = append(fragments, "add-tag="+r.addTag)
+	}
 	if len(r.weekdays) > 0 {
 		fragments = append(fragments, fmt.Sprintf("weekdays=%v", r.weekdays))
 	}
@@ -187,11 +413,17 @@ func (r *route) String() string {
 	if r.inverted {
 		fragments = append(fragments, "invert=true")
 	}
+	if r.priority != 0 {
+		fragments = append(fragments, fmt.Sprintf("priority=%d", r.priority))
+	}
+	if r.cont {
+		fragments = append(fragments, "continue=true")
+	}
 	return "(" + strings.Join(fragments, ",") + ")"
 }
 
 func (r *route) isDefault() bool {
-	return r.class == 0 && len(r.types) == 0 && r.name.String() == ""
+	return r.class == 0 && len(r.types) == 0 && r.name.String() == "" && r.nameDB == nil && r.tag == "" && !r.cont
 }
 
 func (r *route) matchType(typ uint16) bool {
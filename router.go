@@ -1,9 +1,14 @@
 package rdns
 
 import (
+	"encoding/json"
 	"errors"
 	"expvar"
 	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
 
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
@@ -14,6 +19,13 @@ type Router struct {
 	id      string
 	routes  []*route
 	metrics *RouterMetrics
+
+	// Resolvers routes can be re-pointed at through the admin listener, by ID.
+	// None of them lead back to the router.
+	resolvers map[string]Resolver
+
+	// Protects the runtime state of the routes, disabled and override
+	mu sync.RWMutex
 }
 
 var _ Resolver = &Router{}
@@ -37,34 +49,53 @@ func NewRouterMetrics(id string, available int) *RouterMetrics {
 	}
 }
 
+// RouteStatus is the runtime state of a route in a router.
+type RouteStatus struct {
+	ID       string `json:"id,omitempty"`
+	Route    string `json:"route"`
+	Resolver string `json:"resolver,omitempty"`
+	Enabled  bool   `json:"enabled"`
+	Changed  bool   `json:"changed"`
+}
+
 // NewRouter returns a new router instance. The router won't have any routes and can only be used
 // once Add() is called to setup a route.
 func NewRouter(id string) *Router {
-	return &Router{
+	r := &Router{
 		id:      id,
 		metrics: NewRouterMetrics(id, 0),
 	}
+	registerAdminHandler("/routedns/router/"+id, r)
+	return r
 }
 
 // Resolve a request by routing it to the right resolved based on the routes setup in the router.
-func (r *Router) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dialer) (*dns.Msg, error) {
+func (r *Router) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	if len(q.Question) < 1 {
 		return nil, errors.New("no question in query")
 	}
 	question := q.Question[0]
 	log := logger(r.id, q, ci)
 	for _, route := range r.routes {
-		if !route.match(q, ci) {
+		r.mu.RLock()
+		disabled, resolver := route.disabled, route.currentResolver()
+		r.mu.RUnlock()
+		if disabled || !route.match(q, ci) {
+			continue
+		}
+		ci = route.apply(ci)
+		if route.cont {
+			log.WithField("route", route.String()).Debug("continuing with next route")
 			continue
 		}
 		log.WithFields(logrus.Fields{
 			"route":    route.String(),
-			"resolver": route.resolver.String()},
+			"resolver": resolver.String()},
 		).Debug("routing query to resolver")
-		r.metrics.route.Add(route.resolver.String(), 1)
-		a, err := route.resolver.Resolve(q, ci, PanelSocksDialer)
+		r.metrics.route.Add(resolver.String(), 1)
+		a, err := resolver.Resolve(q, ci)
 		if err != nil {
-			r.metrics.failure.Add(route.resolver.String(), 1)
+			r.metrics.failure.Add(resolver.String(), 1)
 		}
 		return a, err
 	}
@@ -72,16 +103,169 @@ func (r *Router) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dial
 }
 
 // Add a new route to the router. New routes are appended to the existing
-// ones and are evaluated in the same order they're added. The default
-// route (no name, no type) should be added last since subsequently added
-// routes won't have any impact. Name is a regular expression that is
-// applied to the name in the first question section of the DNS message.
-// Source is an IP or network in CIDR format.
+// ones and are evaluated in the same order they're added, unless they have
+// a different priority. Routes with higher priority are evaluated first.
+// The default route (no name, no type) should be added last since
+// subsequently added routes won't have any impact. Name is a regular
+// expression that is applied to the name in the first question section of
+// the DNS message. Source is an IP or network in CIDR format.
 func (r *Router) Add(routes ...*route) {
 	r.routes = append(r.routes, routes...)
+	sort.SliceStable(r.routes, func(i, j int) bool {
+		return r.routes[i].priority > r.routes[j].priority
+	})
 	r.metrics.available.Add(1)
 }
 
+// Close stops reloading the name lists of the routes.
+func (r *Router) Close() error {
+	for _, route := range r.routes {
+		route.close()
+	}
+	return nil
+}
+
+// SetResolvers sets the resolvers, groups and routers, by ID, that named routes
+// can be pointed at through the admin listener. They must not lead back to the
+// router, queries would otherwise be routed in a loop.
+func (r *Router) SetResolvers(resolvers map[string]Resolver) {
+	r.resolvers = make(map[string]Resolver, len(resolvers))
+	for id, resolver := range resolvers {
+		if resolver != Resolver(r) {
+			r.resolvers[id] = resolver
+		}
+	}
+}
+
+// Routes returns the runtime state of the routes in the order they're evaluated.
+func (r *Router) Routes() []RouteStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	list := make([]RouteStatus, 0, len(r.routes))
+	for _, route := range r.routes {
+		status := RouteStatus{
+			ID:      route.id,
+			Route:   route.String(),
+			Enabled: !route.disabled,
+			Changed: route.disabled || route.override != nil,
+		}
+		if resolver := route.currentResolver(); resolver != nil {
+			status.Resolver = resolver.String()
+		}
+		list = append(list, status)
+	}
+	return list
+}
+
+// EnableRoute enables or disables the route with the given ID. Disabled routes
+// are skipped until they're enabled again or the configuration is reloaded.
+func (r *Router) EnableRoute(id string, enabled bool) error {
+	route, err := r.route(id)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	route.disabled = !enabled
+	r.mu.Unlock()
+	Log.WithFields(logrus.Fields{"id": r.id, "route": id, "enabled": enabled}).Info("changing route")
+	return nil
+}
+
+// SetRouteResolver sends queries matching the route with the given ID to a
+// different resolver, until it's reset or the configuration is reloaded.
+func (r *Router) SetRouteResolver(id string, resolver Resolver) error {
+	route, err := r.route(id)
+	if err != nil {
+		return err
+	}
+	if route.cont {
+		return fmt.Errorf("route '%s' continues with the next route and has no resolver", id)
+	}
+	r.mu.Lock()
+	route.override = resolver
+	r.mu.Unlock()
+	Log.WithFields(logrus.Fields{"id": r.id, "route": id, "resolver": resolver.String()}).Info("changing route")
+	return nil
+}
+
+// ResetRoute reverts runtime changes to the route with the given ID.
+func (r *Router) ResetRoute(id string) error {
+	route, err := r.route(id)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	route.disabled = false
+	route.override = nil
+	r.mu.Unlock()
+	Log.WithFields(logrus.Fields{"id": r.id, "route": id}).Info("resetting route")
+	return nil
+}
+
+// ServeHTTP lists the routes on GET. A POST request with a "route" parameter
+// changes the named route, enabling or disabling it with the "enabled"
+// parameter, or pointing it at another resolver with "resolver". A DELETE
+// request reverts the changes to the route.
+func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.Routes())
+	case http.MethodPost:
+		id := req.URL.Query().Get("route")
+		if id == "" {
+			http.Error(w, "missing route parameter", http.StatusBadRequest)
+			return
+		}
+		if v := req.URL.Query().Get("enabled"); v != "" {
+			enabled, err := strconv.ParseBool(v)
+			if err != nil {
+				http.Error(w, "invalid enabled parameter", http.StatusBadRequest)
+				return
+			}
+			if err := r.EnableRoute(id, enabled); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+		}
+		if v := req.URL.Query().Get("resolver"); v != "" {
+			resolver, ok := r.resolvers[v]
+			if !ok {
+				http.Error(w, fmt.Sprintf("unknown resolver '%s', or one that leads back to the router", v), http.StatusBadRequest)
+				return
+			}
+			if err := r.SetRouteResolver(id, resolver); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		id := req.URL.Query().Get("route")
+		if id == "" {
+			http.Error(w, "missing route parameter", http.StatusBadRequest)
+			return
+		}
+		if err := r.ResetRoute(id); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Returns the route with the given ID.
+func (r *Router) route(id string) (*route, error) {
+	for _, route := range r.routes {
+		if route.id != "" && route.id == id {
+			return route, nil
+		}
+	}
+	return nil, fmt.Errorf("no route '%s' in router '%s'", id, r.id)
+}
+
 func (r *Router) String() string {
 	return r.id
 }
@@ -1,7 +1,10 @@
 package rdns
 
 import (
+	"encoding/json"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/miekg/dns"
@@ -14,22 +17,22 @@ func TestRouterType(t *testing.T) {
 	q := new(dns.Msg)
 	var ci ClientInfo
 
-	route1, _ := NewRoute("", "", []string{"MX"}, nil, "", "", "", "", "", "", r1)
-	route2, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", r2)
+	route1, _ := NewRoute("", "", []string{"MX"}, nil, "", "", "", "", "", "", "", r1)
+	route2, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", "", r2)
 
 	router := NewRouter("my-router")
 	router.Add(route1, route2)
 
 	// Not MX record, should go to r2
 	q.SetQuestion("acme.test.", dns.TypeA)
-	_, err := router.Resolve(q, ci, nil)
+	_, err := router.Resolve(q, ci)
 	require.NoError(t, err)
 	require.Equal(t, 0, r1.HitCount())
 	require.Equal(t, 1, r2.HitCount())
 
 	// MX record, should go to r1
 	q.SetQuestion("acme.test.", dns.TypeMX)
-	_, err = router.Resolve(q, ci, nil)
+	_, err = router.Resolve(q, ci)
 	require.NoError(t, err)
 	require.Equal(t, 1, r1.HitCount())
 	require.Equal(t, 1, r2.HitCount())
@@ -41,15 +44,15 @@ func TestRouterClass(t *testing.T) {
 	q := new(dns.Msg)
 	var ci ClientInfo
 
-	route1, _ := NewRoute("", "ANY", nil, nil, "", "", "", "", "", "", r1)
-	route2, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", r2)
+	route1, _ := NewRoute("", "ANY", nil, nil, "", "", "", "", "", "", "", r1)
+	route2, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", "", r2)
 
 	router := NewRouter("my-router")
 	router.Add(route1, route2)
 
 	// ClassINET question, should go to r2
 	q.SetQuestion("acme.test.", dns.TypeA)
-	_, err := router.Resolve(q, ci, nil)
+	_, err := router.Resolve(q, ci)
 	require.NoError(t, err)
 	require.Equal(t, 0, r1.HitCount())
 	require.Equal(t, 1, r2.HitCount())
@@ -57,7 +60,7 @@ func TestRouterClass(t *testing.T) {
 	// ClassAny should go to r1
 	q.Question = make([]dns.Question, 1)
 	q.Question[0] = dns.Question{"miek.nl.", dns.TypeMX, dns.ClassANY}
-	_, err = router.Resolve(q, ci, nil)
+	_, err = router.Resolve(q, ci)
 	require.NoError(t, err)
 	require.Equal(t, 1, r1.HitCount())
 	require.Equal(t, 1, r2.HitCount())
@@ -69,22 +72,22 @@ func TestRouterName(t *testing.T) {
 	q := new(dns.Msg)
 	var ci ClientInfo
 
-	route1, _ := NewRoute(`\.acme\.test\.$`, "", nil, nil, "", "", "", "", "", "", r1)
-	route2, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", r2)
+	route1, _ := NewRoute(`\.acme\.test\.$`, "", nil, nil, "", "", "", "", "", "", "", r1)
+	route2, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", "", r2)
 
 	router := NewRouter("my-router")
 	router.Add(route1, route2)
 
 	// No match, should go to r2
 	q.SetQuestion("bla.test.", dns.TypeA)
-	_, err := router.Resolve(q, ci, nil)
+	_, err := router.Resolve(q, ci)
 	require.NoError(t, err)
 	require.Equal(t, 0, r1.HitCount())
 	require.Equal(t, 1, r2.HitCount())
 
 	// Match, should go to r1
 	q.SetQuestion("x.acme.test.", dns.TypeMX)
-	_, err = router.Resolve(q, ci, nil)
+	_, err = router.Resolve(q, ci)
 	require.NoError(t, err)
 	require.Equal(t, 1, r1.HitCount())
 	require.Equal(t, 1, r2.HitCount())
@@ -96,21 +99,298 @@ func TestRouterSource(t *testing.T) {
 	q := new(dns.Msg)
 	q.SetQuestion("acme.test.", dns.TypeA)
 
-	route1, _ := NewRoute("", "", nil, nil, "", "", "192.168.1.100/32", "", "", "", r1)
-	route2, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", r2)
+	route1, _ := NewRoute("", "", nil, nil, "", "", "192.168.1.100/32", "", "", "", "", r1)
+	route2, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", "", r2)
 
 	router := NewRouter("my-router")
 	router.Add(route1, route2)
 
 	// No match, should go to r2
-	_, err := router.Resolve(q, ClientInfo{SourceIP: net.ParseIP("192.168.1.50")}, nil)
+	_, err := router.Resolve(q, ClientInfo{SourceIP: net.ParseIP("192.168.1.50")})
 	require.NoError(t, err)
 	require.Equal(t, 0, r1.HitCount())
 	require.Equal(t, 1, r2.HitCount())
 
 	// Match, should go to r1
-	_, err = router.Resolve(q, ClientInfo{SourceIP: net.ParseIP("192.168.1.100")}, nil)
+	_, err = router.Resolve(q, ClientInfo{SourceIP: net.ParseIP("192.168.1.100")})
 	require.NoError(t, err)
 	require.Equal(t, 1, r1.HitCount())
 	require.Equal(t, 1, r2.HitCount())
 }
+
+func TestRouterProxy(t *testing.T) {
+	var dialer *Socks5Dialer
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			dialer = ci.Dialer
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+	proxy := NewSocks5Dialer("127.0.0.1:1080", Socks5DialerOptions{})
+	panel := NewSocks5Dialer("127.0.0.1:1081", Socks5DialerOptions{})
+
+	route1, _ := NewRoute(`\.proxied\.test\.$`, "", nil, nil, "", "", "", "", "", "", "", r)
+	route1.SetProxy(proxy)
+	route2, _ := NewRoute(`\.direct\.test\.$`, "", nil, nil, "", "", "", "", "", "", "", r)
+	route2.SetProxy(nil)
+	route3, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", "", r)
+
+	router := NewRouter("my-router")
+	router.Add(route1, route2, route3)
+
+	ci := ClientInfo{Dialer: panel}
+	q := new(dns.Msg)
+	tests := []struct {
+		name     string
+		expected *Socks5Dialer
+	}{
+		{"www.proxied.test.", proxy},
+		{"www.direct.test.", nil},
+		{"www.other.test.", panel}, // Unchanged without a proxy on the route
+	}
+	for _, test := range tests {
+		q.SetQuestion(test.name, dns.TypeA)
+		_, err := router.Resolve(q, ci)
+		require.NoError(t, err)
+		require.Same(t, test.expected, dialer, test.name)
+	}
+}
+
+func TestRouterEDNS0(t *testing.T) {
+	r1 := new(TestResolver)
+	r2 := new(TestResolver)
+	q := new(dns.Msg)
+	q.SetQuestion("acme.test.", dns.TypeA)
+
+	route1, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", "", r1)
+	require.NoError(t, route1.MatchEDNS0(65001, "^6b696473"))
+	route2, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", "", r2)
+
+	router := NewRouter("my-router")
+	router.Add(route1, route2)
+
+	// No captured options, should go to r2
+	_, err := router.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 0, r1.HitCount())
+	require.Equal(t, 1, r2.HitCount())
+
+	// Different device, should go to r2
+	_, err = router.Resolve(q, ClientInfo{EDNS0: map[uint16][]byte{65001: []byte("laptop")}})
+	require.NoError(t, err)
+	require.Equal(t, 0, r1.HitCount())
+	require.Equal(t, 2, r2.HitCount())
+
+	// Matching device, should go to r1
+	_, err = router.Resolve(q, ClientInfo{EDNS0: map[uint16][]byte{65001: []byte("kids-tablet")}})
+	require.NoError(t, err)
+	require.Equal(t, 1, r1.HitCount())
+	require.Equal(t, 2, r2.HitCount())
+}
+
+func TestRouterMAC(t *testing.T) {
+	r1 := new(TestResolver)
+	r2 := new(TestResolver)
+	q := new(dns.Msg)
+	q.SetQuestion("acme.test.", dns.TypeA)
+
+	route1, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", "", r1)
+	require.NoError(t, route1.MatchMAC("^00:1a:2b:"))
+	route2, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", "", r2)
+	router := NewRouter("my-router")
+	router.Add(route1, route2)
+
+	mac, _ := net.ParseMAC("00:1a:2b:3c:4d:5e")
+	other, _ := net.ParseMAC("00:ff:2b:3c:4d:5e")
+	for _, ci := range []ClientInfo{{}, {MAC: other}, {MAC: mac}} {
+		_, err := router.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 1, r1.HitCount())
+	require.Equal(t, 2, r2.HitCount())
+}
+
+func TestRouterOriginalDst(t *testing.T) {
+	r1 := new(TestResolver)
+	r2 := new(TestResolver)
+	q := new(dns.Msg)
+	q.SetQuestion("acme.test.", dns.TypeA)
+
+	route1, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", "", r1)
+	require.NoError(t, route1.MatchOriginalDst("8.8.8.0/24"))
+	route2, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", "", r2)
+	router := NewRouter("my-router")
+	router.Add(route1, route2)
+
+	for _, ci := range []ClientInfo{{}, {OriginalDst: net.ParseIP("1.1.1.1")}, {OriginalDst: net.ParseIP("8.8.8.8")}} {
+		_, err := router.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 1, r1.HitCount())
+	require.Equal(t, 2, r2.HitCount())
+}
+
+func TestRouterPriority(t *testing.T) {
+	r1 := new(TestResolver)
+	r2 := new(TestResolver)
+	q := new(dns.Msg)
+	q.SetQuestion("acme.test.", dns.TypeA)
+	var ci ClientInfo
+
+	// The default route is added first, but the second route has a higher priority
+	route1, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", "", r1)
+	route2, _ := NewRoute(`\.test\.$`, "", nil, nil, "", "", "", "", "", "", "", r2)
+	route2.SetPriority(10)
+
+	router := NewRouter("my-router")
+	router.Add(route1, route2)
+
+	_, err := router.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 0, r1.HitCount())
+	require.Equal(t, 1, r2.HitCount())
+}
+
+func TestRouterContinue(t *testing.T) {
+	var (
+		dialer *Socks5Dialer
+		tags   []string
+	)
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			dialer = ci.Dialer
+			tags = ci.Tags
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+	r2 := new(TestResolver)
+	proxy := NewSocks5Dialer("127.0.0.1:1080", Socks5DialerOptions{})
+
+	// Tag queries for a domain and send them through a proxy, then continue
+	route1, _ := NewRoute(`\.kids\.test\.$`, "", nil, nil, "", "", "", "", "", "", "", nil)
+	route1.AddTag("kids")
+	route1.SetProxy(proxy)
+	require.NoError(t, route1.SetContinue())
+	// Tagged queries go to r2
+	route2, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", "", r2)
+	route2.MatchTag("kids")
+	route2.SetProxy(nil)
+	route3, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", "", r)
+
+	router := NewRouter("my-router")
+	router.Add(route1, route2, route3)
+
+	// Not tagged, falls through to the default route unchanged
+	q := new(dns.Msg)
+	q.SetQuestion("www.other.test.", dns.TypeA)
+	_, err := router.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Nil(t, dialer)
+	require.Empty(t, tags)
+	require.Equal(t, 0, r2.HitCount())
+
+	// Tagged by the first route, then matched by the second
+	q.SetQuestion("www.kids.test.", dns.TypeA)
+	_, err = router.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, r2.HitCount())
+
+	// Without the second route, the tag and proxy are passed on to the resolver
+	router = NewRouter("my-router")
+	router.Add(route1, route3)
+	_, err = router.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Same(t, proxy, dialer)
+	require.Equal(t, []string{"kids"}, tags)
+
+	// A route that continues can't have a resolver
+	route4, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", "", r)
+	require.Error(t, route4.SetContinue())
+}
+
+func TestRouterAdmin(t *testing.T) {
+	r1 := new(TestResolver)
+	r2 := new(TestResolver)
+	r3 := new(TestResolver)
+	q := new(dns.Msg)
+	q.SetQuestion("www.acme.test.", dns.TypeA)
+	var ci ClientInfo
+
+	route1, _ := NewRoute(`\.acme\.test\.$`, "", nil, nil, "", "", "", "", "", "", "", r1)
+	route1.SetID("acme")
+	route2, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", "", r2)
+	router := NewRouter("my-router")
+	router.SetResolvers(map[string]Resolver{"r3": r3, "my-router": router})
+	router.Add(route1, route2)
+
+	do := func(method, query string) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, "/routedns/router/my-router?"+query, nil))
+		return w.Code
+	}
+
+	// Disable the route, queries go to the default route
+	require.Equal(t, http.StatusNoContent, do(http.MethodPost, "route=acme&enabled=false"))
+	_, err := router.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 0, r1.HitCount())
+	require.Equal(t, 1, r2.HitCount())
+
+	// Enable it again, pointing at another resolver
+	require.Equal(t, http.StatusNoContent, do(http.MethodPost, "route=acme&enabled=true&resolver=r3"))
+	_, err = router.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 0, r1.HitCount())
+	require.Equal(t, 1, r3.HitCount())
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/routedns/router/my-router", nil))
+	var routes []RouteStatus
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&routes))
+	require.Len(t, routes, 2)
+	require.Equal(t, "acme", routes[0].ID)
+	require.Equal(t, r3.String(), routes[0].Resolver)
+	require.True(t, routes[0].Enabled)
+	require.True(t, routes[0].Changed)
+
+	// Revert the changes
+	require.Equal(t, http.StatusNoContent, do(http.MethodDelete, "route=acme"))
+	_, err = router.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r1.HitCount())
+
+	// Unknown routes and resolvers
+	require.Equal(t, http.StatusNotFound, do(http.MethodPost, "route=other&enabled=false"))
+	require.Equal(t, http.StatusBadRequest, do(http.MethodPost, "route=acme&resolver=other"))
+
+	// The router can't be made to send queries to itself
+	require.Equal(t, http.StatusBadRequest, do(http.MethodPost, "route=acme&resolver=my-router"))
+}
+
+func TestRouterNameDB(t *testing.T) {
+	r1 := new(TestResolver)
+	r2 := new(TestResolver)
+	q := new(dns.Msg)
+	var ci ClientInfo
+
+	db, err := NewDomainDB("streaming", NewStaticLoader([]string{"video.test", ".cdn.test"}))
+	require.NoError(t, err)
+	route1, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", "", r1)
+	route1.MatchNameDB(db, 0)
+	route2, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", "", r2)
+
+	router := NewRouter("my-router")
+	router.Add(route1, route2)
+
+	for _, name := range []string{"video.test.", "www.cdn.test.", "other.test."} {
+		q.SetQuestion(name, dns.TypeA)
+		_, err := router.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, r1.HitCount())
+	require.Equal(t, 1, r2.HitCount())
+}
@@ -2,7 +2,9 @@ package rdns
 
 import (
 	"context"
+	"fmt"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,8 +15,12 @@ type Socks5Dialer struct {
 	*socks5.Client
 	opt Socks5DialerOptions
 
-	once sync.Once
-	addr string
+	// Addresses resolved locally with ResolveLocal
+	addrs sync.Map
+
+	// Closed once the dialer is no longer used, see Close
+	closeMu sync.Mutex
+	closed  chan struct{}
 }
 
 type Socks5DialerOptions struct {
@@ -45,47 +51,220 @@ func NewSocks5Dialer(addr string, opt Socks5DialerOptions) *Socks5Dialer {
 }
 
 func (d *Socks5Dialer) Dial(network string, address string) (net.Conn, error) {
-	d.once.Do(func() {
-		d.addr = address
-
-		// If the address uses a hostname and ResolveLocal is enabled, lookup
-		// the IP for it locally and use that when talking to the proxy going
-		// forward. This avoids the DNS server's address leaking out from the
-		// proxy.
-		if d.opt.ResolveLocal {
-			host, port, err := net.SplitHostPort(address)
-			if err != nil {
-				Log.WithError(err).Error("failed to parse socks5 address")
-				return
-			}
-			Log.WithField("addr", host).Debug("resolving dns server locally")
-			ip := net.ParseIP(host)
-			if ip != nil {
-				// Already an IP
-				return
-			}
-			timeout := d.opt.UDPTimeout
-			if timeout == 0 {
-				timeout = 5 * time.Second
-			}
-			ctx, cancel := context.WithTimeout(context.Background(), timeout)
-			defer cancel()
-			ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
-			if err != nil {
-				Log.WithError(err).Errorf("failed to lookup %q locally", host)
-				return
-			}
-			if len(ips) == 0 {
-				Log.WithError(err).Error("failed to resolve dns server locally, forwarding to socks5 proxy")
-				return
-			}
-			d.addr = net.JoinHostPort(ips[0].String(), port)
+	address = d.resolve(address)
+
+	var src string
+	if d.opt.LocalAddr != nil {
+		src = net.JoinHostPort(d.opt.LocalAddr.String(), "0")
+	}
+	if strings.HasPrefix(network, "udp") {
+		return d.dialUDP(src, address)
+	}
+	if src != "" {
+		return d.Client.DialWithLocalAddr(network, src, address, nil)
+	}
+	return d.Client.Dial(network, address)
+}
+
+// Close marks the dialer as no longer used, for example when a panel replaces
+// its proxy. Clients then close the connections they keep for it.
+func (d *Socks5Dialer) Close() {
+	d.closeMu.Lock()
+	defer d.closeMu.Unlock()
+	if d.closed == nil {
+		d.closed = make(chan struct{})
+	}
+	select {
+	case <-d.closed:
+	default:
+		close(d.closed)
+	}
+}
+
+// Returns a channel that is closed when the dialer is closed.
+func (d *Socks5Dialer) done() chan struct{} {
+	d.closeMu.Lock()
+	defer d.closeMu.Unlock()
+	if d.closed == nil {
+		d.closed = make(chan struct{})
+	}
+	return d.closed
+}
+
+// Identifies the proxy by address, credentials and options. Dialers with the
+// same key can be used in place of each other.
+func (d *Socks5Dialer) key() string {
+	return fmt.Sprintf("%s|%+v", d.Client.Server, d.opt)
+}
+
+// Returns the address to send to the proxy. If the address uses a hostname and
+// ResolveLocal is enabled, lookup the IP for it locally and use that when talking
+// to the proxy going forward. This avoids the DNS server's address leaking out
+// from the proxy. The dialer can be shared by several upstreams, so results are
+// kept per address.
+func (d *Socks5Dialer) resolve(address string) string {
+	if !d.opt.ResolveLocal {
+		return address
+	}
+	if addr, ok := d.addrs.Load(address); ok {
+		return addr.(string)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		Log.WithError(err).Error("failed to parse socks5 address")
+		return address
+	}
+	if net.ParseIP(host) != nil {
+		// Already an IP
+		return address
+	}
+	Log.WithField("addr", host).Debug("resolving dns server locally")
+	timeout := d.opt.UDPTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+	if err != nil {
+		Log.WithError(err).Errorf("failed to lookup %q locally", host)
+		return address
+	}
+	if len(ips) == 0 {
+		Log.Error("failed to resolve dns server locally, forwarding to socks5 proxy")
+		return address
+	}
+	addr := net.JoinHostPort(ips[0].String(), port)
+	d.addrs.Store(address, addr)
+	return addr
+}
+
+// Opens a UDP "connection" through the proxy with UDP ASSOCIATE. Datagrams are
+// exchanged with the relay address given by the proxy, while the control
+// connection is kept open for as long as the association is used. Unlike the
+// socks5 package, no fixed deadline is set on the connection, the caller is
+// expected to manage timeouts.
+func (d *Socks5Dialer) dialUDP(src, address string) (net.Conn, error) {
+	c := &socks5.Client{
+		Server:     d.Client.Server,
+		UserName:   d.Client.UserName,
+		Password:   d.Client.Password,
+		TCPTimeout: d.Client.TCPTimeout,
+		UDPTimeout: d.Client.UDPTimeout,
+		Dst:        address,
+	}
+	var laddr net.Addr
+	if src != "" {
+		laddr = &net.TCPAddr{IP: d.opt.LocalAddr}
+	}
+	if err := c.Negotiate(laddr); err != nil {
+		if c.TCPConn != nil {
+			c.TCPConn.Close()
 		}
+		return nil, fmt.Errorf("socks5 negotiation with %s failed: %w", c.Server, err)
+	}
+	// The association is requested without a source address, the proxy takes
+	// the address of the first datagram
+	reply, err := c.Request(socks5.NewRequest(socks5.CmdUDP, socks5.ATYPIPv4, net.IPv4zero, []byte{0, 0}))
+	if err != nil {
+		c.TCPConn.Close()
+		return nil, fmt.Errorf("socks5 udp associate with %s failed: %w", c.Server, err)
+	}
+	relay, err := socks5UDPRelay(c.Server, reply.Address())
+	if err != nil {
+		c.TCPConn.Close()
+		return nil, err
+	}
+	c.RemoteAddress, _ = net.ResolveUDPAddr("udp", address)
+	c.UDPConn, err = socks5.DialUDP("udp", src, relay)
+	if err != nil {
+		c.TCPConn.Close()
+		return nil, err
+	}
+	return c, nil
+}
 
-	})
+// Returns the address to send datagrams to. Proxies commonly reply to UDP
+// ASSOCIATE with an unspecified address like 0.0.0.0, meaning the relay is
+// on the same host as the proxy itself.
+func socks5UDPRelay(server, relay string) (string, error) {
+	host, port, err := net.SplitHostPort(relay)
+	if err != nil {
+		return "", fmt.Errorf("invalid socks5 udp relay address %q: %w", relay, err)
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsUnspecified() {
+		return relay, nil
+	}
+	serverHost, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return "", fmt.Errorf("invalid socks5 server address %q: %w", server, err)
+	}
+	return net.JoinHostPort(serverHost, port), nil
+}
 
-	if d.opt.LocalAddr != nil {
-		return d.Client.DialWithLocalAddr(network, d.opt.LocalAddr.String(), d.addr, nil)
+// proxiedCache holds what a client keeps per SOCKS5 proxy, like pipelines with
+// open connections, by the key of the dialer. An entry is closed and removed
+// when the dialer it was created for is closed, or when the cache is closed.
+type proxiedCache[T comparable] struct {
+	close func(T)
+
+	mu      sync.Mutex
+	entries map[string]T
+	stop    chan struct{}
+}
+
+func newProxiedCache[T comparable](close func(T)) *proxiedCache[T] {
+	return &proxiedCache[T]{
+		close:   close,
+		entries: make(map[string]T),
+		stop:    make(chan struct{}),
+	}
+}
+
+// Returns the entry for a dialer, creating it if there is none.
+func (c *proxiedCache[T]) get(dialer *Socks5Dialer, create func() (T, error)) (T, error) {
+	key := dialer.key()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, ok := c.entries[key]; ok {
+		return v, nil
+	}
+	v, err := create()
+	if err != nil {
+		return v, err
+	}
+	c.entries[key] = v
+	go func() {
+		select {
+		case <-dialer.done():
+		case <-c.stop:
+			return
+		}
+		c.mu.Lock()
+		current, ok := c.entries[key]
+		if ok && current == v {
+			delete(c.entries, key)
+		}
+		c.mu.Unlock()
+		if ok && current == v {
+			c.close(v)
+		}
+	}()
+	return v, nil
+}
+
+// Closes all entries. The cache isn't used anymore afterwards.
+func (c *proxiedCache[T]) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.stop:
+		return
+	default:
+		close(c.stop)
+	}
+	for key, v := range c.entries {
+		delete(c.entries, key)
+		c.close(v)
 	}
-	return d.Client.Dial(network, d.addr)
 }
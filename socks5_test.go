@@ -0,0 +1,182 @@
+package rdns
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"github.com/txthinking/socks5"
+)
+
+func TestSocks5DialerUDP(t *testing.T) {
+	upstream := new(TestResolver)
+
+	// Plain UDP DNS server behind the proxy
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	s := NewDNSListener("test-ln", addr, "udp", ListenOptions{}, upstream)
+	go func() {
+		err := s.Start()
+		require.NoError(t, err)
+	}()
+	defer s.Stop()
+
+	// SOCKS5 proxy supporting UDP ASSOCIATE
+	proxyAddr, err := getLnAddress()
+	require.NoError(t, err)
+	proxy, err := socks5.NewClassicServer(proxyAddr, "127.0.0.1", "", "", 0, 60)
+	require.NoError(t, err)
+	go proxy.ListenAndServe(nil)
+	defer proxy.Shutdown()
+	time.Sleep(time.Second)
+
+	// The dialer is passed along with the query, like the panel does
+	c, err := NewDNSClient("test-dns", addr, "udp", DNSClientOptions{})
+	require.NoError(t, err)
+	ci := ClientInfo{Dialer: NewSocks5Dialer(proxyAddr, Socks5DialerOptions{})}
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	for i := 0; i < 3; i++ {
+		_, err = c.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 3, upstream.HitCount())
+}
+
+func TestSocks5UDPRelay(t *testing.T) {
+	relay, err := socks5UDPRelay("10.0.0.1:1080", "0.0.0.0:4000")
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.1:4000", relay)
+
+	relay, err = socks5UDPRelay("10.0.0.1:1080", "10.0.0.2:4000")
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.2:4000", relay)
+}
+
+func TestSocks5DialerDoH(t *testing.T) {
+	upstream := new(TestResolver)
+
+	// DoH server behind the proxy
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	s, err := NewDoHListener("test-ln", addr, DoHListenerOptions{TLSConfig: tlsServerConfig}, upstream)
+	require.NoError(t, err)
+	go func() { _ = s.Start() }()
+	defer s.Stop()
+
+	proxyAddr, err := getLnAddress()
+	require.NoError(t, err)
+	proxy, err := socks5.NewClassicServer(proxyAddr, "127.0.0.1", "", "", 0, 60)
+	require.NoError(t, err)
+	go proxy.ListenAndServe(nil)
+	defer proxy.Shutdown()
+	time.Sleep(time.Second)
+
+	tlsClientConfig, err := TLSClientConfig("testdata/ca.crt", "", "", "")
+	require.NoError(t, err)
+	ci := ClientInfo{Dialer: NewSocks5Dialer(proxyAddr, Socks5DialerOptions{})}
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	for _, method := range []string{"POST", "GET"} {
+		c, err := NewDoHClient("test-doh", "https://"+addr+"/dns-query{?dns}", DoHClientOptions{TLSConfig: tlsClientConfig, Method: method})
+		require.NoError(t, err)
+		transport := c.client.Transport
+		for i := 0; i < 2; i++ {
+			_, err = c.Resolve(q, ci)
+			require.NoError(t, err)
+		}
+
+		// The client's own transport is left alone
+		require.Equal(t, transport, c.client.Transport)
+		_, ok := c.proxied.entries[ci.Dialer.key()]
+		require.True(t, ok)
+	}
+	require.Equal(t, 4, upstream.HitCount())
+}
+
+func TestSocks5DialerDoT(t *testing.T) {
+	upstream := new(TestResolver)
+
+	// DoT server behind the proxy
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	s := NewDoTListener("test-ln", addr, DoTListenerOptions{TLSConfig: tlsServerConfig}, upstream)
+	go func() { _ = s.Start() }()
+	defer s.Stop()
+
+	proxyAddr, err := getLnAddress()
+	require.NoError(t, err)
+	proxy, err := socks5.NewClassicServer(proxyAddr, "127.0.0.1", "", "", 0, 60)
+	require.NoError(t, err)
+	go proxy.ListenAndServe(nil)
+	defer proxy.Shutdown()
+	time.Sleep(time.Second)
+
+	tlsClientConfig, err := TLSClientConfig("testdata/ca.crt", "", "", "")
+	require.NoError(t, err)
+	c, err := NewDoTClient("test-dot", addr, DoTClientOptions{TLSConfig: tlsClientConfig})
+	require.NoError(t, err)
+	defer c.Close()
+	ci := ClientInfo{Dialer: NewSocks5Dialer(proxyAddr, Socks5DialerOptions{})}
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Queries through the same proxy share a pipeline
+	_, err = c.Resolve(q, ci)
+	require.NoError(t, err)
+	p := c.proxiedPipeline(ci.Dialer)
+	_, err = c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Same(t, p, c.proxiedPipeline(ci.Dialer))
+	require.Equal(t, 2, upstream.HitCount())
+}
+
+func TestProxiedCache(t *testing.T) {
+	type entry struct{ closed bool }
+	var mu sync.Mutex
+	isClosed := func(e *entry) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return e.closed
+	}
+	c := newProxiedCache(func(e *entry) {
+		mu.Lock()
+		e.closed = true
+		mu.Unlock()
+	})
+	get := func(d *Socks5Dialer) *entry {
+		e, err := c.get(d, func() (*entry, error) { return new(entry), nil })
+		require.NoError(t, err)
+		return e
+	}
+
+	// Dialers for the same proxy share an entry, other proxies or credentials
+	// get their own
+	opt := Socks5DialerOptions{Username: "user", Password: "pass"}
+	d1 := NewSocks5Dialer("127.0.0.1:1080", opt)
+	e1 := get(d1)
+	require.Same(t, e1, get(NewSocks5Dialer("127.0.0.1:1080", opt)))
+	d2 := NewSocks5Dialer("127.0.0.1:1081", opt)
+	e2 := get(d2)
+	require.NotSame(t, e1, e2)
+	e3 := get(NewSocks5Dialer("127.0.0.1:1080", Socks5DialerOptions{Username: "other", Password: "pass"}))
+	require.NotSame(t, e1, e3)
+
+	// The entry is closed along with the dialer it was created for and a new
+	// one is created for the next dialer
+	d1.Close()
+	require.Eventually(t, func() bool { return isClosed(e1) }, time.Second, 10*time.Millisecond)
+	require.NotSame(t, e1, get(NewSocks5Dialer("127.0.0.1:1080", opt)))
+	require.False(t, isClosed(e2))
+
+	// Closing the cache closes all entries
+	c.Close()
+	require.True(t, isClosed(e2))
+	require.True(t, isClosed(e3))
+}
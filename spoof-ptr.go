@@ -0,0 +1,139 @@
+package rdns
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// SpoofPTROptions holds options for answering reverse lookups of IPs used in
+// spoofed responses, and of private address space, locally.
+type SpoofPTROptions struct {
+	// Name to respond with to PTR queries for IPs that are used in spoofed
+	// responses, like "blocked.example.org". Disabled if empty.
+	Name string
+
+	// Answer queries for reverse zones of private IPv4 (RFC 1918) and unique
+	// local IPv6 (fc00::/7) addresses with NXDOMAIN rather than forwarding
+	// them upstream.
+	LocalPrivate bool
+}
+
+// Reverse zones of private address space.
+var privateReverseZones = func() []string {
+	zones := []string{"10.in-addr.arpa.", "168.192.in-addr.arpa.", "c.f.ip6.arpa.", "d.f.ip6.arpa."}
+	for i := 16; i <= 31; i++ {
+		zones = append(zones, strconv.Itoa(i)+".172.in-addr.arpa.")
+	}
+	return zones
+}()
+
+// Maximum number of spoofed IPs that are remembered.
+const maxSpoofPTRIPs = 1024
+
+// Answers reverse lookups for the IPs blocklists spoofed responses with.
+type spoofPTR struct {
+	SpoofPTROptions
+
+	mu  sync.RWMutex
+	ips map[string]struct{}
+}
+
+func newSpoofPTR(opt SpoofPTROptions) *spoofPTR {
+	return &spoofPTR{
+		SpoofPTROptions: opt,
+		ips:             make(map[string]struct{}),
+	}
+}
+
+// Records the IPs used in a spoofed response.
+func (p *spoofPTR) add(rrs []dns.RR) {
+	if p.Name == "" {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, rr := range rrs {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		if len(p.ips) >= maxSpoofPTRIPs {
+			return
+		}
+		p.ips[ip.String()] = struct{}{}
+	}
+}
+
+// Returns a local response to a query for a spoofed IP or a private reverse
+// zone, given the IPs that are always spoofed in addition to those recorded.
+func (p *spoofPTR) answer(q *dns.Msg, spoofed []net.IP) (*dns.Msg, bool) {
+	question := q.Question[0]
+	if p.Name != "" && question.Qtype == dns.TypePTR {
+		if ip := ptrIP(question.Name); ip != nil && p.spoofed(ip, spoofed) {
+			return ptr(q, []string{p.Name}), true
+		}
+	}
+	if p.LocalPrivate {
+		for _, zone := range privateReverseZones {
+			if dns.IsSubDomain(zone, strings.ToLower(question.Name)) {
+				return nxdomain(q), true
+			}
+		}
+	}
+	return nil, false
+}
+
+func (p *spoofPTR) spoofed(ip net.IP, spoofed []net.IP) bool {
+	for _, s := range spoofed {
+		if s.Equal(ip) {
+			return true
+		}
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	_, ok := p.ips[ip.String()]
+	return ok
+}
+
+// Returns the IP of a reverse lookup name like "1.0.0.127.in-addr.arpa." or
+// nil if the name isn't the reverse name of a full address.
+func ptrIP(name string) net.IP {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if s, ok := strings.CutSuffix(name, ".in-addr.arpa"); ok {
+		parts := strings.Split(s, ".")
+		if len(parts) != 4 {
+			return nil
+		}
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+		return net.ParseIP(strings.Join(parts, ".")).To4()
+	}
+	if s, ok := strings.CutSuffix(name, ".ip6.arpa"); ok {
+		nibbles := strings.Split(s, ".")
+		if len(nibbles) != 32 {
+			return nil
+		}
+		var b strings.Builder
+		for i := len(nibbles) - 1; i >= 0; i-- {
+			if len(nibbles[i]) != 1 {
+				return nil
+			}
+			b.WriteString(nibbles[i])
+			if i%4 == 0 && i > 0 {
+				b.WriteByte(':')
+			}
+		}
+		return net.ParseIP(b.String())
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPTRIP(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   net.IP
+	}{
+		{"1.2.0.192.in-addr.arpa.", net.ParseIP("192.0.2.1")},
+		{"1.2.0.192.IN-ADDR.ARPA.", net.ParseIP("192.0.2.1")},
+		{"2.0.192.in-addr.arpa.", nil},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", net.ParseIP("2001:db8::1")},
+		{"example.com.", nil},
+	}
+	for _, test := range tests {
+		ip := ptrIP(test.name)
+		if test.ip == nil {
+			require.Nil(t, ip, test.name)
+			continue
+		}
+		require.True(t, test.ip.Equal(ip), test.name)
+	}
+}
+
+func TestBlocklistSpoofPTR(t *testing.T) {
+	var ci ClientInfo
+	upstream := new(TestResolver)
+	db, err := NewHostsDB("testlist", NewStaticLoader([]string{"192.0.2.1 ads.test"}))
+	require.NoError(t, err)
+	b, err := NewBlocklist("test-bl-spoof-ptr", upstream, BlocklistOptions{
+		BlocklistDB: db,
+		SpoofPTR: SpoofPTROptions{
+			Name:         "blocked.example.org",
+			LocalPrivate: true,
+		},
+	})
+	require.NoError(t, err)
+
+	resolve := func(name string, qtype uint16) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		a, err := b.Resolve(q, ci)
+		require.NoError(t, err)
+		return a
+	}
+
+	// Reverse lookup of the spoofed IP returns the configured name
+	a := resolve("ads.test.", dns.TypeA)
+	require.Len(t, a.Answer, 1)
+	a = resolve("1.2.0.192.in-addr.arpa.", dns.TypePTR)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "blocked.example.org.", a.Answer[0].(*dns.PTR).Ptr)
+
+	// Private address space is answered locally
+	a = resolve("1.1.168.192.in-addr.arpa.", dns.TypePTR)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	a = resolve("1.0.20.172.in-addr.arpa.", dns.TypePTR)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Equal(t, 0, upstream.HitCount())
+
+	// Everything else is forwarded
+	resolve("1.0.32.172.in-addr.arpa.", dns.TypePTR)
+	require.Equal(t, 1, upstream.HitCount())
+}
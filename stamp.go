@@ -0,0 +1,289 @@
+package rdns
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// StampProtocol is the protocol of a server in a DNS stamp.
+type StampProtocol byte
+
+// Protocols in DNS stamps, https://dnscrypt.info/stamps-specifications
+const (
+	StampPlain         StampProtocol = 0x00
+	StampDNSCrypt      StampProtocol = 0x01
+	StampDoH           StampProtocol = 0x02
+	StampDoT           StampProtocol = 0x03
+	StampDoQ           StampProtocol = 0x04
+	StampODoHTarget    StampProtocol = 0x05
+	StampDNSCryptRelay StampProtocol = 0x81
+	StampODoHRelay     StampProtocol = 0x85
+)
+
+func (p StampProtocol) String() string {
+	switch p {
+	case StampPlain:
+		return "plain"
+	case StampDNSCrypt:
+		return "dnscrypt"
+	case StampDoH:
+		return "doh"
+	case StampDoT:
+		return "dot"
+	case StampDoQ:
+		return "doq"
+	case StampODoHTarget:
+		return "odoh"
+	case StampDNSCryptRelay:
+		return "dnscrypt-relay"
+	case StampODoHRelay:
+		return "odoh-relay"
+	}
+	return fmt.Sprintf("unknown(%d)", byte(p))
+}
+
+// StampProps are the informal properties a server announces in its stamp.
+type StampProps uint64
+
+const (
+	StampDNSSEC   StampProps = 1 << 0
+	StampNoLog    StampProps = 1 << 1
+	StampNoFilter StampProps = 1 << 2
+)
+
+// ServerStamp holds the decoded content of a DNS stamp (sdns://) describing an
+// upstream server.
+type ServerStamp struct {
+	Protocol StampProtocol
+	Props    StampProps
+
+	// IP address of the server with optional port. Can be empty for DoH, DoT
+	// and DoQ servers, in which case the host name is resolved.
+	Address string
+
+	// SHA256 hashes of the TBS certificates, one of which has to be in the
+	// certificate chain of the server.
+	Hashes [][]byte
+
+	// Host name of DoH, DoT and DoQ servers with optional port, or provider
+	// name of DNSCrypt servers.
+	ProviderName string
+
+	// Path of DoH servers.
+	Path string
+
+	// Public key of DNSCrypt servers.
+	PublicKey []byte
+
+	// Addresses to resolve the host name with, for DoH, DoT and DoQ servers.
+	BootstrapIPs []string
+}
+
+const stampPrefix = "sdns://"
+
+// IsStamp returns true if the address is a DNS stamp.
+func IsStamp(addr string) bool {
+	return strings.HasPrefix(addr, stampPrefix)
+}
+
+// ParseStamp decodes a DNS stamp as defined in
+// https://dnscrypt.info/stamps-specifications.
+func ParseStamp(s string) (ServerStamp, error) {
+	var stamp ServerStamp
+	if !IsStamp(s) {
+		return stamp, errors.New("stamp doesn't start with sdns://")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s[len(stampPrefix):], "="))
+	if err != nil {
+		return stamp, fmt.Errorf("invalid stamp encoding: %w", err)
+	}
+	if len(b) < 1 {
+		return stamp, errors.New("empty stamp")
+	}
+	stamp.Protocol = StampProtocol(b[0])
+	r := &stampReader{b: b[1:]}
+
+	switch stamp.Protocol {
+	case StampPlain:
+		stamp.Props = r.props()
+		stamp.Address = r.lp()
+	case StampDNSCrypt:
+		stamp.Props = r.props()
+		stamp.Address = r.lp()
+		stamp.PublicKey = []byte(r.lp())
+		stamp.ProviderName = r.lp()
+	case StampDoH:
+		stamp.Props = r.props()
+		stamp.Address = r.lp()
+		stamp.Hashes = r.hashes()
+		stamp.ProviderName = r.lp()
+		stamp.Path = r.lp()
+		if !r.empty() {
+			stamp.BootstrapIPs = r.vlp()
+		}
+	case StampDoT, StampDoQ:
+		stamp.Props = r.props()
+		stamp.Address = r.lp()
+		stamp.Hashes = r.hashes()
+		stamp.ProviderName = r.lp()
+		if !r.empty() {
+			stamp.BootstrapIPs = r.vlp()
+		}
+	default:
+		return stamp, fmt.Errorf("unsupported stamp protocol %s", stamp.Protocol)
+	}
+	if r.err != nil {
+		return stamp, fmt.Errorf("invalid %s stamp: %w", stamp.Protocol, r.err)
+	}
+	if !r.empty() {
+		return stamp, fmt.Errorf("invalid %s stamp: trailing data", stamp.Protocol)
+	}
+	return stamp, nil
+}
+
+// Reads the fields of a stamp, remembering the first error.
+type stampReader struct {
+	b   []byte
+	err error
+}
+
+func (r *stampReader) empty() bool {
+	return len(r.b) == 0
+}
+
+func (r *stampReader) props() StampProps {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.b) < 8 {
+		r.err = errors.New("short properties")
+		return 0
+	}
+	p := binary.LittleEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return StampProps(p)
+}
+
+// Reads a length-prefixed string.
+func (r *stampReader) lp() string {
+	s, _ := r.next()
+	return string(s)
+}
+
+// Reads a set of length-prefixed values, where the high bit of the length
+// marks that more values follow.
+func (r *stampReader) vlp() []string {
+	var values []string
+	for r.err == nil {
+		v, more := r.next()
+		values = append(values, string(v))
+		if !more {
+			break
+		}
+	}
+	return values
+}
+
+// Reads the certificate hashes, which may be a single empty value.
+func (r *stampReader) hashes() [][]byte {
+	var hashes [][]byte
+	for _, h := range r.vlp() {
+		if len(h) == 0 {
+			continue
+		}
+		if len(h) != sha256.Size {
+			r.err = errors.New("invalid certificate hash length")
+			return nil
+		}
+		hashes = append(hashes, []byte(h))
+	}
+	return hashes
+}
+
+func (r *stampReader) next() ([]byte, bool) {
+	if r.err != nil {
+		return nil, false
+	}
+	if len(r.b) < 1 {
+		r.err = errors.New("short stamp")
+		return nil, false
+	}
+	n := int(r.b[0] & 0x7f)
+	more := r.b[0]&0x80 != 0
+	if len(r.b) < 1+n {
+		r.err = errors.New("short stamp")
+		return nil, false
+	}
+	v := r.b[1 : 1+n]
+	r.b = r.b[1+n:]
+	return v, more
+}
+
+// StampVerifyConnection returns a function for tls.Config.VerifyConnection that
+// checks that one of the certificates presented by the server has a TBS
+// certificate matching one of the hashes in a stamp. This is done in addition
+// to the regular certificate validation.
+func StampVerifyConnection(hashes [][]byte) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		for _, cert := range cs.PeerCertificates {
+			h := sha256.Sum256(cert.RawTBSCertificate)
+			for _, hash := range hashes {
+				if bytes.Equal(h[:], hash) {
+					return nil
+				}
+			}
+		}
+		return errors.New("no certificate of the server matches the hashes in the stamp")
+	}
+}
+
+// Returns the host and port of a stamp address, using the default port if
+// none is given. IPv6 addresses can be given with or without brackets.
+func stampHostPort(addr, defaultPort string) (string, string) {
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		return host, port
+	}
+	return strings.Trim(addr, "[]"), defaultPort
+}
+
+// Endpoint returns the address to use for a resolver of the protocol in the
+// stamp, and the IP to connect to if it's not in the address. DoH endpoints are
+// returned as URL.
+func (s ServerStamp) Endpoint() (address string, bootstrapAddr string, err error) {
+	switch s.Protocol {
+	case StampPlain:
+		host, port := stampHostPort(s.Address, PlainDNSPort)
+		return net.JoinHostPort(host, port), "", nil
+	case StampDoT, StampDoQ, StampDoH:
+	default:
+		return "", "", fmt.Errorf("unsupported stamp protocol %s", s.Protocol)
+	}
+	if s.ProviderName == "" {
+		return "", "", fmt.Errorf("no host name in %s stamp", s.Protocol)
+	}
+	// DoQ uses port 853 as well in stamps, as in RFC 9250
+	defaultPort := DoTPort
+	if s.Protocol == StampDoH {
+		defaultPort = DoHPort
+	}
+	ip, addrPort := stampHostPort(s.Address, defaultPort)
+	host, port := stampHostPort(s.ProviderName, addrPort)
+	if ip == "" && len(s.BootstrapIPs) > 0 {
+		ip, _ = stampHostPort(s.BootstrapIPs[0], "")
+	}
+	if s.Protocol == StampDoH {
+		u := "https://" + host
+		if port != DoHPort {
+			u = "https://" + net.JoinHostPort(host, port)
+		}
+		return u + s.Path, ip, nil
+	}
+	return net.JoinHostPort(host, port), ip, nil
+}
@@ -0,0 +1,100 @@
+package rdns
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStamp(t *testing.T) {
+	// Encodes a stamp from the protocol, properties and length-prefixed fields
+	stamp := func(protocol byte, props byte, fields ...[]byte) string {
+		b := []byte{protocol, props, 0, 0, 0, 0, 0, 0, 0}
+		for _, f := range fields {
+			b = append(b, f...)
+		}
+		return "sdns://" + base64.RawURLEncoding.EncodeToString(b)
+	}
+	lp := func(s string) []byte { return append([]byte{byte(len(s))}, s...) }
+	hash := sha256.Sum256([]byte("test"))
+
+	tests := map[string]struct {
+		stamp     string
+		protocol  StampProtocol
+		props     StampProps
+		address   string
+		bootstrap string
+		hashes    int
+	}{
+		"doh": {
+			stamp:     "sdns://AgcAAAAAAAAABzEuMC4wLjEAEmRucy5jbG91ZGZsYXJlLmNvbQovZG5zLXF1ZXJ5",
+			protocol:  StampDoH,
+			props:     StampDNSSEC | StampNoLog | StampNoFilter,
+			address:   "https://dns.cloudflare.com/dns-query",
+			bootstrap: "1.0.0.1",
+		},
+		"plain": {
+			stamp:    stamp(0x00, 0x01, lp("9.9.9.9")),
+			protocol: StampPlain,
+			props:    StampDNSSEC,
+			address:  "9.9.9.9:53",
+		},
+		"plain-ipv6": {
+			stamp:    stamp(0x00, 0x00, lp("[2620:fe::fe]:5353")),
+			protocol: StampPlain,
+			address:  "[2620:fe::fe]:5353",
+		},
+		"dot": {
+			stamp:     stamp(0x03, 0x00, lp("1.1.1.1:8853"), append([]byte{32}, hash[:]...), lp("one.one.one.one")),
+			protocol:  StampDoT,
+			address:   "one.one.one.one:8853",
+			bootstrap: "1.1.1.1",
+			hashes:    1,
+		},
+		"doq-bootstrap": {
+			stamp:     stamp(0x04, 0x00, lp(""), lp(""), lp("dns.adguard-dns.com"), lp("94.140.14.14")),
+			protocol:  StampDoQ,
+			address:   "dns.adguard-dns.com:853",
+			bootstrap: "94.140.14.14",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			s, err := ParseStamp(test.stamp)
+			require.NoError(t, err)
+			require.Equal(t, test.protocol, s.Protocol)
+			require.Equal(t, test.props, s.Props)
+			require.Len(t, s.Hashes, test.hashes)
+			address, bootstrap, err := s.Endpoint()
+			require.NoError(t, err)
+			require.Equal(t, test.address, address)
+			require.Equal(t, test.bootstrap, bootstrap)
+		})
+	}
+
+	// Invalid and unsupported stamps
+	_, err := ParseStamp("sdns://AgcAAAAAAAAABzEuMC4wLjEAEmRucy5jbG91ZGZsYXJl")
+	require.Error(t, err)
+	_, err = ParseStamp(stamp(0x03, 0x00, lp("1.1.1.1"), lp("short"), lp("one.one.one.one")))
+	require.Error(t, err)
+	_, err = ParseStamp(stamp(0x05, 0x00, lp("odoh.example.com")))
+	require.Error(t, err)
+	s, err := ParseStamp(stamp(0x01, 0x00, lp("1.1.1.1"), lp("key"), lp("2.dnscrypt-cert.example.com")))
+	require.NoError(t, err)
+	_, _, err = s.Endpoint()
+	require.Error(t, err)
+}
+
+func TestStampVerifyConnection(t *testing.T) {
+	cert := &x509.Certificate{RawTBSCertificate: []byte("test")}
+	hash := sha256.Sum256(cert.RawTBSCertificate)
+	other := sha256.Sum256([]byte("other"))
+	cs := tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+
+	require.NoError(t, StampVerifyConnection([][]byte{other[:], hash[:]})(cs))
+	require.Error(t, StampVerifyConnection([][]byte{other[:]})(cs))
+}
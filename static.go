@@ -1,6 +1,15 @@
 package rdns
 
 import (
+	"expvar"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+
 	"github.com/miekg/dns"
 )
 
@@ -9,12 +18,30 @@ import (
 // with a router when building a walled garden.
 type StaticResolver struct {
 	id           string
-	answer       []dns.RR
+	answer       staticAnswer
 	ns           []dns.RR
 	extra        []dns.RR
 	edns0Options []dns.EDNS0
 	rcode        int
 	truncate     bool
+
+	// Answers by country or continent code
+	geoAnswers map[string]staticAnswer
+	geoLookup  GeoLookupFunc
+	geoMetric  *expvar.Map
+
+	answerOrder AnswerOrder
+	answerCount int
+	rotation    atomic.Uint64
+
+	// Probes the addresses in answers, optional
+	backends *BackendChecker
+}
+
+// Answer records with their weights for AnswerOrderWeighted.
+type staticAnswer struct {
+	rrs     []dns.RR
+	weights []int
 }
 
 var _ Resolver = &StaticResolver{}
@@ -27,18 +54,82 @@ type StaticResolverOptions struct {
 	EDNS0Options []dns.EDNS0
 	RCode        int
 	Truncate     bool
+
+	// Alternative answers for clients in some locations, for example to
+	// point them to the closest instance of a service. The location is looked
+	// up with the address in the EDNS0 Client Subnet option of the query if
+	// present, or the client IP otherwise. Clients in other locations get
+	// Answer.
+	GeoAnswers []GeoAnswer
+
+	// Location lookup for GeoAnswers.
+	GeoLookup GeoLookupFunc
+
+	// Order of the A and AAAA records in answers, to spread clients over
+	// several instances of a service. Defaults to the configured order, or
+	// AnswerOrderWeighted if weights are given.
+	AnswerOrder AnswerOrder
+
+	// Weights of the A and AAAA records in Answer, in the same order, used
+	// with AnswerOrderWeighted. Records with weight 0 are never returned.
+	// All records have the same weight if empty.
+	AnswerWeights []int
+
+	// Maximum number of A and AAAA records in an answer, after ordering them.
+	// Default 0 returns all of them.
+	AnswerCount int
+
+	// Probe the backends at the addresses of the A and AAAA records in all
+	// answers, and leave out those that are unhealthy. If all backends in an
+	// answer are unhealthy, they're all returned since there's nothing better
+	// to send clients to. Optional.
+	BackendCheck *BackendCheckOptions
+}
+
+// AnswerOrder defines how the A and AAAA records of a static answer are
+// ordered in responses.
+type AnswerOrder string
+
+const (
+	AnswerOrderFixed      AnswerOrder = ""            // As configured
+	AnswerOrderRoundRobin AnswerOrder = "round-robin" // Rotated by one record with every query
+	AnswerOrderRandom     AnswerOrder = "random"      // Shuffled
+	AnswerOrderWeighted   AnswerOrder = "weighted"    // Random, with records of higher weight more likely to come first
+)
+
+// GeoAnswer holds the answer records for clients in a set of locations.
+type GeoAnswer struct {
+	// ISO 3166-1 country codes like "DE", or continent codes like "EU".
+	// Countries take precedence over continents.
+	Locations []string
+
+	// Records in zone-file format
+	Answer []string
+
+	// Weights of the A and AAAA records in Answer, like AnswerWeights.
+	Weights []int
 }
 
 // NewStaticResolver returns a new instance of a StaticResolver resolver.
 func NewStaticResolver(id string, opt StaticResolverOptions) (*StaticResolver, error) {
 	r := &StaticResolver{id: id}
 
-	for _, record := range opt.Answer {
-		rr, err := dns.NewRR(record)
-		if err != nil {
-			return nil, err
+	switch opt.AnswerOrder {
+	case AnswerOrderFixed:
+		if len(opt.AnswerWeights) > 0 {
+			opt.AnswerOrder = AnswerOrderWeighted
 		}
-		r.answer = append(r.answer, rr)
+	case AnswerOrderRoundRobin, AnswerOrderRandom, AnswerOrderWeighted:
+	default:
+		return nil, fmt.Errorf("unsupported answer order '%s'", opt.AnswerOrder)
+	}
+	r.answerOrder = opt.AnswerOrder
+	r.answerCount = opt.AnswerCount
+
+	var err error
+	r.answer, err = newStaticAnswer(opt.Answer, opt.AnswerWeights)
+	if err != nil {
+		return nil, err
 	}
 	for _, record := range opt.NS {
 		rr, err := dns.NewRR(record)
@@ -58,30 +149,73 @@ func NewStaticResolver(id string, opt StaticResolverOptions) (*StaticResolver, e
 	r.edns0Options = opt.EDNS0Options
 	r.truncate = opt.Truncate
 
+	if len(opt.GeoAnswers) > 0 {
+		if opt.GeoLookup == nil {
+			return nil, fmt.Errorf("no location lookup for geo answers in '%s'", id)
+		}
+		r.geoLookup = opt.GeoLookup
+		r.geoMetric = getVarMap("static-responder", id, "geo")
+		r.geoAnswers = make(map[string]staticAnswer)
+		for _, geo := range opt.GeoAnswers {
+			answer, err := newStaticAnswer(geo.Answer, geo.Weights)
+			if err != nil {
+				return nil, err
+			}
+			for _, location := range geo.Locations {
+				location = strings.ToUpper(location)
+				if _, ok := r.geoAnswers[location]; ok {
+					return nil, fmt.Errorf("location '%s' used in more than one geo answer", location)
+				}
+				r.geoAnswers[location] = answer
+			}
+		}
+	}
+
+	if opt.BackendCheck != nil {
+		answers := []staticAnswer{r.answer}
+		for _, answer := range r.geoAnswers {
+			answers = append(answers, answer)
+		}
+		var ips []net.IP
+		for _, answer := range answers {
+			for _, rr := range answer.rrs {
+				if ip := addressRecordIP(rr); ip != nil {
+					ips = append(ips, ip)
+				}
+			}
+		}
+		r.backends, err = NewBackendChecker(id, ips, *opt.BackendCheck)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return r, nil
 }
 
 // Resolve a DNS query by returning a fixed response.
-func (r *StaticResolver) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dialer) (*dns.Msg, error) {
+func (r *StaticResolver) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	answer := new(dns.Msg)
 	answer.SetReply(q)
 
-	// Update the name of every answer record to match that of the query
-	answer.Answer = make([]dns.RR, 0, len(r.answer))
-	for _, rr := range r.answer {
-		r := dns.Copy(rr)
-		r.Header().Name = qName(q)
-		answer.Answer = append(answer.Answer, r)
+	records := r.answer
+	var ecs *dns.EDNS0_SUBNET
+	if r.geoAnswers != nil {
+		records, ecs = r.geoAnswer(q, ci)
 	}
+	answer.Answer = r.answerRecords(q, records)
 	answer.Ns = r.ns
 	answer.Extra = r.extra
 	answer.Rcode = r.rcode
 	answer.Truncated = r.truncate
 
-	if len(r.edns0Options) > 0 {
+	if len(r.edns0Options) > 0 || ecs != nil {
 		answer.SetEdns0(4096, false)
 		opt := answer.IsEdns0()
 		opt.Option = append(opt.Option, r.edns0Options...)
+		if ecs != nil {
+			opt.Option = append(opt.Option, ecs)
+		}
 	}
 
 	logger(r.id, q, ci).WithField("truncated", r.truncate).Debug("responding")
@@ -93,7 +227,206 @@ func (r *StaticResolver) String() string {
 	return r.id
 }
 
+// Close stops the health checks of the backends, if any.
+func (r *StaticResolver) Close() error {
+	if r.backends != nil {
+		return r.backends.Close()
+	}
+	return nil
+}
+
 // Check Cert
 func (s *StaticResolver) CertMonitor() error {
 	return nil
-}
\ No newline at end of file
+}
+
+// Returns the answer records for the location of the client. If the query
+// has an EDNS0 Client Subnet option, it's used for the location and returned
+// with the scope set to be included in the response as per RFC 7871.
+func (r *StaticResolver) geoAnswer(q *dns.Msg, ci ClientInfo) (staticAnswer, *dns.EDNS0_SUBNET) {
+	ip := ci.SourceIP
+	var ecs *dns.EDNS0_SUBNET
+	if edns0 := q.IsEdns0(); edns0 != nil {
+		for _, opt := range edns0.Option {
+			if subnet, ok := opt.(*dns.EDNS0_SUBNET); ok {
+				ecs = &dns.EDNS0_SUBNET{
+					Code:          dns.EDNS0SUBNET,
+					Family:        subnet.Family,
+					SourceNetmask: subnet.SourceNetmask,
+					SourceScope:   subnet.SourceNetmask,
+					Address:       subnet.Address,
+				}
+				// A source prefix of 0 means the client doesn't want its
+				// subnet to be used
+				if subnet.SourceNetmask > 0 {
+					ip = subnet.Address
+				}
+				break
+			}
+		}
+	}
+	log := logger(r.id, q, ci).WithField("ip", ip)
+	if ip == nil || ip.IsUnspecified() || ip.IsPrivate() || ip.IsLoopback() {
+		r.geoMetric.Add("default", 1)
+		return r.answer, ecs
+	}
+	location, err := r.geoLookup(ip)
+	if err != nil {
+		log.WithError(err).Error("failed to lookup ip in geo location database")
+		r.geoMetric.Add("default", 1)
+		return r.answer, ecs
+	}
+	for _, code := range []string{location.Country, location.Continent} {
+		if answer, ok := r.geoAnswers[code]; ok && code != "" {
+			log.WithField("location", code).Debug("using geo answer")
+			r.geoMetric.Add(code, 1)
+			return answer, ecs
+		}
+	}
+	r.geoMetric.Add("default", 1)
+	return r.answer, ecs
+}
+
+// Parses answer records in zone-file format, with the weights of the A and
+// AAAA records among them.
+func newStaticAnswer(records []string, weights []int) (staticAnswer, error) {
+	var answer staticAnswer
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			return answer, err
+		}
+		answer.rrs = append(answer.rrs, rr)
+	}
+	if len(weights) == 0 {
+		return answer, nil
+	}
+	var addrs int
+	for _, rr := range answer.rrs {
+		if isAddressRecord(rr) {
+			addrs++
+		}
+	}
+	if len(weights) != addrs {
+		return answer, fmt.Errorf("got %d weights for %d address records", len(weights), addrs)
+	}
+	for _, w := range weights {
+		if w < 0 {
+			return answer, fmt.Errorf("invalid weight %d", w)
+		}
+	}
+	answer.weights = weights
+	return answer, nil
+}
+
+// Returns copies of the answer records with the name of the query. A and
+// AAAA records are ordered and limited as configured, and come after any
+// other records like CNAMEs.
+func (r *StaticResolver) answerRecords(q *dns.Msg, answer staticAnswer) []dns.RR {
+	if r.backends != nil {
+		answer = r.healthyAnswer(answer)
+	}
+	records := make([]dns.RR, 0, len(answer.rrs))
+	var addrs []dns.RR
+	var weights []int
+	for _, rr := range answer.rrs {
+		rr = dns.Copy(rr)
+		rr.Header().Name = qName(q)
+		if (r.answerOrder == AnswerOrderFixed && r.answerCount == 0) || !isAddressRecord(rr) {
+			records = append(records, rr)
+			continue
+		}
+		if answer.weights != nil {
+			weights = append(weights, answer.weights[len(addrs)])
+		}
+		addrs = append(addrs, rr)
+	}
+	if len(addrs) == 0 {
+		return records
+	}
+
+	switch r.answerOrder {
+	case AnswerOrderRoundRobin:
+		n := int((r.rotation.Add(1) - 1) % uint64(len(addrs)))
+		addrs = append(addrs[n:], addrs[:n]...)
+	case AnswerOrderRandom:
+		rand.Shuffle(len(addrs), func(i, j int) {
+			addrs[i], addrs[j] = addrs[j], addrs[i]
+		})
+	case AnswerOrderWeighted:
+		addrs = weightedOrder(addrs, weights)
+	}
+	if r.answerCount > 0 && len(addrs) > r.answerCount {
+		addrs = addrs[:r.answerCount]
+	}
+	return append(records, addrs...)
+}
+
+// Returns the records in random order, with records of higher weight more
+// likely to come first. Records with weight 0 are removed. Uses the algorithm
+// of Efraimidis and Spirakis, sorting by random keys of u^(1/weight).
+func weightedOrder(rrs []dns.RR, weights []int) []dns.RR {
+	type weighted struct {
+		rr  dns.RR
+		key float64
+	}
+	items := make([]weighted, 0, len(rrs))
+	for i, rr := range rrs {
+		w := 1
+		if weights != nil {
+			w = weights[i]
+		}
+		if w == 0 {
+			continue
+		}
+		items = append(items, weighted{rr: rr, key: math.Pow(rand.Float64(), 1/float64(w))})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].key > items[j].key })
+	out := rrs[:0]
+	for _, item := range items {
+		out = append(out, item.rr)
+	}
+	return out
+}
+
+// Returns the answer without the address records of unhealthy backends, or
+// unchanged if all of them are unhealthy.
+func (r *StaticResolver) healthyAnswer(answer staticAnswer) staticAnswer {
+	var healthy staticAnswer
+	var addrs, healthyAddrs int
+	for _, rr := range answer.rrs {
+		ip := addressRecordIP(rr)
+		if ip == nil {
+			healthy.rrs = append(healthy.rrs, rr)
+			continue
+		}
+		addrs++
+		if !r.backends.Healthy(ip) {
+			continue
+		}
+		healthy.rrs = append(healthy.rrs, rr)
+		if answer.weights != nil {
+			healthy.weights = append(healthy.weights, answer.weights[addrs-1])
+		}
+		healthyAddrs++
+	}
+	if healthyAddrs == 0 {
+		return answer
+	}
+	return healthy
+}
+
+func isAddressRecord(rr dns.RR) bool {
+	return addressRecordIP(rr) != nil
+}
+
+// Returns the IP of an A or AAAA record, nil for other records.
+func addressRecordIP(rr dns.RR) net.IP {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A
+	case *dns.AAAA:
+		return rr.AAAA
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package rdns
 
 import (
+	"net"
 	"testing"
 
 	"github.com/miekg/dns"
@@ -26,7 +27,7 @@ func TestStaticResolver(t *testing.T) {
 	q := new(dns.Msg)
 	q.SetQuestion("test.com.", dns.TypeA)
 
-	a, err := r.Resolve(q, ClientInfo{}, nil)
+	a, err := r.Resolve(q, ClientInfo{})
 	require.NoError(t, err)
 	require.Equal(t, len(opt.Answer), len(a.Answer))
 	require.Equal(t, len(opt.NS), len(a.Ns))
@@ -35,3 +36,107 @@ func TestStaticResolver(t *testing.T) {
 	require.Equal(t, "example.com.", a.Ns[0].Header().Name)
 	require.Equal(t, "ns1.example.com.", a.Extra[0].Header().Name)
 }
+
+func TestStaticResolverGeo(t *testing.T) {
+	locations := map[string]GeoLocation{
+		"192.0.2.1":    {Country: "DE", Continent: "EU"},
+		"192.0.2.2":    {Country: "FR", Continent: "EU"},
+		"198.51.100.1": {Country: "US", Continent: "NA"},
+	}
+	opt := StaticResolverOptions{
+		Answer: []string{"IN A 203.0.113.1"},
+		GeoAnswers: []GeoAnswer{
+			{Locations: []string{"de"}, Answer: []string{"IN A 203.0.113.10"}},
+			{Locations: []string{"EU"}, Answer: []string{"IN A 203.0.113.20"}},
+		},
+		GeoLookup: func(ip net.IP) (GeoLocation, error) {
+			return locations[ip.String()], nil
+		},
+	}
+	r, err := NewStaticResolver("test-static-geo", opt)
+	require.NoError(t, err)
+
+	resolve := func(q *dns.Msg, client string) string {
+		a, err := r.Resolve(q, ClientInfo{SourceIP: net.ParseIP(client)})
+		require.NoError(t, err)
+		require.Len(t, a.Answer, 1)
+		return a.Answer[0].(*dns.A).A.String()
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.com.", dns.TypeA)
+
+	// Countries are preferred over continents, anything else gets the default
+	require.Equal(t, "203.0.113.10", resolve(q, "192.0.2.1"))
+	require.Equal(t, "203.0.113.20", resolve(q, "192.0.2.2"))
+	require.Equal(t, "203.0.113.1", resolve(q, "198.51.100.1"))
+	require.Equal(t, "203.0.113.1", resolve(q, "10.0.0.1"))
+
+	// The client subnet is used if present, and returned with its scope
+	q.SetEdns0(4096, false)
+	edns0 := q.IsEdns0()
+	edns0.Option = append(edns0.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 24,
+		Address:       net.ParseIP("192.0.2.1").To4(),
+	})
+	require.Equal(t, "203.0.113.10", resolve(q, "198.51.100.1"))
+	a, err := r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	ecs := a.IsEdns0().Option[0].(*dns.EDNS0_SUBNET)
+	require.Equal(t, uint8(24), ecs.SourceScope)
+
+	// A location can only be used once
+	opt.GeoAnswers = append(opt.GeoAnswers, GeoAnswer{Locations: []string{"DE"}, Answer: []string{"IN A 203.0.113.30"}})
+	_, err = NewStaticResolver("test-static-geo", opt)
+	require.Error(t, err)
+}
+
+func TestStaticResolverAnswerOrder(t *testing.T) {
+	answer := []string{"IN CNAME www.example.com.", "IN A 192.0.2.1", "IN A 192.0.2.2", "IN A 192.0.2.3"}
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	// Returns the addresses in the answer, after checking the CNAME comes first
+	resolve := func(r *StaticResolver) []string {
+		a, err := r.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		require.IsType(t, &dns.CNAME{}, a.Answer[0])
+		var addrs []string
+		for _, rr := range a.Answer[1:] {
+			addrs = append(addrs, rr.(*dns.A).A.String())
+		}
+		return addrs
+	}
+
+	// Round-robin rotates the address records with every query
+	r, err := NewStaticResolver("test-static", StaticResolverOptions{Answer: answer, AnswerOrder: AnswerOrderRoundRobin})
+	require.NoError(t, err)
+	require.Equal(t, []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}, resolve(r))
+	require.Equal(t, []string{"192.0.2.2", "192.0.2.3", "192.0.2.1"}, resolve(r))
+	require.Equal(t, []string{"192.0.2.3", "192.0.2.1", "192.0.2.2"}, resolve(r))
+
+	// Weighted order with a single record in the answer. Records with weight 0
+	// are never returned, and the heavier one comes first most of the time.
+	r, err = NewStaticResolver("test-static", StaticResolverOptions{
+		Answer:        answer,
+		AnswerWeights: []int{9, 1, 0},
+		AnswerCount:   1,
+	})
+	require.NoError(t, err)
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		addrs := resolve(r)
+		require.Len(t, addrs, 1)
+		counts[addrs[0]]++
+	}
+	require.Zero(t, counts["192.0.2.3"])
+	require.Greater(t, counts["192.0.2.1"], 800)
+	require.Greater(t, counts["192.0.2.2"], 0)
+
+	// Weights have to match the address records
+	_, err = NewStaticResolver("test-static", StaticResolverOptions{Answer: answer, AnswerWeights: []int{1, 2}})
+	require.Error(t, err)
+	_, err = NewStaticResolver("test-static", StaticResolverOptions{Answer: answer, AnswerOrder: "fastest"})
+	require.Error(t, err)
+}
@@ -1,20 +1,34 @@
 package rdns
 
 import (
+	"crypto/tls"
+	"expvar"
 	"fmt"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	syslog "github.com/RackSec/srslog"
 	"github.com/miekg/dns"
-	"github.com/sirupsen/logrus"
 )
 
-// Syslog forwards every query unmodified and logs the content to syslog
+// Syslog forwards every query unmodified and logs the content to syslog.
+// Messages are queued and sent in the background so a slow or unreachable
+// syslog server doesn't hold up queries. Messages are dropped if the queue is
+// full.
 type Syslog struct {
 	id       string
-	writer   *syslog.Writer
 	resolver Resolver
 	opt      SyslogOptions
+	sampler  *LogSampler
+	queue    chan string
+	metrics  *SyslogMetrics
+
+	// Closed to stop sending messages
+	stop      chan struct{}
+	closeOnce sync.Once
 }
 
 var _ Resolver = &Syslog{}
@@ -32,78 +46,234 @@ type SyslogOptions struct {
 	// Syslog tag
 	Tag string
 
+	// Connect to the syslog server over TLS (RFC 5425). The network is
+	// always TCP if set.
+	TLSConfig *tls.Config
+
+	// Use the RFC 5424 format and add the client, query name, response code
+	// and query duration as structured data to every message.
+	StructuredData bool
+
+	// Number of messages that can be queued for sending. Defaults to 1000.
+	QueueSize int
+
 	// Log requests and/or responses
 	LogRequest  bool
 	LogResponse bool
 
 	// Log all response records, including those that do not match the query type
 	Verbose bool
+
+	// Only log a sample of the queries
+	Sampling LogSamplerOptions
+}
+
+type SyslogMetrics struct {
+	// Messages sent to the syslog server.
+	sent *expvar.Int
+	// Messages dropped because the queue was full.
+	drop *expvar.Int
+	// Messages that failed to send.
+	failure *expvar.Int
 }
 
+// SD-ID of the structured data element, using the example enterprise number
+// from RFC 5612.
+const syslogSDID = "routedns@32473"
+
 // NewSyslog returns a new instance of a Syslog generator.
 func NewSyslog(id string, resolver Resolver, opt SyslogOptions) *Syslog {
-	writer, err := syslog.Dial(opt.Network, opt.Address, syslog.Priority(opt.Priority), opt.Tag)
-	if err != nil {
-		// Log any error but don't block if this fails
-		logrus.New().WithError(err).Error("failed to initialize syslog")
+	if opt.QueueSize <= 0 {
+		opt.QueueSize = 1000
 	}
-	return &Syslog{
+	r := &Syslog{
 		id:       id,
-		writer:   writer,
 		resolver: resolver,
 		opt:      opt,
+		sampler:  NewLogSampler(opt.Sampling),
+		queue:    make(chan string, opt.QueueSize),
+		stop:     make(chan struct{}),
+		metrics: &SyslogMetrics{
+			sent:    getVarInt("syslog", id, "sent"),
+			drop:    getVarInt("syslog", id, "drop"),
+			failure: getVarInt("syslog", id, "failure"),
+		},
+	}
+	writer, err := r.dial()
+	if err != nil {
+		// Log any error but don't block if this fails, it's retried when sending
+		Log.WithField("id", id).WithError(err).Error("failed to initialize syslog")
 	}
+	go r.sendLoop(writer)
+	return r
 }
 
 // Resolve passes a DNS query through unmodified. Query details are sent via syslog.
-func (r *Syslog) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dialer) (*dns.Msg, error) {
-	var msg string
-	if r.opt.LogRequest {
-		msg = fmt.Sprintf("id=%s qid=%d type=query client=%s qtype=%s qname=%s", r.id, q.Id, ci.SourceIP.String(), qType(q), qName(q))
-		if _, err := r.writer.Write([]byte(msg)); err != nil {
-			logger(r.id, q, ci).WithError(err).Error("failed to send syslog")
+func (r *Syslog) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	sampled := r.sampler.Sample(ci)
+	if sampled && r.opt.LogRequest {
+		r.logRequest(q, ci)
+	}
+
+	start := time.Now()
+	a, err := r.resolver.Resolve(q, ci)
+	duration := time.Since(start)
+
+	// Queries that weren't sampled are only logged if the response is notable
+	if !sampled {
+		if !r.sampler.Notable(a, err) {
+			return a, err
 		}
+		if r.opt.LogRequest {
+			r.logRequest(q, ci)
+		}
+	}
+	if r.opt.LogResponse {
+		r.logResponse(q, ci, a, err, duration)
 	}
+	return a, err
+}
 
-	a, err := r.resolver.Resolve(q, ci, PanelSocksDialer)
-	if err == nil && a != nil && r.opt.LogResponse {
-		if a.Rcode == dns.RcodeSuccess {
-			var answerRRs = a.Answer
-			// Only print the records that match the query type if verbose=false
-			if !r.opt.Verbose {
-				answerRRs = make([]dns.RR, 0, len(a.Answer))
-				for _, rr := range a.Answer {
-					if rr.Header().Rrtype != q.Question[0].Qtype {
-						continue
-					}
-					answerRRs = append(answerRRs, rr)
-				}
-			}
+func (r *Syslog) logRequest(q *dns.Msg, ci ClientInfo) {
+	msg := fmt.Sprintf("id=%s qid=%d type=query client=%s qtype=%s qname=%s", r.id, q.Id, ci.SourceIP.String(), qType(q), qName(q))
+	r.write(q, ci, "", 0, msg)
+}
 
-			for i, rr := range answerRRs {
-				s := strings.ReplaceAll(rr.String(), "\t", " ")
-				msg = fmt.Sprintf("id=%s qid=%d type=answer answer-num=%d/%d qtype=%s qname=%s answer=%q", r.id, q.Id, i+1, len(answerRRs), qType(q), qName(q), s)
-				if _, err := r.writer.Write([]byte(msg)); err != nil {
-					logger(r.id, q, ci).WithError(err).Error("failed to send syslog")
+func (r *Syslog) logResponse(q *dns.Msg, ci ClientInfo, a *dns.Msg, err error, duration time.Duration) {
+	switch {
+	case err != nil:
+		r.write(q, ci, "ERROR", duration, fmt.Sprintf("id=%s qid=%d type=answer qtype=%s qname=%s error=%q", r.id, q.Id, qType(q), qName(q), err.Error()))
+	case a == nil:
+		r.write(q, ci, "DROP", duration, fmt.Sprintf("id=%s qid=%d type=answer qtype=%s qname=%s rcode=DROP", r.id, q.Id, qType(q), qName(q)))
+	case a.Rcode == dns.RcodeSuccess:
+		var answerRRs = a.Answer
+		// Only print the records that match the query type if verbose=false
+		if !r.opt.Verbose {
+			answerRRs = make([]dns.RR, 0, len(a.Answer))
+			for _, rr := range a.Answer {
+				if rr.Header().Rrtype != q.Question[0].Qtype {
+					continue
 				}
+				answerRRs = append(answerRRs, rr)
 			}
-			// Synthesize a NODATA rcode when the response is NOERROR without any response records
-			if len(answerRRs) == 0 {
-				msg = fmt.Sprintf("id=%s qid=%d type=answer qtype=%s qname=%s rcode=NODATA", r.id, q.Id, qType(q), qName(q))
-				if _, err := r.writer.Write([]byte(msg)); err != nil {
-					logger(r.id, q, ci).WithError(err).Error("failed to send syslog")
-				}
+		}
+
+		for i, rr := range answerRRs {
+			s := strings.ReplaceAll(rr.String(), "\t", " ")
+			r.write(q, ci, "NOERROR", duration, fmt.Sprintf("id=%s qid=%d type=answer answer-num=%d/%d qtype=%s qname=%s answer=%q", r.id, q.Id, i+1, len(answerRRs), qType(q), qName(q), s))
+		}
+		// Synthesize a NODATA rcode when the response is NOERROR without any response records
+		if len(answerRRs) == 0 {
+			r.write(q, ci, "NODATA", duration, fmt.Sprintf("id=%s qid=%d type=answer qtype=%s qname=%s rcode=NODATA", r.id, q.Id, qType(q), qName(q)))
+		}
+	default:
+		rcode := dns.RcodeToString[a.Rcode]
+		r.write(q, ci, rcode, duration, fmt.Sprintf("id=%s qid=%d type=answer qtype=%s qname=%s rcode=%s", r.id, q.Id, qType(q), qName(q), rcode))
+	}
+}
+
+// Queues a message for sending. With structured data, the rcode and duration
+// are only added if not empty.
+func (r *Syslog) write(q *dns.Msg, ci ClientInfo, rcode string, duration time.Duration, msg string) {
+	if r.opt.StructuredData {
+		msg = syslogStructuredData(q, ci, rcode, duration) + " " + msg
+	}
+	select {
+	case r.queue <- msg:
+	default:
+		r.metrics.drop.Add(1)
+		logger(r.id, q, ci).Debug("syslog queue full, dropping message")
+	}
+}
+
+// Close stops sending messages to the syslog server. Queued messages are
+// dropped.
+func (r *Syslog) Close() error {
+	r.closeOnce.Do(func() { close(r.stop) })
+	return nil
+}
+
+// Sends queued messages to the syslog server, reconnecting if the connection
+// couldn't be established before.
+func (r *Syslog) sendLoop(writer *syslog.Writer) {
+	log := Log.WithField("id", r.id)
+	for {
+		var msg string
+		select {
+		case msg = <-r.queue:
+		case <-r.stop:
+			if writer != nil {
+				writer.Close()
 			}
-		} else {
-			msg = fmt.Sprintf("id=%s qid=%d type=answer qtype=%s qname=%s rcode=%s", r.id, q.Id, qType(q), qName(q), dns.RcodeToString[a.Rcode])
-			if _, err := r.writer.Write([]byte(msg)); err != nil {
-				logger(r.id, q, ci).WithError(err).Error("failed to send syslog")
+			return
+		}
+		if writer == nil {
+			var err error
+			if writer, err = r.dial(); err != nil {
+				r.metrics.failure.Add(1)
+				log.WithError(err).Error("failed to connect to syslog")
+				continue
 			}
 		}
+		if _, err := writer.Write([]byte(msg)); err != nil {
+			r.metrics.failure.Add(1)
+			log.WithError(err).Error("failed to send syslog")
+			continue
+		}
+		r.metrics.sent.Add(1)
 	}
-	return a, err
 }
 
+func (r *Syslog) dial() (*syslog.Writer, error) {
+	var (
+		writer *syslog.Writer
+		err    error
+	)
+	if r.opt.TLSConfig != nil {
+		writer, err = syslog.DialWithTLSConfig("tcp+tls", r.opt.Address, syslog.Priority(r.opt.Priority), r.opt.Tag, r.opt.TLSConfig)
+	} else {
+		writer, err = syslog.Dial(r.opt.Network, r.opt.Address, syslog.Priority(r.opt.Priority), r.opt.Tag)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.opt.StructuredData {
+		writer.SetFormatter(syslogRFC5424Formatter)
+	}
+	// Messages over TLS are framed with their length as per RFC 5425
+	if r.opt.TLSConfig != nil {
+		writer.SetFramer(syslog.RFC5425MessageLengthFramer)
+	}
+	return writer, nil
+}
+
+// Formats RFC 5424 messages. Unlike syslog.RFC5424Formatter, the tag is used
+// as APP-NAME and the content is expected to start with structured data.
+func syslogRFC5424Formatter(p syslog.Priority, hostname, tag, content string) string {
+	return fmt.Sprintf("<%d>1 %s %s %s %d - %s",
+		p, time.Now().Format(time.RFC3339), hostname, tag, os.Getpid(), content)
+}
+
+// Returns the structured data element for a message.
+func syslogStructuredData(q *dns.Msg, ci ClientInfo, rcode string, duration time.Duration) string {
+	var b strings.Builder
+	b.WriteString("[" + syslogSDID)
+	param := func(name, value string) {
+		b.WriteString(" " + name + "=\"" + syslogSDEscaper.Replace(value) + "\"")
+	}
+	param("client", ci.SourceIP.String())
+	param("qname", qName(q))
+	if rcode != "" {
+		param("rcode", rcode)
+		param("duration", strconv.FormatInt(duration.Milliseconds(), 10))
+	}
+	b.WriteString("]")
+	return b.String()
+}
+
+// Escapes the characters that aren't allowed in structured data values.
+var syslogSDEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, `]`, `\]`)
+
 func (r *Syslog) String() string {
 	return r.id
 }
@@ -0,0 +1,51 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyslogStructuredData(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetRcode(q, dns.RcodeNameError)
+			return a, nil
+		},
+	}
+	r := NewSyslog("test-syslog", upstream, SyslogOptions{
+		Network:        "udp",
+		Address:        pc.LocalAddr().String(),
+		Priority:       6,
+		Tag:            "routedns",
+		StructuredData: true,
+		LogResponse:    true,
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+	_, err = r.Resolve(q, ClientInfo{SourceIP: net.ParseIP("192.168.1.1")})
+	require.NoError(t, err)
+
+	buf := make([]byte, 1024)
+	require.NoError(t, pc.SetReadDeadline(time.Now().Add(time.Second)))
+	n, _, err := pc.ReadFrom(buf)
+	require.NoError(t, err)
+	msg := string(buf[:n])
+	require.Regexp(t, `^<6>1 \S+ \S+ routedns \d+ - \[routedns@32473 client="192.168.1.1" qname="test.com." rcode="NXDOMAIN" duration="\d+"\] id=test-syslog `, msg)
+}
+
+func TestSyslogStructuredDataEscape(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion(`a\]b"c.`, dns.TypeA)
+	sd := syslogStructuredData(q, ClientInfo{SourceIP: net.ParseIP("::1")}, "", 0)
+	require.Equal(t, `[routedns@32473 client="::1" qname="a\\\]b\"c."]`, sd)
+}
@@ -0,0 +1,62 @@
+package rdns
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Elements of a tenant have IDs made of the tenant name, a dot and the ID in
+// the tenant's configuration. Their metrics and admin endpoints are kept apart
+// by this prefix.
+
+// TenantID returns the ID of an element of a tenant.
+func TenantID(tenant, id string) string {
+	return tenant + "." + id
+}
+
+// Returns true if the ID belongs to an element of the tenant.
+func inTenant(tenant, id string) bool {
+	return strings.HasPrefix(id, tenant+".")
+}
+
+// Returns true if the expvar, in the form routedns.<kind>.<id>.<name>, is a
+// metric of an element of the tenant.
+func tenantMetric(tenant, name string) bool {
+	name, ok := strings.CutPrefix(name, "routedns.")
+	if !ok {
+		return false
+	}
+	_, id, ok := strings.Cut(name, ".")
+	return ok && inTenant(tenant, id)
+}
+
+// Returns true if an admin endpoint, in the form /routedns/<kind>/<id>,
+// belongs to an element of the tenant. Endpoints that aren't for a single
+// element aren't served to tenants.
+func tenantAdminPattern(tenant, pattern string) bool {
+	parts := strings.Split(strings.Trim(pattern, "/"), "/")
+	return len(parts) == 3 && inTenant(tenant, parts[2])
+}
+
+// Serves the metrics of the elements of a tenant, in the same format as
+// expvar.Handler.
+func tenantVarsHandler(tenant string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprintf(w, "{\n")
+		first := true
+		expvar.Do(func(kv expvar.KeyValue) {
+			if !tenantMetric(tenant, kv.Key) {
+				return
+			}
+			if !first {
+				fmt.Fprintf(w, ",\n")
+			}
+			first = false
+			fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+		})
+		fmt.Fprintf(w, "\n}\n")
+	})
+}
@@ -0,0 +1,28 @@
+package rdns
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTenantAdminPattern(t *testing.T) {
+	require.True(t, tenantAdminPattern("acme", "/routedns/group/acme.blocklist"))
+	require.False(t, tenantAdminPattern("acme", "/routedns/group/other.blocklist"))
+	require.False(t, tenantAdminPattern("acme", "/routedns/group/acmeblocklist"))
+	require.False(t, tenantAdminPattern("acme", "/routedns/routes"))
+}
+
+func TestTenantVarsHandler(t *testing.T) {
+	getVarInt("router", TenantID("test-tenant", "router"), "query").Add(1)
+	getVarInt("router", "test-tenant-other", "query").Add(1)
+
+	w := httptest.NewRecorder()
+	tenantVarsHandler("test-tenant").ServeHTTP(w, httptest.NewRequest("GET", "/routedns/vars", nil))
+
+	vars := make(map[string]any)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &vars))
+	require.Equal(t, map[string]any{"routedns.router.test-tenant.router.query": float64(1)}, vars)
+}
@@ -0,0 +1,99 @@
+package rdns
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Timeout is a resolver that limits the time the resolvers behind it can take to
+// answer a query. The deadline is passed on with the query, clients stop waiting
+// for their upstream once it's reached so a hung upstream can't hold up the
+// caller.
+type Timeout struct {
+	id       string
+	resolver Resolver
+	TimeoutOptions
+	metrics *TimeoutMetrics
+}
+
+var _ Resolver = &Timeout{}
+
+type TimeoutOptions struct {
+	// Maximum time to wait for a response. Default 2 seconds.
+	Timeout time.Duration
+}
+
+type TimeoutMetrics struct {
+	// Count of queries.
+	query *expvar.Int
+	// Count of queries that timed out.
+	timeout *expvar.Int
+}
+
+// NewTimeout returns a new instance of a timeout resolver.
+func NewTimeout(id string, resolver Resolver, opt TimeoutOptions) *Timeout {
+	if opt.Timeout == 0 {
+		opt.Timeout = defaultQueryTimeout
+	}
+	return &Timeout{
+		id:             id,
+		resolver:       resolver,
+		TimeoutOptions: opt,
+		metrics: &TimeoutMetrics{
+			query:   getVarInt("timeout", id, "query"),
+			timeout: getVarInt("timeout", id, "timeout"),
+		},
+	}
+}
+
+// Resolve a DNS query with a deadline of the timeout from now, or the deadline
+// set by the caller if that's sooner.
+func (r *Timeout) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	log := logger(r.id, q, ci)
+	r.metrics.query.Add(1)
+
+	ci = ci.WithTimeout(r.Timeout)
+	log.WithField("resolver", r.resolver).Debug("forwarding query to resolver")
+	a, err := r.resolver.Resolve(q, ci)
+	if err != nil && !time.Now().Before(ci.Deadline) {
+		r.metrics.timeout.Add(1)
+	}
+	return a, err
+}
+
+func (r *Timeout) String() string {
+	return r.id
+}
+
+// Check Cert
+func (s *Timeout) CertMonitor() error {
+	return nil
+}
+
+// Resolves a query and returns a timeout error once the deadline in the client
+// info is reached, even if the resolvers don't honour it. They carry on with a
+// copy of the query in the background, their response is discarded.
+func resolveByDeadline(r Resolver, q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if ci.Deadline.IsZero() {
+		return r.Resolve(q, ci)
+	}
+	type result struct {
+		a   *dns.Msg
+		err error
+	}
+	done := make(chan result, 1)
+	go func(q *dns.Msg) {
+		a, err := r.Resolve(q, ci)
+		done <- result{a, err}
+	}(q.Copy())
+	timer := time.NewTimer(time.Until(ci.Deadline))
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return res.a, res.err
+	case <-timer.C:
+		return nil, QueryTimeoutError{q}
+	}
+}
@@ -0,0 +1,83 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeout(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	var deadline time.Time
+	delay := 50 * time.Millisecond
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			deadline = ci.Deadline
+			time.Sleep(delay)
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+	to := NewTimeout("test-timeout", r, TimeoutOptions{Timeout: time.Second})
+
+	// Fast enough, the deadline is passed on to the upstream resolver
+	a, err := to.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.NotNil(t, a)
+	require.False(t, deadline.IsZero())
+
+	// An earlier deadline set by the caller takes precedence
+	ci := ClientInfo{}.WithTimeout(10 * time.Millisecond)
+	_, _ = to.Resolve(q, ci)
+	require.Equal(t, ci.Deadline, deadline)
+}
+
+func TestTimeoutClient(t *testing.T) {
+	// Upstream that never answers
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	client, err := NewDNSClient("test-timeout-client", pc.LocalAddr().String(), "udp", DNSClientOptions{QueryTimeout: 5 * time.Second})
+	require.NoError(t, err)
+	to := NewTimeout("test-timeout-client", client, TimeoutOptions{Timeout: 100 * time.Millisecond})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// The client gives up at the deadline rather than its own timeout
+	start := time.Now()
+	_, err = to.Resolve(q, ClientInfo{})
+	require.ErrorAs(t, err, &QueryTimeoutError{})
+	require.Less(t, time.Since(start), time.Second)
+}
+
+func TestResolveByDeadline(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Resolver that ignores the deadline
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			time.Sleep(time.Second)
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+	start := time.Now()
+	_, err := resolveIncoming(r, q, ClientInfo{}.WithTimeout(50*time.Millisecond))
+	require.ErrorAs(t, err, &QueryTimeoutError{})
+	require.Less(t, time.Since(start), 500*time.Millisecond)
+
+	// Without deadline, the resolver takes as long as it needs
+	a, err := resolveIncoming(r, q, ClientInfo{})
+	require.NoError(t, err)
+	require.NotNil(t, a)
+}
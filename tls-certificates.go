@@ -0,0 +1,200 @@
+package rdns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/XrayR-project/XrayR/common/mylego"
+	"github.com/pion/dtls/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// CertificateFiles are the files of a TLS certificate and its key.
+type CertificateFiles struct {
+	CertFile string
+	KeyFile  string
+}
+
+// TLSCertificates holds the certificates of a TLS server, loaded from files,
+// and picks one for each connection based on the server name (SNI) sent by the
+// client. The files can be reloaded while the server is running. New connections
+// use the new certificates while established connections are not affected.
+type TLSCertificates struct {
+	id            string
+	files         []CertificateFiles
+	rejectUnknown bool
+
+	mu       sync.Mutex // Serializes reloads
+	modTimes []time.Time
+	set      atomic.Pointer[certificateSet]
+}
+
+// Loaded certificates, indexed by the names they're valid for.
+type certificateSet struct {
+	certs  []tls.Certificate
+	byName map[string]*tls.Certificate
+}
+
+// NewTLSCertificates loads a list of certificates. The first is the default
+// certificate, used for clients that don't send a server name or a name none
+// of the certificates is valid for, unless rejectUnknown is set in which case
+// the handshake fails.
+func NewTLSCertificates(id string, files []CertificateFiles, rejectUnknown bool) (*TLSCertificates, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no certificates for '%s'", id)
+	}
+	c := &TLSCertificates{
+		id:            id,
+		files:         files,
+		rejectUnknown: rejectUnknown,
+	}
+	if _, err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload reads the certificates again if any of the files changed since they
+// were last loaded. If loading fails, for example because the certificate was
+// replaced but the key not yet, the current certificates remain in use and the
+// files are loaded again on the next call.
+func (c *TLSCertificates) Reload() error {
+	loaded, err := c.load()
+	if err != nil {
+		return fmt.Errorf("failed to reload certificates for '%s': %w", c.id, err)
+	}
+	if loaded {
+		Log.WithFields(logrus.Fields{"id": c.id}).Info("reloaded certificates")
+	}
+	return nil
+}
+
+// Loads all certificates and replaces the current ones. Returns false if the
+// files didn't change since they were loaded last.
+func (c *TLSCertificates) load() (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Record the modification times before reading so changes made while
+	// loading are picked up by the next reload
+	modTimes, err := c.fileModTimes()
+	if err != nil {
+		return false, err
+	}
+	if c.modTimes != nil && slices.EqualFunc(modTimes, c.modTimes, time.Time.Equal) {
+		return false, nil
+	}
+	set := &certificateSet{
+		certs:  make([]tls.Certificate, 0, len(c.files)),
+		byName: make(map[string]*tls.Certificate),
+	}
+	for _, f := range c.files {
+		cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return false, err
+		}
+		set.certs = append(set.certs, cert)
+	}
+	for i := range set.certs {
+		cert := &set.certs[i]
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return false, err
+		}
+		cert.Leaf = leaf
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			if _, ok := set.byName[name]; !ok {
+				set.byName[name] = cert
+			}
+		}
+	}
+	c.set.Store(set)
+	c.modTimes = modTimes
+	return true, nil
+}
+
+func (c *TLSCertificates) fileModTimes() ([]time.Time, error) {
+	modTimes := make([]time.Time, 0, 2*len(c.files))
+	for _, f := range c.files {
+		for _, name := range []string{f.CertFile, f.KeyFile} {
+			fi, err := os.Stat(name)
+			if err != nil {
+				return nil, err
+			}
+			modTimes = append(modTimes, fi.ModTime())
+		}
+	}
+	return modTimes, nil
+}
+
+// GetCertificate returns the certificate for a TLS handshake. It's meant to be
+// used as GetCertificate callback in tls.Config. Certificates match the names
+// they're valid for, including wildcards. The first certificate matching a name
+// wins.
+func (c *TLSCertificates) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.get(hello.ServerName)
+}
+
+// GetDTLSCertificate returns the certificate for a DTLS handshake. It's meant
+// to be used as GetCertificate callback in dtls.Config.
+func (c *TLSCertificates) GetDTLSCertificate(hello *dtls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.get(hello.ServerName)
+}
+
+func (c *TLSCertificates) get(serverName string) (*tls.Certificate, error) {
+	set := c.set.Load()
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if cert, ok := set.byName[name]; ok {
+		return cert, nil
+	}
+	// Wildcards only cover a single label
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, ok := set.byName["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	if c.rejectUnknown {
+		return nil, fmt.Errorf("no certificate for server name '%s'", serverName)
+	}
+	return &set.certs[0], nil
+}
+
+// Renews a certificate managed by lego and reloads the certificates of a
+// listener from their files. Established connections are not interrupted.
+// Certificates in "http" and "tls" mode are renewed by ACMEClient. Errors are
+// only logged, the periodic task running this would stop otherwise.
+func renewCertificates(certConfig *mylego.CertConfig, certs *TLSCertificates) error {
+	if certConfig == nil {
+		return nil
+	}
+	switch certConfig.CertMode {
+	case "dns":
+		lego, err := mylego.New(certConfig)
+		if err != nil {
+			Log.WithError(err).Error("failed to renew certificate")
+			break
+		}
+		if _, _, _, _, err := lego.RenewCert(); err != nil {
+			Log.WithError(err).Error("failed to renew certificate")
+		}
+	}
+	if certs == nil {
+		return nil
+	}
+	if err := certs.Reload(); err != nil {
+		Log.WithError(err).Error("failed to reload certificates")
+	}
+	return nil
+}
@@ -0,0 +1,311 @@
+package rdns
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TLS listeners configured with the same address, DoT and DoH, share one TCP
+// socket. The ALPN protocols in the client's TLS ClientHello decide which
+// listener a connection is handed to, "dot" for DoT and "h2" or "http/1.1" for
+// DoH, so a single port like 443 can serve both. The listeners then do the
+// handshake with their own TLS config. A listener that has an address to
+// itself doesn't use this and gets the connections straight from the socket.
+var tlsMuxes = struct {
+	mu sync.Mutex
+	m  map[string]*tlsMux
+}{m: make(map[string]*tlsMux)}
+
+// Time a client has to send its ClientHello on a shared socket.
+const tlsSniffTimeout = 10 * time.Second
+
+// tlsMux accepts the connections on a shared TCP socket and passes them on to
+// the listeners by ALPN protocol.
+type tlsMux struct {
+	key string
+	ln  net.Listener
+
+	mu        sync.Mutex
+	listeners []*tlsListener
+
+	// Connections still sending their ClientHello. They count against the
+	// combined connection limit of the listeners, see acquire.
+	pending     int
+	pendingCond *sync.Cond
+}
+
+// tlsListener receives the connections for its ALPN protocols from a shared
+// TCP socket. The connections are passed on before the TLS handshake.
+type tlsListener struct {
+	mux            *tlsMux
+	protos         []string
+	fallback       bool
+	maxConnections int
+	conns          chan net.Conn
+	done           chan struct{}
+	closeOnce      sync.Once
+}
+
+var _ net.Listener = &tlsListener{}
+
+// Returns a listener for TLS connections asking for one of the ALPN protocols
+// in opt.alpn. A fallback listener also gets the connections that don't ask
+// for any protocol served on the socket, if there's only one listener it gets
+// all connections. The socket is opened by the first listener for the address
+// and closed with the last one.
+//
+// The connection limits and metrics of the listener apply once a connection
+// is handed to it. Until then, connections reading their ClientHello are
+// limited to the combined maxConnections of the listeners on the socket, if
+// all of them have a limit.
+func listenTLS(network, addr string, opt socketOptions) (*tlsListener, error) {
+	l := &tlsListener{
+		protos:         opt.alpn,
+		fallback:       opt.alpnFallback,
+		maxConnections: opt.maxConnections,
+		conns:          make(chan net.Conn),
+		done:           make(chan struct{}),
+	}
+
+	tlsMuxes.mu.Lock()
+	defer tlsMuxes.mu.Unlock()
+	key := network + ":" + addr
+	m, ok := tlsMuxes.m[key]
+	if !ok {
+		ln, err := listenStream(network, addr, socketOptions{})
+		if err != nil {
+			return nil, err
+		}
+		m = &tlsMux{key: key, ln: ln}
+		m.pendingCond = sync.NewCond(&m.mu)
+		tlsMuxes.m[key] = m
+		go m.serve()
+	}
+	if err := m.add(l); err != nil {
+		return nil, err
+	}
+	l.mux = m
+	return l, nil
+}
+
+// Adds a listener, unless one of its protocols is already served or there
+// would be two fallback listeners.
+func (m *tlsMux) add(l *tlsListener) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range m.listeners {
+		if l.fallback && e.fallback {
+			return fmt.Errorf("tls connections without alpn protocol are already served on %s", m.key)
+		}
+		for _, proto := range l.protos {
+			if e.serves(proto) {
+				return fmt.Errorf("alpn protocol '%s' is already served on %s", proto, m.key)
+			}
+		}
+	}
+	m.listeners = append(m.listeners, l)
+	return nil
+}
+
+// Removes a listener and returns true if it was the last one.
+func (m *tlsMux) remove(l *tlsListener) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, e := range m.listeners {
+		if e == l {
+			m.listeners = append(m.listeners[:i], m.listeners[i+1:]...)
+			break
+		}
+	}
+	m.pendingCond.Broadcast()
+	return len(m.listeners) == 0
+}
+
+// Waits until another connection can be accepted without going over the
+// combined connection limit of the listeners. There is no limit if one of
+// them has none, the connection could be for that listener. Connections count
+// until they've been handed to a listener, which then applies its own limit,
+// so clients that are slow to send their ClientHello can't pile up on the
+// socket.
+func (m *tlsMux) acquire() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for {
+		limit := m.pendingLimit()
+		if limit == 0 || m.pending < limit {
+			break
+		}
+		m.pendingCond.Wait()
+	}
+	m.pending++
+}
+
+// Returns the combined connection limit of the listeners, 0 if any of them
+// is unlimited. Must be called with the lock held.
+func (m *tlsMux) pendingLimit() int {
+	var limit int
+	for _, l := range m.listeners {
+		if l.maxConnections == 0 {
+			return 0
+		}
+		limit += l.maxConnections
+	}
+	return limit
+}
+
+func (m *tlsMux) release() {
+	m.mu.Lock()
+	m.pending--
+	m.mu.Unlock()
+	m.pendingCond.Signal()
+}
+
+// Returns the listener for the first of the protocols offered by a client
+// that is served on the socket, the fallback listener, or nil.
+func (m *tlsMux) listener(protos []string) *tlsListener {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, proto := range protos {
+		for _, l := range m.listeners {
+			if l.serves(proto) {
+				return l
+			}
+		}
+	}
+	for _, l := range m.listeners {
+		if l.fallback {
+			return l
+		}
+	}
+	if len(m.listeners) == 1 {
+		return m.listeners[0]
+	}
+	return nil
+}
+
+// Accepts connections until the socket is closed.
+func (m *tlsMux) serve() {
+	for {
+		m.acquire()
+		conn, err := m.ln.Accept()
+		if err != nil {
+			m.release()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			Log.WithError(err).WithField("addr", m.key).Warn("failed to accept")
+			continue
+		}
+		go m.dispatch(conn)
+	}
+}
+
+// Reads the ClientHello of a connection and hands the connection to the
+// listener for its protocols. What was read is replayed to the listener.
+func (m *tlsMux) dispatch(conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(tlsSniffTimeout))
+	protos, hello := clientHelloProtos(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	m.release()
+
+	l := m.listener(protos)
+	if l == nil {
+		Log.WithFields(logrus.Fields{"addr": m.key, "client": conn.RemoteAddr(), "alpn": protos}).Debug("no listener for alpn protocols, closing connection")
+		conn.Close()
+		return
+	}
+	conn = &replayConn{Conn: conn, r: io.MultiReader(bytes.NewReader(hello), conn)}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// Accept returns the next connection for one of the listener's protocols.
+func (l *tlsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections. The socket is closed along with the last
+// listener on it.
+func (l *tlsListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		tlsMuxes.mu.Lock()
+		defer tlsMuxes.mu.Unlock()
+		if !l.mux.remove(l) {
+			return
+		}
+		delete(tlsMuxes.m, l.mux.key)
+		err = l.mux.ln.Close()
+	})
+	return err
+}
+
+func (l *tlsListener) Addr() net.Addr {
+	return l.mux.ln.Addr()
+}
+
+func (l *tlsListener) serves(proto string) bool {
+	for _, p := range l.protos {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
+
+// Error used to stop the handshake once the ClientHello has been read.
+var errClientHelloRead = errors.New("client hello read")
+
+// Reads the ClientHello from a connection and returns the ALPN protocols
+// offered by the client along with the data read from the connection. No
+// protocols are returned if the client doesn't send a valid ClientHello.
+func clientHelloProtos(conn net.Conn) ([]string, []byte) {
+	var (
+		buf    bytes.Buffer
+		protos []string
+	)
+	sniff := &replayConn{Conn: conn, r: io.TeeReader(conn, &buf), readOnly: true}
+	_ = tls.Server(sniff, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			protos = hello.SupportedProtos
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	return protos, buf.Bytes()
+}
+
+// replayConn reads from r instead of the connection, to see or replay the
+// data read before. Writes are discarded if it's read-only.
+type replayConn struct {
+	net.Conn
+	r        io.Reader
+	readOnly bool
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *replayConn) Write(b []byte) (int, error) {
+	if c.readOnly {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,166 @@
+package rdns
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSMuxSharedPort(t *testing.T) {
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+
+	// DoT and DoH listeners on the same address
+	dotUpstream := new(TestResolver)
+	dot := NewDoTListener("test-mux-dot", addr, DoTListenerOptions{TLSConfig: tlsServerConfig.Clone(), ListenOptions: ListenOptions{SharePort: true}}, dotUpstream)
+	go func() { _ = dot.Start() }()
+	defer dot.Stop()
+	dohUpstream := new(TestResolver)
+	doh, err := NewDoHListener("test-mux-doh", addr, DoHListenerOptions{TLSConfig: tlsServerConfig.Clone(), ListenOptions: ListenOptions{SharePort: true}}, dohUpstream)
+	require.NoError(t, err)
+	go func() { _ = doh.Start() }()
+	defer doh.Stop()
+	time.Sleep(time.Second)
+
+	tlsClientConfig, err := TLSClientConfig("testdata/ca.crt", "", "", "")
+	require.NoError(t, err)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// The DoT client doesn't ask for a protocol and ends up on the DoT listener
+	dotClient, err := NewDoTClient("test-mux-dot", addr, DoTClientOptions{TLSConfig: tlsClientConfig.Clone()})
+	require.NoError(t, err)
+	_, err = dotClient.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, dotUpstream.HitCount())
+	require.Equal(t, 0, dohUpstream.HitCount())
+
+	// The DoH client asks for h2 and gets the DoH listener
+	dohClient, err := NewDoHClient("test-mux-doh", "https://"+addr+"/dns-query", DoHClientOptions{TLSConfig: tlsClientConfig.Clone()})
+	require.NoError(t, err)
+	_, err = dohClient.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, dotUpstream.HitCount())
+	require.Equal(t, 1, dohUpstream.HitCount())
+}
+
+func TestClientHelloProtos(t *testing.T) {
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	ln, err := listenTLS("tcp", addr, socketOptions{alpn: []string{"dot"}, alpnFallback: true})
+	require.NoError(t, err)
+	defer ln.Close()
+
+	// The listener gets the connection with the ClientHello still to be read
+	tlsClientConfig, err := TLSClientConfig("testdata/ca.crt", "", "", "")
+	require.NoError(t, err)
+	tlsClientConfig.NextProtos = []string{"dot"}
+	go func() {
+		conn, err := tls.Dial("tcp", addr, tlsClientConfig)
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := ln.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	protos, _ := clientHelloProtos(conn)
+	require.Equal(t, []string{"dot"}, protos)
+}
+
+func TestTLSMuxPendingLimit(t *testing.T) {
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	ln, err := listenTLS("tcp", addr, socketOptions{alpn: []string{"dot"}, alpnFallback: true, maxConnections: 1})
+	require.NoError(t, err)
+	defer ln.Close()
+
+	// A client that doesn't send its ClientHello holds the only slot
+	silent, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+
+	tlsClientConfig, err := TLSClientConfig("testdata/ca.crt", "", "", "")
+	require.NoError(t, err)
+	tlsClientConfig.NextProtos = []string{"dot"}
+	go func() {
+		conn, err := tls.Dial("tcp", addr, tlsClientConfig)
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	select {
+	case <-accepted:
+		t.Fatal("connection accepted over the limit")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// Once the first connection is gone, the second one is let through
+	silent.Close()
+	for i := 0; i < 2; i++ {
+		select {
+		case conn := <-accepted:
+			conn.Close()
+		case <-time.After(time.Second):
+			t.Fatal("connection not accepted")
+		}
+	}
+}
+
+func TestTLSMuxPendingUnlimited(t *testing.T) {
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	dot, err := listenTLS("tcp", addr, socketOptions{alpn: []string{"dot"}, alpnFallback: true, maxConnections: 1})
+	require.NoError(t, err)
+	defer dot.Close()
+	doh, err := listenTLS("tcp", addr, socketOptions{alpn: []string{"h2", "http/1.1"}})
+	require.NoError(t, err)
+	defer doh.Close()
+
+	// A client that doesn't send its ClientHello fills the pending slot of the
+	// DoT listener
+	silent, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer silent.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// The DoH listener has no limit, so its clients still get through
+	tlsClientConfig, err := TLSClientConfig("testdata/ca.crt", "", "", "")
+	require.NoError(t, err)
+	tlsClientConfig.NextProtos = []string{"h2"}
+	go func() {
+		conn, err := tls.Dial("tcp", addr, tlsClientConfig)
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := doh.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(time.Second):
+		t.Fatal("doh connection not accepted")
+	}
+}
@@ -1,10 +1,15 @@
 package rdns
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"slices"
+	"strings"
 
 	"github.com/XrayR-project/XrayR/common/mylego"
 )
@@ -73,6 +78,168 @@ func TLSServerConfig(caFile, crtFile, keyFile string, mutualTLS bool) (*tls.Conf
 	return tlsConfig, nil
 }
 
+// TLSServerOptions holds the protocol settings of a TLS server. Zero values
+// leave the Go defaults in place.
+type TLSServerOptions struct {
+	MinVersion       uint16
+	MaxVersion       uint16
+	CipherSuites     []uint16
+	CurvePreferences []tls.CurveID
+	NextProtos       []string // ALPN protocols in order of preference
+}
+
+// Apply sets the protocol options in a TLS server config.
+func (o TLSServerOptions) Apply(tlsConfig *tls.Config) {
+	if o.MinVersion != 0 {
+		tlsConfig.MinVersion = o.MinVersion
+	}
+	if o.MaxVersion != 0 {
+		tlsConfig.MaxVersion = o.MaxVersion
+	}
+	if len(o.CipherSuites) > 0 {
+		tlsConfig.CipherSuites = o.CipherSuites
+	}
+	if len(o.CurvePreferences) > 0 {
+		tlsConfig.CurvePreferences = o.CurvePreferences
+	}
+	if len(o.NextProtos) > 0 {
+		tlsConfig.NextProtos = o.NextProtos
+	}
+}
+
+// ParseTLSVersion returns the TLS version for a string like "1.2" or "1.3".
+// An empty string returns 0 which means the default.
+func ParseTLSVersion(s string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(s), "tls") {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version '%s'", s)
+}
+
+// ParseCipherSuites returns the IDs of a list of cipher suites given by their
+// IANA names, like "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256". Note that the
+// cipher suites of TLS 1.3 are not configurable.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	suites := make(map[string]uint16)
+	for _, c := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[c.Name] = c.ID
+	}
+	var ids []uint16
+	for _, name := range names {
+		id, ok := suites[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unsupported cipher suite '%s'", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// ParseCurvePreferences returns the IDs of a list of elliptic curves given by
+// name, one of "X25519", "P256", "P384" or "P521".
+func ParseCurvePreferences(names []string) ([]tls.CurveID, error) {
+	var ids []tls.CurveID
+	for _, name := range names {
+		switch strings.ReplaceAll(strings.ToUpper(name), "-", "") {
+		case "X25519":
+			ids = append(ids, tls.X25519)
+		case "P256", "CURVEP256":
+			ids = append(ids, tls.CurveP256)
+		case "P384", "CURVEP384":
+			ids = append(ids, tls.CurveP384)
+		case "P521", "CURVEP521":
+			ids = append(ids, tls.CurveP521)
+		default:
+			return nil, fmt.Errorf("unsupported curve '%s'", name)
+		}
+	}
+	return ids, nil
+}
+
+// ClientCertPolicy restricts the client certificates accepted by servers using
+// mutual TLS. Without a policy any certificate signed by the CA is accepted. With
+// a policy, the certificate also has to match at least one of the rules.
+type ClientCertPolicy struct {
+	CommonNames  []string // Subject common names
+	SANs         []string // DNS, email or URI subject alternative names
+	Fingerprints []string // SHA-256 fingerprints of the certificate, hex-encoded with or without colons
+}
+
+// Empty returns true if the policy has no rules.
+func (p ClientCertPolicy) Empty() bool {
+	return len(p.CommonNames) == 0 && len(p.SANs) == 0 && len(p.Fingerprints) == 0
+}
+
+// VerifyPeerCertificate checks a client certificate against the policy. It can
+// be used as VerifyPeerCertificate callback in TLS and DTLS server configs, which
+// is called after the certificate was validated with the CA.
+func (p ClientCertPolicy) VerifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no client certificate")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	for _, name := range p.CommonNames {
+		if cert.Subject.CommonName == name {
+			return nil
+		}
+	}
+	for _, name := range p.SANs {
+		if slices.Contains(certSANs(cert), name) {
+			return nil
+		}
+	}
+	fingerprint := certFingerprint(cert)
+	for _, f := range p.Fingerprints {
+		if strings.ToLower(strings.ReplaceAll(f, ":", "")) == fingerprint {
+			return nil
+		}
+	}
+	return fmt.Errorf("client certificate '%s' not authorized", cert.Subject.CommonName)
+}
+
+// Returns the DNS, email and URI subject alternative names of a certificate.
+func certSANs(cert *x509.Certificate) []string {
+	names := append([]string{}, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	return names
+}
+
+// Returns the hex-encoded SHA-256 fingerprint of a certificate.
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// Sets the identity of the client certificate presented in a TLS connection, if
+// any. The name is the subject common name, or the first subject alternative
+// name if the certificate has no common name.
+func (ci *ClientInfo) setTLSClientIdentity(state *tls.ConnectionState) {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return
+	}
+	cert := state.PeerCertificates[0]
+	ci.TLSClientName = cert.Subject.CommonName
+	if sans := certSANs(cert); ci.TLSClientName == "" && len(sans) > 0 {
+		ci.TLSClientName = sans[0]
+	}
+	ci.TLSClientFingerprint = certFingerprint(cert)
+}
+
 // TLSClientConfig is a convenience function that builds a tls.Config instance for TLS clients
 // based on common options and certificate+key files.
 func TLSClientConfig(caFile, crtFile, keyFile, serverName string) (*tls.Config, error) {
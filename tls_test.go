@@ -0,0 +1,152 @@
+package rdns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSServerOptions(t *testing.T) {
+	v, err := ParseTLSVersion("1.3")
+	require.NoError(t, err)
+	require.Equal(t, uint16(tls.VersionTLS13), v)
+	_, err = ParseTLSVersion("1.4")
+	require.Error(t, err)
+
+	suites, err := ParseCipherSuites([]string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"})
+	require.NoError(t, err)
+	require.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, suites)
+	_, err = ParseCipherSuites([]string{"TLS_UNKNOWN"})
+	require.Error(t, err)
+
+	curves, err := ParseCurvePreferences([]string{"X25519", "P-256"})
+	require.NoError(t, err)
+	require.Equal(t, []tls.CurveID{tls.X25519, tls.CurveP256}, curves)
+
+	tlsConfig := new(tls.Config)
+	TLSServerOptions{
+		MinVersion:       v,
+		CurvePreferences: curves,
+		NextProtos:       []string{"doq", "doq-i02"},
+	}.Apply(tlsConfig)
+	require.Equal(t, uint16(tls.VersionTLS13), tlsConfig.MinVersion)
+	require.Equal(t, curves, tlsConfig.CurvePreferences)
+	require.Equal(t, []string{"doq", "doq-i02"}, tlsConfig.NextProtos)
+}
+
+func TestTLSCertificatesSNI(t *testing.T) {
+	dir := t.TempDir()
+	files := []CertificateFiles{
+		writeTestCertificate(t, dir, "dns.example.com"),
+		writeTestCertificate(t, dir, "*.dns.example.com"),
+		writeTestCertificate(t, dir, "other.example.net"),
+	}
+	certs, err := NewTLSCertificates("test", files, false)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		cert string
+	}{
+		{name: "dns.example.com", cert: "dns.example.com"},
+		{name: "user123.dns.example.com", cert: "*.dns.example.com"},
+		{name: "USER123.dns.example.com.", cert: "*.dns.example.com"},
+		{name: "other.example.net", cert: "other.example.net"},
+		{name: "a.b.dns.example.com", cert: "dns.example.com"}, // Wildcards cover only one label
+		{name: "", cert: "dns.example.com"},
+	}
+	for _, test := range tests {
+		cert, err := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: test.name})
+		require.NoError(t, err, test.name)
+		require.Equal(t, test.cert, cert.Leaf.Subject.CommonName, test.name)
+	}
+
+	// Unknown names should fail if they're rejected
+	certs, err = NewTLSCertificates("test", files, true)
+	require.NoError(t, err)
+	_, err = certs.GetCertificate(&tls.ClientHelloInfo{ServerName: "unknown.example.com"})
+	require.Error(t, err)
+	_, err = certs.GetCertificate(&tls.ClientHelloInfo{ServerName: "user1.dns.example.com"})
+	require.NoError(t, err)
+}
+
+func TestTLSCertificatesReload(t *testing.T) {
+	dir := t.TempDir()
+	files := writeTestCertificate(t, dir, "dns.example.com")
+	certs, err := NewTLSCertificates("test", []CertificateFiles{files}, false)
+	require.NoError(t, err)
+	first, err := certs.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+
+	// Nothing changed, the same certificate should be used
+	require.NoError(t, certs.Reload())
+	cert, err := certs.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	require.Same(t, first, cert)
+
+	// Replace the certificate but not the key. This should fail and keep the
+	// current certificate.
+	renewed := writeTestCertificate(t, t.TempDir(), "dns.example.com")
+	replaceFile(t, renewed.CertFile, files.CertFile)
+	require.Error(t, certs.Reload())
+	cert, err = certs.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	require.Same(t, first, cert)
+
+	// Once the key is replaced as well, the new certificate is used
+	replaceFile(t, renewed.KeyFile, files.KeyFile)
+	require.NoError(t, certs.Reload())
+	cert, err = certs.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	require.NotSame(t, first, cert)
+	require.NotEqual(t, first.Certificate, cert.Certificate)
+}
+
+// Returns a self-signed certificate valid for a name.
+func testCertificate(t *testing.T, name string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// Writes a self-signed certificate and its key to files in a directory.
+func writeTestCertificate(t *testing.T, dir, name string) CertificateFiles {
+	cert := testCertificate(t, name)
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	require.NoError(t, err)
+	base := filepath.Join(dir, strings.ReplaceAll(name, "*", "wildcard"))
+	files := CertificateFiles{CertFile: base + ".crt", KeyFile: base + ".key"}
+	err = os.WriteFile(files.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	require.NoError(t, err)
+	err = os.WriteFile(files.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600)
+	require.NoError(t, err)
+	return files
+}
+
+// Replaces a file with another and makes sure the modification time changes.
+func replaceFile(t *testing.T, from, to string) {
+	require.NoError(t, os.Rename(from, to))
+	modTime := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(to, modTime, modTime))
+}
@@ -0,0 +1,27 @@
+package rdns
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// Address of a client that sent a query to a transparent UDP listener. Holds
+// the original destination of the query, which responses are sent from.
+type transparentAddr struct {
+	*net.UDPAddr
+	dst net.IP
+}
+
+// Returns the original destination of a query received on a transparent
+// listener. Over UDP, it's recorded with the client address. Intercepted TCP
+// connections are accepted on their original destination address.
+func originalDst(w dns.ResponseWriter) net.IP {
+	if addr, ok := w.RemoteAddr().(*transparentAddr); ok {
+		return addr.dst
+	}
+	if addr, ok := w.LocalAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
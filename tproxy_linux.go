@@ -0,0 +1,116 @@
+package rdns
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Sets IP_TRANSPARENT on a socket so it can accept traffic redirected to it
+// with TPROXY, and send responses from addresses that aren't local. Also
+// enables packet info to learn the original destination of UDP queries.
+func transparentControl(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		// Dual-stack sockets take both, IPv4-only ones fail to set the IPv6 options
+		err4 := unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+		err6 := unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+		if err4 != nil && err6 != nil {
+			serr = err4
+			return
+		}
+		if network == "udp" || network == "udp4" || network == "udp6" {
+			err4 = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_PKTINFO, 1)
+			err6 = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_RECVPKTINFO, 1)
+			if err4 != nil && err6 != nil {
+				serr = err4
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// UDP connection of a transparent listener. Queries are returned with the
+// client address and their original destination, responses are sent from
+// that destination so they look like they came from the server the client
+// meant to query.
+type transparentConn struct {
+	*net.UDPConn
+}
+
+func newTransparentConn(pc net.PacketConn) (net.PacketConn, error) {
+	conn, ok := pc.(*net.UDPConn)
+	if !ok {
+		return nil, errors.New("transparent listeners require a udp socket")
+	}
+	return transparentConn{conn}, nil
+}
+
+func (c transparentConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	oob := make([]byte, 128)
+	n, oobn, _, addr, err := c.ReadMsgUDP(b, oob)
+	if err != nil {
+		return n, nil, err
+	}
+	return n, &transparentAddr{UDPAddr: addr, dst: pktinfoDst(oob[:oobn])}, nil
+}
+
+func (c transparentConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	ta, ok := addr.(*transparentAddr)
+	if !ok {
+		return c.UDPConn.WriteTo(b, addr)
+	}
+	n, _, err := c.WriteMsgUDP(b, pktinfoSrc(ta.dst), ta.UDPAddr)
+	return n, err
+}
+
+// Returns the destination address from the packet info of a received packet.
+func pktinfoDst(oob []byte) net.IP {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == unix.SOL_IP && m.Header.Type == unix.IP_PKTINFO && len(m.Data) >= unix.SizeofInet4Pktinfo:
+			info := (*unix.Inet4Pktinfo)(unsafe.Pointer(&m.Data[0]))
+			return net.IP(info.Addr[:]).To4()
+		case m.Header.Level == unix.SOL_IPV6 && m.Header.Type == unix.IPV6_PKTINFO && len(m.Data) >= unix.SizeofInet6Pktinfo:
+			info := (*unix.Inet6Pktinfo)(unsafe.Pointer(&m.Data[0]))
+			return append(net.IP(nil), info.Addr[:]...)
+		}
+	}
+	return nil
+}
+
+// Returns the control message to send a packet from the given source address.
+func pktinfoSrc(src net.IP) []byte {
+	if src == nil {
+		return nil
+	}
+	if ip4 := src.To4(); ip4 != nil {
+		info := unix.Inet4Pktinfo{}
+		copy(info.Spec_dst[:], ip4)
+		return cmsg(unix.SOL_IP, unix.IP_PKTINFO, unsafe.Slice((*byte)(unsafe.Pointer(&info)), unix.SizeofInet4Pktinfo))
+	}
+	info := unix.Inet6Pktinfo{}
+	copy(info.Addr[:], src.To16())
+	return cmsg(unix.SOL_IPV6, unix.IPV6_PKTINFO, unsafe.Slice((*byte)(unsafe.Pointer(&info)), unix.SizeofInet6Pktinfo))
+}
+
+// Builds a socket control message.
+func cmsg(level, typ int, data []byte) []byte {
+	b := make([]byte, unix.CmsgSpace(len(data)))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = int32(level)
+	h.Type = int32(typ)
+	h.SetLen(unix.CmsgLen(len(data)))
+	copy(b[unix.CmsgLen(0):], data)
+	return b
+}
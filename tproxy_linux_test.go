@@ -0,0 +1,48 @@
+package rdns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSListenerTransparent(t *testing.T) {
+	// Setting IP_TRANSPARENT requires CAP_NET_ADMIN
+	pc, err := (socketOptions{transparent: true}).listenConfig().ListenPacket(context.Background(), "udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("transparent sockets not available: %v", err)
+	}
+	pc.Close()
+
+	var dst net.IP
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			dst = ci.OriginalDst
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+
+	for _, network := range []string{"udp", "tcp"} {
+		dst = nil
+		s := NewDNSListener("test-ln", addr, network, ListenOptions{Transparent: true}, upstream)
+		go s.Start()
+		time.Sleep(100 * time.Millisecond)
+
+		// Without redirect, the original destination is the listen address
+		c := dns.Client{Net: network}
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		_, _, err := c.Exchange(q, addr)
+		require.NoError(t, err, network)
+		require.Equal(t, "127.0.0.1", dst.String(), network)
+		s.Stop()
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package rdns
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+var errTransparentUnsupported = errors.New("transparent listeners are not supported on this platform")
+
+func transparentControl(network, address string, c syscall.RawConn) error {
+	return errTransparentUnsupported
+}
+
+func newTransparentConn(pc net.PacketConn) (net.PacketConn, error) {
+	return nil, errTransparentUnsupported
+}
@@ -1,6 +1,8 @@
 package rdns
 
 import (
+	"fmt"
+
 	"github.com/miekg/dns"
 )
 
@@ -19,20 +21,39 @@ var _ Resolver = &TruncateRetry{}
 type TruncateRetryOptions struct {
 }
 
-// NewTruncateRetry returns a new instance of a truncate-retry router.
-func NewTruncateRetry(id string, resolver, retryResolver Resolver, opt TruncateRetryOptions) *TruncateRetry {
+// TCPResolverProvider is implemented by resolvers for datagram transports that
+// can provide a resolver for the same upstream using TCP.
+type TCPResolverProvider interface {
+	TCPResolver() (Resolver, error)
+}
+
+// NewTruncateRetry returns a new instance of a truncate-retry router. If the
+// retry resolver is nil, truncated responses are retried with the same upstream
+// over TCP, which requires the resolver to be a TCPResolverProvider.
+func NewTruncateRetry(id string, resolver, retryResolver Resolver, opt TruncateRetryOptions) (*TruncateRetry, error) {
+	if retryResolver == nil {
+		p, ok := resolver.(TCPResolverProvider)
+		if !ok {
+			return nil, fmt.Errorf("resolver '%s' doesn't support retrying over TCP, a retry resolver is required", resolver)
+		}
+		var err error
+		retryResolver, err = p.TCPResolver()
+		if err != nil {
+			return nil, err
+		}
+	}
 	return &TruncateRetry{
 		id:                   id,
 		TruncateRetryOptions: opt,
 		retryResolver:        retryResolver,
 		resolver:             resolver,
-	}
+	}, nil
 }
 
 // Resolve a DNS query by first resoling it upstream, if the response is truncated, the
 // retry resolver is used to resolve the same query again.
-func (r *TruncateRetry) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dialer) (*dns.Msg, error) {
-	a, err := r.resolver.Resolve(q, ci, PanelSocksDialer)
+func (r *TruncateRetry) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	a, err := r.resolver.Resolve(q, ci)
 	if err != nil || a == nil {
 		return a, err
 	}
@@ -40,7 +61,7 @@ func (r *TruncateRetry) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Soc
 	// Retry the same query on the other resolver if the first one returned a truncated response.
 	if a.Truncated {
 		logger(r.id, q, ci).WithField("resolver", r.retryResolver).Debug("truncated response, forwarding to retry-resolver")
-		a, err = r.retryResolver.Resolve(q, ci, PanelSocksDialer)
+		a, err = r.retryResolver.Resolve(q, ci)
 	}
 	return a, err
 }
@@ -0,0 +1,45 @@
+package rdns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTruncateRetryTCP(t *testing.T) {
+	// Upstream that truncates all responses over UDP
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		a := new(dns.Msg)
+		a.SetReply(q)
+		a.Truncated = w.LocalAddr().Network() == "udp"
+		_ = w.WriteMsg(a)
+	})
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	udpSrv := &dns.Server{Addr: addr, Net: "udp", Handler: handler}
+	go udpSrv.ListenAndServe()
+	defer udpSrv.Shutdown()
+	tcpSrv := &dns.Server{Addr: addr, Net: "tcp", Handler: handler}
+	go tcpSrv.ListenAndServe()
+	defer tcpSrv.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+
+	upstream, err := NewDNSClient("test-udp", addr, "udp", DNSClientOptions{})
+	require.NoError(t, err)
+
+	// Without retry resolver, the same upstream is queried over TCP
+	r, err := NewTruncateRetry("test-retry", upstream, nil, TruncateRetryOptions{})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+	a, err := r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.False(t, a.Truncated)
+
+	// Resolvers that can't switch to TCP need a retry resolver
+	_, err = NewTruncateRetry("test-retry", new(TestResolver), nil, TruncateRetryOptions{})
+	require.Error(t, err)
+}
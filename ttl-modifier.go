@@ -46,8 +46,8 @@ func NewTTLModifier(id string, resolver Resolver, opt TTLModifierOptions) *TTLMo
 
 // Resolve a DNS query by first resoling it upstream, then applying TTL limits
 // on the response.
-func (r *TTLModifier) Resolve(q *dns.Msg, ci ClientInfo, PanelSocksDialer *Socks5Dialer) (*dns.Msg, error) {
-	a, err := r.resolver.Resolve(q, ci, PanelSocksDialer)
+func (r *TTLModifier) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	a, err := r.resolver.Resolve(q, ci)
 	if err != nil || a == nil {
 		return a, err
 	}
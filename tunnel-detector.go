@@ -0,0 +1,248 @@
+package rdns
+
+import (
+	"expvar"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// TunnelDetector is a resolver that scores queries on common signs of DNS tunneling
+// and generated domain names (DGA). Each signal that is present adds a point to the
+// score. Queries reaching the threshold are logged, blocked or sent to a quarantine
+// resolver. Signals are:
+//
+//   - High character entropy of the subdomain part of the name
+//   - Unusually long labels
+//   - High rate of unique subdomains under the same domain
+//   - Query types commonly used to carry data (TXT, NULL, ...)
+type TunnelDetector struct {
+	id string
+	TunnelDetectorOptions
+	resolver Resolver
+	metrics  *TunnelDetectorMetrics
+
+	mu         sync.Mutex
+	currWinID  int64
+	subdomains map[string]map[string]struct{}
+}
+
+var _ Resolver = &TunnelDetector{}
+
+type TunnelDetectorOptions struct {
+	// Number of signals needed to consider a query suspicious. Default 2.
+	Threshold int
+
+	// Number of labels, counted from the root, that form the domain. Everything
+	// below is considered the subdomain. Default 2.
+	DomainLabels int
+
+	// Shannon entropy (bits per character) of the subdomain above which
+	// the query is scored. Default 3.5.
+	MaxEntropy float64
+
+	// Minimum length of the subdomain before entropy is considered. Short names
+	// don't have meaningful entropy. Default 12.
+	MinEntropyLength int
+
+	// Label length above which the query is scored. Default 40.
+	MaxLabelLength int
+
+	// Number of unique subdomains per domain within Window above which the
+	// query is scored. Default 100.
+	MaxUniqueSubdomains int
+
+	// Time window for counting unique subdomains. Default 1 minute.
+	Window time.Duration
+
+	// Query types that are scored. Default TXT, NULL, ANY, CNAME and MX.
+	SuspiciousTypes []uint16
+
+	// What to do with suspicious queries. Default TunnelActionLog.
+	Action TunnelAction
+
+	// Resolver for suspicious queries when the action is TunnelActionRoute.
+	QuarantineResolver Resolver
+}
+
+// TunnelAction defines what is done with queries that are considered suspicious.
+type TunnelAction string
+
+const (
+	TunnelActionLog   TunnelAction = "log"   // Log the query and pass it on
+	TunnelActionBlock TunnelAction = "block" // Respond with REFUSED
+	TunnelActionRoute TunnelAction = "route" // Send the query to the quarantine resolver
+)
+
+type TunnelDetectorMetrics struct {
+	// Count of queries.
+	query *expvar.Int
+	// Count of suspicious queries.
+	suspicious *expvar.Int
+	// Count of signals by name.
+	signal *expvar.Map
+}
+
+// NewTunnelDetector returns a new instance of a tunnel detection resolver.
+func NewTunnelDetector(id string, resolver Resolver, opt TunnelDetectorOptions) *TunnelDetector {
+	if opt.Threshold == 0 {
+		opt.Threshold = 2
+	}
+	if opt.DomainLabels == 0 {
+		opt.DomainLabels = 2
+	}
+	if opt.MaxEntropy == 0 {
+		opt.MaxEntropy = 3.5
+	}
+	if opt.MinEntropyLength == 0 {
+		opt.MinEntropyLength = 12
+	}
+	if opt.MaxLabelLength == 0 {
+		opt.MaxLabelLength = 40
+	}
+	if opt.MaxUniqueSubdomains == 0 {
+		opt.MaxUniqueSubdomains = 100
+	}
+	if opt.Window == 0 {
+		opt.Window = time.Minute
+	}
+	if opt.SuspiciousTypes == nil {
+		opt.SuspiciousTypes = []uint16{dns.TypeTXT, dns.TypeNULL, dns.TypeANY, dns.TypeCNAME, dns.TypeMX}
+	}
+	if opt.Action == "" {
+		opt.Action = TunnelActionLog
+	}
+	return &TunnelDetector{
+		id:                    id,
+		TunnelDetectorOptions: opt,
+		resolver:              resolver,
+		subdomains:            make(map[string]map[string]struct{}),
+		metrics: &TunnelDetectorMetrics{
+			query:      getVarInt("tunnel-detector", id, "query"),
+			suspicious: getVarInt("tunnel-detector", id, "suspicious"),
+			signal:     getVarMap("tunnel-detector", id, "signal"),
+		},
+	}
+}
+
+// Resolve a DNS query after scoring it for signs of tunneling.
+func (r *TunnelDetector) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	r.metrics.query.Add(1)
+	signals := r.score(q)
+	if len(signals) < r.Threshold {
+		return r.resolver.Resolve(q, ci)
+	}
+	r.metrics.suspicious.Add(1)
+	log := logger(r.id, q, ci).WithFields(logrus.Fields{"signals": strings.Join(signals, ",")})
+	switch r.Action {
+	case TunnelActionBlock:
+		log.Info("suspicious query, blocking")
+		return refused(q), nil
+	case TunnelActionRoute:
+		if r.QuarantineResolver != nil {
+			log.WithField("resolver", r.QuarantineResolver).Info("suspicious query, forwarding to quarantine-resolver")
+			return r.QuarantineResolver.Resolve(q, ci)
+		}
+	}
+	log.Info("suspicious query")
+	return r.resolver.Resolve(q, ci)
+}
+
+func (r *TunnelDetector) String() string {
+	return r.id
+}
+
+// Check Cert
+func (r *TunnelDetector) CertMonitor() error {
+	return nil
+}
+
+// Returns the list of signals present in the query.
+func (r *TunnelDetector) score(q *dns.Msg) []string {
+	var signals []string
+	question := q.Question[0]
+	name := strings.ToLower(strings.TrimSuffix(question.Name, "."))
+	labels := dns.SplitDomainName(name)
+
+	for _, t := range r.SuspiciousTypes {
+		if question.Qtype == t {
+			signals = append(signals, "qtype")
+			break
+		}
+	}
+	for _, l := range labels {
+		if len(l) > r.MaxLabelLength {
+			signals = append(signals, "label-length")
+			break
+		}
+	}
+
+	// Split the name into domain and subdomain
+	if len(labels) <= r.DomainLabels {
+		r.countSignals(signals)
+		return signals
+	}
+	sub := strings.Join(labels[:len(labels)-r.DomainLabels], "")
+	domain := strings.Join(labels[len(labels)-r.DomainLabels:], ".")
+
+	if len(sub) >= r.MinEntropyLength && entropy(sub) > r.MaxEntropy {
+		signals = append(signals, "entropy")
+	}
+	if r.countSubdomain(domain, sub) > r.MaxUniqueSubdomains {
+		signals = append(signals, "unique-subdomains")
+	}
+	r.countSignals(signals)
+	return signals
+}
+
+func (r *TunnelDetector) countSignals(signals []string) {
+	for _, s := range signals {
+		r.metrics.signal.Add(s, 1)
+	}
+}
+
+// Records a subdomain and returns the number of unique subdomains seen
+// for the domain in the current window.
+func (r *TunnelDetector) countSubdomain(domain, sub string) int {
+	windowID := time.Now().UnixNano() / int64(r.Window)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// If we have moved on to the next window, start counting again
+	if windowID != r.currWinID {
+		r.currWinID = windowID
+		r.subdomains = make(map[string]map[string]struct{})
+	}
+	subs, ok := r.subdomains[domain]
+	if !ok {
+		subs = make(map[string]struct{})
+		r.subdomains[domain] = subs
+	}
+	// No need to keep track of more than is needed to exceed the limit
+	if len(subs) <= r.MaxUniqueSubdomains {
+		subs[sub] = struct{}{}
+	}
+	return len(subs)
+}
+
+// Shannon entropy in bits per character.
+func entropy(s string) float64 {
+	var freq [256]int
+	for i := 0; i < len(s); i++ {
+		freq[s[i]]++
+	}
+	var e float64
+	n := float64(len(s))
+	for _, c := range freq {
+		if c == 0 {
+			continue
+		}
+		p := float64(c) / n
+		e -= p * math.Log2(p)
+	}
+	return e
+}
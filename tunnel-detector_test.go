@@ -0,0 +1,54 @@
+package rdns
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTunnelDetector(t *testing.T) {
+	var ci ClientInfo
+	r := &TestResolver{}
+	opt := TunnelDetectorOptions{
+		Action:              TunnelActionBlock,
+		MaxUniqueSubdomains: 5,
+	}
+	d := NewTunnelDetector("test-tunnel", r, opt)
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		blocked bool
+	}{
+		{"www.example.com.", dns.TypeA, false},
+		{"www.example.com.", dns.TypeTXT, false},
+		{"mail.example.com.", dns.TypeMX, false},
+		{"a9x7kq2mz4pl8wv3nb6t.example.com.", dns.TypeA, false},
+		{"a9x7kq2mz4pl8wv3nb6t.example.com.", dns.TypeTXT, true},
+		{"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa.example.com.", dns.TypeNULL, true},
+	}
+	for _, test := range tests {
+		q := new(dns.Msg)
+		q.SetQuestion(test.name, test.qtype)
+		a, err := d.Resolve(q, ci)
+		require.NoError(t, err)
+		require.Equal(t, test.blocked, a.Rcode == dns.RcodeRefused, test.name)
+	}
+
+	// Many unique subdomains with high entropy
+	for i := 0; i < 10; i++ {
+		q := new(dns.Msg)
+		q.SetQuestion(fmt.Sprintf("q%d7kx2mz4pl8wv3nb6t.tunnel.com.", i), dns.TypeA)
+		a, err := d.Resolve(q, ci)
+		require.NoError(t, err)
+		require.Equal(t, i >= 5, a.Rcode == dns.RcodeRefused)
+	}
+}
+
+func TestEntropy(t *testing.T) {
+	require.Equal(t, float64(0), entropy("aaaa"))
+	require.Equal(t, float64(1), entropy("abab"))
+	require.Equal(t, float64(2), entropy("abcd"))
+}
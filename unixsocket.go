@@ -0,0 +1,73 @@
+package rdns
+
+import (
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// Opens a unix domain socket listener, "unix" for streams or "unixgram" for
+// datagrams, and applies the file permissions. A stale socket file left behind
+// by a previous process is removed first. Unix sockets are not passed on
+// during a handoff, the new process binds the path again.
+func listenUnix(network, path string, opt socketOptions) (net.Listener, net.PacketConn, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&fs.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, nil, err
+		}
+	}
+	var (
+		ln  net.Listener
+		pc  net.PacketConn
+		err error
+	)
+	switch network {
+	case "unix":
+		ln, err = net.Listen(network, path)
+	case "unixgram":
+		pc, err = net.ListenPacket(network, path)
+	default:
+		return nil, nil, fmt.Errorf("unsupported unix socket type '%s'", network)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := setSocketPermissions(path, opt.socketMode, opt.socketGroup); err != nil {
+		if ln != nil {
+			ln.Close()
+		}
+		if pc != nil {
+			pc.Close()
+		}
+		return nil, nil, err
+	}
+	return ln, pc, nil
+}
+
+// Sets the mode and group of a socket file. A mode of 0 and an empty group
+// leave the defaults of the process in place. The group is a name or a numeric
+// ID.
+func setSocketPermissions(path string, mode os.FileMode, group string) error {
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+	if group == "" {
+		return nil
+	}
+	gid, err := strconv.Atoi(group)
+	if err != nil {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return err
+		}
+	}
+	return os.Chown(path, -1, gid)
+}
@@ -0,0 +1,55 @@
+package rdns
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSListenerUnix(t *testing.T) {
+	upstream := new(TestResolver)
+	path := filepath.Join(t.TempDir(), "dns.sock")
+
+	s := NewDNSListener("test-unix", path, "unix", ListenOptions{SocketMode: 0600}, upstream)
+	go s.Start()
+	defer s.Stop()
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	// Send a query with the same framing as over TCP
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	defer conn.Close()
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	b, err := q.Pack()
+	require.NoError(t, err)
+	_, err = conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(b))))
+	require.NoError(t, err)
+	_, err = conn.Write(b)
+	require.NoError(t, err)
+
+	l := make([]byte, 2)
+	_, err = io.ReadFull(conn, l)
+	require.NoError(t, err)
+	b = make([]byte, binary.BigEndian.Uint16(l))
+	_, err = io.ReadFull(conn, b)
+	require.NoError(t, err)
+	a := new(dns.Msg)
+	require.NoError(t, a.Unpack(b))
+	require.Equal(t, q.Id, a.Id)
+	require.Equal(t, 1, upstream.HitCount())
+}
@@ -3,6 +3,7 @@ package rdns
 import (
 	"expvar"
 	"fmt"
+	"sync"
 )
 
 // Get an *expvar.Int with the given path.
@@ -22,3 +23,40 @@ func getVarMap(base string, id string, name string) *expvar.Map {
 	}
 	return expvar.NewMap(fullname)
 }
+
+// Maximum number of keys in a map of counters by client or user. Further keys
+// are counted under "other".
+const varMapMaxKeys = 1000
+
+// A map of counters by client or user, which would otherwise grow with every
+// client seen.
+type cappedVarMap struct {
+	m *expvar.Map
+
+	mu   sync.Mutex
+	keys map[string]struct{}
+}
+
+// Get a map of counters with the given path that holds at most varMapMaxKeys
+// keys.
+func getCappedVarMap(base string, id string, name string) *cappedVarMap {
+	c := &cappedVarMap{
+		m:    getVarMap(base, id, name),
+		keys: make(map[string]struct{}),
+	}
+	c.m.Do(func(kv expvar.KeyValue) { c.keys[kv.Key] = struct{}{} })
+	return c
+}
+
+// Add adds delta to the counter of a key, or to "other" once the map is full.
+func (c *cappedVarMap) Add(key string, delta int64) {
+	c.mu.Lock()
+	if _, ok := c.keys[key]; !ok {
+		if len(c.keys) >= varMapMaxKeys {
+			key = "other"
+		}
+		c.keys[key] = struct{}{}
+	}
+	c.mu.Unlock()
+	c.m.Add(key, delta)
+}